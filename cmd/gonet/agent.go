@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"time"
+
+	"gonet/pkg/agent"
+	"gonet/pkg/apiauth"
+	"gonet/pkg/controller"
+	"gonet/pkg/ifaceutil"
+	"gonet/pkg/logging"
+	"gonet/pkg/results"
+)
+
+// agentMain runs gonet agent, serving jobs to controllers.
+func agentMain(args []string) {
+	flags := flag.NewFlagSet("agent", flag.ExitOnError)
+	listen := flags.String("listen", ":7070", "Address for the job API, loopback unless a host is given, which needs -token")
+	interfaceName := flags.String("interface", "", "Interface for jobs that don't name one, by name, IP address or subnet")
+	dir := flags.String("dir", "captures", "Directory with the captures replay jobs may use")
+	keep := flags.Duration("keep", 10*time.Minute, "How long finished jobs stay listed with their results")
+	auth := apiauth.RegisterFlags(flags)
+	logs := logging.RegisterFlags(flags)
+	flags.Parse(args)
+	if err := logs.Setup(); err != nil {
+		log.Fatal(err)
+	}
+
+	a := &agent.Agent{Dir: *dir, Keep: *keep}
+	if *interfaceName != "" {
+		device, err := ifaceutil.Resolve(*interfaceName)
+		if err != nil {
+			log.Fatal(err)
+		}
+		a.Interface = device
+	}
+	token := auth.Resolve()
+	ln, err := apiauth.Listen(*listen, token)
+	if err != nil {
+		log.Fatal(err)
+	}
+	slog.Info("Serving jobs", "addr", ln.Addr(), "token", token != "")
+	log.Fatal(http.Serve(ln, apiauth.Require(token, a.Handler())))
+}
+
+// controllerMain runs gonet controller, driving agents through a
+// scenario.
+func controllerMain(args []string) {
+	flags := flag.NewFlagSet("controller", flag.ExitOnError)
+	jsonOut := flags.String("json", "", "Also write the results as JSON to this file, - for stdout")
+	auth := apiauth.RegisterFlags(flags)
+	logs := logging.RegisterFlags(flags)
+	flags.Parse(args)
+	if err := logs.Setup(); err != nil {
+		log.Fatal(err)
+	}
+	if flags.NArg() != 1 {
+		log.Fatal("Usage: gonet controller [-json file] <scenario.yaml>")
+	}
+
+	sc, err := controller.Load(flags.Arg(0))
+	if err != nil {
+		log.Fatalf("Invalid scenario: %v", err)
+	}
+	sc.Token = auth.Resolve()
+
+	// Stop on interrupt
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	res, err := controller.Run(ctx, sc)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *jsonOut != "-" {
+		res.Write(os.Stdout)
+	}
+
+	if *jsonOut != "" {
+		if err := results.Write(*jsonOut, res); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
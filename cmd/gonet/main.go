@@ -0,0 +1,123 @@
+// Command gonet bundles the network test tools in one binary.
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	dhcpsim "gonet/dhcp_sim"
+	dnsload "gonet/dns_load"
+	gopackets "gonet/go_packets"
+	httpload "gonet/http_load"
+	leprox "gonet/le_prox"
+	neighscan "gonet/neigh_scan"
+	netprobe "gonet/net_probe"
+	"gonet/pkg/ifaceutil"
+	stunnat "gonet/stun_nat"
+	tcpclient "gonet/tcp_client"
+	tcpserver "gonet/tcp_server"
+	tlsload "gonet/tls_load"
+	udpclient "gonet/udp_client"
+	udpserver "gonet/udp_server"
+)
+
+const usage = `Usage: gonet <command> [flags] [args]
+
+Commands:
+  udp send     generate UDP traffic on an interface (udp_client)
+  udp recv     count and report UDP traffic on an interface (udp_server)
+  tcp client   measure TCP throughput against a tcp server (tcp_client)
+  tcp server   answer tcp client tests (tcp_server)
+  httpload     generate HTTP load against URLs (http_load)
+  dnsload      send DNS queries to a resolver and check the answers (dns_load)
+  tlsload      open TLS connections and measure the handshakes (tls_load)
+  probe ping   ICMP, UDP or TCP ping with loss over time (net_probe)
+  probe trace  traceroute with per-hop loss and latency (net_probe)
+  probe pmtu   find the path MTU and where it drops (net_probe)
+  dhcpsim      run DHCP clients with random MACs against the servers on a link (dhcp_sim)
+  neigh scan   sweep a network with ARP or neighbor solicitations (neigh_scan)
+  neigh stress fill switch and router neighbor tables with fake hosts (neigh_scan)
+  stun detect  find the public address and NAT behavior with STUN servers (stun_nat)
+  stun punch   test UDP hole punching with a peer (stun_nat)
+  proxy        HTTP/HTTPS and SOCKS5 proxy (le_prox)
+  replay       replay pcap files on an interface (go_packets), also
+               replay analyze, replay merge and replay split
+  report       render -results files as HTML or Markdown
+  runs         list, show and diff the runs kept with -store
+  interfaces   list the interfaces the tools can use
+  agent        run send, recv and replay jobs for a controller
+  controller   run a scenario of jobs on several agents
+
+Run gonet <command> -h for the flags of a command.
+`
+
+func main() {
+	args := os.Args[1:]
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	switch args[0] {
+	case "udp":
+		if len(args) < 2 {
+			log.Fatal("Usage: gonet udp send|recv [flags]")
+		}
+		switch args[1] {
+		case "send":
+			udpclient.Main(args[2:])
+		case "recv":
+			udpserver.Main(args[2:])
+		default:
+			log.Fatalf("Unknown udp command %q, want send or recv", args[1])
+		}
+	case "tcp":
+		if len(args) < 2 {
+			log.Fatal("Usage: gonet tcp client|server [flags]")
+		}
+		switch args[1] {
+		case "client":
+			tcpclient.Main(args[2:])
+		case "server":
+			tcpserver.Main(args[2:])
+		default:
+			log.Fatalf("Unknown tcp command %q, want client or server", args[1])
+		}
+	case "httpload":
+		httpload.Main(args[1:])
+	case "dnsload":
+		dnsload.Main(args[1:])
+	case "tlsload":
+		tlsload.Main(args[1:])
+	case "probe":
+		netprobe.Main(args[1:])
+	case "dhcpsim":
+		dhcpsim.Main(args[1:])
+	case "neigh":
+		neighscan.Main(args[1:])
+	case "stun":
+		stunnat.Main(args[1:])
+	case "proxy":
+		leprox.Main(args[1:])
+	case "replay":
+		gopackets.Main(args[1:])
+	case "agent":
+		agentMain(args[1:])
+	case "controller":
+		controllerMain(args[1:])
+	case "runs":
+		runsMain(args[1:])
+	case "report":
+		reportMain(args[1:])
+	case "interfaces":
+		if err := ifaceutil.ListDevices(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+	case "help", "-h", "-help", "--help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n%s", args[0], usage)
+		os.Exit(2)
+	}
+}
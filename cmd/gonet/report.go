@@ -0,0 +1,63 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"strings"
+
+	"gonet/pkg/logging"
+	"gonet/pkg/results"
+)
+
+// reportMain runs gonet report, rendering -results files.
+func reportMain(args []string) {
+	flags := flag.NewFlagSet("report", flag.ExitOnError)
+	format := flags.String("format", "", "Report format, html or markdown (default by the -out extension, else markdown)")
+	out := flags.String("out", "", "File to write the report to, default stdout")
+	logs := logging.RegisterFlags(flags)
+	flags.Parse(args)
+	if err := logs.Setup(); err != nil {
+		log.Fatal(err)
+	}
+	if flags.NArg() < 1 {
+		log.Fatal("Usage: gonet report [-format html|markdown] [-out file] <results.json>...")
+	}
+	if *format == "" {
+		*format = "markdown"
+		if strings.HasSuffix(*out, ".html") || strings.HasSuffix(*out, ".htm") {
+			*format = "html"
+		}
+	}
+	render := results.Markdown
+	switch *format {
+	case "markdown", "md":
+	case "html":
+		render = results.HTML
+	default:
+		log.Fatalf("Invalid -format %q, want html or markdown", *format)
+	}
+
+	var runs []*results.Run
+	for _, path := range flags.Args() {
+		run, err := results.Read(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		runs = append(runs, run)
+	}
+
+	w := os.Stdout
+	if *out != "" {
+		var err error
+		if w, err = os.Create(*out); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := render(w, runs...); err != nil {
+		log.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		log.Fatal(err)
+	}
+}
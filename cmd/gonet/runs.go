@@ -0,0 +1,161 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"gonet/pkg/logging"
+	"gonet/pkg/results"
+)
+
+const runsUsage = "Usage: gonet runs list|show|diff [flags] [run IDs]"
+
+// headline are the metrics gonet runs list shows, those a run has.
+var headline = []string{"mbps", "capacity_mbps", "rps", "pps", "loss_percent", "error_percent", "latency_avg_ms", "latency_p99_ms", "jitter_ms"}
+
+// runsMain runs gonet runs, looking into the -store run registry.
+func runsMain(args []string) {
+	if len(args) < 1 {
+		log.Fatal(runsUsage)
+	}
+	flags := flag.NewFlagSet("runs "+args[0], flag.ExitOnError)
+	dir := flags.String("store", os.Getenv(results.StoreEnv), "Run registry directory the tools keep runs in with -store (default $"+results.StoreEnv+")")
+	logs := logging.RegisterFlags(flags)
+	var run func(*results.Store)
+	switch args[0] {
+	case "list":
+		tool := flags.String("tool", "", "Only runs of this tool, like \"tcp client\"")
+		target := flags.String("target", "", "Only runs against this server, destination, URL or interface")
+		last := flags.Int("n", 20, "Show the last this many runs, 0 for all")
+		run = func(s *results.Store) {
+			runs, err := s.List(*tool, *target)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if *last > 0 && len(runs) > *last {
+				runs = runs[len(runs)-*last:]
+			}
+			listRuns(runs)
+		}
+	case "show":
+		asJSON := flags.Bool("json", false, "Print the results file instead of the Markdown report")
+		run = func(s *results.Store) {
+			if flags.NArg() != 1 {
+				log.Fatal("Usage: gonet runs show [-json] <run ID>")
+			}
+			r, err := s.Get(flags.Arg(0))
+			if err != nil {
+				log.Fatal(err)
+			}
+			if *asJSON {
+				err = results.Write("-", r)
+			} else {
+				err = results.Markdown(os.Stdout, r)
+			}
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+	case "diff":
+		threshold := flags.Float64("threshold", 5, "Percent a metric may get worse by before it counts as a regression")
+		run = func(s *results.Store) {
+			if n := flags.NArg(); n < 1 || n > 2 {
+				log.Fatal("Usage: gonet runs diff [-threshold percent] [old run ID] <new run ID>")
+			}
+			newRun, err := s.Get(flags.Arg(flags.NArg() - 1))
+			if err != nil {
+				log.Fatal(err)
+			}
+			var old *results.Run
+			if flags.NArg() == 2 {
+				old, err = s.Get(flags.Arg(0))
+			} else {
+				old, err = s.Previous(newRun)
+			}
+			if err != nil {
+				log.Fatal(err)
+			}
+			if old.Tool != newRun.Tool || old.Target() != newRun.Target() {
+				slog.Warn("Comparing runs of different tools or targets", "old", old.Tool+" "+old.Target(), "new", newRun.Tool+" "+newRun.Target())
+			}
+			if diffRuns(old, newRun, *threshold) > 0 {
+				os.Exit(1)
+			}
+		}
+	default:
+		log.Fatal(runsUsage)
+	}
+	flags.Parse(args[1:])
+	if err := logs.Setup(); err != nil {
+		log.Fatal(err)
+	}
+	s, err := results.OpenStore(*dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	run(s)
+}
+
+// listRuns prints a line per run with its headline metrics.
+func listRuns(runs []*results.Run) {
+	fmt.Printf("%-16s  %-19s  %-12s  %-24s  %-6s  %s\n", "ID", "START", "TOOL", "TARGET", "STATUS", "METRICS")
+	for _, r := range runs {
+		var metrics []string
+		for _, name := range headline {
+			if v, ok := r.Summary[name]; ok {
+				metrics = append(metrics, fmt.Sprintf("%s=%.2f", name, v))
+			}
+		}
+		status := "passed"
+		if !r.Passed {
+			status = "failed"
+		}
+		fmt.Printf("%-16s  %-19s  %-12s  %-24s  %-6s  %s\n", r.ID, r.Start.Local().Format("2006-01-02 15:04:05"), r.Tool, r.Target(), status, strings.Join(metrics, " "))
+	}
+}
+
+// diffRuns prints how the metrics moved from old to new and returns how
+// many got worse by more than threshold percent.
+func diffRuns(old, new *results.Run, threshold float64) int {
+	fmt.Printf("%s %s (%s) -> %s (%s)\n\n", new.Tool, new.Target(), old.ID, new.ID, new.Start.Local().Format("2006-01-02 15:04:05"))
+	fmt.Printf("%-24s  %14s  %14s  %9s\n", "METRIC", "OLD", "NEW", "CHANGE")
+	worse := 0
+	for _, c := range results.Diff(old, new, threshold) {
+		mark := ""
+		if c.Worse {
+			mark = "  worse"
+			worse++
+		}
+		fmt.Printf("%-24s  %14s  %14s  %9s%s\n", c.Metric, diffValue(c.Old), diffValue(c.New), diffPercent(c.Percent), mark)
+	}
+	if worse > 0 {
+		fmt.Printf("\n%d metrics got worse by more than %g%%\n", worse, threshold)
+	}
+	return worse
+}
+
+func diffValue(v *float64) string {
+	if v == nil {
+		return "-"
+	}
+	if *v == math.Trunc(*v) {
+		return strconv.FormatFloat(*v, 'f', 0, 64)
+	}
+	return strconv.FormatFloat(*v, 'f', 3, 64)
+}
+
+func diffPercent(p float64) string {
+	switch {
+	case math.IsNaN(p):
+		return "-"
+	case math.IsInf(p, 0):
+		return "new"
+	}
+	return fmt.Sprintf("%+.1f%%", p)
+}
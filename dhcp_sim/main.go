@@ -0,0 +1,105 @@
+package dhcpsim
+
+import (
+	"context"
+	"encoding/hex"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"gonet/pkg/config"
+	"gonet/pkg/ifaceutil"
+	"gonet/pkg/logging"
+	"gonet/pkg/results"
+	"gonet/pkg/stats"
+)
+
+// Main runs gonet dhcpsim with the arguments after the command name.
+func Main(args []string) {
+	// Command line flags
+	flags := flag.NewFlagSet("dhcpsim", flag.ExitOnError)
+	interfaceName := flags.String("interface", "eth0", "Network interface to use, by name, IP address or subnet")
+	macPrefix := flags.String("mac-prefix", "02:00:00", "Start of the clients' MAC addresses, the rest is random")
+	clients := flags.Uint64("n", 0, "Clients to run (default 100 unless -duration is given)")
+	duration := flags.Duration("duration", 0, "How long to start clients")
+	concurrency := flags.Int("c", 10, "Exchanges in flight at most")
+	rate := flags.Float64("rate", 0, "Clients started per second at most (0 for no limit)")
+	timeout := flags.Duration("timeout", 2*time.Second, "How long to wait for each offer or ack")
+	retries := flags.Int("retries", 2, "Times to send a discover or request again when nothing comes")
+	broadcast := flags.Bool("broadcast", false, "Ask the servers to broadcast their answers")
+	hostname := flags.Bool("hostname", false, "Send a host name, gonet-<mac>, for servers that register them in DNS")
+	release := flags.Bool("release", false, "Release each lease once acknowledged, so the pool doesn't run out")
+	histogram := flags.Bool("histogram", false, "Print the latency histograms")
+	report := stats.RegisterFlags(flags)
+	jsonOut := flags.String("json", "", "Write the result as JSON to this file when done, - for stdout")
+	logs := logging.RegisterFlags(flags)
+	configFile := flags.String("config", "", "YAML or JSON file setting flags by name, command line flags win")
+	flags.Parse(args)
+
+	if _, err := config.LoadFlags(flags, *configFile); err != nil {
+		log.Fatalf("Invalid -config: %v", err)
+	}
+	if err := logs.Setup(); err != nil {
+		log.Fatal(err)
+	}
+	if *interfaceName == "" {
+		if err := ifaceutil.ListDevices(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		log.Fatal("Please specify an interface name with -interface")
+	}
+	device, err := ifaceutil.Resolve(*interfaceName)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	cfg := Config{
+		Interface:   device,
+		Concurrency: *concurrency,
+		Rate:        *rate,
+		Clients:     *clients,
+		Duration:    *duration,
+		Timeout:     *timeout,
+		Retries:     *retries,
+		Broadcast:   *broadcast,
+		Hostname:    *hostname,
+		Release:     *release,
+	}
+	prefix, err := hex.DecodeString(strings.ReplaceAll(*macPrefix, ":", ""))
+	if err != nil || len(prefix) == 0 || len(prefix) > 5 {
+		log.Fatalf("Invalid -mac-prefix %q, want 1 to 5 bytes like 02:00:00", *macPrefix)
+	}
+	cfg.MACPrefix = prefix
+	if cfg.Clients == 0 && cfg.Duration == 0 {
+		cfg.Clients = 100
+	}
+
+	// Stop on interrupt
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	var s Sim
+	report.Unit = "Leases"
+	reporter, err := report.Reporter(s.Counters(), "Lease", "acquired", "dhcpsim")
+	if err != nil {
+		log.Fatal(err)
+	}
+	reporter.Start()
+	res, err := s.Run(ctx, cfg)
+	reporter.Stop()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *jsonOut != "-" {
+		res.Write(os.Stdout, *histogram)
+	}
+
+	if *jsonOut != "" {
+		if err := results.Write(*jsonOut, res); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package dhcpsim
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// minLen is the BOOTP message size some servers and relays insist on.
+const minLen = 300
+
+// message is a DHCP message to a client, as far as the simulator cares.
+type message struct {
+	typ       layers.DHCPMsgType
+	xid       uint32
+	yiaddr    net.IP
+	serverID  net.IP
+	serverMAC net.HardwareAddr
+	leaseTime time.Duration
+	at        time.Time
+}
+
+// client is one simulated client.
+type client struct {
+	mac       net.HardwareAddr
+	xid       uint32
+	broadcast bool
+	hostname  string
+}
+
+// build serializes a client message of typ. Discovers and requests are
+// broadcast from 0.0.0.0, releases go to the server that gave the lease.
+func (c *client) build(typ layers.DHCPMsgType, secs uint16, offer *message) ([]byte, error) {
+	dhcp := &layers.DHCPv4{
+		Operation:    layers.DHCPOpRequest,
+		HardwareType: layers.LinkTypeEthernet,
+		HardwareLen:  6,
+		Xid:          c.xid,
+		Secs:         secs,
+		ClientHWAddr: c.mac,
+		ClientIP:     net.IPv4zero,
+		YourClientIP: net.IPv4zero,
+		NextServerIP: net.IPv4zero,
+		RelayAgentIP: net.IPv4zero,
+	}
+	if c.broadcast && typ != layers.DHCPMsgTypeRelease {
+		dhcp.Flags = 0x8000
+	}
+	opt := func(t layers.DHCPOpt, data []byte) {
+		dhcp.Options = append(dhcp.Options, layers.NewDHCPOption(t, data))
+	}
+	opt(layers.DHCPOptMessageType, []byte{byte(typ)})
+	opt(layers.DHCPOptClientID, append([]byte{byte(layers.LinkTypeEthernet)}, c.mac...))
+	switch typ {
+	case layers.DHCPMsgTypeRequest:
+		opt(layers.DHCPOptRequestIP, offer.yiaddr.To4())
+		opt(layers.DHCPOptServerID, offer.serverID.To4())
+	case layers.DHCPMsgTypeRelease:
+		dhcp.ClientIP = offer.yiaddr
+		opt(layers.DHCPOptServerID, offer.serverID.To4())
+	}
+	if typ != layers.DHCPMsgTypeRelease {
+		if c.hostname != "" {
+			opt(layers.DHCPOptHostname, []byte(c.hostname))
+		}
+		opt(layers.DHCPOptParamsRequest, []byte{
+			byte(layers.DHCPOptSubnetMask), byte(layers.DHCPOptRouter),
+			byte(layers.DHCPOptDNS), byte(layers.DHCPOptLeaseTime),
+		})
+	}
+	for int(dhcp.Len()) < minLen {
+		opt(layers.DHCPOptPad, nil)
+	}
+
+	eth := &layers.Ethernet{SrcMAC: c.mac, DstMAC: layers.EthernetBroadcast, EthernetType: layers.EthernetTypeIPv4}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.IPv4zero, DstIP: net.IPv4bcast}
+	if typ == layers.DHCPMsgTypeRelease {
+		eth.DstMAC, ip.SrcIP, ip.DstIP = offer.serverMAC, offer.yiaddr, offer.serverID
+	}
+	udp := &layers.UDP{SrcPort: 68, DstPort: 67}
+	udp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, eth, ip, udp, dhcp)
+	return buf.Bytes(), err
+}
+
+// parse reads a DHCP reply from a captured frame.
+func parse(data []byte, at time.Time) (*message, bool) {
+	packet := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+	dhcp, ok := packet.Layer(layers.LayerTypeDHCPv4).(*layers.DHCPv4)
+	eth, _ := packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	if !ok || eth == nil || dhcp.Operation != layers.DHCPOpReply {
+		return nil, false
+	}
+	m := &message{
+		xid:       dhcp.Xid,
+		yiaddr:    append(net.IP(nil), dhcp.YourClientIP.To4()...),
+		serverMAC: append(net.HardwareAddr(nil), eth.SrcMAC...),
+		at:        at,
+	}
+	for _, o := range dhcp.Options {
+		switch o.Type {
+		case layers.DHCPOptMessageType:
+			if len(o.Data) == 1 {
+				m.typ = layers.DHCPMsgType(o.Data[0])
+			}
+		case layers.DHCPOptServerID:
+			if len(o.Data) == 4 {
+				m.serverID = append(net.IP(nil), o.Data...)
+			}
+		case layers.DHCPOptLeaseTime:
+			if len(o.Data) == 4 {
+				m.leaseTime = time.Duration(binary.BigEndian.Uint32(o.Data)) * time.Second
+			}
+		}
+	}
+	if m.serverID == nil {
+		// Old servers leave the option out, the sender will have to do.
+		if ip, ok := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4); ok {
+			m.serverID = append(net.IP(nil), ip.SrcIP.To4()...)
+		}
+	}
+	return m, m.typ != 0
+}
@@ -0,0 +1,366 @@
+package dhcpsim
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+
+	"gonet/pkg/stats"
+)
+
+// Config is a simulation for Sim.Run.
+type Config struct {
+	Interface string // pcap device
+
+	// MACPrefix is the start of the clients' MAC addresses, the rest is
+	// random. The default is 02:00:00, locally administered.
+	MACPrefix net.HardwareAddr
+
+	Concurrency int     // exchanges in flight at most, default 10
+	Rate        float64 // clients started per second at most, 0 for no limit
+
+	// The simulation ends after Clients or Duration, whichever comes
+	// first; with neither it runs until ctx is done.
+	Clients  uint64
+	Duration time.Duration
+
+	Timeout time.Duration // of each try, default 2s
+	Retries int           // of the discover and the request
+
+	Broadcast bool // ask the servers to broadcast their answers
+	Hostname  bool // send a host name, gonet-<mac>
+	Release   bool // give each lease back once acknowledged
+}
+
+// Result is a finished simulation. Latencies are from the first
+// discover; Lease is the whole discover to ack exchange.
+type Result struct {
+	Clients    uint64            `json:"clients"`
+	Leases     uint64            `json:"leases"`
+	NoOffer    uint64            `json:"no_offer"`
+	NoAck      uint64            `json:"no_ack"`
+	Naks       uint64            `json:"naks"`
+	Errors     uint64            `json:"errors"`
+	Released   uint64            `json:"released"`
+	Servers    map[string]uint64 `json:"servers"` // leases by server identifier
+	LeaseTimes map[string]uint64 `json:"lease_times"`
+	Elapsed    time.Duration     `json:"elapsed_ns"`
+	Rate       float64           `json:"rate"` // leases per second
+
+	Offer stats.Latency `json:"offer"`
+	Ack   stats.Latency `json:"ack"` // from the request
+	Lease stats.Latency `json:"lease"`
+}
+
+// link sends and captures frames, a pcap handle but for tests.
+type link interface {
+	WritePacketData([]byte) error
+	ReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+}
+
+// Sim runs DHCP clients. The zero value is ready to use.
+type Sim struct {
+	counters stats.Counters
+
+	link    link
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	pending map[uint32]chan *message
+	macs    map[string]bool
+}
+
+// Counters counts the leases, for interval reports.
+func (s *Sim) Counters() *stats.Counters {
+	return &s.counters
+}
+
+// Run opens cfg.Interface and runs the clients cfg describes. Cancelling
+// ctx ends it, the result then covers the exchanges done so far.
+func (s *Sim) Run(ctx context.Context, cfg Config) (*Result, error) {
+	handle, err := pcap.OpenLive(cfg.Interface, 1600, true, 100*time.Millisecond)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open device %s: %v", cfg.Interface, err)
+	}
+	defer handle.Close()
+	if err := handle.SetBPFFilter("udp and src port 67 and dst port 68"); err != nil {
+		return nil, err
+	}
+	return s.run(ctx, cfg, handle)
+}
+
+func (s *Sim) run(ctx context.Context, cfg Config, l link) (*Result, error) {
+	if cfg.MACPrefix == nil {
+		cfg.MACPrefix = net.HardwareAddr{0x02, 0x00, 0x00}
+	}
+	if len(cfg.MACPrefix) > 5 {
+		return nil, errors.New("MAC prefix too long, leave a byte at least")
+	}
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = 10
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 2 * time.Second
+	}
+	s.link = l
+	s.pending = map[uint32]chan *message{}
+	s.macs = map[string]bool{}
+
+	// The reader hands the replies to the clients waiting for them, by
+	// transaction ID.
+	readCtx, stopReading := context.WithCancel(context.Background())
+	defer stopReading()
+	go s.read(readCtx)
+
+	res := &Result{Servers: map[string]uint64{}, LeaseTimes: map[string]uint64{}}
+	var mu sync.Mutex
+	var offer, ack, lease stats.Histogram
+
+	// The producer paces the clients; those in flight finish after the
+	// simulation's end unless ctx is done.
+	produce := ctx
+	if cfg.Duration > 0 {
+		var cancel context.CancelFunc
+		produce, cancel = context.WithTimeout(ctx, cfg.Duration)
+		defer cancel()
+	}
+	jobs := make(chan uint64)
+	go func() {
+		defer close(jobs)
+		start := time.Now()
+		for i := uint64(0); cfg.Clients == 0 || i < cfg.Clients; i++ {
+			if cfg.Rate > 0 {
+				due := start.Add(time.Duration(float64(i) / cfg.Rate * float64(time.Second)))
+				if wait := time.Until(due); wait > 0 {
+					select {
+					case <-time.After(wait):
+					case <-produce.Done():
+						return
+					}
+				}
+			}
+			select {
+			case jobs <- i:
+			case <-produce.Done():
+				return
+			}
+		}
+	}()
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for range cfg.Concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range jobs {
+				o := s.client(ctx, cfg)
+				if ctx.Err() != nil {
+					// Interrupted, not the server's fault.
+					continue
+				}
+				mu.Lock()
+				res.Clients++
+				switch {
+				case o.err != nil:
+					res.Errors++
+				case o.offer == nil:
+					res.NoOffer++
+				case o.ack == nil:
+					res.NoAck++
+				case o.ack.typ == layers.DHCPMsgTypeNak:
+					res.Naks++
+				default:
+					res.Leases++
+					res.Servers[o.ack.serverID.String()]++
+					res.LeaseTimes[o.ack.leaseTime.String()]++
+					if o.released {
+						res.Released++
+					}
+				}
+				mu.Unlock()
+				if o.offer != nil {
+					offer.Record(o.offer.at.Sub(o.start))
+				}
+				if o.ack != nil && o.ack.typ == layers.DHCPMsgTypeAck {
+					ack.Record(o.ack.at.Sub(o.requested))
+					lease.Record(o.ack.at.Sub(o.start))
+					s.counters.Add(1, 0)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	res.Elapsed = time.Since(start)
+	res.Offer, res.Ack, res.Lease = offer.Summary(), ack.Summary(), lease.Summary()
+	if secs := res.Elapsed.Seconds(); secs > 0 {
+		res.Rate = float64(res.Leases) / secs
+	}
+	return res, nil
+}
+
+// outcome is how one client's exchange went.
+type outcome struct {
+	start, requested time.Time
+	offer, ack       *message
+	released         bool
+	err              error
+}
+
+// client runs one discover, offer, request, ack exchange with a new MAC.
+func (s *Sim) client(ctx context.Context, cfg Config) outcome {
+	c := &client{mac: s.newMAC(cfg.MACPrefix), broadcast: cfg.Broadcast}
+	if cfg.Hostname {
+		c.hostname = "gonet-" + strings.ReplaceAll(c.mac.String(), ":", "")
+	}
+	replies := make(chan *message, 8)
+	s.mu.Lock()
+	for {
+		c.xid = rand.Uint32()
+		if s.pending[c.xid] == nil {
+			break
+		}
+	}
+	s.pending[c.xid] = replies
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.pending, c.xid)
+		s.mu.Unlock()
+	}()
+
+	var o outcome
+	o.start = time.Now()
+	o.offer, o.err = s.exchange(ctx, cfg, c, layers.DHCPMsgTypeDiscover, nil, replies, o.start)
+	if o.offer == nil || o.err != nil {
+		return o
+	}
+	o.requested = time.Now()
+	o.ack, o.err = s.exchange(ctx, cfg, c, layers.DHCPMsgTypeRequest, o.offer, replies, o.start)
+	if o.ack == nil || o.err != nil || o.ack.typ != layers.DHCPMsgTypeAck || !cfg.Release {
+		return o
+	}
+	// The ack may leave out what the offer said.
+	rel := *o.ack
+	if rel.yiaddr.Equal(net.IPv4zero) {
+		rel.yiaddr = o.offer.yiaddr
+	}
+	if data, err := c.build(layers.DHCPMsgTypeRelease, 0, &rel); err == nil {
+		o.released = s.write(data) == nil
+	}
+	return o
+}
+
+// exchange sends a discover or a request, trying again on timeouts, and
+// returns the offer or the ack or nak, nil if none came.
+func (s *Sim) exchange(ctx context.Context, cfg Config, c *client, typ layers.DHCPMsgType, offer *message, replies chan *message, start time.Time) (*message, error) {
+	want := layers.DHCPMsgTypeOffer
+	if typ == layers.DHCPMsgTypeRequest {
+		want = layers.DHCPMsgTypeAck
+	}
+	for try := 0; try <= cfg.Retries; try++ {
+		data, err := c.build(typ, uint16(time.Since(start)/time.Second), offer)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.write(data); err != nil {
+			return nil, err
+		}
+		timeout := time.NewTimer(cfg.Timeout)
+		for waiting := true; waiting; {
+			select {
+			case m := <-replies:
+				if m.typ == want || (want == layers.DHCPMsgTypeAck && m.typ == layers.DHCPMsgTypeNak) {
+					timeout.Stop()
+					return m, nil
+				}
+			case <-timeout.C:
+				waiting = false
+			case <-ctx.Done():
+				timeout.Stop()
+				return nil, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+func (s *Sim) write(data []byte) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return s.link.WritePacketData(data)
+}
+
+// read dispatches captured replies until ctx is done.
+func (s *Sim) read(ctx context.Context) {
+	for ctx.Err() == nil {
+		data, _, err := s.link.ReadPacketData()
+		if err != nil {
+			if errors.Is(err, pcap.NextErrorTimeoutExpired) {
+				continue
+			}
+			if ctx.Err() == nil {
+				time.Sleep(10 * time.Millisecond)
+			}
+			continue
+		}
+		m, ok := parse(data, time.Now())
+		if !ok {
+			continue
+		}
+		s.mu.Lock()
+		replies := s.pending[m.xid]
+		s.mu.Unlock()
+		if replies != nil {
+			select {
+			case replies <- m:
+			default:
+			}
+		}
+	}
+}
+
+// newMAC returns a MAC no other client of the simulation has had.
+func (s *Sim) newMAC(prefix net.HardwareAddr) net.HardwareAddr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		mac := make(net.HardwareAddr, 6)
+		copy(mac, prefix)
+		for i := len(prefix); i < 6; i++ {
+			mac[i] = byte(rand.N(256))
+		}
+		if !s.macs[string(mac)] {
+			s.macs[string(mac)] = true
+			return mac
+		}
+	}
+}
+
+// Write prints r for people, with the latency histograms when buckets is
+// set.
+func (r *Result) Write(w io.Writer, buckets bool) {
+	fmt.Fprintf(w, "Leases:    %d of %d clients in %v (%.2f/s), %d released\n",
+		r.Leases, r.Clients, r.Elapsed.Round(time.Millisecond), r.Rate, r.Released)
+	fmt.Fprintf(w, "Failures:  %d without offer, %d without ack, %d naks, %d send errors\n", r.NoOffer, r.NoAck, r.Naks, r.Errors)
+	if len(r.Servers) > 0 {
+		fmt.Fprintf(w, "Servers:   %s\n", stats.Counts(r.Servers))
+		fmt.Fprintf(w, "Durations: %s\n", stats.Counts(r.LeaseTimes))
+	}
+	fmt.Fprint(w, "Offer  ")
+	r.Offer.Write(w, buckets)
+	fmt.Fprint(w, "Ack    ")
+	r.Ack.Write(w, buckets)
+	fmt.Fprint(w, "Lease  ")
+	r.Lease.Write(w, buckets)
+}
@@ -0,0 +1,456 @@
+package dnsload
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"gonet/pkg/stats"
+)
+
+// Config is a query load for Load.Run.
+type Config struct {
+	Server string // resolver host:port, port 53 when left out
+	TCP    bool   // query over TCP instead of UDP
+
+	// Names are qname patterns, {rand} replaced by a random label and
+	// {seq} by the query's number; every name is asked with every type.
+	Names   []string
+	Types   []layers.DNSType // default A
+	Recurse bool             // set RD
+
+	// EDNS adds an OPT record advertising this UDP size; DO, NSID and
+	// ClientSubnet imply EDNS with 1232 bytes when it is 0.
+	EDNS         uint16
+	DO           bool
+	NSID         bool
+	ClientSubnet netip.Prefix
+
+	Concurrency int     // queries in flight at most, default 10
+	QPS         float64 // queries started per second at most, 0 for no limit
+
+	// The test ends after Duration or Queries, whichever comes first; with
+	// neither it runs until ctx is done.
+	Duration time.Duration
+	Queries  uint64
+
+	Timeout time.Duration // per query, default 2s
+}
+
+// Result is a finished test. Answered queries are broken down by rcode;
+// Invalid answers don't match their query.
+type Result struct {
+	Sent      uint64            `json:"sent"`
+	Answered  uint64            `json:"answered"`
+	Timeouts  uint64            `json:"timeouts"`
+	Errors    uint64            `json:"errors"`
+	ErrorsBy  map[string]uint64 `json:"errors_by_kind,omitempty"`
+	Invalid   uint64            `json:"invalid"`
+	Truncated uint64            `json:"truncated"`
+	NoData    uint64            `json:"nodata"` // NOERROR without answers
+	Rcodes    map[string]uint64 `json:"rcodes"`
+	NSIDs     map[string]uint64 `json:"nsids,omitempty"`
+
+	Elapsed         time.Duration `json:"elapsed_ns"`
+	QPS             float64       `json:"qps"` // answered per second
+	ServfailPercent float64       `json:"servfail_percent"`
+	TimeoutPercent  float64       `json:"timeout_percent"`
+	Latency         stats.Latency `json:"latency"`
+}
+
+// Load sends DNS queries. The zero value is ready to use.
+type Load struct {
+	counters stats.Counters
+}
+
+// Counters counts the answers and their bytes as they come, for interval
+// reports.
+func (l *Load) Counters() *stats.Counters {
+	return &l.counters
+}
+
+// Run runs the test cfg describes. Cancelling ctx ends it, the result
+// then covers the queries answered so far.
+func (l *Load) Run(ctx context.Context, cfg Config) (*Result, error) {
+	if len(cfg.Names) == 0 {
+		return nil, errors.New("no names to query")
+	}
+	if _, _, err := net.SplitHostPort(cfg.Server); err != nil {
+		cfg.Server = net.JoinHostPort(cfg.Server, "53")
+	}
+	if len(cfg.Types) == 0 {
+		cfg.Types = []layers.DNSType{layers.DNSTypeA}
+	}
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = 10
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 2 * time.Second
+	}
+	if cfg.EDNS == 0 && (cfg.DO || cfg.NSID || cfg.ClientSubnet.IsValid()) {
+		cfg.EDNS = 1232
+	}
+
+	res := &Result{ErrorsBy: map[string]uint64{}, Rcodes: map[string]uint64{}, NSIDs: map[string]uint64{}}
+	var mu sync.Mutex
+	var latency stats.Histogram
+
+	// The producer paces the queries; in-flight ones finish after the
+	// test's end unless ctx is done.
+	produce := ctx
+	if cfg.Duration > 0 {
+		var cancel context.CancelFunc
+		produce, cancel = context.WithTimeout(ctx, cfg.Duration)
+		defer cancel()
+	}
+	jobs := make(chan uint64)
+	go func() {
+		defer close(jobs)
+		start := time.Now()
+		for i := uint64(0); cfg.Queries == 0 || i < cfg.Queries; i++ {
+			if cfg.QPS > 0 {
+				due := start.Add(time.Duration(float64(i) / cfg.QPS * float64(time.Second)))
+				if wait := time.Until(due); wait > 0 {
+					select {
+					case <-time.After(wait):
+					case <-produce.Done():
+						return
+					}
+				}
+			}
+			select {
+			case jobs <- i:
+			case <-produce.Done():
+				return
+			}
+		}
+	}()
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for range cfg.Concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := &worker{cfg: cfg}
+			defer w.close()
+			stop := context.AfterFunc(ctx, w.close)
+			defer stop()
+			for i := range jobs {
+				name, qtype := query(cfg, i)
+				began := time.Now()
+				resp, n, err := w.exchange(name, qtype)
+				took := time.Since(began)
+				if err != nil && ctx.Err() != nil {
+					// Interrupted, not the resolver's fault.
+					continue
+				}
+
+				mu.Lock()
+				res.Sent++
+				switch {
+				case isTimeout(err):
+					res.Timeouts++
+				case errors.Is(err, errMismatch):
+					res.Invalid++
+				case err != nil:
+					kind := errorKind(err)
+					res.Errors++
+					res.ErrorsBy[kind]++
+				default:
+					res.Answered++
+					res.Rcodes[rcodeName(resp.ResponseCode)]++
+					if resp.TC {
+						res.Truncated++
+					}
+					if resp.ResponseCode == layers.DNSResponseCodeNoErr && len(resp.Answers) == 0 {
+						res.NoData++
+					}
+					if id := nsid(resp); id != "" {
+						res.NSIDs[id]++
+					}
+				}
+				mu.Unlock()
+				if err == nil {
+					latency.Record(took)
+					l.counters.Add(1, uint64(n))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	res.Elapsed = time.Since(start)
+	res.Latency = latency.Summary()
+	if secs := res.Elapsed.Seconds(); secs > 0 {
+		res.QPS = float64(res.Answered) / secs
+	}
+	if res.Sent > 0 {
+		res.ServfailPercent = float64(res.Rcodes["SERVFAIL"]) * 100 / float64(res.Sent)
+		res.TimeoutPercent = float64(res.Timeouts) * 100 / float64(res.Sent)
+	}
+	return res, nil
+}
+
+// query returns the name and type of query i.
+func query(cfg Config, i uint64) (string, layers.DNSType) {
+	pattern := cfg.Names[i%uint64(len(cfg.Names))]
+	qtype := cfg.Types[(i/uint64(len(cfg.Names)))%uint64(len(cfg.Types))]
+	if strings.Contains(pattern, "{") {
+		pattern = strings.ReplaceAll(pattern, "{seq}", strconv.FormatUint(i, 10))
+		for strings.Contains(pattern, "{rand}") {
+			pattern = strings.Replace(pattern, "{rand}", randLabel(), 1)
+		}
+	}
+	return strings.TrimSuffix(pattern, "."), qtype
+}
+
+func randLabel() string {
+	const chars = "abcdefghijklmnopqrstuvwxyz0123456789"
+	b := make([]byte, 10)
+	for i := range b {
+		b[i] = chars[rand.IntN(len(chars))]
+	}
+	return string(b)
+}
+
+// errMismatch is returned for answers that don't match their query.
+var errMismatch = errors.New("answer doesn't match the query")
+
+// worker has one socket to the resolver, so its queries come from one
+// source port.
+type worker struct {
+	cfg  Config
+	mu   sync.Mutex
+	conn net.Conn
+	br   *bufio.Reader
+	buf  []byte
+}
+
+func (w *worker) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.conn != nil {
+		w.conn.Close()
+		w.conn = nil
+	}
+}
+
+// exchange sends a query and waits for its answer, returning it and its
+// size.
+func (w *worker) exchange(name string, qtype layers.DNSType) (*layers.DNS, int, error) {
+	w.mu.Lock()
+	conn := w.conn
+	w.mu.Unlock()
+	if conn == nil {
+		network := "udp"
+		if w.cfg.TCP {
+			network = "tcp"
+		}
+		var err error
+		if conn, err = net.DialTimeout(network, w.cfg.Server, w.cfg.Timeout); err != nil {
+			return nil, 0, err
+		}
+		w.mu.Lock()
+		w.conn, w.br = conn, bufio.NewReader(conn)
+		w.mu.Unlock()
+		w.buf = make([]byte, 65535)
+	}
+
+	id := uint16(rand.Uint32())
+	msg, err := encode(w.cfg, id, name, qtype)
+	if err != nil {
+		return nil, 0, err
+	}
+	conn.SetDeadline(time.Now().Add(w.cfg.Timeout))
+	resp, n, err := w.roundTrip(conn, msg, id)
+	if err != nil && w.cfg.TCP {
+		// The stream is out of step after a failure.
+		w.close()
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	q := resp.Questions
+	if !resp.QR || len(q) != 1 || q[0].Type != qtype || !strings.EqualFold(string(q[0].Name), name) {
+		return nil, 0, errMismatch
+	}
+	return resp, n, nil
+}
+
+func (w *worker) roundTrip(conn net.Conn, msg []byte, id uint16) (*layers.DNS, int, error) {
+	if w.cfg.TCP {
+		framed := binary.BigEndian.AppendUint16(nil, uint16(len(msg)))
+		if _, err := conn.Write(append(framed, msg...)); err != nil {
+			return nil, 0, err
+		}
+	} else if _, err := conn.Write(msg); err != nil {
+		return nil, 0, err
+	}
+
+	for {
+		var data []byte
+		if w.cfg.TCP {
+			var size [2]byte
+			if _, err := io.ReadFull(w.br, size[:]); err != nil {
+				return nil, 0, err
+			}
+			data = w.buf[:binary.BigEndian.Uint16(size[:])]
+			if _, err := io.ReadFull(w.br, data); err != nil {
+				return nil, 0, err
+			}
+		} else {
+			n, err := conn.Read(w.buf)
+			if err != nil {
+				return nil, 0, err
+			}
+			data = w.buf[:n]
+		}
+		var resp layers.DNS
+		if err := resp.DecodeFromBytes(data, gopacket.NilDecodeFeedback); err != nil {
+			return nil, 0, errMismatch
+		}
+		// Late answers to queries that timed out are skipped.
+		if resp.ID == id {
+			return &resp, len(data), nil
+		}
+	}
+}
+
+// encode builds the query message.
+func encode(cfg Config, id uint16, name string, qtype layers.DNSType) ([]byte, error) {
+	q := &layers.DNS{
+		ID:        id,
+		RD:        cfg.Recurse,
+		OpCode:    layers.DNSOpCodeQuery,
+		Questions: []layers.DNSQuestion{{Name: []byte(name), Type: qtype, Class: layers.DNSClassIN}},
+	}
+	if cfg.EDNS > 0 {
+		opt := layers.DNSResourceRecord{Type: layers.DNSTypeOPT, Class: layers.DNSClass(cfg.EDNS)}
+		if cfg.DO {
+			opt.TTL = 1 << 15
+		}
+		if cfg.NSID {
+			opt.OPT = append(opt.OPT, layers.DNSOPT{Code: layers.DNSOptionCodeNSID})
+		}
+		if p := cfg.ClientSubnet; p.IsValid() {
+			family := uint16(1)
+			if p.Addr().Is6() {
+				family = 2
+			}
+			data := binary.BigEndian.AppendUint16(nil, family)
+			data = append(data, byte(p.Bits()), 0)
+			data = append(data, p.Masked().Addr().AsSlice()[:(p.Bits()+7)/8]...)
+			opt.OPT = append(opt.OPT, layers.DNSOPT{Code: layers.DNSOptionCodeEDNSClientSubnet, Data: data})
+		}
+		q.Additionals = []layers.DNSResourceRecord{opt}
+	}
+	buf := gopacket.NewSerializeBuffer()
+	if err := q.SerializeTo(buf, gopacket.SerializeOptions{FixLengths: true}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// nsid returns the NSID of an answer, if it carries one.
+func nsid(resp *layers.DNS) string {
+	for _, rr := range resp.Additionals {
+		if rr.Type != layers.DNSTypeOPT {
+			continue
+		}
+		for _, o := range rr.OPT {
+			if o.Code == layers.DNSOptionCodeNSID && len(o.Data) > 0 {
+				if isPrintable(o.Data) {
+					return string(o.Data)
+				}
+				return fmt.Sprintf("%x", o.Data)
+			}
+		}
+	}
+	return ""
+}
+
+func isPrintable(b []byte) bool {
+	return bytes.IndexFunc(b, func(r rune) bool { return r < ' ' || r > '~' }) < 0
+}
+
+var rcodes = map[layers.DNSResponseCode]string{
+	layers.DNSResponseCodeNoErr:    "NOERROR",
+	layers.DNSResponseCodeFormErr:  "FORMERR",
+	layers.DNSResponseCodeServFail: "SERVFAIL",
+	layers.DNSResponseCodeNXDomain: "NXDOMAIN",
+	layers.DNSResponseCodeNotImp:   "NOTIMP",
+	layers.DNSResponseCodeRefused:  "REFUSED",
+	layers.DNSResponseCodeBadVers:  "BADVERS",
+}
+
+func rcodeName(c layers.DNSResponseCode) string {
+	if name, ok := rcodes[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("RCODE%d", c)
+}
+
+// ParseType parses a query type by name, like AAAA, or number.
+func ParseType(s string) (layers.DNSType, error) {
+	s = strings.ToUpper(s)
+	if n, err := strconv.ParseUint(strings.TrimPrefix(s, "TYPE"), 10, 16); err == nil {
+		return layers.DNSType(n), nil
+	}
+	if s == "ANY" {
+		return 255, nil
+	}
+	for t := 1; t < 256; t++ {
+		if layers.DNSType(t).String() == s {
+			return layers.DNSType(t), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown query type %q", s)
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// errorKind sorts socket errors for the breakdown.
+func errorKind(err error) string {
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection refused"
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "connection reset"
+	}
+	return "other"
+}
+
+// Write prints r for people, with the latency histogram when buckets is
+// set.
+func (r *Result) Write(w io.Writer, buckets bool) {
+	fmt.Fprintf(w, "Queries:   %d sent, %d answered in %v (%.2f/s)\n", r.Sent, r.Answered, r.Elapsed.Round(time.Millisecond), r.QPS)
+	fmt.Fprintf(w, "Failures:  %d timeouts (%.2f%%), %d SERVFAIL (%.2f%%), %d invalid answers, %d errors\n",
+		r.Timeouts, r.TimeoutPercent, r.Rcodes["SERVFAIL"], r.ServfailPercent, r.Invalid, r.Errors)
+	fmt.Fprintf(w, "Rcodes:    %s\n", stats.Counts(r.Rcodes))
+	fmt.Fprintf(w, "Answers:   %d without records, %d truncated\n", r.NoData, r.Truncated)
+	if len(r.ErrorsBy) > 0 {
+		fmt.Fprintf(w, "Errors:    %s\n", stats.Counts(r.ErrorsBy))
+	}
+	if len(r.NSIDs) > 0 {
+		fmt.Fprintf(w, "NSIDs:     %s\n", stats.Counts(r.NSIDs))
+	}
+	r.Latency.Write(w, buckets)
+}
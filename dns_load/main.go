@@ -0,0 +1,138 @@
+package dnsload
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"log"
+	"net/netip"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket/layers"
+
+	"gonet/pkg/config"
+	"gonet/pkg/logging"
+	"gonet/pkg/results"
+	"gonet/pkg/stats"
+)
+
+// Main runs gonet dnsload with the arguments after the command name.
+func Main(args []string) {
+	// Command line flags
+	flags := flag.NewFlagSet("dnsload", flag.ExitOnError)
+	server := flags.String("server", "127.0.0.1:53", "Resolver to query, host or host:port")
+	tcp := flags.Bool("tcp", false, "Query over TCP instead of UDP")
+	var names []string
+	flags.Func("name", "Query name pattern, repeatable; {rand} becomes a random label, {seq} the query number", func(s string) error {
+		names = append(names, s)
+		return nil
+	})
+	namesFile := flags.String("names-file", "", "File with a name pattern per line")
+	var types []layers.DNSType
+	flags.Func("type", "Query type like A, AAAA, MX or TXT, repeatable (default A)", func(s string) error {
+		t, err := ParseType(s)
+		types = append(types, t)
+		return err
+	})
+	noRecurse := flags.Bool("norecurse", false, "Clear the recursion desired bit")
+	ednsSize := flags.Uint("edns", 0, "Add an EDNS OPT record advertising this UDP payload size (0 for none unless another EDNS option is set)")
+	do := flags.Bool("do", false, "Set the DNSSEC OK bit")
+	nsidOpt := flags.Bool("nsid", false, "Ask for the server's NSID and count the answers per NSID")
+	ecs := flags.String("ecs", "", "Send an EDNS client subnet, like 192.0.2.0/24")
+	concurrency := flags.Int("c", 10, "Queries in flight at most")
+	qps := flags.Float64("qps", 0, "Queries started per second at most (0 for no limit)")
+	duration := flags.Duration("duration", 0, "How long to send queries (default 10s unless -n is given)")
+	queries := flags.Uint64("n", 0, "Stop after this many queries")
+	timeout := flags.Duration("timeout", 2*time.Second, "Timeout of each query")
+	histogram := flags.Bool("histogram", false, "Print the latency histogram")
+	report := stats.RegisterFlags(flags)
+	jsonOut := flags.String("json", "", "Write the result as JSON to this file when done, - for stdout")
+	logs := logging.RegisterFlags(flags)
+	configFile := flags.String("config", "", "YAML or JSON file setting flags by name, command line flags win")
+	flags.Parse(args)
+
+	if _, err := config.LoadFlags(flags, *configFile); err != nil {
+		log.Fatalf("Invalid -config: %v", err)
+	}
+	if err := logs.Setup(); err != nil {
+		log.Fatal(err)
+	}
+	names = append(names, flags.Args()...)
+	if *namesFile != "" {
+		f, err := os.Open(*namesFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			if line := strings.TrimSpace(sc.Text()); line != "" && !strings.HasPrefix(line, "#") {
+				names = append(names, line)
+			}
+		}
+		f.Close()
+		if err := sc.Err(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if len(names) == 0 {
+		log.Fatal("Usage: gonet dnsload [flags] <name pattern>...")
+	}
+	if *ednsSize > 65535 {
+		log.Fatalf("Invalid -edns %d", *ednsSize)
+	}
+
+	cfg := Config{
+		Server:      *server,
+		TCP:         *tcp,
+		Names:       names,
+		Types:       types,
+		Recurse:     !*noRecurse,
+		EDNS:        uint16(*ednsSize),
+		DO:          *do,
+		NSID:        *nsidOpt,
+		Concurrency: *concurrency,
+		QPS:         *qps,
+		Duration:    *duration,
+		Queries:     *queries,
+		Timeout:     *timeout,
+	}
+	if *ecs != "" {
+		p, err := netip.ParsePrefix(*ecs)
+		if err != nil {
+			log.Fatalf("Invalid -ecs: %v", err)
+		}
+		cfg.ClientSubnet = p
+	}
+	if cfg.Duration == 0 && cfg.Queries == 0 {
+		cfg.Duration = 10 * time.Second
+	}
+
+	// Stop on interrupt
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	var l Load
+	report.Unit = "Answers"
+	reporter, err := report.Reporter(l.Counters(), "Answer", "received", "dnsload")
+	if err != nil {
+		log.Fatal(err)
+	}
+	reporter.Start()
+	res, err := l.Run(ctx, cfg)
+	reporter.Stop()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *jsonOut != "-" {
+		res.Write(os.Stdout, *histogram)
+	}
+
+	if *jsonOut != "" {
+		if err := results.Write(*jsonOut, res); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
@@ -1,6 +1,6 @@
-module go_packets
+module gonet
 
-go 1.23.5
+go 1.24
 
 require github.com/google/gopacket v1.1.19
 
@@ -0,0 +1,289 @@
+package gopackets
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+
+	"gonet/pkg/logging"
+)
+
+// sizeBuckets are the upper bounds of the packet size histogram, the
+// last one catching jumbo frames.
+var sizeBuckets = []int{63, 127, 255, 511, 1023, 1518, 9000, 1 << 30}
+
+type protocolCount struct {
+	Protocol string `json:"protocol"`
+	Packets  int    `json:"packets"`
+}
+
+type flowStats struct {
+	Protocol string    `json:"protocol"`
+	Src      string    `json:"src"`
+	Dst      string    `json:"dst"`
+	Packets  int       `json:"packets"`
+	Bytes    int       `json:"bytes"`
+	First    time.Time `json:"first"`
+	Last     time.Time `json:"last"`
+}
+
+type sizeBucket struct {
+	Min     int `json:"min"`
+	Max     int `json:"max"`
+	Packets int `json:"packets"`
+}
+
+// throughputSample covers the interval starting Offset seconds into the
+// capture.
+type throughputSample struct {
+	Offset  float64 `json:"offset"`
+	Packets int     `json:"packets"`
+	Bytes   int     `json:"bytes"`
+	Mbps    float64 `json:"mbps"`
+}
+
+// analysis is what the analyze command finds in one file.
+type analysis struct {
+	File       string             `json:"file"`
+	LinkType   string             `json:"link_type"`
+	Packets    int                `json:"packets"`
+	Bytes      int                `json:"bytes"`
+	Start      time.Time          `json:"start"`
+	End        time.Time          `json:"end"`
+	Seconds    float64            `json:"seconds"`
+	Protocols  []protocolCount    `json:"protocols"`
+	Flows      []flowStats        `json:"flows"`
+	Sizes      []sizeBucket       `json:"sizes"`
+	Throughput []throughputSample `json:"throughput"`
+}
+
+// analyzeCommand runs "go_packets analyze [flags] files...": flow table,
+// protocol counts, size histogram and throughput over time of each file,
+// as JSON or as a set of CSV files.
+func analyzeCommand(args []string) {
+	fs := flag.NewFlagSet("analyze", flag.ExitOnError)
+	format := fs.String("format", "json", "Output format, json or csv")
+	interval := fs.Duration("interval", time.Second, "Length of the throughput samples")
+	out := fs.String("out", "", "File for the JSON output, default stdout; with -format csv the prefix of the CSV files")
+	logs := logging.RegisterFlags(fs)
+	fs.Parse(args)
+	if err := logs.Setup(); err != nil {
+		log.Fatal(err)
+	}
+	if fs.NArg() < 1 {
+		log.Fatal("Usage: gonet replay analyze [-format json|csv] [-interval 1s] [-out path] <pcap file or glob>...")
+	}
+	if *interval <= 0 {
+		log.Fatalf("Invalid -interval %v", *interval)
+	}
+	if *format == "csv" && *out == "" {
+		log.Fatal("-format csv needs -out, the prefix of the CSV files")
+	}
+	if *format != "json" && *format != "csv" {
+		log.Fatalf("Invalid -format %q, want json or csv", *format)
+	}
+
+	files, err := expandFiles(fs.Args())
+	if err != nil {
+		log.Fatalf("Invalid pcap files: %v", err)
+	}
+	var results []analysis
+	for _, file := range files {
+		a, err := analyzeFile(file, *interval)
+		if err != nil {
+			log.Fatalf("Failed to read pcap file %s: %v", file, err)
+		}
+		results = append(results, a)
+	}
+
+	if *format == "csv" {
+		if err := writeAnalysisCSV(*out, results); err != nil {
+			log.Fatalf("Failed to write CSV: %v", err)
+		}
+		return
+	}
+	b, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	b = append(b, '\n')
+	if *out == "" {
+		os.Stdout.Write(b)
+		return
+	}
+	if err := os.WriteFile(*out, b, 0o644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// analyzeFile decodes file as -dry-run does and tallies it up.
+func analyzeFile(file string, interval time.Duration) (analysis, error) {
+	handle, err := pcap.OpenOffline(file)
+	if err != nil {
+		return analysis{}, err
+	}
+	defer handle.Close()
+	linkType := handle.LinkType()
+	a := analysis{File: file, LinkType: linkType.String()}
+
+	packetSource := gopacket.NewPacketSource(handle, linkType)
+	packetSource.DecodeOptions = gopacket.DecodeOptions{Lazy: true, NoCopy: true}
+
+	protocols := make(map[string]int)
+	flows := make(map[flowKey]*flowStats)
+	sizes := make([]int, len(sizeBuckets))
+	var samples []throughputSample
+
+	for packet := range packetSource.Packets() {
+		ci := packet.Metadata().CaptureInfo
+		a.Packets++
+		a.Bytes += ci.Length
+		if a.Packets == 1 {
+			a.Start = ci.Timestamp
+		}
+		a.End = ci.Timestamp
+
+		for _, layer := range packet.Layers() {
+			protocols[layer.LayerType().String()]++
+		}
+		sizes[sort.SearchInts(sizeBuckets, ci.Length)]++
+
+		if key, ok := packetFlow(linkType, packet.Data()); ok {
+			f := flows[key]
+			if f == nil {
+				f = &flowStats{
+					Protocol: layers.IPProtocol(key.proto).String(),
+					Src:      key.src.String(),
+					Dst:      key.dst.String(),
+					First:    ci.Timestamp,
+				}
+				flows[key] = f
+			}
+			f.Packets++
+			f.Bytes += ci.Length
+			f.Last = ci.Timestamp
+		}
+
+		// Packets out of timestamp order count toward the first sample.
+		sample := max(int(ci.Timestamp.Sub(a.Start)/interval), 0)
+		for len(samples) <= sample {
+			samples = append(samples, throughputSample{Offset: (time.Duration(len(samples)) * interval).Seconds()})
+		}
+		samples[sample].Packets++
+		samples[sample].Bytes += ci.Length
+	}
+	a.Seconds = a.End.Sub(a.Start).Seconds()
+
+	for name, n := range protocols {
+		a.Protocols = append(a.Protocols, protocolCount{Protocol: name, Packets: n})
+	}
+	sort.Slice(a.Protocols, func(i, j int) bool {
+		if a.Protocols[i].Packets != a.Protocols[j].Packets {
+			return a.Protocols[i].Packets > a.Protocols[j].Packets
+		}
+		return a.Protocols[i].Protocol < a.Protocols[j].Protocol
+	})
+
+	for _, f := range flows {
+		a.Flows = append(a.Flows, *f)
+	}
+	sort.Slice(a.Flows, func(i, j int) bool {
+		if a.Flows[i].Bytes != a.Flows[j].Bytes {
+			return a.Flows[i].Bytes > a.Flows[j].Bytes
+		}
+		if !a.Flows[i].First.Equal(a.Flows[j].First) {
+			return a.Flows[i].First.Before(a.Flows[j].First)
+		}
+		return a.Flows[i].Src+a.Flows[i].Dst < a.Flows[j].Src+a.Flows[j].Dst
+	})
+
+	low := 0
+	for i, high := range sizeBuckets {
+		a.Sizes = append(a.Sizes, sizeBucket{Min: low, Max: high, Packets: sizes[i]})
+		low = high + 1
+	}
+
+	for i := range samples {
+		samples[i].Mbps = float64(samples[i].Bytes) * 8 / (interval.Seconds() * 1_000_000)
+	}
+	a.Throughput = samples
+	return a, nil
+}
+
+// writeAnalysisCSV writes one CSV file per table, named prefix-flows.csv
+// and so on, with a row per file and entry.
+func writeAnalysisCSV(prefix string, results []analysis) error {
+	tables := []struct {
+		name   string
+		header []string
+		rows   func(a analysis) [][]string
+	}{
+		{"summary", []string{"file", "link_type", "packets", "bytes", "start", "end", "seconds"}, func(a analysis) [][]string {
+			return [][]string{{a.File, a.LinkType, strconv.Itoa(a.Packets), strconv.Itoa(a.Bytes),
+				a.Start.Format(time.RFC3339Nano), a.End.Format(time.RFC3339Nano), strconv.FormatFloat(a.Seconds, 'f', -1, 64)}}
+		}},
+		{"protocols", []string{"file", "protocol", "packets"}, func(a analysis) (rows [][]string) {
+			for _, p := range a.Protocols {
+				rows = append(rows, []string{a.File, p.Protocol, strconv.Itoa(p.Packets)})
+			}
+			return rows
+		}},
+		{"flows", []string{"file", "protocol", "src", "dst", "packets", "bytes", "first", "last"}, func(a analysis) (rows [][]string) {
+			for _, f := range a.Flows {
+				rows = append(rows, []string{a.File, f.Protocol, f.Src, f.Dst, strconv.Itoa(f.Packets), strconv.Itoa(f.Bytes),
+					f.First.Format(time.RFC3339Nano), f.Last.Format(time.RFC3339Nano)})
+			}
+			return rows
+		}},
+		{"sizes", []string{"file", "min", "max", "packets"}, func(a analysis) (rows [][]string) {
+			for _, s := range a.Sizes {
+				rows = append(rows, []string{a.File, strconv.Itoa(s.Min), strconv.Itoa(s.Max), strconv.Itoa(s.Packets)})
+			}
+			return rows
+		}},
+		{"throughput", []string{"file", "offset", "packets", "bytes", "mbps"}, func(a analysis) (rows [][]string) {
+			for _, s := range a.Throughput {
+				rows = append(rows, []string{a.File, strconv.FormatFloat(s.Offset, 'f', -1, 64), strconv.Itoa(s.Packets), strconv.Itoa(s.Bytes),
+					strconv.FormatFloat(s.Mbps, 'f', 3, 64)})
+			}
+			return rows
+		}},
+	}
+
+	for _, t := range tables {
+		path := fmt.Sprintf("%s-%s.csv", prefix, t.name)
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		err = writeCSV(f, t.header, results, t.rows)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	return nil
+}
+
+func writeCSV(w io.Writer, header []string, results []analysis, rows func(analysis) [][]string) error {
+	cw := csv.NewWriter(w)
+	cw.Write(header)
+	for _, a := range results {
+		cw.WriteAll(rows(a))
+	}
+	cw.Flush()
+	return cw.Error()
+}
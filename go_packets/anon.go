@@ -0,0 +1,154 @@
+package gopackets
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+)
+
+// anonymizer replaces addresses with keyed pseudonyms. IP addresses are
+// anonymized prefix-preserving, addresses sharing a prefix still share one
+// of the same length, so subnets survive; MACs are scrambled keeping the
+// multicast bit. The same key always gives the same mapping.
+type anonymizer struct {
+	key  []byte
+	ips  map[netip.Addr]netip.Addr
+	macs map[string]net.HardwareAddr
+	path string // mapping file, "" to keep nothing
+}
+
+// anonMapping is the mapping file: the key, to anonymize further captures
+// the same way, and the addresses seen so far to read the results with.
+type anonMapping struct {
+	Key  string            `json:"key"`
+	IPs  map[string]string `json:"ips"`
+	MACs map[string]string `json:"macs"`
+}
+
+// newAnonymizer uses key, a hex string, or the key of the mapping file at
+// path; with neither a random key is made.
+func newAnonymizer(key, path string) (*anonymizer, error) {
+	a := &anonymizer{
+		ips:  make(map[netip.Addr]netip.Addr),
+		macs: make(map[string]net.HardwareAddr),
+		path: path,
+	}
+	if path != "" {
+		b, err := os.ReadFile(path)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+		case err != nil:
+			return nil, err
+		default:
+			var m anonMapping
+			if err := json.Unmarshal(b, &m); err != nil {
+				return nil, fmt.Errorf("%s: %v", path, err)
+			}
+			if key == "" {
+				key = m.Key
+			} else if key != m.Key {
+				return nil, fmt.Errorf("-anon-key differs from the key in %s", path)
+			}
+		}
+	}
+
+	if key == "" {
+		a.key = make([]byte, 32)
+		rand.Read(a.key)
+		return a, nil
+	}
+	var err error
+	if a.key, err = hex.DecodeString(key); err != nil || len(a.key) < 16 {
+		return nil, fmt.Errorf("invalid anonymization key, want at least 32 hex digits")
+	}
+	return a, nil
+}
+
+// ip anonymizes an IPv4 or IPv6 address in place.
+func (a *anonymizer) ip(b []byte) {
+	addr, ok := netip.AddrFromSlice(b)
+	if !ok {
+		return
+	}
+	anon, ok := a.ips[addr]
+	if !ok {
+		anon = a.anonymizeIP(addr)
+		a.ips[addr] = anon
+	}
+	copy(b, anon.AsSlice())
+}
+
+// anonymizeIP flips each bit of addr by a pseudorandom function of the
+// bits before it, as Crypto-PAn does, with HMAC-SHA256 as the function.
+func (a *anonymizer) anonymizeIP(addr netip.Addr) netip.Addr {
+	in := addr.AsSlice()
+	out := make([]byte, len(in))
+	prefix := make([]byte, len(in)+1)
+	mac := hmac.New(sha256.New, a.key)
+	for i := 0; i < len(in)*8; i++ {
+		// The prefix is the first i bits of the address and their count.
+		prefix[0] = byte(i)
+		if i > 0 {
+			prefix[1+(i-1)/8] |= in[(i-1)/8] & (0x80 >> ((i - 1) % 8))
+		}
+		mac.Reset()
+		mac.Write(prefix)
+		flip := mac.Sum(nil)[0] >> 7
+		bit := in[i/8] >> (7 - i%8) & 1
+		out[i/8] |= (bit ^ flip) << (7 - i%8)
+	}
+	anon, _ := netip.AddrFromSlice(out)
+	return anon
+}
+
+// mac scrambles a MAC address in place. Broadcast stays as it is, the
+// group bit is kept and the result is marked locally administered so it
+// can't clash with a real vendor's address.
+func (a *anonymizer) mac(b []byte) {
+	if string(b) == "\xff\xff\xff\xff\xff\xff" {
+		return
+	}
+	anon, ok := a.macs[string(b)]
+	if !ok {
+		h := hmac.New(sha256.New, a.key)
+		h.Write([]byte("mac"))
+		h.Write(b)
+		anon = net.HardwareAddr(h.Sum(nil)[:6])
+		anon[0] = anon[0]&^0x01 | b[0]&0x01 | 0x02
+		a.macs[string(b)] = anon
+	}
+	copy(b, anon)
+}
+
+// save writes the key and the addresses seen to the mapping file.
+func (a *anonymizer) save() error {
+	if a.path == "" {
+		return nil
+	}
+	m := anonMapping{
+		Key:  hex.EncodeToString(a.key),
+		IPs:  make(map[string]string),
+		MACs: make(map[string]string),
+	}
+	if b, err := os.ReadFile(a.path); err == nil {
+		json.Unmarshal(b, &m)
+	}
+	for from, to := range a.ips {
+		m.IPs[from.String()] = to.String()
+	}
+	for from, to := range a.macs {
+		m.MACs[net.HardwareAddr(from).String()] = to.String()
+	}
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(a.path, append(b, '\n'), 0600)
+}
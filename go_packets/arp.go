@@ -0,0 +1,166 @@
+package gopackets
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+
+	"gonet/pkg/ifaceutil"
+)
+
+// localInterface finds the MAC and IPv4 networks of the pcap device name.
+func localInterface(name string) (net.HardwareAddr, []*net.IPNet, error) {
+	iface, err := ifaceutil.Lookup(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(iface.HardwareAddr) != 6 {
+		return nil, nil, fmt.Errorf("%s isn't an Ethernet interface", name)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, nil, err
+	}
+	var nets []*net.IPNet
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+			nets = append(nets, ipNet)
+		}
+	}
+	return iface.HardwareAddr, nets, nil
+}
+
+// arpResolver looks up the MAC addresses of hosts on the send interface
+// with ARP requests, caching the answers for the whole replay.
+type arpResolver struct {
+	sendHandle *pcap.Handle
+	listen     *pcap.Handle
+	mac        net.HardwareAddr
+	nets       []*net.IPNet
+	gateway    net.IP
+
+	cache  map[[4]byte]net.HardwareAddr
+	failed map[[4]byte]bool
+}
+
+func newARPResolver(sendHandle *pcap.Handle, device string, mac net.HardwareAddr, nets []*net.IPNet, gateway net.IP) (*arpResolver, error) {
+	listen, err := pcap.OpenLive(device, 128, false, 100*time.Millisecond)
+	if err != nil {
+		return nil, err
+	}
+	if err := listen.SetBPFFilter("arp"); err != nil {
+		listen.Close()
+		return nil, err
+	}
+	return &arpResolver{
+		sendHandle: sendHandle,
+		listen:     listen,
+		mac:        mac,
+		nets:       nets,
+		gateway:    gateway,
+		cache:      make(map[[4]byte]net.HardwareAddr),
+		failed:     make(map[[4]byte]bool),
+	}, nil
+}
+
+func (r *arpResolver) Close() {
+	r.listen.Close()
+}
+
+// nextHop returns the MAC to send a packet for dst to: dst itself when it
+// is on one of the interface's networks, otherwise the gateway. Hosts that
+// don't answer are given up on after the first try and nil is returned.
+func (r *arpResolver) nextHop(dst net.IP) net.HardwareAddr {
+	hop := dst
+	if !r.onLink(dst) {
+		if r.gateway == nil {
+			return nil
+		}
+		hop = r.gateway
+	}
+
+	key := [4]byte(hop.To4())
+	if mac, ok := r.cache[key]; ok {
+		return mac
+	}
+	if r.failed[key] {
+		return nil
+	}
+	mac, err := r.resolve(hop)
+	if err != nil {
+		slog.Warn("ARP failed, keeping the original destination MAC", "addr", hop, "err", err)
+		r.failed[key] = true
+		return nil
+	}
+	slog.Info("ARP resolved", "addr", hop, "mac", mac)
+	r.cache[key] = mac
+	return mac
+}
+
+func (r *arpResolver) onLink(ip net.IP) bool {
+	for _, n := range r.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve sends up to three ARP requests for ip, a second apart.
+func (r *arpResolver) resolve(ip net.IP) (net.HardwareAddr, error) {
+	var src net.IP
+	for _, n := range r.nets {
+		if n.Contains(ip) {
+			src = n.IP.To4()
+		}
+	}
+	if src == nil {
+		return nil, errors.New("not on a local network")
+	}
+
+	eth := layers.Ethernet{
+		SrcMAC:       r.mac,
+		DstMAC:       layers.EthernetBroadcast,
+		EthernetType: layers.EthernetTypeARP,
+	}
+	arp := layers.ARP{
+		AddrType:          layers.LinkTypeEthernet,
+		Protocol:          layers.EthernetTypeIPv4,
+		HwAddressSize:     6,
+		ProtAddressSize:   4,
+		Operation:         layers.ARPRequest,
+		SourceHwAddress:   r.mac,
+		SourceProtAddress: src,
+		DstHwAddress:      make([]byte, 6),
+		DstProtAddress:    ip.To4(),
+	}
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{}, &eth, &arp); err != nil {
+		return nil, err
+	}
+
+	for try := 0; try < 3; try++ {
+		if err := r.sendHandle.WritePacketData(buf.Bytes()); err != nil {
+			return nil, err
+		}
+		deadline := time.Now().Add(time.Second)
+		for time.Now().Before(deadline) {
+			data, _, err := r.listen.ReadPacketData()
+			if err != nil {
+				continue
+			}
+			packet := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.NoCopy)
+			reply, ok := packet.Layer(layers.LayerTypeARP).(*layers.ARP)
+			if ok && reply.Operation == layers.ARPReply && net.IP(reply.SourceProtAddress).Equal(ip) {
+				return net.HardwareAddr(reply.SourceHwAddress), nil
+			}
+		}
+	}
+	return nil, errors.New("no reply")
+}
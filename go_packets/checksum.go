@@ -0,0 +1,139 @@
+package gopackets
+
+import (
+	"encoding/binary"
+
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	ipProtoTCP = 6
+	ipProtoUDP = 17
+)
+
+// ipOffset returns where the IP header starts in a packet of linkType, or
+// -1 if the packet doesn't carry IP. Ethernet frames may have VLAN tags.
+func ipOffset(linkType layers.LinkType, data []byte) int {
+	switch linkType {
+	case layers.LinkTypeRaw, layers.LinkTypeIPv4, layers.LinkTypeIPv6:
+		return 0
+	case layers.LinkTypeNull, layers.LinkTypeLoop:
+		return 4
+	case layers.LinkTypeLinuxSLL:
+		return 16
+	case layers.LinkTypeEthernet:
+		offset := 12
+		for len(data) >= offset+2 {
+			switch layers.EthernetType(binary.BigEndian.Uint16(data[offset:])) {
+			case layers.EthernetTypeDot1Q, layers.EthernetTypeQinQ:
+				offset += 4
+			case layers.EthernetTypeIPv4, layers.EthernetTypeIPv6:
+				return offset + 2
+			default:
+				return -1
+			}
+		}
+	}
+	return -1
+}
+
+// ipPacket is a view of the IP packet in a captured frame.
+type ipPacket struct {
+	header   []byte // IPv4 header, or the fixed IPv6 header
+	src, dst []byte
+	proto    byte
+	l4       []byte // TCP or UDP header and payload, nil if not present whole
+}
+
+// parseIP finds the addresses and transport segment of the IP packet at
+// b. Fragments and packets cut short by the snaplen get no l4, since their
+// transport checksum can't be computed.
+func parseIP(b []byte) (ipPacket, bool) {
+	if len(b) < 20 {
+		return ipPacket{}, false
+	}
+	switch b[0] >> 4 {
+	case 4:
+		headerLen := int(b[0]&0x0f) * 4
+		totalLen := int(binary.BigEndian.Uint16(b[2:]))
+		if headerLen < 20 || len(b) < headerLen {
+			return ipPacket{}, false
+		}
+		p := ipPacket{header: b[:headerLen], src: b[12:16], dst: b[16:20], proto: b[9]}
+		fragmented := binary.BigEndian.Uint16(b[6:])&0x3fff != 0
+		if !fragmented && totalLen >= headerLen && totalLen <= len(b) {
+			p.l4 = b[headerLen:totalLen]
+		}
+		return p, true
+	case 6:
+		if len(b) < 40 {
+			return ipPacket{}, false
+		}
+		// Extension headers aren't followed; only TCP and UDP directly
+		// after the fixed header are handled.
+		p := ipPacket{header: b[:40], src: b[8:24], dst: b[24:40], proto: b[6]}
+		if end := 40 + int(binary.BigEndian.Uint16(b[4:])); end <= len(b) {
+			p.l4 = b[40:end]
+		}
+		return p, true
+	}
+	return ipPacket{}, false
+}
+
+// ports returns the source and destination port fields of a TCP or UDP
+// segment, or nil.
+func (p ipPacket) ports() []byte {
+	if (p.proto == ipProtoTCP && len(p.l4) >= 20) || (p.proto == ipProtoUDP && len(p.l4) >= 8) {
+		return p.l4[:4]
+	}
+	return nil
+}
+
+// fixChecksums recomputes the IPv4 header checksum and the TCP or UDP
+// checksum of p.
+func (p ipPacket) fixChecksums() {
+	if len(p.src) == 4 {
+		p.header[10], p.header[11] = 0, 0
+		binary.BigEndian.PutUint16(p.header[10:], ^fold(sum(0, p.header)))
+	}
+
+	var field int
+	switch {
+	case p.proto == ipProtoTCP && len(p.l4) >= 20:
+		field = 16
+	case p.proto == ipProtoUDP && len(p.l4) >= 8:
+		field = 6
+	default:
+		return
+	}
+	p.l4[field], p.l4[field+1] = 0, 0
+
+	// Pseudo header: addresses, protocol and segment length.
+	s := sum(sum(0, p.src), p.dst)
+	s += uint32(p.proto) + uint32(len(p.l4))
+	csum := ^fold(sum(s, p.l4))
+	if csum == 0 && p.proto == ipProtoUDP {
+		csum = 0xffff // zero means no checksum in UDP
+	}
+	binary.BigEndian.PutUint16(p.l4[field:], csum)
+}
+
+// sum adds b to s as big endian 16-bit words, padding an odd length.
+func sum(s uint32, b []byte) uint32 {
+	for len(b) >= 2 {
+		s += uint32(binary.BigEndian.Uint16(b))
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		s += uint32(b[0]) << 8
+	}
+	return s
+}
+
+// fold reduces a one's complement sum to 16 bits.
+func fold(s uint32) uint16 {
+	for s > 0xffff {
+		s = s>>16 + s&0xffff
+	}
+	return uint16(s)
+}
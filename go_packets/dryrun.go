@@ -0,0 +1,124 @@
+package gopackets
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcap"
+)
+
+// topTalkers is how many source addresses -dry-run lists.
+const topTalkers = 10
+
+type talker struct {
+	addr           string
+	packets, bytes int
+}
+
+// dryRun prints what replaying file would send: packet counts per
+// protocol, bytes, the time span and the busiest sources. Nothing is sent.
+func dryRun(file string) error {
+	handle, err := pcap.OpenOffline(file)
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+
+	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
+	packetSource.DecodeOptions = gopacket.DecodeOptions{Lazy: true, NoCopy: true}
+
+	protocols := make(map[string]int)
+	talkers := make(map[string]*talker)
+	var packets, bytes, truncatedPackets, index int
+	var captureStart, first, last time.Time
+
+	for packet := range packetSource.Packets() {
+		ci := packet.Metadata().CaptureInfo
+		index++
+		if index == 1 {
+			captureStart = ci.Timestamp
+		}
+		skip, done := selection.check(index, ci.Timestamp, captureStart)
+		if done {
+			break
+		}
+		if skip {
+			continue
+		}
+
+		packets++
+		bytes += ci.Length
+		if ci.CaptureLength < ci.Length {
+			truncatedPackets++
+		}
+		if first.IsZero() || ci.Timestamp.Before(first) {
+			first = ci.Timestamp
+		}
+		if ci.Timestamp.After(last) {
+			last = ci.Timestamp
+		}
+
+		for _, layer := range packet.Layers() {
+			protocols[layer.LayerType().String()]++
+		}
+		if network := packet.NetworkLayer(); network != nil {
+			src := network.NetworkFlow().Src().String()
+			t := talkers[src]
+			if t == nil {
+				t = &talker{addr: src}
+				talkers[src] = t
+			}
+			t.packets++
+			t.bytes += ci.Length
+		}
+	}
+
+	span := last.Sub(first)
+	fmt.Printf("File: %s\n", file)
+	fmt.Printf("Link type: %s\n", handle.LinkType())
+	fmt.Printf("Packets: %d (%d truncated)\n", packets, truncatedPackets)
+	fmt.Printf("Bytes: %d\n", bytes)
+	if packets > 0 {
+		fmt.Printf("Captured: %s to %s (%v)\n", first.Format(time.RFC3339Nano), last.Format(time.RFC3339Nano), span)
+	}
+	if span > 0 {
+		fmt.Printf("Capture rate: %.2f pps, %.2f Mbps\n", float64(packets)/span.Seconds(), float64(bytes)*8/(span.Seconds()*1_000_000))
+	}
+
+	names := make([]string, 0, len(protocols))
+	for name := range protocols {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if protocols[names[i]] != protocols[names[j]] {
+			return protocols[names[i]] > protocols[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	fmt.Println("Protocols:")
+	for _, name := range names {
+		fmt.Printf("  %-20s %d\n", name, protocols[name])
+	}
+
+	sorted := make([]*talker, 0, len(talkers))
+	for _, t := range talkers {
+		sorted = append(sorted, t)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].bytes != sorted[j].bytes {
+			return sorted[i].bytes > sorted[j].bytes
+		}
+		return sorted[i].addr < sorted[j].addr
+	})
+	fmt.Println("Top talkers:")
+	for i, t := range sorted {
+		if i == topTalkers {
+			break
+		}
+		fmt.Printf("  %-40s %d packets, %d bytes\n", t.addr, t.packets, t.bytes)
+	}
+	fmt.Println("-----------------------------------")
+	return nil
+}
@@ -0,0 +1,64 @@
+package gopackets
+
+import (
+	"bufio"
+	"encoding/binary"
+	"os"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// pcapDump writes packets to a pcap file with nanosecond timestamps.
+type pcapDump struct {
+	f *os.File
+	w *bufio.Writer
+}
+
+func createPcapDump(path string, linkType layers.LinkType) (*pcapDump, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriterSize(f, 1<<20)
+
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:], 0xa1b23c4d)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], 262144)
+	binary.LittleEndian.PutUint32(header[20:], uint32(linkType))
+	if _, err := w.Write(header); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &pcapDump{f: f, w: w}, nil
+}
+
+// appendPcapDump opens a file made by createPcapDump to add more packets.
+func appendPcapDump(path string) (*pcapDump, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &pcapDump{f: f, w: bufio.NewWriterSize(f, 64<<10)}, nil
+}
+
+// writePacket adds a packet captured at ts, length bytes long on the wire.
+func (p *pcapDump) writePacket(ts time.Time, data []byte, length int) error {
+	record := make([]byte, 16, 16+len(data))
+	binary.LittleEndian.PutUint32(record[0:], uint32(ts.Unix()))
+	binary.LittleEndian.PutUint32(record[4:], uint32(ts.Nanosecond()))
+	binary.LittleEndian.PutUint32(record[8:], uint32(len(data)))
+	binary.LittleEndian.PutUint32(record[12:], uint32(length))
+	_, err := p.w.Write(append(record, data...))
+	return err
+}
+
+func (p *pcapDump) Close() error {
+	if err := p.w.Flush(); err != nil {
+		p.f.Close()
+		return err
+	}
+	return p.f.Close()
+}
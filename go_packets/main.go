@@ -1,96 +1,416 @@
-package main
+package gopackets
 
 import (
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/pcap"
+
+	"gonet/pkg/apiauth"
+	"gonet/pkg/config"
+	"gonet/pkg/ifaceutil"
+	"gonet/pkg/logging"
+	"gonet/pkg/results"
 )
 
-const (
-	// interfaceName = "\\Device\\NPF_{70AD64C5-34A6-4ECA-9FB4-B11CB6006D9A}" // my wifi
-	// interfaceName = "\\Device\\NPF_{95A9BED4-3C01-41DD-BB5C-1244AAE94A95}" // my ethernet
-	interfaceName = "\\Device\\NPF_{96065AE6-861D-443F-96DC-5586B880BB6D}" // my ethernet
+// flags are the options of gonet replay.
+var flags = flag.NewFlagSet("replay", flag.ExitOnError)
+
+var (
+	interfaceName = flags.String("interface", "", "Interface to send on, e.g. eth0, \\Device\\NPF_{...} or \"Ethernet 2\" on Windows, one of its IP addresses or a subnet it is on; lists the interfaces when empty")
+	duration      = flags.Duration("duration", 5*time.Second, "How long to resend the first packet (without -all)")
+	pps           = flags.Float64("pps", 0, "Send at most this many packets per second, 0 for no limit")
+	mbps          = flags.Float64("mbps", 0, "Send at most this many megabits per second, 0 for no limit")
+	loop          = flags.Int("loop", 1, "Times to replay the whole file (with -all), 0 to repeat until a limit is hit")
+	maxPackets    = flags.Int("max-packets", 0, "Stop after sending this many packets in total, 0 for no limit")
+	maxDuration   = flags.Duration("max-duration", 0, "With -all, stop after this long, 0 for no limit")
+	outputPath    = flags.String("output", "", "Write the rewritten and selected packets of the files to this pcap file instead of sending them")
+	dryRunFlag    = flags.Bool("dry-run", false, "Print protocol counts, size, duration and top talkers of the files instead of sending them")
+	all           = flags.Bool("all", false, "Replay every packet of the files in order instead of resending the first one")
+	workers       = flags.Int("workers", 1, "With -all, send from this many goroutines and pcap handles, packets of a flow stay on one")
+	preload       = flags.Bool("preload", false, "With -all, read the files into memory before replaying them, for top speed and steady timing")
+	interleave    = flags.Bool("interleave", false, "With -all and several files, merge them by timestamp instead of replaying them one after the other")
+	speed         = flags.Float64("speed", 1, "With -all, replay this many times faster than captured, e.g. 0.5 for half speed")
+	topspeed      = flags.Bool("topspeed", false, "With -all, ignore the capture timestamps and send as fast as possible")
+	rewriteSrcMAC = flags.String("rewrite-srcmac", "", "Source MAC to put in every frame, or auto for the MAC of -interface")
+	rewriteDstMAC = flags.String("rewrite-dstmac", "", "Destination MAC to put in every frame, or auto to ARP for each IPv4 destination")
+	startPacket   = flags.Int("start-packet", 0, "Number of the first packet to replay, counting from 1 as Wireshark does")
+	endPacket     = flags.Int("end-packet", 0, "Number of the last packet to replay, 0 for the end of the file")
+	startTimeFlag = flags.String("start-time", "", "Skip packets captured before this, an offset into the capture like 30s, an RFC 3339 time or epoch seconds")
+	endTimeFlag   = flags.String("end-time", "", "Stop at packets captured after this, in the same formats as -start-time")
+	truncated     = flags.String("truncated", "skip", "What to do with packets the capture snaplen cut short: pad (with zeros to their wire length), skip or fail")
+	fixCsums      = flags.Bool("fix-csums", false, "Recompute the IPv4, TCP and UDP checksums of every packet, not only rewritten ones")
+	busyWait      = flags.Duration("busy-wait", time.Millisecond, "Spin instead of sleeping for this long before each packet is due, for precise gaps at the cost of a CPU; 0 to only sleep")
+	report        = flags.Duration("report", time.Second, "Interval between progress reports, 0 to disable")
+	jsonSummary   = flags.String("json", "", "Write a JSON summary of the replay to this file when done, - for stdout")
+	vlanStrip     = flags.Bool("vlan-strip", false, "Remove the 802.1Q tags of every frame, applied before -vlan-push")
+	vlanPush      = flags.Int("vlan-push", -1, "Add an 802.1Q tag with this VLAN ID to every frame, -1 for none")
+	vlanPCP       = flags.Int("vlan-pcp", 0, "Priority (PCP, 0-7) of the tag added by -vlan-push")
+	gateway       = flags.String("gateway", "", "With -rewrite-dstmac auto, router to send packets for off-link destinations to")
+	anonymize     = flags.Bool("anonymize", false, "Replace IP addresses prefix-preserving and scramble MAC addresses, keyed by -anon-key")
+	anonKey       = flags.String("anon-key", "", "Hex key for -anonymize, the same key gives the same addresses; default the key of -anon-map or a random one")
+	anonMap       = flags.String("anon-map", "", "JSON file keeping the -anonymize key and the original to anonymized addresses across runs")
+
+	interface2       = flags.String("interface2", "", "With -all, send the other direction of the capture out of this interface, see -split")
+	split            = flags.String("split", "auto", "With -interface2, packets leaving -interface: auto for the side starting each flow, sources in a network or an address, or frames from a MAC address")
+	tcpClient        = flags.Bool("tcp-client", false, "Replay only the client side of the TCP sessions in the files against a live server, following its sequence numbers")
+	tcpWait          = flags.Duration("tcp-wait", 2*time.Second, "With -tcp-client, how long to wait for a quiet server before going on")
+	responsesPath    = flags.String("capture-responses", "", "With -all, save the packets answering the replayed flows to this pcap file and count them")
+	captureInterface = flags.String("capture-interface", "", "Interface to capture responses on, default -interface; setting it alone only counts them")
+	captureFilter    = flags.String("capture-filter", "", "BPF filter narrowing the response capture, e.g. \"host 192.168.50.10\"")
+	responseWait     = flags.Duration("response-wait", time.Second, "How long to keep capturing responses, and on -verify-interface, after the replay")
+	serveAddr        = flags.String("serve", "", "Run as a remote replay agent with an HTTP API on this address, e.g. :9999 for loopback or 0.0.0.0:9999 with -token, see serve.go")
+	serveDir         = flags.String("serve-dir", "captures", "With -serve, directory keeping the uploaded captures")
+	verifyInterface  = flags.String("verify-interface", "", "With -all, capture on this interface behind the device under test and report the replayed packets it dropped, reordered or modified")
+	configFile       = flags.String("config", "", "YAML or JSON file setting flags by name and the pcap files as a files list, command line flags and files win")
+	logs             = logging.RegisterFlags(flags)
+	serveAuth        = apiauth.RegisterFlags(flags)
+	record           = results.RegisterFlags(flags)
 
-	duration = 5 * time.Second
+	ipRewriteRules   listFlag
+	portRewriteRules listFlag
+	patchRules       listFlag
 )
 
-func main() {
-	if len(os.Args) < 2 {
-		log.Fatalf("Usage: %s <pcap file>\n", os.Args[0])
+// output gets the progress reports, stderr when the JSON summary goes to
+// stdout.
+var output io.Writer = os.Stdout
+
+// listFlag collects the values of a repeatable command line flag.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// Main runs gonet replay with the arguments after the command name.
+func Main(args []string) {
+	if len(args) > 0 {
+		switch args[0] {
+		case "analyze":
+			analyzeCommand(args[1:])
+			return
+		case "merge":
+			mergeCommand(args[1:])
+			return
+		case "split":
+			splitCommand(args[1:])
+			return
+		}
 	}
 
-	// List all available interfaces
-	devices, err := pcap.FindAllDevs()
+	flags.Var(&ipRewriteRules, "rewrite-ip", "Map addresses of one network onto another as cidr=cidr, e.g. 10.0.0.0/24=192.168.50.0/24 (repeatable)")
+	flags.Var(&portRewriteRules, "rewrite-port", "Map a TCP/UDP port onto another as port=port, e.g. 80=8080 (repeatable)")
+	flags.Var(&patchRules, "patch", "Overwrite bytes of every frame as offset=N,hex=BYTES, only in frames matching a BPF filter with ,filter=EXPR at the end, e.g. offset=42,hex=deadbeef,filter=udp port 53 (repeatable)")
+	flags.Parse(args)
+	patterns := flags.Args()
+	sections, err := config.LoadFlags(flags, *configFile, "files")
 	if err != nil {
-		log.Fatalf("Failed to find devices: %v", err)
+		log.Fatalf("Invalid -config: %v", err)
+	}
+	if err := logs.Setup(); err != nil {
+		log.Fatal(err)
+	}
+	rec, err := record.Recorder(flags)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(patterns) == 0 && sections["files"] != nil {
+		if err := config.Decode(sections["files"], &patterns); err != nil {
+			log.Fatalf("Invalid files in %s: %v", *configFile, err)
+		}
+	}
+	if *outputPath != "" {
+		// Writing a file needs neither pacing nor the first packet mode.
+		*all, *topspeed = true, true
+		*pps, *mbps = 0, 0
+	}
+	if *interfaceName == "" && !*dryRunFlag && *outputPath == "" {
+		if err := ifaceutil.ListDevices(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		log.Fatal("No interface given, choose one of the above with -interface.")
+	}
+	for _, name := range []*string{interfaceName, interface2, captureInterface, verifyInterface} {
+		if *name == "" {
+			continue
+		}
+		device, err := ifaceutil.Resolve(*name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		*name = device
+	}
+
+	if *serveAddr != "" {
+		sendHandle, err := pcap.OpenLive(*interfaceName, 1600, true, pcap.BlockForever)
+		if err != nil {
+			log.Fatalf("Failed to open device %s: %v", *interfaceName, err)
+		}
+		defer sendHandle.Close()
+		if err := serve(*serveAddr, *serveDir, serveAuth.Resolve(), sendHandle); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 
-	if len(devices) == 0 {
-		log.Fatal("No devices found.")
+	if len(patterns) < 1 {
+		log.Fatal("Usage: gonet replay -interface <name> [-all] <pcap file or glob>...")
 	}
 
-	// fmt.Println("Available devices:")
-	// for _, device := range devices {
-	// 	fmt.Printf("Name: %s\n", device.Name)
-	// 	fmt.Printf("Description: %s\n", device.Description)
-	// 	fmt.Println("Addresses:")
-	// 	for _, address := range device.Addresses {
-	// 		fmt.Printf("  IP: %s, Netmask: %s\n", address.IP, address.Netmask)
-	// 	}
-	// 	fmt.Println("-----------------------------------")
-	// }
+	if *jsonSummary == "-" {
+		output = os.Stderr
+	}
 
-	pcapFile := os.Args[1]
-	handle, err := pcap.OpenOffline(pcapFile)
+	if *speed <= 0 {
+		log.Fatalf("Invalid -speed %v, must be above 0", *speed)
+	}
+
+	if selection, err = parseRange(); err != nil {
+		log.Fatalf("Invalid packet selection: %v", err)
+	}
+	if err := parseTruncated(); err != nil {
+		log.Fatal(err)
+	}
+
+	files, err := expandFiles(patterns)
+	if err != nil {
+		log.Fatalf("Invalid pcap files: %v", err)
+	}
+
+	if *dryRunFlag {
+		for _, file := range files {
+			if err := dryRun(file); err != nil {
+				slog.Warn("Failed to read pcap file", "file", file, "err", err)
+			}
+		}
+		return
+	}
+
+	linkType, err := captureLinkType(files)
 	if err != nil {
 		log.Fatalf("Failed to open pcap file: %v", err)
 	}
+
+	// Open network interface for packet injection, with -output only
+	// needed for ARP.
+	var sendHandle *pcap.Handle
+	if *interfaceName != "" {
+		sendHandle, err = pcap.OpenLive(*interfaceName, 1600, true, pcap.BlockForever)
+		if err != nil {
+			log.Fatalf("Failed to open device %s: %v", *interfaceName, err)
+		}
+		defer sendHandle.Close()
+	}
+
+	if err := setupRewrites(sendHandle, *interfaceName, linkType); err != nil {
+		log.Fatalf("Failed to set up rewriting: %v", err)
+	}
+	if rewrites != nil && rewrites.autoDst != nil {
+		defer rewrites.autoDst.Close()
+	}
+
+	// The summary is written last, after the anonymization mapping is
+	// saved, as failed assertions end the replay there. A failed replay
+	// sets replayErr and returns rather than exiting, so the summary of
+	// what was sent so far is still written, and exits here.
+	sess := &session{start: time.Now()}
+	var summaries []fileSummary
+	var responses *responseSummary
+	var verified *verifySummary
+	var replayErr error
+	defer func() {
+		sum := newSummary(sess.start, summaries, responses, verified)
+		if *jsonSummary != "" {
+			if err := writeSummary(*jsonSummary, sum); err != nil {
+				slog.Error("Failed to write JSON summary", "err", err)
+			}
+		}
+		rec.Set(sum.metrics())
+		_, err := rec.Finish(sum, replayErr)
+		if replayErr != nil {
+			log.Fatal(replayErr)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+	}()
+	if rewrites != nil && rewrites.anon != nil {
+		defer func() {
+			if err := rewrites.anon.save(); err != nil {
+				slog.Warn("Failed to save the anonymization mapping", "err", err)
+			}
+		}()
+	}
+	if *report > 0 {
+		stop := make(chan struct{})
+		defer close(stop)
+		go reportStats(&sess.progress, *report, stop)
+	}
+
+	if *tcpClient {
+		if sendHandle == nil {
+			replayErr = errors.New("-tcp-client needs -interface")
+			return
+		}
+		replayTCPClient(sendHandle, *interfaceName, files, linkType, &sess.progress)
+		fmt.Fprintln(output, "Packet replay completed.")
+		return
+	}
+
+	if *all {
+		var out *sender
+		if *outputPath != "" {
+			slog.Info("Writing packets", "file", *outputPath)
+			if out, err = newFileSender(*outputPath, linkType, &sess.progress); err != nil {
+				replayErr = fmt.Errorf("Failed to create %s: %v", *outputPath, err)
+				return
+			}
+		} else {
+			slog.Info("Starting packet replay")
+			if out, err = newSender(sendHandle, *interfaceName, *interface2, *workers, linkType, &sess.progress); err != nil {
+				replayErr = fmt.Errorf("Failed to open device %s: %v", *interfaceName, err)
+				return
+			}
+			if *interface2 != "" {
+				if out.split, err = newSplitter(*split, linkType); err != nil {
+					replayErr = err
+					return
+				}
+				slog.Info("Splitting directions", "split", *split, "interface", *interfaceName, "interface2", *interface2)
+			}
+			if *responsesPath != "" || *captureInterface != "" {
+				device := *captureInterface
+				if device == "" {
+					device = *interfaceName
+				}
+				if out.responses, err = newResponseCapture(device, *captureFilter, *responsesPath, linkType); err != nil {
+					replayErr = fmt.Errorf("Failed to capture responses on %s: %v", device, err)
+					return
+				}
+				slog.Info("Capturing responses", "interface", device)
+			}
+			if *verifyInterface != "" {
+				if out.verify, err = newVerifier(*verifyInterface, linkType); err != nil {
+					replayErr = fmt.Errorf("Failed to capture on %s: %v", *verifyInterface, err)
+					return
+				}
+				slog.Info("Verifying the replay", "interface", *verifyInterface)
+			}
+		}
+		summaries, err = replayCaptures(out, files, sess)
+		if err != nil {
+			replayErr = err
+			return
+		}
+		if out.responses != nil {
+			s := out.responses.Close(*responseWait)
+			responses = &s
+		}
+		if out.verify != nil {
+			wait := *responseWait
+			if out.responses != nil {
+				wait = 0
+			}
+			s := out.verify.Close(wait)
+			verified = &s
+		}
+		if err := out.Close(); err != nil {
+			replayErr = fmt.Errorf("Failed to write packets to %s: %v", *outputPath, err)
+			return
+		}
+		fmt.Fprintln(output, "Packet replay completed.")
+		return
+	}
+
+	// Without -all only the first file is used.
+	pcapFile := files[0]
+	handle, err := pcap.OpenOffline(pcapFile)
+	if err != nil {
+		replayErr = fmt.Errorf("Failed to open pcap file: %v", err)
+		return
+	}
 	defer handle.Close()
 
 	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
 	firstPacket := []byte{}
+	index := 0
+	var captureStart time.Time
 
+	// The first packet of the selected range is the one resent.
 	for packet := range packetSource.Packets() {
-		firstPacket = packet.Data()
-		break
+		index++
+		if index == 1 {
+			captureStart = packet.Metadata().Timestamp
+		}
+		skip, done := selection.check(index, packet.Metadata().Timestamp, captureStart)
+		if done {
+			break
+		}
+		if skip {
+			continue
+		}
+		data, ci := packet.Data(), packet.Metadata().CaptureInfo
+		data, ok, err := handleTruncated(data, &ci, pcapFile, index)
+		if err != nil {
+			replayErr = err
+			return
+		}
+		if ok {
+			firstPacket = rewrite(data)
+			break
+		}
 	}
 
 	if len(firstPacket) == 0 {
-		log.Fatal("No packets found in PCAP file.")
-	}
-
-	// Open network interface for packet injection
-	sendHandle, err := pcap.OpenLive(interfaceName, 1600, true, pcap.BlockForever)
-	if err != nil {
-		log.Fatalf("Failed to open device %s: %v", interfaceName, err)
+		replayErr = errors.New("No packets found in PCAP file.")
+		return
 	}
-	defer sendHandle.Close()
 
-	log.Println("Starting packet replay...")
+	slog.Info("Starting packet replay")
 	startTime := time.Now()
 	packetsSent := 0
+	var p pacer
 
-	for time.Since(startTime) < duration {
-		err = sendHandle.WritePacketData(firstPacket)
-		if err != nil {
-			log.Fatalf("Failed to send packet: %v", err)
+	for time.Since(startTime) < *duration && (*maxPackets == 0 || packetsSent < *maxPackets) {
+		sleepUntil(p.due(len(firstPacket)))
+		if err := sendHandle.WritePacketData(firstPacket); err != nil {
+			replayErr = fmt.Errorf("Failed to send packet: %v", err)
+			break
 		}
 		packetsSent++
+		sess.progress.sent.Add(1)
+		sess.progress.bytes.Add(int64(len(firstPacket)))
 	}
 
-	// log.Printf("Sent %d packets in %v\n", packetsSent, duration)
-	// fmt.Println("Packet replay completed.")
-
 	// Calculate transmission speed
 	elapsedTime := time.Since(startTime).Seconds()
 	totalBytesSent := packetsSent * len(firstPacket)
 	mbps := (float64(totalBytesSent) * 8) / (elapsedTime * 1_000_000)
 
-	log.Printf("Sent %d packets (%d bytes each) in %.2f seconds", packetsSent, len(firstPacket), elapsedTime)
-	log.Printf("Transmission speed: %.2f Mbps", mbps)
-	fmt.Println("Packet replay completed.")
+	slog.Info("Replay done", "packets", packetsSent, "size", len(firstPacket), "seconds", elapsedTime, "mbps", mbps)
+	if replayErr == nil {
+		fmt.Fprintln(output, "Packet replay completed.")
+	}
+
+	summaries = append(summaries, replayStats{
+		file:    pcapFile,
+		packets: packetsSent,
+		sent:    packetsSent,
+		bytes:   totalBytesSent,
+		elapsed: time.Since(startTime),
+	}.summary(1))
 }
@@ -0,0 +1,54 @@
+package gopackets
+
+import "time"
+
+// maxBurst is how far a pacer may fall behind before it stops catching
+// up. Sleeps are coarse, especially on Windows, so packets due during an
+// oversleep go out back to back rather than being lost from the rate; but
+// an idle gap, e.g. from the capture timing, must not turn into a burst.
+const maxBurst = 50 * time.Millisecond
+
+// pacer spaces packets out to stay under -pps and -mbps.
+type pacer struct {
+	next time.Time
+}
+
+func (p *pacer) limited() bool {
+	return *pps > 0 || *mbps > 0
+}
+
+// due reserves a slot for a packet of size bytes and returns when it may
+// be sent.
+func (p *pacer) due(size int) time.Time {
+	now := time.Now()
+	if !p.limited() {
+		return now
+	}
+
+	var interval time.Duration
+	if *pps > 0 {
+		interval = time.Duration(float64(time.Second) / *pps)
+	}
+	if *mbps > 0 {
+		interval = max(interval, time.Duration(float64(size*8)/(*mbps*1_000_000)*float64(time.Second)))
+	}
+
+	if now.Sub(p.next) > maxBurst {
+		p.next = now
+	}
+	due := p.next
+	p.next = p.next.Add(interval)
+	return due
+}
+
+// sleepUntil waits until the absolute deadline t. The OS timer wakes up
+// late by up to a millisecond or more, which would quantize gaps of tens
+// of microseconds, so the last -busy-wait before t is spun on the clock
+// instead of slept.
+func sleepUntil(t time.Time) {
+	if wait := time.Until(t) - *busyWait; wait > 0 {
+		time.Sleep(wait)
+	}
+	for time.Now().Before(t) {
+	}
+}
@@ -0,0 +1,87 @@
+package gopackets
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// patchRule overwrites bytes of a frame at a fixed offset, only in frames
+// matching filter when it is set.
+type patchRule struct {
+	offset int
+	bytes  []byte
+	filter *pcap.BPF
+}
+
+// parsePatchRule parses "offset=42,hex=deadbeef[,filter=udp port 53]".
+// The filter comes last and runs to the end of the rule, so it may hold
+// commas.
+func parsePatchRule(rule string, linkType layers.LinkType) (patchRule, error) {
+	var p patchRule
+	offset, data := false, false
+	rest := rule
+	for rest != "" {
+		var field string
+		field, rest, _ = strings.Cut(rest, ",")
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return patchRule{}, fmt.Errorf("invalid patch %q, want offset=N,hex=BYTES[,filter=BPF]", rule)
+		}
+		switch key {
+		case "offset":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return patchRule{}, fmt.Errorf("invalid patch offset %q", value)
+			}
+			p.offset, offset = n, true
+		case "hex":
+			b, err := hex.DecodeString(value)
+			if err != nil || len(b) == 0 {
+				return patchRule{}, fmt.Errorf("invalid patch bytes %q", value)
+			}
+			p.bytes, data = b, true
+		case "filter":
+			if rest != "" {
+				value += "," + rest
+				rest = ""
+			}
+			f, err := pcap.NewBPF(linkType, 262144, value)
+			if err != nil {
+				return patchRule{}, fmt.Errorf("invalid patch filter %q: %v", value, err)
+			}
+			p.filter = f
+		default:
+			return patchRule{}, fmt.Errorf("invalid patch %q, unknown %q", rule, key)
+		}
+	}
+	if !offset || !data {
+		return patchRule{}, fmt.Errorf("invalid patch %q, want offset=N,hex=BYTES[,filter=BPF]", rule)
+	}
+	return p, nil
+}
+
+// applyPatches writes the -patch rules into a frame as captured, reporting
+// whether any did. Frames too short for a rule are left alone.
+func applyPatches(rules []patchRule, data []byte) bool {
+	patched := false
+	for _, p := range rules {
+		if p.offset+len(p.bytes) > len(data) {
+			continue
+		}
+		if p.filter != nil {
+			ci := gopacket.CaptureInfo{CaptureLength: len(data), Length: len(data)}
+			if !p.filter.Matches(ci, data) {
+				continue
+			}
+		}
+		copy(data[p.offset:], p.bytes)
+		patched = true
+	}
+	return patched
+}
@@ -0,0 +1,203 @@
+package gopackets
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+
+	"gonet/pkg/logging"
+)
+
+// maxOpenSplits caps the files split -flows keeps open; past it they are
+// all closed and reopened for appending as their flows come back.
+const maxOpenSplits = 256
+
+// mergeCommand runs "go_packets merge -out file files...", combining the
+// captures into one sorted by timestamp, as -interleave replays them.
+func mergeCommand(args []string) {
+	fs := flag.NewFlagSet("merge", flag.ExitOnError)
+	out := fs.String("out", "", "Pcap file to write")
+	logs := logging.RegisterFlags(fs)
+	fs.Parse(args)
+	if err := logs.Setup(); err != nil {
+		log.Fatal(err)
+	}
+	if *out == "" || fs.NArg() < 1 {
+		log.Fatal("Usage: gonet replay merge -out <file> <pcap file or glob>...")
+	}
+	files, err := expandFiles(fs.Args())
+	if err != nil {
+		log.Fatalf("Invalid pcap files: %v", err)
+	}
+	linkType, err := captureLinkType(files)
+	if err != nil {
+		log.Fatalf("Failed to open pcap file: %v", err)
+	}
+
+	var sources []gopacket.PacketDataSource
+	for _, file := range files {
+		handle, err := pcap.OpenOffline(file)
+		if err != nil {
+			log.Fatalf("Failed to open pcap file %s: %v", file, err)
+		}
+		defer handle.Close()
+		sources = append(sources, handle)
+	}
+	dump, err := createPcapDump(*out, linkType)
+	if err != nil {
+		log.Fatalf("Failed to create %s: %v", *out, err)
+	}
+
+	merged := newMergedSource(sources)
+	packets := 0
+	for {
+		data, ci, err := merged.ReadPacketData()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			log.Fatalf("Failed to read packet: %v", err)
+		}
+		if err := dump.writePacket(ci.Timestamp, data, ci.Length); err != nil {
+			log.Fatalf("Failed to write %s: %v", *out, err)
+		}
+		packets++
+	}
+	if err := dump.Close(); err != nil {
+		log.Fatalf("Failed to write %s: %v", *out, err)
+	}
+	slog.Info("Merged files", "packets", packets, "files", len(files), "out", *out)
+}
+
+// splitCommand runs "go_packets split -out prefix [-time d | -count n |
+// -flows] file", cutting a capture into prefix-0001.pcap and on, or a
+// file per flow.
+func splitCommand(args []string) {
+	fs := flag.NewFlagSet("split", flag.ExitOnError)
+	out := fs.String("out", "", "Prefix of the pcap files to write")
+	window := fs.Duration("time", 0, "Start a new file every this long of capture time")
+	count := fs.Int("count", 0, "Start a new file every this many packets")
+	byFlow := fs.Bool("flows", false, "Write each flow, both directions, to its own file; packets without IP go to prefix-other.pcap")
+	logs := logging.RegisterFlags(fs)
+	fs.Parse(args)
+	if err := logs.Setup(); err != nil {
+		log.Fatal(err)
+	}
+	modes := 0
+	for _, set := range []bool{*window > 0, *count > 0, *byFlow} {
+		if set {
+			modes++
+		}
+	}
+	if *out == "" || fs.NArg() != 1 || modes != 1 {
+		log.Fatal("Usage: gonet replay split -out <prefix> -time <duration> | -count <packets> | -flows <pcap file>")
+	}
+
+	file := fs.Arg(0)
+	handle, err := pcap.OpenOffline(file)
+	if err != nil {
+		log.Fatalf("Failed to open pcap file %s: %v", file, err)
+	}
+	defer handle.Close()
+	linkType := handle.LinkType()
+
+	s := &splitWriter{prefix: *out, linkType: linkType, keepOpen: *byFlow, open: make(map[string]*pcapDump), created: make(map[string]bool)}
+	flows := make(map[flowKey]string)
+	var start time.Time
+	packets := 0
+	for {
+		data, ci, err := handle.ReadPacketData()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			log.Fatalf("Failed to read packet: %v", err)
+		}
+		if packets == 0 {
+			start = ci.Timestamp
+		}
+
+		var name string
+		switch {
+		case *window > 0:
+			name = fmt.Sprintf("%04d", max(ci.Timestamp.Sub(start)/(*window), 0)+1)
+		case *count > 0:
+			name = fmt.Sprintf("%04d", packets / *count + 1)
+		default:
+			name = "other"
+			if key, ok := packetFlow(linkType, data); ok {
+				// Both directions share the key starting at the lower
+				// address.
+				if rev := key.reverse(); rev.src.Compare(key.src) < 0 {
+					key = rev
+				}
+				if name = flows[key]; name == "" {
+					name = fmt.Sprintf("flow-%04d", len(flows)+1)
+					flows[key] = name
+					fmt.Printf("%s-%s.pcap %s %s <-> %s\n", *out, name, layers.IPProtocol(key.proto), key.src, key.dst)
+				}
+			}
+		}
+		if err := s.write(name, data, ci); err != nil {
+			log.Fatal(err)
+		}
+		packets++
+	}
+	if err := s.Close(); err != nil {
+		log.Fatal(err)
+	}
+	slog.Info("Split file", "packets", packets, "file", file, "files", len(s.created))
+}
+
+// splitWriter writes packets to prefix-name.pcap files.
+type splitWriter struct {
+	prefix   string
+	linkType layers.LinkType
+	keepOpen bool // with -time and -count only the latest file is open
+	open     map[string]*pcapDump
+	created  map[string]bool
+}
+
+func (s *splitWriter) write(name string, data []byte, ci gopacket.CaptureInfo) error {
+	dump := s.open[name]
+	if dump == nil {
+		if !s.keepOpen || len(s.open) >= maxOpenSplits {
+			if err := s.Close(); err != nil {
+				return err
+			}
+		}
+		path := fmt.Sprintf("%s-%s.pcap", s.prefix, name)
+		var err error
+		if s.created[name] {
+			dump, err = appendPcapDump(path)
+		} else {
+			dump, err = createPcapDump(path, s.linkType)
+		}
+		if err != nil {
+			return err
+		}
+		s.open[name] = dump
+		s.created[name] = true
+	}
+	return dump.writePacket(ci.Timestamp, data, ci.Length)
+}
+
+// Close closes the open files, they may be reopened by write.
+func (s *splitWriter) Close() error {
+	var err error
+	for name, dump := range s.open {
+		if closeErr := dump.Close(); err == nil && closeErr != nil {
+			err = fmt.Errorf("%s-%s.pcap: %v", s.prefix, name, closeErr)
+		}
+		delete(s.open, name)
+	}
+	return err
+}
@@ -0,0 +1,118 @@
+package gopackets
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"runtime"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcap"
+)
+
+// memoryCapture is a capture read into memory by -preload, with the
+// rewrites already applied, so replays don't wait on the disk or decoding
+// and loops reuse it.
+type memoryCapture struct {
+	name    string
+	files   []string
+	packets []memoryPacket
+	bytes   int64
+}
+
+type memoryPacket struct {
+	data []byte
+	ci   gopacket.CaptureInfo
+}
+
+// preloadCaptures reads files into memory, one capture per file or a
+// single merged one with -interleave, and reports the memory used.
+func preloadCaptures(files []string) ([]*memoryCapture, error) {
+	var captures []*memoryCapture
+	if *interleave {
+		var sources []gopacket.PacketDataSource
+		for _, file := range files {
+			handle, err := pcap.OpenOffline(file)
+			if err != nil {
+				return nil, err
+			}
+			defer handle.Close()
+			sources = append(sources, handle)
+		}
+		c, err := loadCapture(newMergedSource(sources), strings.Join(files, "+"), files)
+		if err != nil {
+			return nil, err
+		}
+		captures = append(captures, c)
+	} else {
+		for _, file := range files {
+			handle, err := pcap.OpenOffline(file)
+			if err != nil {
+				return nil, err
+			}
+			c, err := loadCapture(handle, file, []string{file})
+			handle.Close()
+			if err != nil {
+				return nil, err
+			}
+			captures = append(captures, c)
+		}
+	}
+
+	var packets int
+	var bytes int64
+	for _, c := range captures {
+		packets += len(c.packets)
+		bytes += c.bytes
+	}
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	slog.Info("Preloaded packets", "packets", packets, "bytes", bytes, "heap_bytes", mem.HeapAlloc)
+	return captures, nil
+}
+
+func loadCapture(src gopacket.PacketDataSource, name string, files []string) (*memoryCapture, error) {
+	c := &memoryCapture{name: name, files: files}
+	for {
+		data, ci, err := src.ReadPacketData()
+		if errors.Is(err, io.EOF) {
+			return c, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		// Padding has to come before the rewrites; skipped packets are
+		// kept to be counted in the replay.
+		if ci.CaptureLength < ci.Length && *truncated != "skip" {
+			if data, _, err = handleTruncated(data, &ci, name, len(c.packets)+1); err != nil {
+				return nil, err
+			}
+		}
+		c.packets = append(c.packets, memoryPacket{data: rewrite(data), ci: ci})
+		c.bytes += int64(len(data))
+	}
+}
+
+// replay sends the capture once.
+func (c *memoryCapture) replay(out *sender, sess *session) replayStats {
+	sess.progress.startFile(c.files...)
+	stats := replayFile(out, &memorySource{packets: c.packets}, c.name, sess)
+	stats.print()
+	return stats
+}
+
+// memorySource reads a memoryCapture from the start.
+type memorySource struct {
+	packets []memoryPacket
+	next    int
+}
+
+func (s *memorySource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	if s.next == len(s.packets) {
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	}
+	p := s.packets[s.next]
+	s.next++
+	return p.data, p.ci, nil
+}
@@ -0,0 +1,85 @@
+package gopackets
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// timeBound is a point in a capture, either an offset from its first
+// packet or an absolute time.
+type timeBound struct {
+	offset   time.Duration
+	absolute time.Time
+	set      bool
+}
+
+// parseTimeBound accepts an offset like 90s or 1m30s, an RFC 3339 time,
+// or seconds since the epoch as Wireshark shows them.
+func parseTimeBound(s string) (timeBound, error) {
+	if s == "" {
+		return timeBound{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return timeBound{offset: d, set: true}, nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return timeBound{absolute: t, set: true}, nil
+	}
+	if secs, err := strconv.ParseFloat(s, 64); err == nil {
+		return timeBound{absolute: time.Unix(0, int64(secs*1e9)), set: true}, nil
+	}
+	return timeBound{}, fmt.Errorf("invalid time %q, want an offset like 30s, an RFC 3339 time or epoch seconds", s)
+}
+
+func (b timeBound) at(captureStart time.Time) time.Time {
+	if b.absolute.IsZero() {
+		return captureStart.Add(b.offset)
+	}
+	return b.absolute
+}
+
+// packetRange selects the slice of a capture to replay. Packet numbers
+// count from 1 like in Wireshark; zero values don't limit.
+type packetRange struct {
+	startPacket, endPacket int
+	startTime, endTime     timeBound
+}
+
+// selection is the range given with -start-packet, -end-packet,
+// -start-time and -end-time.
+var selection packetRange
+
+func parseRange() (packetRange, error) {
+	r := packetRange{startPacket: *startPacket, endPacket: *endPacket}
+	if r.startPacket < 0 || r.endPacket < 0 || (r.endPacket > 0 && r.endPacket < r.startPacket) {
+		return r, fmt.Errorf("invalid packet range %d-%d", r.startPacket, r.endPacket)
+	}
+	var err error
+	if r.startTime, err = parseTimeBound(*startTimeFlag); err != nil {
+		return r, err
+	}
+	if r.endTime, err = parseTimeBound(*endTimeFlag); err != nil {
+		return r, err
+	}
+	return r, nil
+}
+
+// check places packet number index, captured at ts, against the range.
+// skip means it comes before the range, done that it and everything after
+// it is past the end.
+func (r packetRange) check(index int, ts, captureStart time.Time) (skip, done bool) {
+	if r.endPacket > 0 && index > r.endPacket {
+		return false, true
+	}
+	if r.endTime.set && ts.After(r.endTime.at(captureStart)) {
+		return false, true
+	}
+	if index < r.startPacket {
+		return true, false
+	}
+	if r.startTime.set && ts.Before(r.startTime.at(captureStart)) {
+		return true, false
+	}
+	return false, false
+}
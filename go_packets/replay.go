@@ -0,0 +1,256 @@
+package gopackets
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcap"
+)
+
+// maxErrorLogs caps how many send failures are logged per file; the rest
+// only show up in the summary.
+const maxErrorLogs = 10
+
+// replayStats summarizes the replay of one capture file.
+type replayStats struct {
+	file    string
+	packets int // selected from the file
+	sent    int
+	failed  int
+	bytes   int
+	// truncated counts packets shorter than on the wire, padded or
+	// skipped as set by -truncated.
+	truncated int
+	elapsed   time.Duration
+	stopped   bool  // by -max-packets or -max-duration
+	err       error // that ended the replay, like a truncated packet with -truncated fail
+}
+
+// session tracks the limits and progress shared by all loops of a replay.
+type session struct {
+	start    time.Time
+	packets  int
+	pacer    pacer
+	progress progress
+	stop     atomic.Bool // set to end the session early
+}
+
+// exhausted reports whether -max-packets or -max-duration has been
+// reached, or the session was stopped.
+func (s *session) exhausted() bool {
+	return s.stop.Load() || (*maxPackets > 0 && s.packets >= *maxPackets) ||
+		(*maxDuration > 0 && time.Since(s.start) >= *maxDuration)
+}
+
+// sleepUntil waits until t, or until -max-duration ends the session.
+func (s *session) sleepUntil(t time.Time) {
+	if *maxDuration > 0 {
+		if deadline := s.start.Add(*maxDuration); deadline.Before(t) {
+			t = deadline
+		}
+	}
+	sleepUntil(t)
+}
+
+// replayCaptures replays files -loop times, one after the other or with
+// -interleave merged by timestamp. Each replay is printed and returned
+// for the JSON summary, along with the error that ended it early.
+func replayCaptures(out *sender, files []string, sess *session) ([]fileSummary, error) {
+	var preloaded []*memoryCapture
+	if *preload {
+		var err error
+		if preloaded, err = preloadCaptures(files); err != nil {
+			return nil, fmt.Errorf("failed to preload captures: %v", err)
+		}
+		// Reading the files shouldn't count against -max-duration.
+		sess.start = time.Now()
+	}
+
+	var summaries []fileSummary
+	for i := 0; *loop == 0 || i < *loop; i++ {
+		sess.progress.loop.Store(int64(i + 1))
+
+		var runs []replayStats
+		switch {
+		case preloaded != nil:
+			for _, c := range preloaded {
+				stats := c.replay(out, sess)
+				runs = append(runs, stats)
+				if stats.stopped {
+					break
+				}
+			}
+		case *interleave:
+			runs = append(runs, replayMerged(out, files, sess))
+		default:
+			for _, file := range files {
+				stats := replayOne(out, file, sess)
+				runs = append(runs, stats)
+				if stats.stopped {
+					break
+				}
+			}
+		}
+
+		packets, stopped := 0, false
+		for _, stats := range runs {
+			summaries = append(summaries, stats.summary(i+1))
+			packets += stats.packets
+			stopped = stopped || stats.stopped
+			if stats.err != nil {
+				return summaries, stats.err
+			}
+		}
+		if stopped || packets == 0 {
+			break
+		}
+	}
+	return summaries, nil
+}
+
+// replayOne replays a single capture file. Files that can't be opened are
+// skipped.
+func replayOne(out *sender, file string, sess *session) replayStats {
+	handle, err := pcap.OpenOffline(file)
+	if err != nil {
+		slog.Warn("Failed to open pcap file", "file", file, "err", err)
+		return replayStats{file: file}
+	}
+	defer handle.Close()
+
+	sess.progress.startFile(file)
+	stats := replayFile(out, handle, file, sess)
+	stats.print()
+	return stats
+}
+
+// replayMerged replays files as one capture in timestamp order.
+func replayMerged(out *sender, files []string, sess *session) replayStats {
+	var sources []gopacket.PacketDataSource
+	for _, file := range files {
+		handle, err := pcap.OpenOffline(file)
+		if err != nil {
+			slog.Warn("Failed to open pcap file", "file", file, "err", err)
+			continue
+		}
+		defer handle.Close()
+		sources = append(sources, handle)
+	}
+
+	name := strings.Join(files, "+")
+	sess.progress.startFile(files...)
+	stats := replayFile(out, newMergedSource(sources), name, sess)
+	stats.print()
+	return stats
+}
+
+// replayFile sends every packet of the capture through out in file
+// order. A packet that fails to send is counted and skipped.
+//
+// Packets keep the gaps between their capture timestamps, scaled by
+// -speed, unless -topspeed is given. -pps and -mbps cap the rate either
+// way.
+func replayFile(out *sender, handle gopacket.PacketDataSource, file string, sess *session) replayStats {
+	stats := replayStats{file: file}
+	startTime := time.Now()
+	var captureStart, firstTimestamp time.Time
+	index := 0
+	out.begin(file)
+
+	for {
+		if sess.exhausted() {
+			stats.stopped = true
+			break
+		}
+		data, ci, err := handle.ReadPacketData()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			slog.Warn("Failed to read packet", "file", file, "packet", index+1, "err", err)
+			break
+		}
+		index++
+		sess.progress.record(ci.CaptureLength)
+		if index == 1 {
+			captureStart = ci.Timestamp
+		}
+		skip, done := selection.check(index, ci.Timestamp, captureStart)
+		if done {
+			break
+		}
+		if skip {
+			continue
+		}
+		if ci.CaptureLength < ci.Length {
+			stats.truncated++
+			var ok bool
+			if data, ok, stats.err = handleTruncated(data, &ci, file, index); stats.err != nil {
+				stats.stopped = true
+				break
+			} else if !ok {
+				continue
+			}
+		}
+
+		if !*topspeed {
+			if firstTimestamp.IsZero() {
+				firstTimestamp = ci.Timestamp
+			}
+			// Captures aren't always in timestamp order; late packets are
+			// sent right away.
+			offset := float64(ci.Timestamp.Sub(firstTimestamp)) / *speed
+			sess.sleepUntil(startTime.Add(time.Duration(offset)))
+		}
+		if sess.pacer.limited() {
+			sess.sleepUntil(sess.pacer.due(len(data)))
+		}
+		if sess.exhausted() {
+			stats.stopped = true
+			break
+		}
+		stats.packets++
+		sess.packets++
+
+		if _, preloaded := handle.(*memorySource); !preloaded {
+			data = rewrite(data)
+		}
+		out.send(data, ci, index)
+	}
+
+	out.flush()
+	stats.sent = int(out.sent.Load())
+	stats.failed = int(out.failed.Load())
+	stats.bytes = int(out.bytes.Load())
+	stats.elapsed = time.Since(startTime)
+	return stats
+}
+
+func (s replayStats) mbps() float64 {
+	seconds := s.elapsed.Seconds()
+	if seconds <= 0 {
+		return 0
+	}
+	return float64(s.bytes) * 8 / (seconds * 1_000_000)
+}
+
+func (s replayStats) print() {
+	slog.Info("Replay done", "file", s.file, "sent", s.sent, "packets", s.packets, "failed", s.failed, "bytes", s.bytes, "seconds", s.elapsed.Seconds(), "mbps", s.mbps())
+	if s.err != nil {
+		slog.Error("Replay ended early", "file", s.file, "err", s.err)
+	} else if s.stopped {
+		slog.Info("Stopped early, replay limit reached", "file", s.file)
+	}
+	if s.truncated > 0 {
+		slog.Warn("Packets truncated by the capture snaplen", "file", s.file, "packets", s.truncated, "truncated", *truncated)
+	}
+	if s.failed > maxErrorLogs {
+		slog.Warn("Further send errors not shown", "file", s.file, "errors", s.failed-maxErrorLogs)
+	}
+}
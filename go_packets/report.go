@@ -0,0 +1,200 @@
+package gopackets
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// progress is what the interval reports show, updated by the sender and
+// read by the reporter.
+type progress struct {
+	sent     atomic.Int64
+	bytes    atomic.Int64
+	loop     atomic.Int64
+	fileRead atomic.Int64 // estimated bytes of the capture file read
+	fileSize atomic.Int64
+	overhead int // per packet record bytes besides the data
+}
+
+// recordOverhead estimates the bytes a packet record takes in the capture
+// file besides the packet data, from the file's magic number. pcapng
+// blocks vary; enhanced packet blocks are assumed.
+func recordOverhead(path string) (size int64, overhead int) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 16
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, 16
+	}
+	magic := make([]byte, 4)
+	if _, err := f.Read(magic); err == nil && binary.BigEndian.Uint32(magic) == 0x0a0d0d0a {
+		return info.Size(), 32
+	}
+	return info.Size(), 16
+}
+
+// startFile resets the file progress for a replay of paths, several when
+// they are interleaved.
+func (p *progress) startFile(paths ...string) {
+	var total int64
+	for _, path := range paths {
+		size, overhead := recordOverhead(path)
+		total += size
+		p.overhead = overhead
+	}
+	p.fileRead.Store(0)
+	p.fileSize.Store(total)
+}
+
+// record accounts for a packet of captureLength bytes read from the file.
+func (p *progress) record(captureLength int) {
+	if p.overhead == 32 {
+		captureLength = (captureLength + 3) &^ 3 // pcapng pads to 32 bits
+	}
+	p.fileRead.Add(int64(p.overhead + captureLength))
+}
+
+// reportStats prints the rates of the last interval until stop is closed.
+func reportStats(p *progress, interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	startTime := time.Now()
+	var lastPackets, lastBytes int64
+
+	for {
+		select {
+		case <-ticker.C:
+			currentPackets := p.sent.Load()
+			currentBytes := p.bytes.Load()
+			intervalPackets := currentPackets - lastPackets
+			intervalBytes := currentBytes - lastBytes
+			lastPackets = currentPackets
+			lastBytes = currentBytes
+
+			seconds := interval.Seconds()
+			bitrate := float64(intervalBytes) * 8 / seconds / 1_000_000 // Mbps
+			avgPacketRate := float64(currentPackets) / time.Since(startTime).Seconds()
+
+			file := "-"
+			if size := p.fileSize.Load(); size > 0 {
+				file = fmt.Sprintf("%.0f%%", min(100, float64(p.fileRead.Load())*100/float64(size)))
+			}
+			fmt.Fprintf(output, "Outgoing bitrate: %.2f Mbps | Packets: %d (%.0f pps, %.2f pps avg) | Total sent: %.2f MB | File: %s | Loop: %d\n",
+				bitrate, intervalPackets, float64(intervalPackets)/seconds, avgPacketRate, float64(currentBytes)/1_000_000, file, p.loop.Load())
+
+		case <-stop:
+			return
+		}
+	}
+}
+
+// fileSummary is the JSON form of replayStats.
+type fileSummary struct {
+	File      string  `json:"file"`
+	Loop      int     `json:"loop"`
+	Packets   int     `json:"packets"`
+	Sent      int     `json:"sent"`
+	Failed    int     `json:"failed"`
+	Truncated int     `json:"truncated,omitempty"`
+	Bytes     int     `json:"bytes"`
+	Seconds   float64 `json:"seconds"`
+	Mbps      float64 `json:"mbps"`
+	Stopped   bool    `json:"stopped,omitempty"`
+}
+
+// summary is written by -json when the replay ends.
+type summary struct {
+	Interface string        `json:"interface"`
+	Start     time.Time     `json:"start"`
+	Seconds   float64       `json:"seconds"`
+	Loops     int           `json:"loops"`
+	Packets   int           `json:"packets"`
+	Sent      int           `json:"sent"`
+	Failed    int           `json:"failed"`
+	Bytes     int           `json:"bytes"`
+	PPS       float64       `json:"pps"`
+	Mbps      float64       `json:"mbps"`
+	Files     []fileSummary `json:"files"`
+
+	Responses *responseSummary `json:"responses,omitempty"`
+	Verify    *verifySummary   `json:"verify,omitempty"`
+}
+
+func (s replayStats) summary(loop int) fileSummary {
+	return fileSummary{
+		File:      s.file,
+		Loop:      loop,
+		Packets:   s.packets,
+		Sent:      s.sent,
+		Failed:    s.failed,
+		Truncated: s.truncated,
+		Bytes:     s.bytes,
+		Seconds:   s.elapsed.Seconds(),
+		Mbps:      s.mbps(),
+		Stopped:   s.stopped,
+	}
+}
+
+// newSummary totals the replays of a session started at start.
+func newSummary(start time.Time, files []fileSummary, responses *responseSummary, verified *verifySummary) summary {
+	sum := summary{Interface: *interfaceName, Start: start, Seconds: time.Since(start).Seconds(), Files: files, Responses: responses, Verify: verified}
+	for _, f := range files {
+		sum.Loops = max(sum.Loops, f.Loop)
+		sum.Packets += f.Packets
+		sum.Sent += f.Sent
+		sum.Failed += f.Failed
+		sum.Bytes += f.Bytes
+	}
+	if sum.Seconds > 0 {
+		sum.PPS = float64(sum.Sent) / sum.Seconds
+		sum.Mbps = float64(sum.Bytes) * 8 / (sum.Seconds * 1_000_000)
+	}
+	return sum
+}
+
+// metrics returns the summary as -results metrics.
+func (s summary) metrics() map[string]float64 {
+	m := map[string]float64{
+		"packets":    float64(s.Packets),
+		"sent":       float64(s.Sent),
+		"failed":     float64(s.Failed),
+		"bytes":      float64(s.Bytes),
+		"pps":        s.PPS,
+		"mbps":       s.Mbps,
+		"duration_s": s.Seconds,
+	}
+	if r := s.Responses; r != nil {
+		m["flows"] = float64(r.Flows)
+		m["answered_flows"] = float64(r.AnsweredFlows)
+		m["replies"] = float64(r.Replies)
+	}
+	if v := s.Verify; v != nil {
+		m["verify_received"] = float64(v.Received)
+		m["verify_dropped"] = float64(len(v.Dropped))
+		m["verify_reordered"] = float64(len(v.Reordered))
+		m["verify_modified"] = float64(len(v.Modified))
+	}
+	return m
+}
+
+// writeSummary writes sum as JSON to path, "-" being stdout.
+func writeSummary(path string, sum summary) error {
+	out, err := json.MarshalIndent(sum, "", "  ")
+	if err != nil {
+		return err
+	}
+	out = append(out, '\n')
+	if path == "-" {
+		_, err = os.Stdout.Write(out)
+		return err
+	}
+	return os.WriteFile(path, out, 0o644)
+}
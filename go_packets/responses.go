@@ -0,0 +1,186 @@
+package gopackets
+
+import (
+	"errors"
+	"log/slog"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// flowKey identifies one direction of a flow. Ports are zero for
+// protocols without them.
+type flowKey struct {
+	proto    byte
+	src, dst netip.AddrPort
+}
+
+func (k flowKey) reverse() flowKey {
+	return flowKey{proto: k.proto, src: k.dst, dst: k.src}
+}
+
+// packetFlow returns the flow of an IP packet of linkType.
+func packetFlow(linkType layers.LinkType, data []byte) (flowKey, bool) {
+	offset := ipOffset(linkType, data)
+	if offset < 0 {
+		return flowKey{}, false
+	}
+	ip, ok := parseIP(data[offset:])
+	if !ok {
+		return flowKey{}, false
+	}
+	src, _ := netip.AddrFromSlice(ip.src)
+	dst, _ := netip.AddrFromSlice(ip.dst)
+	var srcPort, dstPort uint16
+	if ports := ip.ports(); ports != nil {
+		srcPort = uint16(ports[0])<<8 | uint16(ports[1])
+		dstPort = uint16(ports[2])<<8 | uint16(ports[3])
+	}
+	return flowKey{proto: ip.proto, src: netip.AddrPortFrom(src, srcPort), dst: netip.AddrPortFrom(dst, dstPort)}, true
+}
+
+type flowState struct {
+	sent, pending, answered, replies int
+}
+
+// responseCapture listens for what the device under test sends back to
+// the replayed flows, saving it to a pcap file and counting which
+// replayed packets got a reply.
+type responseCapture struct {
+	handle   *pcap.Handle
+	dump     *pcapDump
+	linkType layers.LinkType // of the replayed packets
+	done     chan struct{}
+
+	mu    sync.Mutex
+	flows map[flowKey]*flowState
+	other int // captured packets not answering a replayed flow
+}
+
+// newResponseCapture captures on device, narrowed by a BPF filter if one
+// is given, and saves the responses to path unless it is empty.
+func newResponseCapture(device, filter, path string, linkType layers.LinkType) (*responseCapture, error) {
+	handle, err := pcap.OpenLive(device, 262144, true, 100*time.Millisecond)
+	if err != nil {
+		return nil, err
+	}
+	// The replayed packets themselves are seen on the way out; they never
+	// match a reversed flow, but there's no need to read them.
+	handle.SetDirection(pcap.DirectionIn)
+	if filter != "" {
+		if err := handle.SetBPFFilter(filter); err != nil {
+			handle.Close()
+			return nil, err
+		}
+	}
+
+	r := &responseCapture{
+		handle:   handle,
+		linkType: linkType,
+		done:     make(chan struct{}),
+		flows:    make(map[flowKey]*flowState),
+	}
+	if path != "" {
+		if r.dump, err = createPcapDump(path, handle.LinkType()); err != nil {
+			handle.Close()
+			return nil, err
+		}
+	}
+	go r.run()
+	return r, nil
+}
+
+// sent records a replayed packet.
+func (r *responseCapture) sent(data []byte) {
+	key, ok := packetFlow(r.linkType, data)
+	if !ok {
+		return
+	}
+	r.mu.Lock()
+	f := r.flows[key]
+	if f == nil {
+		f = &flowState{}
+		r.flows[key] = f
+	}
+	f.sent++
+	f.pending++
+	r.mu.Unlock()
+}
+
+// run reads packets until Close. A packet in the reverse direction of a
+// replayed flow is a reply to every packet sent on it since the last one.
+func (r *responseCapture) run() {
+	defer close(r.done)
+	linkType := r.handle.LinkType()
+	for {
+		data, ci, err := r.handle.ReadPacketData()
+		if errors.Is(err, pcap.NextErrorTimeoutExpired) {
+			continue
+		}
+		if err != nil {
+			return
+		}
+		key, ok := packetFlow(linkType, data)
+		if !ok {
+			continue
+		}
+
+		r.mu.Lock()
+		f := r.flows[key.reverse()]
+		if f == nil {
+			r.other++
+			r.mu.Unlock()
+			continue
+		}
+		f.replies++
+		f.answered += f.pending
+		f.pending = 0
+		r.mu.Unlock()
+
+		if r.dump != nil {
+			if err := r.dump.writePacket(ci.Timestamp, data, ci.Length); err != nil {
+				slog.Warn("Failed to save response", "err", err)
+			}
+		}
+	}
+}
+
+// responseSummary is the response part of the JSON summary.
+type responseSummary struct {
+	Flows         int `json:"flows"`
+	AnsweredFlows int `json:"answered_flows"`
+	Sent          int `json:"sent"`
+	Answered      int `json:"answered"`
+	Replies       int `json:"replies"`
+	Other         int `json:"other"`
+}
+
+// Close waits for late replies, stops capturing and logs the results.
+func (r *responseCapture) Close(wait time.Duration) responseSummary {
+	time.Sleep(wait)
+	r.handle.Close()
+	<-r.done
+	if r.dump != nil {
+		if err := r.dump.Close(); err != nil {
+			slog.Warn("Failed to save responses", "err", err)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := responseSummary{Flows: len(r.flows), Other: r.other}
+	for _, f := range r.flows {
+		s.Sent += f.sent
+		s.Answered += f.answered
+		s.Replies += f.replies
+		if f.replies > 0 {
+			s.AnsweredFlows++
+		}
+	}
+	slog.Info("Responses", "replies", s.Replies, "answered_flows", s.AnsweredFlows, "flows", s.Flows,
+		"answered", s.Answered, "sent", s.Sent, "other", s.Other)
+	return s
+}
@@ -0,0 +1,314 @@
+package gopackets
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// rewriter changes replayed packets to fit the network they are sent on.
+// A nil MAC is left as captured; with autoDst the destination MAC is
+// looked up per packet by ARP.
+type rewriter struct {
+	linkType layers.LinkType
+	src, dst net.HardwareAddr
+	autoDst  *arpResolver
+	ips      []ipRule
+	ports    map[uint16]uint16
+	anon     *anonymizer // for addresses no rule changes
+	patches  []patchRule
+
+	vlanStrip bool
+	vlanTCI   uint16 // pushed when vlanPush is set
+	vlanPush  bool
+}
+
+// ipRule maps the addresses of one network onto another of the same size,
+// keeping the host part.
+type ipRule struct {
+	from, to netip.Prefix
+}
+
+// rewrites holds what is changed in every packet before it is sent; nil
+// sends packets as captured.
+var rewrites *rewriter
+
+// setupRewrites parses the rewrite flags for a capture of linkType sent on
+// the device of sendHandle.
+func setupRewrites(sendHandle *pcap.Handle, device string, linkType layers.LinkType) error {
+	if *rewriteSrcMAC == "" && *rewriteDstMAC == "" && len(ipRewriteRules) == 0 && len(portRewriteRules) == 0 && !*fixCsums &&
+		!*vlanStrip && *vlanPush < 0 && !*anonymize && len(patchRules) == 0 {
+		return nil
+	}
+	r := &rewriter{linkType: linkType, vlanStrip: *vlanStrip}
+
+	if *vlanStrip || *vlanPush >= 0 {
+		if linkType != layers.LinkTypeEthernet {
+			return fmt.Errorf("VLAN tagging needs an Ethernet capture, not %s", linkType)
+		}
+		if *vlanStrip {
+			slog.Info("Stripping VLAN tags")
+		}
+	}
+	if *vlanPush >= 0 {
+		if *vlanPush > 4094 || *vlanPCP < 0 || *vlanPCP > 7 {
+			return fmt.Errorf("invalid VLAN %d priority %d", *vlanPush, *vlanPCP)
+		}
+		r.vlanPush = true
+		r.vlanTCI = uint16(*vlanPCP)<<13 | uint16(*vlanPush)
+		slog.Info("Pushing VLAN tag", "vlan", *vlanPush, "pcp", *vlanPCP)
+	}
+
+	for _, rule := range ipRewriteRules {
+		ip, err := parseIPRule(rule)
+		if err != nil {
+			return err
+		}
+		slog.Info("Rewriting addresses", "from", ip.from, "to", ip.to)
+		r.ips = append(r.ips, ip)
+	}
+	for _, rule := range portRewriteRules {
+		from, to, err := parsePortRule(rule)
+		if err != nil {
+			return err
+		}
+		if r.ports == nil {
+			r.ports = make(map[uint16]uint16)
+		}
+		slog.Info("Rewriting port", "from", from, "to", to)
+		r.ports[from] = to
+	}
+	for _, rule := range patchRules {
+		p, err := parsePatchRule(rule, linkType)
+		if err != nil {
+			return err
+		}
+		slog.Info("Patching frames", "bytes", len(p.bytes), "offset", p.offset)
+		r.patches = append(r.patches, p)
+	}
+	if *anonymize {
+		if linkType != layers.LinkTypeEthernet && ipOffset(linkType, nil) < 0 {
+			return fmt.Errorf("anonymization isn't supported for %s captures", linkType)
+		}
+		anon, err := newAnonymizer(*anonKey, *anonMap)
+		if err != nil {
+			return err
+		}
+		slog.Info("Anonymizing IP and MAC addresses")
+		r.anon = anon
+	}
+	if (len(r.ips) > 0 || len(r.ports) > 0 || *fixCsums) && ipOffset(linkType, nil) < 0 && linkType != layers.LinkTypeEthernet {
+		return fmt.Errorf("IP rewriting isn't supported for %s captures", linkType)
+	}
+
+	rewrites = r
+	if *rewriteSrcMAC == "" && *rewriteDstMAC == "" {
+		return nil
+	}
+	if linkType != layers.LinkTypeEthernet {
+		return fmt.Errorf("MAC rewriting needs an Ethernet capture, not %s", linkType)
+	}
+
+	var mac net.HardwareAddr
+	var nets []*net.IPNet
+	if *rewriteSrcMAC == "auto" || *rewriteDstMAC == "auto" {
+		if sendHandle == nil {
+			return fmt.Errorf("auto MAC rewriting needs -interface")
+		}
+		var err error
+		if mac, nets, err = localInterface(device); err != nil {
+			return err
+		}
+	}
+
+	switch *rewriteSrcMAC {
+	case "":
+	case "auto":
+		r.src = mac
+	default:
+		var err error
+		if r.src, err = net.ParseMAC(*rewriteSrcMAC); err != nil {
+			return err
+		}
+	}
+
+	switch *rewriteDstMAC {
+	case "":
+	case "auto":
+		var gw net.IP
+		if *gateway != "" {
+			if gw = net.ParseIP(*gateway).To4(); gw == nil {
+				return fmt.Errorf("invalid -gateway %q", *gateway)
+			}
+		}
+		resolver, err := newARPResolver(sendHandle, device, mac, nets, gw)
+		if err != nil {
+			return err
+		}
+		r.autoDst = resolver
+	default:
+		var err error
+		if r.dst, err = net.ParseMAC(*rewriteDstMAC); err != nil {
+			return err
+		}
+	}
+
+	slog.Info("Rewriting MACs", "src", orCaptured(r.src, *rewriteSrcMAC), "dst", orCaptured(r.dst, *rewriteDstMAC))
+	return nil
+}
+
+// parseIPRule parses a from=to rule of two networks with the same prefix
+// length, or two addresses.
+func parseIPRule(rule string) (ipRule, error) {
+	from, to, ok := strings.Cut(rule, "=")
+	if !ok {
+		return ipRule{}, fmt.Errorf("invalid IP rewrite %q, want cidr=cidr", rule)
+	}
+	var prefixes [2]netip.Prefix
+	for i, s := range []string{from, to} {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(s)
+			if addrErr != nil {
+				return ipRule{}, err
+			}
+			p = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefixes[i] = p.Masked()
+	}
+	if prefixes[0].Bits() != prefixes[1].Bits() || prefixes[0].Addr().BitLen() != prefixes[1].Addr().BitLen() {
+		return ipRule{}, fmt.Errorf("invalid IP rewrite %q, both sides must be networks of the same size", rule)
+	}
+	return ipRule{from: prefixes[0], to: prefixes[1]}, nil
+}
+
+// parsePortRule parses a from=to port rule.
+func parsePortRule(rule string) (uint16, uint16, error) {
+	from, to, ok := strings.Cut(rule, "=")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid port rewrite %q, want port=port", rule)
+	}
+	f, err := strconv.ParseUint(from, 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port rewrite %q: %v", rule, err)
+	}
+	t, err := strconv.ParseUint(to, 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port rewrite %q: %v", rule, err)
+	}
+	return uint16(f), uint16(t), nil
+}
+
+func orCaptured(mac net.HardwareAddr, flagValue string) string {
+	switch {
+	case mac != nil:
+		return mac.String()
+	case flagValue == "auto":
+		return "the ARP resolved next hop"
+	}
+	return "as captured"
+}
+
+// rewrite applies the configured rewrites to a packet in place.
+func rewrite(data []byte) []byte {
+	if rewrites == nil {
+		return data
+	}
+
+	// Patch offsets are into the frame as captured, the way Wireshark
+	// shows it.
+	patched := applyPatches(rewrites.patches, data)
+
+	if rewrites.vlanStrip {
+		data = stripVLAN(data)
+	}
+	if rewrites.vlanPush {
+		data = pushVLAN(data, rewrites.vlanTCI)
+	}
+
+	var ip ipPacket
+	isIP := false
+	if offset := ipOffset(rewrites.linkType, data); offset >= 0 {
+		ip, isIP = parseIP(data[offset:])
+	}
+	if isIP && (len(rewrites.ips) > 0 || len(rewrites.ports) > 0 || *fixCsums || rewrites.anon != nil || patched) {
+		changed := rewriteAddr(ip.src)
+		changed = rewriteAddr(ip.dst) || changed
+		if ports := ip.ports(); ports != nil {
+			changed = rewritePort(ports[0:2]) || changed
+			changed = rewritePort(ports[2:4]) || changed
+		}
+		// Captures taken with checksum offload carry zero or garbage
+		// checksums that receivers drop, -fix-csums recomputes them all.
+		if changed || patched || *fixCsums {
+			ip.fixChecksums()
+		}
+	}
+
+	if rewrites.linkType != layers.LinkTypeEthernet || len(data) < 14 {
+		return data
+	}
+	if rewrites.anon != nil {
+		rewrites.anon.mac(data[0:6])
+		rewrites.anon.mac(data[6:12])
+	}
+	if rewrites.dst != nil {
+		copy(data[0:6], rewrites.dst)
+	} else if rewrites.autoDst != nil && isIP && len(ip.dst) == 4 {
+		if mac := rewrites.autoDst.nextHop(net.IP(ip.dst)); mac != nil {
+			copy(data[0:6], mac)
+		}
+	}
+	if rewrites.src != nil {
+		copy(data[6:12], rewrites.src)
+	}
+	return data
+}
+
+// rewriteAddr maps an address through the first matching -rewrite-ip
+// rule, or anonymizes it if none matches, reporting whether it changed.
+func rewriteAddr(b []byte) bool {
+	addr, ok := netip.AddrFromSlice(b)
+	if !ok {
+		return false
+	}
+	for _, rule := range rewrites.ips {
+		if !rule.from.Contains(addr) {
+			continue
+		}
+		host := addr.AsSlice()
+		network := rule.to.Addr().AsSlice()
+		for i := range host {
+			// Network bits come from the target, host bits are kept.
+			bits := rule.to.Bits() - i*8
+			mask := byte(0xff)
+			if bits < 8 {
+				mask = ^byte(0xff >> max(bits, 0))
+			}
+			host[i] = network[i]&mask | host[i]&^mask
+		}
+		copy(b, host)
+		return true
+	}
+	if rewrites.anon != nil {
+		rewrites.anon.ip(b)
+		return true
+	}
+	return false
+}
+
+// rewritePort maps a port field through -rewrite-port.
+func rewritePort(b []byte) bool {
+	to, ok := rewrites.ports[binary.BigEndian.Uint16(b)]
+	if ok {
+		binary.BigEndian.PutUint16(b, to)
+	}
+	return ok
+}
@@ -0,0 +1,201 @@
+package gopackets
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// sender transmits replayed packets, either directly or with -workers
+// spread over several goroutines and pcap handles. Packets of one flow
+// always go to the same worker, so they stay in order. With -output it
+// writes them to a file instead.
+//
+// With -interface2 each worker has a handle on either interface and
+// split decides which one a packet leaves from.
+type sender struct {
+	handles  []*pcap.Handle
+	handles2 []*pcap.Handle
+	split    *splitter
+	dump     *pcapDump
+	queues   []chan queuedPacket
+	wg       sync.WaitGroup
+	linkType layers.LinkType
+	progress *progress
+	// responses, if set, is told about every packet sent.
+	responses *responseCapture
+	// verify, if set, matches the sent packets with a downstream capture.
+	verify *verifier
+
+	// Results of the current file.
+	file                string
+	sent, failed, bytes atomic.Int64
+}
+
+type queuedPacket struct {
+	data  []byte
+	ci    gopacket.CaptureInfo
+	index int
+	side  int
+}
+
+// newSender sends on sendHandle, opening workers-1 more handles on device
+// for the other workers, and a handle per worker on device2 unless it is
+// empty.
+func newSender(sendHandle *pcap.Handle, device, device2 string, workers int, linkType layers.LinkType, p *progress) (*sender, error) {
+	s := &sender{handles: []*pcap.Handle{sendHandle}, linkType: linkType, progress: p}
+	workers = max(workers, 1)
+	for i := 1; i < workers; i++ {
+		handle, err := pcap.OpenLive(device, 1600, true, pcap.BlockForever)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.handles = append(s.handles, handle)
+	}
+	if device2 != "" {
+		for i := 0; i < workers; i++ {
+			handle, err := pcap.OpenLive(device2, 1600, true, pcap.BlockForever)
+			if err != nil {
+				s.Close()
+				return nil, fmt.Errorf("%s: %v", device2, err)
+			}
+			s.handles2 = append(s.handles2, handle)
+		}
+	}
+	if workers == 1 {
+		return s, nil
+	}
+
+	for worker := range workers {
+		queue := make(chan queuedPacket, 1024)
+		s.queues = append(s.queues, queue)
+		go func() {
+			for p := range queue {
+				s.write(worker, p)
+				s.wg.Done()
+			}
+		}()
+	}
+	return s, nil
+}
+
+// newFileSender writes packets to a pcap file at path.
+func newFileSender(path string, linkType layers.LinkType, p *progress) (*sender, error) {
+	dump, err := createPcapDump(path, linkType)
+	if err != nil {
+		return nil, err
+	}
+	return &sender{dump: dump, linkType: linkType, progress: p}, nil
+}
+
+// Close stops the workers and closes the handles opened for them, or the
+// output file.
+func (s *sender) Close() error {
+	for _, queue := range s.queues {
+		close(queue)
+	}
+	if s.dump != nil {
+		return s.dump.Close()
+	}
+	for _, handle := range s.handles[1:] {
+		handle.Close()
+	}
+	for _, handle := range s.handles2 {
+		handle.Close()
+	}
+	return nil
+}
+
+// begin starts counting results for file.
+func (s *sender) begin(file string) {
+	s.file = file
+	s.sent.Store(0)
+	s.failed.Store(0)
+	s.bytes.Store(0)
+}
+
+// send transmits packet number index of the current file, captured as
+// described by ci, or queues it for its flow's worker.
+func (s *sender) send(data []byte, ci gopacket.CaptureInfo, index int) {
+	p := queuedPacket{data: data, ci: ci, index: index}
+	if s.split != nil {
+		p.side = s.split.side(data)
+	}
+	if len(s.queues) == 0 {
+		s.write(0, p)
+		return
+	}
+	s.wg.Add(1)
+	s.queues[s.flowHash(data)%uint32(len(s.queues))] <- p
+}
+
+// flush waits until the queued packets are sent.
+func (s *sender) flush() {
+	s.wg.Wait()
+}
+
+// write sends p on a handle of worker.
+func (s *sender) write(worker int, p queuedPacket) {
+	var verified *verifiedPacket
+	if s.verify != nil {
+		verified = s.verify.sending(p.data, s.file, p.index)
+	}
+	var err error
+	switch {
+	case s.dump != nil:
+		// Rewrites may change the size; what the capture cut off stays off.
+		err = s.dump.writePacket(p.ci.Timestamp, p.data, len(p.data)+p.ci.Length-p.ci.CaptureLength)
+	case p.side == 1:
+		err = s.handles2[worker].WritePacketData(p.data)
+	default:
+		err = s.handles[worker].WritePacketData(p.data)
+	}
+	if err != nil {
+		if verified != nil {
+			s.verify.failed(verified)
+		}
+		if failed := s.failed.Add(1); failed <= maxErrorLogs {
+			slog.Warn("Failed to send packet", "file", s.file, "packet", p.index, "bytes", len(p.data), "err", err)
+		}
+		return
+	}
+	if s.responses != nil {
+		s.responses.sent(p.data)
+	}
+	s.sent.Add(1)
+	s.bytes.Add(int64(len(p.data)))
+	s.progress.sent.Add(1)
+	s.progress.bytes.Add(int64(len(p.data)))
+}
+
+// flowHash hashes the addresses and ports of a packet the same in both
+// directions, so a connection's packets share a worker. Packets without
+// IP hash by their MAC addresses.
+func (s *sender) flowHash(data []byte) uint32 {
+	var a, b []byte
+	if offset := ipOffset(s.linkType, data); offset >= 0 {
+		if ip, ok := parseIP(data[offset:]); ok {
+			a, b = append([]byte{ip.proto}, ip.src...), append([]byte{ip.proto}, ip.dst...)
+			if ports := ip.ports(); ports != nil {
+				a, b = append(a, ports[0:2]...), append(b, ports[2:4]...)
+			}
+		}
+	}
+	if a == nil && s.linkType == layers.LinkTypeEthernet && len(data) >= 12 {
+		a, b = data[6:12], data[0:6]
+	}
+	if string(a) > string(b) {
+		a, b = b, a
+	}
+	h := fnv.New32a()
+	h.Write(a)
+	h.Write(b)
+	return h.Sum32()
+}
@@ -0,0 +1,321 @@
+package gopackets
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"gonet/pkg/apiauth"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// AgentFlags are the flags a replay request may set; everything else, like
+// the interface and rewrites, is fixed when the agent starts.
+var AgentFlags = []string{
+	"pps", "mbps", "loop", "max-packets", "max-duration", "speed", "topspeed",
+	"workers", "preload", "interleave", "start-packet", "end-packet",
+	"start-time", "end-time", "truncated", "fix-csums",
+}
+
+// agent replays uploaded captures on request, one replay at a time, for
+// labs where the sending host is remote.
+type agent struct {
+	dir        string
+	sendHandle *pcap.Handle
+	base       map[string]string // the agent's own values of AgentFlags
+
+	mu      sync.Mutex
+	sess    *session // the running replay, nil if none
+	files   []string
+	last    *summary
+	lastErr string
+}
+
+// replayRequest is the body of POST /replay. Files are names of uploaded
+// captures, flags values of AgentFlags.
+type replayRequest struct {
+	Files []string          `json:"files"`
+	Flags map[string]string `json:"flags"`
+}
+
+// agentStatus is what GET /replay returns.
+type agentStatus struct {
+	Running bool     `json:"running"`
+	Files   []string `json:"files,omitempty"`
+	Sent    int64    `json:"sent"`
+	Bytes   int64    `json:"bytes"`
+	Last    *summary `json:"last,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// serve runs the agent's HTTP API on addr, keeping uploads in dir. It
+// listens on loopback when addr has no host, anywhere else only with a
+// token, which every request then needs (see package apiauth):
+//
+//	PUT    /captures/{name}  upload a capture
+//	GET    /captures         list the uploaded captures
+//	DELETE /captures/{name}  remove a capture
+//	POST   /replay           start a replay, see replayRequest
+//	GET    /replay           progress of the running replay, or the last result
+//	DELETE /replay           stop the running replay
+func serve(addr, dir, token string, sendHandle *pcap.Handle) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	a := &agent{dir: dir, sendHandle: sendHandle, base: make(map[string]string)}
+	for _, name := range AgentFlags {
+		a.base[name] = flags.Lookup(name).Value.String()
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("PUT /captures/{name}", a.upload)
+	mux.HandleFunc("GET /captures", a.list)
+	mux.HandleFunc("DELETE /captures/{name}", a.remove)
+	mux.HandleFunc("POST /replay", a.start)
+	mux.HandleFunc("GET /replay", a.status)
+	mux.HandleFunc("DELETE /replay", a.stop)
+
+	ln, err := apiauth.Listen(addr, token)
+	if err != nil {
+		return err
+	}
+	slog.Info("Serving replays", "addr", ln.Addr(), "dir", dir, "interface", *interfaceName, "token", token != "")
+	return http.Serve(ln, apiauth.Require(token, mux))
+}
+
+// capturePath returns where the capture called name is kept, refusing
+// names that would leave the directory.
+func (a *agent) capturePath(name string) (string, error) {
+	if name == "" || name != filepath.Base(name) || name == "." || name == ".." {
+		return "", fmt.Errorf("invalid capture name %q", name)
+	}
+	return filepath.Join(a.dir, name), nil
+}
+
+func (a *agent) upload(w http.ResponseWriter, r *http.Request) {
+	path, err := a.capturePath(r.PathValue("name"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Written aside first so a replay never reads half an upload.
+	tmp, err := os.CreateTemp(a.dir, ".upload-*")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	n, err := io.Copy(tmp, r.Body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	handle, err := pcap.OpenOffline(tmp.Name())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("not a capture: %v", err), http.StatusBadRequest)
+		return
+	}
+	handle.Close()
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	slog.Info("Uploaded capture", "client", r.RemoteAddr, "file", filepath.Base(path), "bytes", n)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (a *agent) list(w http.ResponseWriter, r *http.Request) {
+	entries, err := os.ReadDir(a.dir)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	type capture struct {
+		Name     string    `json:"name"`
+		Size     int64     `json:"size"`
+		Modified time.Time `json:"modified"`
+	}
+	captures := []capture{}
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || !info.Mode().IsRegular() || e.Name()[0] == '.' {
+			continue
+		}
+		captures = append(captures, capture{Name: e.Name(), Size: info.Size(), Modified: info.ModTime()})
+	}
+	writeJSON(w, http.StatusOK, captures)
+}
+
+func (a *agent) remove(w http.ResponseWriter, r *http.Request) {
+	path, err := a.capturePath(r.PathValue("name"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := os.Remove(path); errors.Is(err, os.ErrNotExist) {
+		http.Error(w, "no such capture", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *agent) start(w http.ResponseWriter, r *http.Request) {
+	var req replayRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(req.Files) == 0 {
+		http.Error(w, "no files to replay", http.StatusBadRequest)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.sess != nil {
+		http.Error(w, "a replay is already running", http.StatusConflict)
+		return
+	}
+
+	files := make([]string, 0, len(req.Files))
+	for _, name := range req.Files {
+		path, err := a.capturePath(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		files = append(files, path)
+	}
+	if err := a.applyFlags(req.Flags); err != nil {
+		a.restoreFlags()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	linkType, err := captureLinkType(files)
+	if err != nil {
+		a.restoreFlags()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sess := &session{start: time.Now()}
+	a.sess, a.files, a.last, a.lastErr = sess, req.Files, nil, ""
+	slog.Info("Started replay", "client", r.RemoteAddr, "files", req.Files)
+	go func() {
+		sum, err := a.replay(sess, files, linkType)
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		a.restoreFlags()
+		a.sess, a.last = nil, sum
+		if err != nil {
+			a.lastErr = err.Error()
+			slog.Warn("Replay failed", "files", a.files, "err", err)
+			return
+		}
+		slog.Info("Replay completed", "files", a.files, "sent", sum.Sent)
+	}()
+	writeJSON(w, http.StatusAccepted, a.statusLocked())
+}
+
+// applyFlags sets the flags of a request and checks them the way main
+// does.
+func (a *agent) applyFlags(values map[string]string) error {
+	for name, value := range values {
+		if _, ok := a.base[name]; !ok {
+			return fmt.Errorf("flag -%s can't be set per replay", name)
+		}
+		if err := flags.Set(name, value); err != nil {
+			return fmt.Errorf("invalid -%s: %v", name, err)
+		}
+	}
+	if *speed <= 0 {
+		return fmt.Errorf("invalid -speed %v, must be above 0", *speed)
+	}
+	var err error
+	if selection, err = parseRange(); err != nil {
+		return fmt.Errorf("invalid packet selection: %v", err)
+	}
+	return parseTruncated()
+}
+
+// restoreFlags puts back the agent's own flag values after a replay.
+func (a *agent) restoreFlags() {
+	for name, value := range a.base {
+		flags.Set(name, value)
+	}
+	selection, _ = parseRange()
+	parseTruncated()
+}
+
+// replay sends files as main does with -all.
+func (a *agent) replay(sess *session, files []string, linkType layers.LinkType) (*summary, error) {
+	if err := setupRewrites(a.sendHandle, *interfaceName, linkType); err != nil {
+		return nil, err
+	}
+	if rewrites != nil && rewrites.autoDst != nil {
+		defer rewrites.autoDst.Close()
+	}
+	out, err := newSender(a.sendHandle, *interfaceName, "", *workers, linkType, &sess.progress)
+	if err != nil {
+		return nil, err
+	}
+	summaries, err := replayCaptures(out, files, sess)
+	out.Close()
+	if rewrites != nil && rewrites.anon != nil {
+		if err := rewrites.anon.save(); err != nil {
+			slog.Warn("Failed to save the anonymization mapping", "err", err)
+		}
+	}
+	sum := newSummary(sess.start, summaries, nil, nil)
+	return &sum, err
+}
+
+func (a *agent) status(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	writeJSON(w, http.StatusOK, a.statusLocked())
+}
+
+func (a *agent) statusLocked() agentStatus {
+	s := agentStatus{Running: a.sess != nil, Files: a.files, Last: a.last, Error: a.lastErr}
+	if a.sess != nil {
+		s.Sent = a.sess.progress.sent.Load()
+		s.Bytes = a.sess.progress.bytes.Load()
+	} else if a.last != nil {
+		s.Sent, s.Bytes = int64(a.last.Sent), int64(a.last.Bytes)
+	}
+	return s
+}
+
+func (a *agent) stop(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.sess == nil {
+		http.Error(w, "no replay is running", http.StatusConflict)
+		return
+	}
+	a.sess.stop.Store(true)
+	slog.Info("Stopped replay", "client", r.RemoteAddr, "files", a.files)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
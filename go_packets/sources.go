@@ -0,0 +1,101 @@
+package gopackets
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// expandFiles resolves glob patterns among the file arguments, for shells
+// that don't, in name order so rotated captures come out in sequence.
+func expandFiles(args []string) ([]string, error) {
+	var files []string
+	for _, arg := range args {
+		if !strings.ContainsAny(arg, "*?[") {
+			files = append(files, arg)
+			continue
+		}
+		matches, err := filepath.Glob(arg)
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no files match %s", arg)
+		}
+		files = append(files, matches...)
+	}
+	return files, nil
+}
+
+// captureLinkType opens every file once and returns their link type, which
+// must be the same for all since they go out on one interface.
+func captureLinkType(files []string) (layers.LinkType, error) {
+	var linkType layers.LinkType
+	for i, file := range files {
+		handle, err := pcap.OpenOffline(file)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %v", file, err)
+		}
+		lt := handle.LinkType()
+		handle.Close()
+		if i > 0 && lt != linkType {
+			return 0, fmt.Errorf("%s is a %s capture, %s is %s", file, lt, files[0], linkType)
+		}
+		linkType = lt
+	}
+	return linkType, nil
+}
+
+// mergedSource reads several captures as one, always returning the
+// earliest of the packets next in each, like mergecap.
+type mergedSource struct {
+	sources []gopacket.PacketDataSource
+	heads   []mergedPacket
+}
+
+type mergedPacket struct {
+	data []byte
+	ci   gopacket.CaptureInfo
+	err  error
+}
+
+func newMergedSource(sources []gopacket.PacketDataSource) *mergedSource {
+	m := &mergedSource{sources: sources, heads: make([]mergedPacket, len(sources))}
+	for i := range sources {
+		m.advance(i)
+	}
+	return m
+}
+
+func (m *mergedSource) advance(i int) {
+	data, ci, err := m.sources[i].ReadPacketData()
+	m.heads[i] = mergedPacket{data: data, ci: ci, err: err}
+}
+
+func (m *mergedSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	next := -1
+	for i, head := range m.heads {
+		if head.err != nil {
+			if !errors.Is(head.err, io.EOF) {
+				// Read errors end the merge like they end a single file.
+				return nil, gopacket.CaptureInfo{}, head.err
+			}
+			continue
+		}
+		if next < 0 || head.ci.Timestamp.Before(m.heads[next].ci.Timestamp) {
+			next = i
+		}
+	}
+	if next < 0 {
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	}
+	head := m.heads[next]
+	m.advance(next)
+	return head.data, head.ci, nil
+}
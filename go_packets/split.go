@@ -0,0 +1,78 @@
+package gopackets
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/netip"
+
+	"github.com/google/gopacket/layers"
+)
+
+// splitter picks the interface each packet goes out of when replaying
+// the two directions of a capture on -interface and -interface2, so a
+// middlebox between them sees both sides of every conversation. Side 0 is
+// -interface.
+type splitter struct {
+	linkType layers.LinkType
+	prefix   netip.Prefix     // sources in it are side 0
+	mac      net.HardwareAddr // frames from it are side 0
+
+	// Without a prefix or MAC the side that starts a flow is side 0.
+	initiators map[flowKey]bool
+}
+
+// newSplitter parses -split: a network, a MAC address, or auto.
+func newSplitter(rule string, linkType layers.LinkType) (*splitter, error) {
+	s := &splitter{linkType: linkType}
+	if rule == "auto" {
+		s.initiators = make(map[flowKey]bool)
+		return s, nil
+	}
+	if prefix, err := netip.ParsePrefix(rule); err == nil {
+		s.prefix = prefix.Masked()
+		return s, nil
+	}
+	if addr, err := netip.ParseAddr(rule); err == nil {
+		s.prefix = netip.PrefixFrom(addr, addr.BitLen())
+		return s, nil
+	}
+	if mac, err := net.ParseMAC(rule); err == nil {
+		if linkType != layers.LinkTypeEthernet {
+			return nil, fmt.Errorf("splitting by MAC needs an Ethernet capture, not %s", linkType)
+		}
+		s.mac = mac
+		return s, nil
+	}
+	return nil, fmt.Errorf("invalid -split %q, want auto, a network, an address or a MAC address", rule)
+}
+
+// side returns 0 or 1 for a packet. Packets that can't be told apart,
+// like ARP when splitting by address, go out side 0.
+func (s *splitter) side(data []byte) int {
+	if s.mac != nil {
+		if len(data) >= 12 && !bytes.Equal(data[6:12], s.mac) {
+			return 1
+		}
+		return 0
+	}
+
+	key, ok := packetFlow(s.linkType, data)
+	if !ok {
+		return 0
+	}
+	if s.prefix.IsValid() {
+		if s.prefix.Contains(key.src.Addr()) {
+			return 0
+		}
+		return 1
+	}
+	switch {
+	case s.initiators[key]:
+		return 0
+	case s.initiators[key.reverse()]:
+		return 1
+	}
+	s.initiators[key] = true
+	return 0
+}
@@ -0,0 +1,326 @@
+package gopackets
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+const (
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpRST = 0x04
+	tcpACK = 0x10
+)
+
+// tcpSegment holds the TCP header fields the client replay works with.
+type tcpSegment struct {
+	seq, ack uint32
+	flags    byte
+	payload  int
+}
+
+// parseTCP finds the flow, TCP header and IP packet of a TCP packet.
+func parseTCP(linkType layers.LinkType, data []byte) (flowKey, tcpSegment, ipPacket, bool) {
+	key, ok := packetFlow(linkType, data)
+	if !ok || key.proto != ipProtoTCP {
+		return flowKey{}, tcpSegment{}, ipPacket{}, false
+	}
+	ip, _ := parseIP(data[ipOffset(linkType, data):])
+	if len(ip.l4) < 20 {
+		return flowKey{}, tcpSegment{}, ipPacket{}, false
+	}
+	headerLen := int(ip.l4[12]>>4) * 4
+	if headerLen < 20 || headerLen > len(ip.l4) {
+		return flowKey{}, tcpSegment{}, ipPacket{}, false
+	}
+	return key, tcpSegment{
+		seq:     binary.BigEndian.Uint32(ip.l4[4:]),
+		ack:     binary.BigEndian.Uint32(ip.l4[8:]),
+		flags:   ip.l4[13],
+		payload: len(ip.l4) - headerLen,
+	}, ip, true
+}
+
+// seqLen is how much sequence space a segment takes.
+func (s tcpSegment) seqLen() uint32 {
+	n := uint32(s.payload)
+	if s.flags&(tcpSYN|tcpFIN) != 0 {
+		n++
+	}
+	return n
+}
+
+// clientPacket is a client packet of a recorded session, already
+// rewritten. serverBytes is how much of the server's sequence space the
+// recorded client had seen when sending it.
+type clientPacket struct {
+	data        []byte
+	seg         tcpSegment
+	serverBytes uint32
+	ackedAll    bool // it acknowledged everything the server had sent
+}
+
+// tcpSession is a recorded TCP connection, from the client's SYN on.
+type tcpSession struct {
+	client    flowKey // as captured
+	serverISN uint32
+	packets   []clientPacket
+}
+
+// loadTCPSessions reads the TCP connections whose SYN is in the files.
+// Packets from the client are kept; the server's only tell how much data
+// the client had received at each point.
+func loadTCPSessions(files []string, linkType layers.LinkType) ([]*tcpSession, error) {
+	var sessions []*tcpSession
+	byFlow := make(map[flowKey]*tcpSession)
+	serverNext := make(map[*tcpSession]uint32)
+
+	for _, file := range files {
+		handle, err := pcap.OpenOffline(file)
+		if err != nil {
+			return nil, err
+		}
+		for {
+			data, _, err := handle.ReadPacketData()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				handle.Close()
+				return nil, fmt.Errorf("%s: %v", file, err)
+			}
+			key, seg, _, ok := parseTCP(linkType, data)
+			if !ok {
+				continue
+			}
+
+			if seg.flags&(tcpSYN|tcpACK) == tcpSYN {
+				s := &tcpSession{client: key}
+				sessions = append(sessions, s)
+				byFlow[key] = s
+			}
+			if s := byFlow[key.reverse()]; s != nil {
+				// From the server.
+				if seg.flags&tcpSYN != 0 {
+					s.serverISN = seg.seq
+				}
+				if end := seg.seq - s.serverISN + seg.seqLen(); end > serverNext[s] {
+					serverNext[s] = end
+				}
+				continue
+			}
+			s := byFlow[key]
+			if s == nil {
+				continue
+			}
+			p := clientPacket{data: rewrite(data), seg: seg, serverBytes: serverNext[s]}
+			if seg.flags&tcpACK != 0 {
+				p.serverBytes = seg.ack - s.serverISN
+				p.ackedAll = p.serverBytes >= serverNext[s]
+			}
+			s.packets = append(s.packets, p)
+		}
+		handle.Close()
+	}
+	return sessions, nil
+}
+
+// liveSession follows the real server's side of a replayed session.
+type liveSession struct {
+	server   flowKey // live server to client direction
+	isn      uint32
+	next     uint32 // next in-order server sequence number
+	synAcked bool
+	reset    bool
+	updated  time.Time
+}
+
+func (l *liveSession) serverBytes() uint32 {
+	return l.next - l.isn
+}
+
+// tcpClientStats counts the outcome of the replayed sessions.
+type tcpClientStats struct {
+	sessions, completed, reset, timedOut, sent int
+}
+
+// replayTCPClient replays only the client side of the recorded TCP
+// sessions against a live server, one session at a time. Acknowledgment
+// numbers are rewritten to the live server's sequence space and each
+// client packet waits for the server data it answered in the capture.
+//
+// The local TCP stack doesn't know these connections and resets them when
+// the server answers from a local address; drop those resets, e.g. with
+// iptables -A OUTPUT -p tcp --tcp-flags RST RST -j DROP.
+func replayTCPClient(sendHandle *pcap.Handle, device string, files []string, linkType layers.LinkType, p *progress) tcpClientStats {
+	sessions, err := loadTCPSessions(files, linkType)
+	if err != nil {
+		log.Fatalf("Failed to read TCP sessions: %v", err)
+	}
+	slog.Info("Replaying the client side of TCP sessions", "sessions", len(sessions))
+
+	listen, err := pcap.OpenLive(device, 262144, true, 10*time.Millisecond)
+	if err != nil {
+		log.Fatalf("Failed to open device %s: %v", device, err)
+	}
+	defer listen.Close()
+	listen.SetDirection(pcap.DirectionIn)
+	if err := listen.SetBPFFilter("tcp"); err != nil {
+		log.Fatalf("Failed to set BPF filter: %v", err)
+	}
+	listenType := layers.LinkType(listen.LinkType())
+
+	var stats tcpClientStats
+	for _, s := range sessions {
+		if len(s.packets) == 0 {
+			continue
+		}
+		stats.sessions++
+		live := &liveSession{updated: time.Now()}
+		if key, _, _, ok := parseTCP(linkType, s.packets[0].data); ok {
+			live.server = key.reverse()
+		}
+
+		sent, err := replayTCPSession(sendHandle, listen, listenType, linkType, s, live, p)
+		stats.sent += sent
+		switch {
+		case live.reset:
+			stats.reset++
+			slog.Warn("TCP session reset by the server", "src", s.client.src, "dst", s.client.dst, "packets", sent)
+		case err != nil:
+			stats.timedOut++
+			slog.Warn("TCP session failed", "src", s.client.src, "dst", s.client.dst, "err", err)
+		default:
+			stats.completed++
+		}
+	}
+	slog.Info("TCP sessions", "replayed", stats.sessions, "completed", stats.completed, "reset", stats.reset,
+		"timed_out", stats.timedOut, "sent", stats.sent)
+	return stats
+}
+
+// replayTCPSession sends the client packets of s, returning how many were
+// sent.
+func replayTCPSession(sendHandle, listen *pcap.Handle, listenType, linkType layers.LinkType, s *tcpSession, live *liveSession, p *progress) (int, error) {
+	sent := 0
+	var clientNext uint32
+	for i, cp := range s.packets {
+		// Retransmissions in the capture are left out, the server has
+		// everything before clientNext already.
+		if i > 0 && cp.seg.payload > 0 && cp.seg.seq+cp.seg.seqLen()-clientNext > 1<<31 {
+			continue
+		}
+
+		if cp.seg.flags&tcpSYN != 0 {
+			if err := sendSYN(sendHandle, listen, listenType, cp, live, p); err != nil {
+				return sent, err
+			}
+			sent++
+			clientNext = cp.seg.seq + 1
+			continue
+		}
+		if !live.synAcked {
+			return sent, errors.New("no SYN in the capture")
+		}
+
+		// Wait for the server data this packet answered, giving up when
+		// the server has gone quiet for -tcp-wait; live content may be
+		// shorter than recorded.
+		for live.serverBytes() < cp.serverBytes && time.Since(live.updated) < *tcpWait && !live.reset {
+			readServer(listen, listenType, live)
+		}
+		if live.reset {
+			return sent, nil
+		}
+
+		data := cp.data
+		if cp.seg.flags&tcpACK != 0 {
+			ack := live.isn + cp.serverBytes
+			if cp.ackedAll || live.serverBytes() < cp.serverBytes {
+				ack = live.next
+			}
+			data = patchAck(linkType, cp.data, ack)
+		}
+		if err := sendHandle.WritePacketData(data); err != nil {
+			return sent, err
+		}
+		sent++
+		p.sent.Add(1)
+		p.bytes.Add(int64(len(data)))
+		if end := cp.seg.seq + cp.seg.seqLen(); end-clientNext < 1<<31 {
+			clientNext = end
+		}
+	}
+
+	// Collect the server's last answers, like its FIN.
+	deadline := time.Now().Add(*tcpWait)
+	for time.Now().Before(deadline) && !live.reset {
+		readServer(listen, listenType, live)
+	}
+	return sent, nil
+}
+
+// sendSYN opens the connection, trying three times.
+func sendSYN(sendHandle, listen *pcap.Handle, listenType layers.LinkType, cp clientPacket, live *liveSession, p *progress) error {
+	for try := 0; try < 3; try++ {
+		if err := sendHandle.WritePacketData(cp.data); err != nil {
+			return err
+		}
+		p.sent.Add(1)
+		p.bytes.Add(int64(len(cp.data)))
+		deadline := time.Now().Add(*tcpWait)
+		for time.Now().Before(deadline) {
+			readServer(listen, listenType, live)
+			if live.synAcked || live.reset {
+				return nil
+			}
+		}
+	}
+	return errors.New("no SYN-ACK from the server")
+}
+
+// readServer reads one packet and updates live if it is from its server.
+func readServer(listen *pcap.Handle, listenType layers.LinkType, live *liveSession) {
+	data, _, err := listen.ReadPacketData()
+	if err != nil {
+		return
+	}
+	key, seg, _, ok := parseTCP(listenType, data)
+	if !ok || key != live.server {
+		return
+	}
+	switch {
+	case seg.flags&tcpRST != 0:
+		live.reset = true
+	case seg.flags&(tcpSYN|tcpACK) == tcpSYN|tcpACK:
+		live.isn = seg.seq
+		live.next = seg.seq + 1
+		live.synAcked = true
+	case live.synAcked && seg.seq == live.next && seg.seqLen() > 0:
+		live.next += seg.seqLen()
+	default:
+		return
+	}
+	live.updated = time.Now()
+}
+
+// patchAck returns a copy of a TCP packet with its acknowledgment number
+// and checksums updated.
+func patchAck(linkType layers.LinkType, data []byte, ack uint32) []byte {
+	out := append([]byte(nil), data...)
+	_, _, ip, ok := parseTCP(linkType, out)
+	if !ok {
+		return data
+	}
+	binary.BigEndian.PutUint32(ip.l4[8:], ack)
+	ip.fixChecksums()
+	return out
+}
@@ -0,0 +1,36 @@
+package gopackets
+
+import (
+	"fmt"
+
+	"github.com/google/gopacket"
+)
+
+// parseTruncated validates -truncated.
+func parseTruncated() error {
+	switch *truncated {
+	case "pad", "skip", "fail":
+		return nil
+	}
+	return fmt.Errorf("invalid -truncated %q, want pad, skip or fail", *truncated)
+}
+
+// handleTruncated deals with a packet captured shorter than it was on the
+// wire, as set by -truncated: padded with zeros to its wire length,
+// skipped (ok is false), or ending the replay with an error. Such a
+// packet would otherwise go out with wrong lengths and checksums.
+func handleTruncated(data []byte, ci *gopacket.CaptureInfo, file string, index int) (out []byte, ok bool, err error) {
+	if ci.CaptureLength >= ci.Length {
+		return data, true, nil
+	}
+	switch *truncated {
+	case "pad":
+		data = append(data, make([]byte, ci.Length-ci.CaptureLength)...)
+		ci.CaptureLength = ci.Length
+		return data, true, nil
+	case "skip":
+		return nil, false, nil
+	}
+	return nil, false, fmt.Errorf("%s: packet %d was captured with only %d of its %d bytes (snaplen too small), replay with -truncated pad or -truncated skip",
+		file, index, ci.CaptureLength, ci.Length)
+}
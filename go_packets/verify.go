@@ -0,0 +1,250 @@
+package gopackets
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// verifiedPacket is a replayed packet waiting to be seen downstream.
+type verifiedPacket struct {
+	seq     int
+	file    string
+	index   int
+	matched bool
+}
+
+// verifier captures downstream of the device under test and matches what
+// arrives with what was replayed. Packets are matched on a hash of the IP
+// packet without the fields routing changes; failing that, on a looser
+// key of the transport payload, which makes them modified. Anything sent
+// but never seen was dropped, anything seen after a packet sent later was
+// reordered.
+type verifier struct {
+	handle   *pcap.Handle
+	linkType layers.LinkType // of the replayed packets
+	done     chan struct{}
+
+	mu         sync.Mutex
+	seq        int
+	exact      map[uint64][]*verifiedPacket
+	loose      map[uint64][]*verifiedPacket
+	sent       []*verifiedPacket
+	lastSeq    int
+	unsent     int
+	received   int
+	unexpected int
+	reordered  []*verifiedPacket
+	modified   []*verifiedPacket
+}
+
+func newVerifier(device string, linkType layers.LinkType) (*verifier, error) {
+	handle, err := pcap.OpenLive(device, 262144, true, 100*time.Millisecond)
+	if err != nil {
+		return nil, err
+	}
+	handle.SetDirection(pcap.DirectionIn)
+	v := &verifier{
+		handle:   handle,
+		linkType: linkType,
+		done:     make(chan struct{}),
+		exact:    make(map[uint64][]*verifiedPacket),
+		loose:    make(map[uint64][]*verifiedPacket),
+		lastSeq:  -1,
+	}
+	go v.run()
+	return v, nil
+}
+
+// sending records a packet about to be sent, before it can possibly be
+// seen downstream.
+func (v *verifier) sending(data []byte, file string, index int) *verifiedPacket {
+	exact, loose := verifyKeys(v.linkType, data)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	p := &verifiedPacket{seq: v.seq, file: file, index: index}
+	v.seq++
+	v.sent = append(v.sent, p)
+	v.exact[exact] = append(v.exact[exact], p)
+	v.loose[loose] = append(v.loose[loose], p)
+	return p
+}
+
+// failed takes back a packet that couldn't be sent.
+func (v *verifier) failed(p *verifiedPacket) {
+	v.mu.Lock()
+	p.matched = true
+	v.unsent++
+	v.mu.Unlock()
+}
+
+func (v *verifier) run() {
+	defer close(v.done)
+	linkType := layers.LinkType(v.handle.LinkType())
+	for {
+		data, _, err := v.handle.ReadPacketData()
+		if errors.Is(err, pcap.NextErrorTimeoutExpired) {
+			continue
+		}
+		if err != nil {
+			return
+		}
+		exact, loose := verifyKeys(linkType, data)
+
+		v.mu.Lock()
+		p := takeUnmatched(v.exact, exact)
+		modified := false
+		if p == nil {
+			p = takeUnmatched(v.loose, loose)
+			modified = p != nil
+		}
+		switch {
+		case p == nil:
+			v.unexpected++
+		default:
+			v.received++
+			p.matched = true
+			if modified {
+				v.modified = append(v.modified, p)
+			}
+			if p.seq < v.lastSeq {
+				v.reordered = append(v.reordered, p)
+			}
+			v.lastSeq = max(v.lastSeq, p.seq)
+		}
+		v.mu.Unlock()
+	}
+}
+
+// takeUnmatched returns the earliest sent packet under key not seen yet.
+func takeUnmatched(m map[uint64][]*verifiedPacket, key uint64) *verifiedPacket {
+	queue := m[key]
+	for len(queue) > 0 && queue[0].matched {
+		queue = queue[1:]
+	}
+	if len(queue) == 0 {
+		delete(m, key)
+		return nil
+	}
+	m[key] = queue[1:]
+	return queue[0]
+}
+
+// verifyKeys hashes the IP packet in a frame, leaving out the link layer,
+// TTL and header checksum, which change on every hop. The loose key only
+// covers the protocol, IPv4 ID and transport payload, so it survives NAT
+// and header rewrites. Frames without IP are hashed past their MACs.
+func verifyKeys(linkType layers.LinkType, data []byte) (exact, loose uint64) {
+	h := fnv.New64a()
+	offset := ipOffset(linkType, data)
+	if offset < 0 {
+		if len(data) > 12 {
+			h.Write(data[12:])
+		}
+		return h.Sum64(), h.Sum64()
+	}
+	packet := append([]byte(nil), data[offset:]...)
+	ip, ok := parseIP(packet)
+	if !ok {
+		h.Write(packet)
+		return h.Sum64(), h.Sum64()
+	}
+
+	var id []byte
+	if packet[0]>>4 == 4 {
+		packet[8] = 0
+		packet[10], packet[11] = 0, 0
+		id = packet[4:6]
+	} else {
+		packet[7] = 0
+	}
+	h.Write(packet)
+	exact = h.Sum64()
+
+	h.Reset()
+	h.Write([]byte{ip.proto})
+	h.Write(id)
+	payload := ip.l4
+	switch {
+	case ip.proto == ipProtoUDP && len(payload) >= 8:
+		payload = payload[8:]
+	case ip.proto == ipProtoTCP && len(payload) >= 20:
+		payload = payload[min(int(payload[12]>>4)*4, len(payload)):]
+		// The sequence number stays with the payload, so retransmissions
+		// and empty ACKs of a connection are told apart.
+		h.Write(ip.l4[4:8])
+	}
+	h.Write(payload)
+	var length [2]byte
+	binary.BigEndian.PutUint16(length[:], uint16(len(payload)))
+	h.Write(length[:])
+	return exact, h.Sum64()
+}
+
+// verifiedRef names a replayed packet in the JSON summary.
+type verifiedRef struct {
+	File  string `json:"file"`
+	Index int    `json:"index"`
+}
+
+// verifySummary is the -verify-interface part of the JSON summary.
+type verifySummary struct {
+	Sent       int           `json:"sent"`
+	Received   int           `json:"received"`
+	Dropped    []verifiedRef `json:"dropped"`
+	Reordered  []verifiedRef `json:"reordered"`
+	Modified   []verifiedRef `json:"modified"`
+	Unexpected int           `json:"unexpected"`
+}
+
+// Close waits for late packets, stops capturing and logs the results.
+func (v *verifier) Close(wait time.Duration) verifySummary {
+	time.Sleep(wait)
+	v.handle.Close()
+	<-v.done
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	refs := func(packets []*verifiedPacket) []verifiedRef {
+		r := make([]verifiedRef, 0, len(packets))
+		for _, p := range packets {
+			r = append(r, verifiedRef{File: p.file, Index: p.index})
+		}
+		return r
+	}
+	var dropped []*verifiedPacket
+	for _, p := range v.sent {
+		if !p.matched {
+			dropped = append(dropped, p)
+		}
+	}
+	s := verifySummary{
+		Sent:       v.seq - v.unsent,
+		Received:   v.received,
+		Dropped:    refs(dropped),
+		Reordered:  refs(v.reordered),
+		Modified:   refs(v.modified),
+		Unexpected: v.unexpected,
+	}
+	slog.Info("Verification", "received", s.Received, "sent", s.Sent, "dropped", len(s.Dropped),
+		"reordered", len(s.Reordered), "modified", len(s.Modified), "other", s.Unexpected)
+	for _, list := range []struct {
+		what string
+		refs []verifiedRef
+	}{{"Dropped", s.Dropped}, {"Reordered", s.Reordered}, {"Modified", s.Modified}} {
+		for i, r := range list.refs {
+			if i == maxErrorLogs {
+				slog.Warn(list.what+" packets not shown", "packets", len(list.refs)-i)
+				break
+			}
+			slog.Warn(list.what+" packet", "file", r.File, "packet", r.Index)
+		}
+	}
+	return s
+}
@@ -0,0 +1,34 @@
+package gopackets
+
+import (
+	"encoding/binary"
+
+	"github.com/google/gopacket/layers"
+)
+
+// stripVLAN removes the 802.1Q and 802.1ad tags of an Ethernet frame, for
+// replaying trunk port captures onto an access port.
+func stripVLAN(frame []byte) []byte {
+	for len(frame) >= 18 {
+		switch layers.EthernetType(binary.BigEndian.Uint16(frame[12:])) {
+		case layers.EthernetTypeDot1Q, layers.EthernetTypeQinQ:
+			frame = append(frame[:12], frame[16:]...)
+		default:
+			return frame
+		}
+	}
+	return frame
+}
+
+// pushVLAN adds an outer 802.1Q tag with the given tag control info, for
+// replaying access port captures onto a trunk.
+func pushVLAN(frame []byte, tci uint16) []byte {
+	if len(frame) < 14 {
+		return frame
+	}
+	tagged := make([]byte, 0, len(frame)+4)
+	tagged = append(tagged, frame[:12]...)
+	tagged = binary.BigEndian.AppendUint16(tagged, uint16(layers.EthernetTypeDot1Q))
+	tagged = binary.BigEndian.AppendUint16(tagged, tci)
+	return append(tagged, frame[12:]...)
+}
@@ -0,0 +1,308 @@
+package httpload
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"syscall"
+	"time"
+
+	"gonet/pkg/stats"
+)
+
+// Config is a load test for Load.Run.
+type Config struct {
+	Targets []string // URLs, requested in turn
+	Method  string   // default GET
+	Body    []byte
+	Header  http.Header
+
+	Concurrency int     // requests in flight at most, default 10
+	RPS         float64 // requests started per second at most, 0 for no limit
+
+	// The test ends after Duration or Requests, whichever comes first;
+	// with neither it runs until ctx is done.
+	Duration time.Duration
+	Requests uint64
+
+	Timeout time.Duration // per request, default 30s
+
+	// HTTP is "1.1" or "2" to force the protocol, HTTP/2 without TLS then
+	// meaning h2c with prior knowledge; empty takes what the server offers.
+	HTTP string
+
+	Proxy             string // URL of an HTTP proxy to go through, like gonet proxy
+	Insecure          bool   // skip TLS certificate verification
+	DisableKeepAlives bool
+}
+
+// TargetResult is how one URL did.
+type TargetResult struct {
+	URL      string            `json:"url"`
+	Requests uint64            `json:"requests"`
+	Errors   uint64            `json:"errors"`
+	Status   map[int]uint64    `json:"status"`
+	ErrorsBy map[string]uint64 `json:"errors_by_kind,omitempty"`
+	Latency  stats.Latency     `json:"latency"`
+
+	latency stats.Histogram
+}
+
+// Result is a finished test. Requests counts the answered ones, Errors
+// those that got no response.
+type Result struct {
+	Requests  uint64            `json:"requests"`
+	Errors    uint64            `json:"errors"`
+	Bytes     uint64            `json:"bytes"` // response bodies
+	Elapsed   time.Duration     `json:"elapsed_ns"`
+	RPS       float64           `json:"rps"`
+	Status    map[int]uint64    `json:"status"`
+	ErrorsBy  map[string]uint64 `json:"errors_by_kind,omitempty"`
+	Protocols map[string]uint64 `json:"protocols"`
+	Latency   stats.Latency     `json:"latency"`
+	Targets   []*TargetResult   `json:"targets"`
+}
+
+// Load generates HTTP requests. The zero value is ready to use.
+type Load struct {
+	counters stats.Counters
+}
+
+// Counters counts the responses and their body bytes as they come, for
+// interval reports.
+func (l *Load) Counters() *stats.Counters {
+	return &l.counters
+}
+
+// transport builds the HTTP client of cfg.
+func transport(cfg Config) (*http.Transport, error) {
+	tr := &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: 10 * time.Second}).DialContext,
+		MaxIdleConnsPerHost: cfg.Concurrency,
+		DisableKeepAlives:   cfg.DisableKeepAlives,
+		ForceAttemptHTTP2:   true,
+		TLSClientConfig:     &tls.Config{InsecureSkipVerify: cfg.Insecure},
+	}
+	if cfg.Proxy != "" {
+		u, err := url.Parse(cfg.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy: %v", err)
+		}
+		tr.Proxy = http.ProxyURL(u)
+	}
+	switch cfg.HTTP {
+	case "":
+	case "1.1", "1":
+		tr.Protocols = new(http.Protocols)
+		tr.Protocols.SetHTTP1(true)
+	case "2":
+		tr.Protocols = new(http.Protocols)
+		tr.Protocols.SetHTTP2(true)
+		tr.Protocols.SetUnencryptedHTTP2(true)
+	default:
+		return nil, fmt.Errorf("invalid HTTP version %q, want 1.1 or 2", cfg.HTTP)
+	}
+	return tr, nil
+}
+
+// Run runs the test cfg describes. Cancelling ctx ends it, the result
+// then covers the requests answered so far.
+func (l *Load) Run(ctx context.Context, cfg Config) (*Result, error) {
+	if len(cfg.Targets) == 0 {
+		return nil, errors.New("no target URLs")
+	}
+	for _, t := range cfg.Targets {
+		if u, err := url.Parse(t); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("invalid target URL %q", t)
+		}
+	}
+	if cfg.Method == "" {
+		cfg.Method = http.MethodGet
+	}
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = 10
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 30 * time.Second
+	}
+	tr, err := transport(cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer tr.CloseIdleConnections()
+	client := &http.Client{
+		Transport: tr,
+		Timeout:   cfg.Timeout,
+		// Redirects are answers too, count them as such.
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+
+	targets := make([]*TargetResult, len(cfg.Targets))
+	for i, t := range cfg.Targets {
+		targets[i] = &TargetResult{URL: t, Status: map[int]uint64{}, ErrorsBy: map[string]uint64{}}
+	}
+	res := &Result{Status: map[int]uint64{}, ErrorsBy: map[string]uint64{}, Protocols: map[string]uint64{}}
+	var mu sync.Mutex
+
+	// The producer paces the requests; in-flight ones finish after the
+	// test's end unless ctx is done.
+	produce := ctx
+	if cfg.Duration > 0 {
+		var cancel context.CancelFunc
+		produce, cancel = context.WithTimeout(ctx, cfg.Duration)
+		defer cancel()
+	}
+	jobs := make(chan uint64)
+	go func() {
+		defer close(jobs)
+		start := time.Now()
+		for i := uint64(0); cfg.Requests == 0 || i < cfg.Requests; i++ {
+			if cfg.RPS > 0 {
+				due := start.Add(time.Duration(float64(i) / cfg.RPS * float64(time.Second)))
+				if wait := time.Until(due); wait > 0 {
+					select {
+					case <-time.After(wait):
+					case <-produce.Done():
+						return
+					}
+				}
+			}
+			select {
+			case jobs <- i:
+			case <-produce.Done():
+				return
+			}
+		}
+	}()
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for range cfg.Concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				t := targets[i%uint64(len(targets))]
+				began := time.Now()
+				status, proto, n, err := l.do(ctx, client, cfg, t.URL)
+				took := time.Since(began)
+				if err != nil && ctx.Err() != nil {
+					// Interrupted, not the server's fault.
+					continue
+				}
+
+				mu.Lock()
+				if err != nil {
+					kind := errorKind(err)
+					t.Errors++
+					t.ErrorsBy[kind]++
+					res.Errors++
+					res.ErrorsBy[kind]++
+				} else {
+					t.Requests++
+					t.Status[status]++
+					res.Requests++
+					res.Status[status]++
+					res.Protocols[proto]++
+					res.Bytes += n
+				}
+				mu.Unlock()
+				if err == nil {
+					t.latency.Record(took)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	res.Elapsed = time.Since(start)
+
+	var all stats.Histogram
+	for _, t := range targets {
+		t.Latency = t.latency.Summary()
+		all.Merge(&t.latency)
+	}
+	res.Latency = all.Summary()
+	res.Targets = targets
+	if secs := res.Elapsed.Seconds(); secs > 0 {
+		res.RPS = float64(res.Requests) / secs
+	}
+	return res, nil
+}
+
+// do makes one request, returning the status, protocol and body size.
+func (l *Load) do(ctx context.Context, client *http.Client, cfg Config, target string) (int, string, uint64, error) {
+	var body io.Reader
+	if cfg.Body != nil {
+		body = bytes.NewReader(cfg.Body)
+	}
+	req, err := http.NewRequestWithContext(ctx, cfg.Method, target, body)
+	if err != nil {
+		return 0, "", 0, err
+	}
+	for k, v := range cfg.Header {
+		req.Header[k] = v
+	}
+	if host := cfg.Header.Get("Host"); host != "" {
+		req.Host = host
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, "", 0, err
+	}
+	n, err := io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return 0, "", 0, err
+	}
+	l.counters.Add(1, uint64(n))
+	return resp.StatusCode, resp.Proto, uint64(n), nil
+}
+
+// errorKind sorts request errors for the breakdown.
+func errorKind(err error) string {
+	var dnsErr *net.DNSError
+	var certErr *tls.CertificateVerificationError
+	var recordErr tls.RecordHeaderError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection refused"
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "connection reset"
+	case errors.As(err, &certErr):
+		return "tls certificate"
+	case errors.As(err, &recordErr):
+		return "tls"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	}
+	return "other"
+}
+
+// Write prints r for people, with the latency histogram when buckets is
+// set.
+func (r *Result) Write(w io.Writer, buckets bool) {
+	fmt.Fprintf(w, "Requests:  %d in %v (%.2f/s), %d errors, %.2f MB\n", r.Requests, r.Elapsed.Round(time.Millisecond), r.RPS, r.Errors, float64(r.Bytes)/1e6)
+	fmt.Fprintf(w, "Status:    %s\n", stats.Counts(r.Status))
+	if len(r.ErrorsBy) > 0 {
+		fmt.Fprintf(w, "Errors:    %s\n", stats.Counts(r.ErrorsBy))
+	}
+	fmt.Fprintf(w, "Protocols: %s\n", stats.Counts(r.Protocols))
+	r.Latency.Write(w, buckets)
+	if len(r.Targets) < 2 {
+		return
+	}
+	for _, t := range r.Targets {
+		fmt.Fprintf(w, "\n%s\n  %d requests, %d errors, status %s\n  ", t.URL, t.Requests, t.Errors, stats.Counts(t.Status))
+		t.Latency.Write(w, false)
+	}
+}
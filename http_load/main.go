@@ -0,0 +1,145 @@
+package httpload
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"gonet/pkg/config"
+	"gonet/pkg/logging"
+	"gonet/pkg/results"
+	"gonet/pkg/stats"
+)
+
+// Main runs gonet httpload with the arguments after the command name.
+func Main(args []string) {
+	// Command line flags
+	flags := flag.NewFlagSet("httpload", flag.ExitOnError)
+	var urls []string
+	flags.Func("url", "Target URL, repeatable, requested in turn with the ones given as arguments", func(s string) error {
+		urls = append(urls, s)
+		return nil
+	})
+	concurrency := flags.Int("c", 10, "Requests in flight at most")
+	rps := flags.Float64("rps", 0, "Requests started per second at most (0 for no limit)")
+	duration := flags.Duration("duration", 0, "How long to send requests (default 10s unless -n is given)")
+	requests := flags.Uint64("n", 0, "Stop after this many requests")
+	timeout := flags.Duration("timeout", 30*time.Second, "Timeout of each request")
+	method := flags.String("method", http.MethodGet, "Request method")
+	body := flags.String("body", "", "Request body")
+	bodyFile := flags.String("body-file", "", "File with the request body")
+	header := http.Header{}
+	flags.Func("H", `Request header "Name: value", repeatable; Host sets the host`, func(s string) error {
+		name, value, ok := strings.Cut(s, ":")
+		if !ok {
+			return errors.New(`want "Name: value"`)
+		}
+		header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+		return nil
+	})
+	httpVersion := flags.String("http", "", "Force HTTP 1.1 or 2, HTTP/2 over plain http being h2c (default: what the server offers)")
+	proxy := flags.String("proxy", "", "Send the requests through this HTTP proxy, e.g. http://127.0.0.1:8080 for gonet proxy")
+	insecure := flags.Bool("insecure", false, "Skip TLS certificate verification")
+	noKeepAlive := flags.Bool("no-keepalive", false, "Open a connection per request")
+	histogram := flags.Bool("histogram", false, "Print the latency histogram")
+	report := stats.RegisterFlags(flags)
+	record := results.RegisterFlags(flags)
+	jsonOut := flags.String("json", "", "Write the result as JSON to this file when done, - for stdout")
+	logs := logging.RegisterFlags(flags)
+	configFile := flags.String("config", "", "YAML or JSON file setting flags by name, command line flags win")
+	flags.Parse(args)
+
+	if _, err := config.LoadFlags(flags, *configFile); err != nil {
+		log.Fatalf("Invalid -config: %v", err)
+	}
+	if err := logs.Setup(); err != nil {
+		log.Fatal(err)
+	}
+	rec, err := record.Recorder(flags)
+	if err != nil {
+		log.Fatal(err)
+	}
+	report.Sinks = append(report.Sinks, rec)
+	urls = append(urls, flags.Args()...)
+	if len(urls) == 0 {
+		log.Fatal("Usage: gonet httpload [flags] <url>...")
+	}
+
+	cfg := Config{
+		Targets:           urls,
+		Method:            *method,
+		Header:            header,
+		Concurrency:       *concurrency,
+		RPS:               *rps,
+		Duration:          *duration,
+		Requests:          *requests,
+		Timeout:           *timeout,
+		HTTP:              *httpVersion,
+		Proxy:             *proxy,
+		Insecure:          *insecure,
+		DisableKeepAlives: *noKeepAlive,
+	}
+	if cfg.Duration == 0 && cfg.Requests == 0 {
+		cfg.Duration = 10 * time.Second
+	}
+	if *body != "" {
+		cfg.Body = []byte(*body)
+	}
+	if *bodyFile != "" {
+		data, err := os.ReadFile(*bodyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cfg.Body = data
+	}
+
+	// Stop on interrupt
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	var l Load
+	report.Unit = "Requests"
+	reporter, err := report.Reporter(l.Counters(), "Response", "received", "httpload")
+	if err != nil {
+		log.Fatal(err)
+	}
+	reporter.Start()
+	res, err := l.Run(ctx, cfg)
+	reporter.Stop()
+	if err != nil {
+		rec.Finish(nil, err)
+		log.Fatal(err)
+	}
+	if *jsonOut != "-" {
+		res.Write(os.Stdout, *histogram)
+	}
+
+	if *jsonOut != "" {
+		if err := results.Write(*jsonOut, res); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	metrics := map[string]float64{
+		"requests": float64(res.Requests),
+		"errors":   float64(res.Errors),
+		"rps":      res.RPS,
+		"bytes":    float64(res.Bytes),
+	}
+	if res.Requests > 0 {
+		metrics["error_percent"] = float64(res.Errors) / float64(res.Requests) * 100
+	}
+	for name, v := range res.Latency.Metrics("latency") {
+		metrics[name] = v
+	}
+	rec.Set(metrics)
+	if _, err := rec.Finish(res, nil); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,109 @@
+package leprox
+
+import (
+	"fmt"
+	"strings"
+)
+
+// accessRules are the ACLs and rate limits. The command line flags give
+// the defaults, fields set in the config file's "access" section replace
+// them, so they can be changed by reloading the config.
+type accessRules struct {
+	SNIAllow     []string `json:"sni_allow"`
+	SNIDeny      []string `json:"sni_deny"`
+	ConnectPorts string   `json:"connect_ports"`
+	RateClient   *float64 `json:"rate_client"`
+	RateHost     *float64 `json:"rate_host"`
+	RateBurst    *int     `json:"rate_burst"`
+}
+
+// flagAccess holds the access rules given on the command line.
+var flagAccess accessRules
+
+func (a *accessRules) compile() error {
+	if a.ConnectPorts != "" {
+		if _, err := parsePortList(a.ConnectPorts); err != nil {
+			return fmt.Errorf("connect_ports: %v", err)
+		}
+	}
+	if (a.RateClient != nil && *a.RateClient < 0) || (a.RateHost != nil && *a.RateHost < 0) {
+		return fmt.Errorf("rate limits can't be negative")
+	}
+	return nil
+}
+
+// merge returns a copy of a with the fields set in over replaced.
+func (a accessRules) merge(over *accessRules) accessRules {
+	if over == nil {
+		return a
+	}
+	if over.SNIAllow != nil {
+		a.SNIAllow = over.SNIAllow
+	}
+	if over.SNIDeny != nil {
+		a.SNIDeny = over.SNIDeny
+	}
+	if over.ConnectPorts != "" {
+		a.ConnectPorts = over.ConnectPorts
+	}
+	if over.RateClient != nil {
+		a.RateClient = over.RateClient
+	}
+	if over.RateHost != nil {
+		a.RateHost = over.RateHost
+	}
+	if over.RateBurst != nil {
+		a.RateBurst = over.RateBurst
+	}
+	return a
+}
+
+// accessPolicy is the compiled form of accessRules used by the handlers.
+type accessPolicy struct {
+	// sniAllow and sniDeny filter tunnels by the hostname in the TLS
+	// ClientHello. Deny wins; a non-empty allow list blocks everything it
+	// doesn't match.
+	sniAllow []string
+	sniDeny  []string
+
+	// connectPorts lists the destination ports CONNECT tunnels may reach;
+	// nil allows every port.
+	connectPorts portList
+
+	// clientLimits and hostLimits cap requests per second per client IP
+	// and per destination host; nil disables the limit.
+	clientLimits *rateLimiter
+	hostLimits   *rateLimiter
+}
+
+// newAccessPolicy compiles rules. Rate limiters of prev whose settings are
+// unchanged are kept, so a reload doesn't refill every bucket.
+func newAccessPolicy(rules accessRules, prev *accessPolicy) (*accessPolicy, error) {
+	p := &accessPolicy{}
+	ports, err := parsePortList(rules.ConnectPorts)
+	if err != nil {
+		return nil, fmt.Errorf("connect ports: %v", err)
+	}
+	p.connectPorts = ports
+	for _, pattern := range rules.SNIAllow {
+		p.sniAllow = append(p.sniAllow, strings.ToLower(pattern))
+	}
+	for _, pattern := range rules.SNIDeny {
+		p.sniDeny = append(p.sniDeny, strings.ToLower(pattern))
+	}
+
+	if prev == nil {
+		prev = &accessPolicy{}
+	}
+	burst := 0
+	if rules.RateBurst != nil {
+		burst = *rules.RateBurst
+	}
+	if rules.RateClient != nil {
+		p.clientLimits = prev.clientLimits.resize(*rules.RateClient, burst)
+	}
+	if rules.RateHost != nil {
+		p.hostLimits = prev.hostLimits.resize(*rules.RateHost, burst)
+	}
+	return p, nil
+}
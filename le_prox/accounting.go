@@ -0,0 +1,196 @@
+package leprox
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// trafficCounters accumulate traffic for one destination host or client.
+type trafficCounters struct {
+	Connections atomic.Int64
+	Requests    atomic.Int64
+	BytesUp     atomic.Int64
+	BytesDown   atomic.Int64
+}
+
+// trafficSnapshot is a point-in-time copy of trafficCounters.
+type trafficSnapshot struct {
+	Connections int64 `json:"connections"`
+	Requests    int64 `json:"requests"`
+	BytesUp     int64 `json:"bytes_up"`
+	BytesDown   int64 `json:"bytes_down"`
+}
+
+func (c *trafficCounters) snapshot() trafficSnapshot {
+	return trafficSnapshot{
+		Connections: c.Connections.Load(),
+		Requests:    c.Requests.Load(),
+		BytesUp:     c.BytesUp.Load(),
+		BytesDown:   c.BytesDown.Load(),
+	}
+}
+
+// trafficStats groups counters by destination host and by client IP.
+type trafficStats struct {
+	mu       sync.Mutex
+	byHost   map[string]*trafficCounters
+	byClient map[string]*trafficCounters
+}
+
+// traffic accounts for everything proxied since startup.
+var traffic = &trafficStats{
+	byHost:   make(map[string]*trafficCounters),
+	byClient: make(map[string]*trafficCounters),
+}
+
+// flow tracks the bytes of one tunnel or request and adds them to the
+// counters of its host and client as they are transferred.
+type flow struct {
+	client string
+	host   string
+	up     atomic.Int64
+	down   atomic.Int64
+
+	hostCounters   *trafficCounters
+	clientCounters *trafficCounters
+}
+
+func (f *flow) addUp(n int64) {
+	f.up.Add(n)
+	f.hostCounters.BytesUp.Add(n)
+	f.clientCounters.BytesUp.Add(n)
+}
+
+func (f *flow) addDown(n int64) {
+	f.down.Add(n)
+	f.hostCounters.BytesDown.Add(n)
+	f.clientCounters.BytesDown.Add(n)
+}
+
+// openFlow starts accounting for traffic between clientAddr and host.
+// Tunnels count as connections, plain HTTP exchanges as requests.
+func (t *trafficStats) openFlow(clientAddr, host string, tunnel bool) *flow {
+	client := clientAddr
+	if ip, _, err := net.SplitHostPort(clientAddr); err == nil {
+		client = ip
+	}
+
+	t.mu.Lock()
+	hc, ok := t.byHost[host]
+	if !ok {
+		hc = &trafficCounters{}
+		t.byHost[host] = hc
+	}
+	cc, ok := t.byClient[client]
+	if !ok {
+		cc = &trafficCounters{}
+		t.byClient[client] = cc
+	}
+	t.mu.Unlock()
+
+	if tunnel {
+		hc.Connections.Add(1)
+		cc.Connections.Add(1)
+	} else {
+		hc.Requests.Add(1)
+		cc.Requests.Add(1)
+	}
+	return &flow{client: client, host: host, hostCounters: hc, clientCounters: cc}
+}
+
+// snapshot copies the counters of every host and client.
+func (t *trafficStats) snapshot() (hosts, clients map[string]trafficSnapshot) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	hosts = make(map[string]trafficSnapshot, len(t.byHost))
+	for host, c := range t.byHost {
+		hosts[host] = c.snapshot()
+	}
+	clients = make(map[string]trafficSnapshot, len(t.byClient))
+	for client, c := range t.byClient {
+		clients[client] = c.snapshot()
+	}
+	return hosts, clients
+}
+
+// handleTraffic serves GET /admin/traffic.
+func handleTraffic(w http.ResponseWriter, r *http.Request) {
+	hosts, clients := traffic.snapshot()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"hosts":   hosts,
+		"clients": clients,
+	})
+}
+
+// reportTraffic logs the busiest hosts and clients every interval.
+func reportTraffic(interval time.Duration, top int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		hosts, clients := traffic.snapshot()
+		logTopTraffic("host", hosts, top)
+		logTopTraffic("client", clients, top)
+	}
+}
+
+func logTopTraffic(kind string, stats map[string]trafficSnapshot, top int) {
+	keys := make([]string, 0, len(stats))
+	for key := range stats {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := stats[keys[i]], stats[keys[j]]
+		return a.BytesUp+a.BytesDown > b.BytesUp+b.BytesDown
+	})
+	if len(keys) > top {
+		keys = keys[:top]
+	}
+
+	slog.Info("Traffic summary", "kind", kind, "count", len(stats))
+	for _, key := range keys {
+		s := stats[key]
+		slog.Info("Traffic", kind, key, "connections", s.Connections, "requests", s.Requests,
+			"bytes_up", s.BytesUp, "bytes_down", s.BytesDown)
+	}
+}
+
+// countingConn counts bytes written to an upstream connection as up and
+// bytes read from it as down.
+type countingConn struct {
+	io.ReadWriteCloser
+	flow *flow
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	c.flow.addDown(int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(p)
+	c.flow.addUp(int64(n))
+	return n, err
+}
+
+// countingReadCloser counts bytes read from a message body.
+type countingReadCloser struct {
+	io.ReadCloser
+	add func(int64)
+}
+
+func (c *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.add(int64(n))
+	return n, err
+}
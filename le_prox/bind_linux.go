@@ -0,0 +1,18 @@
+package leprox
+
+import "syscall"
+
+// bindToDevice pins sockets to an interface with SO_BINDTODEVICE so traffic
+// leaves through it even when the routing table would pick another one.
+func bindToDevice(iface string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var bindErr error
+		err := c.Control(func(fd uintptr) {
+			bindErr = syscall.BindToDevice(int(fd), iface)
+		})
+		if err != nil {
+			return err
+		}
+		return bindErr
+	}
+}
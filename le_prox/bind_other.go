@@ -0,0 +1,11 @@
+//go:build !linux
+
+package leprox
+
+import "syscall"
+
+// bindToDevice is a no-op outside Linux, where egress interfaces are
+// selected by their source address only.
+func bindToDevice(iface string) func(network, address string, c syscall.RawConn) error {
+	return nil
+}
@@ -0,0 +1,210 @@
+package leprox
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// maxRewriteBody caps the response size buffered for regex replacements,
+// larger bodies are passed through unchanged.
+const maxRewriteBody = 16 << 20
+
+// bodyRule stubs or rewrites the response body for matching requests.
+// File and Template answer the request from the proxy without contacting
+// upstream, Replace edits the upstream body with regex substitutions.
+// Exactly one of them is set.
+type bodyRule struct {
+	Match       requestMatch  `json:"match"`
+	Status      int           `json:"status"`
+	ContentType string        `json:"content_type"`
+	File        string        `json:"file"`
+	Template    string        `json:"template"`
+	Replace     []bodyReplace `json:"replace"`
+
+	tmpl *template.Template
+}
+
+// bodyReplace replaces every match of Regex with With, which may refer to
+// capture groups as $1 or ${name}.
+type bodyReplace struct {
+	Regex string `json:"regex"`
+	With  string `json:"with"`
+
+	re *regexp.Regexp
+}
+
+// stubData is what body templates can refer to.
+type stubData struct {
+	Method string
+	URL    string
+	Host   string
+	Path   string
+	Query  url.Values
+	Header http.Header
+}
+
+func (r *bodyRule) compile() error {
+	r.Match.Host = strings.ToLower(r.Match.Host)
+
+	set := 0
+	for _, ok := range []bool{r.File != "", r.Template != "", len(r.Replace) > 0} {
+		if ok {
+			set++
+		}
+	}
+	if set != 1 {
+		return fmt.Errorf("want exactly one of file, template or replace")
+	}
+	if r.Status != 0 && (r.Status < 100 || r.Status > 999) {
+		return fmt.Errorf("invalid status %d", r.Status)
+	}
+
+	if r.File != "" {
+		if _, err := os.Stat(r.File); err != nil {
+			return err
+		}
+	}
+	if r.Template != "" {
+		tmpl, err := template.New("body").Parse(r.Template)
+		if err != nil {
+			return err
+		}
+		r.tmpl = tmpl
+	}
+	for i := range r.Replace {
+		re, err := regexp.Compile(r.Replace[i].Regex)
+		if err != nil {
+			return fmt.Errorf("replace %d: %v", i, err)
+		}
+		r.Replace[i].re = re
+	}
+	return nil
+}
+
+// stubFor returns the first body rule that answers r without upstream, or
+// nil if the request should be forwarded.
+func stubFor(r *http.Request) *bodyRule {
+	rules := currentConfig().BodyRules
+	for i := range rules {
+		if len(rules[i].Replace) == 0 && rules[i].Match.matches(r.URL.Hostname(), r.URL.Path) {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+// respond builds the stubbed response to r.
+func (rule *bodyRule) respond(r *http.Request) (*http.Response, error) {
+	var body []byte
+	if rule.File != "" {
+		data, err := os.ReadFile(rule.File)
+		if err != nil {
+			return nil, err
+		}
+		body = data
+	} else {
+		var buf bytes.Buffer
+		err := rule.tmpl.Execute(&buf, stubData{
+			Method: r.Method,
+			URL:    r.URL.String(),
+			Host:   r.URL.Host,
+			Path:   r.URL.Path,
+			Query:  r.URL.Query(),
+			Header: r.Header,
+		})
+		if err != nil {
+			return nil, err
+		}
+		body = buf.Bytes()
+	}
+
+	status := rule.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	header := make(http.Header)
+	contentType := rule.ContentType
+	if contentType == "" {
+		contentType = http.DetectContentType(body)
+	}
+	header.Set("Content-Type", contentType)
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+
+	return &http.Response{
+		Status:        strconv.Itoa(status) + " " + http.StatusText(status),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       r,
+	}, nil
+}
+
+// rewriteBody applies the replacements of every matching body rule to the
+// response. Compressed bodies need an encoding rule that decodes them first.
+func rewriteBody(r *http.Request, resp *http.Response) {
+	var rules []bodyRule
+	for _, rule := range currentConfig().BodyRules {
+		if len(rule.Replace) > 0 && rule.Match.matches(r.URL.Hostname(), r.URL.Path) {
+			rules = append(rules, rule)
+		}
+	}
+	if len(rules) == 0 || resp.Body == http.NoBody {
+		return
+	}
+	if ce := resp.Header.Get("Content-Encoding"); ce != "" && ce != "identity" {
+		slog.Warn("Not rewriting encoded body, add a decode or transcode encoding rule", "encoding", ce, "url", r.URL)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxRewriteBody+1))
+	if err != nil {
+		slog.Warn("Failed to read body for rewriting", "url", r.URL, "err", err)
+		resp.Body.Close()
+		resp.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), errReader{err}))
+		return
+	}
+	if len(body) > maxRewriteBody {
+		slog.Warn("Not rewriting body, too large", "url", r.URL, "max_bytes", maxRewriteBody)
+		resp.Body = &decodedBody{ReadCloser: io.NopCloser(io.MultiReader(bytes.NewReader(body), resp.Body)), src: resp.Body}
+		return
+	}
+	resp.Body.Close()
+
+	for _, rule := range rules {
+		for _, repl := range rule.Replace {
+			body = repl.re.ReplaceAll(body, []byte(repl.With))
+		}
+		if rule.Status != 0 {
+			resp.StatusCode = rule.Status
+			resp.Status = strconv.Itoa(rule.Status) + " " + http.StatusText(rule.Status)
+		}
+		if rule.ContentType != "" {
+			resp.Header.Set("Content-Type", rule.ContentType)
+		}
+	}
+
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	changedRepresentation(resp)
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+}
+
+// errReader returns err on every read, to replay a failed body read.
+type errReader struct{ err error }
+
+func (r errReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
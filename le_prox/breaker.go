@@ -0,0 +1,107 @@
+package leprox
+
+import (
+	"errors"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errCircuitOpen is returned for dials to hosts whose circuit is open.
+var errCircuitOpen = errors.New("circuit open: upstream is failing, try again later")
+
+// breaker guards upstream hosts against repeated dials; nil disables it.
+var breaker *circuitBreaker
+
+// circuitBreaker opens a per-host circuit after threshold consecutive dial
+// failures. While open, dials fail immediately. Once cooldown has passed a
+// single trial dial is let through: success closes the circuit, failure
+// opens it for another cooldown.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	circuits map[string]*circuit
+}
+
+type circuit struct {
+	failures  int
+	openUntil time.Time
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		circuits:  make(map[string]*circuit),
+	}
+}
+
+// allow reports whether a dial to host may proceed.
+func (b *circuitBreaker) allow(host string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c, ok := b.circuits[strings.ToLower(host)]
+	if !ok || c.failures < b.threshold {
+		return true
+	}
+	now := time.Now()
+	if now.Before(c.openUntil) {
+		return false
+	}
+	// Half-open: this caller gets the trial, everyone else keeps failing
+	// fast until it reports back.
+	c.openUntil = now.Add(b.cooldown)
+	return true
+}
+
+// success closes the circuit for host.
+func (b *circuitBreaker) success(host string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	key := strings.ToLower(host)
+	if c, ok := b.circuits[key]; ok && c.failures >= b.threshold {
+		slog.Info("Circuit closed", "host", host)
+	}
+	delete(b.circuits, key)
+}
+
+// failure records a failed dial to host, opening its circuit once the
+// threshold is reached.
+func (b *circuitBreaker) failure(host string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	key := strings.ToLower(host)
+	c, ok := b.circuits[key]
+	if !ok {
+		c = &circuit{}
+		b.circuits[key] = c
+	}
+	c.failures++
+	if c.failures >= b.threshold {
+		c.openUntil = time.Now().Add(b.cooldown)
+		if c.failures == b.threshold {
+			slog.Warn("Circuit opened", "host", host, "failures", c.failures)
+		}
+	}
+}
+
+// openCircuits lists the hosts whose circuit is currently open.
+func (b *circuitBreaker) openCircuits() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	hosts := []string{}
+	for host, c := range b.circuits {
+		if c.failures >= b.threshold && now.Before(c.openUntil) {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
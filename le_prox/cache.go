@@ -0,0 +1,458 @@
+package leprox
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cache answers repeated GETs locally; nil disables caching.
+var cache *responseCache
+
+// cachedResponse is a stored response together with what is needed to
+// decide whether it may be reused.
+type cachedResponse struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	// Stored is when the response was received or last revalidated.
+	Stored time.Time
+	// Vary holds the request header values named by the Vary header.
+	Vary map[string]string
+}
+
+// responseCache is a shared HTTP cache loosely following RFC 7234. Entries
+// are kept in memory, or in dir if one is set, and evicted least recently
+// used first once their total size exceeds maxSize.
+type responseCache struct {
+	transport http.RoundTripper
+	dir       string
+	maxSize   int64
+	maxObject int64
+	bypass    []string
+
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+// cacheSlot is an LRU element. resp is nil for disk backed entries.
+type cacheSlot struct {
+	key  string
+	size int64
+	resp *cachedResponse
+}
+
+// newResponseCache creates a cache in front of transport. Entries left in
+// dir by an earlier run are reused.
+func newResponseCache(transport http.RoundTripper, dir string, maxSize, maxObject int64) (*responseCache, error) {
+	c := &responseCache{
+		transport: transport,
+		dir:       dir,
+		maxSize:   maxSize,
+		maxObject: maxObject,
+		lru:       list.New(),
+		entries:   make(map[string]*list.Element),
+	}
+	if dir == "" {
+		return c, nil
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var infos []os.FileInfo
+	for _, f := range files {
+		if info, err := f.Info(); err == nil && info.Mode().IsRegular() {
+			infos = append(infos, info)
+		}
+	}
+	// Oldest files go to the back of the LRU so they are evicted first.
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ModTime().After(infos[j].ModTime()) })
+	for _, info := range infos {
+		c.insert(&cacheSlot{key: info.Name(), size: info.Size()})
+	}
+	return c, nil
+}
+
+// RoundTrip serves r from the cache when a fresh entry exists, revalidates
+// stale entries that have validators and stores cacheable responses.
+func (c *responseCache) RoundTrip(r *http.Request) (*http.Response, error) {
+	if !c.usable(r) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			// Unsafe methods invalidate what is stored for the URL.
+			c.delete(cacheKey(r.URL.String()))
+		}
+		return c.transport.RoundTrip(r)
+	}
+
+	key := cacheKey(r.URL.String())
+	stored := c.get(key)
+	if stored != nil && !stored.matchesVary(r) {
+		stored = nil
+	}
+
+	reqCC := parseCacheControl(r.Header.Values("Cache-Control"))
+	_, noCache := reqCC["no-cache"]
+	if r.Header.Get("Pragma") == "no-cache" || reqCC["max-age"] == "0" {
+		noCache = true
+	}
+
+	if stored != nil && !noCache && stored.fresh() {
+		cacheHits.Add(1)
+		return stored.response(r, "HIT"), nil
+	}
+
+	// Revalidate with the stored validators, unless the client sent its own
+	// conditional request, which is answered by upstream as is.
+	conditional := r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != ""
+	if stored != nil && !conditional {
+		etag, lastModified := stored.Header.Get("ETag"), stored.Header.Get("Last-Modified")
+		if etag != "" || lastModified != "" {
+			r = r.Clone(r.Context())
+			if etag != "" {
+				r.Header.Set("If-None-Match", etag)
+			}
+			if lastModified != "" {
+				r.Header.Set("If-Modified-Since", lastModified)
+			}
+		}
+	}
+
+	resp, err := c.transport.RoundTrip(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if stored != nil && !conditional && resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		cacheRevalidations.Add(1)
+		// Memory entries are shared with concurrent readers, so the
+		// refreshed entry is a copy.
+		updated := *stored
+		updated.Header = stored.Header.Clone()
+		for name, values := range resp.Header {
+			updated.Header[name] = values
+		}
+		updated.Stored = time.Now()
+		c.put(key, &updated)
+		return updated.response(r, "REVALIDATED"), nil
+	}
+
+	cacheMisses.Add(1)
+	if r.Method == http.MethodGet && storable(r, resp) {
+		header := resp.Header.Clone()
+		resp.Body = &cacheFill{
+			ReadCloser: resp.Body,
+			limit:      c.maxObject,
+			done: func(body []byte) {
+				c.put(key, &cachedResponse{
+					StatusCode: resp.StatusCode,
+					Header:     header,
+					Body:       body,
+					Stored:     time.Now(),
+					Vary:       varyValues(r, resp.Header),
+				})
+			},
+		}
+	}
+	resp.Header.Set("X-Cache", "MISS")
+	return resp, nil
+}
+
+// usable reports whether r may be answered from or stored in the cache.
+func (c *responseCache) usable(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if r.Header.Get("Range") != "" || upgradeType(r.Header) != "" {
+		return false
+	}
+	if _, ok := parseCacheControl(r.Header.Values("Cache-Control"))["no-store"]; ok {
+		return false
+	}
+	for _, pattern := range c.bypass {
+		if matchHost(pattern, r.URL.Hostname()) {
+			return false
+		}
+	}
+	return true
+}
+
+// storable reports whether resp to r may be stored by a shared cache.
+func storable(r *http.Request, resp *http.Response) bool {
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNonAuthoritativeInfo, http.StatusMultipleChoices,
+		http.StatusMovedPermanently, http.StatusNotFound, http.StatusGone:
+	default:
+		return false
+	}
+	cc := parseCacheControl(resp.Header.Values("Cache-Control"))
+	if _, ok := cc["no-store"]; ok {
+		return false
+	}
+	if _, ok := cc["private"]; ok {
+		return false
+	}
+	if r.Header.Get("Authorization") != "" {
+		_, public := cc["public"]
+		_, shared := cc["s-maxage"]
+		if !public && !shared {
+			return false
+		}
+	}
+	// Responses setting cookies are per user.
+	if resp.Header.Get("Set-Cookie") != "" || resp.Header.Get("Vary") == "*" {
+		return false
+	}
+	return freshnessLifetime(resp.Header) > 0 || resp.Header.Get("ETag") != "" || resp.Header.Get("Last-Modified") != ""
+}
+
+// freshnessLifetime returns how long a response stays fresh, from s-maxage,
+// max-age, Expires or, failing those, 10% of the time since Last-Modified.
+func freshnessLifetime(h http.Header) time.Duration {
+	cc := parseCacheControl(h.Values("Cache-Control"))
+	if _, ok := cc["no-cache"]; ok {
+		return 0
+	}
+	for _, directive := range []string{"s-maxage", "max-age"} {
+		if v, ok := cc[directive]; ok {
+			seconds, err := strconv.Atoi(v)
+			if err != nil {
+				return 0
+			}
+			return time.Duration(seconds) * time.Second
+		}
+	}
+
+	date, err := http.ParseTime(h.Get("Date"))
+	if err != nil {
+		date = time.Now()
+	}
+	if expires := h.Get("Expires"); expires != "" {
+		t, err := http.ParseTime(expires)
+		if err != nil {
+			return 0
+		}
+		return t.Sub(date)
+	}
+	if lm, err := http.ParseTime(h.Get("Last-Modified")); err == nil && lm.Before(date) {
+		return min(date.Sub(lm)/10, 24*time.Hour)
+	}
+	return 0
+}
+
+// age returns the current age of the entry, including the age it already
+// had when it was received.
+func (e *cachedResponse) age() time.Duration {
+	age := time.Since(e.Stored)
+	if seconds, err := strconv.Atoi(e.Header.Get("Age")); err == nil {
+		age += time.Duration(seconds) * time.Second
+	}
+	return age
+}
+
+func (e *cachedResponse) fresh() bool {
+	return e.age() < freshnessLifetime(e.Header)
+}
+
+func (e *cachedResponse) matchesVary(r *http.Request) bool {
+	for name, value := range e.Vary {
+		if strings.Join(r.Header.Values(name), ",") != value {
+			return false
+		}
+	}
+	return true
+}
+
+// response builds a response to r from the entry.
+func (e *cachedResponse) response(r *http.Request, status string) *http.Response {
+	header := e.Header.Clone()
+	header.Set("Age", strconv.Itoa(int(e.age().Seconds())))
+	header.Set("X-Cache", status)
+	header.Set("Content-Length", strconv.Itoa(len(e.Body)))
+	header.Del("Transfer-Encoding")
+
+	body := io.NopCloser(bytes.NewReader(e.Body))
+	if r.Method == http.MethodHead {
+		body = http.NoBody
+	}
+	return &http.Response{
+		Status:        strconv.Itoa(e.StatusCode) + " " + http.StatusText(e.StatusCode),
+		StatusCode:    e.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          body,
+		ContentLength: int64(len(e.Body)),
+		Request:       r,
+	}
+}
+
+// varyValues records the request headers a response varies on.
+func varyValues(r *http.Request, h http.Header) map[string]string {
+	values := make(map[string]string)
+	for _, v := range h.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			if name = http.CanonicalHeaderKey(strings.TrimSpace(name)); name != "" {
+				values[name] = strings.Join(r.Header.Values(name), ",")
+			}
+		}
+	}
+	return values
+}
+
+// parseCacheControl splits Cache-Control directives into a map of
+// lowercased names to (unquoted) values.
+func parseCacheControl(values []string) map[string]string {
+	cc := make(map[string]string)
+	for _, v := range values {
+		for _, directive := range strings.Split(v, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if name != "" {
+				cc[strings.ToLower(name)] = strings.Trim(value, `"`)
+			}
+		}
+	}
+	return cc
+}
+
+// cacheKey maps a URL to a key that is also safe as a file name.
+func cacheKey(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *responseCache) get(key string) *cachedResponse {
+	c.mu.Lock()
+	el, ok := c.entries[key]
+	if !ok {
+		c.mu.Unlock()
+		return nil
+	}
+	c.lru.MoveToFront(el)
+	slot := el.Value.(*cacheSlot)
+	c.mu.Unlock()
+
+	if slot.resp != nil {
+		return slot.resp
+	}
+	f, err := os.Open(filepath.Join(c.dir, key))
+	if err != nil {
+		c.delete(key)
+		return nil
+	}
+	defer f.Close()
+	var e cachedResponse
+	if err := gob.NewDecoder(f).Decode(&e); err != nil {
+		slog.Warn("Dropping unreadable cache entry", "key", key, "err", err)
+		c.delete(key)
+		return nil
+	}
+	return &e
+}
+
+func (c *responseCache) put(key string, e *cachedResponse) {
+	slot := &cacheSlot{key: key, size: int64(len(e.Body))}
+	if c.dir == "" {
+		slot.resp = e
+	} else {
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(e); err != nil {
+			slog.Warn("Failed to encode cache entry", "err", err)
+			return
+		}
+		if err := os.WriteFile(filepath.Join(c.dir, key), buf.Bytes(), 0o644); err != nil {
+			slog.Warn("Failed to write cache entry", "err", err)
+			return
+		}
+		slot.size = int64(buf.Len())
+	}
+	if slot.size > c.maxSize {
+		c.delete(key)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.size -= el.Value.(*cacheSlot).size
+		c.lru.Remove(el)
+		delete(c.entries, key)
+	}
+	c.insert(slot)
+}
+
+// insert adds slot and evicts entries until the cache fits. c.mu must be
+// held, except during construction.
+func (c *responseCache) insert(slot *cacheSlot) {
+	c.entries[slot.key] = c.lru.PushFront(slot)
+	c.size += slot.size
+	for c.size > c.maxSize && c.lru.Len() > 1 {
+		c.evict(c.lru.Back())
+	}
+}
+
+func (c *responseCache) delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.evict(el)
+	}
+}
+
+// evict removes el from the cache. c.mu must be held.
+func (c *responseCache) evict(el *list.Element) {
+	slot := el.Value.(*cacheSlot)
+	c.lru.Remove(el)
+	delete(c.entries, slot.key)
+	c.size -= slot.size
+	if c.dir != "" {
+		os.Remove(filepath.Join(c.dir, slot.key))
+	}
+}
+
+// cacheFill buffers a response body as it is relayed and hands it to done
+// once it has been read completely. Bodies over limit are not stored.
+type cacheFill struct {
+	io.ReadCloser
+	limit int64
+	buf   bytes.Buffer
+	over  bool
+	done  func([]byte)
+}
+
+func (f *cacheFill) Read(p []byte) (int, error) {
+	n, err := f.ReadCloser.Read(p)
+	if !f.over {
+		if int64(f.buf.Len()+n) > f.limit {
+			f.over = true
+			f.buf = bytes.Buffer{}
+		} else {
+			f.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF && !f.over && f.done != nil {
+		f.done(f.buf.Bytes())
+		f.done = nil
+	}
+	return n, err
+}
@@ -0,0 +1,107 @@
+package leprox
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// cidrRoute sends connections to addresses in prefix out through an
+// egress or a SOCKS5 upstream. With neither, they are dialed directly.
+type cidrRoute struct {
+	prefix netip.Prefix
+	egress *egress
+	socks  *socks5Dialer
+}
+
+// cidrRoutes split traffic by destination address, e.g. lab networks
+// through a jump host and everything else direct.
+var cidrRoutes []cidrRoute
+
+// addCIDRRoute parses a cidr=target rule. The target is "direct", a local
+// IP address or interface, or a SOCKS5 upstream as host:port or URL.
+func addCIDRRoute(rule string) error {
+	cidr, target, ok := strings.Cut(rule, "=")
+	if !ok || cidr == "" || target == "" {
+		return fmt.Errorf("invalid CIDR route %q, want cidr=target", rule)
+	}
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return err
+	}
+
+	route := cidrRoute{prefix: prefix.Masked()}
+	switch _, _, err := net.SplitHostPort(target); {
+	case target == "direct":
+	case err == nil || strings.Contains(target, "://"):
+		d, err := parseSOCKS5(target)
+		if err != nil {
+			return err
+		}
+		route.socks = d
+	default:
+		e, err := parseEgress(target)
+		if err != nil {
+			return err
+		}
+		route.egress = e
+	}
+	cidrRoutes = append(cidrRoutes, route)
+	return nil
+}
+
+// cidrRouteFor returns the most specific route covering ip, like a routing
+// table, or nil.
+func cidrRouteFor(ip netip.Addr) *cidrRoute {
+	var best *cidrRoute
+	for i, route := range cidrRoutes {
+		if route.prefix.Contains(ip) && (best == nil || route.prefix.Bits() > best.prefix.Bits()) {
+			best = &cidrRoutes[i]
+		}
+	}
+	return best
+}
+
+func (r *cidrRoute) String() string {
+	switch {
+	case r.socks != nil:
+		return r.socks.String()
+	case r.egress != nil:
+		return r.egress.String()
+	}
+	return "direct"
+}
+
+// dialByCIDR resolves target and dials the first of its addresses covered
+// by a CIDR route. ok is false if no address is covered or the name doesn't
+// resolve here, leaving target to the host based rules.
+func dialByCIDR(ctx context.Context, network, target string) (conn net.Conn, ok bool, err error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, false, nil
+	}
+	addrs, err := lookupHost(ctx, host)
+	if err != nil {
+		return nil, false, nil
+	}
+
+	for _, ip := range addrs {
+		route := cidrRouteFor(ip.Unmap())
+		if route == nil {
+			continue
+		}
+		addr := net.JoinHostPort(ip.Unmap().String(), port)
+		switch {
+		case route.socks != nil:
+			conn, err = route.socks.DialContext(ctx, network, addr)
+		case route.egress != nil:
+			conn, err = route.egress.dialer().DialContext(ctx, network, addr)
+		default:
+			conn, err = upstreamDialer.DialContext(ctx, network, addr)
+		}
+		return conn, true, err
+	}
+	return nil, false, nil
+}
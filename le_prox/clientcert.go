@@ -0,0 +1,72 @@
+package leprox
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// clientCert is a TLS client certificate presented to upstreams matching
+// pattern.
+type clientCert struct {
+	pattern string
+	cert    tls.Certificate
+}
+
+// parseClientCert parses a pattern=cert.pem,key.pem rule.
+func parseClientCert(rule string) (clientCert, error) {
+	pattern, files, ok := strings.Cut(rule, "=")
+	certFile, keyFile, ok2 := strings.Cut(files, ",")
+	if !ok || !ok2 || pattern == "" || certFile == "" || keyFile == "" {
+		return clientCert{}, fmt.Errorf("invalid client certificate %q, want pattern=cert.pem,key.pem", rule)
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return clientCert{}, err
+	}
+	return clientCert{pattern: strings.ToLower(pattern), cert: cert}, nil
+}
+
+// clientCertFor returns the first certificate whose pattern matches host.
+func clientCertFor(certs []clientCert, host string) *tls.Certificate {
+	for i := range certs {
+		if matchHost(certs[i].pattern, host) {
+			return &certs[i].cert
+		}
+	}
+	return nil
+}
+
+// dialTLSWithClientCerts returns a TLS dialer for the upstream transport
+// that presents the client certificate configured for each host. The
+// standard GetClientCertificate hook can't be used since it isn't told
+// which server is asking.
+func dialTLSWithClientCerts(base *tls.Config, certs []clientCert, http2 bool) func(context.Context, string, string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dialUpstream(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		host := hostOnly(addr)
+		cfg := base.Clone()
+		if cfg.ServerName == "" {
+			cfg.ServerName = host
+		}
+		if cert := clientCertFor(certs, host); cert != nil {
+			cfg.Certificates = []tls.Certificate{*cert}
+		}
+		if http2 && len(cfg.NextProtos) == 0 {
+			cfg.NextProtos = []string{"h2", "http/1.1"}
+		}
+
+		tlsConn := tls.Client(conn, cfg)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+}
@@ -0,0 +1,141 @@
+package leprox
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"gonet/pkg/config"
+)
+
+// proxyConfig holds the rule lists loaded from the -config file, the
+// sections next to its flag values.
+type proxyConfig struct {
+	HeaderRules []headerRule   `json:"header_rules"`
+	Routes      []routeRule    `json:"routes"`
+	Encodings   []encodingRule `json:"encodings"`
+	BodyRules   []bodyRule     `json:"body_rules"`
+	// VirtualHosts are only used by the -reverse listener.
+	VirtualHosts []*virtualHost `json:"virtual_hosts"`
+	// Access overrides the ACL and rate limit flags.
+	Access *accessRules `json:"access"`
+	// SLOs are the objectives requests are tracked against.
+	SLOs []*sloRule `json:"slos"`
+
+	// access combines the flags with Access, see activateConfig.
+	access *accessPolicy
+}
+
+// activeConfig is the configuration used by request handlers.
+var activeConfig atomic.Pointer[proxyConfig]
+
+// currentConfig returns the active configuration, which is empty until
+// main activates one.
+func currentConfig() *proxyConfig {
+	if cfg := activeConfig.Load(); cfg != nil {
+		return cfg
+	}
+	return &proxyConfig{access: &accessPolicy{}}
+}
+
+// activateConfig applies the access rules of the flags and cfg and makes
+// cfg the active configuration in one step, so every request sees either
+// the old or the new rules. Connections in progress are left alone.
+func activateConfig(cfg *proxyConfig) error {
+	policy, err := newAccessPolicy(flagAccess.merge(cfg.Access), currentConfig().access)
+	if err != nil {
+		return err
+	}
+	cfg.access = policy
+	activateSLOs(cfg.SLOs)
+	activeConfig.Store(cfg)
+	return nil
+}
+
+// configSections are the keys of a -config file that aren't flags.
+var configSections = []string{"header_rules", "routes", "encodings", "body_rules", "virtual_hosts", "access", "slos"}
+
+// proxyFlags are the proxy's flags, whose keys in a -config file were
+// applied at startup and are skipped when the file is reloaded.
+var proxyFlags *flag.FlagSet
+
+// loadConfig reads and validates a YAML or JSON config file.
+func loadConfig(path string) (*proxyConfig, error) {
+	doc, err := config.Load(path)
+	if err != nil {
+		return nil, err
+	}
+	for key := range doc {
+		if proxyFlags != nil && proxyFlags.Lookup(key) != nil {
+			delete(doc, key)
+		}
+	}
+
+	var cfg proxyConfig
+	if err := config.Decode(doc, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	for i := range cfg.HeaderRules {
+		if err := cfg.HeaderRules[i].compile(); err != nil {
+			return nil, fmt.Errorf("%s: header rule %d: %v", path, i, err)
+		}
+	}
+	for i := range cfg.Routes {
+		if err := cfg.Routes[i].compile(); err != nil {
+			return nil, fmt.Errorf("%s: route %d: %v", path, i, err)
+		}
+	}
+	for i := range cfg.Encodings {
+		if err := cfg.Encodings[i].compile(); err != nil {
+			return nil, fmt.Errorf("%s: encoding rule %d: %v", path, i, err)
+		}
+	}
+	for i := range cfg.BodyRules {
+		if err := cfg.BodyRules[i].compile(); err != nil {
+			return nil, fmt.Errorf("%s: body rule %d: %v", path, i, err)
+		}
+	}
+	for i := range cfg.VirtualHosts {
+		if err := cfg.VirtualHosts[i].compile(); err != nil {
+			return nil, fmt.Errorf("%s: virtual host %d: %v", path, i, err)
+		}
+	}
+	names := make(map[string]bool)
+	for i, slo := range cfg.SLOs {
+		if err := slo.compile(); err != nil {
+			return nil, fmt.Errorf("%s: SLO %d: %v", path, i, err)
+		}
+		if names[slo.Name] {
+			return nil, fmt.Errorf("%s: SLO %d: duplicate name %q", path, i, slo.Name)
+		}
+		names[slo.Name] = true
+	}
+	if cfg.Access != nil {
+		if err := cfg.Access.compile(); err != nil {
+			return nil, fmt.Errorf("%s: access: %v", path, err)
+		}
+	}
+	return &cfg, nil
+}
+
+// summary counts the rules of cfg for logging.
+func (cfg *proxyConfig) summary() string {
+	return fmt.Sprintf("%d header rules, %d routes, %d encoding rules, %d body rules, %d virtual hosts and %d SLOs",
+		len(cfg.HeaderRules), len(cfg.Routes), len(cfg.Encodings), len(cfg.BodyRules), len(cfg.VirtualHosts), len(cfg.SLOs))
+}
+
+// requestMatch selects requests by host pattern and path prefix. Empty
+// fields match everything.
+type requestMatch struct {
+	Host string `json:"host"`
+	Path string `json:"path"`
+}
+
+func (m *requestMatch) matches(host, path string) bool {
+	if m.Host != "" && !matchHost(m.Host, host) {
+		return false
+	}
+	return strings.HasPrefix(path, m.Path)
+}
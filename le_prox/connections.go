@@ -0,0 +1,154 @@
+package leprox
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// activeConn is a tunnel currently relaying bytes.
+type activeConn struct {
+	id          uint64
+	kind        string
+	client      string
+	destination string
+	started     time.Time
+	flow        *flow
+	closers     []io.Closer
+}
+
+// connRegistry tracks active tunnels so they can be listed and closed
+// through the admin API.
+type connRegistry struct {
+	mu     sync.Mutex
+	nextID uint64
+	conns  map[uint64]*activeConn
+}
+
+var activeConns = &connRegistry{conns: make(map[uint64]*activeConn)}
+
+// add registers a tunnel. closers are closed when the tunnel is killed.
+func (r *connRegistry) add(kind, client, destination string, f *flow, closers ...io.Closer) *activeConn {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.nextID++
+	c := &activeConn{
+		id:          r.nextID,
+		kind:        kind,
+		client:      client,
+		destination: destination,
+		started:     time.Now(),
+		flow:        f,
+		closers:     closers,
+	}
+	r.conns[c.id] = c
+	return c
+}
+
+func (r *connRegistry) remove(c *activeConn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.conns, c.id)
+}
+
+// kill closes the tunnel with the given id and reports whether it existed.
+func (r *connRegistry) kill(id uint64) bool {
+	r.mu.Lock()
+	c, ok := r.conns[id]
+	r.mu.Unlock()
+	if !ok {
+		return false
+	}
+	for _, closer := range c.closers {
+		closer.Close()
+	}
+	return true
+}
+
+// connInfo is the admin API view of an active tunnel.
+type connInfo struct {
+	ID          uint64    `json:"id"`
+	Kind        string    `json:"kind"`
+	Client      string    `json:"client"`
+	Destination string    `json:"destination"`
+	Started     time.Time `json:"started"`
+	AgeSeconds  float64   `json:"age_seconds"`
+	BytesUp     int64     `json:"bytes_up"`
+	BytesDown   int64     `json:"bytes_down"`
+}
+
+// list returns the active tunnels ordered by id.
+func (r *connRegistry) list() []connInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	infos := make([]connInfo, 0, len(r.conns))
+	for _, c := range r.conns {
+		infos = append(infos, connInfo{
+			ID:          c.id,
+			Kind:        c.kind,
+			Client:      c.client,
+			Destination: c.destination,
+			Started:     c.started,
+			AgeSeconds:  now.Sub(c.started).Seconds(),
+			BytesUp:     c.flow.up.Load(),
+			BytesDown:   c.flow.down.Load(),
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+// relay copies bytes between a client and its upstream in both directions
+// and keeps the tunnel registered until both directions are done.
+func relay(kind, client, destination string, clientIn io.ReadCloser, clientOut io.WriteCloser, upstream *countingConn) {
+	c := activeConns.add(kind, client, destination, upstream.flow, upstream, clientOut)
+
+	// An emulated access network delays both directions.
+	var downstream io.ReadCloser = upstream
+	if pipes := impairment(client, hostOnly(destination)); pipes != nil {
+		clientIn = pipes.up.reader(clientIn)
+		downstream = pipes.down.reader(upstream)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		transfer(upstream, clientIn)
+	}()
+	go func() {
+		defer wg.Done()
+		transfer(clientOut, downstream)
+	}()
+	go func() {
+		wg.Wait()
+		activeConns.remove(c)
+	}()
+}
+
+// handleListConnections serves GET /admin/connections.
+func handleListConnections(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(activeConns.list())
+}
+
+// handleKillConnection serves DELETE /admin/connections/{id}.
+func handleKillConnection(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid connection id", http.StatusBadRequest)
+		return
+	}
+	if !activeConns.kill(id) {
+		http.Error(w, "no such connection", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
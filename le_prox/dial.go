@@ -0,0 +1,183 @@
+package leprox
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+)
+
+// socksRoute sends destinations matching pattern through dialer. A nil
+// dialer means the destination is dialed directly.
+type socksRoute struct {
+	pattern string
+	dialer  *socks5Dialer
+}
+
+var (
+	// socksDefault is used for destinations that match no route.
+	socksDefault *socks5Dialer
+	socksRoutes  []socksRoute
+
+	// dialRetries is how many times a failed dial is retried, waiting
+	// dialBackoff before the first retry and twice as long each time after.
+	dialRetries int
+	dialBackoff = 100 * time.Millisecond
+
+	// upstreamDialer opens every outbound TCP connection, including the
+	// ones to SOCKS5 upstreams.
+	upstreamDialer = &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+)
+
+// addSOCKSRoute parses a pattern=upstream rule, where upstream is a SOCKS5
+// address or "direct".
+func addSOCKSRoute(rule string) error {
+	pattern, upstream, ok := strings.Cut(rule, "=")
+	if !ok || pattern == "" || upstream == "" {
+		return fmt.Errorf("invalid route %q, want pattern=upstream", rule)
+	}
+
+	route := socksRoute{pattern: strings.ToLower(pattern)}
+	if upstream != "direct" {
+		d, err := parseSOCKS5(upstream)
+		if err != nil {
+			return err
+		}
+		route.dialer = d
+	}
+	socksRoutes = append(socksRoutes, route)
+	return nil
+}
+
+// socksFor returns the SOCKS5 upstream for host, or nil to dial directly.
+func socksFor(host string) *socks5Dialer {
+	for _, route := range socksRoutes {
+		if matchHost(route.pattern, host) {
+			return route.dialer
+		}
+	}
+	return socksDefault
+}
+
+// dialUpstream opens the outbound connection for both CONNECT tunnels and
+// plain HTTP requests. Routing rules match the requested host, host
+// overrides only change the addresses that are finally dialed. Hosts with an
+// open circuit are rejected without dialing.
+func dialUpstream(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if breaker != nil {
+		if !breaker.allow(host) {
+			circuitRejections.Add(1)
+			return nil, errCircuitOpen
+		}
+	}
+
+	conn, err := dialWithRetries(ctx, host, network, addr)
+	if breaker != nil {
+		if err != nil && ctx.Err() == nil {
+			breaker.failure(host)
+		} else if err == nil {
+			breaker.success(host)
+		}
+	}
+	if err == nil && sendProxyProtocol {
+		client, _ := ctx.Value(clientAddrKey{}).(string)
+		if err := writeProxyHeader(conn, client, conn.RemoteAddr()); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, err
+}
+
+// dialWithRetries dials addr, failing over between its replicas and
+// retrying with exponential backoff.
+func dialWithRetries(ctx context.Context, host, network, addr string) (net.Conn, error) {
+	targets := overrideAddrs(addr)
+
+	var lastErr error
+	backoff := dialBackoff
+	for attempt := 0; attempt <= dialRetries; attempt++ {
+		if attempt > 0 {
+			dialRetriesTotal.Add(1)
+			slog.Warn("Retrying dial", "addr", addr, "backoff", backoff, "err", lastErr)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			backoff *= 2
+		}
+
+		for i, target := range targets {
+			if i > 0 {
+				dialFailovers.Add(1)
+				slog.Warn("Failing over", "addr", addr, "to", target, "err", lastErr)
+			}
+			conn, err := dialTarget(ctx, host, network, target)
+			if err == nil {
+				return conn, nil
+			}
+			lastErr = err
+			if ctx.Err() != nil {
+				return nil, lastErr
+			}
+		}
+	}
+	return nil, lastErr
+}
+
+// dialTarget makes a single connection attempt to target on behalf of
+// requests for host. Routes by destination address win over the ones by
+// host pattern.
+func dialTarget(ctx context.Context, host, network, target string) (net.Conn, error) {
+	if len(cidrRoutes) > 0 {
+		if conn, ok, err := dialByCIDR(ctx, network, target); ok {
+			return conn, err
+		}
+	}
+	if d := socksFor(host); d != nil {
+		return d.DialContext(ctx, network, target)
+	}
+
+	if dnsCache != nil {
+		return dialCached(ctx, dialerFor(host), network, target)
+	}
+	return dialerFor(host).DialContext(ctx, network, target)
+}
+
+// matchHost reports whether host matches pattern. Patterns are either an
+// exact hostname, "*" for everything, or "*.example.com" / ".example.com"
+// for example.com and all of its subdomains.
+func matchHost(pattern, host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if pattern == "*" || pattern == host {
+		return true
+	}
+
+	suffix := strings.TrimPrefix(pattern, "*")
+	if !strings.HasPrefix(suffix, ".") {
+		return false
+	}
+	return host == suffix[1:] || strings.HasSuffix(host, suffix)
+}
+
+// listFlag collects the values of a repeatable command line flag.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
@@ -0,0 +1,110 @@
+package leprox
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// egress selects the local side of outbound connections: a source address,
+// an interface, or both.
+type egress struct {
+	ip    net.IP
+	iface string
+}
+
+// egressRule applies an egress to destinations matching pattern.
+type egressRule struct {
+	pattern string
+	egress  *egress
+}
+
+var (
+	// egressDefault is used for destinations that match no rule; nil lets
+	// the operating system choose.
+	egressDefault *egress
+	egressRules   []egressRule
+)
+
+// parseEgress accepts a local IP address or an interface name. Interfaces
+// use their first IPv4 address (or IPv6 if they have none) as the source.
+func parseEgress(s string) (*egress, error) {
+	if ip := net.ParseIP(s); ip != nil {
+		return &egress{ip: ip}, nil
+	}
+
+	iface, err := net.InterfaceByName(s)
+	if err != nil {
+		return nil, fmt.Errorf("%q is neither an IP address nor an interface: %v", s, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+
+	e := &egress{iface: iface.Name}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if e.ip == nil || (e.ip.To4() == nil && ipNet.IP.To4() != nil) {
+			e.ip = ipNet.IP
+		}
+	}
+	if e.ip == nil {
+		return nil, fmt.Errorf("interface %s has no usable address", iface.Name)
+	}
+	return e, nil
+}
+
+func (e *egress) String() string {
+	if e.iface != "" {
+		return fmt.Sprintf("%s (%s)", e.iface, e.ip)
+	}
+	return e.ip.String()
+}
+
+// addEgressRule parses a pattern=ip-or-interface rule.
+func addEgressRule(rule string) error {
+	pattern, local, ok := strings.Cut(rule, "=")
+	if !ok || pattern == "" || local == "" {
+		return fmt.Errorf("invalid egress rule %q, want pattern=ip-or-interface", rule)
+	}
+	e, err := parseEgress(local)
+	if err != nil {
+		return err
+	}
+	egressRules = append(egressRules, egressRule{pattern: strings.ToLower(pattern), egress: e})
+	return nil
+}
+
+// egressFor returns the egress for connections to host, or nil.
+func egressFor(host string) *egress {
+	for _, rule := range egressRules {
+		if matchHost(rule.pattern, host) {
+			return rule.egress
+		}
+	}
+	return egressDefault
+}
+
+// dialerFor returns the dialer for connections to host, bound to the
+// matching egress if there is one.
+func dialerFor(host string) *net.Dialer {
+	e := egressFor(host)
+	if e == nil {
+		return upstreamDialer
+	}
+	return e.dialer()
+}
+
+// dialer returns a copy of the upstream dialer bound to e.
+func (e *egress) dialer() *net.Dialer {
+	d := *upstreamDialer
+	d.LocalAddr = &net.TCPAddr{IP: e.ip}
+	if e.iface != "" {
+		d.Control = bindToDevice(e.iface)
+	}
+	return &d
+}
@@ -0,0 +1,35 @@
+package leprox
+
+import (
+	"flag"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Configure sets up the proxy engine from gonet proxy flags, for programs
+// that embed it through gonet/pkg/proxy. Listener flags like -reverse,
+// -socks5-listen and -tls-cert are ignored there, and so are -replay,
+// -log-level and -log-format.
+func Configure(args []string) error {
+	_, err := configure(flag.NewFlagSet("proxy", flag.ContinueOnError), args, true)
+	return err
+}
+
+// Handler serves proxy requests: CONNECT tunnels, plain HTTP and
+// /proxy.pac.
+func Handler() http.Handler {
+	return http.HandlerFunc(handleRequestAndRedirect)
+}
+
+// Protect applies -read-header-timeout and -max-half-open to server and
+// the listener it will serve.
+func Protect(server *http.Server, ln net.Listener) net.Listener {
+	return protect(server, ln)
+}
+
+// Shutdown drains servers the way SIGTERM does, closing tunnels still
+// open after timeout, and flushes the trace, HAR and pcap outputs.
+func Shutdown(servers []*http.Server, timeout time.Duration) {
+	shutdown(servers, nil, timeout)
+}
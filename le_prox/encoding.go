@@ -0,0 +1,191 @@
+package leprox
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// encodingRule controls the Content-Encoding of matching responses:
+//
+//	identity   ask upstream for an uncompressed response
+//	decode     decompress gzip/deflate responses and send them uncompressed
+//	transcode  decompress for inspection and rewriting, then recompress
+//	           with an encoding the client accepts
+type encodingRule struct {
+	Match requestMatch `json:"match"`
+	Mode  string       `json:"mode"`
+}
+
+func (r *encodingRule) compile() error {
+	r.Match.Host = strings.ToLower(r.Match.Host)
+	switch r.Mode {
+	case "identity", "decode", "transcode":
+		return nil
+	}
+	return fmt.Errorf("unknown mode %q, want identity, decode or transcode", r.Mode)
+}
+
+// matchingEncodingRule returns the first encoding rule for r, or nil.
+func matchingEncodingRule(r *http.Request) *encodingRule {
+	rules := currentConfig().Encodings
+	for i := range rules {
+		if rules[i].Match.matches(r.URL.Hostname(), r.URL.Path) {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+// prepareRequest limits the encodings upstream may use to ones the proxy
+// can decode. It returns the client's original Accept-Encoding.
+func (r *encodingRule) prepareRequest(req *http.Request) string {
+	accept := req.Header.Get("Accept-Encoding")
+	if r.Mode == "identity" {
+		req.Header.Set("Accept-Encoding", "identity")
+	} else if accept != "" {
+		req.Header.Set("Accept-Encoding", "gzip, deflate")
+	}
+	return accept
+}
+
+// decodeResponse replaces a gzip or deflate encoded body with its
+// decompressed content.
+func decodeResponse(resp *http.Response) error {
+	var body io.ReadCloser
+	switch strings.ToLower(resp.Header.Get("Content-Encoding")) {
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return err
+		}
+		body = zr
+	case "deflate":
+		// HTTP deflate is zlib wrapped, but some servers send raw
+		// DEFLATE, which never starts with a valid zlib header.
+		br := bufio.NewReader(resp.Body)
+		if header, err := br.Peek(2); err == nil && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+			zr, err := zlib.NewReader(br)
+			if err != nil {
+				return err
+			}
+			body = zr
+		} else {
+			body = flate.NewReader(br)
+		}
+	default:
+		return nil
+	}
+
+	resp.Body = &decodedBody{ReadCloser: body, src: resp.Body}
+	resp.Header.Del("Content-Encoding")
+	changedRepresentation(resp)
+	varyAcceptEncoding(resp.Header)
+	return nil
+}
+
+// encodeResponse compresses the body with gzip or deflate if accept, the
+// client's Accept-Encoding, allows one of them.
+func encodeResponse(resp *http.Response, accept string) {
+	if resp.Header.Get("Content-Encoding") != "" || resp.Body == http.NoBody {
+		return
+	}
+	encoding := ""
+	for _, part := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if strings.ReplaceAll(params, " ", "") == "q=0" {
+			continue
+		}
+		if name == "gzip" || name == "deflate" {
+			encoding = name
+			break
+		}
+	}
+	if encoding == "" {
+		return
+	}
+
+	src := resp.Body
+	pr, pw := io.Pipe()
+	go func() {
+		var zw interface {
+			io.Writer
+			Flush() error
+			Close() error
+		}
+		if encoding == "gzip" {
+			zw = gzip.NewWriter(pw)
+		} else {
+			zw = zlib.NewWriter(pw)
+		}
+		// Flush after every read so streamed responses are not held back
+		// by the compressor.
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := src.Read(buf)
+			if n > 0 {
+				if _, werr := zw.Write(buf[:n]); werr != nil {
+					pw.CloseWithError(werr)
+					return
+				}
+				if werr := zw.Flush(); werr != nil {
+					pw.CloseWithError(werr)
+					return
+				}
+			}
+			if err == io.EOF {
+				pw.CloseWithError(zw.Close())
+				return
+			}
+			if err != nil {
+				slog.Warn("Failed to read response body for encoding", "encoding", encoding, "err", err)
+				pw.CloseWithError(err)
+				return
+			}
+		}
+	}()
+
+	resp.Body = &decodedBody{ReadCloser: pr, src: src}
+	resp.Header.Set("Content-Encoding", encoding)
+	changedRepresentation(resp)
+	varyAcceptEncoding(resp.Header)
+}
+
+// changedRepresentation fixes up headers after the body bytes changed.
+// The length is no longer known and strong validators no longer hold.
+func changedRepresentation(resp *http.Response) {
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		resp.Header.Set("ETag", "W/"+etag)
+	}
+}
+
+// varyAcceptEncoding marks a response as depending on Accept-Encoding.
+func varyAcceptEncoding(h http.Header) {
+	for _, v := range h.Values("Vary") {
+		if strings.Contains(strings.ToLower(v), "accept-encoding") {
+			return
+		}
+	}
+	h.Add("Vary", "Accept-Encoding")
+}
+
+// decodedBody reads transformed content and closes both the transformer
+// and the original body.
+type decodedBody struct {
+	io.ReadCloser
+	src io.Closer
+}
+
+func (b *decodedBody) Close() error {
+	b.ReadCloser.Close()
+	return b.src.Close()
+}
@@ -0,0 +1,85 @@
+package leprox
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func deflateResponse(body []byte) *http.Response {
+	return &http.Response{
+		Header: http.Header{"Content-Encoding": {"deflate"}, "Content-Length": {"1"}},
+		Body:   io.NopCloser(bytes.NewReader(body)),
+	}
+}
+
+func TestDecodeDeflate(t *testing.T) {
+	const want = "hello, deflate"
+
+	var zlibBody bytes.Buffer
+	zw := zlib.NewWriter(&zlibBody)
+	zw.Write([]byte(want))
+	zw.Close()
+
+	var rawBody bytes.Buffer
+	fw, _ := flate.NewWriter(&rawBody, flate.DefaultCompression)
+	fw.Write([]byte(want))
+	fw.Close()
+
+	for name, body := range map[string][]byte{"zlib": zlibBody.Bytes(), "raw": rawBody.Bytes()} {
+		t.Run(name, func(t *testing.T) {
+			resp := deflateResponse(body)
+			if err := decodeResponse(resp); err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != want {
+				t.Errorf("decoded body = %q, want %q", got, want)
+			}
+			if ce := resp.Header.Get("Content-Encoding"); ce != "" {
+				t.Errorf("Content-Encoding = %q after decoding", ce)
+			}
+		})
+	}
+}
+
+func TestEncodeDeflateRoundTrip(t *testing.T) {
+	const want = "hello, transcoded deflate"
+	resp := &http.Response{Header: http.Header{}, Body: io.NopCloser(strings.NewReader(want))}
+	encodeResponse(resp, "deflate")
+	if ce := resp.Header.Get("Content-Encoding"); ce != "deflate" {
+		t.Fatalf("Content-Encoding = %q, want deflate", ce)
+	}
+	encoded, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// What the client gets must be zlib, as HTTP deflate is.
+	zr, err := zlib.NewReader(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatalf("encoded body isn't zlib: %v", err)
+	}
+	got, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("round trip = %q, want %q", got, want)
+	}
+
+	back := deflateResponse(encoded)
+	if err := decodeResponse(back); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := io.ReadAll(back.Body); string(got) != want {
+		t.Errorf("decodeResponse(encodeResponse) = %q, want %q", got, want)
+	}
+}
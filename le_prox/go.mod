@@ -1,3 +0,0 @@
-module le_prox
-
-go 1.23.6
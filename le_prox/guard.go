@@ -0,0 +1,172 @@
+package leprox
+
+import (
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	// readHeaderTimeout is how long clients get to send request headers.
+	readHeaderTimeout time.Duration
+
+	// halfOpen limits connections per client that haven't sent a complete
+	// request yet; nil disables the limit.
+	halfOpen *halfOpenGuard
+)
+
+// protect applies the header timeout and the half-open limit to a server
+// and its listener.
+func protect(server *http.Server, ln net.Listener) net.Listener {
+	server.ReadHeaderTimeout = readHeaderTimeout
+	if halfOpen == nil {
+		return ln
+	}
+	server.ConnState = halfOpen.connState
+	return &guardListener{Listener: ln, g: halfOpen}
+}
+
+// halfOpenGuard counts per client IP the connections that are still
+// sending their first request, which is how slowloris clients tie up a
+// server.
+type halfOpenGuard struct {
+	limit int
+
+	mu      sync.Mutex
+	pending map[string]int
+}
+
+func newHalfOpenGuard(limit int) *halfOpenGuard {
+	return &halfOpenGuard{limit: limit, pending: make(map[string]int)}
+}
+
+var errTooManyHalfOpen = errors.New("too many incomplete requests from client")
+
+// open registers c as pending, failing if its client is at the limit.
+func (g *halfOpenGuard) open(c *guardConn) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.pending[c.client] >= g.limit {
+		return errTooManyHalfOpen
+	}
+	g.pending[c.client]++
+	return nil
+}
+
+func (g *halfOpenGuard) release(c *guardConn) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.pending[c.client]--; g.pending[c.client] <= 0 {
+		delete(g.pending, c.client)
+	}
+}
+
+// connState releases a connection once reading its first request has
+// finished or it is gone. The server only reports that after the read, so
+// one that took as long as the header timeout is counted as timed out.
+func (g *halfOpenGuard) connState(conn net.Conn, state http.ConnState) {
+	if state == http.StateNew || state == http.StateIdle {
+		return
+	}
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	c, ok := conn.(*guardConn)
+	if !ok {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.pending {
+		return
+	}
+	c.pending = false
+	g.release(c)
+	if readHeaderTimeout > 0 && time.Since(c.started) >= readHeaderTimeout {
+		headerTimeouts.Add(1)
+		slog.Warn("Closed connection, request headers not received in time", "client", c.client, "timeout", readHeaderTimeout)
+	}
+}
+
+// guardListener wraps accepted connections so the half-open limit can be
+// applied to them.
+type guardListener struct {
+	net.Listener
+	g *halfOpenGuard
+}
+
+func (l *guardListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &guardConn{Conn: conn, g: l.g}, nil
+}
+
+// guardConn registers with the guard on its first read rather than in
+// Accept, as the client address of a PROXY protocol connection is only
+// known once the header has been read.
+type guardConn struct {
+	net.Conn
+	g *halfOpenGuard
+
+	once    sync.Once
+	err     error
+	client  string
+	mu      sync.Mutex
+	pending bool
+	started time.Time
+}
+
+func (c *guardConn) Read(p []byte) (int, error) {
+	c.once.Do(func() {
+		c.client = hostOnly(c.Conn.RemoteAddr().String())
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.err = c.g.open(c); c.err != nil {
+			halfOpenRejected.Add(1)
+			slog.Warn("Rejected connection", "client", c.client, "err", c.err)
+			c.Conn.Close()
+			return
+		}
+		c.pending = true
+		c.started = time.Now()
+	})
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.Conn.Read(p)
+}
+
+// enforceTunnelRate closes tunnels that moved fewer than minRate bytes per
+// second, up and down combined, over the last window. Tunnels younger than
+// a window are left alone.
+func enforceTunnelRate(minRate int64, window time.Duration) {
+	ticker := time.NewTicker(window)
+	defer ticker.Stop()
+
+	last := make(map[uint64]int64)
+	for range ticker.C {
+		seen := make(map[uint64]int64)
+		for _, c := range activeConns.list() {
+			total := c.BytesUp + c.BytesDown
+			seen[c.ID] = total
+			prev, ok := last[c.ID]
+			if !ok {
+				continue
+			}
+			if rate := float64(total-prev) / window.Seconds(); rate < float64(minRate) {
+				if activeConns.kill(c.ID) {
+					slowTunnelsClosed.Add(1)
+					slog.Warn("Closed tunnel below the minimum rate", "kind", c.Kind, "id", c.ID, "client", c.Client,
+						"destination", c.Destination, "bytes_per_sec", rate, "min_bytes_per_sec", minRate)
+				}
+			}
+		}
+		last = seen
+	}
+}
@@ -0,0 +1,104 @@
+package leprox
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// acceptTunnel answers a CONNECT request with 200 and returns the client
+// side of the tunnel. HTTP/1 connections are hijacked. An HTTP/2 CONNECT is
+// a single stream of a shared connection, so the stream is wrapped as a
+// net.Conn instead; it only lives as long as the handler, which must call
+// wait before returning.
+func acceptTunnel(w http.ResponseWriter, r *http.Request) (conn net.Conn, wait func(), err error) {
+	if r.ProtoMajor == 2 {
+		w.WriteHeader(http.StatusOK)
+		rc := http.NewResponseController(w)
+		if err := rc.Flush(); err != nil {
+			return nil, nil, err
+		}
+		s := &streamConn{body: r.Body, w: w, rc: rc, done: make(chan struct{}), remote: addrOf(r.RemoteAddr)}
+		if local, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+			s.local = local
+		}
+		return s, func() { <-s.done }, nil
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking not supported")
+	}
+	w.WriteHeader(http.StatusOK)
+	clientConn, brw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	// Bytes the client sent right after CONNECT may already be buffered.
+	return &bufferedConn{Conn: clientConn, r: brw.Reader}, func() {}, nil
+}
+
+// streamConn is an HTTP/2 CONNECT stream used as a connection. Reads come
+// from the request body, writes go to the response and are flushed
+// immediately.
+type streamConn struct {
+	body   io.ReadCloser
+	w      io.Writer
+	rc     *http.ResponseController
+	local  net.Addr
+	remote net.Addr
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func (s *streamConn) Read(p []byte) (int, error) {
+	return s.body.Read(p)
+}
+
+func (s *streamConn) Write(p []byte) (int, error) {
+	select {
+	case <-s.done:
+		return 0, net.ErrClosed
+	default:
+	}
+	n, err := s.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, s.rc.Flush()
+}
+
+func (s *streamConn) Close() error {
+	s.closeOnce.Do(func() {
+		s.body.Close()
+		close(s.done)
+	})
+	return nil
+}
+
+func (s *streamConn) LocalAddr() net.Addr  { return s.local }
+func (s *streamConn) RemoteAddr() net.Addr { return s.remote }
+
+func (s *streamConn) SetDeadline(t time.Time) error {
+	if err := s.rc.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return s.rc.SetWriteDeadline(t)
+}
+
+func (s *streamConn) SetReadDeadline(t time.Time) error  { return s.rc.SetReadDeadline(t) }
+func (s *streamConn) SetWriteDeadline(t time.Time) error { return s.rc.SetWriteDeadline(t) }
+
+// addrOf parses an ip:port address, falling back to an unspecified one.
+func addrOf(addr string) net.Addr {
+	ap, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	return net.TCPAddrFromAddrPort(ap)
+}
@@ -0,0 +1,320 @@
+package leprox
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// recorder writes proxied HTTP exchanges to a HAR file; nil disables it.
+var recorder *harRecorder
+
+// maxCapturedBody caps how much of each body is kept for HAR and pcap
+// recording.
+const maxCapturedBody = 1 << 20
+
+// HAR 1.2 structures, see http://www.softwareishard.com/blog/har-12-spec/.
+type harFile struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	// Client is the address of the client that sent the request, a
+	// custom field telling the sessions apart for -replay.
+	Client string `json:"_client,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type harContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// harRecorder collects entries in memory and periodically rewrites the
+// whole HAR file, so it is always a complete, loadable document.
+type harRecorder struct {
+	path   string
+	bodies bool
+
+	mu      sync.Mutex
+	entries []harEntry
+	dirty   bool
+}
+
+func newHARRecorder(path string, bodies bool) *harRecorder {
+	return &harRecorder{path: path, bodies: bodies, entries: []harEntry{}}
+}
+
+// run saves the file every interval while there are new entries.
+func (h *harRecorder) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := h.save(); err != nil {
+			slog.Warn("Failed to write HAR file", "err", err)
+		}
+	}
+}
+
+// save writes all recorded entries if anything changed since the last save.
+func (h *harRecorder) save() error {
+	h.mu.Lock()
+	if !h.dirty {
+		h.mu.Unlock()
+		return nil
+	}
+	data, err := json.MarshalIndent(harFile{Log: harLog{
+		Version: "1.2",
+		Creator: harCreator{Name: viaName, Version: "1.0"},
+		Entries: h.entries,
+	}}, "", "  ")
+	h.dirty = false
+	h.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a crash never leaves a truncated HAR.
+	tmp, err := os.CreateTemp(filepath.Dir(h.path), ".har-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), h.path)
+}
+
+func (h *harRecorder) add(e harEntry) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.entries = append(h.entries, e)
+	h.dirty = true
+}
+
+// harExchange is a single request/response pair being recorded.
+type harExchange struct {
+	h       *harRecorder
+	entry   harEntry
+	started time.Time
+	waited  time.Time
+	reqBody *capturedBody
+	resp    *http.Response
+	body    *capturedBody
+}
+
+// start records r as it will be sent upstream and wraps its body so the
+// uploaded bytes are captured.
+func (h *harRecorder) start(r *http.Request) *harExchange {
+	x := &harExchange{h: h, started: time.Now()}
+	x.entry.StartedDateTime = x.started
+	x.entry.Client = r.RemoteAddr
+	x.entry.Request = harRequest{
+		Method:      r.Method,
+		URL:         r.URL.String(),
+		HTTPVersion: r.Proto,
+		Cookies:     []harNameValue{},
+		Headers:     harHeaders(r.Header),
+		QueryString: []harNameValue{},
+		HeadersSize: -1,
+	}
+	for _, c := range r.Cookies() {
+		x.entry.Request.Cookies = append(x.entry.Request.Cookies, harNameValue{Name: c.Name, Value: c.Value})
+	}
+	for name, values := range r.URL.Query() {
+		for _, value := range values {
+			x.entry.Request.QueryString = append(x.entry.Request.QueryString, harNameValue{Name: name, Value: value})
+		}
+	}
+	if r.Body != nil && r.Body != http.NoBody {
+		x.reqBody = &capturedBody{ReadCloser: r.Body, keep: h.bodies}
+		r.Body = x.reqBody
+	}
+	return x
+}
+
+// response records resp as it is sent to the client and wraps its body.
+func (x *harExchange) response(resp *http.Response) {
+	x.waited = time.Now()
+	x.resp = resp
+	x.body = &capturedBody{ReadCloser: resp.Body, keep: x.h.bodies}
+	resp.Body = x.body
+}
+
+// upgraded records a 101 Switching Protocols response, leaving its body
+// to the upgraded connection.
+func (x *harExchange) upgraded(resp *http.Response) {
+	x.waited = time.Now()
+	x.resp = resp
+	x.body = &capturedBody{}
+}
+
+// fail records an exchange that got no response from upstream.
+func (x *harExchange) fail(err error) {
+	x.waited = time.Now()
+	x.entry.Response = harResponse{
+		StatusText:  err.Error(),
+		Cookies:     []harNameValue{},
+		Headers:     []harNameValue{},
+		HeadersSize: -1,
+		BodySize:    -1,
+	}
+	x.finish()
+}
+
+// finish completes the entry once the response body has been relayed.
+func (x *harExchange) finish() {
+	done := time.Now()
+	e := &x.entry
+
+	if x.reqBody != nil {
+		e.Request.BodySize = x.reqBody.n
+		text, encoding := x.reqBody.text()
+		e.Request.PostData = &harPostData{MimeType: e.Request.headerValue("Content-Type"), Text: text, Encoding: encoding}
+	}
+
+	if x.resp != nil {
+		e.Response = harResponse{
+			Status:      x.resp.StatusCode,
+			StatusText:  http.StatusText(x.resp.StatusCode),
+			HTTPVersion: x.resp.Proto,
+			Cookies:     []harNameValue{},
+			Headers:     harHeaders(x.resp.Header),
+			Content:     harContent{Size: x.body.n, MimeType: x.resp.Header.Get("Content-Type")},
+			RedirectURL: x.resp.Header.Get("Location"),
+			HeadersSize: -1,
+			BodySize:    x.body.n,
+		}
+		for _, c := range x.resp.Cookies() {
+			e.Response.Cookies = append(e.Response.Cookies, harNameValue{Name: c.Name, Value: c.Value})
+		}
+		e.Response.Content.Text, e.Response.Content.Encoding = x.body.text()
+	}
+
+	e.Timings = harTimings{Send: 0, Wait: millis(x.waited.Sub(x.started)), Receive: millis(done.Sub(x.waited))}
+	e.Time = millis(done.Sub(x.started))
+	x.h.add(*e)
+}
+
+func (r *harRequest) headerValue(name string) string {
+	for _, h := range r.Headers {
+		if http.CanonicalHeaderKey(h.Name) == name {
+			return h.Value
+		}
+	}
+	return ""
+}
+
+func harHeaders(h http.Header) []harNameValue {
+	headers := []harNameValue{}
+	for name, values := range h {
+		for _, value := range values {
+			headers = append(headers, harNameValue{Name: name, Value: value})
+		}
+	}
+	return headers
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// capturedBody counts the bytes read from a message body and keeps the first
+// maxCapturedBody of them when bodies are recorded.
+type capturedBody struct {
+	io.ReadCloser
+	keep bool
+	n    int64
+	buf  bytes.Buffer
+}
+
+func (b *capturedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	if b.keep && b.buf.Len() < maxCapturedBody {
+		b.buf.Write(p[:min(n, maxCapturedBody-b.buf.Len())])
+	}
+	return n, err
+}
+
+// text returns the captured body, base64 encoded unless it is valid UTF-8.
+func (b *capturedBody) text() (string, string) {
+	if b.buf.Len() == 0 {
+		return "", ""
+	}
+	if utf8.Valid(b.buf.Bytes()) {
+		return b.buf.String(), ""
+	}
+	return base64.StdEncoding.EncodeToString(b.buf.Bytes()), "base64"
+}
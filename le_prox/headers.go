@@ -0,0 +1,91 @@
+package leprox
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// viaName identifies this proxy in Via headers.
+const viaName = "le_prox"
+
+// hopHeaders are meaningful only for a single transport-level connection
+// and must not be forwarded (RFC 9110 section 7.6.1).
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// addForwardHeaders controls X-Forwarded-For, X-Forwarded-Proto and Via.
+var addForwardHeaders = true
+
+// removeHopHeaders deletes hop-by-hop headers, including any extra ones
+// the sender listed in its Connection header. "TE: trailers" is kept, as
+// gRPC and other trailer dependent clients need it end to end.
+func removeHopHeaders(h http.Header) {
+	trailers := hasToken(h.Values("Te"), "trailers")
+	for _, value := range h.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+	if trailers {
+		h.Set("Te", "trailers")
+	}
+}
+
+// hasToken reports whether the comma separated header values contain
+// token, ignoring case and parameters.
+func hasToken(values []string, token string) bool {
+	for _, value := range values {
+		for _, part := range strings.Split(value, ",") {
+			name, _, _ := strings.Cut(part, ";")
+			if strings.EqualFold(strings.TrimSpace(name), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// setForwardHeaders records the client and this hop on an outgoing request.
+func setForwardHeaders(r *http.Request, clientAddr string) {
+	if !addForwardHeaders {
+		return
+	}
+
+	if clientIP, _, err := net.SplitHostPort(clientAddr); err == nil {
+		if prior := r.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+			clientIP = strings.Join(prior, ", ") + ", " + clientIP
+		}
+		r.Header.Set("X-Forwarded-For", clientIP)
+	}
+
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	r.Header.Set("X-Forwarded-Proto", proto)
+	addVia(r.Header, r.ProtoMajor, r.ProtoMinor)
+}
+
+// addVia appends this proxy to the Via header of a message.
+func addVia(h http.Header, major, minor int) {
+	if !addForwardHeaders {
+		return
+	}
+	h.Add("Via", fmt.Sprintf("%d.%d %s", major, minor, viaName))
+}
@@ -0,0 +1,47 @@
+package leprox
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestRemoveHopHeaders(t *testing.T) {
+	tests := []struct {
+		name string
+		in   http.Header
+		want http.Header
+	}{
+		{
+			name: "hop-by-hop and listed headers",
+			in: http.Header{
+				"Connection": {"keep-alive, X-Hop"}, "Keep-Alive": {"timeout=5"}, "X-Hop": {"1"},
+				"Transfer-Encoding": {"chunked"}, "Upgrade": {"websocket"}, "Accept": {"*/*"},
+			},
+			want: http.Header{"Accept": {"*/*"}},
+		},
+		{
+			name: "TE trailers kept",
+			in:   http.Header{"Connection": {"TE"}, "Te": {"trailers"}, "Content-Type": {"application/grpc"}},
+			want: http.Header{"Te": {"trailers"}, "Content-Type": {"application/grpc"}},
+		},
+		{
+			name: "TE trailers among codings",
+			in:   http.Header{"Te": {"gzip;q=0.5, Trailers"}},
+			want: http.Header{"Te": {"trailers"}},
+		},
+		{
+			name: "TE without trailers dropped",
+			in:   http.Header{"Te": {"gzip, deflate"}},
+			want: http.Header{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			removeHopHeaders(tt.in)
+			if !reflect.DeepEqual(tt.in, tt.want) {
+				t.Errorf("removeHopHeaders = %v, want %v", tt.in, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package leprox
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"plugin"
+)
+
+// hooks are the Go plugins loaded with -plugin, run in order on every
+// proxied HTTP request including intercepted HTTPS.
+var hooks []*hookPlugin
+
+// hookPlugin holds the hook functions a plugin exports. Either may be nil.
+//
+// RequestHook runs after the header rules and routes and may change the
+// request in place. Returning a response answers the client with it and
+// skips upstream.
+//
+// ResponseHook runs once the response body is decoded and rewritten, and
+// may change the response in place, including replacing its body.
+type hookPlugin struct {
+	path       string
+	onRequest  func(*http.Request) *http.Response
+	onResponse func(*http.Request, *http.Response)
+}
+
+// loadHookPlugin opens a plugin built with go build -buildmode=plugin.
+// Plugins must be built with the same Go version as the proxy.
+func loadHookPlugin(path string) (*hookPlugin, error) {
+	p, err := plugin.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &hookPlugin{path: path}
+	if sym, err := p.Lookup("RequestHook"); err == nil {
+		switch fn := sym.(type) {
+		case func(*http.Request) *http.Response:
+			h.onRequest = fn
+		case *func(*http.Request) *http.Response:
+			h.onRequest = *fn
+		default:
+			return nil, fmt.Errorf("%s: RequestHook is %T, want func(*http.Request) *http.Response", path, sym)
+		}
+	}
+	if sym, err := p.Lookup("ResponseHook"); err == nil {
+		switch fn := sym.(type) {
+		case func(*http.Request, *http.Response):
+			h.onResponse = fn
+		case *func(*http.Request, *http.Response):
+			h.onResponse = *fn
+		default:
+			return nil, fmt.Errorf("%s: ResponseHook is %T, want func(*http.Request, *http.Response)", path, sym)
+		}
+	}
+	if h.onRequest == nil && h.onResponse == nil {
+		return nil, fmt.Errorf("%s exports neither RequestHook nor ResponseHook", path)
+	}
+	return h, nil
+}
+
+// runRequestHooks passes r through the request hooks. The first response
+// returned by a hook ends the chain and is sent to the client.
+func runRequestHooks(r *http.Request) *http.Response {
+	for _, h := range hooks {
+		if h.onRequest == nil {
+			continue
+		}
+		if resp := h.callRequest(r); resp != nil {
+			if resp.Header == nil {
+				resp.Header = make(http.Header)
+			}
+			if resp.Body == nil {
+				resp.Body = http.NoBody
+			}
+			if resp.StatusCode == 0 {
+				resp.StatusCode = http.StatusOK
+			}
+			resp.Request = r
+			slog.Info("Answered from plugin", "url", r.URL, "plugin", h.path)
+			return resp
+		}
+	}
+	return nil
+}
+
+// runResponseHooks passes resp through the response hooks. A hook that
+// replaces the body invalidates Content-Length, which is dropped then.
+func runResponseHooks(r *http.Request, resp *http.Response) {
+	for _, h := range hooks {
+		if h.onResponse == nil {
+			continue
+		}
+		body := resp.Body
+		h.callResponse(r, resp)
+		if resp.Body != body {
+			resp.Header.Del("Content-Length")
+			resp.ContentLength = -1
+		}
+		if resp.Body == nil {
+			resp.Body = http.NoBody
+		}
+	}
+}
+
+// A panicking hook is logged and skipped rather than taking down the
+// client connection.
+func (h *hookPlugin) callRequest(r *http.Request) (resp *http.Response) {
+	defer func() {
+		if err := recover(); err != nil {
+			slog.Error("Plugin RequestHook panicked", "plugin", h.path, "url", r.URL, "err", err)
+			resp = nil
+		}
+	}()
+	return h.onRequest(r)
+}
+
+func (h *hookPlugin) callResponse(r *http.Request, resp *http.Response) {
+	defer func() {
+		if err := recover(); err != nil {
+			slog.Error("Plugin ResponseHook panicked", "plugin", h.path, "url", r.URL, "err", err)
+		}
+	}()
+	h.onResponse(r, resp)
+}
@@ -0,0 +1,83 @@
+package leprox
+
+import (
+	"expvar"
+	"log"
+	"log/slog"
+	"net/http"
+)
+
+// Counters published on the admin listener under /debug/vars.
+var (
+	dnsCacheHits   = expvar.NewInt("dns_cache_hits")
+	dnsCacheMisses = expvar.NewInt("dns_cache_misses")
+
+	dialRetriesTotal = expvar.NewInt("dial_retries")
+	dialFailovers    = expvar.NewInt("dial_failovers")
+
+	circuitRejections = expvar.NewInt("circuit_rejections")
+
+	sniBlocked    = expvar.NewInt("sni_blocked")
+	connectDenied = expvar.NewInt("connect_denied")
+
+	cacheHits          = expvar.NewInt("cache_hits")
+	cacheMisses        = expvar.NewInt("cache_misses")
+	cacheRevalidations = expvar.NewInt("cache_revalidations")
+
+	rateLimited = expvar.NewInt("rate_limited")
+
+	mirrorSent    = expvar.NewInt("mirror_sent")
+	mirrorFailed  = expvar.NewInt("mirror_failed")
+	mirrorDropped = expvar.NewInt("mirror_dropped")
+
+	requestErrors = expvar.NewInt("request_errors")
+	tunnelErrors  = expvar.NewInt("tunnel_errors")
+
+	headerTimeouts    = expvar.NewInt("header_timeouts")
+	halfOpenRejected  = expvar.NewInt("half_open_rejected")
+	slowTunnelsClosed = expvar.NewInt("slow_tunnels_closed")
+
+	configReloads      = expvar.NewInt("config_reloads")
+	configReloadErrors = expvar.NewInt("config_reload_errors")
+
+	sloViolations = expvar.NewInt("slo_violations")
+)
+
+// adminMux serves the admin API and metrics endpoints.
+var adminMux = http.NewServeMux()
+
+func init() {
+	expvar.Publish("circuits_open", expvar.Func(func() any {
+		if breaker == nil {
+			return []string{}
+		}
+		return breaker.openCircuits()
+	}))
+
+	expvar.Publish("backends_healthy", expvar.Func(func() any {
+		healthy := make(map[string]bool)
+		for _, v := range currentConfig().VirtualHosts {
+			for _, b := range v.backends {
+				healthy[b.url.String()] = b.healthy.Load()
+			}
+		}
+		return healthy
+	}))
+
+	expvar.Publish("slos", expvar.Func(func() any {
+		return sloStatuses()
+	}))
+
+	adminMux.Handle("GET /debug/vars", expvar.Handler())
+	adminMux.HandleFunc("GET /admin/traffic", handleTraffic)
+	adminMux.HandleFunc("GET /admin/connections", handleListConnections)
+	adminMux.HandleFunc("DELETE /admin/connections/{id}", handleKillConnection)
+}
+
+// serveAdmin runs the admin listener until the process exits.
+func serveAdmin(addr string) {
+	slog.Info("Starting admin server", "addr", addr)
+	if err := http.ListenAndServe(addr, adminMux); err != nil {
+		log.Fatal("Admin ListenAndServe: ", err)
+	}
+}
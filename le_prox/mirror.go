@@ -0,0 +1,108 @@
+package leprox
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// mirror sends copies of proxied requests to a shadow backend; nil
+// disables mirroring.
+var mirror *mirrorTarget
+
+// mirrorTarget is a shadow backend that receives a copy of each matching
+// request. Its responses are discarded and never delay the real request.
+type mirrorTarget struct {
+	base    *url.URL
+	hosts   []string
+	maxBody int64
+	timeout time.Duration
+	// slots bounds the copies in flight, further ones are dropped so a slow
+	// shadow can't pile up goroutines.
+	slots chan struct{}
+}
+
+func newMirrorTarget(target string, maxBody int64, timeout time.Duration, inFlight int) (*mirrorTarget, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("want http://host[:port] or https://host[:port], got %q", target)
+	}
+	return &mirrorTarget{
+		base:    u,
+		maxBody: maxBody,
+		timeout: timeout,
+		slots:   make(chan struct{}, inFlight),
+	}, nil
+}
+
+// send mirrors r asynchronously. The request body is buffered so both the
+// real request and the copy can read it; bodies over maxBody are not
+// mirrored.
+func (m *mirrorTarget) send(r *http.Request) {
+	if len(m.hosts) > 0 {
+		matched := false
+		for _, pattern := range m.hosts {
+			if matchHost(pattern, r.URL.Hostname()) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return
+		}
+	}
+
+	var body []byte
+	if r.Body != nil && r.Body != http.NoBody {
+		data, err := io.ReadAll(io.LimitReader(r.Body, m.maxBody+1))
+		if err != nil || int64(len(data)) > m.maxBody {
+			// Hand what was read back to the real request and skip the copy.
+			r.Body = &decodedBody{ReadCloser: io.NopCloser(io.MultiReader(bytes.NewReader(data), r.Body)), src: r.Body}
+			mirrorDropped.Add(1)
+			return
+		}
+		r.Body.Close()
+		r.Body = io.NopCloser(bytes.NewReader(data))
+		body = data
+	}
+
+	select {
+	case m.slots <- struct{}{}:
+	default:
+		mirrorDropped.Add(1)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+	shadow := r.Clone(ctx)
+	shadow.URL.Scheme = m.base.Scheme
+	shadow.URL.Host = m.base.Host
+	shadow.Host = m.base.Host
+	shadow.Body = io.NopCloser(bytes.NewReader(body))
+	if body == nil {
+		shadow.Body = http.NoBody
+	}
+
+	go func() {
+		defer func() { <-m.slots }()
+		defer cancel()
+
+		resp, err := upstreamTransport.RoundTrip(shadow)
+		if err != nil {
+			mirrorFailed.Add(1)
+			slog.Warn("Mirror request failed", "url", shadow.URL, "err", err)
+			return
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		mirrorSent.Add(1)
+	}()
+}
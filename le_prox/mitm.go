@@ -0,0 +1,252 @@
+package leprox
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// minter signs interception certificates; nil disables MITM mode.
+	minter *certMinter
+	// mitmHosts limits interception to matching hosts (empty means all).
+	mitmHosts []string
+	// mitmDump logs full intercepted requests and responses.
+	mitmDump bool
+)
+
+// certMinter issues leaf certificates for intercepted hosts, signed by a
+// user supplied CA. Certificates are cached per host for the process lifetime.
+type certMinter struct {
+	ca     *x509.Certificate
+	caKey  crypto.PrivateKey
+	key    *ecdsa.PrivateKey
+	mu     sync.Mutex
+	leaves map[string]*tls.Certificate
+}
+
+// loadCA reads a PEM encoded CA certificate and key for MITM mode.
+func loadCA(certFile, keyFile string) (*certMinter, error) {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	if !ca.IsCA {
+		return nil, fmt.Errorf("%s is not a CA certificate", certFile)
+	}
+
+	// One key pair is shared by all minted leaves, key generation is by far
+	// the most expensive part of issuing a certificate.
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return &certMinter{
+		ca:     ca,
+		caKey:  pair.PrivateKey,
+		key:    key,
+		leaves: make(map[string]*tls.Certificate),
+	}, nil
+}
+
+// certFor returns a certificate valid for host, minting one if needed.
+func (m *certMinter) certFor(host string) (*tls.Certificate, error) {
+	host = strings.ToLower(host)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if cert, ok := m.leaves[host]; ok && time.Now().Before(cert.Leaf.NotAfter) {
+		return cert, nil
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	notAfter := time.Now().Add(365 * 24 * time.Hour)
+	if notAfter.After(m.ca.NotAfter) {
+		notAfter = m.ca.NotAfter
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+	} else {
+		tmpl.DNSNames = []string{host}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, m.ca, &m.key.PublicKey, m.caKey)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	cert := &tls.Certificate{
+		Certificate: [][]byte{der, m.ca.Raw},
+		PrivateKey:  m.key,
+		Leaf:        leaf,
+	}
+	m.leaves[host] = cert
+	return cert, nil
+}
+
+// shouldIntercept reports whether CONNECT tunnels to host are decrypted.
+func shouldIntercept(host string) bool {
+	if minter == nil {
+		return false
+	}
+	if len(mitmHosts) == 0 {
+		return true
+	}
+	for _, pattern := range mitmHosts {
+		if matchHost(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleMITM terminates a CONNECT tunnel with a minted certificate and
+// serves the decrypted requests through the regular HTTP forwarding path.
+func handleMITM(w http.ResponseWriter, r *http.Request, target string) {
+	clientConn, wait, err := acceptTunnel(w, r)
+	if err != nil {
+		slog.Warn("Failed to accept tunnel", "target", target, "err", err)
+		return
+	}
+	interceptTunnel(r.RemoteAddr, clientConn, target)
+	wait()
+}
+
+// interceptTunnel terminates TLS on an accepted tunnel with a minted
+// certificate and serves the requests inside it like plain HTTP ones.
+func interceptTunnel(client string, clientConn net.Conn, target string) {
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		host = target
+	}
+
+	tlsConn := tls.Server(clientConn, &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if _, err := tunnelTarget(target, hello.ServerName); err != nil {
+				sniBlocked.Add(1)
+				slog.Warn("Blocked tunnel", "client", client, "target", target, "sni", hello.ServerName, "err", err)
+				return nil, err
+			}
+			if hello.ServerName != "" {
+				return minter.certFor(hello.ServerName)
+			}
+			return minter.certFor(host)
+		},
+		NextProtos: []string{"h2", "http/1.1"},
+	})
+	if err := tlsConn.Handshake(); err != nil {
+		slog.Warn("MITM handshake with client failed", "target", target, "err", err)
+		clientConn.Close()
+		return
+	}
+
+	// The tunnel stays registered until the client closes it, so it can be
+	// listed, killed and drained like any other.
+	conn := activeConns.add("mitm", client, target, traffic.openFlow(client, host, true), tlsConn)
+	server := &http.Server{
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			if state == http.StateClosed || state == http.StateHijacked {
+				activeConns.remove(conn)
+			}
+		},
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.URL.Scheme = "https"
+			r.URL.Host = target
+			if strings.HasSuffix(target, ":443") {
+				r.URL.Host = host
+			}
+			slog.Info("Intercepted request", "method", r.Method, "url", r.URL)
+			if mitmDump {
+				if dump, err := httputil.DumpRequest(r, true); err == nil {
+					slog.Info("Intercepted request dump", "url", r.URL, "dump", dump)
+				}
+			}
+			handleHTTP(w, r)
+		}),
+		ErrorLog: log.New(io.Discard, "", 0),
+	}
+	server.Serve(&singleConnListener{conn: tlsConn})
+}
+
+// dumpMITMResponse logs an intercepted response when -mitm-dump is set.
+func dumpMITMResponse(r *http.Request, resp *http.Response) {
+	if !mitmDump || r.TLS == nil {
+		return
+	}
+	if dump, err := httputil.DumpResponse(resp, true); err == nil {
+		slog.Info("Intercepted response dump", "url", r.URL, "dump", dump)
+	}
+}
+
+// bufferedConn replays bytes already buffered by the HTTP server before
+// reading from the underlying connection.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// singleConnListener hands a single connection to http.Server.Serve.
+type singleConnListener struct {
+	conn net.Conn
+	once sync.Once
+}
+
+func (l *singleConnListener) Accept() (net.Conn, error) {
+	var conn net.Conn
+	l.once.Do(func() { conn = l.conn })
+	if conn == nil {
+		return nil, errors.New("listener exhausted")
+	}
+	return conn, nil
+}
+
+func (l *singleConnListener) Close() error {
+	return nil
+}
+
+func (l *singleConnListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
@@ -0,0 +1,114 @@
+package leprox
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// useTestMinter enables MITM mode with a throwaway CA for the rest of the
+// test and returns a pool trusting it.
+func useTestMinter(t *testing.T) *x509.CertPool {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "le_prox test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prev := minter
+	minter = &certMinter{ca: ca, caKey: caKey, key: leafKey, leaves: make(map[string]*tls.Certificate)}
+	t.Cleanup(func() { minter = prev })
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	return pool
+}
+
+// connect sends a CONNECT for target to the proxy at addr and returns the
+// connection and the response status.
+func connect(t *testing.T, addr, target string) (net.Conn, int) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		conn.Close()
+		t.Fatal(err)
+	}
+	return conn, resp.StatusCode
+}
+
+func TestMITMAppliesSNIDeny(t *testing.T) {
+	pool := useTestMinter(t)
+	useAccessPolicy(t, &accessPolicy{sniDeny: []string{"blocked.example"}})
+	proxy := httptest.NewServer(http.HandlerFunc(handleTunneling))
+	defer proxy.Close()
+	addr := proxy.Listener.Addr().String()
+
+	t.Run("denied CONNECT host", func(t *testing.T) {
+		conn, status := connect(t, addr, "blocked.example:443")
+		defer conn.Close()
+		if status != http.StatusForbidden {
+			t.Errorf("CONNECT blocked.example = %d, want 403", status)
+		}
+	})
+
+	t.Run("denied SNI", func(t *testing.T) {
+		conn, status := connect(t, addr, "allowed.example:443")
+		defer conn.Close()
+		if status != http.StatusOK {
+			t.Fatalf("CONNECT allowed.example = %d, want 200", status)
+		}
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: "blocked.example", RootCAs: pool})
+		if err := tlsConn.Handshake(); err == nil {
+			t.Error("handshake for blocked.example succeeded, want a certificate to be refused")
+		}
+	})
+
+	t.Run("allowed SNI", func(t *testing.T) {
+		conn, status := connect(t, addr, "allowed.example:443")
+		defer conn.Close()
+		if status != http.StatusOK {
+			t.Fatalf("CONNECT allowed.example = %d, want 200", status)
+		}
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: "allowed.example", RootCAs: pool})
+		if err := tlsConn.Handshake(); err != nil {
+			t.Errorf("handshake for allowed.example: %v", err)
+		}
+	})
+}
@@ -0,0 +1,59 @@
+package leprox
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var (
+	// pacDomains are the host patterns the PAC file sends through this
+	// proxy, everything else goes DIRECT. Empty means all hosts.
+	pacDomains []string
+	// pacProxy is the proxy address written into the PAC file. Empty uses
+	// the Host the PAC file was requested from.
+	pacProxy string
+	// pacTLS advertises the proxy as an HTTPS proxy.
+	pacTLS bool
+)
+
+// servePAC serves the proxy auto-config file at /proxy.pac.
+func servePAC(w http.ResponseWriter, r *http.Request) {
+	proxyAddr := pacProxy
+	if proxyAddr == "" {
+		proxyAddr = r.Host
+	}
+	directive := "PROXY"
+	if pacTLS {
+		directive = "HTTPS"
+	}
+
+	var b strings.Builder
+	b.WriteString("function FindProxyForURL(url, host) {\n")
+	if len(pacDomains) == 0 {
+		fmt.Fprintf(&b, "  return %s;\n", strconv.Quote(directive+" "+proxyAddr))
+	} else {
+		for _, pattern := range pacDomains {
+			fmt.Fprintf(&b, "  if (%s) return %s;\n", pacCondition(pattern), strconv.Quote(directive+" "+proxyAddr))
+		}
+		b.WriteString("  return \"DIRECT\";\n")
+	}
+	b.WriteString("}\n")
+
+	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write([]byte(b.String()))
+}
+
+// pacCondition translates a host pattern (see matchHost) into JavaScript.
+func pacCondition(pattern string) string {
+	if pattern == "*" {
+		return "true"
+	}
+	suffix := strings.TrimPrefix(pattern, "*")
+	if strings.HasPrefix(suffix, ".") {
+		return fmt.Sprintf("host == %s || dnsDomainIs(host, %s)", strconv.Quote(suffix[1:]), strconv.Quote(suffix))
+	}
+	return fmt.Sprintf("host == %s", strconv.Quote(pattern))
+}
@@ -0,0 +1,305 @@
+package leprox
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// tap writes proxied HTTP exchanges to a pcap file; nil disables it.
+var tap *pcapWriter
+
+const (
+	pcapLinkTypeRaw = 101
+	tcpSegmentSize  = 1460
+
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpPSH = 0x08
+	tcpACK = 0x10
+)
+
+// pcapWriter turns HTTP exchanges into synthesized TCP streams so tools
+// like Wireshark can dissect plaintext and decrypted MITM traffic. Each
+// exchange becomes its own connection with a handshake, the request, the
+// response and a FIN exchange.
+type pcapWriter struct {
+	mu sync.Mutex
+	f  *os.File
+	w  *bufio.Writer
+}
+
+func newPcapWriter(path string) (*pcapWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(f)
+
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], 262144)
+	binary.LittleEndian.PutUint32(header[20:], pcapLinkTypeRaw)
+	if _, err := w.Write(header); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &pcapWriter{f: f, w: w}, nil
+}
+
+func (p *pcapWriter) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.w.Flush()
+	return p.f.Close()
+}
+
+// tapExchange collects one request/response pair for the tap.
+type tapExchange struct {
+	p       *pcapWriter
+	client  netip.AddrPort
+	server  netip.AddrPort
+	started time.Time
+	request []byte
+	header  http.Header
+	reqBody *capturedBody
+
+	answered time.Time
+	resp     *http.Response
+	body     *capturedBody
+}
+
+// start captures r as it is sent upstream.
+func (p *pcapWriter) start(r *http.Request) *tapExchange {
+	x := &tapExchange{p: p, started: time.Now()}
+	x.client, x.server = tapEndpoints(r)
+
+	x.request = fmt.Appendf(nil, "%s %s HTTP/1.1\r\nHost: %s\r\n", r.Method, r.URL.RequestURI(), r.Host)
+	x.header = r.Header.Clone()
+	if r.Body != nil && r.Body != http.NoBody {
+		x.reqBody = &capturedBody{ReadCloser: r.Body, keep: true}
+		r.Body = x.reqBody
+	}
+	return x
+}
+
+// response captures resp as it is sent to the client.
+func (x *tapExchange) response(resp *http.Response) {
+	x.answered = time.Now()
+	x.resp = resp
+	x.body = &capturedBody{ReadCloser: resp.Body, keep: true}
+	resp.Body = x.body
+}
+
+// upgraded captures a 101 Switching Protocols response, leaving its body
+// to the upgraded connection.
+func (x *tapExchange) upgraded(resp *http.Response) {
+	x.answered = time.Now()
+	x.resp = resp
+	x.body = &capturedBody{}
+}
+
+// fail records an exchange that got no response, only the request is
+// written.
+func (x *tapExchange) fail() {
+	x.finish()
+}
+
+// finish writes the exchange once the response body has been relayed.
+// Captured bodies are written unchunked with a matching Content-Length.
+func (x *tapExchange) finish() {
+	request := serializeMessage(x.request, x.header, x.reqBody)
+	var response []byte
+	if x.resp != nil {
+		status := fmt.Appendf(nil, "HTTP/1.1 %d %s\r\n", x.resp.StatusCode, http.StatusText(x.resp.StatusCode))
+		response = serializeMessage(status, x.resp.Header, x.body)
+	}
+	answered := x.answered
+	if answered.IsZero() {
+		answered = time.Now()
+	}
+
+	x.p.mu.Lock()
+	defer x.p.mu.Unlock()
+	s := &tcpStream{p: x.p, client: x.client, server: x.server, clientSeq: 1000, serverSeq: 5000}
+	s.send(x.started, true, tcpSYN, nil)
+	s.send(x.started, false, tcpSYN|tcpACK, nil)
+	s.send(x.started, true, tcpACK, nil)
+	s.data(x.started, true, request)
+	s.data(answered, false, response)
+	done := time.Now()
+	s.send(done, false, tcpFIN|tcpACK, nil)
+	s.send(done, true, tcpFIN|tcpACK, nil)
+	s.send(done, false, tcpACK, nil)
+	if err := x.p.w.Flush(); err != nil {
+		slog.Warn("Failed to write pcap", "err", err)
+	}
+}
+
+// serializeMessage appends header and the captured body to the start line.
+func serializeMessage(start []byte, header http.Header, body *capturedBody) []byte {
+	h := header.Clone()
+	framed := h.Get("Content-Length") != "" || h.Get("Transfer-Encoding") != ""
+	h.Del("Transfer-Encoding")
+	h.Del("Content-Length")
+	if body != nil && (framed || body.buf.Len() > 0) {
+		h.Set("Content-Length", strconv.Itoa(body.buf.Len()))
+	}
+	var b bytes.Buffer
+	b.Write(start)
+	h.Write(&b)
+	b.WriteString("\r\n")
+	if body != nil {
+		b.Write(body.buf.Bytes())
+	}
+	return b.Bytes()
+}
+
+// tapEndpoints picks addresses for the synthesized stream. The client is
+// the real client, the server gets a stable address in the 198.18.0.0/15
+// benchmarking range derived from its hostname, since the real one isn't
+// known here. Decrypted HTTPS is shown on port 80 so it dissects as HTTP.
+func tapEndpoints(r *http.Request) (client, server netip.AddrPort) {
+	client, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		client = netip.AddrPortFrom(netip.AddrFrom4([4]byte{127, 0, 0, 1}), 1)
+	}
+	client = netip.AddrPortFrom(client.Addr().Unmap(), client.Port())
+
+	ip, err := netip.ParseAddr(r.URL.Hostname())
+	if err != nil {
+		h := fnv.New32a()
+		h.Write([]byte(r.URL.Hostname()))
+		sum := h.Sum32()
+		ip = netip.AddrFrom4([4]byte{198, 18 + byte(sum>>16&1), byte(sum >> 8), byte(sum)})
+	}
+	port := 80
+	if p, err := strconv.Atoi(r.URL.Port()); err == nil && r.URL.Scheme == "http" {
+		port = p
+	}
+	server = netip.AddrPortFrom(ip.Unmap(), uint16(port))
+
+	// Both ends need the same IP version.
+	if client.Addr().Is4() != server.Addr().Is4() {
+		client = netip.AddrPortFrom(netip.AddrFrom16(client.Addr().As16()), client.Port())
+		server = netip.AddrPortFrom(netip.AddrFrom16(server.Addr().As16()), server.Port())
+	}
+	return client, server
+}
+
+// tcpStream tracks sequence numbers of a synthesized connection.
+type tcpStream struct {
+	p                    *pcapWriter
+	client, server       netip.AddrPort
+	clientSeq, serverSeq uint32
+}
+
+// data sends payload in segments, each acknowledged by the other side.
+func (s *tcpStream) data(t time.Time, fromClient bool, payload []byte) {
+	for len(payload) > 0 {
+		n := min(len(payload), tcpSegmentSize)
+		s.send(t, fromClient, tcpPSH|tcpACK, payload[:n])
+		s.send(t, !fromClient, tcpACK, nil)
+		payload = payload[n:]
+	}
+}
+
+func (s *tcpStream) send(t time.Time, fromClient bool, flags byte, payload []byte) {
+	src, dst := s.client, s.server
+	seq, ack := &s.clientSeq, &s.serverSeq
+	if !fromClient {
+		src, dst = s.server, s.client
+		seq, ack = &s.serverSeq, &s.clientSeq
+	}
+
+	tcp := make([]byte, 20, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:], src.Port())
+	binary.BigEndian.PutUint16(tcp[2:], dst.Port())
+	binary.BigEndian.PutUint32(tcp[4:], *seq)
+	if flags&tcpACK != 0 {
+		binary.BigEndian.PutUint32(tcp[8:], *ack)
+	}
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 65535)
+	tcp = append(tcp, payload...)
+
+	*seq += uint32(len(payload))
+	if flags&(tcpSYN|tcpFIN) != 0 {
+		*seq++
+	}
+
+	var packet []byte
+	if src.Addr().Is4() {
+		ip := make([]byte, 20)
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+len(tcp)))
+		ip[8] = 64
+		ip[9] = 6
+		s4, d4 := src.Addr().As4(), dst.Addr().As4()
+		copy(ip[12:], s4[:])
+		copy(ip[16:], d4[:])
+		binary.BigEndian.PutUint16(ip[10:], checksum(ip, 0))
+
+		pseudo := append(append(append([]byte{}, s4[:]...), d4[:]...), 0, 6, byte(len(tcp)>>8), byte(len(tcp)))
+		binary.BigEndian.PutUint16(tcp[16:], checksum(tcp, sum16(pseudo)))
+		packet = append(ip, tcp...)
+	} else {
+		ip := make([]byte, 40)
+		ip[0] = 0x60
+		binary.BigEndian.PutUint16(ip[4:], uint16(len(tcp)))
+		ip[6] = 6
+		ip[7] = 64
+		s16, d16 := src.Addr().As16(), dst.Addr().As16()
+		copy(ip[8:], s16[:])
+		copy(ip[24:], d16[:])
+
+		pseudo := append(append(append([]byte{}, s16[:]...), d16[:]...), 0, 0, byte(len(tcp)>>8), byte(len(tcp)), 0, 0, 0, 6)
+		binary.BigEndian.PutUint16(tcp[16:], checksum(tcp, sum16(pseudo)))
+		packet = append(ip, tcp...)
+	}
+
+	record := make([]byte, 16)
+	binary.LittleEndian.PutUint32(record[0:], uint32(t.Unix()))
+	binary.LittleEndian.PutUint32(record[4:], uint32(t.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(record[8:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(record[12:], uint32(len(packet)))
+	s.p.w.Write(record)
+	s.p.w.Write(packet)
+}
+
+// sum16 adds b as big endian 16-bit words.
+func sum16(b []byte) uint32 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	return sum
+}
+
+// checksum returns the Internet checksum of b on top of an initial sum.
+func checksum(b []byte, initial uint32) uint16 {
+	sum := initial + sum16(b)
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
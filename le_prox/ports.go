@@ -0,0 +1,63 @@
+package leprox
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// portRange is an inclusive range of ports.
+type portRange struct {
+	lo, hi int
+}
+
+type portList []portRange
+
+// parsePortList parses a comma separated list of ports and lo-hi ranges.
+// "*" allows every port.
+func parsePortList(s string) (portList, error) {
+	if strings.TrimSpace(s) == "*" {
+		return nil, nil
+	}
+
+	var ports portList
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		lo, hi, isRange := strings.Cut(part, "-")
+		if !isRange {
+			hi = lo
+		}
+		l, err1 := strconv.Atoi(lo)
+		h, err2 := strconv.Atoi(hi)
+		if err1 != nil || err2 != nil || l < 1 || h > 65535 || l > h {
+			return nil, fmt.Errorf("invalid port or range %q", part)
+		}
+		ports = append(ports, portRange{l, h})
+	}
+	if len(ports) == 0 {
+		return nil, fmt.Errorf("empty port list")
+	}
+	return ports, nil
+}
+
+// allows reports whether the port of host:port is in the list.
+func (l portList) allows(addr string) bool {
+	if l == nil {
+		return true
+	}
+	_, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return false
+	}
+	for _, r := range l {
+		if port >= r.lo && port <= r.hi {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,393 @@
+package leprox
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// profilePresets are the access networks -profile knows by name, typical
+// rather than worst case figures.
+var profilePresets = map[string]string{
+	"2g":        "down=250kbit,up=50kbit,rtt=600ms,jitter=50ms,loss=1%",
+	"3g":        "down=1600kbit,up=750kbit,rtt=150ms,jitter=20ms,loss=0.5%",
+	"4g":        "down=12mbit,up=5mbit,rtt=70ms,jitter=10ms,loss=0.1%",
+	"dsl":       "down=8mbit,up=1mbit,rtt=40ms,jitter=2ms",
+	"cable":     "down=50mbit,up=5mbit,rtt=20ms,jitter=2ms",
+	"satellite": "down=15mbit,up=3mbit,rtt=600ms,jitter=20ms,loss=0.5%",
+	"leo":       "down=100mbit,up=15mbit,rtt=50ms,jitter=15ms,loss=0.5%",
+}
+
+// segmentSize is what a loss is counted per, a TCP segment on Ethernet.
+const segmentSize = 1460
+
+// link is one direction of an emulated access network.
+type link struct {
+	rate    float64       // bytes per second, 0 for no cap
+	latency time.Duration // one way
+	jitter  time.Duration // added at random, up to
+	loss    float64       // fraction of segments lost
+}
+
+// profile is an access network: a link each way, shared by the
+// connections of a client or to a host.
+type profile struct {
+	name     string
+	up, down link
+
+	mu    sync.Mutex
+	pipes map[string]*pipePair
+	swept time.Time
+}
+
+type pipePair struct{ up, down *pipe }
+
+// parseProfile accepts a preset name or a spec like
+// down=1mbit,up=256kbit,rtt=100ms,jitter=10ms,loss=1%.
+func parseProfile(s string) (*profile, error) {
+	name, spec := "custom", s
+	if preset, ok := profilePresets[strings.ToLower(s)]; ok {
+		name, spec = strings.ToLower(s), preset
+	} else if !strings.Contains(s, "=") {
+		presets := slices.Sorted(maps.Keys(profilePresets))
+		return nil, fmt.Errorf("unknown profile %q, want one of %s or a spec like down=1mbit,up=256kbit,rtt=100ms,loss=1%%", s, strings.Join(presets, ", "))
+	}
+
+	p := &profile{name: name}
+	for _, field := range strings.Split(spec, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+		var err error
+		switch key {
+		case "down":
+			p.down.rate, err = parseBandwidth(value)
+		case "up":
+			p.up.rate, err = parseBandwidth(value)
+		case "rtt":
+			var rtt time.Duration
+			rtt, err = time.ParseDuration(value)
+			p.up.latency, p.down.latency = rtt/2, rtt-rtt/2
+		case "jitter":
+			p.up.jitter, err = time.ParseDuration(value)
+			p.down.jitter = p.up.jitter
+		case "loss":
+			var pct float64
+			pct, err = strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+			if err == nil && (pct < 0 || pct >= 100) {
+				err = fmt.Errorf("want 0 to 100%%")
+			}
+			p.up.loss, p.down.loss = pct/100, pct/100
+		default:
+			return nil, fmt.Errorf("invalid profile field %q, want down, up, rtt, jitter or loss", field)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid profile %s %q: %v", key, value, err)
+		}
+	}
+	if p.up == (link{}) && p.down == (link{}) {
+		return nil, fmt.Errorf("profile %q changes nothing", s)
+	}
+	return p, nil
+}
+
+// parseBandwidth reads a rate in bits per second with a bit, kbit, mbit
+// or gbit suffix, as tc does, returning bytes per second.
+func parseBandwidth(s string) (float64, error) {
+	lower := strings.ToLower(s)
+	scale := 1.0
+	for _, unit := range []struct {
+		suffix string
+		scale  float64
+	}{{"kbit", 1e3}, {"mbit", 1e6}, {"gbit", 1e9}, {"bit", 1}} {
+		if strings.HasSuffix(lower, unit.suffix) {
+			lower, scale = strings.TrimSuffix(lower, unit.suffix), unit.scale
+			break
+		}
+	}
+	bits, err := strconv.ParseFloat(lower, 64)
+	if err != nil || bits <= 0 {
+		return 0, fmt.Errorf("want a positive rate like 512kbit or 10mbit")
+	}
+	return bits * scale / 8, nil
+}
+
+func (p *profile) String() string {
+	var b strings.Builder
+	b.WriteString(p.name)
+	rate := func(r float64) string {
+		if r == 0 {
+			return "uncapped"
+		}
+		return strconv.FormatFloat(r*8/1e6, 'f', -1, 64) + " Mbit/s"
+	}
+	fmt.Fprintf(&b, " (down %s, up %s, rtt %v", rate(p.down.rate), rate(p.up.rate), p.up.latency+p.down.latency)
+	if p.up.jitter > 0 {
+		fmt.Fprintf(&b, ", jitter %v", p.up.jitter)
+	}
+	if p.up.loss > 0 {
+		fmt.Fprintf(&b, ", loss %v%%", p.up.loss*100)
+	}
+	b.WriteString(")")
+	return b.String()
+}
+
+// pipesFor returns the links of key, a client or a host, dropping those
+// idle for a while now and then.
+func (p *profile) pipesFor(key string) *pipePair {
+	now := time.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if now.Sub(p.swept) > time.Minute {
+		for k, pp := range p.pipes {
+			if pp.up.idleSince(now) > time.Minute && pp.down.idleSince(now) > time.Minute {
+				delete(p.pipes, k)
+			}
+		}
+		p.swept = now
+	}
+	pp, ok := p.pipes[key]
+	if !ok {
+		if p.pipes == nil {
+			p.pipes = make(map[string]*pipePair)
+		}
+		pp = &pipePair{up: &pipe{link: p.up}, down: &pipe{link: p.down}}
+		p.pipes[key] = pp
+	}
+	return pp
+}
+
+// profileClientRule applies a profile to clients in prefix.
+type profileClientRule struct {
+	prefix  netip.Prefix
+	profile *profile
+}
+
+// profileHostRule applies a profile to destinations matching pattern.
+type profileHostRule struct {
+	pattern string
+	profile *profile
+}
+
+var (
+	// profileDefault is emulated for traffic no rule covers, nil for
+	// none.
+	profileDefault     *profile
+	profileClientRules []profileClientRule
+	profileHostRules   []profileHostRule
+)
+
+// addProfileClientRule parses a cidr=profile rule.
+func addProfileClientRule(rule string) error {
+	cidr, spec, ok := strings.Cut(rule, "=")
+	if !ok || cidr == "" || spec == "" {
+		return fmt.Errorf("invalid client profile %q, want cidr=profile", rule)
+	}
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return err
+	}
+	p, err := parseProfile(spec)
+	if err != nil {
+		return err
+	}
+	profileClientRules = append(profileClientRules, profileClientRule{prefix: prefix.Masked(), profile: p})
+	return nil
+}
+
+// addProfileHostRule parses a pattern=profile rule.
+func addProfileHostRule(rule string) error {
+	pattern, spec, ok := strings.Cut(rule, "=")
+	if !ok || pattern == "" || spec == "" {
+		return fmt.Errorf("invalid host profile %q, want pattern=profile", rule)
+	}
+	p, err := parseProfile(spec)
+	if err != nil {
+		return err
+	}
+	profileHostRules = append(profileHostRules, profileHostRule{pattern: strings.ToLower(pattern), profile: p})
+	return nil
+}
+
+// impairment returns the links traffic between clientAddr and host goes
+// through, nil if no profile covers it. Client rules come first, the
+// most specific prefix winning, then host rules in order, then the
+// default. Clients get links of their own, as do hosts under host rules.
+func impairment(clientAddr, host string) *pipePair {
+	client := clientAddr
+	if ip, _, err := net.SplitHostPort(clientAddr); err == nil {
+		client = ip
+	}
+	if ip, err := netip.ParseAddr(client); err == nil {
+		var best *profileClientRule
+		for i, rule := range profileClientRules {
+			if rule.prefix.Contains(ip.Unmap()) && (best == nil || rule.prefix.Bits() > best.prefix.Bits()) {
+				best = &profileClientRules[i]
+			}
+		}
+		if best != nil {
+			return best.profile.pipesFor(client)
+		}
+	}
+	for _, rule := range profileHostRules {
+		if matchHost(rule.pattern, host) {
+			return rule.profile.pipesFor(strings.ToLower(host))
+		}
+	}
+	if profileDefault != nil {
+		return profileDefault.pipesFor(client)
+	}
+	return nil
+}
+
+// pipe is the state of a link: when it is done sending what it was
+// given so far.
+type pipe struct {
+	link
+
+	mu        sync.Mutex
+	busyUntil time.Time
+}
+
+func (p *pipe) idleSince(now time.Time) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return now.Sub(p.busyUntil)
+}
+
+// schedule returns when n bytes handed to the link at now come out the
+// other end: once what is queued ahead of them and they themselves have
+// been sent at the rate, the latency and jitter later, and a
+// retransmission timeout later again if one of their segments is lost.
+func (p *pipe) schedule(n int, now time.Time) time.Time {
+	p.mu.Lock()
+	sent := now
+	if p.busyUntil.After(sent) {
+		sent = p.busyUntil
+	}
+	if p.rate > 0 {
+		sent = sent.Add(time.Duration(float64(n) / p.rate * float64(time.Second)))
+	}
+	p.busyUntil = sent
+	p.mu.Unlock()
+
+	arrival := sent.Add(p.latency)
+	if p.jitter > 0 {
+		arrival = arrival.Add(rand.N(p.jitter))
+	}
+	if p.loss > 0 {
+		segments := max(1, (n+segmentSize-1)/segmentSize)
+		if rand.Float64() < 1-math.Pow(1-p.loss, float64(segments)) {
+			// Linux's minimum RTO on top of the round trip.
+			arrival = arrival.Add(200*time.Millisecond + 2*p.latency)
+		}
+	}
+	return arrival
+}
+
+// wait blocks until a message handed to the link now, like request or
+// response headers, has come through.
+func (p *pipe) wait() {
+	time.Sleep(time.Until(p.schedule(0, time.Now())))
+}
+
+// chunkSize is how much the reader of p passes on at a time: about 10ms
+// of data, so pacing is smooth, but at least a segment.
+func (p *pipe) chunkSize() int {
+	if p.rate == 0 {
+		return 32 << 10
+	}
+	return min(max(int(p.rate/100), segmentSize), 32<<10)
+}
+
+// reader returns r delivered through p. It reads ahead of its reader so
+// the link stays full, up to a buffer of what the link holds in flight.
+func (p *pipe) reader(r io.ReadCloser) io.ReadCloser {
+	depth := 64
+	if p.rate > 0 {
+		inFlight := p.rate * (2*p.latency + p.jitter + 200*time.Millisecond).Seconds()
+		depth = max(8, int(inFlight)/p.chunkSize()+8)
+	}
+	s := &shapedReader{ReadCloser: r, pipe: p, chunks: make(chan shapedChunk, depth), closed: make(chan struct{})}
+	go s.pump()
+	return s
+}
+
+type shapedChunk struct {
+	data    []byte
+	err     error
+	arrival time.Time
+}
+
+// shapedReader hands on what it reads at the times its pipe schedules,
+// in order.
+type shapedReader struct {
+	io.ReadCloser
+	pipe   *pipe
+	chunks chan shapedChunk
+	closed chan struct{}
+	once   sync.Once
+
+	cur []byte
+	err error
+}
+
+func (s *shapedReader) pump() {
+	var last time.Time
+	for {
+		buf := make([]byte, s.pipe.chunkSize())
+		n, err := s.ReadCloser.Read(buf)
+		if n > 0 {
+			if arrival := s.pipe.schedule(n, time.Now()); arrival.After(last) {
+				last = arrival
+			}
+		}
+		select {
+		case s.chunks <- shapedChunk{data: buf[:n], err: err, arrival: last}:
+		case <-s.closed:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *shapedReader) Read(p []byte) (int, error) {
+	for len(s.cur) == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+		var c shapedChunk
+		select {
+		case c = <-s.chunks:
+		case <-s.closed:
+			return 0, net.ErrClosed
+		}
+		if d := time.Until(c.arrival); d > 0 {
+			t := time.NewTimer(d)
+			select {
+			case <-t.C:
+			case <-s.closed:
+				t.Stop()
+				return 0, net.ErrClosed
+			}
+		}
+		s.cur, s.err = c.data, c.err
+	}
+	n := copy(p, s.cur)
+	s.cur = s.cur[n:]
+	return n, nil
+}
+
+func (s *shapedReader) Close() error {
+	s.once.Do(func() { close(s.closed) })
+	return s.ReadCloser.Close()
+}
@@ -0,0 +1,166 @@
+package leprox
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// proxyProtocolSig starts every PROXY protocol v2 header.
+var proxyProtocolSig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	proxyCmdLocal = 0x20
+	proxyCmdProxy = 0x21
+
+	proxyFamTCP4 = 0x11
+	proxyFamTCP6 = 0x21
+)
+
+// sendProxyProtocol prepends a PROXY protocol v2 header carrying the
+// client address to every upstream connection.
+var sendProxyProtocol bool
+
+type clientAddrKey struct{}
+
+// withClientAddr records the address of the client a dial is made for, so
+// it can be passed on in a PROXY protocol header.
+func withClientAddr(ctx context.Context, addr string) context.Context {
+	return context.WithValue(ctx, clientAddrKey{}, addr)
+}
+
+// writeProxyHeader writes a v2 header for a connection from src to dst.
+// Without a usable src the header uses the LOCAL command, which tells the
+// receiver to keep the real connection addresses.
+func writeProxyHeader(w io.Writer, src string, dst net.Addr) error {
+	header := append([]byte{}, proxyProtocolSig...)
+
+	s, serr := netip.ParseAddrPort(src)
+	d, derr := netip.ParseAddrPort(dst.String())
+	if serr != nil || derr != nil {
+		header = append(header, proxyCmdLocal, 0x00, 0x00, 0x00)
+		_, err := w.Write(header)
+		return err
+	}
+
+	srcIP, dstIP := s.Addr().Unmap(), d.Addr().Unmap()
+	if srcIP.Is4() && dstIP.Is4() {
+		header = append(header, proxyCmdProxy, proxyFamTCP4, 0x00, 12)
+		header = append(header, srcIP.AsSlice()...)
+		header = append(header, dstIP.AsSlice()...)
+	} else {
+		// Mixed families are sent as IPv6 with v4-mapped addresses.
+		src16, dst16 := srcIP.As16(), dstIP.As16()
+		header = append(header, proxyCmdProxy, proxyFamTCP6, 0x00, 36)
+		header = append(header, src16[:]...)
+		header = append(header, dst16[:]...)
+	}
+	header = binary.BigEndian.AppendUint16(header, s.Port())
+	header = binary.BigEndian.AppendUint16(header, d.Port())
+	_, err := w.Write(header)
+	return err
+}
+
+// proxyListener accepts connections that start with a PROXY protocol v2
+// header, as sent by load balancers such as HAProxy or AWS NLB.
+type proxyListener struct {
+	net.Listener
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: conn}, nil
+}
+
+// proxyConn reads the header on first use rather than in Accept, so a
+// slow client can't hold up the accept loop.
+type proxyConn struct {
+	net.Conn
+
+	once   sync.Once
+	err    error
+	remote net.Addr
+	local  net.Addr
+}
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		c.remote, c.local = c.Conn.RemoteAddr(), c.Conn.LocalAddr()
+		c.Conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		c.err = c.readHeader()
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			c.Conn.Close()
+		}
+	})
+}
+
+func (c *proxyConn) readHeader() error {
+	fixed := make([]byte, 16)
+	if _, err := io.ReadFull(c.Conn, fixed); err != nil {
+		return fmt.Errorf("reading PROXY header: %w", err)
+	}
+	if !bytes.Equal(fixed[:12], proxyProtocolSig) {
+		return errors.New("missing PROXY protocol v2 header")
+	}
+	if fixed[12]>>4 != 2 {
+		return fmt.Errorf("unsupported PROXY protocol version %d", fixed[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(fixed[14:]))
+	if _, err := io.ReadFull(c.Conn, body); err != nil {
+		return fmt.Errorf("reading PROXY header: %w", err)
+	}
+
+	// LOCAL connections (health checks from the balancer itself) and
+	// non-TCP families keep the real addresses. TLVs are ignored.
+	if fixed[12] != proxyCmdProxy {
+		return nil
+	}
+	var size int
+	switch fixed[13] {
+	case proxyFamTCP4:
+		size = 4
+	case proxyFamTCP6:
+		size = 16
+	default:
+		return nil
+	}
+	if len(body) < 2*size+4 {
+		return errors.New("short PROXY protocol address block")
+	}
+	srcIP, _ := netip.AddrFromSlice(body[:size])
+	dstIP, _ := netip.AddrFromSlice(body[size : 2*size])
+	ports := body[2*size:]
+	c.remote = net.TCPAddrFromAddrPort(netip.AddrPortFrom(srcIP.Unmap(), binary.BigEndian.Uint16(ports)))
+	c.local = net.TCPAddrFromAddrPort(netip.AddrPortFrom(dstIP.Unmap(), binary.BigEndian.Uint16(ports[2:])))
+	return nil
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.Conn.Read(p)
+}
+
+// RemoteAddr returns the original client address from the header.
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.init()
+	return c.remote
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	c.init()
+	return c.local
+}
@@ -0,0 +1,136 @@
+package leprox
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimiter keeps a token bucket per key. Buckets refill at rate tokens
+// per second up to burst.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = int(math.Max(1, math.Ceil(rate)))
+	}
+	return &rateLimiter{rate: rate, burst: float64(burst), buckets: make(map[string]*bucket)}
+}
+
+// resize returns a limiter for rate and burst, l itself if it already has
+// those settings. A rate of 0 disables the limit.
+func (l *rateLimiter) resize(rate float64, burst int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	n := newRateLimiter(rate, burst)
+	if l != nil && l.rate == n.rate && l.burst == n.burst {
+		return l
+	}
+	return n
+}
+
+// take consumes a token for key. If none is left it returns false and how
+// long until one is available.
+func (l *rateLimiter) take(key string) (bool, time.Duration) {
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Buckets that have been idle long enough to be full again are the same
+	// as missing ones, drop them now and then so the map stays small.
+	if now.Sub(l.swept) > time.Minute {
+		full := time.Duration(l.burst / l.rate * float64(time.Second))
+		for k, b := range l.buckets {
+			if now.Sub(b.last) > full {
+				delete(l.buckets, k)
+			}
+		}
+		l.swept = now
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// refund returns a token taken for key, for a request that another limit
+// rejected after all.
+func (l *rateLimiter) refund(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if b, ok := l.buckets[key]; ok {
+		b.tokens = math.Min(l.burst, b.tokens+1)
+	}
+}
+
+// allowRequest applies the client and host rate limits to a request for
+// host, answering 429 Too Many Requests if either is exceeded.
+func allowRequest(w http.ResponseWriter, r *http.Request, host string) bool {
+	ok, wait, what := takeRateLimits(r.RemoteAddr, host)
+	if !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		http.Error(w, "Rate limit exceeded for "+what, http.StatusTooManyRequests)
+	}
+	return ok
+}
+
+// takeRateLimits applies the client and host rate limits to a request
+// from clientAddr for host, only the client's with no host. When one is
+// exceeded it returns how long to wait and which limit it was, and no
+// token of either limit is spent.
+func takeRateLimits(clientAddr, host string) (bool, time.Duration, string) {
+	client, _, err := net.SplitHostPort(clientAddr)
+	if err != nil {
+		client = clientAddr
+	}
+	host = strings.ToLower(host)
+
+	policy := currentConfig().access
+	clientLimited := policy.clientLimits != nil && client != ""
+	if clientLimited {
+		if ok, wait := policy.clientLimits.take(client); !ok {
+			rateLimited.Add(1)
+			return false, wait, "client " + client
+		}
+	}
+	if policy.hostLimits != nil && host != "" {
+		if ok, wait := policy.hostLimits.take(host); !ok {
+			// The request isn't made, so it doesn't count against the
+			// client either.
+			if clientLimited {
+				policy.clientLimits.refund(client)
+			}
+			rateLimited.Add(1)
+			return false, wait, "host " + host
+		}
+	}
+	return true, 0, ""
+}
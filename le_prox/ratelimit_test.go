@@ -0,0 +1,42 @@
+package leprox
+
+import "testing"
+
+func TestTakeRateLimitsRefundsClient(t *testing.T) {
+	// Rates low enough that nothing refills during the test.
+	useAccessPolicy(t, &accessPolicy{
+		clientLimits: newRateLimiter(0.001, 2),
+		hostLimits:   newRateLimiter(0.001, 1),
+	})
+
+	if ok, _, what := takeRateLimits("192.0.2.1:1000", "a.example"); !ok {
+		t.Fatalf("first request limited by %s", what)
+	}
+	// a.example is out of tokens, the client must keep its last one.
+	for i := 0; i < 3; i++ {
+		if ok, _, what := takeRateLimits("192.0.2.1:1000", "a.example"); ok || what != "host a.example" {
+			t.Fatalf("request %d to a.example = %v limited by %q, want limited by host", i, ok, what)
+		}
+	}
+	if ok, _, what := takeRateLimits("192.0.2.1:1001", "b.example"); !ok {
+		t.Fatalf("request to b.example limited by %s, want the client's token refunded", what)
+	}
+	if ok, _, what := takeRateLimits("192.0.2.1:1002", "c.example"); ok || what != "client 192.0.2.1" {
+		t.Fatalf("third request = %v limited by %q, want limited by client", ok, what)
+	}
+}
+
+func TestRefundCapsAtBurst(t *testing.T) {
+	l := newRateLimiter(0.001, 1)
+	if ok, _ := l.take("k"); !ok {
+		t.Fatal("first take failed")
+	}
+	l.refund("k")
+	l.refund("k")
+	if ok, _ := l.take("k"); !ok {
+		t.Fatal("take after refund failed")
+	}
+	if ok, _ := l.take("k"); ok {
+		t.Fatal("refunds exceeded the burst")
+	}
+}
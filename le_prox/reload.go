@@ -0,0 +1,64 @@
+package leprox
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// watchConfig reloads the config file on SIGHUP and, if interval is set,
+// whenever polling shows its modification time or size changed.
+func watchConfig(path string, interval time.Duration, reverse bool) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		tick = time.NewTicker(interval).C
+	}
+	last, _ := os.Stat(path)
+
+	for {
+		select {
+		case <-hup:
+			slog.Info("Received SIGHUP, reloading", "path", path)
+		case <-tick:
+			info, err := os.Stat(path)
+			if err != nil || (last != nil && info.ModTime().Equal(last.ModTime()) && info.Size() == last.Size()) {
+				continue
+			}
+			last = info
+			slog.Info("Config changed, reloading", "path", path)
+		}
+		if err := reloadConfig(path, reverse); err != nil {
+			configReloadErrors.Add(1)
+			slog.Warn("Failed to reload config, keeping the previous one", "err", err)
+		}
+	}
+}
+
+// reloadConfig loads path and makes it the active configuration. Requests
+// already being handled and open tunnels keep the rules they started with.
+func reloadConfig(path string, reverse bool) error {
+	cfg, err := loadConfig(path)
+	if err != nil {
+		return err
+	}
+	if reverse && len(cfg.VirtualHosts) == 0 {
+		return fmt.Errorf("%s: -reverse needs virtual_hosts", path)
+	}
+
+	old := currentConfig()
+	if err := activateConfig(cfg); err != nil {
+		return err
+	}
+	if reverse {
+		restartHealthChecks(old.VirtualHosts, cfg.VirtualHosts)
+	}
+	configReloads.Add(1)
+	slog.Info("Reloaded config", "rules", cfg.summary(), "path", path)
+	return nil
+}
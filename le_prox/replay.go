@@ -0,0 +1,266 @@
+package leprox
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gonet/pkg/stats"
+)
+
+// replayOptions are the -replay flags.
+type replayOptions struct {
+	target   string        // scheme://host[:port][/prefix], empty the recorded URLs
+	keepHost bool          // send the recorded Host to the target
+	speed    float64       // 1 original timing, 2 twice as fast, 0 no waiting
+	repeat   int           // times each copy runs the session
+	parallel int           // copies running at once
+	timeout  time.Duration // per request
+}
+
+// replayHeaders are recorded request headers the replayed request gets
+// anew: those of the proxy hop and those the client sets itself.
+var replayHeaders = []string{"Content-Length", "Via", "X-Forwarded-For", "X-Forwarded-Proto", "Traceparent", "Tracestate"}
+
+// replayEntry is a recorded request ready to be sent again.
+type replayEntry struct {
+	e      *harEntry
+	offset time.Duration // from the start of the session
+	// after is the request of the same client that had finished when
+	// this one started, the latest to, or -1: it is awaited again so the
+	// requests of a client keep their order at any speed.
+	after int
+	body  []byte
+}
+
+// loadReplay reads a HAR file, such as -har records, and orders its
+// entries for replaying.
+func loadReplay(path string) ([]replayEntry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f harFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("invalid HAR file %s: %v", path, err)
+	}
+	if len(f.Log.Entries) == 0 {
+		return nil, fmt.Errorf("no entries in %s", path)
+	}
+	entries := f.Log.Entries
+	slices.SortStableFunc(entries, func(a, b harEntry) int { return a.StartedDateTime.Compare(b.StartedDateTime) })
+
+	start := entries[0].StartedDateTime
+	replay := make([]replayEntry, len(entries))
+	truncated := 0
+	for i := range entries {
+		e := &entries[i]
+		r := replayEntry{e: e, offset: e.StartedDateTime.Sub(start), after: -1}
+		if _, err := url.Parse(e.Request.URL); err != nil {
+			return nil, fmt.Errorf("entry %d: invalid URL %q", i, e.Request.URL)
+		}
+		if pd := e.Request.PostData; pd != nil {
+			r.body = []byte(pd.Text)
+			if pd.Encoding == "base64" {
+				if r.body, err = base64.StdEncoding.DecodeString(pd.Text); err != nil {
+					return nil, fmt.Errorf("entry %d: invalid base64 body", i)
+				}
+			}
+		}
+		if e.Request.BodySize > int64(len(r.body)) {
+			truncated++
+		}
+
+		client := sessionOf(e.Client)
+		var finished time.Time
+		for j := i - 1; j >= 0; j-- {
+			p := &entries[j]
+			if sessionOf(p.Client) != client {
+				continue
+			}
+			end := p.StartedDateTime.Add(time.Duration(p.Time * float64(time.Millisecond)))
+			if !end.After(e.StartedDateTime) && end.After(finished) {
+				finished, r.after = end, j
+			}
+		}
+		replay[i] = r
+	}
+	if truncated > 0 {
+		slog.Warn("Some request bodies were not recorded in full, record with -har-bodies", "requests", truncated)
+	}
+	return replay, nil
+}
+
+// sessionOf is the client IP of a recorded address: the connections of
+// a client are one session.
+func sessionOf(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// replayStats sum up the replayed requests.
+type replayStats struct {
+	requests   atomic.Uint64
+	failed     atomic.Uint64 // no response
+	mismatched atomic.Uint64 // another status than recorded
+	bytes      atomic.Uint64
+	latency    stats.Histogram // to the response headers
+	recorded   stats.Histogram // what the recording took
+}
+
+// replay sends the requests of a recorded session again with their
+// timing scaled by o.speed, and prints how it went to w.
+func replay(path string, o replayOptions, w io.Writer) error {
+	entries, err := loadReplay(path)
+	if err != nil {
+		return err
+	}
+	var target *url.URL
+	if o.target != "" {
+		if target, err = url.Parse(o.target); err != nil || target.Host == "" {
+			return fmt.Errorf("invalid -replay-target %q, want a URL like http://host:port", o.target)
+		}
+	}
+	if o.speed < 0 {
+		return fmt.Errorf("invalid -replay-speed %v", o.speed)
+	}
+	o.repeat, o.parallel = max(o.repeat, 1), max(o.parallel, 1)
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			MaxIdleConnsPerHost: 100,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		Timeout: o.timeout,
+		// Redirects were recorded as requests of their own.
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+
+	last := entries[len(entries)-1].offset
+	slog.Info("Replaying session", "path", path, "requests", len(entries), "duration", last, "target", o.target,
+		"speed", o.speed, "repeat", o.repeat, "parallel", o.parallel)
+	st := &replayStats{}
+	began := time.Now()
+	var wg sync.WaitGroup
+	for c := range o.parallel {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for run := range o.repeat {
+				replayOnce(client, entries, target, o, st)
+				slog.Debug("Replayed session", "copy", c+1, "run", run+1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	fmt.Fprintf(w, "Replayed:  %d requests in %v (recorded %v at speed %v)\n", st.requests.Load(),
+		time.Since(began).Round(time.Millisecond), last.Round(time.Millisecond), o.speed)
+	fmt.Fprintf(w, "Results:   %d failed, %d with another status than recorded, %d bytes received\n",
+		st.failed.Load(), st.mismatched.Load(), st.bytes.Load())
+	st.latency.Summary().Write(w, false)
+	if rec := st.recorded.Summary(); rec.Count > 0 {
+		fmt.Fprintf(w, "Recorded:  mean %v, p50 %v, p90 %v, p99 %v, max %v\n", rec.Mean.Round(time.Microsecond),
+			rec.P50.Round(time.Microsecond), rec.P90.Round(time.Microsecond), rec.P99.Round(time.Microsecond), rec.Max.Round(time.Microsecond))
+	}
+	return nil
+}
+
+// replayOnce runs the session once, each request at its offset or once
+// the request it came after is done, whichever is later.
+func replayOnce(client *http.Client, entries []replayEntry, target *url.URL, o replayOptions, st *replayStats) {
+	start := time.Now()
+	done := make([]chan struct{}, len(entries))
+	for i := range done {
+		done[i] = make(chan struct{})
+	}
+	var wg sync.WaitGroup
+	for i := range entries {
+		r := &entries[i]
+		if o.speed > 0 {
+			time.Sleep(time.Until(start.Add(time.Duration(float64(r.offset) / o.speed))))
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(done[i])
+			if r.after >= 0 {
+				<-done[r.after]
+			}
+			replayRequest(client, r, target, o.keepHost, st)
+		}()
+	}
+	wg.Wait()
+}
+
+// replayRequest sends a recorded request again and counts how it went.
+func replayRequest(client *http.Client, r *replayEntry, target *url.URL, keepHost bool, st *replayStats) {
+	e := r.e
+	u, _ := url.Parse(e.Request.URL)
+	host := u.Host
+	if target != nil {
+		u.Scheme, u.Host = target.Scheme, target.Host
+		u.Path = strings.TrimSuffix(target.Path, "/") + u.Path
+		if u.RawPath != "" {
+			u.RawPath = strings.TrimSuffix(target.EscapedPath(), "/") + u.RawPath
+		}
+	}
+	var body io.Reader
+	if r.body != nil {
+		body = bytes.NewReader(r.body)
+	}
+	req, err := http.NewRequestWithContext(context.Background(), e.Request.Method, u.String(), body)
+	if err != nil {
+		st.requests.Add(1)
+		st.failed.Add(1)
+		slog.Warn("Replayed request failed", "method", e.Request.Method, "url", u, "err", err)
+		return
+	}
+	for _, h := range e.Request.Headers {
+		req.Header.Add(h.Name, h.Value)
+	}
+	removeHopHeaders(req.Header)
+	for _, name := range replayHeaders {
+		req.Header.Del(name)
+	}
+	if keepHost {
+		req.Host = host
+	}
+
+	st.requests.Add(1)
+	st.recorded.Record(time.Duration(e.Timings.Wait * float64(time.Millisecond)))
+	sent := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		st.failed.Add(1)
+		slog.Warn("Replayed request failed", "method", req.Method, "url", u, "err", err)
+		return
+	}
+	st.latency.Record(time.Since(sent))
+	n, err := io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	st.bytes.Add(uint64(n))
+	if err != nil {
+		slog.Warn("Replayed response body failed", "method", req.Method, "url", u, "err", err)
+	}
+	if e.Response.Status != 0 && resp.StatusCode != e.Response.Status {
+		st.mismatched.Add(1)
+		slog.Debug("Replayed request got another status", "method", req.Method, "url", u,
+			"status", resp.StatusCode, "recorded", e.Response.Status)
+	}
+}
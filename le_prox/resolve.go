@@ -0,0 +1,193 @@
+package leprox
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hostOverrides maps hostnames to the addresses that should be dialed in
+// their place, like entries in /etc/hosts. Several addresses are replicas
+// tried in order when dialing fails.
+var hostOverrides = make(map[string][]string)
+
+// setResolver sends all upstream DNS lookups to the server at addr instead
+// of the system resolver. addr is host:port for plain DNS, tls://host[:port]
+// for DNS over TLS or an https:// URL for DNS over HTTPS.
+func setResolver(addr string) error {
+	var dial func(ctx context.Context, network, address string) (net.Conn, error)
+	var err error
+	switch {
+	case strings.HasPrefix(addr, "tls://"):
+		dial, err = dotDialer(strings.TrimPrefix(addr, "tls://"))
+	case strings.HasPrefix(addr, "https://"):
+		dial, err = dohDialer(addr)
+	}
+	if err != nil {
+		return err
+	}
+	if dial != nil {
+		upstreamDialer.Resolver = &net.Resolver{PreferGo: true, Dial: dial}
+		return nil
+	}
+
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "53")
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return fmt.Errorf("invalid resolver address %q", addr)
+	}
+
+	upstreamDialer.Resolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+	return nil
+}
+
+// addHostOverride parses a host=address[,address...] rule, where each
+// address is an IP or another hostname.
+func addHostOverride(rule string) error {
+	host, targets, ok := strings.Cut(rule, "=")
+	if !ok || host == "" || targets == "" {
+		return fmt.Errorf("invalid host override %q, want host=address[,address...]", rule)
+	}
+	for _, target := range strings.Split(targets, ",") {
+		if target = strings.TrimSpace(target); target == "" {
+			return fmt.Errorf("empty address in host override %q", rule)
+		}
+		hostOverrides[strings.ToLower(host)] = append(hostOverrides[strings.ToLower(host)], target)
+	}
+	return nil
+}
+
+// overrideAddrs returns the addresses to dial for host:port, which is addr
+// itself unless host has overrides.
+func overrideAddrs(addr string) []string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return []string{addr}
+	}
+	targets, ok := hostOverrides[strings.ToLower(strings.TrimSuffix(host, "."))]
+	if !ok {
+		return []string{addr}
+	}
+	addrs := make([]string, len(targets))
+	for i, target := range targets {
+		addrs[i] = net.JoinHostPort(target, port)
+	}
+	return addrs
+}
+
+// dnsCache remembers upstream lookups for a fixed TTL; nil disables it.
+var dnsCache *hostCache
+
+// hostCache is a TTL cache of resolved addresses keyed by hostname.
+type hostCache struct {
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[string]hostCacheEntry
+}
+
+type hostCacheEntry struct {
+	addrs   []netip.Addr
+	expires time.Time
+}
+
+func newHostCache(ttl time.Duration) *hostCache {
+	return &hostCache{ttl: ttl, entries: make(map[string]hostCacheEntry)}
+}
+
+// lookup returns the addresses for host, resolving it on a miss.
+func (c *hostCache) lookup(ctx context.Context, host string) ([]netip.Addr, error) {
+	key := strings.ToLower(host)
+	now := time.Now()
+
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		dnsCacheHits.Add(1)
+		return entry.addrs, nil
+	}
+	dnsCacheMisses.Add(1)
+
+	resolver := upstreamDialer.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	addrs, err := resolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.entries[key] = hostCacheEntry{addrs: addrs, expires: now.Add(c.ttl)}
+	// Expired entries are swept on insert so the map can't grow without
+	// bound on workloads that touch many distinct hosts.
+	for k, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.mu.Unlock()
+	return addrs, nil
+}
+
+// lookupHost returns the addresses of host through the DNS cache if it is
+// enabled. IP literals are returned as they are.
+func lookupHost(ctx context.Context, host string) ([]netip.Addr, error) {
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{ip.Unmap()}, nil
+	}
+	if dnsCache != nil {
+		return dnsCache.lookup(ctx, host)
+	}
+	resolver := upstreamDialer.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	return resolver.LookupNetIP(ctx, "ip", host)
+}
+
+// dialCached resolves addr through dnsCache and dials the addresses in
+// order until one connects.
+func dialCached(ctx context.Context, dialer *net.Dialer, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		return dialer.DialContext(ctx, network, addr)
+	}
+
+	addrs, err := dnsCache.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	var firstErr error
+	for _, ip := range addrs {
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.Unmap().String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if firstErr == nil {
+		firstErr = fmt.Errorf("no addresses found for %s", host)
+	}
+	return nil, firstErr
+}
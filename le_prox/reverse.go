@@ -0,0 +1,196 @@
+package leprox
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// virtualHost sends reverse proxy requests whose Host matches one of Hosts
+// to Backends in round-robin order, skipping backends failing their health
+// check.
+type virtualHost struct {
+	Hosts          []string `json:"hosts"`
+	Backends       []string `json:"backends"`
+	HealthPath     string   `json:"health_path"`
+	HealthInterval string   `json:"health_interval"`
+
+	backends []*backend
+	interval time.Duration
+	next     atomic.Uint64
+}
+
+// backend is one origin server of a virtual host.
+type backend struct {
+	url     *url.URL
+	healthy atomic.Bool
+}
+
+func (v *virtualHost) compile() error {
+	if len(v.Hosts) == 0 || len(v.Backends) == 0 {
+		return fmt.Errorf("need at least one host and one backend")
+	}
+	for i, host := range v.Hosts {
+		v.Hosts[i] = strings.ToLower(host)
+	}
+	for _, raw := range v.Backends {
+		u, err := url.Parse(raw)
+		if err != nil {
+			return err
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid backend %q, want http://host[:port][/path]", raw)
+		}
+		b := &backend{url: u}
+		b.healthy.Store(true)
+		v.backends = append(v.backends, b)
+	}
+
+	v.interval = 10 * time.Second
+	if v.HealthInterval != "" {
+		d, err := time.ParseDuration(v.HealthInterval)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid health_interval %q", v.HealthInterval)
+		}
+		v.interval = d
+	}
+	if v.HealthPath != "" && !strings.HasPrefix(v.HealthPath, "/") {
+		return fmt.Errorf("health_path must start with /")
+	}
+	return nil
+}
+
+// pick returns the next healthy backend, or nil if all are down.
+func (v *virtualHost) pick() *backend {
+	n := uint64(len(v.backends))
+	start := v.next.Add(1)
+	for i := uint64(0); i < n; i++ {
+		if b := v.backends[(start+i)%n]; b.healthy.Load() {
+			return b
+		}
+	}
+	return nil
+}
+
+// virtualHostFor returns the virtual host serving host, or nil.
+func virtualHostFor(host string) *virtualHost {
+	for _, v := range currentConfig().VirtualHosts {
+		for _, pattern := range v.Hosts {
+			if matchHost(pattern, host) {
+				return v
+			}
+		}
+	}
+	return nil
+}
+
+// handleReverse serves the reverse proxy listener. The request is pointed
+// at a backend and then goes through the same path as forward proxy
+// requests, so rules, caching, recording and metrics all apply.
+func handleReverse(w http.ResponseWriter, r *http.Request) {
+	slog.Info("Received reverse request", "method", r.Method, "host", r.Host, "url", r.URL)
+
+	v := virtualHostFor(hostOnly(r.Host))
+	if v == nil {
+		http.Error(w, "No backend configured for "+r.Host, http.StatusNotFound)
+		return
+	}
+	b := v.pick()
+	if b == nil {
+		http.Error(w, "No healthy backend for "+r.Host, http.StatusBadGateway)
+		return
+	}
+
+	r.URL.Scheme = b.url.Scheme
+	r.URL.Host = b.url.Host
+	if b.url.Path != "" && b.url.Path != "/" {
+		r.URL.Path = strings.TrimSuffix(b.url.Path, "/") + r.URL.Path
+		r.URL.RawPath = ""
+	}
+	handleHTTP(w, r)
+}
+
+// stopHealthChecks cancels the checks started by restartHealthChecks.
+var stopHealthChecks context.CancelFunc
+
+// restartHealthChecks replaces the health checks of the old virtual hosts
+// with checks of vhosts after a config reload. Backends that were already
+// known keep their health state until they are checked again.
+func restartHealthChecks(old, vhosts []*virtualHost) {
+	healthy := make(map[string]bool)
+	for _, v := range old {
+		for _, b := range v.backends {
+			healthy[b.url.String()] = b.healthy.Load()
+		}
+	}
+	for _, v := range vhosts {
+		for _, b := range v.backends {
+			if h, ok := healthy[b.url.String()]; ok {
+				b.healthy.Store(h)
+			}
+		}
+	}
+
+	if stopHealthChecks != nil {
+		stopHealthChecks()
+	}
+	var ctx context.Context
+	ctx, stopHealthChecks = context.WithCancel(context.Background())
+	startHealthChecks(ctx, vhosts)
+}
+
+// startHealthChecks polls the health path of every backend that has one
+// until ctx is done.
+func startHealthChecks(ctx context.Context, vhosts []*virtualHost) {
+	for _, v := range vhosts {
+		if v.HealthPath == "" {
+			continue
+		}
+		for _, b := range v.backends {
+			go b.checkHealth(ctx, v.HealthPath, v.interval)
+		}
+	}
+}
+
+func (b *backend) checkHealth(ctx context.Context, path string, interval time.Duration) {
+	target := strings.TrimSuffix(b.url.String(), "/") + path
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		reqCtx, cancel := context.WithTimeout(ctx, min(interval, 5*time.Second))
+		healthy := false
+		req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, target, nil)
+		if err == nil {
+			var resp *http.Response
+			resp, err = upstreamTransport.RoundTrip(req)
+			if err == nil {
+				resp.Body.Close()
+				healthy = resp.StatusCode < 400
+				if !healthy {
+					err = fmt.Errorf("status %s", resp.Status)
+				}
+			}
+		}
+		cancel()
+
+		if was := b.healthy.Swap(healthy); was != healthy {
+			if healthy {
+				slog.Info("Backend is healthy again", "backend", b.url)
+			} else {
+				slog.Warn("Backend failed its health check", "backend", b.url, "err", err)
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package leprox
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// headerRule adds, replaces or removes headers on matching requests and on
+// their responses, e.g. to inject auth tokens or strip cookies.
+type headerRule struct {
+	Match    requestMatch  `json:"match"`
+	Request  headerActions `json:"request"`
+	Response headerActions `json:"response"`
+}
+
+// headerActions are applied in order: remove, then set, then add.
+type headerActions struct {
+	Remove []string          `json:"remove"`
+	Set    map[string]string `json:"set"`
+	Add    map[string]string `json:"add"`
+}
+
+func (r *headerRule) compile() error {
+	r.Match.Host = strings.ToLower(r.Match.Host)
+	for _, actions := range []headerActions{r.Request, r.Response} {
+		for _, name := range actions.Remove {
+			if name == "" {
+				return fmt.Errorf("empty header name in remove")
+			}
+		}
+	}
+	return nil
+}
+
+func (a *headerActions) apply(h http.Header) {
+	for _, name := range a.Remove {
+		h.Del(name)
+	}
+	for name, value := range a.Set {
+		h.Set(name, value)
+	}
+	for name, value := range a.Add {
+		h.Add(name, value)
+	}
+}
+
+// matchingHeaderRules returns the header rules that apply to r.
+func matchingHeaderRules(r *http.Request) []headerRule {
+	var rules []headerRule
+	for _, rule := range currentConfig().HeaderRules {
+		if rule.Match.matches(r.URL.Hostname(), r.URL.Path) {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// routeRule sends matching requests to a different destination, e.g. from
+// api.prod.example.com to api.staging.example.com. Empty fields keep the
+// original value. Path replaces the matched path prefix.
+type routeRule struct {
+	Match        requestMatch `json:"match"`
+	Scheme       string       `json:"scheme"`
+	Host         string       `json:"host"`
+	Path         string       `json:"path"`
+	PreserveHost bool         `json:"preserve_host"`
+}
+
+func (r *routeRule) compile() error {
+	r.Match.Host = strings.ToLower(r.Match.Host)
+	if r.Scheme != "" && r.Scheme != "http" && r.Scheme != "https" {
+		return fmt.Errorf("unsupported scheme %q", r.Scheme)
+	}
+	if r.Path != "" && r.Match.Path == "" {
+		return fmt.Errorf("path rewrite needs a match path prefix")
+	}
+	if r.Scheme == "" && r.Host == "" && r.Path == "" {
+		return fmt.Errorf("route changes nothing")
+	}
+	return nil
+}
+
+// applyRoutes rewrites the destination of r using the first matching route
+// and reports whether one matched.
+func applyRoutes(r *http.Request) bool {
+	for _, route := range currentConfig().Routes {
+		if !route.Match.matches(r.URL.Hostname(), r.URL.Path) {
+			continue
+		}
+
+		if route.Scheme != "" {
+			r.URL.Scheme = route.Scheme
+		}
+		if route.Host != "" {
+			r.URL.Host = route.Host
+			if !route.PreserveHost {
+				r.Host = route.Host
+			}
+		}
+		if route.Path != "" {
+			r.URL.Path = route.Path + strings.TrimPrefix(r.URL.Path, route.Match.Path)
+			r.URL.RawPath = ""
+		}
+		return true
+	}
+	return false
+}
+
+// routeTunnel returns the dial address for a CONNECT to addr. Only routes
+// without a path match apply, since tunnels carry no visible path.
+func routeTunnel(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	for _, route := range currentConfig().Routes {
+		if route.Match.Path != "" || route.Host == "" || !route.Match.matches(host, "") {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(route.Host); err == nil {
+			return route.Host
+		}
+		return net.JoinHostPort(route.Host, port)
+	}
+	return addr
+}
@@ -0,0 +1,125 @@
+package leprox
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// dotDialer returns a resolver Dial func speaking DNS over TLS (RFC 7858)
+// to addr, host[:port] with port 853 by default.
+func dotDialer(addr string) (func(ctx context.Context, network, address string) (net.Conn, error), error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "853")
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil || host == "" {
+		return nil, fmt.Errorf("invalid DNS over TLS server %q", addr)
+	}
+
+	// The resolver's own name is looked up with the system resolver.
+	d := &tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: 10 * time.Second},
+		Config:    &tls.Config{ServerName: host},
+	}
+	return func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return d.DialContext(ctx, "tcp", addr)
+	}, nil
+}
+
+// dohDialer returns a resolver Dial func sending queries to a DNS over
+// HTTPS (RFC 8484) endpoint.
+func dohDialer(endpoint string) (func(ctx context.Context, network, address string) (net.Conn, error), error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid DNS over HTTPS URL %q", endpoint)
+	}
+	if u.Path == "" {
+		u.Path = "/dns-query"
+	}
+	// Queries bypass the upstream transport, whose dials would need this
+	// resolver in the first place.
+	client := &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: &http.Transport{ForceAttemptHTTP2: true, MaxIdleConnsPerHost: 4},
+	}
+	return func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return &dohConn{ctx: ctx, url: u.String(), client: client}, nil
+	}, nil
+}
+
+// dohConn passes the Go resolver's messages to a DoH endpoint. It isn't a
+// PacketConn, so the resolver frames messages with a length prefix as on
+// TCP; each complete query is POSTed and its answer queued for reading.
+type dohConn struct {
+	ctx    context.Context
+	url    string
+	client *http.Client
+
+	deadline time.Time
+	in       bytes.Buffer
+	out      bytes.Buffer
+}
+
+func (c *dohConn) Write(p []byte) (int, error) {
+	c.in.Write(p)
+	for c.in.Len() >= 2 {
+		size := int(binary.BigEndian.Uint16(c.in.Bytes()))
+		if c.in.Len() < 2+size {
+			break
+		}
+		query := c.in.Next(2 + size)[2:]
+		answer, err := c.exchange(query)
+		if err != nil {
+			return 0, err
+		}
+		c.out.Write(binary.BigEndian.AppendUint16(nil, uint16(len(answer))))
+		c.out.Write(answer)
+	}
+	return len(p), nil
+}
+
+func (c *dohConn) exchange(query []byte) ([]byte, error) {
+	ctx := c.ctx
+	if !c.deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, c.deadline)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DNS over HTTPS server returned %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 65535))
+}
+
+func (c *dohConn) Read(p []byte) (int, error) {
+	if c.out.Len() == 0 {
+		return 0, io.EOF
+	}
+	return c.out.Read(p)
+}
+
+func (c *dohConn) Close() error                       { return nil }
+func (c *dohConn) LocalAddr() net.Addr                { return &net.TCPAddr{} }
+func (c *dohConn) RemoteAddr() net.Addr               { return &net.TCPAddr{} }
+func (c *dohConn) SetDeadline(t time.Time) error      { c.deadline = t; return nil }
+func (c *dohConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *dohConn) SetWriteDeadline(t time.Time) error { c.deadline = t; return nil }
@@ -0,0 +1,93 @@
+package leprox
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+)
+
+// shutdown stops accepting new connections and waits up to timeout for
+// in-flight requests and active tunnels to finish. Whatever is still open
+// after that is closed.
+func shutdown(servers []*http.Server, listeners []net.Listener, timeout time.Duration) {
+	slog.Info("Shutting down, draining active connections", "connections", activeConns.count(), "timeout", timeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	for _, ln := range listeners {
+		ln.Close()
+	}
+	// Shutdown closes the listener and waits for requests being handled,
+	// hijacked tunnels are tracked by activeConns instead.
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			slog.Warn("Timed out waiting for requests to finish", "err", err)
+		}
+	}
+
+	if !activeConns.waitIdle(ctx) {
+		n := activeConns.killAll()
+		slog.Warn("Drain timeout reached, closed the remaining connections", "connections", n)
+	} else {
+		slog.Info("All connections drained")
+	}
+
+	if tracer != nil {
+		flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := tracer.flush(flushCtx); err != nil {
+			slog.Warn("Failed to export spans", "err", err)
+		}
+		cancel()
+	}
+	if recorder != nil {
+		if err := recorder.save(); err != nil {
+			slog.Warn("Failed to write HAR file", "err", err)
+		}
+	}
+	if tap != nil {
+		if err := tap.Close(); err != nil {
+			slog.Warn("Failed to close pcap file", "err", err)
+		}
+	}
+}
+
+// count returns the number of active tunnels.
+func (r *connRegistry) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.conns)
+}
+
+// waitIdle waits until no tunnels are active, reporting false if ctx ends
+// first.
+func (r *connRegistry) waitIdle(ctx context.Context) bool {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for r.count() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
+}
+
+// killAll closes every active tunnel and returns how many there were.
+func (r *connRegistry) killAll() int {
+	r.mu.Lock()
+	ids := make([]uint64, 0, len(r.conns))
+	for id := range r.conns {
+		ids = append(ids, id)
+	}
+	r.mu.Unlock()
+
+	for _, id := range ids {
+		r.kill(id)
+	}
+	return len(ids)
+}
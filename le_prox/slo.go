@@ -0,0 +1,259 @@
+package leprox
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"gonet/pkg/stats"
+)
+
+// sloRule is an objective for the requests to matching destinations,
+// from the slos section of the config file. Each window of requests is
+// judged on its own: it meets the objective when its 99th percentile
+// latency and its error rate are within the targets.
+type sloRule struct {
+	Name  string       `json:"name"` // default the match
+	Match requestMatch `json:"match"`
+	// LatencyP99 is the most the 99th percentile of the time to the
+	// response headers may be, like "250ms".
+	LatencyP99 string `json:"latency_p99"`
+	// ErrorRate is the most percent of requests that may fail or be
+	// answered with a 5xx status.
+	ErrorRate *float64 `json:"error_rate"`
+	Window    string   `json:"window"` // default 1m
+	// MinRequests is how many requests a window needs to be judged,
+	// default 1.
+	MinRequests uint64 `json:"min_requests"`
+
+	p99    time.Duration
+	window time.Duration
+}
+
+func (s *sloRule) compile() error {
+	if s.LatencyP99 == "" && s.ErrorRate == nil {
+		return errors.New("need latency_p99 or error_rate")
+	}
+	if s.LatencyP99 != "" {
+		d, err := time.ParseDuration(s.LatencyP99)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid latency_p99 %q", s.LatencyP99)
+		}
+		s.p99 = d
+	}
+	if s.ErrorRate != nil && (*s.ErrorRate < 0 || *s.ErrorRate > 100) {
+		return fmt.Errorf("invalid error_rate %v, want 0 to 100 percent", *s.ErrorRate)
+	}
+	s.window = time.Minute
+	if s.Window != "" {
+		d, err := time.ParseDuration(s.Window)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid window %q", s.Window)
+		}
+		s.window = d
+	}
+	if s.MinRequests == 0 {
+		s.MinRequests = 1
+	}
+	if s.Name == "" {
+		s.Name = s.Match.Host + s.Match.Path
+		if s.Name == "" {
+			s.Name = "*"
+		}
+	}
+	return nil
+}
+
+// sloWindow is a window of requests and how it did.
+type sloWindow struct {
+	Start     time.Time     `json:"start"`
+	Requests  uint64        `json:"requests"`
+	Errors    uint64        `json:"errors"`
+	ErrorRate float64       `json:"error_percent"`
+	P99       time.Duration `json:"latency_p99_ns"`
+	Met       *bool         `json:"met,omitempty"` // once judged
+}
+
+// sloTracker judges the windows of an objective. Trackers are kept by
+// name across config reloads, so a changed target applies from the next
+// window on and the history stays.
+type sloTracker struct {
+	mu      sync.Mutex
+	rule    *sloRule
+	current sloWindow
+	latency *stats.Histogram
+
+	windows   uint64 // judged
+	violated  uint64
+	violating bool
+	last      *sloWindow
+}
+
+// sloTrackers are the trackers of the active objectives by name.
+var sloTrackers = struct {
+	sync.Mutex
+	byName map[string]*sloTracker
+}{byName: map[string]*sloTracker{}}
+
+// activateSLOs sets up the trackers of rules, dropping those of
+// objectives no longer configured.
+func activateSLOs(rules []*sloRule) {
+	sloTrackers.Lock()
+	defer sloTrackers.Unlock()
+	keep := make(map[string]*sloTracker, len(rules))
+	for _, rule := range rules {
+		t := sloTrackers.byName[rule.Name]
+		if t == nil {
+			t = &sloTracker{current: sloWindow{Start: time.Now()}, latency: &stats.Histogram{}}
+		}
+		t.mu.Lock()
+		t.rule = rule
+		t.mu.Unlock()
+		keep[rule.Name] = t
+	}
+	sloTrackers.byName = keep
+}
+
+// observeSLOs counts a request to the objectives it falls under: the
+// time to its response headers and whether it failed.
+func observeSLOs(r *http.Request, latency time.Duration, resp *http.Response, err error) {
+	rules := currentConfig().SLOs
+	if len(rules) == 0 {
+		return
+	}
+	failed := err != nil || resp.StatusCode >= 500
+	host := r.URL.Hostname()
+	var trackers []*sloTracker
+	sloTrackers.Lock()
+	for _, rule := range rules {
+		if t := sloTrackers.byName[rule.Name]; t != nil && rule.Match.matches(host, r.URL.Path) {
+			trackers = append(trackers, t)
+		}
+	}
+	sloTrackers.Unlock()
+	for _, t := range trackers {
+		t.observe(latency, failed)
+	}
+}
+
+func (t *sloTracker) observe(latency time.Duration, failed bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.roll(time.Now())
+	t.current.Requests++
+	if failed {
+		t.current.Errors++
+	}
+	t.latency.Record(latency)
+}
+
+// roll judges the window when it has ended by now, with t.mu held.
+func (t *sloTracker) roll(now time.Time) {
+	w := t.rule.window
+	if elapsed := now.Sub(t.current.Start); elapsed >= w {
+		t.judge()
+		// The windows of an idle spell in between had no requests.
+		t.current = sloWindow{Start: t.current.Start.Add(elapsed / w * w)}
+		t.latency = &stats.Histogram{}
+	}
+}
+
+// judge closes the current window, logging when the objective is
+// violated or met again.
+func (t *sloTracker) judge() {
+	c := &t.current
+	rule := t.rule
+	if c.Requests < rule.MinRequests {
+		return
+	}
+	c.P99 = t.latency.Quantile(0.99)
+	c.ErrorRate = float64(c.Errors) * 100 / float64(c.Requests)
+	latencyMet := rule.p99 == 0 || c.P99 <= rule.p99
+	errorsMet := rule.ErrorRate == nil || c.ErrorRate <= *rule.ErrorRate
+	met := latencyMet && errorsMet
+	c.Met = &met
+	t.windows++
+	last := *c
+	t.last = &last
+	if !met {
+		t.violated++
+		sloViolations.Add(1)
+		args := []any{"slo", rule.Name, "window", rule.window, "requests", c.Requests, "latency_p99", c.P99, "error_percent", c.ErrorRate}
+		if !latencyMet {
+			args = append(args, "latency_p99_target", rule.p99)
+		}
+		if !errorsMet {
+			args = append(args, "error_percent_target", *rule.ErrorRate)
+		}
+		slog.Warn("SLO violated", args...)
+	} else if t.violating {
+		slog.Info("SLO met again", "slo", rule.Name, "requests", c.Requests, "latency_p99", c.P99, "error_percent", c.ErrorRate)
+	}
+	t.violating = !met
+}
+
+// sloStatus is what the slos metric shows of an objective.
+type sloStatus struct {
+	LatencyP99 time.Duration `json:"latency_p99_target_ns,omitempty"`
+	ErrorRate  *float64      `json:"error_percent_target,omitempty"`
+	Window     time.Duration `json:"window_ns"`
+
+	Windows    uint64     `json:"windows"` // judged
+	Violated   uint64     `json:"violated_windows"`
+	Compliance float64    `json:"compliance_percent"`
+	Violating  bool       `json:"violating"` // the last window missed
+	Last       *sloWindow `json:"last,omitempty"`
+	Current    sloWindow  `json:"current"`
+}
+
+// sloStatuses returns the status of every objective by name.
+func sloStatuses() map[string]sloStatus {
+	sloTrackers.Lock()
+	defer sloTrackers.Unlock()
+	now := time.Now()
+	statuses := make(map[string]sloStatus, len(sloTrackers.byName))
+	for name, t := range sloTrackers.byName {
+		t.mu.Lock()
+		t.roll(now)
+		s := sloStatus{
+			LatencyP99: t.rule.p99,
+			ErrorRate:  t.rule.ErrorRate,
+			Window:     t.rule.window,
+			Windows:    t.windows,
+			Violated:   t.violated,
+			Compliance: 100,
+			Violating:  t.violating,
+			Last:       t.last,
+			Current:    t.current,
+		}
+		if t.windows > 0 {
+			s.Compliance = float64(t.windows-t.violated) * 100 / float64(t.windows)
+		}
+		if s.Current.Requests > 0 {
+			s.Current.P99 = t.latency.Quantile(0.99)
+			s.Current.ErrorRate = float64(s.Current.Errors) * 100 / float64(s.Current.Requests)
+		}
+		t.mu.Unlock()
+		statuses[name] = s
+	}
+	return statuses
+}
+
+// judgeSLOs closes the windows of the objectives as they end, so
+// violations are logged without waiting for the next request.
+func judgeSLOs(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		sloTrackers.Lock()
+		for _, t := range sloTrackers.byName {
+			t.mu.Lock()
+			t.roll(now)
+			t.mu.Unlock()
+		}
+		sloTrackers.Unlock()
+	}
+}
@@ -0,0 +1,235 @@
+package leprox
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// errNotTLS is returned by peekSNI when the stream does not start with a
+// TLS handshake record.
+var errNotTLS = errors.New("not a TLS ClientHello")
+
+// peekSNI returns the server name from the TLS ClientHello at the start of
+// br without consuming any bytes. br must be able to buffer a full TLS
+// record (16KiB plus header).
+func peekSNI(br *bufio.Reader) (string, error) {
+	header, err := br.Peek(5)
+	if err != nil {
+		return "", err
+	}
+	if header[0] != 0x16 || header[1] != 0x03 {
+		return "", errNotTLS
+	}
+	recordLen := int(binary.BigEndian.Uint16(header[3:5]))
+
+	record, err := br.Peek(5 + recordLen)
+	if err != nil {
+		return "", err
+	}
+	return clientHelloServerName(record[5:])
+}
+
+// clientHelloServerName extracts the server_name extension from a
+// handshake message holding a ClientHello. It returns "" without an error
+// if the client sent no SNI.
+func clientHelloServerName(msg []byte) (string, error) {
+	errMalformed := errors.New("malformed ClientHello")
+
+	if len(msg) < 4 || msg[0] != 0x01 {
+		return "", errNotTLS
+	}
+	body := msg[4:]
+	if n := int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3]); n < len(body) {
+		body = body[:n]
+	}
+
+	// client_version and random
+	if len(body) < 34 {
+		return "", errMalformed
+	}
+	body = body[34:]
+
+	// session_id, cipher_suites and compression_methods
+	for _, lenBytes := range []int{1, 2, 1} {
+		if len(body) < lenBytes {
+			return "", errMalformed
+		}
+		n := int(body[0])
+		if lenBytes == 2 {
+			n = int(binary.BigEndian.Uint16(body))
+		}
+		if len(body) < lenBytes+n {
+			return "", errMalformed
+		}
+		body = body[lenBytes+n:]
+	}
+
+	if len(body) < 2 {
+		return "", nil // no extensions
+	}
+	extensions := body[2:]
+	if n := int(binary.BigEndian.Uint16(body)); n < len(extensions) {
+		extensions = extensions[:n]
+	}
+
+	for len(extensions) >= 4 {
+		extType := binary.BigEndian.Uint16(extensions)
+		extLen := int(binary.BigEndian.Uint16(extensions[2:]))
+		if len(extensions) < 4+extLen {
+			return "", errMalformed
+		}
+		data := extensions[4 : 4+extLen]
+		extensions = extensions[4+extLen:]
+		if extType != 0x0000 {
+			continue
+		}
+
+		// server_name_list
+		if len(data) < 2 {
+			return "", errMalformed
+		}
+		list := data[2:]
+		for len(list) >= 3 {
+			nameType := list[0]
+			nameLen := int(binary.BigEndian.Uint16(list[1:]))
+			if len(list) < 3+nameLen {
+				return "", errMalformed
+			}
+			if nameType == 0 {
+				return string(list[3 : 3+nameLen]), nil
+			}
+			list = list[3+nameLen:]
+		}
+	}
+	return "", nil
+}
+
+// sniInspection reports whether CONNECT tunnels are inspected for SNI.
+func sniInspection() bool {
+	policy := currentConfig().access
+	return len(policy.sniAllow) > 0 || len(policy.sniDeny) > 0
+}
+
+// sniAllowed applies the SNI allow and deny lists to host.
+func sniAllowed(host string) bool {
+	policy := currentConfig().access
+	for _, pattern := range policy.sniDeny {
+		if matchHost(pattern, host) {
+			return false
+		}
+	}
+	if len(policy.sniAllow) == 0 {
+		return true
+	}
+	for _, pattern := range policy.sniAllow {
+		if matchHost(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleInspectedTunnel accepts a CONNECT tunnel and hands it to
+// inspectTunnel.
+func handleInspectedTunnel(w http.ResponseWriter, r *http.Request, target string) {
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	clientConn, wait, err := acceptTunnel(w, r)
+	if err != nil {
+		slog.Warn("Failed to accept tunnel", "target", target, "err", err)
+		return
+	}
+	defer wait()
+	inspectTunnel(withClientAddr(r.Context(), r.RemoteAddr), "connect", r.RemoteAddr, clientConn, target)
+}
+
+// Reasons tunnelTarget refuses a tunnel.
+var (
+	errSNIBlocked  = errors.New("blocked by SNI policy")
+	errSNIMismatch = errors.New("SNI does not match the requested host")
+)
+
+// tunnelTarget applies the SNI policy to a tunnel requested for target
+// whose ClientHello named sni, and returns where to dial. A requested
+// hostname and the SNI must both be allowed and must name the same host,
+// otherwise a client could tunnel to a blocked host while presenting an
+// allowed name. When the client requested an IP address, the SNI
+// hostname is dialed instead so host based rules apply.
+func tunnelTarget(target, sni string) (string, error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return "", err
+	}
+	isIP := net.ParseIP(host) != nil
+	if (!isIP || sni == "") && !sniAllowed(host) {
+		return "", errSNIBlocked
+	}
+	if sni == "" {
+		return target, nil
+	}
+	if !sniAllowed(sni) {
+		return "", errSNIBlocked
+	}
+	if isIP {
+		return net.JoinHostPort(sni, port), nil
+	}
+	if !strings.EqualFold(strings.TrimSuffix(host, "."), strings.TrimSuffix(sni, ".")) {
+		return "", errSNIMismatch
+	}
+	return target, nil
+}
+
+// inspectTunnel reads the ClientHello from an accepted tunnel and only
+// then decides whether and where to dial, see tunnelTarget. Non-TLS and
+// SNI-less tunnels are checked against the requested host alone.
+func inspectTunnel(ctx context.Context, kind, client string, clientConn net.Conn, target string) {
+	br := bufio.NewReaderSize(clientConn, 16*1024+5)
+	clientConn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	sni, err := peekSNI(br)
+	clientConn.SetReadDeadline(time.Time{})
+	if err != nil && err != errNotTLS {
+		slog.Warn("Failed to read ClientHello", "target", target, "err", err)
+		clientConn.Close()
+		return
+	}
+
+	requested := target
+	target, err = tunnelTarget(requested, sni)
+	if err != nil {
+		sniBlocked.Add(1)
+		slog.Warn("Blocked tunnel", "client", client, "target", requested, "sni", sni, "err", err)
+		clientConn.Close()
+		return
+	}
+
+	if routed := routeTunnel(target); routed != target {
+		slog.Info("Routed tunnel", "host", target, "to", routed)
+		target = routed
+	}
+
+	destConn, err := dialUpstream(ctx, "tcp", target)
+	if err != nil {
+		tunnelErrors.Add(1)
+		slog.Warn("Tunnel dial failed", "target", target, "err", err)
+		clientConn.Close()
+		return
+	}
+
+	upstream := &countingConn{ReadWriteCloser: destConn, flow: traffic.openFlow(client, hostOnly(target), true)}
+	clientIn := struct {
+		io.Reader
+		io.Closer
+	}{br, clientConn}
+	relay(kind, client, target, clientIn, clientConn, upstream)
+}
@@ -0,0 +1,51 @@
+package leprox
+
+import "testing"
+
+// useAccessPolicy makes policy the active access policy for the rest of
+// the test.
+func useAccessPolicy(t *testing.T, policy *accessPolicy) {
+	t.Helper()
+	prev := activeConfig.Load()
+	activeConfig.Store(&proxyConfig{access: policy})
+	t.Cleanup(func() { activeConfig.Store(prev) })
+}
+
+func TestTunnelTarget(t *testing.T) {
+	useAccessPolicy(t, &accessPolicy{
+		sniAllow: []string{"allowed.example", "*.allowed.example"},
+		sniDeny:  []string{"blocked.allowed.example"},
+	})
+
+	tests := []struct {
+		name    string
+		target  string
+		sni     string
+		want    string
+		wantErr error
+	}{
+		{name: "allowed host and SNI", target: "allowed.example:443", sni: "allowed.example", want: "allowed.example:443"},
+		{name: "SNI differs in case", target: "Allowed.Example:443", sni: "allowed.example.", want: "Allowed.Example:443"},
+		{name: "allowed host without SNI", target: "allowed.example:443", want: "allowed.example:443"},
+		{name: "denied SNI", target: "blocked.allowed.example:443", sni: "blocked.allowed.example", wantErr: errSNIBlocked},
+		{name: "denied host behind allowed SNI", target: "blocked.allowed.example:443", sni: "allowed.example", wantErr: errSNIBlocked},
+		{name: "host outside allow list behind allowed SNI", target: "other.example:443", sni: "allowed.example", wantErr: errSNIBlocked},
+		{name: "allowed host with denied SNI", target: "allowed.example:443", sni: "blocked.allowed.example", wantErr: errSNIBlocked},
+		{name: "mismatched allowed names", target: "www.allowed.example:443", sni: "allowed.example", wantErr: errSNIMismatch},
+		{name: "IP literal rewritten to SNI", target: "192.0.2.1:8443", sni: "www.allowed.example", want: "www.allowed.example:8443"},
+		{name: "IPv6 literal rewritten to SNI", target: "[2001:db8::1]:443", sni: "allowed.example", want: "allowed.example:443"},
+		{name: "IP literal with denied SNI", target: "192.0.2.1:443", sni: "blocked.allowed.example", wantErr: errSNIBlocked},
+		{name: "IP literal without SNI", target: "192.0.2.1:443", wantErr: errSNIBlocked},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tunnelTarget(tt.target, tt.sni)
+			if err != tt.wantErr {
+				t.Fatalf("tunnelTarget(%q, %q) error = %v, want %v", tt.target, tt.sni, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("tunnelTarget(%q, %q) = %q, want %q", tt.target, tt.sni, got, tt.want)
+			}
+		})
+	}
+}
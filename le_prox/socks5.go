@@ -0,0 +1,260 @@
+package leprox
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// SOCKS5 protocol constants (RFC 1928 and RFC 1929).
+const (
+	socks5Version = 0x05
+
+	socks5AuthNone     = 0x00
+	socks5AuthPassword = 0x02
+	socks5AuthNoAccept = 0xff
+
+	socks5CmdConnect = 0x01
+
+	socks5AddrIPv4   = 0x01
+	socks5AddrDomain = 0x03
+	socks5AddrIPv6   = 0x04
+)
+
+// socks5Replies maps SOCKS5 reply codes to readable errors.
+var socks5Replies = map[byte]string{
+	0x01: "general SOCKS server failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+// socks5Dialer opens TCP connections through a SOCKS5 upstream such as an
+// SSH -D tunnel or Tor.
+type socks5Dialer struct {
+	addr     string
+	username string
+	password string
+}
+
+// parseSOCKS5 accepts either host:port or socks5://[user:pass@]host:port.
+func parseSOCKS5(s string) (*socks5Dialer, error) {
+	if _, _, err := net.SplitHostPort(s); err == nil {
+		return &socks5Dialer{addr: s}, nil
+	}
+
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "socks5" && u.Scheme != "socks5h" {
+		return nil, fmt.Errorf("unsupported upstream scheme %q", u.Scheme)
+	}
+	if u.Port() == "" {
+		return nil, fmt.Errorf("missing port in SOCKS5 upstream %q", s)
+	}
+
+	d := &socks5Dialer{addr: u.Host}
+	if u.User != nil {
+		d.username = u.User.Username()
+		d.password, _ = u.User.Password()
+	}
+	return d, nil
+}
+
+func (d *socks5Dialer) String() string {
+	return "socks5://" + d.addr
+}
+
+// DialContext connects to addr through the SOCKS5 upstream. Hostnames are
+// passed through unresolved so the upstream performs the DNS lookup.
+func (d *socks5Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, fmt.Errorf("socks5: unsupported network %q", network)
+	}
+
+	host, _, _ := net.SplitHostPort(d.addr)
+	conn, err := dialerFor(host).DialContext(ctx, "tcp", d.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else {
+		conn.SetDeadline(time.Now().Add(30 * time.Second))
+	}
+
+	if err := d.handshake(conn, addr); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("socks5 %s: %w", d.addr, err)
+	}
+
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// handshake negotiates authentication and issues the CONNECT command.
+func (d *socks5Dialer) handshake(conn net.Conn, addr string) error {
+	methods := []byte{socks5AuthNone}
+	if d.username != "" {
+		methods = append(methods, socks5AuthPassword)
+	}
+	greeting := append([]byte{socks5Version, byte(len(methods))}, methods...)
+	if _, err := conn.Write(greeting); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != socks5Version {
+		return fmt.Errorf("unexpected protocol version %d", reply[0])
+	}
+
+	switch reply[1] {
+	case socks5AuthNone:
+	case socks5AuthPassword:
+		if err := d.authenticate(conn); err != nil {
+			return err
+		}
+	case socks5AuthNoAccept:
+		return errors.New("no acceptable authentication methods")
+	default:
+		return fmt.Errorf("unsupported authentication method %d", reply[1])
+	}
+
+	req, err := socks5Request(socks5CmdConnect, addr)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	_, err = readSOCKS5Reply(conn)
+	return err
+}
+
+// authenticate performs username/password authentication (RFC 1929).
+func (d *socks5Dialer) authenticate(conn net.Conn) error {
+	if len(d.username) > 255 || len(d.password) > 255 {
+		return errors.New("username or password too long")
+	}
+	req := []byte{0x01, byte(len(d.username))}
+	req = append(req, d.username...)
+	req = append(req, byte(len(d.password)))
+	req = append(req, d.password...)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[1] != 0x00 {
+		return errors.New("authentication failed")
+	}
+	return nil
+}
+
+// socks5Request builds a request for cmd targeting addr.
+func socks5Request(cmd byte, addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", portStr)
+	}
+
+	req, err := appendSOCKS5Addr([]byte{socks5Version, cmd, 0x00}, host)
+	if err != nil {
+		return nil, err
+	}
+	return binary.BigEndian.AppendUint16(req, uint16(port)), nil
+}
+
+// appendSOCKS5Addr appends the SOCKS5 encoding of host to b. Domain names
+// are length prefixed with a single byte, so longer ones are an error.
+func appendSOCKS5Addr(b []byte, host string) ([]byte, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			return append(append(b, socks5AddrIPv4), ip4...), nil
+		}
+		return append(append(b, socks5AddrIPv6), ip.To16()...), nil
+	}
+	if len(host) > 255 {
+		return nil, fmt.Errorf("host name of %d bytes is too long for SOCKS5", len(host))
+	}
+	b = append(b, socks5AddrDomain, byte(len(host)))
+	return append(b, host...), nil
+}
+
+// readSOCKS5Reply reads a command reply and returns the bound address.
+func readSOCKS5Reply(r io.Reader) (string, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", err
+	}
+	if header[0] != socks5Version {
+		return "", fmt.Errorf("unexpected protocol version %d", header[0])
+	}
+	if header[1] != 0x00 {
+		if msg, ok := socks5Replies[header[1]]; ok {
+			return "", errors.New(msg)
+		}
+		return "", fmt.Errorf("request failed with code %d", header[1])
+	}
+
+	host, err := readSOCKS5Addr(r, header[3])
+	if err != nil {
+		return "", err
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// readSOCKS5Addr reads an address of the given type from r.
+func readSOCKS5Addr(r io.Reader, atyp byte) (string, error) {
+	switch atyp {
+	case socks5AddrIPv4, socks5AddrIPv6:
+		size := net.IPv4len
+		if atyp == socks5AddrIPv6 {
+			size = net.IPv6len
+		}
+		ip := make(net.IP, size)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		return ip.String(), nil
+	case socks5AddrDomain:
+		n := make([]byte, 1)
+		if _, err := io.ReadFull(r, n); err != nil {
+			return "", err
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", err
+		}
+		return string(name), nil
+	default:
+		return "", fmt.Errorf("unknown address type %d", atyp)
+	}
+}
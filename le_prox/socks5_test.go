@@ -0,0 +1,35 @@
+package leprox
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestSOCKS5Request(t *testing.T) {
+	tests := []struct {
+		name    string
+		addr    string
+		want    []byte
+		wantErr bool
+	}{
+		{name: "IPv4", addr: "192.0.2.1:80", want: []byte{5, 1, 0, socks5AddrIPv4, 192, 0, 2, 1, 0, 80}},
+		{name: "IPv6", addr: "[2001:db8::1]:443", want: append(append([]byte{5, 1, 0, socks5AddrIPv6}, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1), 1, 187)},
+		{name: "domain", addr: "example.com:443", want: append(append([]byte{5, 1, 0, socks5AddrDomain, 11}, "example.com"...), 1, 187)},
+		{name: "longest domain", addr: strings.Repeat("a", 255) + ":1", want: append(append([]byte{5, 1, 0, socks5AddrDomain, 255}, strings.Repeat("a", 255)...), 0, 1)},
+		{name: "domain too long", addr: strings.Repeat("a", 256) + ":1", wantErr: true},
+		{name: "bad port", addr: "example.com:http", wantErr: true},
+		{name: "missing port", addr: "example.com", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := socks5Request(0x01, tt.addr)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("socks5Request(%q) error = %v, want error %v", tt.addr, err, tt.wantErr)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("socks5Request(%q) = %v, want %v", tt.addr, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,439 @@
+package leprox
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	socks5CmdUDPAssociate = 0x03
+
+	socks5ReplySucceeded      = 0x00
+	socks5ReplyFailure        = 0x01
+	socks5ReplyNotAllowed     = 0x02
+	socks5ReplyHostUnreach    = 0x04
+	socks5ReplyCmdUnsupported = 0x07
+)
+
+// serveSOCKS5 accepts SOCKS5 clients on ln. CONNECT goes through the same
+// upstream dialing as HTTP tunnels, UDP ASSOCIATE relays datagrams
+// directly from this host. Both are held to the tunnel policy.
+func serveSOCKS5(ln net.Listener) {
+	slog.Info("Starting SOCKS5 server", "addr", ln.Addr())
+	for {
+		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			slog.Warn("SOCKS5 accept failed", "err", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go handleSOCKS5(conn)
+	}
+}
+
+// handleSOCKS5 negotiates a session without authentication and runs the
+// requested command.
+func handleSOCKS5(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	cmd, target, err := readSOCKS5Request(conn)
+	if err != nil {
+		slog.Warn("SOCKS5 handshake failed", "client", conn.RemoteAddr(), "err", err)
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	switch cmd {
+	case socks5CmdConnect:
+		socks5Connect(conn, target)
+	case socks5CmdUDPAssociate:
+		socks5Associate(conn, target)
+	default:
+		writeSOCKS5Reply(conn, socks5ReplyCmdUnsupported, nil)
+		conn.Close()
+	}
+}
+
+// readSOCKS5Request reads the greeting and the command request.
+func readSOCKS5Request(conn net.Conn) (byte, string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return 0, "", err
+	}
+	if header[0] != socks5Version {
+		return 0, "", errors.New("not a SOCKS5 client")
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return 0, "", err
+	}
+	if bytes.IndexByte(methods, socks5AuthNone) < 0 {
+		conn.Write([]byte{socks5Version, socks5AuthNoAccept})
+		return 0, "", errors.New("client requires authentication")
+	}
+	if _, err := conn.Write([]byte{socks5Version, socks5AuthNone}); err != nil {
+		return 0, "", err
+	}
+
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(conn, req); err != nil {
+		return 0, "", err
+	}
+	if req[0] != socks5Version {
+		return 0, "", errors.New("bad request version")
+	}
+	host, err := readSOCKS5Addr(conn, req[3])
+	if err != nil {
+		return 0, "", err
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return 0, "", err
+	}
+	return req[1], net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// writeSOCKS5Reply answers a request, naming bound as the server side
+// address.
+func writeSOCKS5Reply(w io.Writer, code byte, bound net.Addr) error {
+	host, port := "0.0.0.0", 0
+	if bound != nil {
+		if ap, err := netip.ParseAddrPort(bound.String()); err == nil {
+			host, port = ap.Addr().Unmap().String(), int(ap.Port())
+		}
+	}
+	reply, err := appendSOCKS5Addr([]byte{socks5Version, code, 0x00}, host)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(binary.BigEndian.AppendUint16(reply, uint16(port)))
+	return err
+}
+
+// socks5Connect opens a TCP tunnel to target, under the same policy as
+// HTTP CONNECT tunnels: rate limits, allowed ports, MITM and SNI
+// filtering.
+func socks5Connect(conn net.Conn, target string) {
+	client := conn.RemoteAddr().String()
+	if ok, _, what := takeRateLimits(client, hostOnly(target)); !ok {
+		slog.Warn("Denied SOCKS5 CONNECT, rate limit exceeded", "client", client, "target", target, "limit", what)
+		writeSOCKS5Reply(conn, socks5ReplyNotAllowed, nil)
+		conn.Close()
+		return
+	}
+	if !currentConfig().access.connectPorts.allows(target) {
+		connectDenied.Add(1)
+		slog.Warn("Denied SOCKS5 CONNECT, port not allowed", "client", client, "target", target)
+		writeSOCKS5Reply(conn, socks5ReplyNotAllowed, nil)
+		conn.Close()
+		return
+	}
+
+	// Intercepted and inspected tunnels are accepted before dialing, the
+	// client's first bytes decide where they go.
+	if hostname, _, err := net.SplitHostPort(target); err == nil && shouldIntercept(hostname) {
+		if !sniAllowed(hostname) {
+			sniBlocked.Add(1)
+			slog.Warn("Blocked tunnel", "client", client, "target", target)
+			writeSOCKS5Reply(conn, socks5ReplyNotAllowed, nil)
+			conn.Close()
+			return
+		}
+		if writeSOCKS5Reply(conn, socks5ReplySucceeded, nil) == nil {
+			interceptTunnel(client, conn, target)
+		}
+		conn.Close()
+		return
+	}
+	if sniInspection() {
+		if writeSOCKS5Reply(conn, socks5ReplySucceeded, nil) != nil {
+			conn.Close()
+			return
+		}
+		inspectTunnel(withClientAddr(context.Background(), client), "socks5", client, conn, target)
+		return
+	}
+
+	if routed := routeTunnel(target); routed != target {
+		slog.Info("Routed tunnel", "host", target, "to", routed)
+		target = routed
+	}
+
+	slog.Info("SOCKS5 CONNECT", "client", client, "target", target)
+	destConn, err := dialUpstream(withClientAddr(context.Background(), client), "tcp", target)
+	if err != nil {
+		tunnelErrors.Add(1)
+		slog.Warn("SOCKS5 dial failed", "target", target, "err", err)
+		writeSOCKS5Reply(conn, socks5ReplyHostUnreach, nil)
+		conn.Close()
+		return
+	}
+	if err := writeSOCKS5Reply(conn, socks5ReplySucceeded, destConn.LocalAddr()); err != nil {
+		destConn.Close()
+		conn.Close()
+		return
+	}
+
+	upstream := &countingConn{ReadWriteCloser: destConn, flow: traffic.openFlow(client, hostOnly(target), true)}
+	relay("socks5", client, target, conn, conn, upstream)
+}
+
+// errDatagramDenied drops the datagrams to a destination the policy
+// already refused for the association.
+var errDatagramDenied = errors.New("destination denied")
+
+// allowDatagram applies the tunnel policy to a datagram destination:
+// allowed ports, and the SNI lists on the destination host since there
+// is no ClientHello to read.
+func allowDatagram(target string) error {
+	if !currentConfig().access.connectPorts.allows(target) {
+		connectDenied.Add(1)
+		return errors.New("port not allowed")
+	}
+	if sniInspection() && !sniAllowed(hostOnly(target)) {
+		sniBlocked.Add(1)
+		return errors.New("host not allowed")
+	}
+	return nil
+}
+
+// udpAssociation relays datagrams between one SOCKS5 client and any
+// number of destinations. It lives as long as the client's TCP control
+// connection.
+type udpAssociation struct {
+	control net.Conn
+	relay   *net.UDPConn // faces the client
+	out     *net.UDPConn // faces destinations
+	flow    *flow
+
+	mu       sync.Mutex
+	client   *net.UDPAddr            // learned from the first datagram
+	sentTo   map[netip.AddrPort]bool // only these may answer
+	resolved map[string]netip.AddrPort
+	denied   map[string]bool // destinations the policy refused
+}
+
+// socks5Associate sets up a UDP relay. expected is the address the
+// client said it will send from, usually all zeros when it doesn't know.
+func socks5Associate(conn net.Conn, expected string) {
+	clientAddr := conn.RemoteAddr().String()
+	if ok, _, what := takeRateLimits(clientAddr, ""); !ok {
+		slog.Warn("Denied SOCKS5 UDP ASSOCIATE, rate limit exceeded", "client", clientAddr, "limit", what)
+		writeSOCKS5Reply(conn, socks5ReplyNotAllowed, nil)
+		conn.Close()
+		return
+	}
+	localIP := net.IP(nil)
+	if tcp, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		localIP = tcp.IP
+	}
+	relayConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIP})
+	if err != nil {
+		slog.Warn("SOCKS5 UDP relay failed", "client", clientAddr, "err", err)
+		writeSOCKS5Reply(conn, socks5ReplyFailure, nil)
+		conn.Close()
+		return
+	}
+	out, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		slog.Warn("SOCKS5 UDP relay failed", "client", clientAddr, "err", err)
+		relayConn.Close()
+		writeSOCKS5Reply(conn, socks5ReplyFailure, nil)
+		conn.Close()
+		return
+	}
+	if err := writeSOCKS5Reply(conn, socks5ReplySucceeded, relayConn.LocalAddr()); err != nil {
+		relayConn.Close()
+		out.Close()
+		conn.Close()
+		return
+	}
+
+	a := &udpAssociation{
+		control:  conn,
+		relay:    relayConn,
+		out:      out,
+		flow:     traffic.openFlow(clientAddr, "udp", true),
+		sentTo:   make(map[netip.AddrPort]bool),
+		resolved: make(map[string]netip.AddrPort),
+		denied:   make(map[string]bool),
+	}
+	// A client that names its source port is held to it; the IP is always
+	// the one of the control connection.
+	if ap, err := netip.ParseAddrPort(expected); err == nil && ap.Port() != 0 {
+		if host, err := netip.ParseAddrPort(clientAddr); err == nil {
+			a.client = net.UDPAddrFromAddrPort(netip.AddrPortFrom(host.Addr().Unmap(), ap.Port()))
+		}
+	}
+
+	c := activeConns.add("socks5-udp", clientAddr, relayConn.LocalAddr().String(), a.flow, conn, relayConn, out)
+	slog.Info("SOCKS5 UDP ASSOCIATE", "client", clientAddr, "relay", relayConn.LocalAddr())
+
+	go a.fromClient()
+	go a.fromDestinations()
+
+	// The association ends when the client closes the control connection.
+	io.Copy(io.Discard, conn)
+	conn.Close()
+	relayConn.Close()
+	out.Close()
+	activeConns.remove(c)
+	slog.Info("SOCKS5 UDP association closed", "client", clientAddr, "bytes_up", a.flow.up.Load(), "bytes_down", a.flow.down.Load())
+}
+
+// fromClient unwraps client datagrams and sends them on to their
+// destination.
+func (a *udpAssociation) fromClient() {
+	clientIP, _ := netip.ParseAddrPort(a.control.RemoteAddr().String())
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := a.relay.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			return
+		}
+		from = netip.AddrPortFrom(from.Addr().Unmap(), from.Port())
+		if from.Addr() != clientIP.Addr().Unmap() {
+			continue
+		}
+		a.mu.Lock()
+		if a.client == nil {
+			a.client = net.UDPAddrFromAddrPort(from)
+		}
+		ok := a.client.AddrPort() == from
+		a.mu.Unlock()
+		if !ok {
+			continue
+		}
+
+		target, payload, err := parseSOCKS5Datagram(buf[:n])
+		if err != nil {
+			continue
+		}
+		dst, err := a.resolve(target)
+		if err == errDatagramDenied {
+			continue
+		}
+		if err != nil {
+			slog.Warn("SOCKS5 UDP datagram dropped", "client", from, "target", target, "err", err)
+			continue
+		}
+		a.mu.Lock()
+		a.sentTo[dst] = true
+		a.mu.Unlock()
+		if _, err := a.out.WriteToUDPAddrPort(payload, dst); err == nil {
+			a.flow.addUp(int64(len(payload)))
+		}
+	}
+}
+
+// fromDestinations wraps datagrams from destinations the client has sent
+// to and passes them back to the client.
+func (a *udpAssociation) fromDestinations() {
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := a.out.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			return
+		}
+		from = netip.AddrPortFrom(from.Addr().Unmap(), from.Port())
+		a.mu.Lock()
+		client, known := a.client, a.sentTo[from]
+		a.mu.Unlock()
+		if client == nil || !known {
+			continue
+		}
+
+		datagram, err := appendSOCKS5Addr([]byte{0x00, 0x00, 0x00}, from.Addr().String())
+		if err != nil {
+			continue
+		}
+		datagram = binary.BigEndian.AppendUint16(datagram, from.Port())
+		datagram = append(datagram, buf[:n]...)
+		if _, err := a.relay.WriteToUDP(datagram, client); err == nil {
+			a.flow.addDown(int64(n))
+		}
+	}
+}
+
+// resolve looks up the destination of a datagram, honoring host overrides
+// and the DNS cache, once the policy allows it. Results and refusals are
+// kept for the association's lifetime, rate limits apply to each new
+// destination.
+func (a *udpAssociation) resolve(target string) (netip.AddrPort, error) {
+	a.mu.Lock()
+	dst, ok := a.resolved[target]
+	denied := a.denied[target]
+	a.mu.Unlock()
+	if ok {
+		return dst, nil
+	}
+	if denied {
+		return netip.AddrPort{}, errDatagramDenied
+	}
+	if err := allowDatagram(target); err != nil {
+		a.mu.Lock()
+		a.denied[target] = true
+		a.mu.Unlock()
+		return netip.AddrPort{}, err
+	}
+	if ok, _, what := takeRateLimits(a.control.RemoteAddr().String(), hostOnly(target)); !ok {
+		return netip.AddrPort{}, errors.New("rate limit exceeded for " + what)
+	}
+
+	host, portStr, err := net.SplitHostPort(overrideAddrs(target)[0])
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addrs, err := lookupHost(ctx, host)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	if len(addrs) == 0 {
+		return netip.AddrPort{}, errors.New("no addresses for " + host)
+	}
+	dst = netip.AddrPortFrom(addrs[0].Unmap(), uint16(port))
+
+	a.mu.Lock()
+	a.resolved[target] = dst
+	a.mu.Unlock()
+	return dst, nil
+}
+
+// parseSOCKS5Datagram splits a UDP request into its destination and data.
+// Fragmented datagrams are rejected, as RFC 1928 allows.
+func parseSOCKS5Datagram(b []byte) (string, []byte, error) {
+	if len(b) < 4 {
+		return "", nil, errors.New("short datagram")
+	}
+	if b[2] != 0 {
+		return "", nil, errors.New("fragmented datagram")
+	}
+	r := bytes.NewReader(b[4:])
+	host, err := readSOCKS5Addr(r, b[3])
+	if err != nil {
+		return "", nil, err
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", nil, err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), b[len(b)-r.Len():], nil
+}
@@ -0,0 +1,73 @@
+package leprox
+
+import (
+	"log/slog"
+	"time"
+)
+
+// statsTotals are the aggregate counters the live report is computed from.
+type statsTotals struct {
+	requests, tunnels       int64
+	up, down                int64
+	requestErrs, tunnelErrs int64
+}
+
+func currentTotals() statsTotals {
+	hosts, _ := traffic.snapshot()
+	t := statsTotals{requestErrs: requestErrors.Value(), tunnelErrs: tunnelErrors.Value()}
+	for _, s := range hosts {
+		t.requests += s.Requests
+		t.tunnels += s.Connections
+		t.up += s.BytesUp
+		t.down += s.BytesDown
+	}
+	return t
+}
+
+// reportStats logs a one-line summary of the proxy's load every interval,
+// like the UDP tools' interval reports. With perConn every active tunnel
+// gets a line with its own rates too.
+func reportStats(interval time.Duration, perConn bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	last := currentTotals()
+	lastTick := time.Now()
+	lastConn := make(map[uint64][2]int64)
+
+	for now := range ticker.C {
+		cur := currentTotals()
+		secs := now.Sub(lastTick).Seconds()
+
+		// Failed tunnels never open a flow, so they are added to the
+		// attempts here; failed requests are already counted.
+		errs := cur.requestErrs - last.requestErrs + cur.tunnelErrs - last.tunnelErrs
+		attempts := cur.requests - last.requests + cur.tunnels - last.tunnels + cur.tunnelErrs - last.tunnelErrs
+		errRate := 0.0
+		if attempts > 0 {
+			errRate = float64(errs) / float64(attempts) * 100
+		}
+
+		slog.Info("Report", "active_tunnels", activeConns.count(), "requests_per_sec", float64(cur.requests-last.requests)/secs,
+			"up_mbps", mbps(cur.up-last.up, secs), "down_mbps", mbps(cur.down-last.down, secs), "errors", errs, "error_percent", errRate)
+
+		if perConn {
+			seen := make(map[uint64][2]int64)
+			for _, c := range activeConns.list() {
+				prev := lastConn[c.ID]
+				seen[c.ID] = [2]int64{c.BytesUp, c.BytesDown}
+				slog.Info("Tunnel", "id", c.ID, "kind", c.Kind, "client", c.Client, "destination", c.Destination,
+					"up_mbps", mbps(c.BytesUp-prev[0], secs), "down_mbps", mbps(c.BytesDown-prev[1], secs),
+					"bytes_up", c.BytesUp, "bytes_down", c.BytesDown)
+			}
+			lastConn = seen
+		}
+
+		last, lastTick = cur, now
+	}
+}
+
+// mbps converts bytes transferred in secs to megabits per second.
+func mbps(bytes int64, secs float64) float64 {
+	return float64(bytes) * 8 / secs / 1_000_000
+}
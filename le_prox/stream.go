@@ -0,0 +1,99 @@
+package leprox
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// flushInterval is how often buffered response data is flushed to the
+// client while a body is being copied. Negative values flush after every
+// write, zero disables periodic flushing.
+var flushInterval = 100 * time.Millisecond
+
+// responseFlushInterval picks the flush interval for a response. Server-sent
+// events and bodies of unknown length are streamed immediately.
+func responseFlushInterval(resp *http.Response) time.Duration {
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType == "text/event-stream" {
+		return -1
+	}
+	if resp.ContentLength == -1 {
+		return -1
+	}
+	return flushInterval
+}
+
+// copyResponse streams body to w, flushing according to interval.
+func copyResponse(w http.ResponseWriter, body io.Reader, interval time.Duration) error {
+	var dst io.Writer = w
+	if interval != 0 {
+		mlw := &maxLatencyWriter{
+			dst:     w,
+			flush:   http.NewResponseController(w).Flush,
+			latency: interval,
+		}
+		defer mlw.stop()
+
+		// Send the headers right away so clients see the response start
+		// even if the first body bytes take a while.
+		mlw.flushPending = true
+		mlw.delayedFlush()
+		dst = mlw
+	}
+
+	_, err := io.Copy(dst, body)
+	return err
+}
+
+// maxLatencyWriter flushes writes to dst at most latency after they happen.
+type maxLatencyWriter struct {
+	dst     io.Writer
+	flush   func() error
+	latency time.Duration // negative means flush immediately
+
+	mu           sync.Mutex
+	t            *time.Timer
+	flushPending bool
+}
+
+func (m *maxLatencyWriter) Write(p []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n, err := m.dst.Write(p)
+	if m.latency < 0 {
+		m.flush()
+		return n, err
+	}
+	if m.flushPending {
+		return n, err
+	}
+	if m.t == nil {
+		m.t = time.AfterFunc(m.latency, m.delayedFlush)
+	} else {
+		m.t.Reset(m.latency)
+	}
+	m.flushPending = true
+	return n, err
+}
+
+func (m *maxLatencyWriter) delayedFlush() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.flushPending {
+		return
+	}
+	m.flush()
+	m.flushPending = false
+}
+
+func (m *maxLatencyWriter) stop() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.flushPending = false
+	if m.t != nil {
+		m.t.Stop()
+	}
+}
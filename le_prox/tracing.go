@@ -0,0 +1,338 @@
+package leprox
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tracer exports spans of proxied requests; nil disables tracing.
+var tracer *spanExporter
+
+// Span kinds as numbered by OTLP.
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+// span is a timed operation in a W3C trace. A nil *span is valid and does
+// nothing, so call sites don't need to check whether tracing is on.
+type span struct {
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	sampled  bool
+
+	name  string
+	kind  int
+	start time.Time
+
+	mu    sync.Mutex
+	attrs map[string]any
+	err   string
+	ended bool
+}
+
+// startRequestSpan starts the server span for r, continuing the trace of
+// an incoming traceparent header if there is one.
+func startRequestSpan(r *http.Request, name string) *span {
+	if tracer == nil {
+		return nil
+	}
+	s := &span{name: name, kind: spanKindServer, start: time.Now(), attrs: make(map[string]any)}
+	if traceID, parentID, sampled, ok := parseTraceparent(r.Header.Get("Traceparent")); ok {
+		s.traceID, s.parentID, s.sampled = traceID, parentID, sampled
+	} else {
+		rand.Read(s.traceID[:])
+		s.sampled = tracer.sample(s.traceID)
+	}
+	rand.Read(s.spanID[:])
+	s.set("http.request.method", r.Method)
+	s.set("url.full", r.URL.String())
+	s.set("client.address", hostOnly(r.RemoteAddr))
+	return s
+}
+
+// child starts a span below s.
+func (s *span) child(name string, kind int) *span {
+	if s == nil {
+		return nil
+	}
+	c := &span{traceID: s.traceID, parentID: s.spanID, sampled: s.sampled, name: name, kind: kind, start: time.Now(), attrs: make(map[string]any)}
+	rand.Read(c.spanID[:])
+	return c
+}
+
+func (s *span) set(key string, value any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.attrs[key] = value
+	s.mu.Unlock()
+}
+
+func (s *span) fail(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.err = err.Error()
+	s.mu.Unlock()
+}
+
+// end finishes s and queues it for export. Only the first call counts.
+func (s *span) end() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.mu.Unlock()
+	if s.sampled {
+		tracer.add(s, time.Now())
+	}
+}
+
+// traceparent formats the W3C header naming s as the parent.
+func (s *span) traceparent() string {
+	flags := "00"
+	if s.sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(s.traceID[:]) + "-" + hex.EncodeToString(s.spanID[:]) + "-" + flags
+}
+
+// parseTraceparent parses a version 00 W3C traceparent header.
+func parseTraceparent(h string) (traceID [16]byte, parentID [8]byte, sampled bool, ok bool) {
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return traceID, parentID, false, false
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil || traceID == [16]byte{} {
+		return traceID, parentID, false, false
+	}
+	if _, err := hex.Decode(parentID[:], []byte(parts[2])); err != nil || parentID == [8]byte{} {
+		return traceID, parentID, false, false
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return traceID, parentID, false, false
+	}
+	return traceID, parentID, flags&1 == 1, true
+}
+
+// traceUpstream starts the client span for forwarding r, records dial,
+// TLS and time-to-first-byte child spans through httptrace, and propagates
+// the trace to upstream in the traceparent header.
+func traceUpstream(r *http.Request, parent *span) (*http.Request, *span) {
+	if parent == nil {
+		return r, nil
+	}
+	upstream := parent.child("upstream", spanKindClient)
+	upstream.set("server.address", r.URL.Host)
+	r.Header.Set("Traceparent", upstream.traceparent())
+
+	// Happy Eyeballs dials addresses in parallel, each attempt gets a
+	// span of its own.
+	var dialMu sync.Mutex
+	dials := map[string]*span{}
+	var handshake, wait *span
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			upstream.set("http.connection.reused", info.Reused)
+		},
+		ConnectStart: func(network, addr string) {
+			dial := upstream.child("dial", spanKindInternal)
+			dial.set("network.peer.address", addr)
+			dialMu.Lock()
+			dials[network+" "+addr] = dial
+			dialMu.Unlock()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			dialMu.Lock()
+			dial := dials[network+" "+addr]
+			delete(dials, network+" "+addr)
+			dialMu.Unlock()
+			dial.fail(err)
+			dial.end()
+		},
+		TLSHandshakeStart: func() {
+			handshake = upstream.child("tls", spanKindInternal)
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			handshake.set("tls.protocol.version", tls.VersionName(state.Version))
+			handshake.fail(err)
+			handshake.end()
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			wait = upstream.child("wait", spanKindInternal)
+		},
+		GotFirstResponseByte: func() {
+			wait.end()
+		},
+	}
+	return r.WithContext(httptrace.WithClientTrace(r.Context(), trace)), upstream
+}
+
+// spanExporter batches finished spans and posts them to an OTLP/HTTP
+// collector using the JSON encoding.
+type spanExporter struct {
+	endpoint string
+	ratio    float64
+	client   *http.Client
+
+	mu      sync.Mutex
+	pending []otlpSpan
+}
+
+func newSpanExporter(endpoint string, ratio float64) *spanExporter {
+	if !strings.Contains(strings.TrimPrefix(strings.TrimPrefix(endpoint, "http://"), "https://"), "/") {
+		endpoint = strings.TrimSuffix(endpoint, "/") + "/v1/traces"
+	}
+	// Export requests go straight to the collector, not through the
+	// upstream dialer and its routing rules.
+	return &spanExporter{endpoint: endpoint, ratio: ratio, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// sample decides whether a new trace is recorded. The decision is derived
+// from the trace ID so it is consistent for the whole trace.
+func (e *spanExporter) sample(traceID [16]byte) bool {
+	if e.ratio >= 1 {
+		return true
+	}
+	var n uint64
+	for _, b := range traceID[8:] {
+		n = n<<8 | uint64(b)
+	}
+	return float64(n>>1) < e.ratio*float64(math.MaxUint64>>1)
+}
+
+// maxPendingSpans bounds memory when the collector is unreachable.
+const maxPendingSpans = 8192
+
+func (e *spanExporter) add(s *span, end time.Time) {
+	s.mu.Lock()
+	o := otlpSpan{
+		TraceID:           hex.EncodeToString(s.traceID[:]),
+		SpanID:            hex.EncodeToString(s.spanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(end.UnixNano(), 10),
+	}
+	if s.parentID != [8]byte{} {
+		o.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	for key, value := range s.attrs {
+		o.Attributes = append(o.Attributes, otlpAttribute(key, value))
+	}
+	if s.err != "" {
+		o.Status = &otlpStatus{Code: 2, Message: s.err}
+	}
+	s.mu.Unlock()
+
+	e.mu.Lock()
+	if len(e.pending) < maxPendingSpans {
+		e.pending = append(e.pending, o)
+	}
+	e.mu.Unlock()
+}
+
+// run exports pending spans every interval.
+func (e *spanExporter) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := e.flush(context.Background()); err != nil {
+			slog.Warn("Failed to export spans", "err", err)
+		}
+	}
+}
+
+func (e *spanExporter) flush(ctx context.Context) error {
+	e.mu.Lock()
+	spans := e.pending
+	e.pending = nil
+	e.mu.Unlock()
+	if len(spans) == 0 {
+		return nil
+	}
+
+	body, err := json.Marshal(map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{
+				"attributes": []any{otlpAttribute("service.name", viaName)},
+			},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]string{"name": viaName},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("collector returned %s for %d spans", resp.Status, len(spans))
+	}
+	return nil
+}
+
+// OTLP JSON structures, see opentelemetry-proto's trace.proto.
+type otlpSpan struct {
+	TraceID           string           `json:"traceId"`
+	SpanID            string           `json:"spanId"`
+	ParentSpanID      string           `json:"parentSpanId,omitempty"`
+	Name              string           `json:"name"`
+	Kind              int              `json:"kind"`
+	StartTimeUnixNano string           `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string           `json:"endTimeUnixNano"`
+	Attributes        []map[string]any `json:"attributes,omitempty"`
+	Status            *otlpStatus      `json:"status,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+func otlpAttribute(key string, value any) map[string]any {
+	var v map[string]any
+	switch value := value.(type) {
+	case bool:
+		v = map[string]any{"boolValue": value}
+	case int:
+		v = map[string]any{"intValue": strconv.Itoa(value)}
+	case int64:
+		v = map[string]any{"intValue": strconv.FormatInt(value, 10)}
+	default:
+		v = map[string]any{"stringValue": fmt.Sprint(value)}
+	}
+	return map[string]any{"key": key, "value": v}
+}
@@ -0,0 +1,163 @@
+package leprox
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strconv"
+	"time"
+)
+
+// serveTransparent accepts connections redirected to the proxy by the
+// firewall (iptables REDIRECT or TPROXY) and tunnels them to their original
+// destination, so clients need no proxy configuration.
+func serveTransparent(ln net.Listener, tproxy bool) {
+	mode := "REDIRECT"
+	if tproxy {
+		mode = "TPROXY"
+	}
+	slog.Info("Starting transparent proxy", "mode", mode, "addr", ln.Addr())
+
+	for {
+		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			slog.Warn("Transparent accept failed", "err", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go handleTransparent(conn, tproxy)
+	}
+}
+
+// handleTransparent recovers the original destination of conn and relays
+// it there under the same policy as CONNECT tunnels: rate limits, allowed
+// ports and SNI filtering. The original destination is always what gets
+// dialed, a TLS client's SNI only has to be consistent with it.
+func handleTransparent(conn net.Conn, tproxy bool) {
+	client := conn.RemoteAddr().String()
+	var dst *net.TCPAddr
+	var err error
+	if tproxy {
+		// With TPROXY the socket is bound to the original destination.
+		dst = conn.LocalAddr().(*net.TCPAddr)
+	} else {
+		dst, err = originalDst(conn)
+	}
+	if err != nil {
+		slog.Warn("Transparent connection failed", "client", client, "err", err)
+		conn.Close()
+		return
+	}
+	if !tproxy && isLocalAddr(dst) && dst.Port == conn.LocalAddr().(*net.TCPAddr).Port {
+		slog.Warn("Transparent connection was not redirected, dropping", "client", client)
+		conn.Close()
+		return
+	}
+	target := net.JoinHostPort(dst.IP.String(), strconv.Itoa(dst.Port))
+
+	// Only SNI rules need the ClientHello. Waiting for it would stall
+	// protocols where the server speaks first, like SMTP or SSH.
+	br := bufio.NewReaderSize(conn, 16*1024+5)
+	inspect := sniInspection()
+	var sni string
+	if inspect {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		sni, _ = peekSNI(br)
+		conn.SetReadDeadline(time.Time{})
+	}
+	host := dst.IP.String()
+	if sni != "" {
+		host = sni
+	}
+
+	if ok, _, what := takeRateLimits(client, host); !ok {
+		slog.Warn("Denied transparent connection, rate limit exceeded", "client", client, "target", target, "limit", what)
+		conn.Close()
+		return
+	}
+	if !currentConfig().access.connectPorts.allows(target) {
+		connectDenied.Add(1)
+		slog.Warn("Denied transparent connection, port not allowed", "client", client, "target", target)
+		conn.Close()
+		return
+	}
+	ctx := withClientAddr(context.Background(), client)
+	if inspect {
+		if err := checkTransparentSNI(ctx, dst.IP, sni); err != nil {
+			sniBlocked.Add(1)
+			slog.Warn("Blocked transparent connection", "client", client, "target", target, "sni", sni, "err", err)
+			conn.Close()
+			return
+		}
+	}
+
+	slog.Info("Transparent connection", "client", client, "target", target, "sni", sni)
+	destConn, err := dialUpstream(ctx, "tcp", target)
+	if err != nil {
+		tunnelErrors.Add(1)
+		slog.Warn("Transparent dial failed", "target", target, "err", err)
+		conn.Close()
+		return
+	}
+
+	upstream := &countingConn{ReadWriteCloser: destConn, flow: traffic.openFlow(client, host, true)}
+	clientIn := struct {
+		io.Reader
+		io.Closer
+	}{br, conn}
+	relay("transparent", client, target, clientIn, conn, upstream)
+}
+
+// checkTransparentSNI applies the SNI policy to a connection to dst whose
+// ClientHello named sni. The SNI must resolve to dst, otherwise a client
+// could reach any address while presenting an allowed name.
+func checkTransparentSNI(ctx context.Context, dst net.IP, sni string) error {
+	if _, err := tunnelTarget(net.JoinHostPort(dst.String(), "0"), sni); err != nil {
+		return err
+	}
+	if sni == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	addrs, err := lookupHost(ctx, sni)
+	if err != nil {
+		return fmt.Errorf("resolving SNI: %v", err)
+	}
+	want, _ := netip.AddrFromSlice(dst)
+	for _, addr := range addrs {
+		if addr.Unmap() == want.Unmap() {
+			return nil
+		}
+	}
+	return errSNIMismatch
+}
+
+// isLocalAddr reports whether addr belongs to this host.
+func isLocalAddr(addr *net.TCPAddr) bool {
+	if addr.IP.IsLoopback() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.Equal(addr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// errTransparentUnsupported is returned on platforms without transparent
+// proxy support.
+var errTransparentUnsupported = fmt.Errorf("transparent proxy mode requires Linux")
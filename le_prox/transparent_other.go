@@ -0,0 +1,13 @@
+//go:build !linux
+
+package leprox
+
+import "net"
+
+func originalDst(conn net.Conn) (*net.TCPAddr, error) {
+	return nil, errTransparentUnsupported
+}
+
+func listenTransparent(addr string, tproxy bool) (net.Listener, error) {
+	return nil, errTransparentUnsupported
+}
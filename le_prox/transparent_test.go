@@ -0,0 +1,49 @@
+package leprox
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTransparentServerSpeaksFirst(t *testing.T) {
+	useAccessPolicy(t, &accessPolicy{})
+
+	// With TPROXY the original destination is the listener itself, so the
+	// second connection it accepts is the proxy dialing "upstream".
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		proxied, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go handleTransparent(proxied, true)
+		upstream, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer upstream.Close()
+		upstream.Write([]byte("220 ready\r\n"))
+		bufio.NewReader(upstream).ReadString('\n')
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// Without SNI rules the proxy must not wait for a ClientHello.
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	banner, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatalf("reading the server's banner: %v", err)
+	}
+	if banner != "220 ready\r\n" {
+		t.Errorf("banner = %q", banner)
+	}
+}
@@ -0,0 +1,83 @@
+package leprox
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// upstreamTransport forwards plain HTTP and intercepted requests.
+var upstreamTransport *http.Transport
+
+// transportConfig holds the tunables of the upstream transport.
+type transportConfig struct {
+	MaxIdleConns          int
+	MaxIdleConnsPerHost   int
+	MaxConnsPerHost       int
+	IdleConnTimeout       time.Duration
+	ResponseHeaderTimeout time.Duration
+	DialTimeout           time.Duration
+	InsecureSkipVerify    bool
+	RootCAFile            string
+	HTTP2                 bool
+	// H2C forces HTTP/2 for every upstream, over cleartext for http://.
+	H2C bool
+	// ClientCerts are pattern=cert.pem,key.pem rules for mutual TLS.
+	ClientCerts []string
+}
+
+// newUpstreamTransport builds the upstream transport from cfg. It also
+// applies the dial settings to upstreamDialer so CONNECT tunnels share them.
+func newUpstreamTransport(cfg transportConfig) (*http.Transport, error) {
+	upstreamDialer.Timeout = cfg.DialTimeout
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: cfg.InsecureSkipVerify}
+	if cfg.RootCAFile != "" {
+		pem, err := os.ReadFile(cfg.RootCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.RootCAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = dialUpstream
+	t.TLSClientConfig = tlsConfig
+	t.MaxIdleConns = cfg.MaxIdleConns
+	t.MaxIdleConnsPerHost = cfg.MaxIdleConnsPerHost
+	t.MaxConnsPerHost = cfg.MaxConnsPerHost
+	t.IdleConnTimeout = cfg.IdleConnTimeout
+	t.ResponseHeaderTimeout = cfg.ResponseHeaderTimeout
+	t.ForceAttemptHTTP2 = cfg.HTTP2
+	if cfg.H2C {
+		t.Protocols = new(http.Protocols)
+		t.Protocols.SetHTTP2(true)
+		t.Protocols.SetUnencryptedHTTP2(true)
+	}
+	if len(cfg.ClientCerts) > 0 {
+		var certs []clientCert
+		for _, rule := range cfg.ClientCerts {
+			c, err := parseClientCert(rule)
+			if err != nil {
+				return nil, err
+			}
+			certs = append(certs, c)
+		}
+		t.DialTLSContext = dialTLSWithClientCerts(tlsConfig, certs, cfg.HTTP2)
+	}
+	if !cfg.HTTP2 {
+		// A non-nil, empty map disables HTTP/2 negotiation.
+		t.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+	return t, nil
+}
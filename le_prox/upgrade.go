@@ -0,0 +1,80 @@
+package leprox
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// upgradeType returns the protocol requested through an HTTP Upgrade
+// (e.g. "websocket"), or "" if the message is not an upgrade.
+func upgradeType(h http.Header) string {
+	for _, value := range h.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return h.Get("Upgrade")
+			}
+		}
+	}
+	return ""
+}
+
+// handleUpgradeResponse relays a 101 Switching Protocols response to the
+// client and then copies raw bytes in both directions until either side
+// closes.
+func handleUpgradeResponse(w http.ResponseWriter, r *http.Request, upgrade string, resp *http.Response, f *flow) {
+	body, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		http.Error(w, "upstream returned a non-writable upgrade body", http.StatusBadGateway)
+		return
+	}
+	backConn := &countingConn{ReadWriteCloser: body, flow: f}
+	defer backConn.Close()
+
+	if got := upgradeType(resp.Header); !strings.EqualFold(got, upgrade) {
+		http.Error(w, fmt.Sprintf("upstream switched to %q, requested %q", got, upgrade), http.StatusBadGateway)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	clientConn, brw, err := hijacker.Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer clientConn.Close()
+
+	addVia(resp.Header, resp.ProtoMajor, resp.ProtoMinor)
+	resp.Body = nil
+	if err := resp.Write(brw); err != nil {
+		slog.Warn("Failed to write upgrade response", "url", r.URL, "err", err)
+		return
+	}
+	if err := brw.Flush(); err != nil {
+		slog.Warn("Failed to write upgrade response", "url", r.URL, "err", err)
+		return
+	}
+
+	slog.Info("Upgraded connection", "protocol", upgrade, "url", r.URL)
+	c := activeConns.add("upgrade:"+strings.ToLower(upgrade), r.RemoteAddr, r.URL.Host, f, backConn, clientConn)
+	defer activeConns.remove(c)
+
+	// Bytes the client sent right after its request may already sit in the
+	// server's read buffer, so the client side is read through brw.
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(backConn, brw)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(clientConn, backConn)
+		done <- struct{}{}
+	}()
+	<-done
+}
@@ -0,0 +1,63 @@
+package leprox
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestUpgradeIsRecorded(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: test\r\n\r\nhello")
+		brw.Flush()
+	}))
+	defer backend.Close()
+
+	prevTransport, prevRecorder := upstreamTransport, recorder
+	upstreamTransport = &http.Transport{}
+	recorder = newHARRecorder("", false)
+	defer func() { upstreamTransport, recorder = prevTransport, prevRecorder }()
+
+	proxy := httptest.NewServer(http.HandlerFunc(handleHTTP))
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET %s/ws HTTP/1.1\r\nHost: %s\r\nConnection: Upgrade\r\nUpgrade: test\r\n\r\n", backend.URL, backend.Listener.Addr())
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status = %d, want 101", resp.StatusCode)
+	}
+	conn.Close()
+
+	// The exchange is finished once the tunnel is gone.
+	var entries []harEntry
+	for deadline := time.Now().Add(5 * time.Second); len(entries) == 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		recorder.mu.Lock()
+		entries = append(entries, recorder.entries...)
+		recorder.mu.Unlock()
+	}
+	if len(entries) != 1 {
+		t.Fatalf("recorded %d entries, want 1", len(entries))
+	}
+	if got := entries[0].Response.Status; got != http.StatusSwitchingProtocols {
+		t.Errorf("recorded status %d, want 101", got)
+	}
+}
@@ -0,0 +1,216 @@
+package neighscan
+
+import (
+	"context"
+	"encoding/hex"
+	"flag"
+	"log"
+	"net/netip"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"gonet/pkg/config"
+	"gonet/pkg/ifaceutil"
+	"gonet/pkg/logging"
+	"gonet/pkg/results"
+	"gonet/pkg/stats"
+)
+
+// Main runs gonet neigh with the arguments after the command name.
+func Main(args []string) {
+	if len(args) < 1 {
+		log.Fatal("Usage: gonet neigh scan|stress [flags] [network]")
+	}
+	switch args[0] {
+	case "scan":
+		scanCommand(args[1:])
+	case "stress":
+		stressCommand(args[1:])
+	default:
+		log.Fatalf("Unknown neigh command %q, want scan or stress", args[0])
+	}
+}
+
+func scanCommand(args []string) {
+	// Command line flags
+	flags := flag.NewFlagSet("neigh scan", flag.ExitOnError)
+	interfaceName := flags.String("interface", "eth0", "Network interface to use, by name, IP address or subnet")
+	source := flags.String("source", "", "Address to ask from, 0.0.0.0 for ARP probes (default the interface's)")
+	rate := flags.Float64("rate", 500, "Requests per second")
+	retries := flags.Int("retries", 1, "Times to ask the silent addresses again")
+	timeout := flags.Duration("timeout", time.Second, "How long to wait for late answers after each pass")
+	maxHosts := flags.Int("max", 65536, "Addresses to sweep at most")
+	histogram := flags.Bool("histogram", false, "Print the latency histogram")
+	report := stats.RegisterFlags(flags)
+	jsonOut := flags.String("json", "", "Write the result as JSON to this file when done, - for stdout")
+	logs := logging.RegisterFlags(flags)
+	configFile := flags.String("config", "", "YAML or JSON file setting flags by name, command line flags win")
+	flags.Parse(args)
+
+	if _, err := config.LoadFlags(flags, *configFile); err != nil {
+		log.Fatalf("Invalid -config: %v", err)
+	}
+	if err := logs.Setup(); err != nil {
+		log.Fatal(err)
+	}
+	if flags.NArg() > 1 {
+		log.Fatal("Usage: gonet neigh scan [flags] [network]")
+	}
+	cfg := ScanConfig{
+		Interface: device(*interfaceName),
+		Rate:      *rate,
+		Retries:   *retries,
+		Timeout:   *timeout,
+		MaxHosts:  *maxHosts,
+	}
+	if flags.NArg() == 1 {
+		cfg.Prefix = parsePrefix(flags.Arg(0))
+	}
+	if *source != "" {
+		a, err := netip.ParseAddr(*source)
+		if err != nil {
+			log.Fatalf("Invalid -source: %v", err)
+		}
+		cfg.Source = a
+	}
+
+	// Stop on interrupt
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	var s Scanner
+	report.Unit = "Hosts"
+	reporter, err := report.Reporter(s.Counters(), "Host", "found", "neigh scan")
+	if err != nil {
+		log.Fatal(err)
+	}
+	reporter.Start()
+	res, err := s.Run(ctx, cfg)
+	reporter.Stop()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *jsonOut != "-" {
+		res.Write(os.Stdout, *histogram)
+	}
+	if *jsonOut != "" {
+		if err := results.Write(*jsonOut, res); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+func stressCommand(args []string) {
+	// Command line flags
+	flags := flag.NewFlagSet("neigh stress", flag.ExitOnError)
+	interfaceName := flags.String("interface", "eth0", "Network interface to use, by name, IP address or subnet")
+	target := flags.String("target", "", "Router whose table to fill, asked for its MAC by every host (default announcements only)")
+	hosts := flags.Int("hosts", 1000, "Fake hosts")
+	churn := flags.Bool("churn", false, "Give every host a new MAC each round")
+	macPrefix := flags.String("mac-prefix", "02:00:00", "Start of the hosts' MAC addresses, the rest is random")
+	rate := flags.Float64("rate", 1000, "Frames per second")
+	frames := flags.Uint64("n", 0, "Stop after this many frames")
+	duration := flags.Duration("duration", 0, "Stop after this long (default 10s unless -n is given)")
+	timeout := flags.Duration("timeout", time.Second, "Answers later than this count as missing")
+	window := flags.Duration("window", 10*time.Second, "Length of the answers over time windows")
+	histogram := flags.Bool("histogram", false, "Print the latency histogram")
+	report := stats.RegisterFlags(flags)
+	jsonOut := flags.String("json", "", "Write the result as JSON to this file when done, - for stdout")
+	logs := logging.RegisterFlags(flags)
+	configFile := flags.String("config", "", "YAML or JSON file setting flags by name, command line flags win")
+	flags.Parse(args)
+
+	if _, err := config.LoadFlags(flags, *configFile); err != nil {
+		log.Fatalf("Invalid -config: %v", err)
+	}
+	if err := logs.Setup(); err != nil {
+		log.Fatal(err)
+	}
+	if flags.NArg() > 1 {
+		log.Fatal("Usage: gonet neigh stress [flags] [network]")
+	}
+	cfg := StressConfig{
+		Interface: device(*interfaceName),
+		Hosts:     *hosts,
+		Churn:     *churn,
+		Rate:      *rate,
+		Frames:    *frames,
+		Duration:  *duration,
+		Timeout:   *timeout,
+		Window:    *window,
+	}
+	if flags.NArg() == 1 {
+		cfg.Prefix = parsePrefix(flags.Arg(0))
+	}
+	if *target != "" {
+		a, err := netip.ParseAddr(*target)
+		if err != nil {
+			log.Fatalf("Invalid -target: %v", err)
+		}
+		cfg.Target = a
+	}
+	prefix, err := hex.DecodeString(strings.ReplaceAll(*macPrefix, ":", ""))
+	if err != nil || len(prefix) == 0 || len(prefix) > 5 {
+		log.Fatalf("Invalid -mac-prefix %q, want 1 to 5 bytes like 02:00:00", *macPrefix)
+	}
+	cfg.MACPrefix = prefix
+	if cfg.Frames == 0 && cfg.Duration == 0 {
+		cfg.Duration = 10 * time.Second
+	}
+
+	// Stop on interrupt
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	var s Stresser
+	report.Unit = "Frames"
+	reporter, err := report.Reporter(s.Counters(), "Frame", "sent", "neigh stress")
+	if err != nil {
+		log.Fatal(err)
+	}
+	reporter.Start()
+	res, err := s.Run(ctx, cfg)
+	reporter.Stop()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *jsonOut != "-" {
+		res.Write(os.Stdout, *histogram)
+	}
+	if *jsonOut != "" {
+		if err := results.Write(*jsonOut, res); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// device resolves the -interface flag to a pcap device, listing the
+// devices when it's empty.
+func device(name string) string {
+	if name == "" {
+		if err := ifaceutil.ListDevices(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		log.Fatal("Please specify an interface name with -interface")
+	}
+	dev, err := ifaceutil.Resolve(name)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return dev
+}
+
+// parsePrefix reads the network argument, a single address being a
+// network of one.
+func parsePrefix(s string) netip.Prefix {
+	if a, err := netip.ParseAddr(s); err == nil {
+		return netip.PrefixFrom(a, a.BitLen())
+	}
+	p, err := netip.ParsePrefix(s)
+	if err != nil {
+		log.Fatalf("Invalid network %q: %v", s, err)
+	}
+	return p
+}
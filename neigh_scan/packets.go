@@ -0,0 +1,250 @@
+package neighscan
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"gonet/pkg/ifaceutil"
+)
+
+// answer is an ARP reply or neighbor advertisement: addr is at mac, told
+// to to. With ask set it's a request or solicitation instead, addr asking
+// where to is.
+type answer struct {
+	addr netip.Addr
+	mac  net.HardwareAddr
+	to   netip.Addr
+	ask  bool
+}
+
+// solicit builds an ARP request, or an ICMPv6 neighbor solicitation, from
+// mac and src for target. An ARP request from 0.0.0.0 is a probe, which
+// hosts answer without learning the sender; one with src the same as
+// target is a gratuitous ARP.
+func solicit(mac net.HardwareAddr, src, target netip.Addr) ([]byte, error) {
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if target.Is4() {
+		eth := &layers.Ethernet{SrcMAC: mac, DstMAC: layers.EthernetBroadcast, EthernetType: layers.EthernetTypeARP}
+		arp := &layers.ARP{
+			AddrType:          layers.LinkTypeEthernet,
+			Protocol:          layers.EthernetTypeIPv4,
+			HwAddressSize:     6,
+			ProtAddressSize:   4,
+			Operation:         layers.ARPRequest,
+			SourceHwAddress:   mac,
+			SourceProtAddress: src.AsSlice(),
+			DstHwAddress:      make([]byte, 6),
+			DstProtAddress:    target.AsSlice(),
+		}
+		err := gopacket.SerializeLayers(buf, opts, eth, arp)
+		return buf.Bytes(), err
+	}
+
+	// To the solicited-node group of the target, with our link-layer
+	// address for the answer.
+	t := target.As16()
+	group := netip.AddrFrom16([16]byte{0xff, 0x02, 11: 1, 12: 0xff, 13: t[13], 14: t[14], 15: t[15]})
+	eth := &layers.Ethernet{
+		SrcMAC:       mac,
+		DstMAC:       net.HardwareAddr{0x33, 0x33, 0xff, t[13], t[14], t[15]},
+		EthernetType: layers.EthernetTypeIPv6,
+	}
+	ip := &layers.IPv6{Version: 6, HopLimit: 255, NextHeader: layers.IPProtocolICMPv6, SrcIP: src.AsSlice(), DstIP: group.AsSlice()}
+	icmp := &layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeNeighborSolicitation, 0)}
+	icmp.SetNetworkLayerForChecksum(ip)
+	ns := &layers.ICMPv6NeighborSolicitation{
+		TargetAddress: target.AsSlice(),
+		Options:       layers.ICMPv6Options{{Type: layers.ICMPv6OptSourceAddress, Data: mac}},
+	}
+	err := gopacket.SerializeLayers(buf, opts, eth, ip, icmp, ns)
+	return buf.Bytes(), err
+}
+
+// announce builds a gratuitous ARP, or an unsolicited neighbor
+// advertisement to all nodes, saying addr is at mac.
+func announce(mac net.HardwareAddr, addr netip.Addr) ([]byte, error) {
+	if addr.Is4() {
+		return solicit(mac, addr, addr)
+	}
+	eth := &layers.Ethernet{SrcMAC: mac, DstMAC: net.HardwareAddr{0x33, 0x33, 0, 0, 0, 1}, EthernetType: layers.EthernetTypeIPv6}
+	ip := &layers.IPv6{Version: 6, HopLimit: 255, NextHeader: layers.IPProtocolICMPv6, SrcIP: addr.AsSlice(), DstIP: net.IPv6linklocalallnodes}
+	icmp := &layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeNeighborAdvertisement, 0)}
+	icmp.SetNetworkLayerForChecksum(ip)
+	na := &layers.ICMPv6NeighborAdvertisement{
+		Flags:         0x20, // override
+		TargetAddress: addr.AsSlice(),
+		Options:       layers.ICMPv6Options{{Type: layers.ICMPv6OptTargetAddress, Data: mac}},
+	}
+	buf := gopacket.NewSerializeBuffer()
+	err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, eth, ip, icmp, na)
+	return buf.Bytes(), err
+}
+
+// parse reads an ARP request or reply, or a neighbor solicitation or
+// advertisement, from a captured frame.
+func parse(data []byte) (answer, bool) {
+	packet := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+	if arp, ok := packet.Layer(layers.LayerTypeARP).(*layers.ARP); ok {
+		if len(arp.SourceProtAddress) != 4 || len(arp.DstProtAddress) != 4 {
+			return answer{}, false
+		}
+		return answer{
+			addr: netip.AddrFrom4([4]byte(arp.SourceProtAddress)),
+			mac:  append(net.HardwareAddr(nil), arp.SourceHwAddress...),
+			to:   netip.AddrFrom4([4]byte(arp.DstProtAddress)),
+			ask:  arp.Operation == layers.ARPRequest,
+		}, arp.Operation == layers.ARPRequest || arp.Operation == layers.ARPReply
+	}
+	ip, _ := packet.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
+	eth, _ := packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	if ip == nil || eth == nil {
+		return answer{}, false
+	}
+	a := answer{mac: append(net.HardwareAddr(nil), eth.SrcMAC...)}
+	var target net.IP
+	var options layers.ICMPv6Options
+	switch l := packet.Layer(layers.LayerTypeICMPv6NeighborAdvertisement).(type) {
+	case *layers.ICMPv6NeighborAdvertisement:
+		target, options = l.TargetAddress, l.Options
+		a.to, _ = netip.AddrFromSlice(ip.DstIP)
+	default:
+		ns, ok := packet.Layer(layers.LayerTypeICMPv6NeighborSolicitation).(*layers.ICMPv6NeighborSolicitation)
+		if !ok {
+			return answer{}, false
+		}
+		a.ask = true
+		a.to, _ = netip.AddrFromSlice(ns.TargetAddress)
+		target = ip.SrcIP
+	}
+	a.addr, _ = netip.AddrFromSlice(target)
+	for _, o := range options {
+		if o.Type == layers.ICMPv6OptTargetAddress && len(o.Data) == 6 {
+			a.mac = append(net.HardwareAddr(nil), o.Data...)
+		}
+	}
+	return a, a.addr.IsValid() && a.to.IsValid()
+}
+
+// filter is the BPF filter for ARP, or ICMPv6 neighbor solicitations and
+// advertisements.
+func filter(v6 bool) string {
+	if v6 {
+		return "icmp6 and (ip6[40] == 135 or ip6[40] == 136)"
+	}
+	return "arp"
+}
+
+// local is what the tools need to know of their interface.
+type local struct {
+	mac      net.HardwareAddr
+	prefixes []netip.Prefix // with the interface's addresses
+}
+
+// lookup finds the MAC and the networks of the pcap device name.
+func lookup(name string) (*local, error) {
+	iface, err := ifaceutil.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(iface.HardwareAddr) != 6 {
+		return nil, fmt.Errorf("%s isn't an Ethernet interface", name)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	l := &local{mac: iface.HardwareAddr}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			a, _ := netip.AddrFromSlice(ipNet.IP)
+			ones, _ := ipNet.Mask.Size()
+			l.prefixes = append(l.prefixes, netip.PrefixFrom(a.Unmap(), ones))
+		}
+	}
+	return l, nil
+}
+
+// network returns the interface's first network of the family, a global
+// one for IPv6.
+func (l *local) network(v6 bool) (netip.Prefix, error) {
+	for _, p := range l.prefixes {
+		if p.Addr().Is6() == v6 && !p.Addr().IsLinkLocalUnicast() {
+			return p, nil
+		}
+	}
+	return netip.Prefix{}, errors.New("the interface has no network of that family, give one")
+}
+
+// source returns the interface's address to solicit target from: the one
+// on target's network, for IPv6 the link-local one. ok is false when
+// there is none.
+func (l *local) source(target netip.Addr) (netip.Addr, bool) {
+	for _, p := range l.prefixes {
+		if target.Is4() && p.Contains(target) {
+			return p.Addr(), true
+		}
+		if target.Is6() && p.Addr().Is6() && p.Addr().IsLinkLocalUnicast() {
+			return p.Addr(), true
+		}
+	}
+	return netip.Addr{}, false
+}
+
+// owns tells whether addr is one of the interface's.
+func (l *local) owns(addr netip.Addr) bool {
+	for _, p := range l.prefixes {
+		if p.Addr() == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// hosts lists the addresses of p hosts may have: without the network and
+// broadcast addresses of IPv4 networks and the subnet-router anycast
+// address of IPv6 ones. It fails when there would be more than max.
+func hosts(p netip.Prefix, max int) ([]netip.Addr, error) {
+	p = p.Masked()
+	bits := p.Addr().BitLen() - p.Bits()
+	if bits >= 31 || 1<<bits > max+2 {
+		return nil, fmt.Errorf("%s has more than %d addresses", p, max)
+	}
+	var list []netip.Addr
+	for a := p.Addr(); a.IsValid() && p.Contains(a); a = a.Next() {
+		list = append(list, a)
+	}
+	switch {
+	case p.Addr().Is4() && bits >= 2:
+		list = list[1 : len(list)-1]
+	case p.Addr().Is6() && bits >= 1:
+		list = list[1:]
+	}
+	return list, nil
+}
+
+// randomAddr returns an address in p with random host bits.
+func randomAddr(p netip.Prefix) netip.Addr {
+	b := p.Masked().Addr().AsSlice()
+	r := make([]byte, len(b))
+	rand.Read(r)
+	for i := range b {
+		keep := p.Bits() - i*8
+		switch {
+		case keep >= 8:
+		case keep <= 0:
+			b[i] = r[i]
+		default:
+			mask := byte(0xff) << (8 - keep)
+			b[i] = b[i]&mask | r[i]&^mask
+		}
+	}
+	a, _ := netip.AddrFromSlice(b)
+	return a
+}
@@ -0,0 +1,291 @@
+package neighscan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcap"
+
+	"gonet/pkg/stats"
+)
+
+// ScanConfig is a sweep for Scanner.Run.
+type ScanConfig struct {
+	Interface string // pcap device
+
+	// Prefix is the network to sweep, by default the interface's first
+	// IPv4 one. IPv6 prefixes are swept with neighbor solicitations, so
+	// only small ones, like a /120, are of any use.
+	Prefix netip.Prefix
+
+	// Source is the address to ask from, by default the interface's
+	// address on the network, or its link-local one for IPv6. 0.0.0.0
+	// sends ARP probes, which don't touch the hosts' tables.
+	Source netip.Addr
+
+	Rate     float64       // requests per second, default 500
+	Retries  int           // requests again to the silent addresses
+	Timeout  time.Duration // wait for late answers after each pass, default 1s
+	MaxHosts int           // addresses to sweep at most, default 65536
+}
+
+// Host is an address that answered.
+type Host struct {
+	Addr    string        `json:"addr"`
+	MAC     string        `json:"mac"`                  // of the first answer
+	Others  []string      `json:"other_macs,omitempty"` // other MACs that answered for it, a conflict
+	Latency time.Duration `json:"latency_ns"`           // from the last request to the first answer
+	Tries   int           `json:"tries"`                // requests sent until it answered
+	Answers uint64        `json:"answers"`
+
+	addr netip.Addr
+}
+
+// ScanResult is a finished sweep, the hosts in address order.
+type ScanResult struct {
+	Interface string        `json:"interface"`
+	Prefix    string        `json:"prefix"`
+	Source    string        `json:"source"`
+	Addresses int           `json:"addresses"`
+	Sent      uint64        `json:"sent"`
+	Alive     int           `json:"alive"`
+	Conflicts int           `json:"conflicts"` // addresses more than one MAC answered for
+	Elapsed   time.Duration `json:"elapsed_ns"`
+	Latency   stats.Latency `json:"latency"`
+	Hosts     []*Host       `json:"hosts"`
+}
+
+// link sends and captures frames, a pcap handle but for tests.
+type link interface {
+	WritePacketData([]byte) error
+	ReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+}
+
+// open opens device for sending and for the answers of family.
+func open(device string, v6 bool) (*pcap.Handle, error) {
+	handle, err := pcap.OpenLive(device, 128, true, 100*time.Millisecond)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open device %s: %v", device, err)
+	}
+	if err := handle.SetBPFFilter(filter(v6)); err != nil {
+		handle.Close()
+		return nil, err
+	}
+	return handle, nil
+}
+
+// Scanner sweeps a network for its hosts. The zero value is ready to use.
+type Scanner struct {
+	counters stats.Counters
+}
+
+// Counters counts the hosts found, for interval reports.
+func (s *Scanner) Counters() *stats.Counters {
+	return &s.counters
+}
+
+// Run sweeps the network cfg describes. Cancelling ctx ends it, the result
+// then covers the answers so far.
+func (s *Scanner) Run(ctx context.Context, cfg ScanConfig) (*ScanResult, error) {
+	l, err := lookup(cfg.Interface)
+	if err != nil {
+		return nil, err
+	}
+	if !cfg.Prefix.IsValid() {
+		if cfg.Prefix, err = l.network(false); err != nil {
+			return nil, err
+		}
+	}
+	if !cfg.Source.IsValid() {
+		var ok bool
+		if cfg.Source, ok = l.source(cfg.Prefix.Addr()); !ok {
+			return nil, fmt.Errorf("no address of %s to ask from, give one", cfg.Interface)
+		}
+	}
+	handle, err := open(cfg.Interface, cfg.Prefix.Addr().Is6())
+	if err != nil {
+		return nil, err
+	}
+	defer handle.Close()
+	return s.run(ctx, cfg, l.mac, handle)
+}
+
+// target is the state of one swept address.
+type target struct {
+	sent  time.Time
+	tries int
+	host  *Host
+}
+
+func (s *Scanner) run(ctx context.Context, cfg ScanConfig, mac []byte, l link) (*ScanResult, error) {
+	if cfg.Rate <= 0 {
+		cfg.Rate = 500
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = time.Second
+	}
+	if cfg.MaxHosts <= 0 {
+		cfg.MaxHosts = 65536
+	}
+	if cfg.Source.Is4() != cfg.Prefix.Addr().Is4() {
+		return nil, fmt.Errorf("source %s and network %s are of different families", cfg.Source, cfg.Prefix)
+	}
+	addrs, err := hosts(cfg.Prefix, cfg.MaxHosts)
+	if err != nil {
+		return nil, err
+	}
+	res := &ScanResult{Interface: cfg.Interface, Prefix: cfg.Prefix.Masked().String(), Source: cfg.Source.String(), Addresses: len(addrs)}
+	var mu sync.Mutex
+	targets := make(map[netip.Addr]*target, len(addrs))
+	for _, a := range addrs {
+		targets[a] = &target{}
+	}
+
+	readCtx, stopReading := context.WithCancel(context.Background())
+	defer stopReading()
+	reading := read(readCtx, l, func(a answer, at time.Time) {
+		mu.Lock()
+		defer mu.Unlock()
+		t := targets[a.addr]
+		if a.ask || t == nil || t.tries == 0 {
+			return
+		}
+		if t.host == nil {
+			t.host = &Host{Addr: a.addr.String(), MAC: a.mac.String(), Latency: at.Sub(t.sent), Tries: t.tries, addr: a.addr}
+			s.counters.Add(1, 0)
+		} else if m := a.mac.String(); m != t.host.MAC && !contains(t.host.Others, m) {
+			t.host.Others = append(t.host.Others, m)
+		}
+		t.host.Answers++
+	})
+
+	start := time.Now()
+	sent := 0
+passes:
+	for try := 0; try <= cfg.Retries; try++ {
+		for _, a := range addrs {
+			mu.Lock()
+			t := targets[a]
+			done := t.host != nil
+			mu.Unlock()
+			if done {
+				continue
+			}
+			if !pace(ctx, start, sent, cfg.Rate) {
+				break passes
+			}
+			data, err := solicit(mac, cfg.Source, a)
+			if err != nil {
+				return nil, err
+			}
+			mu.Lock()
+			t.sent = time.Now()
+			t.tries++
+			mu.Unlock()
+			if err := l.WritePacketData(data); err != nil {
+				return nil, err
+			}
+			sent++
+		}
+		select {
+		case <-time.After(cfg.Timeout):
+		case <-ctx.Done():
+			break passes
+		}
+	}
+	stopReading()
+	<-reading
+
+	mu.Lock()
+	defer mu.Unlock()
+	res.Sent = uint64(sent)
+	res.Elapsed = time.Since(start)
+	var latency stats.Histogram
+	for _, t := range targets {
+		if t.host == nil {
+			continue
+		}
+		res.Hosts = append(res.Hosts, t.host)
+		latency.Record(t.host.Latency)
+		if len(t.host.Others) > 0 {
+			res.Conflicts++
+		}
+	}
+	sort.Slice(res.Hosts, func(i, j int) bool { return res.Hosts[i].addr.Less(res.Hosts[j].addr) })
+	res.Alive = len(res.Hosts)
+	res.Latency = latency.Summary()
+	return res, nil
+}
+
+// pace waits until frame i is due at rate frames per second from start.
+// It returns false when ctx is done first.
+func pace(ctx context.Context, start time.Time, i int, rate float64) bool {
+	due := start.Add(time.Duration(float64(i) / rate * float64(time.Second)))
+	if wait := time.Until(due); wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+		}
+	}
+	return ctx.Err() == nil
+}
+
+// read hands the answers captured on l to got until ctx is done, in a
+// goroutine. The channel returned is closed when it's stopped.
+func read(ctx context.Context, l link, got func(answer, time.Time)) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for ctx.Err() == nil {
+			data, _, err := l.ReadPacketData()
+			if err != nil {
+				if !errors.Is(err, pcap.NextErrorTimeoutExpired) && ctx.Err() == nil {
+					time.Sleep(10 * time.Millisecond)
+				}
+				continue
+			}
+			if a, ok := parse(data); ok {
+				got(a, time.Now())
+			}
+		}
+	}()
+	return done
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Write prints r for people, a line per host, with the latency histogram
+// when buckets is set.
+func (r *ScanResult) Write(w io.Writer, buckets bool) {
+	for _, h := range r.Hosts {
+		fmt.Fprintf(w, "%-40s %s  %v", h.Addr, h.MAC, h.Latency.Round(time.Microsecond))
+		if h.Tries > 1 {
+			fmt.Fprintf(w, ", try %d", h.Tries)
+		}
+		if len(h.Others) > 0 {
+			fmt.Fprintf(w, ", also %s", strings.Join(h.Others, ", "))
+		}
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintf(w, "--- %s from %s on %s ---\n", r.Prefix, r.Source, r.Interface)
+	fmt.Fprintf(w, "%d of %d addresses alive, %d requests in %v, %d conflicts\n",
+		r.Alive, r.Addresses, r.Sent, r.Elapsed.Round(time.Millisecond), r.Conflicts)
+	if r.Alive > 0 {
+		r.Latency.Write(w, buckets)
+	}
+}
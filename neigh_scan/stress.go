@@ -0,0 +1,342 @@
+package neighscan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"gonet/pkg/stats"
+)
+
+// StressConfig is a neighbor table stress for Stresser.Run.
+type StressConfig struct {
+	Interface string // pcap device
+
+	// Prefix is where the fake hosts' addresses come from, by default the
+	// interface's first IPv4 network.
+	Prefix netip.Prefix
+
+	// Target is the router whose table to fill: every fake host asks it
+	// for its MAC, so it learns the host, and the answers tell whether it
+	// keeps up. Without one the hosts announce themselves with gratuitous
+	// ARPs or unsolicited advertisements, filling the tables of whatever
+	// listens.
+	Target netip.Addr
+
+	Hosts int // fake hosts, default 1000
+
+	// Churn gives each host a new MAC every round, so the entries keep
+	// changing rather than being refreshed; switches see a new MAC each
+	// frame.
+	Churn bool
+
+	// MACPrefix is the start of the hosts' MAC addresses, the rest is
+	// random. The default is 02:00:00, locally administered.
+	MACPrefix net.HardwareAddr
+
+	Rate float64 // frames per second, default 1000
+
+	// The stress ends after Frames or Duration, whichever comes first;
+	// with neither it runs until ctx is done.
+	Frames   uint64
+	Duration time.Duration
+
+	Timeout time.Duration // answers later than this count as missing, default 1s
+	Window  time.Duration // of the answers over time, default 10s
+}
+
+// StressWindow is the frames of one stretch of a stress.
+type StressWindow struct {
+	Start         time.Time     `json:"start"`
+	Sent          uint64        `json:"sent"`
+	Answered      uint64        `json:"answered"`
+	AnswerPercent float64       `json:"answer_percent"`
+	Mean          time.Duration `json:"mean_ns"`
+
+	sum time.Duration
+}
+
+// StressResult is a finished stress. Answers and latencies are only
+// there with a target.
+type StressResult struct {
+	Interface     string         `json:"interface"`
+	Prefix        string         `json:"prefix"`
+	Target        string         `json:"target,omitempty"`
+	Hosts         int            `json:"hosts"`
+	Churn         bool           `json:"churn"`
+	Sent          uint64         `json:"sent"`
+	Rounds        uint64         `json:"rounds"` // through all the hosts
+	Answered      uint64         `json:"answered"`
+	AnswerPercent float64        `json:"answer_percent"`
+	Asked         uint64         `json:"asked"` // requests of the target for fake hosts, entries it lost or checks
+	Elapsed       time.Duration  `json:"elapsed_ns"`
+	Rate          float64        `json:"rate"` // frames per second
+	Latency       stats.Latency  `json:"latency"`
+	Window        time.Duration  `json:"window_ns"`
+	Windows       []StressWindow `json:"windows"`
+}
+
+// Stresser fills neighbor tables with fake hosts. The zero value is ready
+// to use.
+type Stresser struct {
+	counters stats.Counters
+	macs     map[string]bool
+}
+
+// Counters counts the frames sent, for interval reports.
+func (s *Stresser) Counters() *stats.Counters {
+	return &s.counters
+}
+
+// Run stresses the tables cfg describes. Cancelling ctx ends it, the
+// result then covers the frames so far.
+func (s *Stresser) Run(ctx context.Context, cfg StressConfig) (*StressResult, error) {
+	l, err := lookup(cfg.Interface)
+	if err != nil {
+		return nil, err
+	}
+	if !cfg.Prefix.IsValid() {
+		if cfg.Prefix, err = l.network(cfg.Target.Is6()); err != nil {
+			return nil, err
+		}
+	}
+	handle, err := open(cfg.Interface, cfg.Prefix.Addr().Is6())
+	if err != nil {
+		return nil, err
+	}
+	defer handle.Close()
+	return s.run(ctx, cfg, l, handle)
+}
+
+// fake is one fake host.
+type fake struct {
+	addr netip.Addr
+	mac  net.HardwareAddr
+
+	sent     time.Time
+	window   int
+	answered bool
+}
+
+func (s *Stresser) run(ctx context.Context, cfg StressConfig, loc *local, l link) (*StressResult, error) {
+	if cfg.Hosts <= 0 {
+		cfg.Hosts = 1000
+	}
+	if cfg.MACPrefix == nil {
+		cfg.MACPrefix = net.HardwareAddr{0x02, 0x00, 0x00}
+	}
+	if len(cfg.MACPrefix) > 5 {
+		return nil, errors.New("MAC prefix too long, leave a byte at least")
+	}
+	if cfg.Rate <= 0 {
+		cfg.Rate = 1000
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = time.Second
+	}
+	if cfg.Window <= 0 {
+		cfg.Window = 10 * time.Second
+	}
+	if cfg.Target.IsValid() && cfg.Target.Is4() != cfg.Prefix.Addr().Is4() {
+		return nil, fmt.Errorf("target %s and network %s are of different families", cfg.Target, cfg.Prefix)
+	}
+	fakes, err := s.fakes(cfg, loc)
+	if err != nil {
+		return nil, err
+	}
+	byAddr := make(map[netip.Addr]*fake, len(fakes))
+	for _, f := range fakes {
+		byAddr[f.addr] = f
+	}
+
+	res := &StressResult{Interface: cfg.Interface, Prefix: cfg.Prefix.Masked().String(), Hosts: len(fakes), Churn: cfg.Churn, Window: cfg.Window}
+	if cfg.Target.IsValid() {
+		res.Target = cfg.Target.String()
+	}
+	var mu sync.Mutex
+	var latency stats.Histogram
+
+	readCtx, stopReading := context.WithCancel(context.Background())
+	defer stopReading()
+	reading := read(readCtx, l, func(a answer, at time.Time) {
+		mu.Lock()
+		defer mu.Unlock()
+		f := byAddr[a.to]
+		if !cfg.Target.IsValid() || a.addr != cfg.Target || f == nil {
+			return
+		}
+		if a.ask {
+			res.Asked++
+			return
+		}
+		rtt := at.Sub(f.sent)
+		if f.answered || f.sent.IsZero() || rtt > cfg.Timeout {
+			return
+		}
+		f.answered = true
+		w := &res.Windows[f.window]
+		w.Answered++
+		w.sum += rtt
+		res.Answered++
+		latency.Record(rtt)
+	})
+
+	stop := ctx
+	if cfg.Duration > 0 {
+		var cancel context.CancelFunc
+		stop, cancel = context.WithTimeout(ctx, cfg.Duration)
+		defer cancel()
+	}
+	start := time.Now()
+	for i := 0; cfg.Frames == 0 || uint64(i) < cfg.Frames; i++ {
+		if !pace(stop, start, i, cfg.Rate) {
+			break
+		}
+		f := fakes[i%len(fakes)]
+		if cfg.Churn && i >= len(fakes) {
+			delete(s.macs, string(f.mac))
+			f.mac = s.newMAC(cfg.MACPrefix)
+		}
+		var data []byte
+		if cfg.Target.IsValid() {
+			data, err = solicit(f.mac, f.addr, cfg.Target)
+		} else {
+			data, err = announce(f.mac, f.addr)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		now := time.Now()
+		mu.Lock()
+		w := int(now.Sub(start) / cfg.Window)
+		for len(res.Windows) <= w {
+			res.Windows = append(res.Windows, StressWindow{Start: start.Add(time.Duration(len(res.Windows)) * cfg.Window)})
+		}
+		res.Windows[w].Sent++
+		res.Sent++
+		f.sent, f.window, f.answered = now, w, false
+		mu.Unlock()
+		if err := l.WritePacketData(data); err != nil {
+			return nil, err
+		}
+		s.counters.Add(1, uint64(len(data)))
+	}
+	res.Elapsed = time.Since(start)
+	if cfg.Target.IsValid() && ctx.Err() == nil {
+		// The last answers.
+		select {
+		case <-time.After(cfg.Timeout):
+		case <-ctx.Done():
+		}
+	}
+	stopReading()
+	<-reading
+
+	mu.Lock()
+	defer mu.Unlock()
+	res.Rounds = res.Sent / uint64(len(fakes))
+	if secs := res.Elapsed.Seconds(); secs > 0 {
+		res.Rate = float64(res.Sent) / secs
+	}
+	res.AnswerPercent = percent(res.Answered, res.Sent)
+	res.Latency = latency.Summary()
+	for i := range res.Windows {
+		w := &res.Windows[i]
+		w.AnswerPercent = percent(w.Answered, w.Sent)
+		if w.Answered > 0 {
+			w.Mean = w.sum / time.Duration(w.Answered)
+		}
+	}
+	return res, nil
+}
+
+// fakes makes cfg.Hosts fake hosts at random addresses of cfg.Prefix,
+// none of them the target's or the interface's.
+func (s *Stresser) fakes(cfg StressConfig, loc *local) ([]*fake, error) {
+	p := cfg.Prefix.Masked()
+	bits := p.Addr().BitLen() - p.Bits()
+	if bits < 31 && 1<<bits < cfg.Hosts+3 {
+		return nil, fmt.Errorf("%s is too small for %d hosts", p, cfg.Hosts)
+	}
+	// Not the network's own addresses either.
+	reserved := map[netip.Addr]bool{p.Addr(): true, cfg.Target: true}
+	if p.Addr().Is4() && bits >= 2 {
+		b := p.Addr().As4()
+		for i := p.Bits(); i < 32; i++ {
+			b[i/8] |= 0x80 >> (i % 8)
+		}
+		reserved[netip.AddrFrom4(b)] = true
+	}
+	s.macs = map[string]bool{}
+	fakes := make([]*fake, 0, cfg.Hosts)
+	for len(fakes) < cfg.Hosts {
+		a := randomAddr(p)
+		if reserved[a] || loc.owns(a) {
+			continue
+		}
+		reserved[a] = true
+		fakes = append(fakes, &fake{addr: a, mac: s.newMAC(cfg.MACPrefix)})
+	}
+	return fakes, nil
+}
+
+// newMAC returns a MAC none of the hosts has.
+func (s *Stresser) newMAC(prefix net.HardwareAddr) net.HardwareAddr {
+	for {
+		mac := make(net.HardwareAddr, 6)
+		copy(mac, prefix)
+		for i := len(prefix); i < 6; i++ {
+			mac[i] = byte(rand.N(256))
+		}
+		if !s.macs[string(mac)] {
+			s.macs[string(mac)] = true
+			return mac
+		}
+	}
+}
+
+func percent(n, of uint64) float64 {
+	if of == 0 {
+		return 0
+	}
+	return float64(n) * 100 / float64(of)
+}
+
+// Write prints r for people, with the latency histogram when buckets is
+// set.
+func (r *StressResult) Write(w io.Writer, buckets bool) {
+	what, churn := "announcements", ""
+	if r.Target != "" {
+		what = "requests to " + r.Target
+	}
+	if r.Churn {
+		churn = ", new MACs each round"
+	}
+	fmt.Fprintf(w, "--- %d hosts in %s on %s ---\n", r.Hosts, r.Prefix, r.Interface)
+	fmt.Fprintf(w, "Sent:      %d %s in %v (%.0f/s), %d rounds%s\n",
+		r.Sent, what, r.Elapsed.Round(time.Millisecond), r.Rate, r.Rounds, churn)
+	if r.Target == "" {
+		return
+	}
+	fmt.Fprintf(w, "Answered:  %d (%.1f%%), %d requests from the target for the hosts\n", r.Answered, r.AnswerPercent, r.Asked)
+	r.Latency.Write(w, buckets)
+	if len(r.Windows) < 2 {
+		return
+	}
+	fmt.Fprintf(w, "Answers over time, %v windows:\n", r.Window)
+	start := r.Windows[0].Start
+	for _, win := range r.Windows {
+		fmt.Fprintf(w, "  %-8v %7d sent %6.1f%% answered", win.Start.Sub(start).Round(time.Second), win.Sent, win.AnswerPercent)
+		if win.Answered > 0 {
+			fmt.Fprintf(w, "  mean %v", win.Mean.Round(time.Microsecond))
+		}
+		fmt.Fprintln(w)
+	}
+}
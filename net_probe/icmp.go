@@ -0,0 +1,202 @@
+package netprobe
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// ICMP types, see RFC 792 and RFC 4443.
+const (
+	icmpEchoReply    = 0
+	icmpUnreachable  = 3
+	icmpEchoRequest  = 8
+	icmpTimeExceeded = 11
+
+	icmp6Unreachable  = 1
+	icmp6PacketTooBig = 2
+	icmp6TimeExceeded = 3
+	icmp6EchoRequest  = 128
+	icmp6EchoReply    = 129
+)
+
+// IP protocol numbers of the probes.
+const (
+	protoICMP  = 1
+	protoTCP   = 6
+	protoUDP   = 17
+	protoICMP6 = 58
+)
+
+// icmpMessage is what a received ICMP message says about a probe.
+type icmpMessage struct {
+	kind  string
+	final bool // sent by the target itself: an echo reply or port unreachable
+
+	// Of the echo request an echo reply answers or an error quotes.
+	id, seq uint16
+
+	// Next-hop MTU of a fragmentation needed or packet too big, 0 if the
+	// router didn't say.
+	mtu int
+
+	// Of the packet an error quotes, proto is 0 for echo replies.
+	proto            byte
+	srcPort, dstPort uint16
+}
+
+// parseICMP reads an ICMP message without the IP header, as raw sockets
+// return them. Messages other than echo replies and errors are left out.
+func parseICMP(v6 bool, b []byte) (icmpMessage, bool) {
+	var m icmpMessage
+	if len(b) < 8 {
+		return m, false
+	}
+	typ, code := b[0], b[1]
+	switch {
+	case !v6 && typ == icmpEchoReply, v6 && typ == icmp6EchoReply:
+		m.kind, m.final = "echo reply", true
+		m.id, m.seq = binary.BigEndian.Uint16(b[4:]), binary.BigEndian.Uint16(b[6:])
+		return m, true
+	case !v6 && typ == icmpTimeExceeded, v6 && typ == icmp6TimeExceeded:
+		m.kind = "time exceeded"
+	case !v6 && typ == icmpUnreachable:
+		m.kind = unreachable4[code]
+	case v6 && typ == icmp6Unreachable:
+		m.kind = unreachable6[code]
+	case v6 && typ == icmp6PacketTooBig:
+		m.kind, m.mtu = "packet too big", int(binary.BigEndian.Uint32(b[4:]))
+	default:
+		return m, false
+	}
+	if m.kind == "" {
+		m.kind = "unreachable"
+	}
+	if m.kind == "fragmentation needed" {
+		m.mtu = int(binary.BigEndian.Uint16(b[6:]))
+	}
+	m.final = m.kind == "port unreachable" || m.kind == "protocol unreachable"
+
+	// Errors quote the IP header and at least 8 bytes of the packet.
+	inner := b[8:]
+	var t []byte
+	if v6 {
+		if len(inner) < 48 {
+			return m, false
+		}
+		m.proto, t = inner[6], inner[40:]
+	} else {
+		if len(inner) < 20 {
+			return m, false
+		}
+		ihl := int(inner[0]&0x0f) * 4
+		if len(inner) < ihl+8 {
+			return m, false
+		}
+		m.proto, t = inner[9], inner[ihl:]
+	}
+	switch m.proto {
+	case protoICMP, protoICMP6:
+		m.id, m.seq = binary.BigEndian.Uint16(t[4:]), binary.BigEndian.Uint16(t[6:])
+	case protoTCP, protoUDP:
+		m.srcPort, m.dstPort = binary.BigEndian.Uint16(t), binary.BigEndian.Uint16(t[2:])
+	}
+	return m, true
+}
+
+var unreachable4 = map[byte]string{
+	0: "net unreachable", 1: "host unreachable", 2: "protocol unreachable", 3: "port unreachable",
+	4: "fragmentation needed", 9: "prohibited", 10: "prohibited", 13: "prohibited",
+}
+
+var unreachable6 = map[byte]string{
+	0: "net unreachable", 1: "prohibited", 3: "host unreachable", 4: "port unreachable", 5: "prohibited", 6: "prohibited",
+}
+
+// echoRequest builds an ICMP echo request with size bytes of payload.
+func echoRequest(v6 bool, id, seq uint16, size int) []byte {
+	b := make([]byte, 8+size)
+	b[0] = icmpEchoRequest
+	if v6 {
+		b[0] = icmp6EchoRequest
+	}
+	binary.BigEndian.PutUint16(b[4:], id)
+	binary.BigEndian.PutUint16(b[6:], seq)
+	for i := 8; i < len(b); i++ {
+		b[i] = byte(i)
+	}
+	// The kernel sums ICMPv6 itself, it needs the addresses.
+	if !v6 {
+		binary.BigEndian.PutUint16(b[2:], checksum(b))
+	}
+	return b
+}
+
+// checksum is the internet checksum of RFC 1071.
+func checksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// icmpConn is a raw ICMP socket, read by one probe at a time.
+type icmpConn struct {
+	conn *net.IPConn
+	v6   bool
+	mu   sync.Mutex
+}
+
+func listenICMP(v6 bool) (*icmpConn, error) {
+	network := "ip4:icmp"
+	if v6 {
+		network = "ip6:ipv6-icmp"
+	}
+	conn, err := net.ListenIP(network, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%v (raw ICMP sockets need root or CAP_NET_RAW)", err)
+	}
+	return &icmpConn{conn: conn, v6: v6}, nil
+}
+
+// errLost is a probe nothing came back for in time.
+var errLost = errors.New("timeout")
+
+// wait reads ICMP messages until match takes one, or returns errLost
+// once timeout has passed since sent.
+func (c *icmpConn) wait(ctx context.Context, sent time.Time, timeout time.Duration, match func(icmpMessage) bool) (Reply, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn.SetReadDeadline(sent.Add(timeout))
+	stop := context.AfterFunc(ctx, func() { c.conn.SetReadDeadline(time.Now()) })
+	defer stop()
+
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := c.conn.ReadFromIP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return Reply{}, ctx.Err()
+			}
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				return Reply{}, errLost
+			}
+			return Reply{}, err
+		}
+		if m, ok := parseICMP(c.v6, buf[:n]); ok && match(m) {
+			return Reply{From: from.IP, RTT: time.Since(sent), Kind: m.kind, Final: m.final, MTU: m.mtu}, nil
+		}
+	}
+}
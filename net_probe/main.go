@@ -0,0 +1,231 @@
+package netprobe
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"time"
+
+	"gonet/pkg/config"
+	"gonet/pkg/logging"
+	"gonet/pkg/results"
+	"gonet/pkg/stats"
+)
+
+// Main runs gonet probe with the arguments after the command name.
+func Main(args []string) {
+	if len(args) < 1 {
+		log.Fatal("Usage: gonet probe ping|trace|pmtu [flags] <target>")
+	}
+	switch args[0] {
+	case "ping":
+		pingCommand(args[1:])
+	case "trace", "traceroute":
+		traceCommand(args[1:])
+	case "pmtu":
+		pmtuCommand(args[1:])
+	default:
+		log.Fatalf("Unknown probe command %q, want ping, trace or pmtu", args[0])
+	}
+}
+
+func pingCommand(args []string) {
+	// Command line flags
+	flags := flag.NewFlagSet("probe ping", flag.ExitOnError)
+	proto := flags.String("proto", "icmp", "Probe with icmp echo requests (needs root), udp datagrams or tcp connects")
+	port := flags.Int("port", 0, fmt.Sprintf("Port of udp and tcp probes (default %d for udp, %d for tcp)", DefaultUDPPort, DefaultTCPPort))
+	family := flags.String("family", "", "Address family of the target, 4 or 6 (default the first address)")
+	size := flags.Int("size", 56, "Payload bytes of icmp and udp probes")
+	ttl := flags.Int("ttl", 0, "TTL of the probes (0 for the system's)")
+	count := flags.Int("c", 0, "Stop after this many probes")
+	duration := flags.Duration("duration", 0, "Stop after this long")
+	interval := flags.Duration("interval", time.Second, "Time between probes")
+	timeout := flags.Duration("timeout", 2*time.Second, "How long to wait for each reply")
+	window := flags.Duration("window", 10*time.Second, "Length of the loss over time windows")
+	quiet := flags.Bool("q", false, "Don't print each probe")
+	report := stats.RegisterFlags(flags)
+	jsonOut := flags.String("json", "", "Write the result as JSON to this file when done, - for stdout")
+	logs := logging.RegisterFlags(flags)
+	configFile := flags.String("config", "", "YAML or JSON file setting flags by name, command line flags win")
+	flags.Parse(args)
+
+	if _, err := config.LoadFlags(flags, *configFile); err != nil {
+		log.Fatalf("Invalid -config: %v", err)
+	}
+	if err := logs.Setup(); err != nil {
+		log.Fatal(err)
+	}
+	if flags.NArg() != 1 {
+		log.Fatal("Usage: gonet probe ping [flags] <target>")
+	}
+	if *size < 0 || *size > 65000 {
+		log.Fatalf("Invalid -size %d", *size)
+	}
+	cfg := PingConfig{
+		Target:   flags.Arg(0),
+		Family:   *family,
+		Proto:    *proto,
+		Port:     *port,
+		Size:     *size,
+		TTL:      *ttl,
+		Count:    *count,
+		Duration: *duration,
+		Interval: *interval,
+		Timeout:  *timeout,
+		Window:   *window,
+	}
+
+	// Stop on interrupt
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	var p Pinger
+	if !*quiet && *jsonOut != "-" {
+		p.Replies = func(seq int, r Reply, err error) {
+			if err != nil {
+				fmt.Printf("seq=%d: %s\n", seq, failure(err))
+				return
+			}
+			fmt.Printf("seq=%d from %s: %s time=%v\n", seq, r.From, r.Kind, r.RTT.Round(time.Microsecond))
+		}
+	}
+	report.Unit = "Replies"
+	reporter, err := report.Reporter(p.Counters(), "Reply", "received", "probe ping")
+	if err != nil {
+		log.Fatal(err)
+	}
+	reporter.Start()
+	res, err := p.Run(ctx, cfg)
+	reporter.Stop()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *jsonOut != "-" {
+		res.Write(os.Stdout)
+	}
+	if *jsonOut != "" {
+		if err := results.Write(*jsonOut, res); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+func traceCommand(args []string) {
+	// Command line flags
+	flags := flag.NewFlagSet("probe trace", flag.ExitOnError)
+	proto := flags.String("proto", "icmp", "Probe with icmp echo requests, udp datagrams or tcp connects; all need root for the ICMP answers")
+	port := flags.Int("port", 0, fmt.Sprintf("Port of udp and tcp probes, udp adding one per probe (default %d for udp, %d for tcp)", DefaultUDPPort, DefaultTCPPort))
+	family := flags.String("family", "", "Address family of the target, 4 or 6 (default the first address)")
+	size := flags.Int("size", 32, "Payload bytes of icmp and udp probes")
+	firstTTL := flags.Int("first", 1, "TTL to start at")
+	maxTTL := flags.Int("max", 30, "Most hops to go")
+	queries := flags.Int("q", 3, "Probes per hop and cycle")
+	timeout := flags.Duration("timeout", time.Second, "How long to wait for each answer")
+	cycles := flags.Int("cycles", 1, "Times to trace the path, for the loss on each hop over time")
+	interval := flags.Duration("interval", time.Second, "Time between cycles")
+	noNames := flags.Bool("n", false, "Don't look up the names of the hops")
+	jsonOut := flags.String("json", "", "Write the result as JSON to this file when done, - for stdout")
+	logs := logging.RegisterFlags(flags)
+	configFile := flags.String("config", "", "YAML or JSON file setting flags by name, command line flags win")
+	flags.Parse(args)
+
+	if _, err := config.LoadFlags(flags, *configFile); err != nil {
+		log.Fatalf("Invalid -config: %v", err)
+	}
+	if err := logs.Setup(); err != nil {
+		log.Fatal(err)
+	}
+	if flags.NArg() != 1 {
+		log.Fatal("Usage: gonet probe trace [flags] <target>")
+	}
+	if *size < 0 || *size > 65000 {
+		log.Fatalf("Invalid -size %d", *size)
+	}
+	cfg := TraceConfig{
+		Target:   flags.Arg(0),
+		Family:   *family,
+		Proto:    *proto,
+		Port:     *port,
+		Size:     *size,
+		FirstTTL: *firstTTL,
+		MaxTTL:   *maxTTL,
+		Queries:  *queries,
+		Timeout:  *timeout,
+		Cycles:   *cycles,
+		Interval: *interval,
+		NoNames:  *noNames,
+	}
+
+	// Stop on interrupt
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	res, err := Trace(ctx, cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *jsonOut != "-" {
+		res.Write(os.Stdout)
+	}
+	if *jsonOut != "" {
+		if err := results.Write(*jsonOut, res); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+func pmtuCommand(args []string) {
+	// Command line flags
+	flags := flag.NewFlagSet("probe pmtu", flag.ExitOnError)
+	proto := flags.String("proto", "icmp", "Probe with icmp echo requests or udp datagrams; both need root for the ICMP answers")
+	port := flags.Int("port", 0, fmt.Sprintf("Port of udp probes, adding one per probe (default %d)", DefaultUDPPort))
+	family := flags.String("family", "", "Address family of the target, 4 or 6 (default the first address)")
+	maxSize := flags.Int("max", 1500, "Packet size to start from, IP header included")
+	maxTTL := flags.Int("max-ttl", 30, "Most hops to go")
+	queries := flags.Int("q", 2, "Tries of each size before it counts as lost")
+	timeout := flags.Duration("timeout", time.Second, "How long to wait for each answer")
+	jsonOut := flags.String("json", "", "Write the result as JSON to this file when done, - for stdout")
+	logs := logging.RegisterFlags(flags)
+	configFile := flags.String("config", "", "YAML or JSON file setting flags by name, command line flags win")
+	flags.Parse(args)
+
+	if _, err := config.LoadFlags(flags, *configFile); err != nil {
+		log.Fatalf("Invalid -config: %v", err)
+	}
+	if err := logs.Setup(); err != nil {
+		log.Fatal(err)
+	}
+	if flags.NArg() != 1 {
+		log.Fatal("Usage: gonet probe pmtu [flags] <target>")
+	}
+	cfg := PMTUConfig{
+		Target:  flags.Arg(0),
+		Family:  *family,
+		Proto:   *proto,
+		Port:    *port,
+		Max:     *maxSize,
+		MaxTTL:  *maxTTL,
+		Queries: *queries,
+		Timeout: *timeout,
+	}
+
+	// Stop on interrupt
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	res, err := DiscoverPMTU(ctx, cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *jsonOut != "-" {
+		res.Write(os.Stdout)
+	}
+	if *jsonOut != "" {
+		if err := results.Write(*jsonOut, res); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package netprobe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"time"
+
+	"gonet/pkg/stats"
+)
+
+// PingConfig is a ping for Pinger.Run.
+type PingConfig struct {
+	Target string // host name or address
+	Family string // "4" or "6" to pick the target's address family
+	Proto  string // icmp, udp or tcp
+	Port   int    // of udp and tcp probes, 0 for DefaultUDPPort or DefaultTCPPort
+	Size   int    // payload bytes of icmp and udp probes
+	TTL    int    // 0 for the system's
+
+	// The ping ends after Count probes or Duration, whichever comes
+	// first; with neither it runs until ctx is done.
+	Count    int
+	Duration time.Duration
+
+	Interval time.Duration // between probes, default 1s
+	Timeout  time.Duration // of each probe, default 2s
+	Window   time.Duration // of the loss over time, default 10s
+}
+
+// Window is the probes of one stretch of a ping.
+type Window struct {
+	Start       time.Time     `json:"start"`
+	Sent        uint64        `json:"sent"`
+	Received    uint64        `json:"received"`
+	LossPercent float64       `json:"loss_percent"`
+	Mean        time.Duration `json:"mean_ns"`
+
+	sum time.Duration
+}
+
+// PingResult is a finished ping.
+type PingResult struct {
+	Target      string            `json:"target"`
+	Addr        string            `json:"addr"`
+	Proto       string            `json:"proto"`
+	Sent        uint64            `json:"sent"`
+	Received    uint64            `json:"received"`
+	LossPercent float64           `json:"loss_percent"`
+	Failures    map[string]uint64 `json:"failures,omitempty"` // lost probes by reason
+	Elapsed     time.Duration     `json:"elapsed_ns"`
+	Latency     stats.Latency     `json:"latency"`
+	Window      time.Duration     `json:"window_ns"`
+	Windows     []Window          `json:"windows"`
+}
+
+// Pinger probes a target at an interval.
+type Pinger struct {
+	// Replies, if set, gets each probe as it's done, err being errLost
+	// or the like when nothing came back from the target.
+	Replies func(seq int, r Reply, err error)
+
+	counters stats.Counters
+}
+
+// Counters counts the replies, for interval reports.
+func (p *Pinger) Counters() *stats.Counters {
+	return &p.counters
+}
+
+// Run pings the target cfg describes. Cancelling ctx ends it, the result
+// then covers the probes done so far.
+func (p *Pinger) Run(ctx context.Context, cfg PingConfig) (*PingResult, error) {
+	if cfg.Interval <= 0 {
+		cfg.Interval = time.Second
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 2 * time.Second
+	}
+	if cfg.Window <= 0 {
+		cfg.Window = 10 * time.Second
+	}
+	dst, err := resolve(ctx, cfg.Target, cfg.Family)
+	if err != nil {
+		return nil, err
+	}
+	pr, err := newProber(proberConfig{proto: cfg.Proto, dst: dst, port: cfg.Port, timeout: cfg.Timeout})
+	if err != nil {
+		return nil, err
+	}
+	defer pr.Close()
+	if cfg.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.Duration)
+		defer cancel()
+	}
+
+	res := &PingResult{Target: cfg.Target, Addr: dst.String(), Proto: cfg.Proto, Failures: map[string]uint64{}, Window: cfg.Window}
+	var latency stats.Histogram
+	tick := time.NewTicker(cfg.Interval)
+	defer tick.Stop()
+	start := time.Now()
+	for seq := 0; cfg.Count == 0 || seq < cfg.Count; seq++ {
+		if seq > 0 {
+			select {
+			case <-tick.C:
+			case <-ctx.Done():
+			}
+		}
+		began := time.Now()
+		r, err := pr.probe(ctx, cfg.TTL, uint16(seq), cfg.Size)
+		if ctx.Err() != nil {
+			// Cut short by the end, not lost.
+			break
+		}
+
+		i := int(began.Sub(start) / cfg.Window)
+		for len(res.Windows) <= i {
+			res.Windows = append(res.Windows, Window{Start: start.Add(time.Duration(len(res.Windows)) * cfg.Window)})
+		}
+		w := &res.Windows[i]
+		res.Sent++
+		w.Sent++
+		switch {
+		case err == nil && r.Final:
+			res.Received++
+			w.Received++
+			w.sum += r.RTT
+			latency.Record(r.RTT)
+			p.counters.Add(1, uint64(cfg.Size))
+		case err == nil:
+			res.Failures[r.Kind]++
+		default:
+			res.Failures[failure(err)]++
+		}
+		if p.Replies != nil {
+			p.Replies(seq, r, err)
+		}
+	}
+	res.Elapsed = time.Since(start)
+	res.Latency = latency.Summary()
+	res.LossPercent = lossPercent(res.Sent, res.Received)
+	for i := range res.Windows {
+		w := &res.Windows[i]
+		w.LossPercent = lossPercent(w.Sent, w.Received)
+		if w.Received > 0 {
+			w.Mean = w.sum / time.Duration(w.Received)
+		}
+	}
+	return res, nil
+}
+
+// resolve returns the first address of host in family, "4", "6" or
+// either when empty.
+func resolve(ctx context.Context, host, family string) (net.IP, error) {
+	if family != "" && family != "4" && family != "6" {
+		return nil, fmt.Errorf("invalid address family %q, want 4 or 6", family)
+	}
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip"+family, host)
+	if err != nil {
+		return nil, err
+	}
+	return ips[0], nil
+}
+
+// failure names why a probe failed, without the socket call around it.
+func failure(err error) string {
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		return errno.Error()
+	}
+	return err.Error()
+}
+
+func lossPercent(sent, received uint64) float64 {
+	if sent == 0 {
+		return 0
+	}
+	return float64(sent-received) * 100 / float64(sent)
+}
+
+// Write prints r for people, with the loss over time when the ping spans
+// more than one window.
+func (r *PingResult) Write(w io.Writer) {
+	fmt.Fprintf(w, "--- %s (%s) %s ping ---\n", r.Target, r.Addr, r.Proto)
+	fmt.Fprintf(w, "Probes:    %d sent, %d received, %.1f%% loss in %v\n", r.Sent, r.Received, r.LossPercent, r.Elapsed.Round(time.Millisecond))
+	if len(r.Failures) > 0 {
+		fmt.Fprintf(w, "Failures:  %s\n", stats.Counts(r.Failures))
+	}
+	r.Latency.Write(w, false)
+	if len(r.Windows) < 2 {
+		return
+	}
+	fmt.Fprintf(w, "Loss over time, %v windows:\n", r.Window)
+	start := r.Windows[0].Start
+	for _, win := range r.Windows {
+		fmt.Fprintf(w, "  %-8v %6d sent %6.1f%% loss", win.Start.Sub(start).Round(time.Second), win.Sent, win.LossPercent)
+		if win.Received > 0 {
+			fmt.Fprintf(w, "  mean %v", win.Mean.Round(time.Microsecond))
+		}
+		fmt.Fprintln(w)
+	}
+}
@@ -0,0 +1,207 @@
+package netprobe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"syscall"
+	"time"
+)
+
+// PMTUConfig is a path MTU discovery for DiscoverPMTU. Sizes are of
+// whole IP packets.
+type PMTUConfig struct {
+	Target string // host name or address
+	Family string // "4" or "6" to pick the target's address family
+	Proto  string // icmp or udp
+	Port   int    // of udp probes, 0 for DefaultUDPPort
+
+	Max     int           // size to start from, default 1500
+	MaxTTL  int           // default 30
+	Queries int           // tries of each size before it counts as lost, default 2
+	Timeout time.Duration // of each probe, default 1s
+}
+
+// PMTUHop is the size that gets to one hop.
+type PMTUHop struct {
+	TTL  int    `json:"ttl"`
+	Addr string `json:"addr,omitempty"` // empty when the hop didn't answer
+	MTU  int    `json:"mtu"`
+}
+
+// MTUDrop is where the path MTU goes down.
+type MTUDrop struct {
+	TTL    int    `json:"ttl"`              // of the probe that found it
+	Router string `json:"router,omitempty"` // that said so, empty when found by search
+	From   int    `json:"from"`
+	To     int    `json:"to"`
+	Reason string `json:"reason"`
+}
+
+// PMTUResult is a finished discovery. PMTU is the largest packet that
+// got to the last hop, the target when Reached.
+type PMTUResult struct {
+	Target  string        `json:"target"`
+	Addr    string        `json:"addr"`
+	Proto   string        `json:"proto"`
+	PMTU    int           `json:"pmtu"`
+	Reached bool          `json:"reached"`
+	Elapsed time.Duration `json:"elapsed_ns"`
+	Hops    []PMTUHop     `json:"hops"`
+	Drops   []MTUDrop     `json:"drops,omitempty"`
+}
+
+// DiscoverPMTU walks the path to the target like a trace, with don't
+// fragment probes as big as the path MTU found so far. Fragmentation
+// needed and packet too big answers lower it to the MTU the router
+// gives; hops that only drop the bigger probes, and routers that give no
+// MTU, are searched for the largest size that passes. Cancelling ctx
+// ends it, the result then covers the hops done so far.
+func DiscoverPMTU(ctx context.Context, cfg PMTUConfig) (*PMTUResult, error) {
+	if cfg.Max <= 0 {
+		cfg.Max = 1500
+	}
+	if cfg.MaxTTL <= 0 {
+		cfg.MaxTTL = 30
+	}
+	if cfg.Queries <= 0 {
+		cfg.Queries = 2
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = time.Second
+	}
+	if cfg.Proto != "icmp" && cfg.Proto != "udp" {
+		return nil, fmt.Errorf("invalid protocol %q, want icmp or udp", cfg.Proto)
+	}
+	dst, err := resolve(ctx, cfg.Target, cfg.Family)
+	if err != nil {
+		return nil, err
+	}
+	// The smallest MTU a link may have, the probes' own headers.
+	floor, overhead := 68, 20+8
+	if dst.To4() == nil {
+		floor, overhead = 1280, 40+8
+	}
+	if cfg.Max < floor || cfg.Max > 65535 {
+		return nil, fmt.Errorf("invalid size %d, want %d to 65535", cfg.Max, floor)
+	}
+	pr, err := newProber(proberConfig{proto: cfg.Proto, dst: dst, port: cfg.Port, timeout: cfg.Timeout, routers: true, df: true})
+	if err != nil {
+		return nil, err
+	}
+	defer pr.Close()
+
+	var seq uint16
+	try := func(ttl, size int) (Reply, error) {
+		for range cfg.Queries {
+			seq++
+			r, err := pr.probe(ctx, ttl, seq, size-overhead)
+			if !errors.Is(err, errLost) {
+				return r, err
+			}
+		}
+		return Reply{}, errLost
+	}
+	passes := func(r Reply, err error) bool {
+		return err == nil && r.Kind != "fragmentation needed" && r.Kind != "packet too big"
+	}
+	// search finds the largest size between lo, which passes, and hi,
+	// which doesn't.
+	search := func(ttl, lo, hi int) int {
+		for hi-lo > 1 && ctx.Err() == nil {
+			mid := (lo + hi) / 2
+			if passes(try(ttl, mid)) {
+				lo = mid
+			} else {
+				hi = mid
+			}
+		}
+		return lo
+	}
+
+	res := &PMTUResult{Target: cfg.Target, Addr: dst.String(), Proto: cfg.Proto}
+	mtu := cfg.Max
+	start := time.Now()
+walk:
+	for ttl := 1; ttl <= cfg.MaxTTL && ctx.Err() == nil; {
+		r, err := try(ttl, mtu)
+		if ctx.Err() != nil {
+			break
+		}
+		drop := MTUDrop{TTL: ttl, From: mtu}
+		switch {
+		case err == nil && !passes(r, err):
+			drop.Router, drop.Reason, drop.To = r.From.String(), r.Kind, r.MTU
+			if drop.To < floor || drop.To >= mtu {
+				// No usable MTU in the answer.
+				drop.To = search(ttl, floor, mtu)
+			}
+		case errors.Is(err, syscall.EMSGSIZE):
+			drop.Reason, drop.To = "local interface", search(ttl, floor, mtu)
+		case err == nil:
+			res.Hops = append(res.Hops, PMTUHop{TTL: ttl, Addr: r.From.String(), MTU: mtu})
+			if r.Kind != "time exceeded" {
+				res.Reached = r.Final
+				break walk
+			}
+			ttl++
+			continue
+		case errors.Is(err, errLost):
+			// A hop that doesn't answer, or a black hole that drops what's
+			// too big without saying so.
+			if mtu > floor && passes(try(ttl, floor)) {
+				drop.Reason, drop.To = "no answer to bigger probes", search(ttl, floor, mtu)
+				break
+			}
+			res.Hops = append(res.Hops, PMTUHop{TTL: ttl, MTU: mtu})
+			ttl++
+			continue
+		default:
+			return nil, err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		if drop.To >= mtu {
+			// Even the smallest size is too big; there's no going on.
+			return nil, fmt.Errorf("hop %d: %s at %d bytes", ttl, drop.Reason, mtu)
+		}
+		res.Drops = append(res.Drops, drop)
+		mtu = drop.To
+	}
+	res.PMTU = mtu
+	res.Elapsed = time.Since(start)
+	return res, nil
+}
+
+// Write prints r for people, the drops before the hop they were found at.
+func (r *PMTUResult) Write(w io.Writer) {
+	fmt.Fprintf(w, "--- %s (%s) %s path MTU ---\n", r.Target, r.Addr, r.Proto)
+	drops := r.Drops
+	writeDrops := func(ttl int) {
+		for len(drops) > 0 && drops[0].TTL <= ttl {
+			d := drops[0]
+			fmt.Fprintf(w, "     %d -> %d: %s", d.From, d.To, d.Reason)
+			if d.Router != "" {
+				fmt.Fprintf(w, " from %s", d.Router)
+			}
+			fmt.Fprintln(w)
+			drops = drops[1:]
+		}
+	}
+	for _, h := range r.Hops {
+		writeDrops(h.TTL)
+		addr := h.Addr
+		if addr == "" {
+			addr = "*"
+		}
+		fmt.Fprintf(w, "%3d  %-40s %d\n", h.TTL, addr, h.MTU)
+	}
+	writeDrops(256)
+	if r.Reached {
+		fmt.Fprintf(w, "Path MTU:  %d\n", r.PMTU)
+	} else {
+		fmt.Fprintf(w, "Path MTU:  %d or less, target not reached\n", r.PMTU)
+	}
+}
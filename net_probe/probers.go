@@ -0,0 +1,259 @@
+package netprobe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Reply is what came back for a probe.
+type Reply struct {
+	From net.IP
+	RTT  time.Duration
+	Kind string // echo reply, time exceeded, port unreachable, tcp open...
+	MTU  int    // next-hop MTU of a fragmentation needed or packet too big
+
+	// Final is set when the reply comes from the target rather than a
+	// router on the way.
+	Final bool
+}
+
+// prober sends one probe at a time, with size bytes of payload where the
+// protocol has one. A probe that gets no answer within the timeout
+// returns errLost.
+type prober interface {
+	probe(ctx context.Context, ttl int, seq uint16, size int) (Reply, error)
+	Close() error
+}
+
+// Default ports of the UDP and TCP probes.
+const (
+	DefaultUDPPort = 33434
+	DefaultTCPPort = 80
+)
+
+// proberConfig is what newProber needs.
+type proberConfig struct {
+	proto   string // icmp, udp or tcp
+	dst     net.IP
+	port    int // of udp and tcp probes, 0 for the default
+	timeout time.Duration
+
+	// routers has the UDP and TCP probers listen for ICMP too, as routers
+	// answer with nothing else; ICMP probers always do.
+	routers bool
+
+	df bool // set don't fragment, and send probes bigger than the path MTU
+}
+
+// newProber makes the prober cfg describes.
+func newProber(cfg proberConfig) (prober, error) {
+	v6 := cfg.dst.To4() == nil
+	var icmp *icmpConn
+	if cfg.proto == "icmp" || cfg.routers {
+		var err error
+		if icmp, err = listenICMP(v6); err != nil {
+			return nil, err
+		}
+		if cfg.df {
+			raw, err := icmp.conn.SyscallConn()
+			if err == nil {
+				err = setDF(raw, v6)
+			}
+			if err != nil {
+				icmp.conn.Close()
+				return nil, err
+			}
+		}
+	}
+	switch cfg.proto {
+	case "icmp":
+		return &icmpProber{icmp: icmp, dst: cfg.dst, id: uint16(rand.N(1 << 16)), timeout: cfg.timeout}, nil
+	case "udp":
+		if cfg.port == 0 {
+			cfg.port = DefaultUDPPort
+		}
+		return &udpProber{icmp: icmp, dst: cfg.dst, port: cfg.port, df: cfg.df, timeout: cfg.timeout}, nil
+	case "tcp":
+		if cfg.port == 0 {
+			cfg.port = DefaultTCPPort
+		}
+		return &tcpProber{icmp: icmp, dst: cfg.dst, port: cfg.port, timeout: cfg.timeout}, nil
+	}
+	if icmp != nil {
+		icmp.conn.Close()
+	}
+	return nil, fmt.Errorf("unknown protocol %q, want icmp, udp or tcp", cfg.proto)
+}
+
+// icmpProber sends echo requests on a raw socket.
+type icmpProber struct {
+	icmp    *icmpConn
+	dst     net.IP
+	id      uint16
+	timeout time.Duration
+}
+
+func (p *icmpProber) probe(ctx context.Context, ttl int, seq uint16, size int) (Reply, error) {
+	if ttl > 0 {
+		raw, err := p.icmp.conn.SyscallConn()
+		if err != nil {
+			return Reply{}, err
+		}
+		if err := setTTL(raw, p.icmp.v6, ttl); err != nil {
+			return Reply{}, err
+		}
+	}
+	sent := time.Now()
+	if _, err := p.icmp.conn.WriteToIP(echoRequest(p.icmp.v6, p.id, seq, size), &net.IPAddr{IP: p.dst}); err != nil {
+		return Reply{}, err
+	}
+	return p.icmp.wait(ctx, sent, p.timeout, func(m icmpMessage) bool {
+		return m.id == p.id && m.seq == seq && (m.proto == 0 || m.proto == protoICMP || m.proto == protoICMP6)
+	})
+}
+
+func (p *icmpProber) Close() error {
+	return p.icmp.conn.Close()
+}
+
+// udpProber sends each datagram from a new socket. Without an ICMP
+// listener a closed port shows as a refused read, no root needed; traces
+// add the sequence number to the port, like traceroute.
+type udpProber struct {
+	icmp    *icmpConn
+	dst     net.IP
+	port    int
+	df      bool
+	timeout time.Duration
+}
+
+func (p *udpProber) probe(ctx context.Context, ttl int, seq uint16, size int) (Reply, error) {
+	port := p.port
+	if p.icmp != nil {
+		port = (p.port + int(seq)) % 65536
+	}
+	d := net.Dialer{Control: probeControl(ttl, p.df, nil)}
+	conn, err := d.DialContext(ctx, "udp", net.JoinHostPort(p.dst.String(), strconv.Itoa(port)))
+	if err != nil {
+		return Reply{}, err
+	}
+	defer conn.Close()
+	local := uint16(conn.LocalAddr().(*net.UDPAddr).Port)
+
+	sent := time.Now()
+	if _, err := conn.Write(make([]byte, size)); err != nil {
+		return Reply{}, err
+	}
+	if p.icmp != nil {
+		return p.icmp.wait(ctx, sent, p.timeout, func(m icmpMessage) bool {
+			return m.proto == protoUDP && m.srcPort == local && m.dstPort == uint16(port)
+		})
+	}
+
+	conn.SetReadDeadline(sent.Add(p.timeout))
+	stop := context.AfterFunc(ctx, func() { conn.SetReadDeadline(time.Now()) })
+	defer stop()
+	_, err = conn.Read(make([]byte, 1500))
+	switch {
+	case err == nil:
+		return Reply{From: p.dst, RTT: time.Since(sent), Kind: "udp reply", Final: true}, nil
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return Reply{From: p.dst, RTT: time.Since(sent), Kind: "port unreachable", Final: true}, nil
+	case ctx.Err() != nil:
+		return Reply{}, ctx.Err()
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return Reply{}, errLost
+	}
+	return Reply{}, err
+}
+
+func (p *udpProber) Close() error {
+	if p.icmp != nil {
+		return p.icmp.conn.Close()
+	}
+	return nil
+}
+
+// tcpProber times connects; an accept and a reset both mean the target
+// answered.
+type tcpProber struct {
+	icmp    *icmpConn
+	dst     net.IP
+	port    int
+	timeout time.Duration
+}
+
+func (p *tcpProber) probe(ctx context.Context, ttl int, seq uint16, size int) (Reply, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	// The local port is needed to match ICMP errors before the connect
+	// is done, so the socket is bound first.
+	var bound chan int
+	if p.icmp != nil {
+		bound = make(chan int, 1)
+	}
+	d := net.Dialer{Control: probeControl(ttl, false, bound)}
+	type dialed struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan dialed, 1)
+	sent := time.Now()
+	go func() {
+		conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(p.dst.String(), strconv.Itoa(p.port)))
+		done <- dialed{conn, err}
+	}()
+
+	var routers chan Reply
+	if p.icmp != nil {
+		routers = make(chan Reply, 1)
+		go func() {
+			var local int
+			select {
+			case local = <-bound:
+			case <-ctx.Done():
+				return
+			}
+			r, err := p.icmp.wait(ctx, sent, p.timeout, func(m icmpMessage) bool {
+				return m.proto == protoTCP && m.srcPort == uint16(local) && m.dstPort == uint16(p.port)
+			})
+			if err == nil {
+				routers <- r
+			}
+		}()
+	}
+
+	select {
+	case r := <-routers:
+		return r, nil
+	case d := <-done:
+		rtt := time.Since(sent)
+		switch {
+		case d.err == nil:
+			d.conn.Close()
+			return Reply{From: p.dst, RTT: rtt, Kind: "tcp open", Final: true}, nil
+		case errors.Is(d.err, syscall.ECONNREFUSED):
+			return Reply{From: p.dst, RTT: rtt, Kind: "tcp refused", Final: true}, nil
+		case ctx.Err() == context.DeadlineExceeded:
+			return Reply{}, errLost
+		case ctx.Err() != nil:
+			return Reply{}, ctx.Err()
+		}
+		return Reply{}, d.err
+	}
+}
+
+func (p *tcpProber) Close() error {
+	if p.icmp != nil {
+		return p.icmp.conn.Close()
+	}
+	return nil
+}
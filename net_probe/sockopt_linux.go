@@ -0,0 +1,91 @@
+package netprobe
+
+import (
+	"strings"
+	"syscall"
+)
+
+// setTTL sets the TTL, or the hop limit over IPv6, of the packets a
+// socket sends.
+func setTTL(c syscall.RawConn, v6 bool, ttl int) error {
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		if v6 {
+			err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS, ttl)
+		} else {
+			err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TTL, ttl)
+		}
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// IPV6_DONTFRAG, see linux/in6.h.
+const ipv6DontFrag = 62
+
+// setDF has a socket send with don't fragment set, whatever the kernel
+// knows of the path MTU, so that too big probes reach the router that
+// can't pass them on.
+func setDF(c syscall.RawConn, v6 bool) error {
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		if v6 {
+			if err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_PROBE); err == nil {
+				err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, ipv6DontFrag, 1)
+			}
+		} else {
+			err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_PROBE)
+		}
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// probeControl sets the TTL of a dialed socket unless ttl is 0, sets
+// don't fragment with df and, if bound is set, binds the socket and
+// sends its port there before the connect.
+func probeControl(ttl int, df bool, bound chan<- int) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		v6 := strings.HasSuffix(network, "6")
+		if ttl > 0 {
+			if err := setTTL(c, v6, ttl); err != nil {
+				return err
+			}
+		}
+		if df {
+			if err := setDF(c, v6); err != nil {
+				return err
+			}
+		}
+		if bound == nil {
+			return nil
+		}
+		var err error
+		cerr := c.Control(func(fd uintptr) {
+			var sa syscall.Sockaddr = &syscall.SockaddrInet4{}
+			if v6 {
+				sa = &syscall.SockaddrInet6{}
+			}
+			if err = syscall.Bind(int(fd), sa); err != nil {
+				return
+			}
+			if sa, err = syscall.Getsockname(int(fd)); err != nil {
+				return
+			}
+			switch sa := sa.(type) {
+			case *syscall.SockaddrInet4:
+				bound <- sa.Port
+			case *syscall.SockaddrInet6:
+				bound <- sa.Port
+			}
+		})
+		if cerr != nil {
+			return cerr
+		}
+		return err
+	}
+}
@@ -0,0 +1,27 @@
+//go:build !linux
+
+package netprobe
+
+import (
+	"errors"
+	"syscall"
+)
+
+var errTTLUnsupported = errors.New("setting the TTL or don't fragment of probes is only supported on Linux")
+
+func setTTL(c syscall.RawConn, v6 bool, ttl int) error {
+	return errTTLUnsupported
+}
+
+func setDF(c syscall.RawConn, v6 bool) error {
+	return errTTLUnsupported
+}
+
+func probeControl(ttl int, df bool, bound chan<- int) func(network, address string, c syscall.RawConn) error {
+	if ttl == 0 && !df && bound == nil {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		return errTTLUnsupported
+	}
+}
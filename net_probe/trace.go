@@ -0,0 +1,224 @@
+package netprobe
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"gonet/pkg/stats"
+)
+
+// TraceConfig is a traceroute for Trace.
+type TraceConfig struct {
+	Target string // host name or address
+	Family string // "4" or "6" to pick the target's address family
+	Proto  string // icmp, udp or tcp
+	Port   int    // of udp and tcp probes, 0 for DefaultUDPPort or DefaultTCPPort
+	Size   int    // payload bytes of icmp and udp probes
+
+	FirstTTL int           // default 1
+	MaxTTL   int           // default 30
+	Queries  int           // probes per hop and cycle, default 3
+	Timeout  time.Duration // of each probe, default 1s
+
+	// Cycles repeats the trace, an Interval apart, to see the loss on
+	// each hop over time. The default is one.
+	Cycles   int
+	Interval time.Duration
+
+	NoNames bool // don't look up the names of the hops
+}
+
+// Hop is what answered probes with one TTL.
+type Hop struct {
+	TTL         int           `json:"ttl"`
+	Addrs       []string      `json:"addrs"` // most answers first
+	Names       []string      `json:"names,omitempty"`
+	Sent        uint64        `json:"sent"`
+	Received    uint64        `json:"received"`
+	LossPercent float64       `json:"loss_percent"`
+	Kinds       []string      `json:"kinds,omitempty"` // of answers other than time exceeded
+	Latency     stats.Latency `json:"latency"`
+
+	from    map[string]uint64
+	kinds   map[string]bool
+	latency stats.Histogram
+}
+
+// TraceResult is a finished trace.
+type TraceResult struct {
+	Target  string        `json:"target"`
+	Addr    string        `json:"addr"`
+	Proto   string        `json:"proto"`
+	Cycles  int           `json:"cycles"`
+	Reached bool          `json:"reached"` // the target answered
+	Elapsed time.Duration `json:"elapsed_ns"`
+	Hops    []*Hop        `json:"hops"`
+}
+
+// Trace finds the hops to the target cfg describes. Cancelling ctx ends
+// it, the result then covers the cycles done so far.
+func Trace(ctx context.Context, cfg TraceConfig) (*TraceResult, error) {
+	if cfg.FirstTTL <= 0 {
+		cfg.FirstTTL = 1
+	}
+	if cfg.MaxTTL <= 0 {
+		cfg.MaxTTL = 30
+	}
+	if cfg.MaxTTL > 255 || cfg.FirstTTL > cfg.MaxTTL {
+		return nil, fmt.Errorf("invalid TTLs %d to %d", cfg.FirstTTL, cfg.MaxTTL)
+	}
+	if cfg.Queries <= 0 {
+		cfg.Queries = 3
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = time.Second
+	}
+	if cfg.Cycles <= 0 {
+		cfg.Cycles = 1
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = time.Second
+	}
+	dst, err := resolve(ctx, cfg.Target, cfg.Family)
+	if err != nil {
+		return nil, err
+	}
+	pr, err := newProber(proberConfig{proto: cfg.Proto, dst: dst, port: cfg.Port, timeout: cfg.Timeout, routers: true})
+	if err != nil {
+		return nil, err
+	}
+	defer pr.Close()
+
+	res := &TraceResult{Target: cfg.Target, Addr: dst.String(), Proto: cfg.Proto}
+	hops := map[int]*Hop{}
+	last := cfg.MaxTTL
+	var seq uint16
+	start := time.Now()
+cycles:
+	for cycle := 0; cycle < cfg.Cycles; cycle++ {
+		if cycle > 0 {
+			select {
+			case <-time.After(cfg.Interval):
+			case <-ctx.Done():
+				break cycles
+			}
+		}
+		for ttl := cfg.FirstTTL; ttl <= last; ttl++ {
+			h := hops[ttl]
+			if h == nil {
+				h = &Hop{TTL: ttl, from: map[string]uint64{}, kinds: map[string]bool{}}
+				hops[ttl] = h
+			}
+			stop := false
+			for range cfg.Queries {
+				seq++
+				r, err := pr.probe(ctx, ttl, seq, cfg.Size)
+				if ctx.Err() != nil {
+					break cycles
+				}
+				h.Sent++
+				if err != nil {
+					continue
+				}
+				h.Received++
+				h.from[r.From.String()]++
+				h.latency.Record(r.RTT)
+				if r.Kind != "time exceeded" {
+					// The target, or a router that won't pass the
+					// probes on: either way the end of the path.
+					h.kinds[r.Kind] = true
+					stop = true
+					res.Reached = res.Reached || r.Final
+				}
+			}
+			if stop {
+				last = ttl
+				break
+			}
+		}
+		res.Cycles++
+	}
+	res.Elapsed = time.Since(start)
+
+	for ttl := cfg.FirstTTL; ttl <= cfg.MaxTTL; ttl++ {
+		h := hops[ttl]
+		if h == nil || ttl > last {
+			continue
+		}
+		h.LossPercent = lossPercent(h.Sent, h.Received)
+		h.Latency = h.latency.Summary()
+		for a := range h.from {
+			h.Addrs = append(h.Addrs, a)
+		}
+		sort.Slice(h.Addrs, func(i, j int) bool {
+			if h.from[h.Addrs[i]] != h.from[h.Addrs[j]] {
+				return h.from[h.Addrs[i]] > h.from[h.Addrs[j]]
+			}
+			return h.Addrs[i] < h.Addrs[j]
+		})
+		for k := range h.kinds {
+			h.Kinds = append(h.Kinds, k)
+		}
+		sort.Strings(h.Kinds)
+		if !cfg.NoNames {
+			h.Names = lookupNames(ctx, h.Addrs)
+		}
+		res.Hops = append(res.Hops, h)
+	}
+	return res, nil
+}
+
+// lookupNames returns the reverse DNS names of addrs, empty where there
+// is none.
+func lookupNames(ctx context.Context, addrs []string) []string {
+	if len(addrs) == 0 {
+		return nil
+	}
+	names := make([]string, len(addrs))
+	found := false
+	for i, a := range addrs {
+		lctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+		if ns, err := net.DefaultResolver.LookupAddr(lctx, a); err == nil && len(ns) > 0 {
+			names[i] = strings.TrimSuffix(ns[0], ".")
+			found = true
+		}
+		cancel()
+	}
+	if !found {
+		return nil
+	}
+	return names
+}
+
+// Write prints r for people, a line per hop.
+func (r *TraceResult) Write(w io.Writer) {
+	fmt.Fprintf(w, "--- %s (%s) %s trace, %d cycles ---\n", r.Target, r.Addr, r.Proto, r.Cycles)
+	for _, h := range r.Hops {
+		if h.Received == 0 {
+			fmt.Fprintf(w, "%3d  *\n", h.TTL)
+			continue
+		}
+		addrs := make([]string, len(h.Addrs))
+		for i, a := range h.Addrs {
+			addrs[i] = a
+			if i < len(h.Names) && h.Names[i] != "" {
+				addrs[i] = fmt.Sprintf("%s (%s)", h.Names[i], a)
+			}
+		}
+		fmt.Fprintf(w, "%3d  %s\n     %d/%d answered, %.1f%% loss, min %v, mean %v, max %v",
+			h.TTL, strings.Join(addrs, ", "), h.Received, h.Sent, h.LossPercent,
+			h.Latency.Min.Round(time.Microsecond), h.Latency.Mean.Round(time.Microsecond), h.Latency.Max.Round(time.Microsecond))
+		if len(h.Kinds) > 0 {
+			fmt.Fprintf(w, ", %s", strings.Join(h.Kinds, ", "))
+		}
+		fmt.Fprintln(w)
+	}
+	if !r.Reached {
+		fmt.Fprintln(w, "Target not reached")
+	}
+}
@@ -0,0 +1,44 @@
+// Package afxdp sends and receives frames through AF_XDP sockets, the
+// kernel's path between a NIC queue and a memory area shared with user
+// space (the UMEM), skipping the network stack and pcap's per packet
+// system calls. Drivers with XDP support move the frames without copying
+// them; the others, like veth, fall back to copy mode. Receiving needs an
+// XDP program steering the frames to the sockets, see LoadRedirect. It is
+// Linux only, Open fails elsewhere.
+package afxdp
+
+// Config describes the socket to open.
+type Config struct {
+	Interface string // by name
+	Queue     int    // NIC queue to bind to
+	Receive   bool   // set up for receiving instead of sending
+
+	// Frames is the number of UMEM frames of FrameSize bytes, a power of
+	// two; the TX or RX ring has as many slots.
+	Frames    int
+	FrameSize int
+}
+
+// Defaults for the zero Config fields.
+const (
+	DefaultFrames    = 4096
+	DefaultFrameSize = 2048
+)
+
+func (c Config) withDefaults() Config {
+	if c.Frames == 0 {
+		c.Frames = DefaultFrames
+	}
+	if c.FrameSize == 0 {
+		c.FrameSize = DefaultFrameSize
+	}
+	return c
+}
+
+// Stats are the kernel's counters of a receiving socket.
+type Stats struct {
+	Dropped   uint64 `json:"dropped"`    // frames dropped for any reason
+	Invalid   uint64 `json:"invalid"`    // bad descriptors in the fill ring
+	RingFull  uint64 `json:"ring_full"`  // dropped as the RX ring was full
+	FillEmpty uint64 `json:"fill_empty"` // times the fill ring ran out of frames
+}
@@ -0,0 +1,297 @@
+package afxdp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// From linux/if_xdp.h.
+const (
+	afXDP  = 44
+	solXDP = 283
+
+	xdpMmapOffsets         = 1
+	xdpRxRing              = 2
+	xdpTxRing              = 3
+	xdpUmemReg             = 4
+	xdpUmemFillRing        = 5
+	xdpUmemCompletionRing  = 6
+	xdpPgoffRxRing         = 0
+	xdpPgoffTxRing         = 0x80000000
+	xdpUmemPgoffFillRing   = 0x100000000
+	xdpUmemPgoffCompletion = 0x180000000
+
+	xdpCopy          = 1 << 1
+	xdpZeroCopy      = 1 << 2
+	xdpUseNeedWakeup = 1 << 3
+	xdpRingNeedWake  = 1 << 0
+)
+
+type umemReg struct {
+	Addr, Len                     uint64
+	ChunkSize, Headroom, Flags, _ uint32
+}
+
+type ringOffset struct {
+	Producer, Consumer, Desc, Flags uint64
+}
+
+type mmapOffsets struct {
+	Rx, Tx, Fill, Completion ringOffset
+}
+
+type sockaddrXDP struct {
+	Family       uint16
+	Flags        uint16
+	Ifindex      uint32
+	QueueID      uint32
+	SharedUmemFD uint32
+}
+
+// desc is an RX or TX ring entry.
+type desc struct {
+	Addr    uint64
+	Len     uint32
+	Options uint32
+}
+
+// ring is one of the four rings the kernel shares with the socket. The
+// producer and consumer are free running, masked to index the entries.
+type ring struct {
+	mem                []byte
+	producer, consumer *uint32
+	flags              *uint32
+	entries            unsafe.Pointer
+	mask               uint32
+}
+
+func mapRing(fd int, off ringOffset, pgoff int64, n int, size uintptr) (ring, error) {
+	mem, err := syscall.Mmap(fd, pgoff, int(off.Desc)+n*int(size), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE)
+	if err != nil {
+		return ring{}, err
+	}
+	base := unsafe.Pointer(&mem[0])
+	return ring{
+		mem:      mem,
+		producer: (*uint32)(unsafe.Add(base, off.Producer)),
+		consumer: (*uint32)(unsafe.Add(base, off.Consumer)),
+		flags:    (*uint32)(unsafe.Add(base, off.Flags)),
+		entries:  unsafe.Add(base, off.Desc),
+		mask:     uint32(n - 1),
+	}, nil
+}
+
+func (r *ring) desc(i uint32) *desc {
+	return (*desc)(unsafe.Add(r.entries, uintptr(i&r.mask)*unsafe.Sizeof(desc{})))
+}
+
+func (r *ring) addr(i uint32) *uint64 {
+	return (*uint64)(unsafe.Add(r.entries, uintptr(i&r.mask)*8))
+}
+
+// Socket is an AF_XDP socket with its UMEM, set up for sending or
+// receiving.
+type Socket struct {
+	fd        int
+	umem      []byte
+	frameSize int
+	zeroCopy  bool
+	wakeup    bool // bound with need wakeup, else every send needs a kick
+
+	fill, completion, tx, rx ring
+	free                     []uint64 // UMEM frames not in flight
+}
+
+// Open binds an AF_XDP socket to the queue of cfg, zero copy when the
+// driver can and copy mode otherwise.
+func Open(cfg Config) (*Socket, error) {
+	cfg = cfg.withDefaults()
+	if cfg.Frames&(cfg.Frames-1) != 0 {
+		return nil, fmt.Errorf("AF_XDP frames must be a power of two, not %d", cfg.Frames)
+	}
+	iface, err := net.InterfaceByName(cfg.Interface)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := syscall.Socket(afXDP, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("AF_XDP socket: %v", err)
+	}
+	s := &Socket{fd: fd, frameSize: cfg.FrameSize}
+	if err := s.setup(cfg, iface.Index); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Socket) setup(cfg Config, ifindex int) error {
+	var err error
+	s.umem, err = syscall.Mmap(-1, 0, cfg.Frames*cfg.FrameSize, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE|syscall.MAP_ANONYMOUS|syscall.MAP_POPULATE)
+	if err != nil {
+		return fmt.Errorf("UMEM: %v", err)
+	}
+	reg := umemReg{Addr: uint64(uintptr(unsafe.Pointer(&s.umem[0]))), Len: uint64(len(s.umem)), ChunkSize: uint32(cfg.FrameSize)}
+	if err := setsockopt(s.fd, xdpUmemReg, unsafe.Pointer(&reg), unsafe.Sizeof(reg)); err != nil {
+		return fmt.Errorf("UMEM registration: %v", err)
+	}
+	// The kernel wants both UMEM rings, though only receiving uses the
+	// fill ring and sending the completion ring.
+	dataRing := xdpTxRing
+	if cfg.Receive {
+		dataRing = xdpRxRing
+	}
+	for _, opt := range []int{xdpUmemFillRing, xdpUmemCompletionRing, dataRing} {
+		if err := syscall.SetsockoptInt(s.fd, solXDP, opt, cfg.Frames); err != nil {
+			return fmt.Errorf("AF_XDP rings: %v", err)
+		}
+	}
+	var off mmapOffsets
+	size := uint32(unsafe.Sizeof(off))
+	if _, _, e := syscall.Syscall6(syscall.SYS_GETSOCKOPT, uintptr(s.fd), solXDP, xdpMmapOffsets, uintptr(unsafe.Pointer(&off)), uintptr(unsafe.Pointer(&size)), 0); e != 0 {
+		return fmt.Errorf("AF_XDP ring offsets: %v", e)
+	}
+	if s.fill, err = mapRing(s.fd, off.Fill, xdpUmemPgoffFillRing, cfg.Frames, 8); err != nil {
+		return fmt.Errorf("fill ring: %v", err)
+	}
+	if s.completion, err = mapRing(s.fd, off.Completion, xdpUmemPgoffCompletion, cfg.Frames, 8); err != nil {
+		return fmt.Errorf("completion ring: %v", err)
+	}
+	if cfg.Receive {
+		if s.rx, err = mapRing(s.fd, off.Rx, xdpPgoffRxRing, cfg.Frames, unsafe.Sizeof(desc{})); err != nil {
+			return fmt.Errorf("RX ring: %v", err)
+		}
+		// Every frame starts out in the fill ring for the kernel to
+		// receive into.
+		for i := range cfg.Frames {
+			*s.fill.addr(uint32(i)) = uint64(i * cfg.FrameSize)
+		}
+		atomic.StoreUint32(s.fill.producer, uint32(cfg.Frames))
+	} else {
+		if s.tx, err = mapRing(s.fd, off.Tx, xdpPgoffTxRing, cfg.Frames, unsafe.Sizeof(desc{})); err != nil {
+			return fmt.Errorf("TX ring: %v", err)
+		}
+		for i := range cfg.Frames {
+			s.free = append(s.free, uint64(i*cfg.FrameSize))
+		}
+	}
+
+	sa := sockaddrXDP{Family: afXDP, Ifindex: uint32(ifindex), QueueID: uint32(cfg.Queue)}
+	for _, flags := range []uint16{xdpZeroCopy | xdpUseNeedWakeup, xdpCopy | xdpUseNeedWakeup, xdpCopy} {
+		sa.Flags = flags
+		_, _, e := syscall.Syscall(syscall.SYS_BIND, uintptr(s.fd), uintptr(unsafe.Pointer(&sa)), unsafe.Sizeof(sa))
+		if e == 0 {
+			s.zeroCopy = flags&xdpZeroCopy != 0
+			s.wakeup = flags&xdpUseNeedWakeup != 0
+			return nil
+		}
+		err = e
+	}
+	return fmt.Errorf("AF_XDP bind to %s queue %d: %v", cfg.Interface, cfg.Queue, err)
+}
+
+func setsockopt(fd, opt int, val unsafe.Pointer, size uintptr) error {
+	if _, _, e := syscall.Syscall6(syscall.SYS_SETSOCKOPT, uintptr(fd), solXDP, uintptr(opt), uintptr(val), size, 0); e != 0 {
+		return e
+	}
+	return nil
+}
+
+// ZeroCopy tells if the driver moves the frames without copying them.
+func (s *Socket) ZeroCopy() bool {
+	return s.zeroCopy
+}
+
+// Send queues up to n frames, calling fill with each free UMEM frame to
+// write into and taking the length it returns. It returns how many were
+// queued, fewer when the ring is full, and wakes the kernel up to send
+// them.
+func (s *Socket) Send(n int, fill func(frame []byte) int) (int, error) {
+	s.reclaim()
+	prod := *s.tx.producer
+	room := int(s.tx.mask+1) - int(prod-atomic.LoadUint32(s.tx.consumer))
+	n = min(n, room, len(s.free))
+	for i := range n {
+		addr := s.free[len(s.free)-1]
+		s.free = s.free[:len(s.free)-1]
+		l := fill(s.umem[addr : addr+uint64(s.frameSize)])
+		*s.tx.desc(prod + uint32(i)) = desc{Addr: addr, Len: uint32(l)}
+	}
+	if n > 0 {
+		atomic.StoreUint32(s.tx.producer, prod+uint32(n))
+	}
+	return n, s.kick()
+}
+
+// reclaim takes the frames the kernel is done sending back.
+func (s *Socket) reclaim() {
+	cons := *s.completion.consumer
+	prod := atomic.LoadUint32(s.completion.producer)
+	for i := cons; i != prod; i++ {
+		s.free = append(s.free, *s.completion.addr(i))
+	}
+	atomic.StoreUint32(s.completion.consumer, prod)
+}
+
+// kick wakes the kernel up to go through the TX ring, when it asks for it.
+func (s *Socket) kick() error {
+	if s.wakeup && atomic.LoadUint32(s.tx.flags)&xdpRingNeedWake == 0 {
+		return nil
+	}
+	_, _, e := syscall.Syscall6(syscall.SYS_SENDTO, uintptr(s.fd), 0, 0, syscall.MSG_DONTWAIT, 0, 0)
+	switch e {
+	case 0, syscall.EAGAIN, syscall.EBUSY, syscall.ENOBUFS, syscall.ENETDOWN:
+		return nil
+	}
+	return e
+}
+
+// Flush waits up to timeout for the queued frames to be sent.
+func (s *Socket) Flush(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		if err := s.kick(); err != nil {
+			return err
+		}
+		s.reclaim()
+		if len(s.free) == int(s.tx.mask+1) {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return errors.New("AF_XDP frames still queued")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Close closes the socket and unmaps the rings and UMEM.
+func (s *Socket) Close() error {
+	err := syscall.Close(s.fd)
+	for _, r := range []ring{s.tx, s.rx, s.completion, s.fill} {
+		if r.mem != nil {
+			syscall.Munmap(r.mem)
+		}
+	}
+	if s.umem != nil {
+		syscall.Munmap(s.umem)
+	}
+	return err
+}
+
+// Queues returns the number of receive queues of the interface.
+func Queues(iface string) (int, error) {
+	rx, err := filepath.Glob(filepath.Join("/sys/class/net", iface, "queues", "rx-*"))
+	if err != nil {
+		return 0, err
+	}
+	if len(rx) == 0 {
+		return 1, nil
+	}
+	return len(rx), nil
+}
@@ -0,0 +1,41 @@
+//go:build !linux
+
+package afxdp
+
+import (
+	"errors"
+	"time"
+)
+
+var errLinuxOnly = errors.New("AF_XDP needs Linux")
+
+// Socket is an AF_XDP socket, which only Linux has.
+type Socket struct{}
+
+// Open fails: AF_XDP is Linux only.
+func Open(cfg Config) (*Socket, error) {
+	return nil, errLinuxOnly
+}
+
+func (s *Socket) ZeroCopy() bool                                              { return false }
+func (s *Socket) FD() int                                                     { return -1 }
+func (s *Socket) Send(n int, fill func(frame []byte) int) (int, error)        { return 0, errLinuxOnly }
+func (s *Socket) Receive(timeout time.Duration, fn func([]byte)) (int, error) { return 0, errLinuxOnly }
+func (s *Socket) Stats() (Stats, error)                                       { return Stats{}, errLinuxOnly }
+func (s *Socket) Flush(timeout time.Duration) error                           { return nil }
+func (s *Socket) Close() error                                                { return nil }
+
+// Program is an XDP program, which only Linux has.
+type Program struct{}
+
+// LoadRedirect fails: XDP is Linux only.
+func LoadRedirect(iface string, port, queues int) (*Program, error) {
+	return nil, errLinuxOnly
+}
+
+func (p *Program) Generic() bool                       { return false }
+func (p *Program) Register(queue int, s *Socket) error { return errLinuxOnly }
+func (p *Program) Close() error                        { return nil }
+
+// Queues fails: AF_XDP is Linux only.
+func Queues(iface string) (int, error) { return 0, errLinuxOnly }
@@ -0,0 +1,226 @@
+package afxdp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// From linux/bpf.h.
+const (
+	bpfMapCreate     = 0
+	bpfMapUpdateElem = 2
+	bpfProgLoad      = 5
+	bpfLinkCreate    = 28
+
+	bpfMapTypeXSKMap = 17
+	bpfProgTypeXDP   = 6
+	bpfXDP           = 37 // attach type
+
+	xdpFlagsSKBMode = 1 << 1
+	xdpFlagsDrvMode = 1 << 2
+
+	xdpPass            = 2
+	funcRedirectMap    = 51
+	bpfPseudoMapFD     = 1
+	ethPIPNetworkOrder = 0x0008 // ETH_P_IP as a little endian load sees it
+)
+
+// Program is an XDP program attached to an interface, steering UDP to or
+// from a port to the AF_XDP sockets registered for the queues and passing
+// everything else on to the network stack.
+type Program struct {
+	xskMap, prog, link int
+	generic            bool
+}
+
+// LoadRedirect loads the program for port and attaches it to the
+// interface, in the driver when it supports XDP and as generic XDP
+// otherwise. queues is the number of queues sockets can be registered
+// for. Only one XDP program can be attached to an interface at a time.
+func LoadRedirect(iface string, port, queues int) (*Program, error) {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, err
+	}
+	p := &Program{xskMap: -1, prog: -1, link: -1}
+	mapAttr := struct{ Type, KeySize, ValueSize, MaxEntries, Flags uint32 }{bpfMapTypeXSKMap, 4, 4, uint32(queues), 0}
+	if p.xskMap, err = bpf(bpfMapCreate, unsafe.Pointer(&mapAttr), unsafe.Sizeof(mapAttr)); err != nil {
+		return nil, fmt.Errorf("XSKMAP: %v", err)
+	}
+
+	insns := redirectProgram(p.xskMap, port)
+	license := []byte("GPL\x00")
+	logBuf := make([]byte, 4096)
+	progAttr := struct {
+		Type, InsnCnt      uint32
+		Insns, License     uint64
+		LogLevel, LogSize  uint32
+		LogBuf             uint64
+		KernVersion, Flags uint32
+		Name               [16]byte
+	}{
+		Type:     bpfProgTypeXDP,
+		InsnCnt:  uint32(len(insns) / 8),
+		Insns:    uint64(uintptr(unsafe.Pointer(&insns[0]))),
+		License:  uint64(uintptr(unsafe.Pointer(&license[0]))),
+		LogLevel: 1,
+		LogSize:  uint32(len(logBuf)),
+		LogBuf:   uint64(uintptr(unsafe.Pointer(&logBuf[0]))),
+	}
+	copy(progAttr.Name[:], "gonet_udp_xsk")
+	if p.prog, err = bpf(bpfProgLoad, unsafe.Pointer(&progAttr), unsafe.Sizeof(progAttr)); err != nil {
+		p.Close()
+		return nil, fmt.Errorf("XDP program: %v: %s", err, cString(logBuf))
+	}
+
+	for _, flags := range []uint32{xdpFlagsDrvMode, xdpFlagsSKBMode} {
+		linkAttr := struct{ ProgFD, Ifindex, AttachType, Flags uint32 }{uint32(p.prog), uint32(ifi.Index), bpfXDP, flags}
+		if p.link, err = bpf(bpfLinkCreate, unsafe.Pointer(&linkAttr), unsafe.Sizeof(linkAttr)); err == nil {
+			p.generic = flags == xdpFlagsSKBMode
+			return p, nil
+		}
+	}
+	p.Close()
+	return nil, fmt.Errorf("attaching XDP to %s: %v", iface, err)
+}
+
+// Generic tells if the program runs as generic XDP, after the driver
+// built an skb, rather than in the driver.
+func (p *Program) Generic() bool {
+	return p.generic
+}
+
+// Register steers the frames of queue to s.
+func (p *Program) Register(queue int, s *Socket) error {
+	key, value := uint32(queue), uint32(s.FD())
+	attr := struct {
+		MapFD, _          uint32
+		Key, Value, Flags uint64
+	}{MapFD: uint32(p.xskMap), Key: uint64(uintptr(unsafe.Pointer(&key))), Value: uint64(uintptr(unsafe.Pointer(&value)))}
+	if _, err := bpf(bpfMapUpdateElem, unsafe.Pointer(&attr), unsafe.Sizeof(attr)); err != nil {
+		return fmt.Errorf("registering the socket of queue %d: %v", queue, err)
+	}
+	return nil
+}
+
+// Close detaches the program and frees it.
+func (p *Program) Close() error {
+	var err error
+	for _, fd := range []int{p.link, p.prog, p.xskMap} {
+		if fd >= 0 {
+			if cerr := syscall.Close(fd); err == nil {
+				err = cerr
+			}
+		}
+	}
+	return err
+}
+
+// sysBPF is the number of the bpf system call, which the syscall package
+// doesn't have.
+var sysBPF = map[string]uintptr{"amd64": 321, "386": 357, "arm64": 280, "riscv64": 280, "loong64": 280, "arm": 386, "ppc64": 361, "ppc64le": 361, "s390x": 351}[runtime.GOARCH]
+
+func bpf(cmd int, attr unsafe.Pointer, size uintptr) (int, error) {
+	if sysBPF == 0 {
+		return -1, fmt.Errorf("no bpf system call on %s", runtime.GOARCH)
+	}
+	fd, _, e := syscall.Syscall(sysBPF, uintptr(cmd), uintptr(attr), size)
+	if e != 0 {
+		return -1, e
+	}
+	return int(fd), nil
+}
+
+func cString(b []byte) string {
+	for i, c := range b {
+		if c == 0 {
+			return string(b[:i])
+		}
+	}
+	return string(b)
+}
+
+// insn encodes an eBPF instruction.
+func insn(code, dst, src uint8, off int16, imm int32) []byte {
+	b := make([]byte, 8)
+	b[0] = code
+	b[1] = dst | src<<4
+	binary.LittleEndian.PutUint16(b[2:], uint16(off))
+	binary.LittleEndian.PutUint32(b[4:], uint32(imm))
+	return b
+}
+
+// eBPF opcodes the program uses.
+const (
+	ldxw  = 0x61
+	ldxh  = 0x69
+	ldxb  = 0x71
+	movX  = 0xbf
+	movK  = 0xb7
+	addK  = 0x07
+	addX  = 0x0f
+	andK  = 0x57
+	lshK  = 0x67
+	jgtX  = 0x2d
+	jeqK  = 0x15
+	jneK  = 0x55
+	ldDW  = 0x18
+	call  = 0x85
+	exitI = 0x95
+)
+
+// redirectProgram returns the instructions of the program: frames of
+// IPv4 UDP to or from port go to the socket of their queue in xskMap,
+// the rest pass. In C:
+//
+//	if (data + 34 > data_end || eth->h_proto != htons(ETH_P_IP) || ip->protocol != IPPROTO_UDP)
+//		return XDP_PASS;
+//	udp = (void *)ip + ip->ihl * 4;
+//	if (udp + 1 > data_end || (udp->dest != htons(port) && udp->source != htons(port)))
+//		return XDP_PASS;
+//	return bpf_redirect_map(&xsks, ctx->rx_queue_index, XDP_PASS);
+func redirectProgram(xskMap, port int) []byte {
+	portLE := int32(uint16(port)>>8 | uint16(port)<<8)
+	const (
+		ctx, data, end, tmp, val = 6, 2, 3, 4, 5
+		pass                     = 27 // index of the pass label
+	)
+	// jump returns the offset from instruction i to target.
+	jump := func(i, target int) int16 { return int16(target - i - 1) }
+	var prog []byte
+	add := func(b []byte) { prog = append(prog, b...) }
+	add(insn(movX, ctx, 1, 0, 0))                               // 0: r6 = ctx
+	add(insn(ldxw, data, ctx, 0, 0))                            // 1: r2 = ctx->data
+	add(insn(ldxw, end, ctx, 4, 0))                             // 2: r3 = ctx->data_end
+	add(insn(movX, tmp, data, 0, 0))                            // 3: r4 = data
+	add(insn(addK, tmp, 0, 0, 34))                              // 4: r4 += eth + ip
+	add(insn(jgtX, tmp, end, jump(5, pass), 0))                 // 5: if r4 > end goto pass
+	add(insn(ldxh, val, data, 12, 0))                           // 6: r5 = eth->h_proto
+	add(insn(jneK, val, 0, jump(7, pass), ethPIPNetworkOrder))  // 7: if not IPv4 goto pass
+	add(insn(ldxb, val, data, 23, 0))                           // 8: r5 = ip->protocol
+	add(insn(jneK, val, 0, jump(9, pass), syscall.IPPROTO_UDP)) // 9: if not UDP goto pass
+	add(insn(ldxb, val, data, 14, 0))                           // 10: r5 = ip->version_ihl
+	add(insn(andK, val, 0, 0, 0x0f))                            // 11: r5 &= 0xf
+	add(insn(lshK, val, 0, 0, 2))                               // 12: r5 <<= 2
+	add(insn(addX, data, val, 0, 0))                            // 13: data += ihl bytes
+	add(insn(movX, tmp, data, 0, 0))                            // 14: r4 = data
+	add(insn(addK, tmp, 0, 0, 14+8))                            // 15: r4 += eth + udp
+	add(insn(jgtX, tmp, end, jump(16, pass), 0))                // 16: if r4 > end goto pass
+	add(insn(ldxh, val, data, 14+2, 0))                         // 17: r5 = udp->dest
+	add(insn(jeqK, val, 0, jump(18, 21), portLE))               // 18: if port goto redirect
+	add(insn(ldxh, val, data, 14, 0))                           // 19: r5 = udp->source
+	add(insn(jneK, val, 0, jump(20, pass), portLE))             // 20: if not port goto pass
+	add(insn(ldxw, 2, ctx, 16, 0))                              // 21: r2 = ctx->rx_queue_index
+	add(insn(ldDW, 1, bpfPseudoMapFD, 0, int32(xskMap)))        // 22-23: r1 = xskMap
+	add(insn(0, 0, 0, 0, 0))                                    // upper half of the map
+	add(insn(movK, 3, 0, 0, xdpPass))                           // 24: r3 = XDP_PASS on a missing socket
+	add(insn(call, 0, 0, 0, funcRedirectMap))                   // 25: bpf_redirect_map
+	add(insn(exitI, 0, 0, 0, 0))                                // 26
+	add(insn(movK, 0, 0, 0, xdpPass))                           // 27: pass: return XDP_PASS
+	add(insn(exitI, 0, 0, 0, 0))                                // 28
+	return prog
+}
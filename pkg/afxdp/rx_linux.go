@@ -0,0 +1,72 @@
+package afxdp
+
+import (
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	xdpStatistics = 7
+	rxBatch       = 256
+)
+
+// FD returns the socket's file descriptor, for Program.Register.
+func (s *Socket) FD() int {
+	return s.fd
+}
+
+// Receive waits up to timeout for frames and calls fn with each that
+// arrived, up to a batch of them, handing the frames back to the kernel
+// after. The frame is only valid during the call. It returns how many
+// frames there were.
+func (s *Socket) Receive(timeout time.Duration, fn func(frame []byte)) (int, error) {
+	cons := *s.rx.consumer
+	prod := atomic.LoadUint32(s.rx.producer)
+	if prod == cons {
+		if err := s.poll(timeout); err != nil {
+			return 0, err
+		}
+		prod = atomic.LoadUint32(s.rx.producer)
+	}
+	n := min(prod-cons, rxBatch)
+	fill := *s.fill.producer
+	for i := range n {
+		d := s.rx.desc(cons + i)
+		fn(s.umem[d.Addr : d.Addr+uint64(d.Len)])
+		*s.fill.addr(fill + i) = d.Addr &^ uint64(s.frameSize-1)
+	}
+	if n > 0 {
+		atomic.StoreUint32(s.rx.consumer, cons+n)
+		atomic.StoreUint32(s.fill.producer, fill+n)
+	}
+	return int(n), nil
+}
+
+// poll waits for the socket to get frames, which also wakes the kernel
+// up to refill when it asks for it.
+func (s *Socket) poll(timeout time.Duration) error {
+	fds := [1]struct {
+		fd             int32
+		events, revent int16
+	}{{fd: int32(s.fd), events: 1}} // POLLIN
+	ts := syscall.NsecToTimespec(int64(timeout))
+	_, _, e := syscall.Syscall6(syscall.SYS_PPOLL, uintptr(unsafe.Pointer(&fds[0])), 1, uintptr(unsafe.Pointer(&ts)), 0, 0, 0)
+	if e != 0 && e != syscall.EINTR {
+		return e
+	}
+	return nil
+}
+
+// Stats returns the kernel's counters of the socket.
+func (s *Socket) Stats() (Stats, error) {
+	var raw struct {
+		Dropped, Invalid, TxInvalid, RingFull, FillEmpty, TxRingEmpty uint64
+	}
+	size := uint32(unsafe.Sizeof(raw))
+	if _, _, e := syscall.Syscall6(syscall.SYS_GETSOCKOPT, uintptr(s.fd), solXDP, xdpStatistics, uintptr(unsafe.Pointer(&raw)), uintptr(unsafe.Pointer(&size)), 0); e != 0 {
+		return Stats{}, e
+	}
+	return Stats{Dropped: raw.Dropped, Invalid: raw.Invalid, RingFull: raw.RingFull, FillEmpty: raw.FillEmpty}, nil
+}
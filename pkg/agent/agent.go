@@ -0,0 +1,288 @@
+// Package agent runs traffic jobs on a host for a remote controller: UDP
+// generators, UDP receivers and pcap replays, started and stopped over an
+// HTTP API so one controller can drive many hosts. The API is JSON over
+// HTTP like gonet replay -serve's rather than gRPC, which would bring the
+// gRPC and protobuf modules into a module that otherwise only needs
+// gopacket; it is guarded as package apiauth describes.
+//
+//	POST   /jobs       start a job, see JobSpec; recv jobs answer once capturing
+//	GET    /jobs       status of every job
+//	GET    /jobs/{id}  status of a job
+//	DELETE /jobs/{id}  stop a job and return its final status
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"gonet/pkg/capture"
+	"gonet/pkg/config"
+)
+
+// Job kinds.
+const (
+	KindSend   = "send"
+	KindRecv   = "recv"
+	KindReplay = "replay"
+)
+
+// Job states.
+const (
+	StateRunning = "running"
+	StateDone    = "done"
+	StateStopped = "stopped"
+	StateFailed  = "failed"
+)
+
+// JobSpec is a job for an agent. Kind picks the fields that apply, the
+// names follow the flags of the matching gonet command.
+type JobSpec struct {
+	Kind      string `json:"kind"`
+	Interface string `json:"interface,omitempty"` // default the agent's
+
+	// Duration bounds send and recv jobs, 0 runs them until stopped.
+	Duration config.Duration `json:"duration,omitempty"`
+
+	// send
+	SrcIP    string `json:"srcip,omitempty"`
+	DestIP   string `json:"destip,omitempty"`
+	DestMAC  string `json:"destmac,omitempty"`
+	SrcPort  int    `json:"srcport,omitempty"`  // default 12345
+	DestPort int    `json:"destport,omitempty"` // default 8125
+	PPS      int    `json:"pps,omitempty"`
+	Size     int    `json:"size,omitempty"` // default 1400
+
+	// send and recv: number the packets of Stream, see gonet udp send -seq.
+	Sequence bool   `json:"seq,omitempty"`
+	Stream   uint32 `json:"stream,omitempty"`
+
+	// recv
+	Port int `json:"port,omitempty"` // default 8125
+
+	// replay: captures in the agent's directory and gonet replay flags,
+	// limited to the ones gonet replay -serve accepts. The replay runs in
+	// a child process of the agent's gonet binary.
+	Files []string          `json:"files,omitempty"`
+	Flags map[string]string `json:"flags,omitempty"`
+}
+
+// Status is what the API reports about a job.
+type Status struct {
+	ID      string        `json:"id"`
+	Spec    JobSpec       `json:"spec"`
+	State   string        `json:"state"`
+	Error   string        `json:"error,omitempty"`
+	Started time.Time     `json:"started"`
+	Elapsed time.Duration `json:"elapsed_ns"`
+
+	// Packets and bytes sent by send and replay jobs, received by recv
+	// jobs.
+	Packets uint64 `json:"packets"`
+	Bytes   uint64 `json:"bytes"`
+
+	Sequence *capture.SequenceStats `json:"sequence,omitempty"`
+	Replay   json.RawMessage        `json:"replay,omitempty"` // the gonet replay -json summary
+}
+
+// Agent runs jobs, any number at a time.
+type Agent struct {
+	Interface string // pcap device for jobs that don't name one
+	Dir       string // captures for replay jobs
+	// Keep is how long finished jobs stay listed with their results,
+	// default ten minutes.
+	Keep time.Duration
+
+	mu   sync.Mutex
+	jobs map[string]*job
+	next int
+}
+
+// job is a running or finished job.
+type job struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	// live reads the counters while the job runs.
+	live func() (packets, bytes uint64)
+
+	mu     sync.Mutex
+	status Status
+	ended  time.Time // zero while running
+}
+
+// Handler serves the API.
+func (a *Agent) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /jobs", a.start)
+	mux.HandleFunc("GET /jobs", a.list)
+	mux.HandleFunc("GET /jobs/{id}", a.get)
+	mux.HandleFunc("DELETE /jobs/{id}", a.stop)
+	return mux
+}
+
+func (a *Agent) start(w http.ResponseWriter, r *http.Request) {
+	var spec JobSpec
+	if err := json.NewDecoder(r.Body).Decode(&spec); err != nil {
+		http.Error(w, fmt.Sprintf("invalid job: %v", err), http.StatusBadRequest)
+		return
+	}
+	if spec.Interface == "" {
+		spec.Interface = a.Interface
+	}
+
+	a.mu.Lock()
+	a.next++
+	id := strconv.Itoa(a.next)
+	a.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	j := &job{cancel: cancel, done: make(chan struct{})}
+	j.status = Status{ID: id, Spec: spec, State: StateRunning, Started: time.Now()}
+
+	var err error
+	switch spec.Kind {
+	case KindSend:
+		err = a.startSend(ctx, j)
+	case KindRecv:
+		err = a.startRecv(ctx, j)
+	case KindReplay:
+		err = a.startReplay(ctx, j)
+	default:
+		err = fmt.Errorf("unknown job kind %q, want send, recv or replay", spec.Kind)
+	}
+	if err != nil {
+		cancel()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	a.mu.Lock()
+	if a.jobs == nil {
+		a.jobs = make(map[string]*job)
+	}
+	a.prune()
+	a.jobs[id] = j
+	a.mu.Unlock()
+	slog.Info("Started job", "job", id, "kind", spec.Kind, "client", r.RemoteAddr)
+	writeJSON(w, http.StatusCreated, j.snapshot())
+}
+
+// prune drops the jobs that finished more than Keep ago, with a.mu
+// held.
+func (a *Agent) prune() {
+	keep := a.Keep
+	if keep <= 0 {
+		keep = 10 * time.Minute
+	}
+	for id, j := range a.jobs {
+		j.mu.Lock()
+		expired := !j.ended.IsZero() && time.Since(j.ended) > keep
+		j.mu.Unlock()
+		if expired {
+			delete(a.jobs, id)
+		}
+	}
+}
+
+func (a *Agent) list(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	a.prune()
+	statuses := make([]Status, 0, len(a.jobs))
+	for i := 1; i <= a.next; i++ {
+		if j, ok := a.jobs[strconv.Itoa(i)]; ok {
+			statuses = append(statuses, j.snapshot())
+		}
+	}
+	a.mu.Unlock()
+	writeJSON(w, http.StatusOK, statuses)
+}
+
+func (a *Agent) lookup(w http.ResponseWriter, r *http.Request) *job {
+	a.mu.Lock()
+	j := a.jobs[r.PathValue("id")]
+	a.mu.Unlock()
+	if j == nil {
+		http.Error(w, "no such job", http.StatusNotFound)
+	}
+	return j
+}
+
+func (a *Agent) get(w http.ResponseWriter, r *http.Request) {
+	if j := a.lookup(w, r); j != nil {
+		writeJSON(w, http.StatusOK, j.snapshot())
+	}
+}
+
+func (a *Agent) stop(w http.ResponseWriter, r *http.Request) {
+	j := a.lookup(w, r)
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	if j.status.State == StateRunning {
+		j.status.State = StateStopped
+	}
+	j.mu.Unlock()
+	j.cancel()
+	<-j.done
+	writeJSON(w, http.StatusOK, j.snapshot())
+}
+
+// run runs the job's work in the background and records how it ended.
+// finish, if set, fills in the results.
+func (j *job) run(work func() error, finish func(*Status)) {
+	go func() {
+		defer close(j.done)
+		err := work()
+
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		j.ended = time.Now()
+		s := &j.status
+		s.Elapsed = j.ended.Sub(s.Started)
+		if j.live != nil {
+			s.Packets, s.Bytes = j.live()
+		}
+		if finish != nil {
+			finish(s)
+		}
+		switch {
+		case err != nil:
+			s.State, s.Error = StateFailed, err.Error()
+			slog.Warn("Job failed", "job", s.ID, "err", err)
+		case s.State == StateRunning:
+			s.State = StateDone
+		}
+	}()
+}
+
+// snapshot returns the status with the counters of a running job.
+func (j *job) snapshot() Status {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	s := j.status
+	if s.State == StateRunning {
+		s.Elapsed = time.Since(s.Started)
+		if j.live != nil {
+			s.Packets, s.Bytes = j.live()
+		}
+	}
+	return s
+}
+
+// errNoInterface is returned for jobs when neither they nor the agent
+// name an interface.
+var errNoInterface = errors.New("no interface, give the agent -interface or the job one")
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,188 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"time"
+
+	gopackets "gonet/go_packets"
+	"gonet/pkg/capture"
+	"gonet/pkg/generator"
+	"gonet/pkg/ifaceutil"
+)
+
+// device resolves the job's interface.
+func device(spec JobSpec) (string, error) {
+	if spec.Interface == "" {
+		return "", errNoInterface
+	}
+	return ifaceutil.Resolve(spec.Interface)
+}
+
+// withDuration bounds ctx by the job's duration.
+func withDuration(ctx context.Context, spec JobSpec) (context.Context, context.CancelFunc) {
+	if spec.Duration > 0 {
+		return context.WithTimeout(ctx, time.Duration(spec.Duration))
+	}
+	return context.WithCancel(ctx)
+}
+
+func (a *Agent) startSend(ctx context.Context, j *job) error {
+	spec := &j.status.Spec
+	spec.SrcPort = orDefault(spec.SrcPort, 12345)
+	spec.DestPort = orDefault(spec.DestPort, 8125)
+	spec.Size = orDefault(spec.Size, 1400)
+	dev, err := device(*spec)
+	if err != nil {
+		return err
+	}
+	cfg := generator.Config{
+		Interface: dev,
+		SrcPort:   spec.SrcPort,
+		DstPort:   spec.DestPort,
+		PPS:       spec.PPS,
+		Size:      spec.Size,
+		Sequence:  spec.Sequence,
+		Stream:    spec.Stream,
+	}
+	if cfg.SrcIP = net.ParseIP(spec.SrcIP); cfg.SrcIP == nil {
+		return fmt.Errorf("invalid srcip %q", spec.SrcIP)
+	}
+	if cfg.DstIP = net.ParseIP(spec.DestIP); cfg.DstIP == nil {
+		return fmt.Errorf("invalid destip %q", spec.DestIP)
+	}
+	if spec.DestMAC != "" {
+		if cfg.DstMAC, err = net.ParseMAC(spec.DestMAC); err != nil {
+			return err
+		}
+	}
+	if cfg.PPS <= 0 {
+		return fmt.Errorf("invalid pps %d", cfg.PPS)
+	}
+
+	g := &generator.Generator{}
+	j.live = g.Stats
+	ctx, cancel := withDuration(ctx, *spec)
+	j.run(func() error {
+		defer cancel()
+		return g.Run(ctx, cfg)
+	}, nil)
+	return nil
+}
+
+func (a *Agent) startRecv(ctx context.Context, j *job) error {
+	j.status.Spec.Port = orDefault(j.status.Spec.Port, 8125)
+	spec := j.status.Spec
+	dev, err := device(spec)
+	if err != nil {
+		return err
+	}
+
+	c := &capture.Capture{}
+	j.live = c.Stats
+	ready := make(chan struct{})
+	failed := make(chan error, 1)
+	ctx, cancel := withDuration(ctx, spec)
+	cfg := capture.Config{
+		Interface:   dev,
+		Port:        spec.Port,
+		Promiscuous: true,
+		Sequence:    spec.Sequence,
+		Stream:      spec.Stream,
+		Ready:       func() { close(ready) },
+	}
+	j.run(func() error {
+		defer cancel()
+		err := c.Run(ctx, cfg)
+		failed <- err
+		return err
+	}, func(s *Status) {
+		if spec.Sequence {
+			seq := c.Sequence()
+			s.Sequence = &seq
+		}
+	})
+
+	// Answer once the capture is up, so the controller can start the
+	// senders.
+	select {
+	case <-ready:
+		return nil
+	case err := <-failed:
+		return err
+	}
+}
+
+func (a *Agent) startReplay(ctx context.Context, j *job) error {
+	spec := j.status.Spec
+	dev, err := device(spec)
+	if err != nil {
+		return err
+	}
+	if len(spec.Files) == 0 {
+		return fmt.Errorf("no files to replay")
+	}
+
+	args := []string{"replay", "-interface", dev, "-all", "-json", "-"}
+	for name, value := range spec.Flags {
+		if !slices.Contains(gopackets.AgentFlags, name) {
+			return fmt.Errorf("flag -%s can't be set by a job", name)
+		}
+		args = append(args, "-"+name+"="+value)
+	}
+	for _, name := range spec.Files {
+		if name == "" || name != filepath.Base(name) || name == "." || name == ".." {
+			return fmt.Errorf("invalid capture name %q", name)
+		}
+		args = append(args, filepath.Join(a.Dir, name))
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	var stdout bytes.Buffer
+	cmd := exec.CommandContext(ctx, exe, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	j.run(func() error {
+		err := cmd.Wait()
+		if ctx.Err() != nil {
+			// Stopped, the replay was killed before its summary.
+			return nil
+		}
+		return err
+	}, func(s *Status) {
+		out := stdout.Bytes()
+		if i := bytes.IndexByte(out, '{'); i >= 0 {
+			var sum struct {
+				Sent  uint64 `json:"sent"`
+				Bytes uint64 `json:"bytes"`
+			}
+			if json.Unmarshal(out[i:], &sum) == nil {
+				s.Replay = json.RawMessage(out[i:])
+				s.Packets, s.Bytes = sum.Sent, sum.Bytes
+			}
+		}
+	})
+	return nil
+}
+
+// orDefault returns v, or def when v is 0.
+func orDefault(v, def int) int {
+	if v == 0 {
+		return def
+	}
+	return v
+}
@@ -0,0 +1,85 @@
+// Package apiauth guards the HTTP control APIs of the remote agents:
+// they listen on loopback unless told otherwise, and need a shared token
+// to listen anywhere else. Clients send the token as a bearer token.
+package apiauth
+
+import (
+	"crypto/subtle"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+)
+
+// TokenEnv is the environment variable holding the token when -token
+// isn't given, keeping it out of process listings.
+const TokenEnv = "GONET_TOKEN"
+
+// Options are the flags of an agent's API.
+type Options struct {
+	Token string
+}
+
+// RegisterFlags adds -token to fs.
+func RegisterFlags(fs *flag.FlagSet) *Options {
+	o := &Options{}
+	fs.StringVar(&o.Token, "token", "", "Shared token the API requires as a bearer token, default $"+TokenEnv)
+	return o
+}
+
+// Resolve returns the token: -token, or else $GONET_TOKEN.
+func (o *Options) Resolve() string {
+	if o.Token != "" {
+		return o.Token
+	}
+	return os.Getenv(TokenEnv)
+}
+
+// Listen opens addr, on loopback when it has no host. A listener
+// reachable from elsewhere needs a token.
+func Listen(addr, token string) (net.Listener, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	if token == "" && !loopback(host) {
+		return nil, fmt.Errorf("listening on %s needs a token, set -token or $%s", host, TokenEnv)
+	}
+	return net.Listen("tcp", net.JoinHostPort(host, port))
+}
+
+func loopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Require answers 401 Unauthorized to requests without the bearer token,
+// letting all through when token is empty.
+func Require(token string, h http.Handler) http.Handler {
+	if token == "" {
+		return h
+	}
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "missing or wrong token", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Set adds the bearer token to a request, if there is one.
+func Set(r *http.Request, token string) {
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+}
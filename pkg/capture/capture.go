@@ -0,0 +1,201 @@
+// Package capture counts the UDP packets arriving on an interface, the
+// engine behind gonet udp recv.
+package capture
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+
+	"gonet/pkg/stats"
+)
+
+// Config selects the traffic to count.
+type Config struct {
+	Interface   string // pcap device name, see ifaceutil.Resolve
+	Port        int    // UDP port, either direction
+	Promiscuous bool
+
+	// Sequence reads the seqhdr.Header of Stream at the start of each
+	// payload, see Capture.Sequence.
+	Sequence bool
+	Stream   uint32
+
+	// Trailer reads the trailer.Trailer at the end of each payload, see
+	// Capture.Trailer.
+	Trailer bool
+
+	// Flows, if set, gets the UDP flows of the capture.
+	Flows *FlowTable
+
+	// Backend is how packets come in: "pcap", the default, or "xdp" for
+	// an AF_XDP socket per receive queue, see runXDP. Without AF_XDP the
+	// capture falls back to pcap.
+	Backend string
+
+	// Ready, if set, is called once packets are being captured.
+	Ready func()
+}
+
+// Capture counts received packets. The zero value is ready to use.
+type Capture struct {
+	counters stats.Counters
+	seq      atomic.Pointer[streamSequencer]
+	hops     atomic.Pointer[hopTracker]
+	xdp      atomic.Pointer[[]*xdpQueue]
+}
+
+// Counters returns the live counters, for a stats.Reporter.
+func (c *Capture) Counters() *stats.Counters {
+	return &c.counters
+}
+
+// Stats returns the packets and bytes received so far.
+func (c *Capture) Stats() (packets, bytes uint64) {
+	return c.counters.Load()
+}
+
+// Sequence returns the sequence mode results so far.
+func (c *Capture) Sequence() SequenceStats {
+	if q := c.seq.Load(); q != nil {
+		return q.load()
+	}
+	return SequenceStats{}
+}
+
+// Trailer returns what the telemetry trailers told so far.
+func (c *Capture) Trailer() TrailerStats {
+	if t := c.hops.Load(); t != nil {
+		return t.load()
+	}
+	return TrailerStats{}
+}
+
+// Run counts packets matching cfg until ctx is done.
+func (c *Capture) Run(ctx context.Context, cfg Config) error {
+	switch cfg.Backend {
+	case "", "pcap":
+	case "xdp":
+		prog, queues, err := openXDP(cfg)
+		if err == nil {
+			return c.runXDP(ctx, cfg, prog, queues)
+		}
+		slog.Warn("AF_XDP unavailable, falling back to pcap", "interface", cfg.Interface, "err", err)
+	default:
+		return fmt.Errorf("unknown backend %q, want pcap or xdp", cfg.Backend)
+	}
+
+	// A read timeout lets the loop notice ctx, BlockForever would hold the
+	// handle until the next packet.
+	handle, err := pcap.OpenLive(cfg.Interface, 65536, cfg.Promiscuous, 100*time.Millisecond)
+	if err != nil {
+		return fmt.Errorf("failed to open device %s: %v", cfg.Interface, err)
+	}
+	defer handle.Close()
+
+	filter := fmt.Sprintf("udp and port %d", cfg.Port)
+	if err := handle.SetBPFFilter(filter); err != nil {
+		return fmt.Errorf("failed to set BPF filter: %v", err)
+	}
+
+	dec := newUDPDecoder(c.observers(cfg))
+	if cfg.Ready != nil {
+		cfg.Ready()
+	}
+
+	for ctx.Err() == nil {
+		data, ci, err := handle.ZeroCopyReadPacketData()
+		if err == pcap.NextErrorTimeoutExpired {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read packet: %v", err)
+		}
+		c.counters.Add(1, uint64(len(data)))
+		if dec != nil {
+			dec.observe(data, ci.Timestamp)
+		}
+	}
+	return nil
+}
+
+// observers sets up what the decoded packets go to for cfg, each nil
+// when it doesn't apply.
+func (c *Capture) observers(cfg Config) (*streamSequencer, *hopTracker, *FlowTable) {
+	var q *streamSequencer
+	var hops *hopTracker
+	if cfg.Sequence {
+		q = &streamSequencer{stream: cfg.Stream}
+		c.seq.Store(q)
+	}
+	if cfg.Trailer {
+		hops = &hopTracker{}
+		c.hops.Store(hops)
+	}
+	return q, hops, cfg.Flows
+}
+
+// udpDecoder finds the UDP payload and flow of frames for sequence mode,
+// telemetry trailers and flow tables.
+type udpDecoder struct {
+	eth     layers.Ethernet
+	dot1q   layers.Dot1Q
+	ip4     layers.IPv4
+	ip6     layers.IPv6
+	udp     layers.UDP
+	parser  *gopacket.DecodingLayerParser
+	decoded []gopacket.LayerType
+
+	seq   *streamSequencer
+	hops  *hopTracker
+	flows *FlowTable
+}
+
+// newUDPDecoder returns a decoder handing packets to those of seq, hops
+// and flows that are set, nil if none is.
+func newUDPDecoder(seq *streamSequencer, hops *hopTracker, flows *FlowTable) *udpDecoder {
+	if seq == nil && hops == nil && flows == nil {
+		return nil
+	}
+	d := &udpDecoder{seq: seq, hops: hops, flows: flows}
+	d.parser = gopacket.NewDecodingLayerParser(layers.LayerTypeEthernet, &d.eth, &d.dot1q, &d.ip4, &d.ip6, &d.udp)
+	d.parser.IgnoreUnsupported = true
+	return d
+}
+
+// observe hands the frame data received at at to the decoder's
+// observers if it is UDP.
+func (d *udpDecoder) observe(data []byte, at time.Time) {
+	d.parser.DecodeLayers(data, &d.decoded)
+	if len(d.decoded) == 0 || d.decoded[len(d.decoded)-1] != layers.LayerTypeUDP {
+		return
+	}
+	key := FlowKey{SrcPort: uint16(d.udp.SrcPort), DstPort: uint16(d.udp.DstPort)}
+	var ipBytes int
+	if slices.Contains(d.decoded, layers.LayerTypeIPv4) {
+		key.Src, _ = netip.AddrFromSlice(d.ip4.SrcIP.To4())
+		key.Dst, _ = netip.AddrFromSlice(d.ip4.DstIP.To4())
+		ipBytes = int(d.ip4.Length)
+	} else {
+		key.Src, _ = netip.AddrFromSlice(d.ip6.SrcIP)
+		key.Dst, _ = netip.AddrFromSlice(d.ip6.DstIP)
+		ipBytes = 40 + int(d.ip6.Length)
+	}
+	if d.seq != nil {
+		d.seq.add(key, d.udp.Payload, at)
+	}
+	if d.hops != nil {
+		d.hops.add(d.udp.Payload, at)
+	}
+	if d.flows != nil {
+		d.flows.add(key, ipBytes, data, at)
+	}
+}
@@ -0,0 +1,72 @@
+package capture
+
+import (
+	"math/rand/v2"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// FlowKey identifies a UDP flow by its addresses and ports.
+type FlowKey struct {
+	Src, Dst         netip.Addr
+	SrcPort, DstPort uint16
+}
+
+// Flow is the traffic of a flow since it was first seen, bytes counted
+// from the IP header on as flow records do.
+type Flow struct {
+	FlowKey
+	Packets, Bytes uint64
+	First, Last    time.Time
+}
+
+// FlowTable collects the flows of the captures it is given to, for flow
+// export; it may outlive them, so one table can span the tests of a
+// session.Server. It is safe for concurrent use and the zero value is
+// ready to use.
+type FlowTable struct {
+	// Sample, if set, is called with one in SampleRate frames as they
+	// arrive, chosen at random, and the count of frames the table has
+	// seen. frame is only valid during the call.
+	SampleRate int
+	Sample     func(frame []byte, pool uint64)
+
+	mu    sync.Mutex
+	flows map[FlowKey]*Flow
+	pool  atomic.Uint64
+}
+
+// Flows returns the flows seen so far.
+func (t *FlowTable) Flows() []Flow {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	flows := make([]Flow, 0, len(t.flows))
+	for _, f := range t.flows {
+		flows = append(flows, *f)
+	}
+	return flows
+}
+
+// add counts a packet of the flow key with ipBytes bytes, which frame
+// carried, at time at.
+func (t *FlowTable) add(key FlowKey, ipBytes int, frame []byte, at time.Time) {
+	pool := t.pool.Add(1)
+	if t.Sample != nil && t.SampleRate > 0 && rand.IntN(t.SampleRate) == 0 {
+		t.Sample(frame, pool)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f := t.flows[key]
+	if f == nil {
+		if t.flows == nil {
+			t.flows = map[FlowKey]*Flow{}
+		}
+		f = &Flow{FlowKey: key, First: at}
+		t.flows[key] = f
+	}
+	f.Packets++
+	f.Bytes += uint64(ipBytes)
+	f.Last = at
+}
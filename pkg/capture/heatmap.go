@@ -0,0 +1,253 @@
+package capture
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxBins bounds the loss bins of a flow: when they run out, neighbors
+// merge and each covers twice the sequence numbers.
+const maxBins = 4096
+
+// lossBin counts the sequence numbers of a bin received, and when the
+// earliest of them was sent, which places the bin in time.
+type lossBin struct {
+	received uint64
+	sent     time.Time
+}
+
+func (q *sequencer) bin(seq uint64, sent time.Time) {
+	for seq/q.binWidth >= maxBins {
+		for i := range len(q.bins) / 2 {
+			a, b := q.bins[2*i], q.bins[2*i+1]
+			if a.sent.IsZero() || !b.sent.IsZero() && b.sent.Before(a.sent) {
+				a.sent = b.sent
+			}
+			q.bins[i] = lossBin{received: a.received + b.received, sent: a.sent}
+		}
+		if len(q.bins)%2 == 1 {
+			q.bins[len(q.bins)/2] = q.bins[len(q.bins)-1]
+		}
+		q.bins = q.bins[:(len(q.bins)+1)/2]
+		q.binWidth *= 2
+	}
+	i := int(seq / q.binWidth)
+	if i >= len(q.bins) {
+		q.bins = append(q.bins, make([]lossBin, i+1-len(q.bins))...)
+	}
+	b := &q.bins[i]
+	b.received++
+	if b.sent.IsZero() || sent.Before(b.sent) {
+		b.sent = sent
+	}
+}
+
+// Heatmap is the loss of a sequence mode stream per flow and period of
+// the run, the periods going by the send times in the headers.
+type Heatmap struct {
+	Stream uint32        `json:"stream"`
+	Start  time.Time     `json:"start"`
+	Step   time.Duration `json:"step_ns"`
+	Flows  []HeatmapFlow `json:"flows"`
+}
+
+// HeatmapFlow is the row of a flow: the packets sent and lost in each
+// period.
+type HeatmapFlow struct {
+	Flow     string   `json:"flow"`
+	Expected []uint64 `json:"expected"`
+	Lost     []uint64 `json:"lost"`
+}
+
+// String formats k as source > destination.
+func (k FlowKey) String() string {
+	return netip.AddrPortFrom(k.Src, k.SrcPort).String() + " > " + netip.AddrPortFrom(k.Dst, k.DstPort).String()
+}
+
+// Heatmap returns the loss of the sequence mode stream in columns
+// periods, nil without sequence mode or packets. A packet lost counts in
+// the period its neighbors were sent in; those lost after the last one a
+// flow received don't show.
+func (c *Capture) Heatmap(columns int) *Heatmap {
+	s := c.seq.Load()
+	if s == nil || columns <= 0 {
+		return nil
+	}
+	type row struct {
+		key      FlowKey
+		expected []uint64
+		received []uint64
+		sent     []time.Time
+	}
+	var rows []row
+	var start, end time.Time
+	keys, qs := s.sequencers()
+	for i, q := range qs {
+		q.mu.Lock()
+		r := row{key: keys[i]}
+		for j, b := range q.bins {
+			first := uint64(j) * q.binWidth
+			if first >= q.stats.Next {
+				break
+			}
+			r.expected = append(r.expected, min(q.binWidth, q.stats.Next-first))
+			r.received = append(r.received, b.received)
+			r.sent = append(r.sent, b.sent)
+		}
+		q.mu.Unlock()
+		interpolate(r.sent)
+		if len(r.sent) == 0 {
+			continue
+		}
+		if start.IsZero() || r.sent[0].Before(start) {
+			start = r.sent[0]
+		}
+		if last := r.sent[len(r.sent)-1]; last.After(end) {
+			end = last
+		}
+		rows = append(rows, r)
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+
+	h := &Heatmap{Stream: s.stream, Start: start, Step: max(end.Sub(start)/time.Duration(columns), 1)}
+	if end.Sub(start) < time.Duration(columns) {
+		columns = int(end.Sub(start)) + 1
+	}
+	for _, r := range rows {
+		f := HeatmapFlow{Flow: r.key.String(), Expected: make([]uint64, columns), Lost: make([]uint64, columns)}
+		for j := range r.expected {
+			col := min(int(r.sent[j].Sub(start)/h.Step), columns-1)
+			f.Expected[col] += r.expected[j]
+			if r.received[j] < r.expected[j] {
+				f.Lost[col] += r.expected[j] - r.received[j]
+			}
+		}
+		h.Flows = append(h.Flows, f)
+	}
+	return h
+}
+
+// interpolate fills in the send times of bins nothing of arrived from
+// the bins around them.
+func interpolate(sent []time.Time) {
+	prev := -1
+	for i := range sent {
+		if sent[i].IsZero() {
+			continue
+		}
+		if prev < 0 {
+			for j := range i {
+				sent[j] = sent[i]
+			}
+		} else {
+			step := sent[i].Sub(sent[prev]) / time.Duration(i-prev)
+			for j := prev + 1; j < i; j++ {
+				sent[j] = sent[prev].Add(step * time.Duration(j-prev))
+			}
+		}
+		prev = i
+	}
+	if prev < 0 {
+		clear(sent)
+		return
+	}
+	for j := prev + 1; j < len(sent); j++ {
+		sent[j] = sent[prev]
+	}
+}
+
+// heatLevels are the characters of loss levels, by upper bound in
+// percent; more is '@'.
+var heatLevels = []struct {
+	below float64
+	char  byte
+}{{0.1, ':'}, {1, '-'}, {5, '='}, {10, '+'}, {25, '*'}, {50, '#'}}
+
+func heatChar(expected, lost uint64) byte {
+	switch {
+	case expected == 0:
+		return ' '
+	case lost == 0:
+		return '.'
+	}
+	pct := float64(lost) * 100 / float64(expected)
+	for _, l := range heatLevels {
+		if pct < l.below {
+			return l.char
+		}
+	}
+	return '@'
+}
+
+// Write draws h in text, a row per flow and a column per period, with
+// the loss of each flow at the end.
+func (h *Heatmap) Write(w io.Writer) {
+	if len(h.Flows) == 0 {
+		return
+	}
+	columns := len(h.Flows[0].Expected)
+	width := 0
+	for _, f := range h.Flows {
+		width = max(width, len(f.Flow))
+	}
+	fmt.Fprintf(w, "Loss heatmap: %d periods of %v\n", columns, roundLabel(h.Step))
+	endLabel := roundLabel(h.Step * time.Duration(columns)).String()
+	fmt.Fprintf(w, "%*s  0s%*s\n", width, "", columns-2, endLabel)
+	for _, f := range h.Flows {
+		var row strings.Builder
+		var expected, lost uint64
+		for i := range f.Expected {
+			row.WriteByte(heatChar(f.Expected[i], f.Lost[i]))
+			expected += f.Expected[i]
+			lost += f.Lost[i]
+		}
+		pct := 0.0
+		if expected > 0 {
+			pct = float64(lost) * 100 / float64(expected)
+		}
+		fmt.Fprintf(w, "%*s |%s| %d lost (%.2f%%)\n", width, f.Flow, row.String(), lost, pct)
+	}
+	fmt.Fprintln(w, "'.' none lost, ':' < 0.1%, '-' < 1%, '=' < 5%, '+' < 10%, '*' < 25%, '#' < 50%, '@' more")
+}
+
+// roundLabel rounds d to three significant digits or so, for the axis.
+func roundLabel(d time.Duration) time.Duration {
+	for unit := time.Second; unit >= time.Microsecond; unit /= 10 {
+		if d >= 100*unit {
+			return d.Round(unit)
+		}
+	}
+	return d
+}
+
+// WriteCSV writes h as CSV, a line per flow and period.
+func (h *Heatmap) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"stream", "flow", "start_s", "end_s", "expected", "lost", "loss_percent"})
+	for _, f := range h.Flows {
+		for i := range f.Expected {
+			pct := 0.0
+			if f.Expected[i] > 0 {
+				pct = float64(f.Lost[i]) * 100 / float64(f.Expected[i])
+			}
+			cw.Write([]string{
+				fmt.Sprintf("%08x", h.Stream),
+				f.Flow,
+				strconv.FormatFloat((h.Step * time.Duration(i)).Seconds(), 'f', 3, 64),
+				strconv.FormatFloat((h.Step * time.Duration(i+1)).Seconds(), 'f', 3, 64),
+				strconv.FormatUint(f.Expected[i], 10),
+				strconv.FormatUint(f.Lost[i], 10),
+				strconv.FormatFloat(pct, 'f', 4, 64),
+			})
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,145 @@
+package capture
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"time"
+
+	"gonet/pkg/trailer"
+)
+
+// TrailerStats are what the telemetry trailers of the packets told, see
+// package trailer. Delays are between timestamps taken by different
+// clocks, only right as far as those agree.
+type TrailerStats struct {
+	Packets  uint64     `json:"packets"`  // that carried a trailer
+	Overflow uint64     `json:"overflow"` // whose hop slots ran out
+	Hops     []HopStats `json:"hops"`
+}
+
+// HopStats is a leg of the path: from the sender, or the device before,
+// to a device, or to the receiver after the last one.
+type HopStats struct {
+	Hop      int    `json:"hop"` // from 1
+	Node     uint32 `json:"node"`
+	Receiver bool   `json:"receiver,omitempty"` // Node doesn't apply
+	Packets  uint64 `json:"packets"`
+
+	DelayMin time.Duration `json:"delay_min_ns"`
+	DelayAvg time.Duration `json:"delay_avg_ns"`
+	DelayMax time.Duration `json:"delay_max_ns"`
+	// ResidenceAvg is the average time in the device, as it reported.
+	ResidenceAvg time.Duration `json:"residence_avg_ns"`
+}
+
+// hopKey tells legs apart, the same hop of different paths being
+// different devices.
+type hopKey struct {
+	hop      int
+	node     uint32
+	receiver bool
+}
+
+// hopTracker sums up the trailers of a capture.
+type hopTracker struct {
+	mu       sync.Mutex
+	packets  uint64
+	overflow uint64
+	hops     map[hopKey]*hopSum
+}
+
+type hopSum struct {
+	stats        HopStats
+	delaySum     time.Duration
+	residenceSum time.Duration
+}
+
+func (t *hopTracker) add(payload []byte, captured time.Time) {
+	tr, ok := trailer.Parse(payload)
+	if !ok {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.packets++
+	if tr.Overflow {
+		t.overflow++
+	}
+	prev := tr.Sent
+	for i, h := range tr.Hops {
+		t.leg(hopKey{hop: i + 1, node: h.Node}, h.At.Sub(prev), h.Residence)
+		prev = h.At
+	}
+	t.leg(hopKey{hop: len(tr.Hops) + 1, receiver: true}, captured.Sub(prev), 0)
+}
+
+func (t *hopTracker) leg(key hopKey, delay, residence time.Duration) {
+	s := t.hops[key]
+	if s == nil {
+		if t.hops == nil {
+			t.hops = map[hopKey]*hopSum{}
+		}
+		s = &hopSum{stats: HopStats{Hop: key.hop, Node: key.node, Receiver: key.receiver}}
+		t.hops[key] = s
+	}
+	st := &s.stats
+	if st.Packets == 0 || delay < st.DelayMin {
+		st.DelayMin = delay
+	}
+	if st.Packets == 0 || delay > st.DelayMax {
+		st.DelayMax = delay
+	}
+	st.Packets++
+	s.delaySum += delay
+	s.residenceSum += residence
+}
+
+// load returns the stats, the legs in path order.
+func (t *hopTracker) load() TrailerStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ts := TrailerStats{Packets: t.packets, Overflow: t.overflow}
+	for _, s := range t.hops {
+		st := s.stats
+		st.DelayAvg = s.delaySum / time.Duration(st.Packets)
+		st.ResidenceAvg = s.residenceSum / time.Duration(st.Packets)
+		ts.Hops = append(ts.Hops, st)
+	}
+	slices.SortFunc(ts.Hops, func(a, b HopStats) int {
+		if c := cmp.Compare(a.Hop, b.Hop); c != 0 {
+			return c
+		}
+		if a.Receiver != b.Receiver {
+			if a.Receiver {
+				return 1
+			}
+			return -1
+		}
+		return cmp.Compare(a.Node, b.Node)
+	})
+	return ts
+}
+
+// Write prints s for people, a line per leg.
+func (s TrailerStats) Write(w io.Writer) {
+	fmt.Fprintf(w, "Trailer:   %d packets, %d out of hop slots\n", s.Packets, s.Overflow)
+	for _, h := range s.Hops {
+		to := fmt.Sprintf("node %d", h.Node)
+		if h.Receiver {
+			to = "receiver"
+		}
+		fmt.Fprintf(w, "  hop %d, %s: %d packets, delay min %.3f ms, avg %.3f ms, max %.3f ms", h.Hop, to, h.Packets,
+			ms(h.DelayMin), ms(h.DelayAvg), ms(h.DelayMax))
+		if h.ResidenceAvg > 0 {
+			fmt.Fprintf(w, ", residence avg %.3f ms", ms(h.ResidenceAvg))
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,191 @@
+package capture
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	"gonet/pkg/seqhdr"
+)
+
+// SequenceStats are what sequence mode learned from the seqhdr headers.
+// Latency is the capture time minus the send time, so it is only right
+// when both hosts' clocks agree, or after correcting it by their offset.
+type SequenceStats struct {
+	Received   uint64 `json:"received"`   // distinct sequence numbers
+	Duplicates uint64 `json:"duplicates"` // sequence numbers seen again
+	Reordered  uint64 `json:"reordered"`  // arrived after a higher one
+	Next       uint64 `json:"next"`       // highest sequence number seen plus one
+
+	LatencyMin time.Duration `json:"latency_min_ns"`
+	LatencyAvg time.Duration `json:"latency_avg_ns"`
+	LatencyMax time.Duration `json:"latency_max_ns"`
+	// Jitter is the smoothed variation of the latency as RFC 3550
+	// computes it.
+	Jitter time.Duration `json:"jitter_ns"`
+}
+
+// Lost returns how many of the first sent packets never arrived. With
+// sent 0 it counts the gaps below the highest sequence number seen.
+func (s SequenceStats) Lost(sent uint64) uint64 {
+	expected := sent
+	if expected == 0 {
+		expected = s.Next
+	}
+	if s.Received >= expected {
+		return 0
+	}
+	return expected - s.Received
+}
+
+// seqWindow is how far back duplicates are detected, older packets count
+// as reordered.
+const seqWindow = 1 << 20
+
+// streamSequencer tracks the sequence numbers of a stream, per flow as
+// senders number the packets of each destination on their own.
+type streamSequencer struct {
+	stream uint32
+
+	mu    sync.Mutex
+	flows map[FlowKey]*sequencer
+	order []FlowKey // as first seen
+}
+
+func (s *streamSequencer) add(key FlowKey, payload []byte, captured time.Time) {
+	h, ok := seqhdr.Parse(payload)
+	if !ok || h.Stream != s.stream {
+		return
+	}
+	s.mu.Lock()
+	q := s.flows[key]
+	if q == nil {
+		if s.flows == nil {
+			s.flows = map[FlowKey]*sequencer{}
+		}
+		q = &sequencer{binWidth: 1}
+		s.flows[key] = q
+		s.order = append(s.order, key)
+	}
+	s.mu.Unlock()
+	q.add(h, captured)
+}
+
+// load sums up the flows.
+func (s *streamSequencer) load() SequenceStats {
+	var sum SequenceStats
+	var latencySum time.Duration
+	var jitter float64
+	_, qs := s.sequencers()
+	for _, q := range qs {
+		q.mu.Lock()
+		f := q.stats
+		if f.Received > 0 {
+			if sum.Received == 0 || f.LatencyMin < sum.LatencyMin {
+				sum.LatencyMin = f.LatencyMin
+			}
+			if sum.Received == 0 || f.LatencyMax > sum.LatencyMax {
+				sum.LatencyMax = f.LatencyMax
+			}
+		}
+		sum.Received += f.Received
+		sum.Duplicates += f.Duplicates
+		sum.Reordered += f.Reordered
+		sum.Next += f.Next
+		latencySum += q.latencySum
+		jitter += q.jitter * float64(f.Received)
+		q.mu.Unlock()
+	}
+	if sum.Received > 0 {
+		sum.LatencyAvg = latencySum / time.Duration(sum.Received)
+		sum.Jitter = time.Duration(jitter / float64(sum.Received))
+	}
+	return sum
+}
+
+// sequencers returns the flows and their sequencers as first seen.
+func (s *streamSequencer) sequencers() ([]FlowKey, []*sequencer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	qs := make([]*sequencer, len(s.order))
+	for i, key := range s.order {
+		qs[i] = s.flows[key]
+	}
+	return slices.Clone(s.order), qs
+}
+
+// sequencer tracks the sequence numbers of one flow.
+type sequencer struct {
+	mu    sync.Mutex
+	seen  [seqWindow / 64]uint64 // ring bitmap of the last seqWindow numbers
+	stats SequenceStats
+
+	latencySum  time.Duration
+	lastLatency time.Duration
+	jitter      float64
+
+	// bins count the distinct sequence numbers received per binWidth of
+	// them, for the loss heatmap.
+	bins     []lossBin
+	binWidth uint64
+}
+
+func (q *sequencer) add(h seqhdr.Header, captured time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	s := &q.stats
+	switch {
+	case h.Seq >= s.Next:
+		// Forget the numbers leaving the window.
+		if h.Seq-s.Next >= seqWindow {
+			q.seen = [seqWindow / 64]uint64{}
+		} else {
+			for seq := s.Next; seq < h.Seq; seq++ {
+				q.clear(seq)
+			}
+		}
+		s.Next = h.Seq + 1
+	case s.Next-h.Seq > seqWindow:
+		s.Reordered++
+	case q.isSet(h.Seq):
+		s.Duplicates++
+		return
+	default:
+		s.Reordered++
+	}
+	q.set(h.Seq)
+	q.bin(h.Seq, h.Sent)
+
+	latency := captured.Sub(h.Sent)
+	if s.Received == 0 || latency < s.LatencyMin {
+		s.LatencyMin = latency
+	}
+	if s.Received == 0 || latency > s.LatencyMax {
+		s.LatencyMax = latency
+	}
+	if s.Received > 0 {
+		d := float64(latency - q.lastLatency)
+		if d < 0 {
+			d = -d
+		}
+		q.jitter += (d - q.jitter) / 16
+	}
+	q.lastLatency = latency
+	q.latencySum += latency
+	s.Received++
+}
+
+func (q *sequencer) isSet(seq uint64) bool {
+	i := seq % seqWindow
+	return q.seen[i/64]&(1<<(i%64)) != 0
+}
+
+func (q *sequencer) set(seq uint64) {
+	i := seq % seqWindow
+	q.seen[i/64] |= 1 << (i % 64)
+}
+
+func (q *sequencer) clear(seq uint64) {
+	i := seq % seqWindow
+	q.seen[i/64] &^= 1 << (i % 64)
+}
@@ -0,0 +1,141 @@
+package capture
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gonet/pkg/afxdp"
+	"gonet/pkg/stats"
+)
+
+// QueueStats are the counts of a receive queue with the xdp backend.
+type QueueStats struct {
+	Queue   int    `json:"queue"`
+	Packets uint64 `json:"packets"`
+	Bytes   uint64 `json:"bytes"`
+	afxdp.Stats
+}
+
+// xdpQueue is the socket of a receive queue.
+type xdpQueue struct {
+	queue    int
+	sock     *afxdp.Socket
+	counters stats.Counters
+
+	// closed is set once final has the kernel's last counts.
+	closed atomic.Bool
+	final  afxdp.Stats
+}
+
+// Queues returns the counts per receive queue of the xdp backend, none
+// with pcap.
+func (c *Capture) Queues() []QueueStats {
+	queues := c.xdp.Load()
+	if queues == nil {
+		return nil
+	}
+	var all []QueueStats
+	for _, q := range *queues {
+		s := QueueStats{Queue: q.queue}
+		s.Packets, s.Bytes = q.counters.Load()
+		if q.closed.Load() {
+			s.Stats = q.final
+		} else {
+			s.Stats, _ = q.sock.Stats()
+		}
+		all = append(all, s)
+	}
+	return all
+}
+
+// openXDP attaches the program steering cfg.Port to a socket per receive
+// queue of the interface.
+func openXDP(cfg Config) (*afxdp.Program, []*xdpQueue, error) {
+	n, err := afxdp.Queues(cfg.Interface)
+	if err != nil {
+		return nil, nil, err
+	}
+	var queues []*xdpQueue
+	closeAll := func() {
+		for _, q := range queues {
+			q.sock.Close()
+		}
+	}
+	for i := range n {
+		sock, err := afxdp.Open(afxdp.Config{Interface: cfg.Interface, Queue: i, Receive: true})
+		if err != nil {
+			closeAll()
+			return nil, nil, fmt.Errorf("queue %d: %v", i, err)
+		}
+		queues = append(queues, &xdpQueue{queue: i, sock: sock})
+	}
+	prog, err := afxdp.LoadRedirect(cfg.Interface, cfg.Port, n)
+	if err != nil {
+		closeAll()
+		return nil, nil, err
+	}
+	for _, q := range queues {
+		if err := prog.Register(q.queue, q.sock); err != nil {
+			prog.Close()
+			closeAll()
+			return nil, nil, err
+		}
+	}
+	return prog, queues, nil
+}
+
+// runXDP counts the packets the program steers to the queues' sockets,
+// reading each queue on its own goroutine. -promisc doesn't apply: the
+// program sees what the NIC accepts. Frames of other traffic, and UDP in
+// VLAN tags, pass on to the network stack uncounted.
+func (c *Capture) runXDP(ctx context.Context, cfg Config, prog *afxdp.Program, queues []*xdpQueue) error {
+	defer func() {
+		prog.Close()
+		for _, q := range queues {
+			q.final, _ = q.sock.Stats()
+			q.closed.Store(true)
+			q.sock.Close()
+		}
+	}()
+	c.xdp.Store(&queues)
+	slog.Info("Receiving with AF_XDP", "interface", cfg.Interface, "queues", len(queues), "generic", prog.Generic())
+
+	seq, hops, flows := c.observers(cfg)
+	if cfg.Ready != nil {
+		cfg.Ready()
+	}
+
+	// A failing queue stops the others.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var wg sync.WaitGroup
+	errs := make(chan error, len(queues))
+	for _, xq := range queues {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			dec := newUDPDecoder(seq, hops, flows)
+			for ctx.Err() == nil {
+				_, err := xq.sock.Receive(100*time.Millisecond, func(frame []byte) {
+					c.counters.Add(1, uint64(len(frame)))
+					xq.counters.Add(1, uint64(len(frame)))
+					if dec != nil {
+						dec.observe(frame, time.Now())
+					}
+				})
+				if err != nil {
+					errs <- fmt.Errorf("queue %d: %v", xq.queue, err)
+					cancel()
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
@@ -0,0 +1,169 @@
+// Package config reads the -config files of the gonet tools. A file is a
+// YAML (or JSON) mapping whose keys are flag names, setting the flags that
+// weren't given on the command line, plus the sections a tool documents
+// for what flags can't express, like lists of targets or rules.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// Load reads the mapping in the YAML or JSON file at path.
+func Load(path string) (map[string]any, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return doc, nil
+}
+
+// Parse parses a YAML or JSON document holding a mapping.
+func Parse(data []byte) (map[string]any, error) {
+	var v any
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		dec := json.NewDecoder(bytes.NewReader(trimmed))
+		dec.UseNumber()
+		if err := dec.Decode(&v); err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		if v, err = parseYAML(data); err != nil {
+			return nil, err
+		}
+	}
+
+	if v == nil {
+		return map[string]any{}, nil
+	}
+	doc, ok := v.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("want a mapping of flag names and sections, got %T", v)
+	}
+	return doc, nil
+}
+
+// LoadFlags reads path and sets the flags of fs it names, leaving the ones
+// given on the command line alone, so call it after fs.Parse. Lists set a
+// repeatable flag once per item. The sections are returned, any other key
+// is an error. An empty path does nothing.
+func LoadFlags(fs *flag.FlagSet, path string, sections ...string) (map[string]any, error) {
+	if path == "" {
+		return map[string]any{}, nil
+	}
+	doc, err := Load(path)
+	if err != nil {
+		return nil, err
+	}
+	rest, err := ApplyFlags(fs, doc, sections...)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return rest, nil
+}
+
+// ApplyFlags is LoadFlags for a parsed document.
+func ApplyFlags(fs *flag.FlagSet, doc map[string]any, sections ...string) (map[string]any, error) {
+	given := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	rest := map[string]any{}
+	for key, value := range doc {
+		if slices.Contains(sections, key) {
+			rest[key] = value
+			continue
+		}
+		if fs.Lookup(key) == nil {
+			return nil, fmt.Errorf("unknown key %q, not a flag of %s", key, fs.Name())
+		}
+		if given[key] || value == nil {
+			continue
+		}
+
+		values, ok := value.([]any)
+		if !ok {
+			values = []any{value}
+		}
+		for _, v := range values {
+			s, err := flagValue(v)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", key, err)
+			}
+			if err := fs.Set(key, s); err != nil {
+				return nil, fmt.Errorf("%s: %v", key, err)
+			}
+		}
+	}
+	return rest, nil
+}
+
+// flagValue formats a scalar the way it would be written on the command
+// line.
+func flagValue(v any) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case json.Number:
+		return v.String(), nil
+	}
+	return "", fmt.Errorf("want a value or a list of values, got %T", v)
+}
+
+// Decode converts a section into out the way encoding/json would decode
+// it, rejecting unknown fields.
+func Decode(section, out any) error {
+	data, err := json.Marshal(section)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode(out)
+}
+
+// Duration is a time.Duration that sections write like a flag, "1m30s",
+// or as seconds.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var v any
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case string:
+		parsed, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*d = Duration(parsed)
+	case float64:
+		*d = Duration(v * float64(time.Second))
+	default:
+		return fmt.Errorf("invalid duration %s", b)
+	}
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
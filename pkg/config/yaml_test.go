@@ -0,0 +1,210 @@
+package config
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseYAML(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+		want any
+	}{
+		{name: "empty", doc: "", want: nil},
+		{name: "only comments", doc: "# nothing\n---\n  # here\n", want: nil},
+		{
+			name: "scalars",
+			doc: "int: 42\nneg: -7\nfloat: 1.5\nexp: 1e3\ntrue: true\nfalse: False\nnull: ~\n" +
+				"hex: 0x10\nunderscore: 1_000\nstring: hello world\nurl: http://example.com:8080/x\n",
+			want: map[string]any{
+				"int": int64(42), "neg": int64(-7), "float": 1.5, "exp": 1000.0,
+				"true": true, "false": false, "null": nil,
+				"hex": "0x10", "underscore": "1_000",
+				"string": "hello world", "url": "http://example.com:8080/x",
+			},
+		},
+		{
+			name: "quoted scalars",
+			doc: `double: "a # not a comment"` + "\n" +
+				`escaped: "tab\there \"q\""` + "\n" +
+				`single: 'it''s'` + "\n" +
+				`number: "42"` + "\n" +
+				`"quoted key": 'v: w'` + "\n",
+			want: map[string]any{
+				"double": "a # not a comment", "escaped": "tab\there \"q\"",
+				"single": "it's", "number": "42", "quoted key": "v: w",
+			},
+		},
+		{
+			name: "comments",
+			doc:  "a: b # trailing\nc: d#not-a-comment\n# whole line\n",
+			want: map[string]any{"a": "b", "c": "d#not-a-comment"},
+		},
+		{
+			name: "nested mappings",
+			doc:  "outer:\n  inner:\n    leaf: 1\n  other: x\nnext: y\n",
+			want: map[string]any{
+				"outer": map[string]any{"inner": map[string]any{"leaf": int64(1)}, "other": "x"},
+				"next":  "y",
+			},
+		},
+		{
+			name: "indented sequence",
+			doc:  "list:\n  - a\n  - 2\nafter: z\n",
+			want: map[string]any{"list": []any{"a", int64(2)}, "after": "z"},
+		},
+		{
+			name: "same-indent sequence",
+			doc:  "list:\n- a\n- b\nafter: z\n",
+			want: map[string]any{"list": []any{"a", "b"}, "after": "z"},
+		},
+		{
+			name: "sequence of mappings",
+			doc:  "routes:\n  - host: a\n    port: 80\n  - host: b\n    tags: [x, y]\n",
+			want: map[string]any{"routes": []any{
+				map[string]any{"host": "a", "port": int64(80)},
+				map[string]any{"host": "b", "tags": []any{"x", "y"}},
+			}},
+		},
+		{
+			name: "nested sequences",
+			doc:  "m:\n  -\n    - 1\n    - 2\n  - -\n",
+			want: map[string]any{"m": []any{[]any{int64(1), int64(2)}, "-"}},
+		},
+		{
+			name: "empty values",
+			doc:  "a:\nb:\n  -\nc: x\n",
+			want: map[string]any{"a": nil, "b": []any{nil}, "c": "x"},
+		},
+		{
+			name: "flow collections",
+			doc: "list: [a, 'b, c', \"d]\", 3]\nempty: []\nmap: {k: v, n: 1, l: [1, 2]}\n" +
+				"nested: [[1, 2], {a: b}]\ntrailing: [a, ]\n",
+			want: map[string]any{
+				"list":     []any{"a", "b, c", "d]", int64(3)},
+				"empty":    []any{},
+				"map":      map[string]any{"k": "v", "n": int64(1), "l": []any{int64(1), int64(2)}},
+				"nested":   []any{[]any{int64(1), int64(2)}, map[string]any{"a": "b"}},
+				"trailing": []any{"a"},
+			},
+		},
+		{
+			name: "top-level sequence",
+			doc:  "- a\n- b: c\n",
+			want: []any{"a", map[string]any{"b": "c"}},
+		},
+		{
+			name: "CRLF line endings",
+			doc:  "a: 1\r\nb:\r\n  - x\r\n",
+			want: map[string]any{"a": int64(1), "b": []any{"x"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseYAML([]byte(tt.doc))
+			if err != nil {
+				t.Fatalf("parseYAML: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseYAML = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseYAMLErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		doc     string
+		wantErr string
+	}{
+		{name: "tab indentation", doc: "a:\n\tb: 1\n", wantErr: "line 2: tabs"},
+		{name: "over-indented key", doc: "a: 1\n  b: 2\n", wantErr: "line 2: unexpected indentation"},
+		{name: "dedent below document", doc: "  a: 1\nb: 2\n", wantErr: "line 2: unexpected indentation"},
+		{name: "sequence item in mapping", doc: "a: 1\n- b\n", wantErr: "line 2: unexpected indentation"},
+		{name: "missing colon", doc: "a: 1\njust text\n", wantErr: "line 2: want key: value"},
+		{name: "duplicate key", doc: "a: 1\nb: 2\na: 3\n", wantErr: `line 3: duplicate key "a"`},
+		{name: "unterminated string", doc: `a: "open` + "\n", wantErr: "line 1: unterminated string"},
+		{name: "text after closing quote", doc: `a: "x" y` + "\n", wantErr: "line 1: unterminated string"},
+		{name: "bad escape", doc: `a: "\q"` + "\n", wantErr: "line 1: invalid syntax"},
+		{name: "unterminated list", doc: "a: [1, 2\n", wantErr: "line 1: unterminated list"},
+		{name: "unterminated mapping", doc: "a: {k: v\n", wantErr: "line 1: unterminated mapping"},
+		{name: "flow mapping without value", doc: "a: {k}\n", wantErr: "line 1: want key: value"},
+		{name: "error inside flow list", doc: "a: [\"x]\n", wantErr: "line 1: unterminated"},
+		{name: "block scalar", doc: "a: |\n  text\n", wantErr: "line 1: unsupported YAML |"},
+		{name: "anchor", doc: "a: &x 1\n", wantErr: "line 1: unsupported YAML &x 1"},
+		{name: "alias", doc: "a: *x\n", wantErr: "line 1: unsupported YAML *x"},
+		{name: "tag", doc: "a: !!str 1\n", wantErr: "line 1: unsupported YAML !!str 1"},
+		{name: "error in sequence item", doc: "- 'open\n", wantErr: "line 1: unterminated string"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseYAML([]byte(tt.doc))
+			if err == nil {
+				t.Fatalf("parseYAML = %#v, want error containing %q", got, tt.wantErr)
+			}
+			if !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parseYAML error = %q, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSplitFlow(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"", []string{""}},
+		{"a", []string{"a"}},
+		{" a , b ,c", []string{"a", "b", "c"}},
+		{`"a,b", 'c,d'`, []string{`"a,b"`, `'c,d'`}},
+		{`"a\",b", c`, []string{`"a\",b"`, "c"}},
+		{"[1, 2], {a: b, c: d}, e", []string{"[1, 2]", "{a: b, c: d}", "e"}},
+	}
+	for _, tt := range tests {
+		if got := splitFlow(tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitFlow(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestClosingQuote(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int
+	}{
+		{`"abc"`, 4},
+		{`"a\"b" rest`, 5},
+		{`"a\\"`, 4},
+		{`'it''s'`, 6},
+		{`'a'b'`, 2},
+		{`"open`, -1},
+		{`'open''`, -1},
+	}
+	for _, tt := range tests {
+		if got := closingQuote(tt.in); got != tt.want {
+			t.Errorf("closingQuote(%q) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	doc, err := Parse([]byte(`{"count": 3, "targets": ["a"]}`))
+	if err != nil {
+		t.Fatalf("Parse JSON: %v", err)
+	}
+	if got := doc["count"]; got != json.Number("3") {
+		t.Errorf("count = %#v, want json.Number(\"3\")", got)
+	}
+	if _, err := Parse([]byte("- a\n- b\n")); err == nil {
+		t.Error("Parse of a sequence succeeded, want an error")
+	}
+	doc, err = Parse([]byte("# empty\n"))
+	if err != nil || len(doc) != 0 {
+		t.Errorf("Parse of an empty document = %v, %v, want an empty mapping", doc, err)
+	}
+}
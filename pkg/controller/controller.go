@@ -0,0 +1,330 @@
+// Package controller drives gonet agents from a scenario file: it starts
+// the receivers, then the senders and replays, waits for them to finish
+// and merges what each receiver saw of its sender into one report, so one
+// run can test a whole traffic matrix.
+package controller
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"time"
+
+	"gonet/pkg/agent"
+	"gonet/pkg/apiauth"
+	"gonet/pkg/config"
+	"gonet/pkg/session"
+)
+
+// Scenario is the file gonet controller runs.
+type Scenario struct {
+	// Agents maps names to agent addresses, host:port or URLs.
+	Agents map[string]string `json:"agents"`
+
+	// Drain is how long receivers keep capturing after the last sender
+	// is done, default one second.
+	Drain config.Duration `json:"drain"`
+
+	Jobs []Job `json:"jobs"`
+
+	// Token is sent to the agents as a bearer token, see package
+	// apiauth. It comes from gonet controller -token, not the file.
+	Token string `json:"-"`
+}
+
+// Job is a job of the scenario, an agent.JobSpec with where to run it.
+type Job struct {
+	Name  string `json:"name"` // default agent/kind/index
+	Agent string `json:"agent"`
+	// From names the send job a recv job measures, taking its stream,
+	// sequence mode and port.
+	From string `json:"from"`
+
+	agent.JobSpec
+}
+
+// JobResult is the final status of a job.
+type JobResult struct {
+	Name   string       `json:"name"`
+	Agent  string       `json:"agent"`
+	Status agent.Status `json:"status"`
+}
+
+// Flow is what a recv job saw of its From job.
+type Flow struct {
+	From   string          `json:"from"`
+	To     string          `json:"to"`
+	Report *session.Report `json:"report"`
+}
+
+// Result is the outcome of a scenario.
+type Result struct {
+	Jobs  []JobResult `json:"jobs"`
+	Flows []Flow      `json:"flows"`
+}
+
+// Load reads a scenario from a YAML or JSON file.
+func Load(path string) (*Scenario, error) {
+	doc, err := config.Load(path)
+	if err != nil {
+		return nil, err
+	}
+	var sc Scenario
+	if err := config.Decode(doc, &sc); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if err := sc.check(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &sc, nil
+}
+
+// check validates the scenario and fills in names, streams and the
+// settings recv jobs take from their senders.
+func (sc *Scenario) check() error {
+	if len(sc.Jobs) == 0 {
+		return fmt.Errorf("no jobs")
+	}
+	byName := map[string]*Job{}
+	for i := range sc.Jobs {
+		j := &sc.Jobs[i]
+		if _, ok := sc.Agents[j.Agent]; !ok {
+			return fmt.Errorf("job %d: unknown agent %q", i+1, j.Agent)
+		}
+		if j.Name == "" {
+			j.Name = fmt.Sprintf("%s/%s/%d", j.Agent, j.Kind, i+1)
+		}
+		if byName[j.Name] != nil {
+			return fmt.Errorf("duplicate job name %q", j.Name)
+		}
+		byName[j.Name] = j
+		if j.Kind == agent.KindSend && j.Sequence && j.Stream == 0 {
+			j.Stream = rand.Uint32()
+		}
+	}
+
+	for i := range sc.Jobs {
+		j := &sc.Jobs[i]
+		if j.From == "" {
+			continue
+		}
+		from := byName[j.From]
+		if j.Kind != agent.KindRecv || from == nil || from.Kind != agent.KindSend {
+			return fmt.Errorf("job %s: from must name a send job and is only for recv jobs", j.Name)
+		}
+		j.Sequence, j.Stream = from.Sequence, from.Stream
+		if j.Port == 0 {
+			j.Port = from.DestPort
+		}
+	}
+	return nil
+}
+
+// started is a job running on its agent.
+type started struct {
+	job    *Job
+	client *client
+	status agent.Status
+}
+
+// Run runs the scenario. Cancelling ctx stops the senders early, the
+// result then covers what ran.
+func Run(ctx context.Context, sc *Scenario) (*Result, error) {
+	clients := map[string]*client{}
+	for name, addr := range sc.Agents {
+		clients[name] = newClient(addr, sc.Token)
+	}
+
+	// Receivers first, an agent answers once its capture is up.
+	var recvs, senders []*started
+	stopAll := func() {
+		for _, s := range append(recvs, senders...) {
+			s.client.stop(s.status.ID)
+		}
+	}
+	for _, kind := range []string{agent.KindRecv, ""} {
+		for i := range sc.Jobs {
+			j := &sc.Jobs[i]
+			if (kind == agent.KindRecv) != (j.Kind == agent.KindRecv) {
+				continue
+			}
+			status, err := clients[j.Agent].start(j.JobSpec)
+			if err != nil {
+				stopAll()
+				return nil, fmt.Errorf("starting %s: %v", j.Name, err)
+			}
+			slog.Info("Started job", "name", j.Name, "job", status.ID, "agent", j.Agent)
+			s := &started{job: j, client: clients[j.Agent], status: *status}
+			if kind == agent.KindRecv {
+				recvs = append(recvs, s)
+			} else {
+				senders = append(senders, s)
+			}
+		}
+	}
+
+	// Wait for the senders, or for bounded receivers when there are none.
+	waitFor := senders
+	if len(waitFor) == 0 {
+		waitFor = recvs
+	}
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for running(waitFor) {
+		select {
+		case <-ctx.Done():
+			slog.Info("Interrupted, stopping the jobs")
+			for _, s := range senders {
+				s.client.stop(s.status.ID)
+			}
+			waitFor = nil
+		case <-ticker.C:
+			for _, s := range waitFor {
+				if s.status.State != agent.StateRunning {
+					continue
+				}
+				if status, err := s.client.get(s.status.ID); err != nil {
+					slog.Warn("Failed to poll job", "name", s.job.Name, "err", err)
+				} else {
+					s.status = *status
+				}
+			}
+		}
+	}
+
+	if len(senders) > 0 {
+		drain := time.Duration(sc.Drain)
+		if drain <= 0 {
+			drain = time.Second
+		}
+		time.Sleep(drain)
+	}
+
+	res := &Result{}
+	byName := map[string]*started{}
+	for _, s := range append(recvs, senders...) {
+		// Stopping returns the final status, also of finished jobs.
+		if status, err := s.client.stop(s.status.ID); err != nil {
+			slog.Warn("Failed to stop job", "name", s.job.Name, "err", err)
+		} else {
+			s.status = *status
+		}
+		byName[s.job.Name] = s
+	}
+	for i := range sc.Jobs {
+		s := byName[sc.Jobs[i].Name]
+		res.Jobs = append(res.Jobs, JobResult{Name: s.job.Name, Agent: s.job.Agent, Status: s.status})
+	}
+	for _, to := range recvs {
+		from := byName[to.job.From]
+		if from == nil {
+			continue
+		}
+		res.Flows = append(res.Flows, Flow{From: from.job.Name, To: to.job.Name, Report: flowReport(from.status, to.status)})
+	}
+	return res, nil
+}
+
+func running(jobs []*started) bool {
+	for _, s := range jobs {
+		if s.status.State == agent.StateRunning {
+			return true
+		}
+	}
+	return false
+}
+
+// flowReport merges a sender's and a receiver's final status.
+func flowReport(from, to agent.Status) *session.Report {
+	spec := from.Spec
+	r := &session.Report{
+		Params: session.Params{
+			Stream:   spec.Stream,
+			Port:     to.Spec.Port,
+			PPS:      spec.PPS,
+			Size:     spec.Size,
+			Duration: time.Duration(spec.Duration),
+			Sequence: spec.Sequence,
+		},
+		Elapsed:  from.Elapsed,
+		Sent:     session.Counts{Packets: from.Packets, Bytes: from.Bytes},
+		Received: session.Counts{Packets: to.Packets, Bytes: to.Bytes},
+		Sequence: to.Sequence,
+	}
+	r.Merge()
+	return r
+}
+
+// Write prints r for people.
+func (r *Result) Write(w io.Writer) {
+	for _, j := range r.Jobs {
+		s := j.Status
+		fmt.Fprintf(w, "%-24s %-7s %-8s %10d packets %14d bytes  %v", j.Name, s.Spec.Kind, s.State, s.Packets, s.Bytes, s.Elapsed.Round(time.Millisecond))
+		if s.Error != "" {
+			fmt.Fprintf(w, "  %s", s.Error)
+		}
+		fmt.Fprintln(w)
+	}
+	for _, f := range r.Flows {
+		fmt.Fprintf(w, "\n%s -> %s\n", f.From, f.To)
+		f.Report.Write(w)
+	}
+}
+
+// client talks to one agent.
+type client struct {
+	base  string
+	token string
+	http  *http.Client
+}
+
+func newClient(addr, token string) *client {
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	return &client{base: strings.TrimSuffix(addr, "/"), token: token, http: &http.Client{Timeout: 30 * time.Second}}
+}
+
+func (c *client) start(spec agent.JobSpec) (*agent.Status, error) {
+	body, err := json.Marshal(spec)
+	if err != nil {
+		return nil, err
+	}
+	return c.do(http.MethodPost, "/jobs", body)
+}
+
+func (c *client) get(id string) (*agent.Status, error) {
+	return c.do(http.MethodGet, "/jobs/"+id, nil)
+}
+
+func (c *client) stop(id string) (*agent.Status, error) {
+	return c.do(http.MethodDelete, "/jobs/"+id, nil)
+}
+
+func (c *client) do(method, path string, body []byte) (*agent.Status, error) {
+	req, err := http.NewRequest(method, c.base+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	apiauth.Set(req, c.token)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	var status agent.Status
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
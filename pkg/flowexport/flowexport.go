@@ -0,0 +1,148 @@
+// Package flowexport sends the flows gonet udp recv sees to a collector,
+// as NetFlow v9 or IPFIX records or as sFlow packet samples, so test
+// traffic shows up where the production flows are analyzed.
+package flowexport
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"gonet/pkg/capture"
+)
+
+// The formats Config.Format takes.
+const (
+	NetFlow9 = "netflow9"
+	IPFIX    = "ipfix"
+	SFlow    = "sflow"
+)
+
+// maxMessage bounds the datagrams sent, to stay within common MTUs.
+const maxMessage = 1400
+
+// Config is where and how flows go.
+type Config struct {
+	Collector string // UDP host:port
+	Format    string
+
+	// Interval is how often NetFlow and IPFIX records of the traffic
+	// since the last ones go out, the active timeout of a router. sFlow
+	// samples go out when a datagram is full or a second has passed.
+	Interval time.Duration
+
+	// SampleRate is how many packets there are per sFlow sample.
+	SampleRate int
+
+	// IfIndex is the interface index records give as the input.
+	IfIndex int
+}
+
+// Exporter sends the flows of a capture.FlowTable.
+type Exporter struct {
+	cfg   Config
+	conn  net.Conn
+	start time.Time // the system uptime of NetFlow and sFlow starts here
+
+	// NetFlow and IPFIX.
+	seq  uint32 // messages for NetFlow, data records for IPFIX
+	last map[capture.FlowKey]capture.Flow
+
+	// sFlow.
+	samples   chan sample
+	dropped   atomic.Uint32
+	sampleSeq uint32
+}
+
+// New connects to the collector.
+func New(cfg Config) (*Exporter, error) {
+	switch cfg.Format {
+	case NetFlow9, IPFIX:
+		if cfg.Interval <= 0 {
+			return nil, fmt.Errorf("invalid export interval %v", cfg.Interval)
+		}
+	case SFlow:
+		if cfg.SampleRate <= 0 {
+			return nil, fmt.Errorf("invalid sampling rate %d", cfg.SampleRate)
+		}
+	default:
+		return nil, fmt.Errorf("unknown flow export format %q, want %s, %s or %s", cfg.Format, NetFlow9, IPFIX, SFlow)
+	}
+	conn, err := net.Dial("udp", cfg.Collector)
+	if err != nil {
+		return nil, err
+	}
+	return &Exporter{
+		cfg:     cfg,
+		conn:    conn,
+		start:   time.Now(),
+		last:    map[capture.FlowKey]capture.Flow{},
+		samples: make(chan sample, 1024),
+	}, nil
+}
+
+// Table returns a flow table for the captures to fill, sampling into e
+// with sFlow.
+func (e *Exporter) Table() *capture.FlowTable {
+	t := &capture.FlowTable{}
+	if e.cfg.Format == SFlow {
+		t.SampleRate, t.Sample = e.cfg.SampleRate, e.sample
+	}
+	return t
+}
+
+// Run exports the flows of t until ctx is done, then what is left, and
+// closes the connection. Failed sends are logged and skipped.
+func (e *Exporter) Run(ctx context.Context, t *capture.FlowTable) {
+	defer e.conn.Close()
+	slog.Info("Exporting flows", "collector", e.cfg.Collector, "format", e.cfg.Format)
+	if e.cfg.Format == SFlow {
+		e.runSFlow(ctx)
+		return
+	}
+	ticker := time.NewTicker(e.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			e.export(t.Flows(), time.Now())
+			return
+		case now := <-ticker.C:
+			e.export(t.Flows(), now)
+		}
+	}
+}
+
+// export sends the traffic of flows since the last export.
+func (e *Exporter) export(flows []capture.Flow, now time.Time) {
+	var changed []capture.Flow
+	for _, f := range flows {
+		prev, seen := e.last[f.FlowKey]
+		if seen && prev.Packets == f.Packets {
+			continue
+		}
+		e.last[f.FlowKey] = f
+		if seen {
+			// The first packet since is later, this is as close as
+			// the counts get.
+			f.Packets -= prev.Packets
+			f.Bytes -= prev.Bytes
+			f.First = prev.Last
+		}
+		changed = append(changed, f)
+	}
+	for _, m := range e.messages(changed, now) {
+		if _, err := e.conn.Write(m); err != nil {
+			slog.Warn("Failed to export flows", "collector", e.cfg.Collector, "err", err)
+		}
+	}
+}
+
+// uptime returns the milliseconds from the start of e to t, the system
+// uptime NetFlow v9 and sFlow timestamps count from.
+func (e *Exporter) uptime(t time.Time) uint32 {
+	return uint32(max(t.Sub(e.start), 0).Milliseconds())
+}
@@ -0,0 +1,175 @@
+package flowexport
+
+import (
+	"encoding/binary"
+	"time"
+
+	"gonet/pkg/capture"
+)
+
+// Information elements of the records, NetFlow v9 and IPFIX sharing their
+// numbers but for the timestamps.
+const (
+	ieOctets    = 1
+	iePackets   = 2
+	ieProtocol  = 4
+	ieSrcPort   = 7
+	ieSrcIPv4   = 8
+	ieInputIf   = 10
+	ieDstPort   = 11
+	ieDstIPv4   = 12
+	ieLast      = 21 // NetFlow v9, uptime milliseconds
+	ieFirst     = 22
+	ieSrcIPv6   = 27
+	ieDstIPv6   = 28
+	ieStartMsec = 152 // IPFIX, Unix milliseconds
+	ieEndMsec   = 153
+)
+
+type field struct{ id, len uint16 }
+
+type template struct {
+	id     uint16
+	fields []field
+}
+
+func (t template) recordLen() int {
+	n := 0
+	for _, f := range t.fields {
+		n += int(f.len)
+	}
+	return n
+}
+
+// templates returns the templates of IPv4 and IPv6 flows of format.
+func templates(format string) [2]template {
+	first, last := field{ieFirst, 4}, field{ieLast, 4}
+	if format == IPFIX {
+		first, last = field{ieStartMsec, 8}, field{ieEndMsec, 8}
+	}
+	common := []field{{ieSrcPort, 2}, {ieDstPort, 2}, {ieProtocol, 1}, {iePackets, 8}, {ieOctets, 8}, first, last, {ieInputIf, 4}}
+	return [2]template{
+		{256, append([]field{{ieSrcIPv4, 4}, {ieDstIPv4, 4}}, common...)},
+		{257, append([]field{{ieSrcIPv6, 16}, {ieDstIPv6, 16}}, common...)},
+	}
+}
+
+// messages encodes flows as NetFlow v9 or IPFIX messages of at most
+// maxMessage bytes, each starting with the templates it uses so a
+// collector that missed earlier ones can decode it.
+func (e *Exporter) messages(flows []capture.Flow, now time.Time) [][]byte {
+	tmpls := templates(e.cfg.Format)
+	byFamily := [2][]capture.Flow{}
+	for _, f := range flows {
+		i := 0
+		if f.Src.Is6() {
+			i = 1
+		}
+		byFamily[i] = append(byFamily[i], f)
+	}
+
+	var msgs [][]byte
+	for i, t := range tmpls {
+		rest := byFamily[i]
+		for len(rest) > 0 {
+			m := e.header(now)
+			m = appendTemplate(m, e.cfg.Format, t)
+			setStart := len(m)
+			m = binary.BigEndian.AppendUint16(m, t.id)
+			m = append(m, 0, 0) // set length
+			n := 0
+			for len(rest) > 0 && len(m)+t.recordLen()+3 <= maxMessage {
+				m = e.appendRecord(m, t, rest[0])
+				rest = rest[1:]
+				n++
+			}
+			for (len(m)-setStart)%4 != 0 {
+				m = append(m, 0)
+			}
+			binary.BigEndian.PutUint16(m[setStart+2:], uint16(len(m)-setStart))
+			msgs = append(msgs, e.finish(m, n))
+		}
+	}
+	return msgs
+}
+
+// header starts a message; finish fills in what depends on its content.
+func (e *Exporter) header(now time.Time) []byte {
+	if e.cfg.Format == IPFIX {
+		m := make([]byte, 16)
+		binary.BigEndian.PutUint16(m[0:], 10)
+		binary.BigEndian.PutUint32(m[4:], uint32(now.Unix()))
+		binary.BigEndian.PutUint32(m[8:], e.seq)
+		binary.BigEndian.PutUint32(m[12:], 1) // observation domain
+		return m
+	}
+	m := make([]byte, 20)
+	binary.BigEndian.PutUint16(m[0:], 9)
+	binary.BigEndian.PutUint32(m[4:], e.uptime(now))
+	binary.BigEndian.PutUint32(m[8:], uint32(now.Unix()))
+	binary.BigEndian.PutUint32(m[12:], e.seq)
+	binary.BigEndian.PutUint32(m[16:], 1) // source ID
+	return m
+}
+
+// finish completes message m of n data records: IPFIX has the length in
+// the header and counts data records in its sequence, NetFlow v9 counts
+// the records, the template among them, and the messages.
+func (e *Exporter) finish(m []byte, n int) []byte {
+	if e.cfg.Format == IPFIX {
+		binary.BigEndian.PutUint16(m[2:], uint16(len(m)))
+		e.seq += uint32(n)
+	} else {
+		binary.BigEndian.PutUint16(m[2:], uint16(n+1))
+		e.seq++
+	}
+	return m
+}
+
+func appendTemplate(m []byte, format string, t template) []byte {
+	setID := uint16(0)
+	if format == IPFIX {
+		setID = 2
+	}
+	m = binary.BigEndian.AppendUint16(m, setID)
+	m = binary.BigEndian.AppendUint16(m, uint16(4+4+4*len(t.fields)))
+	m = binary.BigEndian.AppendUint16(m, t.id)
+	m = binary.BigEndian.AppendUint16(m, uint16(len(t.fields)))
+	for _, f := range t.fields {
+		m = binary.BigEndian.AppendUint16(m, f.id)
+		m = binary.BigEndian.AppendUint16(m, f.len)
+	}
+	return m
+}
+
+func (e *Exporter) appendRecord(m []byte, t template, f capture.Flow) []byte {
+	for _, fl := range t.fields {
+		switch fl.id {
+		case ieSrcIPv4, ieSrcIPv6:
+			m = append(m, f.Src.AsSlice()...)
+		case ieDstIPv4, ieDstIPv6:
+			m = append(m, f.Dst.AsSlice()...)
+		case ieSrcPort:
+			m = binary.BigEndian.AppendUint16(m, f.SrcPort)
+		case ieDstPort:
+			m = binary.BigEndian.AppendUint16(m, f.DstPort)
+		case ieProtocol:
+			m = append(m, 17) // UDP
+		case iePackets:
+			m = binary.BigEndian.AppendUint64(m, f.Packets)
+		case ieOctets:
+			m = binary.BigEndian.AppendUint64(m, f.Bytes)
+		case ieFirst:
+			m = binary.BigEndian.AppendUint32(m, e.uptime(f.First))
+		case ieLast:
+			m = binary.BigEndian.AppendUint32(m, e.uptime(f.Last))
+		case ieStartMsec:
+			m = binary.BigEndian.AppendUint64(m, uint64(f.First.UnixMilli()))
+		case ieEndMsec:
+			m = binary.BigEndian.AppendUint64(m, uint64(f.Last.UnixMilli()))
+		case ieInputIf:
+			m = binary.BigEndian.AppendUint32(m, uint32(e.cfg.IfIndex))
+		}
+	}
+	return m
+}
@@ -0,0 +1,132 @@
+package flowexport
+
+import (
+	"context"
+	"encoding/binary"
+	"log/slog"
+	"net"
+	"time"
+)
+
+// headerLen is how much of a sampled frame sFlow carries, the usual
+// agent default.
+const headerLen = 128
+
+// sample is a frame sampled by the flow table.
+type sample struct {
+	header   []byte
+	frameLen int
+	pool     uint64
+}
+
+// sample keeps the start of frame for the next datagram, dropping it
+// when the exporter falls behind, as sFlow agents do.
+func (e *Exporter) sample(frame []byte, pool uint64) {
+	s := sample{header: append([]byte(nil), frame[:min(len(frame), headerLen)]...), frameLen: len(frame), pool: pool}
+	select {
+	case e.samples <- s:
+	default:
+		e.dropped.Add(1)
+	}
+}
+
+// runSFlow sends the samples in sFlow v5 datagrams until ctx is done.
+func (e *Exporter) runSFlow(ctx context.Context) {
+	agent := net.IPv4zero.To4()
+	if a, ok := e.conn.LocalAddr().(*net.UDPAddr); ok {
+		agent = a.IP
+	}
+	var datagramSeq uint32
+	var pending [][]byte
+	size := 0
+	flush := func() {
+		if len(pending) == 0 {
+			return
+		}
+		datagramSeq++
+		d := sflowHeader(agent, datagramSeq, e.uptime(time.Now()), len(pending))
+		for _, s := range pending {
+			d = append(d, s...)
+		}
+		if _, err := e.conn.Write(d); err != nil {
+			slog.Warn("Failed to export samples", "collector", e.cfg.Collector, "err", err)
+		}
+		pending, size = pending[:0], 0
+	}
+	add := func(s sample) {
+		enc := e.flowSample(s)
+		if size+len(enc)+sflowHeaderLen > maxMessage {
+			flush()
+		}
+		pending, size = append(pending, enc), size+len(enc)
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			for {
+				select {
+				case s := <-e.samples:
+					add(s)
+				default:
+					flush()
+					return
+				}
+			}
+		case s := <-e.samples:
+			add(s)
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// sflowHeaderLen is the most a datagram header takes, with an IPv6 agent.
+const sflowHeaderLen = 40
+
+// sflowHeader starts a datagram of n samples from agent.
+func sflowHeader(agent net.IP, seq, uptime uint32, n int) []byte {
+	d := binary.BigEndian.AppendUint32(nil, 5) // version
+	if ip4 := agent.To4(); ip4 != nil {
+		d = binary.BigEndian.AppendUint32(d, 1)
+		d = append(d, ip4...)
+	} else {
+		d = binary.BigEndian.AppendUint32(d, 2)
+		d = append(d, agent.To16()...)
+	}
+	d = binary.BigEndian.AppendUint32(d, 0) // sub-agent
+	d = binary.BigEndian.AppendUint32(d, seq)
+	d = binary.BigEndian.AppendUint32(d, uptime)
+	return binary.BigEndian.AppendUint32(d, uint32(n))
+}
+
+// flowSample encodes s as a flow sample with a raw packet header record.
+func (e *Exporter) flowSample(s sample) []byte {
+	e.sampleSeq++
+	padded := (len(s.header) + 3) &^ 3
+	record := binary.BigEndian.AppendUint32(nil, 1) // raw packet header
+	record = binary.BigEndian.AppendUint32(record, uint32(16+padded))
+	record = binary.BigEndian.AppendUint32(record, 1) // Ethernet
+	record = binary.BigEndian.AppendUint32(record, uint32(s.frameLen+4))
+	record = binary.BigEndian.AppendUint32(record, 4) // the FCS, stripped
+	record = binary.BigEndian.AppendUint32(record, uint32(len(s.header)))
+	record = append(record, s.header...)
+	record = append(record, make([]byte, padded-len(s.header))...)
+
+	ifIndex := uint32(e.cfg.IfIndex)
+	body := binary.BigEndian.AppendUint32(nil, e.sampleSeq)
+	body = binary.BigEndian.AppendUint32(body, ifIndex) // source: the interface
+	body = binary.BigEndian.AppendUint32(body, uint32(e.cfg.SampleRate))
+	body = binary.BigEndian.AppendUint32(body, uint32(s.pool))
+	body = binary.BigEndian.AppendUint32(body, e.dropped.Load())
+	body = binary.BigEndian.AppendUint32(body, ifIndex) // input
+	body = binary.BigEndian.AppendUint32(body, 0)       // output unknown
+	body = binary.BigEndian.AppendUint32(body, 1)       // records
+	body = append(body, record...)
+
+	sample := binary.BigEndian.AppendUint32(nil, 1) // flow sample
+	sample = binary.BigEndian.AppendUint32(sample, uint32(len(body)))
+	return append(sample, body...)
+}
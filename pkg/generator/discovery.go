@@ -0,0 +1,236 @@
+package generator
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// LLDPMAC and CDPMAC are the multicast addresses LLDP and CDP announce to.
+var (
+	LLDPMAC = net.HardwareAddr{0x01, 0x80, 0xc2, 0x00, 0x00, 0x0e}
+	CDPMAC  = net.HardwareAddr{0x01, 0x00, 0x0c, 0xcc, 0xcc, 0xcc}
+)
+
+// Discovery describes the LLDP, or with CDP Cisco Discovery Protocol,
+// announcements to send instead of UDP. Empty fields are left out, but
+// for the identifiers, which default to the source MAC and interface.
+type Discovery struct {
+	CDP bool
+
+	ChassisID    string // the CDP device ID
+	PortID       string
+	TTL          uint16 // seconds the neighbor keeps the entry
+	SystemName   string
+	SystemDesc   string   // the CDP software version
+	PortDesc     string   // the CDP platform
+	Capabilities []string // see DiscoveryCapabilities
+	MgmtIP       net.IP
+
+	// TLVs are added after the others as they are.
+	TLVs []TLV
+}
+
+// TLV is a raw LLDP or CDP TLV.
+type TLV struct {
+	Type  uint16
+	Value []byte
+}
+
+// DiscoveryCapabilities are the names Discovery.Capabilities takes, with
+// their LLDP and CDP bits.
+var DiscoveryCapabilities = map[string]struct{ LLDP, CDP uint16 }{
+	"other":     {0x01, 0},
+	"repeater":  {0x02, 0x40},
+	"bridge":    {0x04, 0x02},
+	"switch":    {0x04, 0x08},
+	"ap":        {0x08, 0},
+	"router":    {0x10, 0x01},
+	"telephone": {0x20, 0x80},
+	"docsis":    {0x40, 0},
+	"station":   {0x80, 0x10},
+}
+
+// Frame builds the announcement of port from src to dst, LLDPMAC or
+// CDPMAC when dst is nil.
+func (d Discovery) Frame(src, dst net.HardwareAddr, port string) ([]byte, error) {
+	var lldpCaps, cdpCaps uint16
+	for _, name := range d.Capabilities {
+		bits, ok := DiscoveryCapabilities[strings.ToLower(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown capability %q", name)
+		}
+		lldpCaps |= bits.LLDP
+		cdpCaps |= bits.CDP
+	}
+	if d.CDP {
+		return d.cdpFrame(src, dst, port, cdpCaps)
+	}
+	return d.lldpFrame(src, dst, port, lldpCaps)
+}
+
+func (d Discovery) lldpFrame(src, dst net.HardwareAddr, port string, caps uint16) ([]byte, error) {
+	if dst == nil {
+		dst = LLDPMAC
+	}
+	lldp := layers.LinkLayerDiscovery{
+		ChassisID: layers.LLDPChassisID{Subtype: layers.LLDPChassisIDSubTypeMACAddr, ID: src},
+		PortID:    layers.LLDPPortID{Subtype: layers.LLDPPortIDSubtypeIfaceName, ID: []byte(port)},
+		TTL:       d.TTL,
+	}
+	if d.ChassisID != "" {
+		lldp.ChassisID = layers.LLDPChassisID{Subtype: layers.LLDPChassisIDSubTypeLocal, ID: []byte(d.ChassisID)}
+	}
+	if d.PortID != "" {
+		lldp.PortID = layers.LLDPPortID{Subtype: layers.LLDPPortIDSubtypeLocal, ID: []byte(d.PortID)}
+	}
+	add := func(t layers.LLDPTLVType, v []byte) error {
+		if len(v) > 511 {
+			return fmt.Errorf("LLDP TLV %d of %d bytes, the most is 511", t, len(v))
+		}
+		lldp.Values = append(lldp.Values, layers.LinkLayerDiscoveryValue{Type: t, Length: uint16(len(v)), Value: v})
+		return nil
+	}
+	for _, s := range []struct {
+		t layers.LLDPTLVType
+		v string
+	}{{layers.LLDPTLVPortDescription, d.PortDesc}, {layers.LLDPTLVSysName, d.SystemName}, {layers.LLDPTLVSysDescription, d.SystemDesc}} {
+		if s.v != "" {
+			if err := add(s.t, []byte(s.v)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if caps != 0 {
+		// Supported and enabled.
+		add(layers.LLDPTLVSysCapabilities, binary.BigEndian.AppendUint16(binary.BigEndian.AppendUint16(nil, caps), caps))
+	}
+	if d.MgmtIP != nil {
+		addr, subtype := d.MgmtIP.To4(), byte(1)
+		if addr == nil {
+			addr, subtype = d.MgmtIP.To16(), 2
+		}
+		// Address length and subtype, address, interface numbering
+		// unknown, no OID.
+		v := append([]byte{byte(1 + len(addr)), subtype}, addr...)
+		add(layers.LLDPTLVMgmtAddress, append(v, 1, 0, 0, 0, 0, 0))
+	}
+	for _, t := range d.TLVs {
+		if t.Type > 127 {
+			return nil, fmt.Errorf("invalid LLDP TLV type %d, want 0 to 127", t.Type)
+		}
+		if err := add(layers.LLDPTLVType(t.Type), t.Value); err != nil {
+			return nil, err
+		}
+	}
+
+	eth := layers.Ethernet{SrcMAC: src, DstMAC: dst, EthernetType: layers.EthernetTypeLinkLayerDiscovery}
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{}, &eth, &lldp); err != nil {
+		return nil, fmt.Errorf("failed to serialize LLDP: %v", err)
+	}
+	return pad(buf.Bytes()), nil
+}
+
+// CDP TLV types.
+const (
+	cdpDeviceID     = 0x0001
+	cdpAddresses    = 0x0002
+	cdpPortID       = 0x0003
+	cdpCapabilities = 0x0004
+	cdpVersion      = 0x0005
+	cdpPlatform     = 0x0006
+)
+
+// cdpFrame builds a CDP version 2 frame: 802.3 with LLC and SNAP, which
+// gopacket can decode but not serialize.
+func (d Discovery) cdpFrame(src, dst net.HardwareAddr, port string, caps uint16) ([]byte, error) {
+	if dst == nil {
+		dst = CDPMAC
+	}
+	deviceID, portID := d.ChassisID, d.PortID
+	if deviceID == "" {
+		deviceID = src.String()
+	}
+	if portID == "" {
+		portID = port
+	}
+	pdu := []byte{2, byte(min(d.TTL, 255)), 0, 0} // version, TTL, checksum
+	add := func(t uint16, v []byte) error {
+		if len(v) > 0xffff-4 {
+			return fmt.Errorf("CDP TLV %d of %d bytes is too long", t, len(v))
+		}
+		pdu = binary.BigEndian.AppendUint16(pdu, t)
+		pdu = binary.BigEndian.AppendUint16(pdu, uint16(4+len(v)))
+		pdu = append(pdu, v...)
+		return nil
+	}
+	add(cdpDeviceID, []byte(deviceID))
+	if ip := d.MgmtIP.To4(); ip != nil {
+		// One address: NLPID protocol 0xcc, IP.
+		add(cdpAddresses, append([]byte{0, 0, 0, 1, 1, 1, 0xcc, 0, 4}, ip...))
+	} else if d.MgmtIP != nil {
+		return nil, fmt.Errorf("CDP management address %s must be IPv4", d.MgmtIP)
+	}
+	add(cdpPortID, []byte(portID))
+	if caps != 0 {
+		add(cdpCapabilities, binary.BigEndian.AppendUint32(nil, uint32(caps)))
+	}
+	if d.SystemDesc != "" {
+		add(cdpVersion, []byte(d.SystemDesc))
+	}
+	if d.PortDesc != "" {
+		add(cdpPlatform, []byte(d.PortDesc))
+	}
+	for _, t := range d.TLVs {
+		if err := add(t.Type, t.Value); err != nil {
+			return nil, err
+		}
+	}
+	binary.BigEndian.PutUint16(pdu[2:], cdpChecksum(pdu))
+
+	// 802.3 header with the length, then LLC and SNAP with Cisco's OUI.
+	frame := append(append([]byte{}, dst...), src...)
+	frame = binary.BigEndian.AppendUint16(frame, uint16(8+len(pdu)))
+	frame = append(frame, 0xaa, 0xaa, 0x03, 0x00, 0x00, 0x0c, 0x20, 0x00)
+	if len(frame)+len(pdu) > 1514 {
+		return nil, fmt.Errorf("CDP frame of %d bytes is too long", len(frame)+len(pdu))
+	}
+	return pad(append(frame, pdu...)), nil
+}
+
+// cdpChecksum is the IP checksum of pdu, with an odd last byte sign
+// extended the way Cisco's implementation does.
+func cdpChecksum(pdu []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(pdu); i += 2 {
+		sum += uint32(pdu[i])<<8 | uint32(pdu[i+1])
+	}
+	if len(pdu)%2 == 1 {
+		sum += uint32(uint16(int16(int8(pdu[len(pdu)-1]))))
+	}
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// pad pads frame to the minimum frame size.
+func pad(frame []byte) []byte {
+	if len(frame) < 60 {
+		frame = append(frame, make([]byte, 60-len(frame))...)
+	}
+	return frame
+}
+
+// String describes d for logs.
+func (d Discovery) String() string {
+	if d.CDP {
+		return "CDP"
+	}
+	return "LLDP"
+}
@@ -0,0 +1,276 @@
+// Package generator sends a steady stream of UDP packets on an interface,
+// the engine behind gonet udp send.
+package generator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+
+	"gonet/pkg/afxdp"
+	"gonet/pkg/ifaceutil"
+	"gonet/pkg/seqhdr"
+	"gonet/pkg/stats"
+	"gonet/pkg/trailer"
+)
+
+// Config describes the stream to send.
+type Config struct {
+	Interface string           // pcap device name, see ifaceutil.Resolve
+	SrcMAC    net.HardwareAddr // default the interface's address
+	DstMAC    net.HardwareAddr // default broadcast
+	SrcIP     net.IP
+	DstIP     net.IP
+	SrcPort   int
+	DstPort   int
+	PPS       int           // packets per second
+	Size      int           // payload size in bytes
+	Duration  time.Duration // 0 sends until the context is done
+
+	// Targets, when set, replace DstMAC, DstIP and DstPort: packets go to
+	// each of them in turn, sharing the rate.
+	Targets []Target
+
+	// Sequence starts every payload with a seqhdr.Header of Stream, so the
+	// receiver can count loss and measure latency. Each destination
+	// address and port is numbered on its own, as the receiver tracks
+	// each flow.
+	Sequence bool
+	Stream   uint32
+
+	// TimeProto, when set, makes the payloads NTP or PTP messages of
+	// their own size instead of Size random bytes.
+	TimeProto *TimeProto
+
+	// Trailer, if positive, appends a trailer.Trailer of that many hop
+	// slots to the payloads, for the devices on the path to stamp. The
+	// UDP checksum is left out so they don't have to fix it.
+	Trailer int
+
+	// Backend is how the packets go out: "pcap", the default, or "xdp"
+	// for an AF_XDP socket on Queue, see runXDP. Without AF_XDP the
+	// generator falls back to pcap.
+	Backend string
+	Queue   int
+
+	// Pause, when set, sends flow control frames instead of UDP, to
+	// DstMAC or PauseMAC, and Discovery LLDP or CDP announcements; the
+	// IP and target fields don't apply.
+	Pause     *Pause
+	Discovery *Discovery
+}
+
+// Target is one destination of the stream.
+type Target struct {
+	MAC  net.HardwareAddr // default broadcast
+	IP   net.IP
+	Port int
+}
+
+// Generator sends packets and counts what went out. The zero value is
+// ready to use.
+type Generator struct {
+	counters stats.Counters
+}
+
+// Counters returns the live counters, for a stats.Reporter.
+func (g *Generator) Counters() *stats.Counters {
+	return &g.counters
+}
+
+// Stats returns the packets and bytes sent so far.
+func (g *Generator) Stats() (packets, bytes uint64) {
+	return g.counters.Load()
+}
+
+// Run sends packets described by cfg until ctx is done or cfg.Duration has
+// passed. Failed sends are logged and skipped.
+func (g *Generator) Run(ctx context.Context, cfg Config) error {
+	if cfg.PPS <= 0 {
+		return errors.New("packet rate must be positive")
+	}
+	control := cfg.Pause != nil || cfg.Discovery != nil
+	if control && cfg.Sequence {
+		return errors.New("sequence mode only applies to UDP")
+	}
+	targets := slices.Clone(cfg.Targets)
+	if len(targets) == 0 {
+		targets = []Target{{MAC: cfg.DstMAC, IP: cfg.DstIP, Port: cfg.DstPort}}
+	}
+	if control {
+		targets = nil
+	} else if cfg.SrcIP == nil {
+		return errors.New("source IP is required")
+	}
+	if cfg.Sequence && cfg.Size < seqhdr.Len {
+		return fmt.Errorf("sequence mode needs payloads of at least %d bytes", seqhdr.Len)
+	}
+	if cfg.TimeProto != nil {
+		if control || cfg.Sequence {
+			return errors.New("time protocol messages can't be sequenced or sent as control frames")
+		}
+		size, err := cfg.TimeProto.Size()
+		if err != nil {
+			return err
+		}
+		cfg.Size = size
+	}
+	if cfg.Trailer < 0 || cfg.Trailer > trailer.MaxHops {
+		return fmt.Errorf("invalid trailer of %d hops, want 0 to %d", cfg.Trailer, trailer.MaxHops)
+	}
+	if cfg.Trailer > 0 && control {
+		return errors.New("the telemetry trailer only applies to UDP")
+	}
+	for i := range targets {
+		if targets[i].IP == nil {
+			return errors.New("destination IP is required")
+		}
+		if targets[i].MAC == nil {
+			targets[i].MAC = layers.EthernetBroadcast
+		}
+	}
+
+	srcMAC := cfg.SrcMAC
+	if srcMAC == nil {
+		iface, err := ifaceutil.Lookup(cfg.Interface)
+		if err != nil {
+			return fmt.Errorf("failed to get interface %s: %v", cfg.Interface, err)
+		}
+		srcMAC = iface.HardwareAddr
+	}
+	var frame []byte
+	if control {
+		var err error
+		if frame, err = cfg.controlFrame(srcMAC); err != nil {
+			return err
+		}
+	}
+
+	switch cfg.Backend {
+	case "", "pcap":
+	case "xdp":
+		sock, err := afxdp.Open(afxdp.Config{Interface: cfg.Interface, Queue: cfg.Queue})
+		if err == nil {
+			defer sock.Close()
+			slog.Info("Sending with AF_XDP", "interface", cfg.Interface, "queue", cfg.Queue, "zerocopy", sock.ZeroCopy())
+			if frame != nil {
+				return g.sendXDP(ctx, cfg, sock, [][]byte{frame}, []int{0}, nil)
+			}
+			return g.runXDP(ctx, cfg, sock, srcMAC, targets)
+		}
+		slog.Warn("AF_XDP unavailable, falling back to pcap", "interface", cfg.Interface, "err", err)
+	default:
+		return fmt.Errorf("unknown backend %q, want pcap or xdp", cfg.Backend)
+	}
+
+	handle, err := pcap.OpenLive(cfg.Interface, 1600, true, pcap.BlockForever)
+	if err != nil {
+		return fmt.Errorf("failed to open device %s: %v", cfg.Interface, err)
+	}
+	defer handle.Close()
+	if frame != nil {
+		return g.sendFrame(ctx, cfg, handle, frame)
+	}
+
+	// Create random payload
+	payload := make([]byte, cfg.payloadLen())
+	rand.Read(payload)
+
+	eth := layers.Ethernet{
+		SrcMAC:       srcMAC,
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    cfg.SrcIP,
+	}
+	udp := layers.UDP{
+		SrcPort: layers.UDPPort(cfg.SrcPort),
+	}
+	if err := udp.SetNetworkLayerForChecksum(&ip); err != nil {
+		return fmt.Errorf("failed to set network layer for checksum: %v", err)
+	}
+
+	opts := gopacket.SerializeOptions{
+		FixLengths:       true,
+		ComputeChecksums: true,
+	}
+	buf := gopacket.NewSerializeBuffer()
+
+	// Sleep between packets to keep the rate
+	sleepDuration := time.Duration(1000000/cfg.PPS) * time.Microsecond
+
+	var endTime time.Time
+	if cfg.Duration > 0 {
+		endTime = time.Now().Add(cfg.Duration)
+	}
+
+	stamp := cfg.stamper(srcMAC)
+	slots, flows := flowSlots(targets)
+	seqs := make([]uint64, flows)
+	for n := 0; ctx.Err() == nil; n++ {
+		if !endTime.IsZero() && time.Now().After(endTime) {
+			return nil
+		}
+
+		target, slot := targets[n%len(targets)], slots[n%len(targets)]
+		eth.DstMAC, ip.DstIP, udp.DstPort = target.MAC, target.IP, layers.UDPPort(target.Port)
+		if stamp != nil {
+			stamp(payload, seqs[slot], time.Now())
+		}
+
+		if err := gopacket.SerializeLayers(buf, opts, &eth, &ip, &udp, gopacket.Payload(payload)); err != nil {
+			slog.Warn("Failed to serialize packet", "err", err)
+			continue
+		}
+		packetData := buf.Bytes()
+		if cfg.Trailer > 0 {
+			packetData[udpPayload-2], packetData[udpPayload-1] = 0, 0
+		}
+		if err := handle.WritePacketData(packetData); err != nil {
+			slog.Warn("Failed to send packet", "err", err)
+			continue
+		}
+		g.counters.Add(1, uint64(len(packetData)))
+		seqs[slot]++
+
+		time.Sleep(sleepDuration)
+	}
+	return nil
+}
+
+// payloadLen returns the size of the UDP payloads, the trailer included.
+func (cfg Config) payloadLen() int {
+	if cfg.Trailer > 0 {
+		return cfg.Size + trailer.Len(cfg.Trailer)
+	}
+	return cfg.Size
+}
+
+// flowSlots returns the sequence counter of each target and how many
+// there are, targets with the same address and port sharing one.
+func flowSlots(targets []Target) (slots []int, n int) {
+	seen := map[string]int{}
+	for _, t := range targets {
+		key := net.JoinHostPort(t.IP.String(), strconv.Itoa(t.Port))
+		slot, ok := seen[key]
+		if !ok {
+			slot = len(seen)
+			seen[key] = slot
+		}
+		slots = append(slots, slot)
+	}
+	return slots, len(seen)
+}
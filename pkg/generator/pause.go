@@ -0,0 +1,100 @@
+package generator
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/google/gopacket/pcap"
+)
+
+// PauseMAC is the reserved multicast address of MAC control frames,
+// which bridges don't forward.
+var PauseMAC = net.HardwareAddr{0x01, 0x80, 0xc2, 0x00, 0x00, 0x01}
+
+// Pause describes the flow control frames to send instead of UDP: 802.3x
+// pause frames stopping the whole link, or with PFC 802.1Qbb priority
+// flow control frames stopping the traffic classes in Priorities.
+type Pause struct {
+	PFC        bool
+	Priorities []int // 0 to 7, with PFC
+
+	// Quanta is how long the peer should stop, in units of 512 bit times
+	// at the link speed; 0 resumes it (XON).
+	Quanta uint16
+}
+
+// Frame builds the frame from src to dst, PauseMAC when dst is nil,
+// padded to the minimum frame size.
+func (p Pause) Frame(src, dst net.HardwareAddr) ([]byte, error) {
+	if dst == nil {
+		dst = PauseMAC
+	}
+	frame := make([]byte, 60)
+	copy(frame[0:], dst)
+	copy(frame[6:], src)
+	binary.BigEndian.PutUint16(frame[12:], 0x8808) // MAC control
+	if !p.PFC {
+		binary.BigEndian.PutUint16(frame[14:], 0x0001)
+		binary.BigEndian.PutUint16(frame[16:], p.Quanta)
+		return frame, nil
+	}
+	if len(p.Priorities) == 0 {
+		return nil, errors.New("PFC needs priorities to pause")
+	}
+	binary.BigEndian.PutUint16(frame[14:], 0x0101)
+	var enable uint16
+	for _, prio := range p.Priorities {
+		if prio < 0 || prio > 7 {
+			return nil, fmt.Errorf("invalid PFC priority %d, want 0 to 7", prio)
+		}
+		enable |= 1 << prio
+		binary.BigEndian.PutUint16(frame[18+2*prio:], p.Quanta)
+	}
+	binary.BigEndian.PutUint16(frame[16:], enable)
+	return frame, nil
+}
+
+// String describes p for logs.
+func (p Pause) String() string {
+	if p.PFC {
+		return fmt.Sprintf("PFC priorities %v for %d quanta", p.Priorities, p.Quanta)
+	}
+	return fmt.Sprintf("pause for %d quanta", p.Quanta)
+}
+
+// controlFrame builds the frame of the Pause or Discovery mode.
+func (cfg Config) controlFrame(srcMAC net.HardwareAddr) ([]byte, error) {
+	if cfg.Discovery != nil {
+		slog.Info("Sending discovery announcements", "protocol", cfg.Discovery)
+		return cfg.Discovery.Frame(srcMAC, cfg.DstMAC, cfg.Interface)
+	}
+	slog.Info("Sending flow control frames", "frames", cfg.Pause)
+	return cfg.Pause.Frame(srcMAC, cfg.DstMAC)
+}
+
+// sendFrame sends frame through handle at cfg.PPS until ctx is done or
+// cfg.Duration has passed, paced like the UDP stream.
+func (g *Generator) sendFrame(ctx context.Context, cfg Config, handle *pcap.Handle, frame []byte) error {
+	sleepDuration := time.Duration(1000000/cfg.PPS) * time.Microsecond
+	var endTime time.Time
+	if cfg.Duration > 0 {
+		endTime = time.Now().Add(cfg.Duration)
+	}
+	for ctx.Err() == nil {
+		if !endTime.IsZero() && time.Now().After(endTime) {
+			return nil
+		}
+		if err := handle.WritePacketData(frame); err != nil {
+			slog.Warn("Failed to send packet", "err", err)
+			continue
+		}
+		g.counters.Add(1, uint64(len(frame)))
+		time.Sleep(sleepDuration)
+	}
+	return nil
+}
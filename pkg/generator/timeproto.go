@@ -0,0 +1,135 @@
+package generator
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"gonet/pkg/seqhdr"
+	"gonet/pkg/trailer"
+)
+
+// Time protocol messages TimeProto.Protocol takes.
+const (
+	NTPRequest  = "ntp"
+	PTPSync     = "ptp-sync"
+	PTPDelayReq = "ptp-delay-req"
+)
+
+const ntpLen, ptpLen = 48, 44
+
+// Well known ports of the protocols.
+const (
+	NTPPort      = 123
+	PTPEventPort = 319
+)
+
+// PTPMulticast is the primary PTP multicast group, and PTPMulticastMAC
+// its Ethernet address.
+var (
+	PTPMulticast    = net.IPv4(224, 0, 1, 129)
+	PTPMulticastMAC = net.HardwareAddr{0x01, 0x00, 0x5e, 0x00, 0x01, 0x81}
+)
+
+// TimeProto makes the UDP payloads well-formed time protocol messages
+// rather than random bytes: NTPv4 client requests, or PTPv2 Sync or
+// Delay_Req event messages. Each carries the time it was built as its
+// transmit or origin timestamp, and PTP ones count up in sequenceId.
+type TimeProto struct {
+	Protocol string
+	Domain   uint8 // PTP domain
+}
+
+// Size returns the length of the messages.
+func (t TimeProto) Size() (int, error) {
+	switch t.Protocol {
+	case NTPRequest:
+		return ntpLen, nil
+	case PTPSync, PTPDelayReq:
+		return ptpLen, nil
+	}
+	return 0, fmt.Errorf("unknown time protocol %q, want %s, %s or %s", t.Protocol, NTPRequest, PTPSync, PTPDelayReq)
+}
+
+// ntpEpoch is 1900-01-01 in Unix seconds, where NTP timestamps start.
+const ntpEpoch = -2208988800
+
+// putNTP writes a client request (mode 3) sent at now to b.
+func putNTP(b []byte, now time.Time) {
+	clear(b[:ntpLen])
+	b[0] = 0<<6 | 4<<3 | 3 // no leap warning, version 4, client
+	b[2] = 6               // poll: 64 s
+	b[3] = 0xec            // precision: 2^-20 s
+	secs := uint64(now.Unix() - ntpEpoch)
+	frac := uint64(now.Nanosecond()) << 32 / 1e9
+	binary.BigEndian.PutUint64(b[40:], secs<<32|frac) // transmit timestamp
+}
+
+// putPTP writes a Sync, or Delay_Req, message number seq from clock sent
+// at now to b. Sync is one-step, its origin timestamp is the one that
+// counts.
+func (t TimeProto) putPTP(b []byte, clock [8]byte, seq uint64, now time.Time) {
+	clear(b[:ptpLen])
+	msgType, control, interval := byte(0x0), byte(0x00), byte(0) // 1 s
+	if t.Protocol == PTPDelayReq {
+		msgType, control, interval = 0x1, 0x01, 0x7f
+	}
+	b[0] = msgType
+	b[1] = 2 // version
+	binary.BigEndian.PutUint16(b[2:], ptpLen)
+	b[4] = t.Domain
+	copy(b[20:], clock[:])
+	binary.BigEndian.PutUint16(b[28:], 1) // port number
+	binary.BigEndian.PutUint16(b[30:], uint16(seq))
+	b[32] = control
+	b[33] = interval
+	secs := uint64(now.Unix())
+	binary.BigEndian.PutUint16(b[34:], uint16(secs>>32))
+	binary.BigEndian.PutUint32(b[36:], uint32(secs))
+	binary.BigEndian.PutUint32(b[40:], uint32(now.Nanosecond()))
+}
+
+// stamper returns what writes the parts of the payload that change per
+// packet, the sequence header or the time protocol message and the
+// trailer, nil when nothing does. srcMAC makes the PTP clock identity.
+func (cfg Config) stamper(srcMAC net.HardwareAddr) func(payload []byte, seq uint64, now time.Time) {
+	stamp := cfg.headStamper(srcMAC)
+	if cfg.Trailer <= 0 {
+		return stamp
+	}
+	return func(payload []byte, seq uint64, now time.Time) {
+		if stamp != nil {
+			stamp(payload, seq, now)
+		}
+		trailer.Put(payload, cfg.Trailer, now)
+	}
+}
+
+// headStamper returns what writes the sequence header or time protocol
+// message at the start of the payload, nil for neither.
+func (cfg Config) headStamper(srcMAC net.HardwareAddr) func(payload []byte, seq uint64, now time.Time) {
+	switch {
+	case cfg.Sequence:
+		return func(payload []byte, seq uint64, now time.Time) {
+			seqhdr.Header{Stream: cfg.Stream, Seq: seq, Sent: now}.Put(payload)
+		}
+	case cfg.TimeProto == nil:
+		return nil
+	case cfg.TimeProto.Protocol == NTPRequest:
+		return func(payload []byte, seq uint64, now time.Time) {
+			putNTP(payload, now)
+		}
+	}
+	// EUI-64 from the MAC, as PTP over Ethernet ports do.
+	var clock [8]byte
+	if len(srcMAC) == 6 {
+		copy(clock[:3], srcMAC[:3])
+		clock[3], clock[4] = 0xff, 0xfe
+		copy(clock[5:], srcMAC[3:])
+	}
+	t := *cfg.TimeProto
+	return func(payload []byte, seq uint64, now time.Time) {
+		t.putPTP(payload, clock, seq, now)
+	}
+}
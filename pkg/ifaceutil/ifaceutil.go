@@ -0,0 +1,137 @@
+// Package ifaceutil finds the network interfaces the tools capture and
+// send on. An -interface may be given as the pcap device name, the name
+// the OS shows (eth0, or "Ethernet 2" for a Windows Npcap device named
+// \Device\NPF_{GUID}), one of its IP addresses or a subnet it is on.
+package ifaceutil
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+
+	"github.com/google/gopacket/pcap"
+)
+
+// ListDevices prints the interfaces pcap can use with their addresses.
+func ListDevices(w io.Writer) error {
+	devices, err := pcap.FindAllDevs()
+	if err != nil {
+		return fmt.Errorf("failed to find devices: %v", err)
+	}
+	if len(devices) == 0 {
+		return fmt.Errorf("no devices found")
+	}
+
+	fmt.Fprintln(w, "Available devices:")
+	for _, device := range devices {
+		fmt.Fprintf(w, "Name: %s\n", device.Name)
+		if iface := osInterface(device); iface != nil && iface.Name != device.Name {
+			fmt.Fprintf(w, "Interface: %s\n", iface.Name)
+		}
+		fmt.Fprintf(w, "Description: %s\n", device.Description)
+		fmt.Fprintln(w, "Addresses:")
+		for _, address := range device.Addresses {
+			fmt.Fprintf(w, "  IP: %s, Netmask: %s\n", address.IP, address.Netmask)
+		}
+		fmt.Fprintln(w, "-----------------------------------")
+	}
+	return nil
+}
+
+// Resolve returns the pcap device name for spec, which is matched against
+// device names, OS interface names, addresses and subnets in that order.
+// A spec that matches nothing is returned as is, for devices pcap doesn't
+// list.
+func Resolve(spec string) (string, error) {
+	devices, err := pcap.FindAllDevs()
+	if err != nil {
+		return spec, nil
+	}
+	for _, device := range devices {
+		if device.Name == spec {
+			return spec, nil
+		}
+	}
+	for _, device := range devices {
+		if iface := osInterface(device); iface != nil && iface.Name == spec {
+			return device.Name, nil
+		}
+	}
+
+	if addr, err := netip.ParseAddr(spec); err == nil {
+		for _, device := range devices {
+			for _, address := range device.Addresses {
+				if ip, ok := netip.AddrFromSlice(address.IP); ok && ip.Unmap() == addr.Unmap() {
+					return device.Name, nil
+				}
+			}
+		}
+		return "", fmt.Errorf("no interface has the address %s", spec)
+	}
+	if prefix, err := netip.ParsePrefix(spec); err == nil {
+		for _, device := range devices {
+			for _, address := range device.Addresses {
+				if ip, ok := netip.AddrFromSlice(address.IP); ok && prefix.Contains(ip.Unmap()) {
+					return device.Name, nil
+				}
+			}
+		}
+		return "", fmt.Errorf("no interface is on %s", spec)
+	}
+	return spec, nil
+}
+
+// Lookup returns the OS interface of the pcap device name. Windows NPF
+// device names don't match the names Go knows interfaces by, so the
+// device's addresses are used to find it as well.
+func Lookup(name string) (*net.Interface, error) {
+	if iface, err := net.InterfaceByName(name); err == nil {
+		return iface, nil
+	}
+	devices, err := pcap.FindAllDevs()
+	if err != nil {
+		return nil, err
+	}
+	for _, device := range devices {
+		if device.Name != name {
+			continue
+		}
+		if iface := osInterface(device); iface != nil {
+			return iface, nil
+		}
+	}
+	return nil, fmt.Errorf("no interface found for %s", name)
+}
+
+// osInterface finds the OS interface with the name or an address of a
+// pcap device.
+func osInterface(device pcap.Interface) *net.Interface {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	for i, iface := range ifaces {
+		if iface.Name == device.Name {
+			return &ifaces[i]
+		}
+	}
+	for i, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			for _, address := range device.Addresses {
+				if address.IP.Equal(ipNet.IP) {
+					return &ifaces[i]
+				}
+			}
+		}
+	}
+	return nil
+}
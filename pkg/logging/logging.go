@@ -0,0 +1,75 @@
+// Package logging sets up the log output the gonet tools share: slog
+// records on stderr, at least as severe as -log-level, as logfmt text or
+// JSON lines by -log-format. Results and interval reports aren't logs and
+// keep going to stdout.
+package logging
+
+import (
+	"encoding"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// Options are the logging flags the tools share.
+type Options struct {
+	Level  string
+	Format string
+}
+
+// RegisterFlags adds -log-level and -log-format to fs.
+func RegisterFlags(fs *flag.FlagSet) *Options {
+	o := &Options{}
+	fs.StringVar(&o.Level, "log-level", "info", "Least severe log messages to show: debug, info, warn or error")
+	fs.StringVar(&o.Format, "log-format", "text", "Format of the log messages on stderr: text or json")
+	return o
+}
+
+// Handler returns the handler the options ask for, writing to w.
+func (o *Options) Handler(w io.Writer) (slog.Handler, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(o.Level)); err != nil {
+		return nil, fmt.Errorf("invalid -log-level %q, want debug, info, warn or error", o.Level)
+	}
+	opts := &slog.HandlerOptions{Level: level, ReplaceAttr: replace}
+	switch o.Format {
+	case "text", "":
+		return slog.NewTextHandler(w, opts), nil
+	case "json":
+		return slog.NewJSONHandler(w, opts), nil
+	default:
+		return nil, fmt.Errorf("invalid -log-format %q, want text or json", o.Format)
+	}
+}
+
+// Setup makes the handler the options ask for the default on stderr.
+// What still goes through the log package, the fatal errors of the
+// commands, is logged at error level.
+func (o *Options) Setup() error {
+	h, err := o.Handler(os.Stderr)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(slog.New(h))
+	slog.SetLogLoggerLevel(slog.LevelError)
+	return nil
+}
+
+// replace writes values the way people read them in both formats:
+// addresses, URLs and other Stringers as their strings rather than JSON
+// structs, and bytes as text rather than base64.
+func replace(_ []string, a slog.Attr) slog.Attr {
+	if a.Value.Kind() != slog.KindAny {
+		return a
+	}
+	switch v := a.Value.Any().(type) {
+	case error, encoding.TextMarshaler:
+	case fmt.Stringer:
+		a.Value = slog.StringValue(v.String())
+	case []byte:
+		a.Value = slog.StringValue(string(v))
+	}
+	return a
+}
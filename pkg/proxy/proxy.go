@@ -0,0 +1,67 @@
+// Package proxy embeds the gonet HTTP/HTTPS forward proxy (le_prox) in
+// other programs, such as test harnesses that need a proxy on an
+// ephemeral port.
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	leprox "gonet/le_prox"
+)
+
+// Config configures the proxy.
+type Config struct {
+	// Flags are gonet proxy command line flags, e.g. -config rules.json or
+	// -mitm -mitm-ca ca.pem -mitm-key ca.key.
+	Flags []string
+
+	// DrainTimeout is how long Close waits for active requests and
+	// tunnels, default 30s.
+	DrainTimeout time.Duration
+}
+
+// Proxy is a configured proxy. The engine's state is shared by the
+// process, so create one Proxy per process.
+type Proxy struct {
+	server       *http.Server
+	drainTimeout time.Duration
+}
+
+// New configures the proxy engine from cfg.
+func New(cfg Config) (*Proxy, error) {
+	if err := leprox.Configure(cfg.Flags); err != nil {
+		return nil, err
+	}
+	p := &Proxy{
+		server:       &http.Server{Handler: leprox.Handler()},
+		drainTimeout: cfg.DrainTimeout,
+	}
+	if p.drainTimeout <= 0 {
+		p.drainTimeout = 30 * time.Second
+	}
+	return p, nil
+}
+
+// Handler returns the proxy's request handler, for serving it from an
+// existing server.
+func (p *Proxy) Handler() http.Handler {
+	return p.server.Handler
+}
+
+// Serve accepts proxy clients on l until Close. It returns nil after
+// Close.
+func (p *Proxy) Serve(l net.Listener) error {
+	err := p.server.Serve(leprox.Protect(p.server, l))
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// Close stops accepting clients and drains the active ones.
+func (p *Proxy) Close() error {
+	leprox.Shutdown([]*http.Server{p.server}, p.drainTimeout)
+	return nil
+}
@@ -0,0 +1,90 @@
+package results
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Assertion is how a condition on a metric went. Value is nil when the
+// run didn't measure the metric, which fails the assertion, or when the
+// tool checked it itself and says what it got in Detail.
+type Assertion struct {
+	Metric    string   `json:"metric"`
+	Condition string   `json:"condition"`
+	Value     *float64 `json:"value"`
+	Detail    string   `json:"detail,omitempty"`
+	Pass      bool     `json:"pass"`
+}
+
+// String writes a for people, like "mbps > 900 (got 512.3)".
+func (a Assertion) String() string {
+	return fmt.Sprintf("%s %s (got %s)", a.Metric, a.Condition, a.got())
+}
+
+// got writes the value a was checked against.
+func (a Assertion) got() string {
+	switch {
+	case a.Value != nil:
+		return strconv.FormatFloat(*a.Value, 'f', -1, 64)
+	case a.Detail != "":
+		return a.Detail
+	}
+	return "not measured"
+}
+
+// check is a parsed -assert.
+type check struct {
+	metric, cond string
+	op           string
+	limit        float64
+}
+
+// parseCheck parses "metric op value", op being one of < <= > >= == !=
+// and value a number, a trailing % allowed.
+func parseCheck(s string) (check, error) {
+	for _, op := range []string{"<=", ">=", "==", "!=", "<", ">"} {
+		i := strings.Index(s, op)
+		if i < 0 {
+			continue
+		}
+		c := check{metric: strings.TrimSpace(s[:i]), op: op}
+		value := strings.TrimSpace(s[i+len(op):])
+		c.cond = op + " " + value
+		if c.metric == "" {
+			return check{}, fmt.Errorf("invalid assertion %q, want metric op value", s)
+		}
+		limit, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(value, "%")), 64)
+		if err != nil {
+			return check{}, fmt.Errorf("invalid assertion %q: %v", s, err)
+		}
+		c.limit = limit
+		return c, nil
+	}
+	return check{}, fmt.Errorf("invalid assertion %q, needs one of < <= > >= == !=", s)
+}
+
+// eval checks the condition against the summary metrics.
+func (c check) eval(summary map[string]float64) Assertion {
+	a := Assertion{Metric: c.metric, Condition: c.cond}
+	v, ok := summary[c.metric]
+	if !ok {
+		return a
+	}
+	a.Value = &v
+	switch c.op {
+	case "<":
+		a.Pass = v < c.limit
+	case "<=":
+		a.Pass = v <= c.limit
+	case ">":
+		a.Pass = v > c.limit
+	case ">=":
+		a.Pass = v >= c.limit
+	case "==":
+		a.Pass = v == c.limit
+	case "!=":
+		a.Pass = v != c.limit
+	}
+	return a
+}
@@ -0,0 +1,210 @@
+package results
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Markdown writes runs as a Markdown report: a table comparing the
+// summaries when there are several, then each run's parameters, summary,
+// assertions and series.
+func Markdown(w io.Writer, runs ...*Run) error {
+	if len(runs) == 0 {
+		return errNoRuns
+	}
+	var b strings.Builder
+	if len(runs) > 1 {
+		b.WriteString("# gonet runs\n\n| metric |")
+		for _, run := range runs {
+			fmt.Fprintf(&b, " %s |", title(run))
+		}
+		b.WriteString("\n|---|" + strings.Repeat("---:|", len(runs)) + "\n")
+		for _, name := range Metrics(runs...) {
+			fmt.Fprintf(&b, "| %s |", name)
+			for _, run := range runs {
+				fmt.Fprintf(&b, " %s |", metric(run, name))
+			}
+			b.WriteString("\n")
+		}
+		b.WriteString("\n")
+	}
+	for _, run := range runs {
+		fmt.Fprintf(&b, "## %s\n\n", title(run))
+		fmt.Fprintf(&b, "%s on %s, %s, %s.", run.Start.Format(time.RFC3339), run.Host, run.End.Sub(run.Start).Round(time.Millisecond), status(run))
+		if run.Error != "" {
+			fmt.Fprintf(&b, " Error: %s.", run.Error)
+		}
+		b.WriteString("\n\n")
+		if len(run.Params) > 0 || len(run.Args) > 0 {
+			b.WriteString("| parameter | value |\n|---|---|\n")
+			for _, name := range sortedKeys(run.Params) {
+				fmt.Fprintf(&b, "| %s | `%s` |\n", name, strings.ReplaceAll(run.Params[name], "|", "\\|"))
+			}
+			if len(run.Args) > 0 {
+				fmt.Fprintf(&b, "| args | `%s` |\n", strings.Join(run.Args, " "))
+			}
+			b.WriteString("\n")
+		}
+		if len(run.Summary) > 0 {
+			b.WriteString("| metric | value |\n|---|---:|\n")
+			for _, name := range Metrics(run) {
+				fmt.Fprintf(&b, "| %s | %s |\n", name, metric(run, name))
+			}
+			b.WriteString("\n")
+		}
+		if len(run.Assertions) > 0 {
+			b.WriteString("| assertion | value | result |\n|---|---:|---|\n")
+			for _, a := range run.Assertions {
+				fmt.Fprintf(&b, "| %s %s | %s | %s |\n", a.Metric, a.Condition, value(a), passFail(a.Pass))
+			}
+			b.WriteString("\n")
+		}
+		if len(run.Series) > 0 {
+			b.WriteString("| elapsed s | mbps | packets | bytes |\n|---:|---:|---:|---:|\n")
+			for _, s := range run.Series {
+				fmt.Fprintf(&b, "| %s | %s | %d | %d |\n", num(s.Elapsed.Seconds()), num(s.Mbps), s.Packets, s.Bytes)
+			}
+			b.WriteString("\n")
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// HTML writes runs as a standalone HTML page with the same content as
+// Markdown, and the series drawn as a throughput chart.
+func HTML(w io.Writer, runs ...*Run) error {
+	if len(runs) == 0 {
+		return errNoRuns
+	}
+	return page.Execute(w, struct {
+		Runs    []*Run
+		Metrics []string
+	}{runs, Metrics(runs...)})
+}
+
+var page = template.Must(template.New("report").Funcs(template.FuncMap{
+	"title":    title,
+	"status":   status,
+	"metric":   metric,
+	"value":    value,
+	"passFail": passFail,
+	"num":      num,
+	"sorted":   sortedKeys,
+	"chart":    chart,
+	"join":     strings.Join,
+	"rfc3339":  func(t time.Time) string { return t.Format(time.RFC3339) },
+	"took":     func(r *Run) time.Duration { return r.End.Sub(r.Start).Round(time.Millisecond) },
+}).Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>gonet report</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222 }
+table { border-collapse: collapse; margin: 1em 0 }
+th, td { border: 1px solid #ccc; padding: 0.2em 0.6em; text-align: left }
+td.n { text-align: right; font-variant-numeric: tabular-nums }
+.pass { color: #070 } .fail { color: #b00 }
+svg { border: 1px solid #ccc; margin: 1em 0 }
+</style></head><body>
+{{if gt (len .Runs) 1}}<h1>gonet runs</h1>
+<table><tr><th>metric</th>{{range .Runs}}<th>{{title .}}</th>{{end}}</tr>
+{{range $m := .Metrics}}<tr><td>{{$m}}</td>{{range $.Runs}}<td class="n">{{metric . $m}}</td>{{end}}</tr>
+{{end}}</table>{{end}}
+{{range .Runs}}<h2>{{title .}}</h2>
+<p>{{rfc3339 .Start}} on {{.Host}}, {{took .}}, <span class="{{if .Passed}}pass{{else}}fail{{end}}">{{status .}}</span>.{{if .Error}} Error: {{.Error}}.{{end}}</p>
+{{if or .Params .Args}}<table><tr><th>parameter</th><th>value</th></tr>
+{{$p := .Params}}{{range sorted .Params}}<tr><td>{{.}}</td><td><code>{{index $p .}}</code></td></tr>
+{{end}}{{if .Args}}<tr><td>args</td><td><code>{{join .Args " "}}</code></td></tr>{{end}}</table>{{end}}
+{{if .Summary}}<table><tr><th>metric</th><th>value</th></tr>
+{{range $m, $v := .Summary}}<tr><td>{{$m}}</td><td class="n">{{num $v}}</td></tr>
+{{end}}</table>{{end}}
+{{if .Assertions}}<table><tr><th>assertion</th><th>value</th><th>result</th></tr>
+{{range .Assertions}}<tr><td>{{.Metric}} {{.Condition}}</td><td class="n">{{value .}}</td><td class="{{if .Pass}}pass{{else}}fail{{end}}">{{passFail .Pass}}</td></tr>
+{{end}}</table>{{end}}
+{{if .Series}}{{chart .}}
+<table><tr><th>elapsed s</th><th>mbps</th><th>packets</th><th>bytes</th></tr>
+{{range .Series}}<tr><td class="n">{{num .Elapsed.Seconds}}</td><td class="n">{{num .Mbps}}</td><td class="n">{{.Packets}}</td><td class="n">{{.Bytes}}</td></tr>
+{{end}}</table>{{end}}
+{{end}}</body></html>
+`))
+
+// chart draws the throughput series of run as an SVG line.
+func chart(run *Run) template.HTML {
+	const width, height, pad = 640.0, 200.0, 30.0
+	end, top := 0.0, 0.0
+	for _, s := range run.Series {
+		end = math.Max(end, s.Elapsed.Seconds())
+		top = math.Max(top, s.Mbps)
+	}
+	if end == 0 || top == 0 {
+		return ""
+	}
+	var points []string
+	for _, s := range run.Series {
+		x := pad + s.Elapsed.Seconds()/end*(width-2*pad)
+		y := height - pad - s.Mbps/top*(height-2*pad)
+		points = append(points, fmt.Sprintf("%.1f,%.1f", x, y))
+	}
+	return template.HTML(fmt.Sprintf(`<svg width="%.0f" height="%.0f" xmlns="http://www.w3.org/2000/svg">`+
+		`<polyline fill="none" stroke="#36c" stroke-width="1.5" points="%s"/>`+
+		`<text x="%.0f" y="16" font-size="12">%s Mbps</text>`+
+		`<text x="%.0f" y="%.0f" font-size="12" text-anchor="end">%ss</text></svg>`,
+		width, height, strings.Join(points, " "), pad, num(top), width-pad, height-8, num(end)))
+}
+
+// title names a run in headings and columns.
+func title(run *Run) string {
+	return fmt.Sprintf("%s %s", run.Tool, run.ID)
+}
+
+func status(run *Run) string {
+	if run.Passed {
+		return "passed"
+	}
+	return "failed"
+}
+
+// metric writes a summary metric of run, - when it has none.
+func metric(run *Run, name string) string {
+	v, ok := run.Summary[name]
+	if !ok {
+		return "-"
+	}
+	return num(v)
+}
+
+func value(a Assertion) string {
+	if a.Value != nil {
+		return num(*a.Value)
+	}
+	return a.got()
+}
+
+func passFail(pass bool) string {
+	if pass {
+		return "pass"
+	}
+	return "fail"
+}
+
+// num writes whole numbers as they are and others to three decimals.
+func num(v float64) string {
+	if v == math.Trunc(v) && math.Abs(v) < 1e15 {
+		return strconv.FormatFloat(v, 'f', 0, 64)
+	}
+	return strconv.FormatFloat(v, 'f', 3, 64)
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
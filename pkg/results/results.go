@@ -0,0 +1,292 @@
+// Package results is the file format the gonet tools write their runs in
+// with -results: what ran with which flags, the interval series, the
+// summary metrics and how the -assert conditions on them went. One schema
+// serves every tool, so runs can be rendered with gonet report and
+// compared whatever made them.
+//
+// Runs kept with -store go to a registry that is a plain directory of
+// these files rather than an embedded database: the files can be read,
+// copied and rendered with gonet report on their own, and the module
+// keeps to a single dependency. Each run is written to a temporary file
+// and renamed into place, so concurrent tools never see or leave a
+// partial file and need no lock. Queries read every file, which is fine
+// for the thousands of runs a host collects.
+package results
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gonet/pkg/stats"
+)
+
+// Schema names the format and Version its revision. Readers take files
+// of the schema up to their version; new fields don't change it, changed
+// or removed ones do.
+const (
+	Schema  = "gonet.results"
+	Version = 1
+)
+
+// Run is one run of a tool.
+type Run struct {
+	Schema  string `json:"schema"`
+	Version int    `json:"version"`
+	ID      string `json:"id"`
+
+	// Tool is the command, like "tcp client"; Params are the flags given,
+	// on the command line or by -config, and Args the rest.
+	Tool   string            `json:"tool"`
+	Params map[string]string `json:"params"`
+	Args   []string          `json:"args,omitempty"`
+	Host   string            `json:"host"`
+
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+
+	// Series are the interval reports, Summary the metrics of the whole
+	// run, named with their unit like mbps, loss_percent or latency_avg_ms.
+	Series  []stats.Sample     `json:"series,omitempty"`
+	Summary map[string]float64 `json:"summary"`
+
+	Assertions []Assertion `json:"assertions,omitempty"`
+	Passed     bool        `json:"passed"` // no error and every assertion held
+	Error      string      `json:"error,omitempty"`
+
+	// Result is the tool's own result, as its -json writes it.
+	Result json.RawMessage `json:"result,omitempty"`
+}
+
+// Options are the results flags the tools share.
+type Options struct {
+	Path    string
+	Store   string
+	Asserts []string
+}
+
+// RegisterFlags adds -results, -store and -assert to fs.
+func RegisterFlags(fs *flag.FlagSet) *Options {
+	o := &Options{}
+	fs.StringVar(&o.Path, "results", "", "Write the run in the gonet results format to this file when done, see gonet report")
+	fs.StringVar(&o.Store, "store", os.Getenv(StoreEnv), "Keep the run in the run registry in this directory, see gonet runs (default $"+StoreEnv+")")
+	fs.Func("assert", "Condition on a summary metric like \"mbps > 900\" or \"loss_percent < 0.1\", failing the run when it doesn't hold (repeatable)", func(s string) error {
+		if _, err := parseCheck(s); err != nil {
+			return err
+		}
+		o.Asserts = append(o.Asserts, s)
+		return nil
+	})
+	return o
+}
+
+// Recorder collects a run as it goes. It is a stats.Sink, taking the
+// interval series and the packet and byte totals from a Reporter.
+type Recorder struct {
+	path   string
+	store  string
+	checks []check
+
+	mu  sync.Mutex
+	run Run
+}
+
+// Recorder starts recording a run of the command fs parses, call it once
+// the flags are parsed and loaded.
+func (o *Options) Recorder(fs *flag.FlagSet) (*Recorder, error) {
+	r := &Recorder{path: o.Path, store: o.Store}
+	for _, s := range o.Asserts {
+		c, err := parseCheck(s)
+		if err != nil {
+			return nil, err
+		}
+		r.checks = append(r.checks, c)
+	}
+	var id [8]byte
+	rand.Read(id[:])
+	host, _ := os.Hostname()
+	r.run = Run{
+		Schema:  Schema,
+		Version: Version,
+		ID:      hex.EncodeToString(id[:]),
+		Tool:    fs.Name(),
+		Params:  map[string]string{},
+		Args:    fs.Args(),
+		Host:    host,
+		Start:   time.Now(),
+		Summary: map[string]float64{},
+	}
+	// The assertions are recorded with how they went.
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name != "assert" {
+			r.run.Params[f.Name] = f.Value.String()
+		}
+	})
+	return r, nil
+}
+
+// Report adds a sample to the series.
+func (r *Recorder) Report(s stats.Sample) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.run.Series = append(r.run.Series, s)
+	return nil
+}
+
+// Summary sets the packets, bytes, mbps, pps and duration_s metrics,
+// leaving packets and pps out for tools counting bytes alone, like tcp.
+func (r *Recorder) Summary(s stats.Summary) error {
+	m := map[string]float64{
+		"bytes":      float64(s.Bytes),
+		"mbps":       s.Mbps,
+		"duration_s": s.Duration.Seconds(),
+	}
+	if s.Packets > 0 || s.Bytes == 0 {
+		m["packets"] = float64(s.Packets)
+		m["pps"] = s.PPS
+	}
+	r.Set(m)
+	return nil
+}
+
+// Set sets summary metrics, replacing ones of the same name.
+func (r *Recorder) Set(metrics map[string]float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for name, v := range metrics {
+		r.run.Summary[name] = v
+	}
+}
+
+// Assert adds an assertion the tool checked itself, like the phase checks
+// of a scenario.
+func (r *Recorder) Assert(a Assertion) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.run.Assertions = append(r.run.Assertions, a)
+}
+
+// Finish ends the run with the tool's result and error, checks the
+// assertions, writes the file if -results asks for one and keeps the run
+// in the -store registry. It returns an error when the run can't be
+// written or an assertion failed.
+func (r *Recorder) Finish(result any, runErr error) (*Run, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	run := &r.run
+	run.End = time.Now()
+	if runErr != nil {
+		run.Error = runErr.Error()
+	}
+	if result != nil {
+		data, err := json.Marshal(result)
+		if err != nil {
+			return nil, err
+		}
+		run.Result = data
+	}
+	for _, c := range r.checks {
+		run.Assertions = append(run.Assertions, c.eval(run.Summary))
+	}
+	run.Passed = runErr == nil
+	var failed []string
+	for _, a := range run.Assertions {
+		if !a.Pass {
+			run.Passed = false
+			failed = append(failed, a.String())
+			slog.Error("Assertion failed", "metric", a.Metric, "condition", a.Condition, "got", a.got())
+		}
+	}
+	if r.path != "" {
+		if err := Write(r.path, run); err != nil {
+			return run, err
+		}
+	}
+	if r.store != "" {
+		s, err := OpenStore(r.store)
+		if err == nil {
+			err = s.Add(run)
+		}
+		if err != nil {
+			return run, fmt.Errorf("failed to keep the run in %s: %v", r.store, err)
+		}
+	}
+	if len(failed) > 0 {
+		return run, fmt.Errorf("%d of %d assertions failed: %s", len(failed), len(run.Assertions), strings.Join(failed, ", "))
+	}
+	return run, nil
+}
+
+// Write writes v, usually a Run or a tool's -json result, as indented
+// JSON to path, - being stdout.
+func Write(path string, v any) error {
+	if path == "-" {
+		return encodeIndented(os.Stdout, v)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := encodeIndented(f, v); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func encodeIndented(w io.Writer, v any) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// Read reads a run from path, refusing other schemas and newer versions.
+func Read(path string) (*Run, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var run Run
+	if err := json.Unmarshal(data, &run); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	switch {
+	case run.Schema != Schema:
+		return nil, fmt.Errorf("%s: not a gonet results file", path)
+	case run.Version > Version:
+		return nil, fmt.Errorf("%s: results version %d is newer than this gonet's %d", path, run.Version, Version)
+	}
+	if run.Summary == nil {
+		run.Summary = map[string]float64{}
+	}
+	return &run, nil
+}
+
+// Metrics returns the names of the summary metrics of runs, sorted.
+func Metrics(runs ...*Run) []string {
+	seen := map[string]bool{}
+	var names []string
+	for _, run := range runs {
+		for name := range run.Summary {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// errNoRuns is returned by the renderers without runs.
+var errNoRuns = errors.New("no runs to report")
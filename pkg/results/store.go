@@ -0,0 +1,192 @@
+package results
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// StoreEnv is the environment variable naming the run registry when
+// -store isn't given, so every run on a host can be kept without adding
+// the flag each time.
+const StoreEnv = "GONET_RUNS"
+
+// Store is the run registry, a directory keeping each run as a results
+// file named by its start time and ID, so the names sort by time.
+type Store struct {
+	Dir string
+}
+
+// OpenStore opens the registry in dir, creating it if needed.
+func OpenStore(dir string) (*Store, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("no run registry, give one with -store or %s", StoreEnv)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &Store{Dir: dir}, nil
+}
+
+// Add keeps run in the registry. The file is renamed into place once
+// complete, so other tools adding or listing runs at the same time never
+// read it half written.
+func (s *Store) Add(run *Run) error {
+	name := fmt.Sprintf("%s-%s.json", run.Start.UTC().Format("20060102T150405.000"), run.ID)
+	tmp, err := os.CreateTemp(s.Dir, ".run-*")
+	if err != nil {
+		return err
+	}
+	if err := encodeIndented(tmp, run); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(s.Dir, name))
+}
+
+// List returns the runs in the registry oldest first, those of tool and
+// target only when they are set.
+func (s *Store) List(tool, target string) ([]*Run, error) {
+	paths, err := filepath.Glob(filepath.Join(s.Dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	var runs []*Run
+	for _, path := range paths {
+		run, err := Read(path)
+		if err != nil {
+			return nil, err
+		}
+		if tool != "" && run.Tool != tool || target != "" && run.Target() != target {
+			continue
+		}
+		runs = append(runs, run)
+	}
+	return runs, nil
+}
+
+// Get returns the run whose ID starts with id.
+func (s *Store) Get(id string) (*Run, error) {
+	if id == "" || strings.ContainsAny(id, `*?[\/`) {
+		return nil, fmt.Errorf("invalid run ID %q", id)
+	}
+	paths, err := filepath.Glob(filepath.Join(s.Dir, "*-"+id+"*.json"))
+	if err != nil {
+		return nil, err
+	}
+	switch len(paths) {
+	case 0:
+		return nil, fmt.Errorf("no run %s in %s", id, s.Dir)
+	case 1:
+		return Read(paths[0])
+	}
+	return nil, fmt.Errorf("run ID %s is ambiguous, %d runs start with it", id, len(paths))
+}
+
+// Previous returns the last run of the same tool and target before run.
+func (s *Store) Previous(run *Run) (*Run, error) {
+	runs, err := s.List(run.Tool, run.Target())
+	if err != nil {
+		return nil, err
+	}
+	var prev *Run
+	for _, r := range runs {
+		if r.ID == run.ID || !r.Start.Before(run.Start) {
+			break
+		}
+		prev = r
+	}
+	if prev == nil {
+		return nil, errors.New("no earlier run of the same tool and target")
+	}
+	return prev, nil
+}
+
+// Target is where the run went, what makes runs of a tool comparable:
+// the server, destination, URL or interface it was given, else its
+// arguments.
+func (r *Run) Target() string {
+	for _, name := range []string{"server", "destip", "url", "interface", "listen"} {
+		if v := r.Params[name]; v != "" {
+			return v
+		}
+	}
+	return strings.Join(r.Args, " ")
+}
+
+// Change is how a summary metric moved from one run to another.
+type Change struct {
+	Metric string
+	Old    *float64 // nil when the old run lacks the metric
+	New    *float64 // nil when the new run lacks it
+	// Percent is the change relative to Old, infinite when Old is 0 and
+	// New isn't, NaN when either is missing.
+	Percent float64
+	// Worse is set when the change exceeds the threshold in the
+	// direction that is bad for the metric, see LowerIsBetter.
+	Worse bool
+}
+
+// Diff compares the summaries of two runs, flagging changes of more than
+// threshold percent for the worse.
+func Diff(old, new *Run, threshold float64) []Change {
+	var changes []Change
+	for _, name := range Metrics(old, new) {
+		c := Change{Metric: name, Percent: math.NaN()}
+		if v, ok := old.Summary[name]; ok {
+			c.Old = &v
+		}
+		if v, ok := new.Summary[name]; ok {
+			c.New = &v
+		}
+		if c.Old != nil && c.New != nil {
+			switch {
+			case *c.Old != 0:
+				c.Percent = (*c.New - *c.Old) / math.Abs(*c.Old) * 100
+			case *c.New != 0:
+				c.Percent = math.Inf(int(math.Copysign(1, *c.New)))
+			default:
+				c.Percent = 0
+			}
+			switch {
+			case LowerIsBetter(name):
+				c.Worse = c.Percent > threshold
+			case HigherIsBetter(name):
+				c.Worse = -c.Percent > threshold
+			}
+		}
+		changes = append(changes, c)
+	}
+	return changes
+}
+
+// LowerIsBetter tells the metrics that get better as they fall: loss,
+// errors, latency and the like.
+func LowerIsBetter(metric string) bool {
+	for _, s := range []string{"loss", "lost", "error", "failed", "dropped", "reordered", "duplicates", "modified", "jitter", "latency", "_ms"} {
+		if strings.Contains(metric, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// HigherIsBetter tells the rates that get better as they rise.
+func HigherIsBetter(metric string) bool {
+	for _, s := range []string{"mbps", "pps", "rps"} {
+		if strings.HasSuffix(metric, s) {
+			return true
+		}
+	}
+	return false
+}
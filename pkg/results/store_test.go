@@ -0,0 +1,168 @@
+package results
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testRun(id, tool, server string, start time.Time, summary map[string]float64) *Run {
+	return &Run{
+		Schema:  Schema,
+		Version: Version,
+		ID:      id,
+		Tool:    tool,
+		Params:  map[string]string{"server": server},
+		Start:   start,
+		Summary: summary,
+	}
+}
+
+func ids(runs []*Run) []string {
+	var ids []string
+	for _, r := range runs {
+		ids = append(ids, r.ID)
+	}
+	return ids
+}
+
+func TestStore(t *testing.T) {
+	s, err := OpenStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	// Added out of order, listed by start time.
+	for _, run := range []*Run{
+		testRun("cc01", "tcp client", "a:5201", start.Add(2*time.Minute), map[string]float64{"mbps": 90}),
+		testRun("aa01", "tcp client", "a:5201", start, map[string]float64{"mbps": 100}),
+		testRun("bb01", "tcp client", "b:5201", start.Add(time.Minute), nil),
+		testRun("dd01", "udp send", "a:5201", start.Add(3*time.Minute), nil),
+	} {
+		if err := s.Add(run); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		tool, target string
+		want         []string
+	}{
+		{"", "", []string{"aa01", "bb01", "cc01", "dd01"}},
+		{"tcp client", "", []string{"aa01", "bb01", "cc01"}},
+		{"tcp client", "a:5201", []string{"aa01", "cc01"}},
+		{"", "a:5201", []string{"aa01", "cc01", "dd01"}},
+		{"tcp server", "", nil},
+	}
+	for _, tt := range tests {
+		runs, err := s.List(tt.tool, tt.target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(ids(runs)); got != fmt.Sprint(tt.want) {
+			t.Errorf("List(%q, %q) = %v, want %v", tt.tool, tt.target, got, tt.want)
+		}
+	}
+
+	run, err := s.Get("cc")
+	if err != nil || run.ID != "cc01" || run.Summary["mbps"] != 90 {
+		t.Errorf("Get(cc) = %+v, %v, want run cc01", run, err)
+	}
+	for _, id := range []string{"", "zz", "*", "../x"} {
+		if _, err := s.Get(id); err == nil {
+			t.Errorf("Get(%q) succeeded, want an error", id)
+		}
+	}
+	if err := s.Add(testRun("cc02", "tcp client", "a:5201", start.Add(4*time.Minute), nil)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get("cc"); err == nil {
+		t.Error("Get of an ambiguous prefix succeeded, want an error")
+	}
+
+	prev, err := s.Previous(run)
+	if err != nil || prev.ID != "aa01" {
+		t.Errorf("Previous(cc01) = %+v, %v, want run aa01", prev, err)
+	}
+	first, _ := s.Get("aa01")
+	if _, err := s.Previous(first); err == nil {
+		t.Error("Previous of the first run succeeded, want an error")
+	}
+}
+
+func TestStoreConcurrentAdd(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	const n = 20
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.Add(testRun(fmt.Sprintf("%04x", i), "tcp client", "a:5201", start, nil)); err != nil {
+				t.Error(err)
+			}
+		}()
+		// Listing while others write must never see a partial file.
+		if _, err := s.List("", ""); err != nil {
+			t.Fatalf("List during Add: %v", err)
+		}
+	}
+	wg.Wait()
+
+	runs, err := s.List("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != n {
+		t.Errorf("List found %d runs, want %d", len(runs), n)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != n {
+		t.Errorf("registry holds %d files, want %d without temporary files", len(entries), n)
+	}
+}
+
+func TestOpenStoreNeedsDir(t *testing.T) {
+	if _, err := OpenStore(""); err == nil {
+		t.Error("OpenStore(\"\") succeeded, want an error")
+	}
+}
+
+func TestDiff(t *testing.T) {
+	old := &Run{Summary: map[string]float64{"mbps": 100, "loss_percent": 1, "errors": 0, "gone": 5}}
+	new := &Run{Summary: map[string]float64{"mbps": 80, "loss_percent": 1.05, "errors": 2, "added": 1}}
+	changes := Diff(old, new, 10)
+
+	byMetric := map[string]Change{}
+	for _, c := range changes {
+		byMetric[c.Metric] = c
+	}
+	if got := fmt.Sprint(Metrics(old, new)); got != "[added errors gone loss_percent mbps]" {
+		t.Errorf("Metrics = %s", got)
+	}
+	if c := byMetric["mbps"]; c.Percent != -20 || !c.Worse {
+		t.Errorf("mbps change = %+v, want -20%% and worse", c)
+	}
+	if c := byMetric["loss_percent"]; math.Abs(c.Percent-5) > 1e-9 || c.Worse {
+		t.Errorf("loss_percent change = %+v, want 5%% and within the threshold", c)
+	}
+	if c := byMetric["errors"]; !math.IsInf(c.Percent, 1) || !c.Worse {
+		t.Errorf("errors change = %+v, want +Inf and worse", c)
+	}
+	for _, name := range []string{"gone", "added"} {
+		if c := byMetric[name]; !math.IsNaN(c.Percent) || c.Worse {
+			t.Errorf("%s change = %+v, want NaN and not worse", name, c)
+		}
+	}
+}
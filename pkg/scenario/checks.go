@@ -0,0 +1,214 @@
+package scenario
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gonet/pkg/session"
+)
+
+// metrics are what a phase can assert on, from its merged report. The
+// latency, jitter, reordered and duplicates metrics need sequence mode.
+//
+//	loss         lost packets in percent, "< 0.1%"
+//	lost         lost packets, "== 0"
+//	received     packets the receiver saw
+//	reordered    packets that arrived after a later one
+//	duplicates   packets seen twice
+//	latency_min  one-way latency, "< 2ms"
+//	latency_avg
+//	latency_max
+//	jitter
+//	throughput   received bits per second, "> 950Mbps"
+var metrics = map[string]unit{
+	"loss":        percent,
+	"lost":        count,
+	"received":    count,
+	"reordered":   count,
+	"duplicates":  count,
+	"latency_min": duration,
+	"latency_avg": duration,
+	"latency_max": duration,
+	"jitter":      duration,
+	"throughput":  rate,
+}
+
+type unit int
+
+const (
+	count unit = iota
+	percent
+	duration
+	rate
+)
+
+// parse reads a value written in u.
+func (u unit) parse(s string) (float64, error) {
+	switch u {
+	case percent:
+		return strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(s, "%")), 64)
+	case duration:
+		d, err := time.ParseDuration(s)
+		return float64(d), err
+	case rate:
+		return parseRate(s)
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+// format writes a value of u for people.
+func (u unit) format(v float64) string {
+	switch u {
+	case percent:
+		return fmt.Sprintf("%.3f%%", v)
+	case duration:
+		return time.Duration(v).Round(time.Microsecond).String()
+	case rate:
+		return fmt.Sprintf("%.2f Mbps", v/1e6)
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// check is a parsed assertion.
+type check struct {
+	metric, cond string
+	op           string
+	limit        float64
+}
+
+// CheckResult is how an assertion went.
+type CheckResult struct {
+	Metric    string `json:"metric"`
+	Condition string `json:"condition"`
+	Value     string `json:"value"`
+	Pass      bool   `json:"pass"`
+}
+
+// parseCheck parses a condition like "< 0.1%" on metric.
+func parseCheck(metric, cond string) (check, error) {
+	u, ok := metrics[metric]
+	if !ok {
+		return check{}, fmt.Errorf("unknown metric %q", metric)
+	}
+	c := check{metric: metric, cond: strings.TrimSpace(cond)}
+	for _, op := range []string{"<=", ">=", "==", "!=", "<", ">"} {
+		if strings.HasPrefix(c.cond, op) {
+			c.op = op
+			break
+		}
+	}
+	if c.op == "" {
+		return check{}, fmt.Errorf("%s: condition %q needs one of < <= > >= == !=", metric, cond)
+	}
+	limit, err := u.parse(strings.TrimSpace(c.cond[len(c.op):]))
+	if err != nil {
+		return check{}, fmt.Errorf("%s: %v", metric, err)
+	}
+	c.limit = limit
+	return c, nil
+}
+
+// eval checks the assertion against r.
+func (c check) eval(r *session.Report) CheckResult {
+	res := CheckResult{Metric: c.metric, Condition: c.cond}
+	v, ok := value(c.metric, r)
+	if !ok {
+		res.Value = "not measured, needs seq"
+		return res
+	}
+	res.Value = metrics[c.metric].format(v)
+	switch c.op {
+	case "<":
+		res.Pass = v < c.limit
+	case "<=":
+		res.Pass = v <= c.limit
+	case ">":
+		res.Pass = v > c.limit
+	case ">=":
+		res.Pass = v >= c.limit
+	case "==":
+		res.Pass = v == c.limit
+	case "!=":
+		res.Pass = v != c.limit
+	}
+	return res
+}
+
+// value returns metric from r, false when r lacks it.
+func value(metric string, r *session.Report) (float64, bool) {
+	switch metric {
+	case "loss":
+		return r.LossPercent, true
+	case "lost":
+		return float64(r.Lost), true
+	case "received":
+		return float64(r.Received.Packets), true
+	case "throughput":
+		if r.Elapsed <= 0 {
+			return 0, true
+		}
+		return float64(r.Received.Bytes) * 8 / r.Elapsed.Seconds(), true
+	}
+
+	s := r.Sequence
+	if s == nil {
+		return 0, false
+	}
+	switch metric {
+	case "reordered":
+		return float64(s.Reordered), true
+	case "duplicates":
+		return float64(s.Duplicates), true
+	case "latency_min":
+		return float64(s.LatencyMin), s.Received > 0
+	case "latency_avg":
+		return float64(s.LatencyAvg), s.Received > 0
+	case "latency_max":
+		return float64(s.LatencyMax), s.Received > 0
+	case "jitter":
+		return float64(s.Jitter), s.Received > 0
+	}
+	return 0, false
+}
+
+func sortChecks(checks []CheckResult) {
+	slices.SortFunc(checks, func(a, b CheckResult) int {
+		return strings.Compare(a.Metric, b.Metric)
+	})
+}
+
+// parseRate parses bits per second like 1Gbps, 500Mbps, 2.5G or 1e9.
+func parseRate(s string) (float64, error) {
+	v := strings.TrimSpace(s)
+	lower := strings.ToLower(v)
+	for _, suffix := range []string{"bps", "bit/s", "b/s"} {
+		if strings.HasSuffix(lower, suffix) {
+			v = strings.TrimSpace(v[:len(v)-len(suffix)])
+			break
+		}
+	}
+	mult := 1.0
+	if n := len(v); n > 0 {
+		switch v[n-1] {
+		case 'k', 'K':
+			mult = 1e3
+		case 'm', 'M':
+			mult = 1e6
+		case 'g', 'G':
+			mult = 1e9
+		case 't', 'T':
+			mult = 1e12
+		}
+		if mult != 1 {
+			v = v[:n-1]
+		}
+	}
+	f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+	if err != nil || f <= 0 {
+		return 0, fmt.Errorf("invalid rate %q, want bits per second like 500Mbps", s)
+	}
+	return f * mult, nil
+}
@@ -0,0 +1,219 @@
+// Package scenario runs a test in phases between gonet udp send and gonet
+// udp recv -control, like a baseline, a burst, a failover and a recovery,
+// checking assertions on each phase's merged report.
+package scenario
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"runtime"
+	"time"
+
+	"gonet/pkg/config"
+	"gonet/pkg/generator"
+	"gonet/pkg/session"
+)
+
+// Scenario is the file gonet udp send -scenario runs.
+type Scenario struct {
+	// Size and Sequence apply to phases that don't set them.
+	Size     int  `json:"size"`
+	Sequence bool `json:"seq"`
+
+	Phases []Phase `json:"phases"`
+}
+
+// Phase is one coordinated test.
+type Phase struct {
+	Name     string          `json:"name"`
+	Duration config.Duration `json:"duration"`
+
+	// Rate is in bits per second of Ethernet frames, like 500Mbps or 1G,
+	// PPS in packets per second; one of them is required.
+	Rate string `json:"rate"`
+	PPS  int    `json:"pps"`
+
+	Size     int   `json:"size"`
+	Sequence *bool `json:"seq"`
+
+	// Trigger is a shell command run TriggerAfter into the phase, e.g. to
+	// fail a link over. A failing command fails the phase.
+	Trigger      string          `json:"trigger"`
+	TriggerAfter config.Duration `json:"trigger_after"`
+
+	// Assert maps metrics, listed in checks.go, to conditions like "< 0.1%".
+	Assert map[string]string `json:"assert"`
+}
+
+// Load reads a scenario from a YAML or JSON file.
+func Load(path string) (*Scenario, error) {
+	doc, err := config.Load(path)
+	if err != nil {
+		return nil, err
+	}
+	var sc Scenario
+	if err := config.Decode(doc, &sc); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if len(sc.Phases) == 0 {
+		return nil, fmt.Errorf("%s: no phases", path)
+	}
+	for i := range sc.Phases {
+		p := &sc.Phases[i]
+		if p.Name == "" {
+			p.Name = fmt.Sprintf("phase %d", i+1)
+		}
+		if p.Duration <= 0 {
+			return nil, fmt.Errorf("%s: %s has no duration", path, p.Name)
+		}
+		if (p.Rate == "") == (p.PPS == 0) {
+			return nil, fmt.Errorf("%s: %s needs either rate or pps", path, p.Name)
+		}
+		if p.Rate != "" {
+			if _, err := parseRate(p.Rate); err != nil {
+				return nil, fmt.Errorf("%s: %s: %v", path, p.Name, err)
+			}
+		}
+		for metric, cond := range p.Assert {
+			if _, err := parseCheck(metric, cond); err != nil {
+				return nil, fmt.Errorf("%s: %s: %v", path, p.Name, err)
+			}
+		}
+	}
+	return &sc, nil
+}
+
+// PhaseResult is how a phase went.
+type PhaseResult struct {
+	Name   string          `json:"name"`
+	Report *session.Report `json:"report,omitempty"`
+	Checks []CheckResult   `json:"checks"`
+	Error  string          `json:"error,omitempty"`
+	Pass   bool            `json:"pass"`
+}
+
+// Run runs the phases one after the other against the receiver at addr,
+// each with the settings of base overridden by the phase. A phase that
+// can't run fails and the ones after it still run, unless ctx is done.
+func Run(ctx context.Context, cl *session.Client, addr string, base generator.Config, sc *Scenario) []PhaseResult {
+	var results []PhaseResult
+	for _, p := range sc.Phases {
+		if ctx.Err() != nil {
+			break
+		}
+		slog.Info("Phase started", "phase", p.Name, "duration", time.Duration(p.Duration))
+		results = append(results, runPhase(ctx, cl, addr, base, sc, p))
+	}
+	return results
+}
+
+func runPhase(ctx context.Context, cl *session.Client, addr string, base generator.Config, sc *Scenario, p Phase) PhaseResult {
+	res := PhaseResult{Name: p.Name}
+
+	cfg := base
+	cfg.Duration = time.Duration(p.Duration)
+	if sc.Size > 0 {
+		cfg.Size = sc.Size
+	}
+	if p.Size > 0 {
+		cfg.Size = p.Size
+	}
+	cfg.Sequence = sc.Sequence
+	if p.Sequence != nil {
+		cfg.Sequence = *p.Sequence
+	}
+	cfg.PPS = p.PPS
+	if p.Rate != "" {
+		bps, _ := parseRate(p.Rate)
+		// Ethernet, IPv4 and UDP headers come on top of the payload.
+		cfg.PPS = max(1, int(bps/float64((cfg.Size+42)*8)))
+	}
+
+	triggered := make(chan error, 1)
+	if p.Trigger != "" {
+		go func() {
+			select {
+			case <-time.After(time.Duration(p.TriggerAfter)):
+				triggered <- trigger(ctx, p.Trigger)
+			case <-ctx.Done():
+				triggered <- ctx.Err()
+			}
+		}()
+	} else {
+		triggered <- nil
+	}
+
+	r, err := cl.Run(ctx, addr, cfg)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	res.Report = r
+	if err := <-triggered; err != nil {
+		res.Error = fmt.Sprintf("trigger failed: %v", err)
+	}
+
+	res.Pass = res.Error == ""
+	for metric, cond := range p.Assert {
+		c, _ := parseCheck(metric, cond)
+		cr := c.eval(r)
+		res.Checks = append(res.Checks, cr)
+		res.Pass = res.Pass && cr.Pass
+	}
+	sortChecks(res.Checks)
+	return res
+}
+
+// trigger runs command with the system shell.
+func trigger(ctx context.Context, command string) error {
+	slog.Info("Running trigger", "command", command)
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", command)
+	}
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	return cmd.Run()
+}
+
+// Passed reports whether every phase passed.
+func Passed(results []PhaseResult) bool {
+	for _, r := range results {
+		if !r.Pass {
+			return false
+		}
+	}
+	return len(results) > 0
+}
+
+// Write prints the phase reports and a pass/fail summary.
+func Write(w io.Writer, results []PhaseResult) {
+	for _, r := range results {
+		fmt.Fprintf(w, "\n== %s\n", r.Name)
+		if r.Report != nil {
+			r.Report.Write(w)
+		}
+		for _, c := range r.Checks {
+			fmt.Fprintf(w, "  %s %s %s: %s\n", verdict(c.Pass), c.Metric, c.Condition, c.Value)
+		}
+		if r.Error != "" {
+			fmt.Fprintf(w, "  FAIL %s\n", r.Error)
+		}
+	}
+	fmt.Fprintln(w)
+	for _, r := range results {
+		fmt.Fprintf(w, "%-4s %s\n", verdict(r.Pass), r.Name)
+	}
+}
+
+func verdict(pass bool) string {
+	if pass {
+		return "PASS"
+	}
+	return "FAIL"
+}
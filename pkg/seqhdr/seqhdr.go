@@ -0,0 +1,39 @@
+// Package seqhdr is the header sequence mode puts at the start of UDP
+// payloads, so a receiver can count lost, reordered and duplicated packets
+// and measure their one-way latency.
+package seqhdr
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// Len is the size of the header, the smallest payload sequence mode can
+// send.
+const Len = 20
+
+// Header numbers a packet of a stream.
+type Header struct {
+	Stream uint32 // tells concurrent tests apart
+	Seq    uint64 // counts from 0
+	Sent   time.Time
+}
+
+// Put writes h to the start of b, which must hold Len bytes.
+func (h Header) Put(b []byte) {
+	binary.BigEndian.PutUint32(b[0:], h.Stream)
+	binary.BigEndian.PutUint64(b[4:], h.Seq)
+	binary.BigEndian.PutUint64(b[12:], uint64(h.Sent.UnixNano()))
+}
+
+// Parse reads the header at the start of payload.
+func Parse(payload []byte) (Header, bool) {
+	if len(payload) < Len {
+		return Header{}, false
+	}
+	return Header{
+		Stream: binary.BigEndian.Uint32(payload[0:]),
+		Seq:    binary.BigEndian.Uint64(payload[4:]),
+		Sent:   time.Unix(0, int64(binary.BigEndian.Uint64(payload[12:]))),
+	}, true
+}
@@ -0,0 +1,88 @@
+package session
+
+import (
+	"errors"
+	"time"
+)
+
+// Clock is the receiver's clock against the sender's, estimated NTP style
+// over the control channel before and after a sequence mode test, so the
+// one-way latency can be corrected when the hosts aren't synchronized.
+type Clock struct {
+	// Offset is how far the receiver's clock is ahead of the sender's at
+	// the middle of the test.
+	Offset time.Duration `json:"offset_ns"`
+	// Skew is how much faster the receiver's clock runs, in parts per
+	// million.
+	Skew float64 `json:"skew_ppm"`
+	// RTT is the round trip of the worse of the two best probes; an
+	// asymmetric path can put the offset off by up to half of it.
+	RTT time.Duration `json:"rtt_ns"`
+}
+
+// syncProbes is how many probes each estimate takes the best of.
+const syncProbes = 8
+
+// timestamps of a probe: the sender's send time, the receiver's receive
+// and reply times, in Unix nanoseconds of each host's clock.
+type timestamps struct {
+	T1 int64 `json:"t1"`
+	T2 int64 `json:"t2"`
+	T3 int64 `json:"t3"`
+}
+
+// sample is a probe's estimate.
+type sample struct {
+	offset, rtt time.Duration
+	at          time.Time // sender's clock halfway through the probe
+}
+
+// sync probes the receiver's clock and returns the sample with the
+// shortest round trip, the least disturbed by queueing.
+func (c *conn) sync() (sample, error) {
+	var best sample
+	for i := 0; i < syncProbes; i++ {
+		t1 := time.Now()
+		if err := c.send(message{Type: "sync", Sync: &timestamps{T1: t1.UnixNano()}}); err != nil {
+			return sample{}, err
+		}
+		m, err := c.receive(10*time.Second, "sync")
+		if err != nil {
+			return sample{}, err
+		}
+		t4 := time.Now()
+		ts := m.Sync
+		if ts == nil || ts.T1 != t1.UnixNano() {
+			return sample{}, errors.New("sync reply doesn't match the probe")
+		}
+		s := sample{
+			offset: time.Duration((ts.T2 - ts.T1 + ts.T3 - t4.UnixNano()) / 2),
+			rtt:    t4.Sub(t1) - time.Duration(ts.T3-ts.T2),
+			at:     t1.Add(t4.Sub(t1) / 2),
+		}
+		if i == 0 || s.rtt < best.rtt {
+			best = s
+		}
+	}
+	return best, nil
+}
+
+// estimate combines the samples taken before and after the test.
+func estimate(before, after sample) *Clock {
+	c := &Clock{Offset: (before.offset + after.offset) / 2, RTT: max(before.rtt, after.rtt)}
+	if span := after.at.Sub(before.at); span > 0 {
+		c.Skew = float64(after.offset-before.offset) / float64(span) * 1e6
+	}
+	return c
+}
+
+// answerSync replies to a sync probe received at t2.
+func (c *conn) answerSync(m *message, t2 time.Time) error {
+	if m.Sync == nil {
+		return errors.New("sync message without timestamps")
+	}
+	ts := *m.Sync
+	ts.T2 = t2.UnixNano()
+	ts.T3 = time.Now().UnixNano()
+	return c.send(message{Type: "sync", Sync: &ts})
+}
@@ -0,0 +1,142 @@
+package session
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"gonet/pkg/capture"
+)
+
+// Counts are packets and bytes seen by one end.
+type Counts struct {
+	Packets uint64 `json:"packets"`
+	Bytes   uint64 `json:"bytes"`
+}
+
+// Report merges the sender's and the receiver's view of a test.
+type Report struct {
+	Params   Params        `json:"params"`
+	Elapsed  time.Duration `json:"elapsed_ns"` // how long the sender sent
+	Sent     Counts        `json:"sent"`
+	Received Counts        `json:"received"`
+
+	// Lost counts from the sequence numbers in sequence mode, else from
+	// the packet counts.
+	Lost        uint64  `json:"lost"`
+	LossPercent float64 `json:"loss_percent"`
+
+	Sequence *capture.SequenceStats `json:"sequence,omitempty"`
+
+	// Clock, when the ends estimated it, has been taken off the
+	// sequence latency.
+	Clock *Clock `json:"clock,omitempty"`
+
+	// Heatmap, when the receiver was asked for it, is the loss per flow
+	// and period in sequence mode.
+	Heatmap *capture.Heatmap `json:"heatmap,omitempty"`
+
+	// Trailer is what the telemetry trailers told, when the packets
+	// carried them.
+	Trailer *capture.TrailerStats `json:"trailer,omitempty"`
+}
+
+// Merge fills in the loss from the counts and sequence results and
+// corrects the latency by the clock offset, once.
+func (r *Report) Merge() {
+	switch {
+	case r.Sequence != nil:
+		r.Lost = r.Sequence.Lost(r.Sent.Packets)
+	case r.Sent.Packets > r.Received.Packets:
+		r.Lost = r.Sent.Packets - r.Received.Packets
+	}
+	expected := r.Sent.Packets
+	if expected == 0 && r.Sequence != nil {
+		expected = r.Sequence.Next
+	}
+	if expected > 0 {
+		r.LossPercent = float64(r.Lost) * 100 / float64(expected)
+	}
+	if s := r.Sequence; s != nil && r.Clock != nil && s.Received > 0 {
+		s.LatencyMin -= r.Clock.Offset
+		s.LatencyAvg -= r.Clock.Offset
+		s.LatencyMax -= r.Clock.Offset
+	}
+}
+
+// Write prints r for people.
+func (r *Report) Write(w io.Writer) {
+	p := r.Params
+	if p.PPS > 0 {
+		mode := ""
+		if p.Sequence {
+			mode = ", sequence mode"
+		}
+		if p.Trailer > 0 {
+			mode += fmt.Sprintf(", %d hop trailer", p.Trailer)
+		}
+		fmt.Fprintf(w, "Test %08x: %d pps of %d byte payloads for %v to port %d%s\n", p.Stream, p.PPS, p.Size, p.Duration, p.Port, mode)
+	}
+	if r.Sent.Packets > 0 {
+		fmt.Fprintf(w, "Sent:      %d packets, %d bytes (%.2f Mbps)\n", r.Sent.Packets, r.Sent.Bytes, mbps(r.Sent.Bytes, r.Elapsed))
+	}
+	fmt.Fprintf(w, "Received:  %d packets, %d bytes (%.2f Mbps)\n", r.Received.Packets, r.Received.Bytes, mbps(r.Received.Bytes, r.Elapsed))
+	fmt.Fprintf(w, "Lost:      %d packets (%.2f%%)\n", r.Lost, r.LossPercent)
+
+	if s := r.Sequence; s != nil {
+		fmt.Fprintf(w, "Reordered: %d, duplicated: %d\n", s.Reordered, s.Duplicates)
+		if s.Received > 0 {
+			fmt.Fprintf(w, "Latency:   min %.3f ms, avg %.3f ms, max %.3f ms, jitter %.3f ms\n",
+				ms(s.LatencyMin), ms(s.LatencyAvg), ms(s.LatencyMax), ms(s.Jitter))
+		}
+	}
+	if c := r.Clock; c != nil {
+		fmt.Fprintf(w, "Clock:     receiver %+.3f ms (within %.3f ms), skew %+.2f ppm, corrected\n",
+			ms(c.Offset), ms(c.RTT)/2, c.Skew)
+	}
+	if r.Trailer != nil {
+		r.Trailer.Write(w)
+	}
+	if r.Heatmap != nil {
+		r.Heatmap.Write(w)
+	}
+}
+
+// Metrics returns r as results summary metrics, the latency ones only in
+// sequence mode and the trailer ones with a trailer.
+func (r *Report) Metrics() map[string]float64 {
+	m := map[string]float64{
+		"sent":            float64(r.Sent.Packets),
+		"received":        float64(r.Received.Packets),
+		"received_bytes":  float64(r.Received.Bytes),
+		"lost":            float64(r.Lost),
+		"loss_percent":    r.LossPercent,
+		"throughput_mbps": mbps(r.Received.Bytes, r.Elapsed),
+	}
+	if t := r.Trailer; t != nil {
+		m["trailer_packets"] = float64(t.Packets)
+		m["trailer_overflow"] = float64(t.Overflow)
+	}
+	if s := r.Sequence; s != nil {
+		m["reordered"] = float64(s.Reordered)
+		m["duplicates"] = float64(s.Duplicates)
+		if s.Received > 0 {
+			m["latency_min_ms"] = ms(s.LatencyMin)
+			m["latency_avg_ms"] = ms(s.LatencyAvg)
+			m["latency_max_ms"] = ms(s.LatencyMax)
+			m["jitter_ms"] = ms(s.Jitter)
+		}
+	}
+	return m
+}
+
+func mbps(bytes uint64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return float64(bytes) * 8 / d.Seconds() / 1e6
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,320 @@
+// Package session runs coordinated tests between gonet udp send and gonet
+// udp recv, like iperf: the sender connects to the receiver's control
+// port over TCP, asks for a test, sends it while the receiver captures it,
+// and both ends print the same merged report.
+//
+// The control channel carries one JSON message per line: hello with the
+// test from the sender, ready or error from the receiver, done with the
+// sender's counts, and result with the merged report. In sequence mode the
+// sender also sends sync probes around the test, each answered with the
+// receiver's timestamps, to correct the latency for the clocks' offset.
+package session
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"gonet/pkg/capture"
+	"gonet/pkg/generator"
+	"gonet/pkg/stats"
+)
+
+// Params is the test the sender asks for.
+type Params struct {
+	Stream   uint32        `json:"stream"`
+	Port     int           `json:"port"`
+	PPS      int           `json:"pps"`
+	Size     int           `json:"size"`
+	Duration time.Duration `json:"duration_ns"`
+	Sequence bool          `json:"sequence"`
+	Trailer  int           `json:"trailer,omitempty"` // hop slots
+}
+
+// message is a line of the control channel.
+type message struct {
+	Type    string        `json:"type"` // hello, ready, sync, done, result or error
+	Params  *Params       `json:"params,omitempty"`
+	Sync    *timestamps   `json:"sync,omitempty"`
+	Sent    *Counts       `json:"sent,omitempty"`
+	Elapsed time.Duration `json:"elapsed_ns,omitempty"`
+	Clock   *Clock        `json:"clock,omitempty"`
+	Report  *Report       `json:"report,omitempty"`
+	Error   string        `json:"error,omitempty"`
+}
+
+// DefaultDuration is the length of a test that doesn't give one.
+const DefaultDuration = 10 * time.Second
+
+// ReporterFunc makes the interval reporter for a test's counters.
+type ReporterFunc func(*stats.Counters) (*stats.Reporter, error)
+
+// conn reads and writes messages.
+type conn struct {
+	net.Conn
+	dec *json.Decoder
+	enc *json.Encoder
+}
+
+func newConn(c net.Conn) *conn {
+	return &conn{Conn: c, dec: json.NewDecoder(bufio.NewReader(c)), enc: json.NewEncoder(c)}
+}
+
+// receive reads the next message within timeout, turning error messages
+// into errors.
+func (c *conn) receive(timeout time.Duration, want ...string) (*message, error) {
+	c.SetReadDeadline(time.Now().Add(timeout))
+	var m message
+	if err := c.dec.Decode(&m); err != nil {
+		return nil, err
+	}
+	if m.Type == "error" {
+		return nil, errors.New(m.Error)
+	}
+	if !slices.Contains(want, m.Type) {
+		return nil, fmt.Errorf("got %q message, want %s", m.Type, strings.Join(want, " or "))
+	}
+	return &m, nil
+}
+
+func (c *conn) send(m message) error {
+	c.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	return c.enc.Encode(m)
+}
+
+// Client runs tests against a Server.
+type Client struct {
+	// Reporter, if set, reports the sending side during the test.
+	Reporter ReporterFunc
+}
+
+// Run asks the receiver at addr for the test cfg describes, sends it and
+// returns the merged report. Cancelling ctx ends the test early, the
+// report then covers what was sent so far.
+func (cl *Client) Run(ctx context.Context, addr string, cfg generator.Config) (*Report, error) {
+	if len(cfg.Targets) > 0 {
+		return nil, errors.New("a coordinated test has a single destination")
+	}
+	if cfg.Duration <= 0 {
+		cfg.Duration = DefaultDuration
+	}
+	cfg.Stream = rand.Uint32()
+	params := Params{
+		Stream:   cfg.Stream,
+		Port:     cfg.DstPort,
+		PPS:      cfg.PPS,
+		Size:     cfg.Size,
+		Duration: cfg.Duration,
+		Sequence: cfg.Sequence,
+		Trailer:  cfg.Trailer,
+	}
+
+	var d net.Dialer
+	nc, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c := newConn(nc)
+	defer c.Close()
+
+	if err := c.send(message{Type: "hello", Params: &params}); err != nil {
+		return nil, err
+	}
+	if _, err := c.receive(30*time.Second, "ready"); err != nil {
+		return nil, fmt.Errorf("receiver refused the test: %v", err)
+	}
+
+	// The latency needs the receiver's clock, sampled on both sides of
+	// the test for its skew.
+	var before sample
+	if cfg.Sequence {
+		if before, err = c.sync(); err != nil {
+			return nil, fmt.Errorf("clock sync: %v", err)
+		}
+	}
+
+	var g generator.Generator
+	if cl.Reporter != nil {
+		reporter, err := cl.Reporter(g.Counters())
+		if err != nil {
+			return nil, err
+		}
+		reporter.Start()
+		defer reporter.Stop()
+	}
+	start := time.Now()
+	if err := g.Run(ctx, cfg); err != nil {
+		c.send(message{Type: "error", Error: err.Error()})
+		return nil, err
+	}
+	elapsed := time.Since(start)
+
+	packets, bytes := g.Stats()
+	done := message{Type: "done", Sent: &Counts{Packets: packets, Bytes: bytes}, Elapsed: elapsed}
+	if cfg.Sequence {
+		after, err := c.sync()
+		if err != nil {
+			return nil, fmt.Errorf("clock sync: %v", err)
+		}
+		done.Clock = estimate(before, after)
+	}
+	if err := c.send(done); err != nil {
+		return nil, err
+	}
+	m, err := c.receive(time.Minute, "result")
+	if err != nil {
+		return nil, fmt.Errorf("no result from the receiver: %v", err)
+	}
+	if m.Report == nil {
+		return nil, errors.New("result without a report")
+	}
+	return m.Report, nil
+}
+
+// Server accepts tests from Clients, one at a time.
+type Server struct {
+	Interface   string // pcap device name to capture on
+	Promiscuous bool
+	Backend     string // see capture.Config
+
+	// Flows, if set, gets the flows of every test.
+	Flows *capture.FlowTable
+
+	// Heatmap, if positive, adds a loss heatmap of this many periods to
+	// the reports of sequence mode tests.
+	Heatmap int
+
+	// Drain is how long the capture goes on after the sender is done, for
+	// packets still in flight, default one second.
+	Drain time.Duration
+
+	// Reporter, if set, reports the receiving side during each test.
+	Reporter ReporterFunc
+
+	// Reports, if set, gets the merged report of each test.
+	Reports func(*Report)
+}
+
+// Serve runs the tests asked for on ln until ctx is done.
+func (s *Server) Serve(ctx context.Context, ln net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	for {
+		nc, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		if err := s.handle(ctx, newConn(nc)); err != nil {
+			slog.Warn("Test failed", "client", nc.RemoteAddr(), "err", err)
+		}
+		nc.Close()
+	}
+}
+
+func (s *Server) handle(ctx context.Context, c *conn) error {
+	m, err := c.receive(30*time.Second, "hello")
+	if err != nil {
+		return err
+	}
+	p := m.Params
+	if p == nil || p.Port <= 0 || p.Port > 65535 || p.PPS <= 0 || p.Duration <= 0 {
+		c.send(message{Type: "error", Error: "invalid test parameters"})
+		return fmt.Errorf("invalid test parameters %+v", p)
+	}
+	slog.Info("Test started", "stream", fmt.Sprintf("%08x", p.Stream), "client", c.RemoteAddr(), "pps", p.PPS, "size", p.Size, "duration", p.Duration, "port", p.Port)
+
+	var capt capture.Capture
+	if s.Reporter != nil {
+		reporter, err := s.Reporter(capt.Counters())
+		if err != nil {
+			return err
+		}
+		reporter.Start()
+		defer reporter.Stop()
+	}
+
+	captureCtx, stop := context.WithCancel(ctx)
+	defer stop()
+	ready := make(chan struct{})
+	finished := make(chan error, 1)
+	go func() {
+		finished <- capt.Run(captureCtx, capture.Config{
+			Interface:   s.Interface,
+			Port:        p.Port,
+			Promiscuous: s.Promiscuous,
+			Backend:     s.Backend,
+			Flows:       s.Flows,
+			Sequence:    p.Sequence,
+			Stream:      p.Stream,
+			Trailer:     p.Trailer > 0,
+			Ready:       func() { close(ready) },
+		})
+	}()
+	select {
+	case <-ready:
+	case err := <-finished:
+		c.send(message{Type: "error", Error: err.Error()})
+		return err
+	}
+	if err := c.send(message{Type: "ready"}); err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(p.Duration + time.Minute)
+	for {
+		m, err = c.receive(time.Until(deadline), "sync", "done")
+		if err != nil {
+			return err
+		}
+		if m.Type == "done" {
+			break
+		}
+		if err := c.answerSync(m, time.Now()); err != nil {
+			return err
+		}
+	}
+	drain := s.Drain
+	if drain <= 0 {
+		drain = time.Second
+	}
+	time.Sleep(drain)
+	stop()
+	if err := <-finished; err != nil {
+		c.send(message{Type: "error", Error: err.Error()})
+		return err
+	}
+
+	packets, bytes := capt.Stats()
+	r := &Report{Params: *p, Elapsed: m.Elapsed, Received: Counts{Packets: packets, Bytes: bytes}}
+	if m.Sent != nil {
+		r.Sent = *m.Sent
+	}
+	if p.Sequence {
+		seq := capt.Sequence()
+		r.Sequence = &seq
+		r.Clock = m.Clock
+		r.Heatmap = capt.Heatmap(s.Heatmap)
+	}
+	if p.Trailer > 0 {
+		t := capt.Trailer()
+		r.Trailer = &t
+	}
+	r.Merge()
+	if s.Reports != nil {
+		s.Reports(r)
+	}
+	return c.send(message{Type: "result", Report: r})
+}
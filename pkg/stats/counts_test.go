@@ -0,0 +1,18 @@
+package stats
+
+import "testing"
+
+func TestCounts(t *testing.T) {
+	if got := Counts(map[string]uint64{}); got != "none" {
+		t.Errorf("Counts(empty) = %q, want none", got)
+	}
+	got := Counts(map[string]uint64{"timeout": 2, "refused": 5, "reset": 2})
+	if want := "refused: 5, reset: 2, timeout: 2"; got != want {
+		t.Errorf("Counts = %q, want %q", got, want)
+	}
+	// Non-string keys tie-break on their formatted value.
+	got = Counts(map[int]uint64{503: 1, 200: 9, 404: 1})
+	if want := "200: 9, 404: 1, 503: 1"; got != want {
+		t.Errorf("Counts = %q, want %q", got, want)
+	}
+}
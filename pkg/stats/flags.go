@@ -0,0 +1,90 @@
+package stats
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Options are the reporting flags the tools share.
+type Options struct {
+	Interval   time.Duration
+	Format     string
+	Out        string
+	Prometheus string
+
+	// NoPackets leaves packets out of the text reports, for the tools
+	// that count byte streams; Unit names what the tools that count
+	// something else count, like "Requests".
+	NoPackets bool
+	Unit      string
+
+	// Sinks get the reports too, like the recorder of -results.
+	Sinks []Sink
+}
+
+// RegisterFlags adds -report, -stats-format, -stats-out and -prometheus
+// to fs. The report interval is whole seconds, as the tools always took.
+func RegisterFlags(fs *flag.FlagSet) *Options {
+	o := &Options{}
+	fs.Func("report", "Reporting interval in seconds (default 1)", func(s string) error {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			var secs float64
+			if _, scanErr := fmt.Sscan(s, &secs); scanErr != nil {
+				return err
+			}
+			d = time.Duration(secs * float64(time.Second))
+		}
+		o.Interval = d
+		return nil
+	})
+	o.Interval = time.Second
+	fs.StringVar(&o.Format, "stats-format", "text", "Format of the interval reports: text, json or csv")
+	fs.StringVar(&o.Out, "stats-out", "", "File to write the interval reports to, default stdout")
+	fs.StringVar(&o.Prometheus, "prometheus", "", "Also serve the counters for Prometheus on this address, e.g. :9100")
+	return o
+}
+
+// Reporter opens the sinks the options ask for and returns a Reporter
+// for c. direction, verb and metric name the text lines and the
+// Prometheus metrics, e.g. "Incoming", "received" and "udp_recv". A
+// -stats-out file is closed by the Reporter's Stop.
+func (o *Options) Reporter(c *Counters, direction, verb, metric string) (*Reporter, error) {
+	switch o.Format {
+	case "text", "json", "csv":
+	default:
+		return nil, fmt.Errorf("invalid -stats-format %q, want text, json or csv", o.Format)
+	}
+
+	var w io.Writer = os.Stdout
+	var out *os.File
+	if o.Out != "" {
+		f, err := os.Create(o.Out)
+		if err != nil {
+			return nil, err
+		}
+		w, out = f, f
+	}
+
+	var sinks []Sink
+	switch o.Format {
+	case "text":
+		sinks = append(sinks, &TextSink{W: w, Direction: direction, Verb: verb, NoPackets: o.NoPackets, Unit: o.Unit})
+	case "json":
+		sinks = append(sinks, NewJSONSink(w))
+	case "csv":
+		sinks = append(sinks, NewCSVSink(w))
+	}
+	if o.Prometheus != "" {
+		sinks = append(sinks, NewPrometheusSink(o.Prometheus, metric))
+	}
+	sinks = append(sinks, o.Sinks...)
+	r := NewReporter(c, o.Interval, sinks...)
+	if out != nil {
+		r.out = out
+	}
+	return r, nil
+}
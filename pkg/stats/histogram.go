@@ -0,0 +1,229 @@
+package stats
+
+import (
+	"fmt"
+	"io"
+	"math/bits"
+	"strings"
+	"sync"
+	"time"
+)
+
+// subBits sets the histogram's precision: each power of two of
+// nanoseconds is split in 1<<subBits buckets, so values are kept to
+// within about 1.6%.
+const subBits = 6
+
+const (
+	subBuckets = 1 << subBits
+	numBuckets = subBuckets + (64-subBits-1)*subBuckets
+)
+
+// Histogram records latencies for percentiles, from any goroutine. The
+// zero value is ready to use.
+type Histogram struct {
+	mu       sync.Mutex
+	counts   []uint64
+	n        uint64
+	sum      time.Duration
+	min, max time.Duration
+}
+
+func bucketOf(v uint64) int {
+	if v < subBuckets {
+		return int(v)
+	}
+	shift := bits.Len64(v) - subBits - 1
+	return subBuckets + shift*subBuckets + int(v>>shift) - subBuckets
+}
+
+// bucketRange returns the values bucket i holds, [low, high).
+func bucketRange(i int) (low, high uint64) {
+	if i < subBuckets {
+		return uint64(i), uint64(i) + 1
+	}
+	shift := (i - subBuckets) / subBuckets
+	m := uint64((i-subBuckets)%subBuckets + subBuckets)
+	return m << shift, (m + 1) << shift
+}
+
+// Record adds a latency.
+func (h *Histogram) Record(d time.Duration) {
+	d = max(d, 0)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.counts == nil {
+		h.counts = make([]uint64, numBuckets)
+	}
+	h.counts[bucketOf(uint64(d))]++
+	if h.n == 0 || d < h.min {
+		h.min = d
+	}
+	h.max = max(h.max, d)
+	h.n++
+	h.sum += d
+}
+
+// Merge adds the latencies of o.
+func (h *Histogram) Merge(o *Histogram) {
+	o.mu.Lock()
+	counts := append([]uint64(nil), o.counts...)
+	n, sum, lo, hi := o.n, o.sum, o.min, o.max
+	o.mu.Unlock()
+	if n == 0 {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.counts == nil {
+		h.counts = make([]uint64, numBuckets)
+	}
+	for i, c := range counts {
+		h.counts[i] += c
+	}
+	if h.n == 0 || lo < h.min {
+		h.min = lo
+	}
+	h.max = max(h.max, hi)
+	h.n += n
+	h.sum += sum
+}
+
+// Count returns how many latencies were recorded.
+func (h *Histogram) Count() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.n
+}
+
+// quantile returns the q quantile, 0 <= q <= 1, with h.mu held.
+func (h *Histogram) quantile(q float64) time.Duration {
+	if h.n == 0 {
+		return 0
+	}
+	rank := uint64(q*float64(h.n-1)) + 1
+	var seen uint64
+	for i, c := range h.counts {
+		seen += c
+		if seen >= rank {
+			low, high := bucketRange(i)
+			mid := time.Duration(low + (high-low)/2)
+			return min(max(mid, h.min), h.max)
+		}
+	}
+	return h.max
+}
+
+// Quantile returns the q quantile of the latencies, like 0.99.
+func (h *Histogram) Quantile(q float64) time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.quantile(q)
+}
+
+// Latency summarizes a Histogram.
+type Latency struct {
+	Count uint64        `json:"count"`
+	Min   time.Duration `json:"min_ns"`
+	Mean  time.Duration `json:"mean_ns"`
+	P50   time.Duration `json:"p50_ns"`
+	P90   time.Duration `json:"p90_ns"`
+	P99   time.Duration `json:"p99_ns"`
+	P999  time.Duration `json:"p999_ns"`
+	Max   time.Duration `json:"max_ns"`
+
+	// Buckets count the latencies between powers of two microseconds,
+	// empty ones are left out.
+	Buckets []Bucket `json:"buckets,omitempty"`
+}
+
+// Bucket is a range of the latency histogram.
+type Bucket struct {
+	UpTo  time.Duration `json:"le_ns"`
+	Count uint64        `json:"count"`
+}
+
+// Summary returns the percentiles and a coarse histogram.
+func (h *Histogram) Summary() Latency {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	l := Latency{Count: h.n}
+	if h.n == 0 {
+		return l
+	}
+	l.Min, l.Max = h.min, h.max
+	l.Mean = h.sum / time.Duration(h.n)
+	l.P50, l.P90, l.P99, l.P999 = h.quantile(0.5), h.quantile(0.9), h.quantile(0.99), h.quantile(0.999)
+
+	upTo := time.Microsecond
+	var b Bucket
+	for i, c := range h.counts {
+		if c == 0 {
+			continue
+		}
+		low, _ := bucketRange(i)
+		for time.Duration(low) >= upTo {
+			if b.Count > 0 {
+				l.Buckets = append(l.Buckets, b)
+			}
+			b = Bucket{}
+			upTo *= 2
+		}
+		b.UpTo = upTo
+		b.Count += c
+	}
+	if b.Count > 0 {
+		l.Buckets = append(l.Buckets, b)
+	}
+	return l
+}
+
+// Metrics returns l as results summary metrics in milliseconds, named
+// prefix_p50_ms and so on.
+func (l Latency) Metrics(prefix string) map[string]float64 {
+	if l.Count == 0 {
+		return nil
+	}
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	return map[string]float64{
+		prefix + "_min_ms":  ms(l.Min),
+		prefix + "_mean_ms": ms(l.Mean),
+		prefix + "_p50_ms":  ms(l.P50),
+		prefix + "_p90_ms":  ms(l.P90),
+		prefix + "_p99_ms":  ms(l.P99),
+		prefix + "_max_ms":  ms(l.Max),
+	}
+}
+
+// Write prints the percentiles, and the histogram when buckets is set.
+func (l Latency) Write(w io.Writer, buckets bool) {
+	if l.Count == 0 {
+		fmt.Fprintln(w, "Latency:   no samples")
+		return
+	}
+	fmt.Fprintf(w, "Latency:   min %v, mean %v, p50 %v, p90 %v, p99 %v, p99.9 %v, max %v\n",
+		round(l.Min), round(l.Mean), round(l.P50), round(l.P90), round(l.P99), round(l.P999), round(l.Max))
+	if !buckets {
+		return
+	}
+	var most uint64
+	for _, b := range l.Buckets {
+		most = max(most, b.Count)
+	}
+	for _, b := range l.Buckets {
+		bar := strings.Repeat("#", int((b.Count*40+most-1)/most))
+		fmt.Fprintf(w, "  <= %-10v %10d  %s\n", b.UpTo, b.Count, bar)
+	}
+}
+
+// round keeps three significant figures or so.
+func round(d time.Duration) time.Duration {
+	switch {
+	case d >= time.Second:
+		return d.Round(time.Millisecond)
+	case d >= time.Millisecond:
+		return d.Round(time.Microsecond)
+	}
+	return d.Round(time.Microsecond / 10)
+}
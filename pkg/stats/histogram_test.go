@@ -0,0 +1,146 @@
+package stats
+
+import (
+	"testing"
+	"time"
+)
+
+// uniform returns n latencies spread evenly from step to n*step.
+func uniform(n int, step time.Duration) []time.Duration {
+	values := make([]time.Duration, n)
+	for i := range values {
+		values[i] = time.Duration(i+1) * step
+	}
+	return values
+}
+
+func record(values []time.Duration) *Histogram {
+	h := &Histogram{}
+	for _, v := range values {
+		h.Record(v)
+	}
+	return h
+}
+
+// within reports whether got is within the histogram's precision of
+// want.
+func within(got, want time.Duration) bool {
+	diff := got - want
+	if diff < 0 {
+		diff = -diff
+	}
+	return float64(diff) <= float64(want)/subBuckets+1
+}
+
+func TestHistogramQuantile(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []time.Duration
+		q      float64
+		want   time.Duration
+	}{
+		{"empty", nil, 0.5, 0},
+		{"single", []time.Duration{3 * time.Millisecond}, 0.99, 3 * time.Millisecond},
+		{"min", uniform(1000, time.Millisecond), 0, time.Millisecond},
+		{"p50", uniform(1000, time.Millisecond), 0.5, 500 * time.Millisecond},
+		{"p90", uniform(1000, time.Millisecond), 0.9, 900 * time.Millisecond},
+		{"p99", uniform(1000, time.Millisecond), 0.99, 990 * time.Millisecond},
+		{"max", uniform(1000, time.Millisecond), 1, 1000 * time.Millisecond},
+		{"small values exact", uniform(50, time.Nanosecond), 0.5, 25},
+		{"negative clamped", []time.Duration{-time.Second}, 0.5, 0},
+		{"outlier", append(uniform(99, time.Microsecond), time.Second), 0.99, 99 * time.Microsecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := record(tt.values)
+			if got := h.Quantile(tt.q); !within(got, tt.want) {
+				t.Errorf("Quantile(%v) = %v, want %v", tt.q, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHistogramSummary(t *testing.T) {
+	tests := []struct {
+		name             string
+		values           []time.Duration
+		count            uint64
+		min, mean, max   time.Duration
+		p50, p999        time.Duration
+		buckets, largest int // number of buckets and index of the fullest
+	}{
+		{name: "empty"},
+		{
+			name: "uniform", values: uniform(1000, time.Millisecond), count: 1000,
+			min: time.Millisecond, mean: 500500 * time.Microsecond, max: time.Second,
+			p50: 500 * time.Millisecond, p999: 999 * time.Millisecond,
+			buckets: 11, largest: 10,
+		},
+		{
+			name: "constant", values: []time.Duration{time.Millisecond, time.Millisecond, time.Millisecond}, count: 3,
+			min: time.Millisecond, mean: time.Millisecond, max: time.Millisecond,
+			p50: time.Millisecond, p999: time.Millisecond,
+			buckets: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := record(tt.values).Summary()
+			if l.Count != tt.count || l.Min != tt.min || l.Mean != tt.mean || l.Max != tt.max {
+				t.Errorf("count %d, min %v, mean %v, max %v; want %d, %v, %v, %v",
+					l.Count, l.Min, l.Mean, l.Max, tt.count, tt.min, tt.mean, tt.max)
+			}
+			if !within(l.P50, tt.p50) || !within(l.P999, tt.p999) {
+				t.Errorf("p50 %v, p99.9 %v; want %v, %v", l.P50, l.P999, tt.p50, tt.p999)
+			}
+			if len(l.Buckets) != tt.buckets {
+				t.Fatalf("%d buckets, want %d: %v", len(l.Buckets), tt.buckets, l.Buckets)
+			}
+			var sum uint64
+			for i, b := range l.Buckets {
+				sum += b.Count
+				if i > 0 && b.UpTo <= l.Buckets[i-1].UpTo {
+					t.Errorf("bucket %d up to %v after %v", i, b.UpTo, l.Buckets[i-1].UpTo)
+				}
+				if b.Count > l.Buckets[tt.largest].Count {
+					t.Errorf("bucket %d fuller than bucket %d", i, tt.largest)
+				}
+			}
+			if sum != tt.count {
+				t.Errorf("buckets hold %d latencies, want %d", sum, tt.count)
+			}
+		})
+	}
+}
+
+func TestHistogramMerge(t *testing.T) {
+	a := record(uniform(500, time.Millisecond))
+	b := record(uniform(500, time.Millisecond))
+	b.Record(2 * time.Second)
+	a.Merge(b)
+	a.Merge(&Histogram{})
+
+	if got := a.Count(); got != 1001 {
+		t.Errorf("Count() = %d, want 1001", got)
+	}
+	l := a.Summary()
+	if l.Min != time.Millisecond || l.Max != 2*time.Second {
+		t.Errorf("min %v, max %v; want 1ms, 2s", l.Min, l.Max)
+	}
+	if !within(l.P50, 250*time.Millisecond) {
+		t.Errorf("p50 %v, want 250ms", l.P50)
+	}
+}
+
+func TestBucketRange(t *testing.T) {
+	for _, v := range []uint64{0, 1, 63, 64, 65, 127, 128, 1000, 1 << 20, 123456789, 1<<62 + 12345} {
+		i := bucketOf(v)
+		low, high := bucketRange(i)
+		if v < low || v >= high {
+			t.Errorf("%d in bucket %d holding [%d, %d)", v, i, low, high)
+		}
+		if v >= subBuckets && float64(high-low)/float64(low) > 1.0/subBuckets {
+			t.Errorf("bucket %d of %d is [%d, %d), wider than the precision", i, v, low, high)
+		}
+	}
+}
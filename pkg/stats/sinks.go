@@ -0,0 +1,166 @@
+package stats
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TextSink writes the udp tools' human readable lines. Direction is
+// "Incoming" or "Outgoing", Verb "received" or "sent". NoPackets leaves
+// the packets out, for byte streams, and Unit names what they count
+// instead of packets, like "Requests".
+type TextSink struct {
+	W         io.Writer
+	Direction string
+	Verb      string
+	NoPackets bool
+	Unit      string
+}
+
+func (t *TextSink) Report(s Sample) error {
+	if t.NoPackets {
+		_, err := fmt.Fprintf(t.W, "%s bitrate: %.2f Mbps | Total %s: %.2f MB\n",
+			t.Direction, s.Mbps, t.Verb, float64(s.TotalBytes)/1_000_000)
+		return err
+	}
+	if t.Unit != "" {
+		_, err := fmt.Fprintf(t.W, "%s bitrate: %.2f Mbps | %s: %d (%.2f/s avg) | Total %s: %.2f MB\n",
+			t.Direction, s.Mbps, t.Unit, s.Packets, s.AvgPPS, t.Verb, float64(s.TotalBytes)/1_000_000)
+		return err
+	}
+	_, err := fmt.Fprintf(t.W, "%s bitrate: %.2f Mbps | Packets: %d (%.2f pps avg) | Total %s: %.2f MB\n",
+		t.Direction, s.Mbps, s.Packets, s.AvgPPS, t.Verb, float64(s.TotalBytes)/1_000_000)
+	return err
+}
+
+func (t *TextSink) Summary(s Summary) error {
+	if t.NoPackets {
+		_, err := fmt.Fprintf(t.W, "\nTotal bytes: %.2f MB | Avg bitrate: %.2f Mbps | Duration: %.2f sec\n",
+			float64(s.Bytes)/1_000_000, s.Mbps, s.Duration.Seconds())
+		return err
+	}
+	if t.Unit != "" {
+		_, err := fmt.Fprintf(t.W, "\nTotal %s: %d | Total bytes: %.2f MB | Avg bitrate: %.2f Mbps | Duration: %.2f sec\n",
+			strings.ToLower(t.Unit), s.Packets, float64(s.Bytes)/1_000_000, s.Mbps, s.Duration.Seconds())
+		return err
+	}
+	_, err := fmt.Fprintf(t.W, "\nTotal packets: %d | Total bytes: %.2f MB | Avg bitrate: %.2f Mbps | Duration: %.2f sec\n",
+		s.Packets, float64(s.Bytes)/1_000_000, s.Mbps, s.Duration.Seconds())
+	return err
+}
+
+// JSONSink writes a JSON object per line, the samples and then the summary
+// under "summary".
+type JSONSink struct {
+	enc *json.Encoder
+}
+
+func NewJSONSink(w io.Writer) *JSONSink {
+	return &JSONSink{enc: json.NewEncoder(w)}
+}
+
+func (j *JSONSink) Report(s Sample) error {
+	return j.enc.Encode(s)
+}
+
+func (j *JSONSink) Summary(s Summary) error {
+	return j.enc.Encode(struct {
+		Summary Summary `json:"summary"`
+	}{s})
+}
+
+// CSVSink writes a row per sample after a header, and the summary as a
+// last row of kind "total".
+type CSVSink struct {
+	w      *csv.Writer
+	header bool
+}
+
+func NewCSVSink(w io.Writer) *CSVSink {
+	return &CSVSink{w: csv.NewWriter(w)}
+}
+
+func (c *CSVSink) write(row []string) error {
+	if !c.header {
+		c.header = true
+		c.w.Write([]string{"kind", "time", "elapsed", "packets", "bytes", "total_packets", "total_bytes", "mbps", "avg_pps"})
+	}
+	c.w.Write(row)
+	c.w.Flush()
+	return c.w.Error()
+}
+
+func (c *CSVSink) Report(s Sample) error {
+	return c.write([]string{"interval", s.Time.Format(time.RFC3339Nano), ftoa(s.Elapsed.Seconds()),
+		utoa(s.Packets), utoa(s.Bytes), utoa(s.TotalPackets), utoa(s.TotalBytes), ftoa(s.Mbps), ftoa(s.AvgPPS)})
+}
+
+func (c *CSVSink) Summary(s Summary) error {
+	return c.write([]string{"total", time.Now().Format(time.RFC3339Nano), ftoa(s.Duration.Seconds()),
+		utoa(s.Packets), utoa(s.Bytes), utoa(s.Packets), utoa(s.Bytes), ftoa(s.Mbps), ftoa(s.PPS)})
+}
+
+func utoa(n uint64) string { return strconv.FormatUint(n, 10) }
+
+func ftoa(f float64) string { return strconv.FormatFloat(f, 'f', 3, 64) }
+
+// PrometheusSink serves the latest sample in the Prometheus text format
+// on /metrics, with names starting with Prefix.
+type PrometheusSink struct {
+	prefix string
+
+	mu     sync.Mutex
+	sample Sample
+}
+
+// NewPrometheusSink listens on addr, e.g. ":9100".
+func NewPrometheusSink(addr, prefix string) *PrometheusSink {
+	p := &PrometheusSink{prefix: prefix}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", p.serve)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			slog.Error("Prometheus listener failed", "addr", addr, "err", err)
+		}
+	}()
+	return p
+}
+
+func (p *PrometheusSink) Report(s Sample) error {
+	p.mu.Lock()
+	p.sample = s
+	p.mu.Unlock()
+	return nil
+}
+
+// Summary keeps the last sample; the process is usually about to exit.
+func (p *PrometheusSink) Summary(Summary) error {
+	return nil
+}
+
+func (p *PrometheusSink) serve(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	s := p.sample
+	p.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, m := range []struct {
+		name, kind, help string
+		value            float64
+	}{
+		{"packets_total", "counter", "Packets counted.", float64(s.TotalPackets)},
+		{"bytes_total", "counter", "Bytes counted.", float64(s.TotalBytes)},
+		{"mbps", "gauge", "Megabits per second over the last interval.", s.Mbps},
+		{"pps", "gauge", "Packets per second over the last interval.", float64(s.Packets) / max(s.Interval.Seconds(), 1e-9)},
+	} {
+		name := p.prefix + "_" + m.name
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %g\n", name, m.help, name, m.kind, name, m.value)
+	}
+}
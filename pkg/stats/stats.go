@@ -0,0 +1,175 @@
+// Package stats counts packets and bytes and reports them at an interval
+// to one or more sinks, like the udp tools' per-second bitrate lines.
+package stats
+
+import (
+	"io"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Counters are updated by the data path, from any goroutine.
+type Counters struct {
+	packets atomic.Uint64
+	bytes   atomic.Uint64
+}
+
+// Add counts packets totalling bytes.
+func (c *Counters) Add(packets, bytes uint64) {
+	c.packets.Add(packets)
+	c.bytes.Add(bytes)
+}
+
+// Load returns the totals so far.
+func (c *Counters) Load() (packets, bytes uint64) {
+	return c.packets.Load(), c.bytes.Load()
+}
+
+// Sample is one interval report.
+type Sample struct {
+	Time         time.Time     `json:"time"`
+	Elapsed      time.Duration `json:"elapsed_ns"`
+	Interval     time.Duration `json:"interval_ns"`
+	Packets      uint64        `json:"packets"`
+	Bytes        uint64        `json:"bytes"`
+	TotalPackets uint64        `json:"total_packets"`
+	TotalBytes   uint64        `json:"total_bytes"`
+	Mbps         float64       `json:"mbps"`    // over the interval
+	AvgPPS       float64       `json:"avg_pps"` // since the start
+}
+
+// Summary is reported once when the Reporter stops.
+type Summary struct {
+	Packets  uint64        `json:"packets"`
+	Bytes    uint64        `json:"bytes"`
+	Duration time.Duration `json:"duration_ns"`
+	Mbps     float64       `json:"mbps"`
+	PPS      float64       `json:"pps"`
+}
+
+// Sink receives the reports.
+type Sink interface {
+	Report(Sample) error
+	Summary(Summary) error
+}
+
+// Reporter samples Counters at an interval and hands the samples to its
+// sinks.
+type Reporter struct {
+	counters *Counters
+	interval time.Duration
+	sinks    []Sink
+	start    time.Time
+	stop     chan struct{}
+	done     chan struct{}
+	once     sync.Once
+
+	// out is the file the sinks write to, closed once the summary is
+	// written.
+	out io.Closer
+}
+
+// NewReporter reports c every interval to sinks once started; an interval
+// of 0 only reports the summary.
+func NewReporter(c *Counters, interval time.Duration, sinks ...Sink) *Reporter {
+	return &Reporter{counters: c, interval: interval, sinks: sinks, stop: make(chan struct{}), done: make(chan struct{})}
+}
+
+// Start begins the interval reports; the elapsed time counts from here.
+func (r *Reporter) Start() {
+	r.start = time.Now()
+	go r.run()
+}
+
+func (r *Reporter) run() {
+	defer close(r.done)
+	if r.interval <= 0 {
+		<-r.stop
+		return
+	}
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	var lastPackets, lastBytes uint64
+	last := r.start
+	for {
+		select {
+		case now := <-ticker.C:
+			packets, bytes := r.counters.Load()
+			s := newSample(r.start, last, now, lastPackets, lastBytes, packets, bytes)
+			lastPackets, lastBytes, last = packets, bytes, now
+			r.each(func(sink Sink) error { return sink.Report(s) })
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// Stop ends the interval reports and reports and returns the summary.
+func (r *Reporter) Stop() Summary {
+	r.once.Do(func() { close(r.stop) })
+	<-r.done
+
+	packets, bytes := r.counters.Load()
+	s := newSummary(packets, bytes, time.Since(r.start))
+	r.each(func(sink Sink) error { return sink.Summary(s) })
+	if r.out != nil {
+		if err := syncClose(r.out); err != nil {
+			slog.Warn("Failed to write stats", "err", err)
+		}
+		r.out = nil
+	}
+	return s
+}
+
+// syncClose flushes c to disk if it is a file and closes it.
+func syncClose(c io.Closer) error {
+	if f, ok := c.(interface{ Sync() error }); ok {
+		if err := f.Sync(); err != nil {
+			c.Close()
+			return err
+		}
+	}
+	return c.Close()
+}
+
+// newSample is the report at now of the interval since last, the
+// counters having been at lastPackets and lastBytes then.
+func newSample(start, last, now time.Time, lastPackets, lastBytes, packets, bytes uint64) Sample {
+	s := Sample{
+		Time:         now,
+		Elapsed:      now.Sub(start),
+		Interval:     now.Sub(last),
+		Packets:      packets - lastPackets,
+		Bytes:        bytes - lastBytes,
+		TotalPackets: packets,
+		TotalBytes:   bytes,
+	}
+	if secs := s.Interval.Seconds(); secs > 0 {
+		s.Mbps = float64(s.Bytes) * 8 / secs / 1_000_000
+	}
+	if secs := s.Elapsed.Seconds(); secs > 0 {
+		s.AvgPPS = float64(packets) / secs
+	}
+	return s
+}
+
+// newSummary is the summary of packets and bytes over d.
+func newSummary(packets, bytes uint64, d time.Duration) Summary {
+	s := Summary{Packets: packets, Bytes: bytes, Duration: d}
+	if secs := d.Seconds(); secs > 0 {
+		s.Mbps = float64(bytes) * 8 / secs / 1_000_000
+		s.PPS = float64(packets) / secs
+	}
+	return s
+}
+
+func (r *Reporter) each(f func(Sink) error) {
+	for _, sink := range r.sinks {
+		if err := f(sink); err != nil {
+			slog.Warn("Failed to write stats", "err", err)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package stats
+
+import (
+	"flag"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNewSample(t *testing.T) {
+	start := time.Unix(1000, 0)
+	tests := []struct {
+		name                      string
+		last, now                 time.Duration // after start
+		lastPackets, lastBytes    uint64
+		packets, bytes            uint64
+		wantPackets, wantBytes    uint64
+		wantInterval, wantElapsed time.Duration
+		wantMbps, wantAvgPPS      float64
+	}{
+		{
+			name: "first interval", last: 0, now: time.Second,
+			packets: 1000, bytes: 1_250_000,
+			wantPackets: 1000, wantBytes: 1_250_000,
+			wantInterval: time.Second, wantElapsed: time.Second,
+			wantMbps: 10, wantAvgPPS: 1000,
+		},
+		{
+			name: "later interval", last: 2 * time.Second, now: 3 * time.Second,
+			lastPackets: 2000, lastBytes: 2_000_000, packets: 2500, bytes: 2_125_000,
+			wantPackets: 500, wantBytes: 125_000,
+			wantInterval: time.Second, wantElapsed: 3 * time.Second,
+			wantMbps: 1, wantAvgPPS: 2500.0 / 3,
+		},
+		{
+			name: "late tick", last: time.Second, now: 1500 * time.Millisecond,
+			lastPackets: 100, lastBytes: 100_000, packets: 150, bytes: 162_500,
+			wantPackets: 50, wantBytes: 62_500,
+			wantInterval: 500 * time.Millisecond, wantElapsed: 1500 * time.Millisecond,
+			wantMbps: 1, wantAvgPPS: 100,
+		},
+		{
+			name: "idle", last: time.Second, now: 2 * time.Second,
+			lastPackets: 10, lastBytes: 1000, packets: 10, bytes: 1000,
+			wantInterval: time.Second, wantElapsed: 2 * time.Second,
+			wantAvgPPS: 5,
+		},
+		{name: "no time passed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSample(start, start.Add(tt.last), start.Add(tt.now), tt.lastPackets, tt.lastBytes, tt.packets, tt.bytes)
+			if s.Packets != tt.wantPackets || s.Bytes != tt.wantBytes || s.TotalPackets != tt.packets || s.TotalBytes != tt.bytes {
+				t.Errorf("packets %d, bytes %d, totals %d, %d; want %d, %d, %d, %d",
+					s.Packets, s.Bytes, s.TotalPackets, s.TotalBytes, tt.wantPackets, tt.wantBytes, tt.packets, tt.bytes)
+			}
+			if s.Interval != tt.wantInterval || s.Elapsed != tt.wantElapsed {
+				t.Errorf("interval %v, elapsed %v; want %v, %v", s.Interval, s.Elapsed, tt.wantInterval, tt.wantElapsed)
+			}
+			if !near(s.Mbps, tt.wantMbps) || !near(s.AvgPPS, tt.wantAvgPPS) {
+				t.Errorf("mbps %v, avg pps %v; want %v, %v", s.Mbps, s.AvgPPS, tt.wantMbps, tt.wantAvgPPS)
+			}
+		})
+	}
+}
+
+func TestNewSummary(t *testing.T) {
+	tests := []struct {
+		name           string
+		packets, bytes uint64
+		d              time.Duration
+		mbps, pps      float64
+	}{
+		{"one second", 1000, 1_250_000, time.Second, 10, 1000},
+		{"ten seconds", 50_000, 62_500_000, 10 * time.Second, 50, 5000},
+		{"half a second", 10, 12_500, 500 * time.Millisecond, 0.2, 20},
+		{"no time", 10, 1000, 0, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSummary(tt.packets, tt.bytes, tt.d)
+			if s.Packets != tt.packets || s.Bytes != tt.bytes || s.Duration != tt.d || !near(s.Mbps, tt.mbps) || !near(s.PPS, tt.pps) {
+				t.Errorf("got %+v, want mbps %v, pps %v", s, tt.mbps, tt.pps)
+			}
+		})
+	}
+}
+
+// recordingSink keeps what it was given.
+type recordingSink struct {
+	mu      sync.Mutex
+	samples []Sample
+	summary *Summary
+}
+
+func (r *recordingSink) Report(s Sample) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.samples = append(r.samples, s)
+	return nil
+}
+
+func (r *recordingSink) Summary(s Summary) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.summary = &s
+	return nil
+}
+
+func TestReporter(t *testing.T) {
+	c := &Counters{}
+	sink := &recordingSink{}
+	r := NewReporter(c, 10*time.Millisecond, sink)
+	r.Start()
+	for range 5 {
+		c.Add(10, 1000)
+		time.Sleep(15 * time.Millisecond)
+	}
+	sum := r.Stop()
+	r.Stop() // twice is fine
+
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if sum.Packets != 50 || sum.Bytes != 5000 {
+		t.Errorf("summary %+v, want 50 packets, 5000 bytes", sum)
+	}
+	if sink.summary == nil || sink.summary.Packets != 50 {
+		t.Errorf("sink summary %+v", sink.summary)
+	}
+	if len(sink.samples) == 0 {
+		t.Fatal("no samples")
+	}
+	var packets, bytes uint64
+	for i, s := range sink.samples {
+		packets += s.Packets
+		bytes += s.Bytes
+		if s.TotalPackets != packets || s.TotalBytes != bytes {
+			t.Errorf("sample %d totals %d, %d; the intervals add up to %d, %d", i, s.TotalPackets, s.TotalBytes, packets, bytes)
+		}
+		if s.Interval <= 0 || s.Elapsed < s.Interval {
+			t.Errorf("sample %d interval %v, elapsed %v", i, s.Interval, s.Elapsed)
+		}
+	}
+}
+
+func TestReporterNoInterval(t *testing.T) {
+	c := &Counters{}
+	sink := &recordingSink{}
+	r := NewReporter(c, 0, sink)
+	r.Start()
+	c.Add(3, 300)
+	time.Sleep(5 * time.Millisecond)
+	r.Stop()
+	if len(sink.samples) != 0 || sink.summary == nil || sink.summary.Packets != 3 {
+		t.Errorf("samples %v, summary %+v; want only the summary", sink.samples, sink.summary)
+	}
+}
+
+func TestReportFlag(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"", time.Second, false},
+		{"2", 2 * time.Second, false},
+		{"0.5", 500 * time.Millisecond, false},
+		{"250ms", 250 * time.Millisecond, false},
+		{"0", 0, false},
+		{"soon", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			fs.SetOutput(nopWriter{})
+			o := RegisterFlags(fs)
+			var args []string
+			if tt.value != "" {
+				args = []string{"-report", tt.value}
+			}
+			err := fs.Parse(args)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && o.Interval != tt.want {
+				t.Errorf("interval %v, want %v", o.Interval, tt.want)
+			}
+		})
+	}
+}
+
+func TestReporterClosesStatsOut(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stats.csv")
+	o := &Options{Format: "csv", Out: path}
+	c := &Counters{}
+	r, err := o.Reporter(c, "Outgoing", "sent", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Start()
+	c.Add(2, 200)
+	r.Stop()
+	r.Stop() // a second Stop must not touch the closed file
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "\ntotal,") {
+		t.Errorf("-stats-out holds %q, want the summary row", data)
+	}
+	if r.out != nil {
+		t.Error("Stop left the -stats-out file open")
+	}
+}
+
+func TestReporterInvalidFormat(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stats.out")
+	o := &Options{Format: "xml", Out: path}
+	if _, err := o.Reporter(&Counters{}, "Outgoing", "sent", "test"); err == nil {
+		t.Fatal("Reporter accepted -stats-format xml")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("an invalid format still created -stats-out: %v", err)
+	}
+}
+
+type nopWriter struct{}
+
+func (nopWriter) Write(p []byte) (int, error) { return len(p), nil }
+
+func near(a, b float64) bool {
+	return math.Abs(a-b) <= 1e-9*math.Max(1, math.Abs(b))
+}
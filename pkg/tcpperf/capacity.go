@@ -0,0 +1,443 @@
+package tcpperf
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Defaults of capacity tests.
+const (
+	DefaultProbeSize = 1472 // a full 1500 byte IPv4 packet
+	DefaultPairs     = 500
+	DefaultTrains    = 50
+	DefaultTrainLen  = 32
+	DefaultGap       = 10 * time.Millisecond
+)
+
+// Limits on what a client can ask of a capacity test.
+const (
+	minProbeSize = 16
+	maxProbeSize = 65507
+	maxPairs     = 100000
+	maxTrains    = 10000
+	maxTrainLen  = 1000
+)
+
+// Probe kinds, the byte after the test in every probe packet.
+const (
+	probePair  = 0
+	probeTrain = 1
+)
+
+// capacityReady is the server's answer to a capacity header: the UDP port
+// to send the probes to.
+type capacityReady struct {
+	Port  int    `json:"port"`
+	Error string `json:"error,omitempty"`
+}
+
+// arrival is what the server saw of one pair or train: the packets that
+// came, whether in order, and then the time between the first and the
+// last.
+type arrival struct {
+	N     int           `json:"n"`
+	Order bool          `json:"order,omitempty"`
+	D     time.Duration `json:"d,omitempty"`
+
+	first, last time.Time
+	next        int
+}
+
+// capacityDone is the server's answer once the client is done sending.
+type capacityDone struct {
+	Pairs  []arrival `json:"pairs"`
+	Trains []arrival `json:"trains"`
+}
+
+// CapacityConfig is a capacity estimate for Client.Capacity. Pairs and
+// trains are sent back to back, an idle time apart averaging Gap after
+// each pair and TrainLen/2 times that after each train, so the path only
+// sees a trickle.
+type CapacityConfig struct {
+	Server   string        // host:port of gonet tcp server
+	Size     int           // UDP payload bytes of each probe, default DefaultProbeSize
+	Pairs    int           // default DefaultPairs
+	Trains   int           // default DefaultTrains, -1 for none
+	TrainLen int           // packets per train, default DefaultTrainLen
+	Gap      time.Duration // default DefaultGap
+}
+
+// Mode is a capacity many pairs agree on.
+type Mode struct {
+	Mbps  float64 `json:"mbps"`
+	Count int     `json:"count"`
+}
+
+// CapacityResult is a finished capacity estimate. Rates are of IP
+// packets, headers included.
+type CapacityResult struct {
+	Test       string        `json:"test"`
+	Size       int           `json:"size"`
+	PairsSent  int           `json:"pairs_sent"`
+	Pairs      int           `json:"pairs"`      // that came whole and in order
+	Compressed int           `json:"compressed"` // pairs that came at the same time, too fast to tell
+	TrainsSent int           `json:"trains_sent"`
+	Trains     int           `json:"trains"`
+	Lost       uint64        `json:"lost"` // probe packets
+	Modes      []Mode        `json:"modes"`
+	ADR        float64       `json:"adr_mbps"` // asymptotic dispersion rate of the trains
+	Mbps       float64       `json:"mbps"`     // the capacity
+	Elapsed    time.Duration `json:"elapsed_ns"`
+}
+
+// Capacity estimates the bottleneck capacity from the client to the
+// server with packet pairs and trains, pathrate style: the bottleneck
+// spreads back to back packets by the time it takes to send one, so each
+// pair's spread gives its capacity. Cross traffic widens or narrows some
+// spreads, so the capacity is the strongest mode of the pair estimates
+// that isn't below the dispersion rate of the longer trains, which cross
+// traffic slows down.
+func (c *Client) Capacity(ctx context.Context, cfg CapacityConfig) (*CapacityResult, error) {
+	if cfg.Size <= 0 {
+		cfg.Size = DefaultProbeSize
+	}
+	if cfg.Pairs <= 0 {
+		cfg.Pairs = DefaultPairs
+	}
+	switch {
+	case cfg.Trains < 0:
+		cfg.Trains = 0
+	case cfg.Trains == 0:
+		cfg.Trains = DefaultTrains
+	}
+	if cfg.TrainLen <= 0 {
+		cfg.TrainLen = DefaultTrainLen
+	}
+	if cfg.Gap <= 0 {
+		cfg.Gap = DefaultGap
+	}
+	if cfg.Size < minProbeSize || cfg.Size > maxProbeSize {
+		return nil, fmt.Errorf("invalid probe size %d, want %d to %d", cfg.Size, minProbeSize, maxProbeSize)
+	}
+	h := header{
+		Test:     fmt.Sprintf("%08x", rand.Uint32()),
+		Capacity: true,
+		Len:      cfg.Size,
+		Pairs:    cfg.Pairs,
+		Trains:   cfg.Trains,
+		TrainLen: cfg.TrainLen,
+		// The longest the probing can take, the gaps being at most one
+		// and a half times their mean; the server waits no longer.
+		Duration: (time.Duration(cfg.Pairs)*cfg.Gap + time.Duration(cfg.Trains)*cfg.Gap*time.Duration(cfg.TrainLen)/2) * 3 / 2,
+	}
+	if h.Duration > maxDuration {
+		return nil, fmt.Errorf("the probes would take %v, more than %v", h.Duration.Round(time.Second), maxDuration)
+	}
+
+	var d net.Dialer
+	nc, err := d.DialContext(ctx, "tcp", cfg.Server)
+	if err != nil {
+		return nil, err
+	}
+	conn := nc.(*net.TCPConn)
+	defer conn.Close()
+	if err := json.NewEncoder(conn).Encode(h); err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	dec := json.NewDecoder(br)
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	var ready capacityReady
+	if err := dec.Decode(&ready); err != nil {
+		return nil, fmt.Errorf("no answer from the server: %v", err)
+	}
+	if ready.Error != "" {
+		return nil, errors.New(ready.Error)
+	}
+	remote := conn.RemoteAddr().(*net.TCPAddr)
+	uc, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: remote.IP, Port: ready.Port, Zone: remote.Zone})
+	if err != nil {
+		return nil, err
+	}
+	defer uc.Close()
+
+	res := &CapacityResult{Test: h.Test, Size: cfg.Size}
+	buf := make([]byte, cfg.Size)
+	copy(buf, h.Test)
+	// send sends a pair or train back to back.
+	send := func(kind byte, n uint32, packets int) error {
+		buf[8] = kind
+		binary.BigEndian.PutUint32(buf[9:], n)
+		for i := range packets {
+			binary.BigEndian.PutUint16(buf[13:], uint16(i))
+			if _, err := uc.Write(buf); err != nil {
+				return err
+			}
+			c.counters.Add(1, uint64(len(buf)))
+		}
+		return nil
+	}
+	// idle waits about mean, at random so as not to fall in step with
+	// anything periodic on the path.
+	idle := func(mean time.Duration) bool {
+		select {
+		case <-time.After(time.Duration(float64(mean) * (0.5 + rand.Float64()))):
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	start := time.Now()
+	for i := 0; i < cfg.Pairs && ctx.Err() == nil; i++ {
+		if err := send(probePair, uint32(i), 2); err != nil {
+			return nil, err
+		}
+		res.PairsSent++
+		idle(cfg.Gap)
+	}
+	for i := 0; i < cfg.Trains && ctx.Err() == nil; i++ {
+		if err := send(probeTrain, uint32(i), cfg.TrainLen); err != nil {
+			return nil, err
+		}
+		res.TrainsSent++
+		idle(cfg.Gap * time.Duration(cfg.TrainLen) / 2)
+	}
+	res.Elapsed = time.Since(start)
+
+	// The end of the stream tells the server to answer.
+	if err := conn.CloseWrite(); err != nil {
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	var done capacityDone
+	if err := dec.Decode(&done); err != nil {
+		return nil, fmt.Errorf("no result from the server: %v", err)
+	}
+
+	// Bits on the wire of each probe, as IP packets.
+	bits := float64(cfg.Size+8+20) * 8
+	if remote.IP.To4() == nil {
+		bits += 20 * 8
+	}
+	var pairs, trains []float64
+	for i, a := range done.Pairs {
+		if i >= res.PairsSent {
+			break
+		}
+		res.Lost += uint64(2 - min(a.N, 2))
+		switch {
+		case a.N != 2 || !a.Order:
+		case a.D > 0:
+			pairs = append(pairs, bits/a.D.Seconds()/1e6)
+		default:
+			// Both at the same time, too close to tell apart.
+			res.Compressed++
+		}
+	}
+	for i, a := range done.Trains {
+		if i >= res.TrainsSent {
+			break
+		}
+		res.Lost += uint64(cfg.TrainLen - min(a.N, cfg.TrainLen))
+		if a.N == cfg.TrainLen && a.Order && a.D > 0 {
+			trains = append(trains, bits*float64(cfg.TrainLen-1)/a.D.Seconds()/1e6)
+		}
+	}
+	res.Pairs, res.Trains = len(pairs), len(trains)
+	if len(pairs) == 0 {
+		return nil, errors.New("no pair came through whole, in order and spread out")
+	}
+	res.Modes = modes(pairs)
+	if len(trains) > 0 {
+		slices.Sort(trains)
+		res.ADR = trains[len(trains)/2]
+	}
+	// The strongest mode at the ADR or above; the ADR is below the
+	// capacity unless the path is idle, when they're about the same.
+	res.Mbps = res.Modes[0].Mbps
+	for _, m := range res.Modes {
+		if m.Mbps >= res.ADR*0.95 {
+			res.Mbps = m.Mbps
+			break
+		}
+	}
+	return res, nil
+}
+
+// modes finds the values most estimates agree on within 5%, strongest
+// first: up to five, each with 5% of the estimates at least.
+func modes(est []float64) []Mode {
+	est = slices.Clone(est)
+	slices.Sort(est)
+	claimed := make([]bool, len(est))
+	var out []Mode
+	for len(out) < 5 {
+		best, bestLo, bestHi := -1, 0, 0
+		for i, e := range est {
+			if claimed[i] {
+				continue
+			}
+			lo, _ := slices.BinarySearch(est, e/1.05)
+			hi, _ := slices.BinarySearch(est, e*1.05)
+			n := 0
+			for j := lo; j < hi; j++ {
+				if !claimed[j] {
+					n++
+				}
+			}
+			if best < 0 || n > bestHi-bestLo {
+				best, bestLo, bestHi = i, lo, lo+n
+			}
+		}
+		if best < 0 {
+			break
+		}
+		var in []float64
+		lo, _ := slices.BinarySearch(est, est[best]/1.05)
+		hi, _ := slices.BinarySearch(est, est[best]*1.05)
+		for j := lo; j < hi; j++ {
+			if !claimed[j] {
+				in = append(in, est[j])
+				claimed[j] = true
+			}
+		}
+		if len(out) > 0 && (len(in) < 3 || len(in)*20 < len(est)) {
+			break
+		}
+		out = append(out, Mode{Mbps: in[len(in)/2], Count: len(in)})
+	}
+	return out
+}
+
+// Write prints r for people.
+func (r *CapacityResult) Write(w io.Writer) {
+	fmt.Fprintf(w, "Capacity test %s, client to server, %d byte probes:\n", r.Test, r.Size)
+	fmt.Fprintf(w, "  pairs    %6d of %d usable, %d compressed\n", r.Pairs, r.PairsSent, r.Compressed)
+	fmt.Fprintf(w, "  trains   %6d of %d usable, %d packets lost\n", r.Trains, r.TrainsSent, r.Lost)
+	parts := make([]string, len(r.Modes))
+	for i, m := range r.Modes {
+		parts[i] = fmt.Sprintf("%.2f Mbps (%d)", m.Mbps, m.Count)
+	}
+	fmt.Fprintf(w, "  modes    %s\n", strings.Join(parts, ", "))
+	if r.Trains > 0 {
+		fmt.Fprintf(w, "  ADR      %.2f Mbps\n", r.ADR)
+	}
+	fmt.Fprintf(w, "  capacity %.2f Mbps in %v\n", r.Mbps, r.Elapsed.Round(time.Millisecond))
+}
+
+// capacity answers a capacity test: it takes the probes on a UDP port of
+// its own until the client ends the stream, then tells the client how
+// they came.
+func (s *Server) capacity(ctx context.Context, conn *net.TCPConn, br *bufio.Reader, h header) error {
+	enc := json.NewEncoder(conn)
+	if h.Test == "" || h.Len < minProbeSize || h.Len > maxProbeSize || h.Pairs < 0 || h.Pairs > maxPairs ||
+		h.Trains < 0 || h.Trains > maxTrains || (h.Trains > 0 && (h.TrainLen < 2 || h.TrainLen > maxTrainLen)) ||
+		h.Duration < 0 || h.Duration > maxDuration {
+		enc.Encode(capacityReady{Error: "invalid test parameters"})
+		return fmt.Errorf("invalid capacity test parameters %+v", h)
+	}
+	local := conn.LocalAddr().(*net.TCPAddr)
+	uc, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP, Zone: local.Zone})
+	if err != nil {
+		enc.Encode(capacityReady{Error: "no UDP port for the probes"})
+		return err
+	}
+	defer uc.Close()
+	uc.SetReadBuffer(4 << 20)
+	if err := enableStamps(uc); err != nil {
+		return err
+	}
+	// A client has as long as it said the probing takes, or the longest
+	// test when it didn't say, to end the stream; one that goes quiet
+	// doesn't hold the socket and the arrivals any longer.
+	wait := maxDuration
+	if h.Duration > 0 {
+		wait = h.Duration
+	}
+	conn.SetReadDeadline(time.Now().Add(wait + 10*time.Second))
+	if err := enc.Encode(capacityReady{Port: uc.LocalAddr().(*net.UDPAddr).Port}); err != nil {
+		return err
+	}
+	slog.Info("Capacity test started", "test", h.Test, "client", conn.RemoteAddr().(*net.TCPAddr).IP, "pairs", h.Pairs, "trains", h.Trains, "train_len", h.TrainLen)
+
+	done := capacityDone{Pairs: make([]arrival, h.Pairs), Trains: make([]arrival, h.Trains)}
+	read := make(chan struct{})
+	go func() {
+		defer close(read)
+		buf := make([]byte, h.Len+1)
+		oob := make([]byte, stampOOB)
+		for {
+			n, oobn, _, _, err := uc.ReadMsgUDP(buf, oob)
+			if err != nil {
+				if errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, net.ErrClosed) {
+					return
+				}
+				continue
+			}
+			at := stamp(oob[:oobn])
+			if n != h.Len || string(buf[:8]) != h.Test {
+				continue
+			}
+			s.counters.Add(1, uint64(n))
+			i, idx := int(binary.BigEndian.Uint32(buf[9:])), int(binary.BigEndian.Uint16(buf[13:]))
+			var a *arrival
+			switch {
+			case buf[8] == probePair && i < len(done.Pairs):
+				a = &done.Pairs[i]
+			case buf[8] == probeTrain && i < len(done.Trains):
+				a = &done.Trains[i]
+			default:
+				continue
+			}
+			if a.N == 0 {
+				a.first, a.Order = at, true
+			}
+			a.Order = a.Order && idx == a.next
+			a.N++
+			a.next = idx + 1
+			a.last = at
+		}
+	}()
+
+	// The client ends the stream once it has sent everything; the last
+	// probes may still be on their way.
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	_, err = io.Copy(io.Discard, br)
+	if ctx.Err() != nil {
+		return nil
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return fmt.Errorf("capacity test %s not ended within %v", h.Test, wait)
+	}
+	uc.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	<-read
+	uc.Close()
+
+	var got uint64
+	for _, list := range [][]arrival{done.Pairs, done.Trains} {
+		for i := range list {
+			a := &list[i]
+			got += uint64(a.N)
+			if a.Order {
+				a.D = a.last.Sub(a.first)
+			}
+		}
+	}
+	slog.Info("Capacity test done", "test", h.Test, "received", got, "sent", 2*h.Pairs+h.Trains*h.TrainLen)
+	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	return enc.Encode(done)
+}
@@ -0,0 +1,42 @@
+package tcpperf
+
+import (
+	"net"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// stampOOB is room for a SCM_TIMESTAMPNS control message.
+const stampOOB = 64
+
+// enableStamps has the kernel stamp every datagram conn receives, so that
+// packet gaps aren't blurred by the scheduler.
+func enableStamps(conn *net.UDPConn) error {
+	c, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	if err := c.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_TIMESTAMPNS, 1)
+	}); err != nil {
+		return err
+	}
+	return serr
+}
+
+// stamp returns the receive time in the control messages of a read, now
+// when there's none.
+func stamp(oob []byte) time.Time {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err == nil {
+		for _, m := range msgs {
+			if m.Header.Level == syscall.SOL_SOCKET && m.Header.Type == syscall.SCM_TIMESTAMPNS && len(m.Data) >= int(unsafe.Sizeof(syscall.Timespec{})) {
+				ts := (*syscall.Timespec)(unsafe.Pointer(&m.Data[0]))
+				return time.Unix(ts.Unix())
+			}
+		}
+	}
+	return time.Now()
+}
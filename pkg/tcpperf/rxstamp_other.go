@@ -0,0 +1,21 @@
+//go:build !linux
+
+package tcpperf
+
+import (
+	"net"
+	"time"
+)
+
+// stampOOB is room for control messages, which only Linux stamps get.
+const stampOOB = 0
+
+// enableStamps does nothing: the receive times are taken after each read.
+func enableStamps(conn *net.UDPConn) error {
+	return nil
+}
+
+// stamp returns now.
+func stamp(oob []byte) time.Time {
+	return time.Now()
+}
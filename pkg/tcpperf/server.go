@@ -0,0 +1,154 @@
+package tcpperf
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"gonet/pkg/stats"
+)
+
+// Limits on what a client can ask for.
+const (
+	maxStreams  = 128
+	maxLen      = 16 << 20
+	maxDuration = time.Hour
+)
+
+// Server answers the streams of Clients, any number of tests at a time.
+type Server struct {
+	// Window sets the socket buffers of tests that don't ask for a
+	// window, 0 leaves the system's.
+	Window int
+
+	// Reports, if set, gets each test once all its streams have ended,
+	// with what the server received, or sent in reverse mode.
+	Reports func(*Result)
+
+	counters stats.Counters
+
+	mu    sync.Mutex
+	tests map[string]*Result
+}
+
+// Counters counts the bytes the server receives and sends, for interval
+// reports.
+func (s *Server) Counters() *stats.Counters {
+	return &s.counters
+}
+
+// Serve answers the streams accepted on ln until ctx is done.
+func (s *Server) Serve(ctx context.Context, ln net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	for {
+		nc, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		conn, ok := nc.(*net.TCPConn)
+		if !ok {
+			nc.Close()
+			continue
+		}
+		go func() {
+			defer conn.Close()
+			if err := s.handle(ctx, conn); err != nil {
+				slog.Warn("Stream failed", "client", conn.RemoteAddr(), "err", err)
+			}
+		}()
+	}
+}
+
+func (s *Server) handle(ctx context.Context, conn *net.TCPConn) error {
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	br := bufio.NewReaderSize(conn, DefaultLen)
+	conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	line, err := br.ReadBytes('\n')
+	if err != nil {
+		return err
+	}
+	var h header
+	if err := json.Unmarshal(line, &h); err != nil {
+		return fmt.Errorf("invalid header: %v", err)
+	}
+	if h.Capacity {
+		return s.capacity(ctx, conn, br, h)
+	}
+	if h.Test == "" || h.Streams < 1 || h.Streams > maxStreams || h.Stream < 1 || h.Stream > h.Streams ||
+		h.Len < 1 || h.Len > maxLen || h.Duration <= 0 || h.Duration > maxDuration {
+		json.NewEncoder(conn).Encode(streamDone{Error: "invalid test parameters"})
+		return fmt.Errorf("invalid test parameters %+v", h)
+	}
+	conn.SetReadDeadline(time.Time{})
+	window := h.Window
+	if window <= 0 {
+		window = s.Window
+	}
+	if err := tune(conn, window, false); err != nil {
+		return err
+	}
+	if h.Stream == 1 {
+		slog.Info("Test started", "test", h.Test, "client", conn.RemoteAddr().(*net.TCPAddr).IP, "streams", h.Streams, "duration", h.Duration, "reverse", h.Reverse)
+	}
+
+	res := StreamResult{Stream: h.Stream}
+	start := time.Now()
+	if h.Reverse {
+		res.Bytes, err = fill(ctx, conn, h.Len, h.Duration, &s.counters)
+		res.Elapsed = time.Since(start)
+		if err == nil {
+			err = conn.CloseWrite()
+		}
+		s.record(h, res)
+		return err
+	}
+
+	// The client half-closes when done; a drop mid-test is still
+	// reported as far as it got.
+	res.Bytes, err = drain(br, h.Len, &s.counters)
+	res.Elapsed = time.Since(start)
+	s.record(h, res)
+	if err != nil {
+		return err
+	}
+	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	return json.NewEncoder(conn).Encode(streamDone{Bytes: res.Bytes, Elapsed: res.Elapsed})
+}
+
+// record adds a stream to its test and reports the test once complete.
+func (s *Server) record(h header, sr StreamResult) {
+	s.mu.Lock()
+	if s.tests == nil {
+		s.tests = make(map[string]*Result)
+	}
+	r := s.tests[h.Test]
+	if r == nil {
+		r = &Result{Test: h.Test, Reverse: h.Reverse}
+		s.tests[h.Test] = r
+	}
+	r.add(sr)
+	complete := len(r.Streams) >= h.Streams
+	if complete {
+		delete(s.tests, h.Test)
+	}
+	s.mu.Unlock()
+
+	if complete && s.Reports != nil {
+		slices.SortFunc(r.Streams, func(a, b StreamResult) int { return a.Stream - b.Stream })
+		s.Reports(r)
+	}
+}
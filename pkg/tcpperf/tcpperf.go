@@ -0,0 +1,327 @@
+// Package tcpperf measures TCP throughput between gonet tcp client and
+// gonet tcp server, like iperf: the client opens parallel streams, each
+// starting with a JSON header line describing the test, then sends for the
+// test's duration (or receives, in reverse mode). In forward mode the
+// client half-closes each stream when done and the server answers with a
+// JSON line of what it received.
+//
+// Capacity tests estimate the bottleneck capacity instead, with packet
+// pairs and trains: the server answers the header with a UDP port, the
+// client sends the probes to it and ends the stream, and the server
+// answers with how they came.
+package tcpperf
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"gonet/pkg/stats"
+)
+
+// DefaultDuration is the length of a test that doesn't give one.
+const DefaultDuration = 10 * time.Second
+
+// DefaultLen is the size of the reads and writes of a test that doesn't
+// give one.
+const DefaultLen = 128 << 10
+
+// header opens each stream of a test.
+type header struct {
+	Test     string        `json:"test"`
+	Stream   int           `json:"stream"`
+	Streams  int           `json:"streams"`
+	Reverse  bool          `json:"reverse"`
+	Duration time.Duration `json:"duration_ns"`
+	Window   int           `json:"window,omitempty"`
+	Len      int           `json:"len"`
+
+	// Capacity tests send Pairs packet pairs and Trains trains of
+	// TrainLen packets, each Len bytes, over UDP instead.
+	Capacity bool `json:"capacity,omitempty"`
+	Pairs    int  `json:"pairs,omitempty"`
+	Trains   int  `json:"trains,omitempty"`
+	TrainLen int  `json:"train_len,omitempty"`
+}
+
+// streamDone is the server's answer to a forward stream.
+type streamDone struct {
+	Bytes   uint64        `json:"bytes"`
+	Elapsed time.Duration `json:"elapsed_ns"`
+	Error   string        `json:"error,omitempty"`
+}
+
+// Config is a test for Client.Run.
+type Config struct {
+	Server   string        // host:port of gonet tcp server
+	Streams  int           // parallel connections, default 1
+	Duration time.Duration // default 10s
+	Len      int           // bytes per read or write, default DefaultLen
+
+	// Window sets the socket send and receive buffers of both ends,
+	// which bound the TCP window; 0 leaves the system's.
+	Window  int
+	NoDelay bool
+
+	// Reverse has the server send and the client receive.
+	Reverse bool
+}
+
+// StreamResult is what a stream moved, as the receiving end counted it.
+type StreamResult struct {
+	Stream  int           `json:"stream"`
+	Bytes   uint64        `json:"bytes"`
+	Elapsed time.Duration `json:"elapsed_ns"`
+	Mbps    float64       `json:"mbps"`
+}
+
+// Result is a finished test.
+type Result struct {
+	Test    string         `json:"test"`
+	Reverse bool           `json:"reverse"`
+	Streams []StreamResult `json:"streams"`
+	Bytes   uint64         `json:"bytes"`
+	Elapsed time.Duration  `json:"elapsed_ns"` // of the longest stream
+	Mbps    float64        `json:"mbps"`
+}
+
+// add totals the streams.
+func (r *Result) add(s StreamResult) {
+	s.Mbps = mbps(s.Bytes, s.Elapsed)
+	r.Streams = append(r.Streams, s)
+	r.Bytes += s.Bytes
+	r.Elapsed = max(r.Elapsed, s.Elapsed)
+	r.Mbps = mbps(r.Bytes, r.Elapsed)
+}
+
+// Write prints r for people.
+func (r *Result) Write(w io.Writer) {
+	dir := "client to server"
+	if r.Reverse {
+		dir = "server to client"
+	}
+	fmt.Fprintf(w, "Test %s, %s:\n", r.Test, dir)
+	for _, s := range r.Streams {
+		fmt.Fprintf(w, "  stream %-3d %14d bytes in %-12v %10.2f Mbps\n", s.Stream, s.Bytes, s.Elapsed.Round(time.Millisecond), s.Mbps)
+	}
+	fmt.Fprintf(w, "  total      %14d bytes in %-12v %10.2f Mbps\n", r.Bytes, r.Elapsed.Round(time.Millisecond), r.Mbps)
+}
+
+func mbps(bytes uint64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return float64(bytes) * 8 / d.Seconds() / 1e6
+}
+
+// Client runs tests against a Server.
+type Client struct {
+	counters stats.Counters
+}
+
+// Counters counts the bytes the client sends, or receives in reverse
+// mode, for interval reports.
+func (c *Client) Counters() *stats.Counters {
+	return &c.counters
+}
+
+// Run runs the test cfg describes. Cancelling ctx ends it early, the
+// result then covers what was moved so far.
+func (c *Client) Run(ctx context.Context, cfg Config) (*Result, error) {
+	if cfg.Streams <= 0 {
+		cfg.Streams = 1
+	}
+	if cfg.Duration <= 0 {
+		cfg.Duration = DefaultDuration
+	}
+	if cfg.Len <= 0 {
+		cfg.Len = DefaultLen
+	}
+	h := header{
+		Test:     fmt.Sprintf("%08x", rand.Uint32()),
+		Streams:  cfg.Streams,
+		Reverse:  cfg.Reverse,
+		Duration: cfg.Duration,
+		Window:   cfg.Window,
+		Len:      cfg.Len,
+	}
+
+	// Connect every stream before sending on any.
+	conns := make([]*net.TCPConn, cfg.Streams)
+	defer func() {
+		for _, conn := range conns {
+			if conn != nil {
+				conn.Close()
+			}
+		}
+	}()
+	var d net.Dialer
+	for i := range conns {
+		nc, err := d.DialContext(ctx, "tcp", cfg.Server)
+		if err != nil {
+			return nil, err
+		}
+		conns[i] = nc.(*net.TCPConn)
+		if err := tune(conns[i], cfg.Window, cfg.NoDelay); err != nil {
+			return nil, err
+		}
+	}
+
+	res := &Result{Test: h.Test, Reverse: cfg.Reverse}
+	results := make([]StreamResult, cfg.Streams)
+	errs := make([]error, cfg.Streams)
+	var wg sync.WaitGroup
+	for i, conn := range conns {
+		sh := h
+		sh.Stream = i + 1
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], errs[i] = c.stream(ctx, conn, sh)
+		}()
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	for _, s := range results {
+		res.add(s)
+	}
+	return res, nil
+}
+
+// stream runs one connection of a test.
+func (c *Client) stream(ctx context.Context, conn *net.TCPConn, h header) (StreamResult, error) {
+	res := StreamResult{Stream: h.Stream}
+	enc := json.NewEncoder(conn)
+	if err := enc.Encode(h); err != nil {
+		return res, err
+	}
+
+	if h.Reverse {
+		stop := context.AfterFunc(ctx, func() { conn.Close() })
+		defer stop()
+		start := time.Now()
+		n, err := drain(conn, h.Len, &c.counters)
+		res.Bytes, res.Elapsed = n, time.Since(start)
+		if err != nil && ctx.Err() == nil {
+			return res, fmt.Errorf("stream %d: %v", h.Stream, err)
+		}
+		return res, nil
+	}
+
+	stop := context.AfterFunc(ctx, func() { conn.SetWriteDeadline(time.Now()) })
+	_, err := fill(ctx, conn, h.Len, h.Duration, &c.counters)
+	stop()
+	if err != nil && ctx.Err() == nil {
+		return res, fmt.Errorf("stream %d: %v", h.Stream, err)
+	}
+	conn.SetWriteDeadline(time.Time{})
+	if err := conn.CloseWrite(); err != nil {
+		return res, err
+	}
+
+	// The server counts to the end of the stream and answers.
+	conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	var done streamDone
+	if err := json.NewDecoder(bufio.NewReader(conn)).Decode(&done); err != nil {
+		return res, fmt.Errorf("stream %d: no result from the server: %v", h.Stream, err)
+	}
+	if done.Error != "" {
+		return res, fmt.Errorf("stream %d: %s", h.Stream, done.Error)
+	}
+	res.Bytes, res.Elapsed = done.Bytes, done.Elapsed
+	return res, nil
+}
+
+// fill writes to conn for d or until ctx is done, counting into counters.
+func fill(ctx context.Context, conn *net.TCPConn, size int, d time.Duration, counters *stats.Counters) (uint64, error) {
+	buf := make([]byte, size)
+	for i := range buf {
+		buf[i] = byte(i)
+	}
+	end := time.Now().Add(d)
+	conn.SetWriteDeadline(end)
+	var total uint64
+	for ctx.Err() == nil && time.Now().Before(end) {
+		n, err := conn.Write(buf)
+		total += uint64(n)
+		counters.Add(0, uint64(n))
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				break
+			}
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// drain reads r to its end, counting into counters.
+func drain(r io.Reader, size int, counters *stats.Counters) (uint64, error) {
+	buf := make([]byte, size)
+	var total uint64
+	for {
+		n, err := r.Read(buf)
+		total += uint64(n)
+		counters.Add(0, uint64(n))
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+// tune applies the socket options of a test.
+func tune(conn *net.TCPConn, window int, noDelay bool) error {
+	if window > 0 {
+		if err := conn.SetReadBuffer(window); err != nil {
+			return err
+		}
+		if err := conn.SetWriteBuffer(window); err != nil {
+			return err
+		}
+	}
+	return conn.SetNoDelay(noDelay)
+}
+
+// Size is a byte count flag, like 128K or 4M in powers of 1024.
+type Size int
+
+func (s *Size) String() string {
+	return strconv.Itoa(int(*s))
+}
+
+func (s *Size) Set(v string) error {
+	mult := 1
+	if n := len(v); n > 0 {
+		switch v[n-1] {
+		case 'k', 'K':
+			mult = 1 << 10
+		case 'm', 'M':
+			mult = 1 << 20
+		case 'g', 'G':
+			mult = 1 << 30
+		}
+		if mult != 1 {
+			v = v[:n-1]
+		}
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %q, want bytes like 128K or 4M", v)
+	}
+	*s = Size(n * mult)
+	return nil
+}
@@ -0,0 +1,131 @@
+// Package trailer is the telemetry trailer gonet udp send can append to
+// UDP payloads for the devices on the path to stamp, in the manner of
+// In-band Network Telemetry, so gonet udp recv can tell which hop the
+// delay was added at.
+//
+// The trailer ends the payload, where a device finds it from the UDP
+// length without knowing what comes before. It is MaxHops hop slots of
+// HopLen bytes followed by a footer of FooterLen, all big endian:
+//
+//	hop slot:  node ID (4), residence time ns (4), timestamp Unix ns (8)
+//	footer:    magic "GNTT" (4), version (1), slots (1), hops (1),
+//	           flags (1), sent Unix ns (8)
+//
+// A device stamping a packet writes its slot number hops, counting from
+// 0, increments hops, or sets the overflow flag when the slots are full,
+// and fixes or zeroes the UDP checksum; the sender leaves it zero. The
+// trailer keeps its size along the path, so no lengths change.
+package trailer
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// Sizes of the parts of a trailer.
+const (
+	HopLen    = 16
+	FooterLen = 16
+)
+
+// MaxHops is the most hop slots a trailer has.
+const MaxHops = 255
+
+// Magic and Version start the footer.
+const (
+	Magic   = 0x474e5454 // "GNTT"
+	Version = 1
+)
+
+// flagOverflow marks a trailer a device found full.
+const flagOverflow = 0x01
+
+// Len returns the size of a trailer of slots hop slots.
+func Len(slots int) int {
+	return slots*HopLen + FooterLen
+}
+
+// Hop is the stamp of a device.
+type Hop struct {
+	Node      uint32        // identifies the device
+	Residence time.Duration // how long the packet spent in it, 0 unknown
+	At        time.Time     // when it forwarded the packet
+}
+
+// Trailer is a decoded trailer.
+type Trailer struct {
+	Sent     time.Time
+	Slots    int
+	Hops     []Hop
+	Overflow bool // a device found no slot left
+}
+
+// Put writes an empty trailer of slots hop slots, sent at sent, to the
+// end of payload, which must hold Len(slots) bytes.
+func Put(payload []byte, slots int, sent time.Time) {
+	t := payload[len(payload)-Len(slots):]
+	clear(t[:slots*HopLen])
+	f := t[slots*HopLen:]
+	binary.BigEndian.PutUint32(f[0:], Magic)
+	f[4], f[5], f[6], f[7] = Version, byte(slots), 0, 0
+	binary.BigEndian.PutUint64(f[8:], uint64(sent.UnixNano()))
+}
+
+// footer returns the footer at the end of payload and the slots before
+// it, nil if there is no trailer.
+func footer(payload []byte) (f, slots []byte) {
+	if len(payload) < FooterLen {
+		return nil, nil
+	}
+	f = payload[len(payload)-FooterLen:]
+	if binary.BigEndian.Uint32(f[0:]) != Magic || f[4] != Version {
+		return nil, nil
+	}
+	n := int(f[5]) * HopLen
+	if len(payload) < FooterLen+n || f[6] > f[5] {
+		return nil, nil
+	}
+	return f, payload[len(payload)-FooterLen-n : len(payload)-FooterLen]
+}
+
+// Stamp records hop in the trailer ending payload, as a device on the
+// path does, and reports whether there was a trailer. A full trailer
+// gets the overflow flag instead.
+func Stamp(payload []byte, hop Hop) bool {
+	f, slots := footer(payload)
+	if f == nil {
+		return false
+	}
+	if f[6] == f[5] {
+		f[7] |= flagOverflow
+		return true
+	}
+	s := slots[int(f[6])*HopLen:]
+	binary.BigEndian.PutUint32(s[0:], hop.Node)
+	binary.BigEndian.PutUint32(s[4:], uint32(min(max(hop.Residence, 0), 1<<32-1)))
+	binary.BigEndian.PutUint64(s[8:], uint64(hop.At.UnixNano()))
+	f[6]++
+	return true
+}
+
+// Parse reads the trailer at the end of payload.
+func Parse(payload []byte) (Trailer, bool) {
+	f, slots := footer(payload)
+	if f == nil {
+		return Trailer{}, false
+	}
+	t := Trailer{
+		Sent:     time.Unix(0, int64(binary.BigEndian.Uint64(f[8:]))),
+		Slots:    int(f[5]),
+		Overflow: f[7]&flagOverflow != 0,
+	}
+	for i := range int(f[6]) {
+		s := slots[i*HopLen:]
+		t.Hops = append(t.Hops, Hop{
+			Node:      binary.BigEndian.Uint32(s[0:]),
+			Residence: time.Duration(binary.BigEndian.Uint32(s[4:])),
+			At:        time.Unix(0, int64(binary.BigEndian.Uint64(s[8:]))),
+		})
+	}
+	return t, true
+}
@@ -0,0 +1,341 @@
+package stunnat
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NAT behaviors, RFC 4787 terms.
+const (
+	EndpointIndependent  = "endpoint-independent"
+	AddressDependent     = "address-dependent"
+	AddressPortDependent = "address and port-dependent"
+	Unknown              = "unknown"
+)
+
+// Config is a NAT behavior detection for Detect.
+type Config struct {
+	// Servers are STUN servers, host or host:port. The first one that
+	// answers runs the mapping and filtering tests, which need a server
+	// with an alternate address (RFC 5780, or RFC 3489 CHANGED-ADDRESS);
+	// the others tell whether the mapping is the same for every server.
+	Servers []string
+
+	Local  string // address of the local socket, default any with a random port
+	Family string // "4" or "6", default 4
+
+	Timeout time.Duration // of each try, default 500ms
+	Retries int           // tries again after timeouts
+}
+
+// ServerResult is one server's answer to a plain binding request.
+type ServerResult struct {
+	Server string        `json:"server"`
+	Addr   string        `json:"addr,omitempty"`
+	Mapped string        `json:"mapped,omitempty"`
+	Other  string        `json:"other,omitempty"` // alternate address
+	RTT    time.Duration `json:"rtt_ns,omitempty"`
+	Error  string        `json:"error,omitempty"`
+}
+
+// Result is a finished detection.
+type Result struct {
+	Local   string          `json:"local"`
+	Mapped  string          `json:"mapped"` // public address of the socket
+	NAT     bool            `json:"nat"`
+	Servers []*ServerResult `json:"servers"`
+
+	Mapping       string `json:"mapping"`
+	MappingBy     string `json:"mapping_by,omitempty"` // how it was found
+	Filtering     string `json:"filtering"`
+	PortPreserved bool   `json:"port_preserved"`
+	Hairpin       string `json:"hairpin"` // yes, no or unknown
+
+	Type     string        `json:"type"`     // the RFC 3489 name
+	Punching string        `json:"punching"` // how hole punching should go
+	Elapsed  time.Duration `json:"elapsed_ns"`
+}
+
+// Detect finds the public address of a local UDP socket and how the NAT
+// in front of it maps and filters, with the servers cfg gives.
+func Detect(ctx context.Context, cfg Config) (*Result, error) {
+	if len(cfg.Servers) == 0 {
+		return nil, errors.New("no STUN servers")
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 500 * time.Millisecond
+	}
+	conn, err := listen(cfg.Local, cfg.Family)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	c := &client{conn: conn, timeout: cfg.Timeout, retries: cfg.Retries}
+
+	start := time.Now()
+	res := &Result{Mapping: Unknown, Filtering: Unknown, Hairpin: Unknown}
+	local := unmap(conn.LocalAddr().(*net.UDPAddr).AddrPort())
+	res.Local = local.String()
+
+	// Test I with every server.
+	var primary, other netip.AddrPort
+	var mapped []netip.AddrPort
+	var addrs []netip.Addr
+	for _, s := range cfg.Servers {
+		sr := &ServerResult{Server: s}
+		res.Servers = append(res.Servers, sr)
+		addr, err := resolve(ctx, s, cfg.Family)
+		if err != nil {
+			sr.Error = err.Error()
+			continue
+		}
+		sr.Addr = addr.String()
+		r, err := c.bind(ctx, addr, 0)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			sr.Error = err.Error()
+			continue
+		}
+		sr.Mapped, sr.RTT = r.mapped.String(), r.rtt
+		if r.other.IsValid() {
+			sr.Other = r.other.String()
+		}
+		if !primary.IsValid() {
+			primary, other = addr, r.other
+			res.Mapped = r.mapped.String()
+		}
+		mapped = append(mapped, r.mapped)
+		addrs = append(addrs, addr.Addr())
+	}
+	if !primary.IsValid() {
+		return nil, errors.New("no STUN server answered")
+	}
+	first := mapped[0]
+	res.NAT = !isLocal(first, local)
+	res.PortPreserved = first.Port() == local.Port()
+
+	// The tests need an alternate address with another IP and port of
+	// the same family.
+	if other.IsValid() && (other.Addr() == primary.Addr() || other.Port() == primary.Port() || other.Addr().Is4() != primary.Addr().Is4()) {
+		other = netip.AddrPort{}
+	}
+
+	// Filtering: tests II and III, answers asked for from the alternate
+	// address and port, then the alternate port. They go first, before
+	// the mapping tests open the NAT to the alternate address.
+	if other.IsValid() {
+		r, err := c.bind(ctx, primary, changeIP|changePort)
+		switch {
+		case err == nil && r.from.Addr() != primary.Addr():
+			res.Filtering = EndpointIndependent
+		case err == nil:
+			// The server didn't do as asked.
+		case errors.Is(err, errTimeout):
+			r, err = c.bind(ctx, primary, changePort)
+			switch {
+			case err == nil && r.from != primary:
+				res.Filtering = AddressDependent
+			case errors.Is(err, errTimeout):
+				res.Filtering = AddressPortDependent
+			}
+		}
+	}
+
+	// Mapping: tests II and III of RFC 5780, to the alternate address
+	// with the primary port, then the alternate port.
+	switch {
+	case !res.NAT:
+		res.Mapping, res.MappingBy = EndpointIndependent, "no NAT"
+	case other.IsValid():
+		res.MappingBy = "alternate address of " + primary.String()
+		r2, err := c.bind(ctx, netip.AddrPortFrom(other.Addr(), primary.Port()), 0)
+		if err != nil {
+			break
+		}
+		if r2.mapped == first {
+			res.Mapping = EndpointIndependent
+			break
+		}
+		r3, err := c.bind(ctx, other, 0)
+		if err != nil {
+			break
+		}
+		if r3.mapped == r2.mapped {
+			res.Mapping = AddressDependent
+		} else {
+			res.Mapping = AddressPortDependent
+		}
+	case len(mapped) > 1:
+		// Only servers at different addresses tell the mappings apart.
+		res.MappingBy = "servers compared"
+		res.Mapping = EndpointIndependent
+		for i := range mapped[1:] {
+			if addrs[i+1] != addrs[0] && mapped[i+1] != first {
+				res.Mapping = "address-dependent or address and port-dependent"
+			}
+		}
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	if res.NAT {
+		res.Hairpin = "no"
+		if hairpin(c, first) {
+			res.Hairpin = "yes"
+		}
+	}
+	res.Type, res.Punching = classify(res)
+	res.Elapsed = time.Since(start)
+	return res, nil
+}
+
+// hairpin tells whether a packet to the socket's own public address comes
+// back to it through the NAT.
+func hairpin(c *client, mapped netip.AddrPort) bool {
+	var id [12]byte
+	rand.Read(id[:])
+	req := request(id, 0)
+	if _, err := c.conn.WriteToUDPAddrPort(req, mapped); err != nil {
+		return false
+	}
+	c.conn.SetReadDeadline(time.Now().Add(c.timeout))
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := c.conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			return false
+		}
+		if bytes.Equal(buf[:n], req) {
+			return true
+		}
+	}
+}
+
+// classify names the NAT the RFC 3489 way and says what that means for
+// hole punching.
+func classify(r *Result) (typ, punching string) {
+	switch {
+	case !r.NAT && r.Filtering == EndpointIndependent:
+		return "open internet", "not needed, the socket is reachable as it is"
+	case !r.NAT && r.Filtering == Unknown:
+		return "no NAT", "not needed unless a firewall filters, which takes a server with an alternate address to tell"
+	case !r.NAT:
+		return "firewall, " + r.Filtering + " filtering", "works with every peer, the firewall opens on the first packet out"
+	case r.Mapping == EndpointIndependent && r.Filtering == EndpointIndependent:
+		return "full cone", "works with every peer"
+	case r.Mapping == EndpointIndependent && r.Filtering == AddressDependent:
+		return "restricted cone", "works with every peer when both sides send"
+	case r.Mapping == EndpointIndependent && r.Filtering == AddressPortDependent:
+		return "port restricted cone", "works unless the peer's NAT is symmetric"
+	case r.Mapping == EndpointIndependent:
+		return "cone, filtering unknown", "works with cone NAT peers"
+	case r.Mapping == Unknown:
+		return "unknown", "unknown, give servers with an alternate address or several servers"
+	default:
+		return "symmetric", "only with peers behind full or restricted cone NATs, otherwise a relay is needed"
+	}
+}
+
+// isLocal tells whether mapped is the socket's own address, no NAT
+// between it and the server.
+func isLocal(mapped, local netip.AddrPort) bool {
+	if mapped.Port() != local.Port() {
+		return false
+	}
+	if local.Addr().IsValid() && !local.Addr().IsUnspecified() {
+		return mapped.Addr() == local.Addr()
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if ipNet, ok := a.(*net.IPNet); ok {
+			if ip, ok := netip.AddrFromSlice(ipNet.IP); ok && ip.Unmap() == mapped.Addr() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// listen opens the local UDP socket of family at addr.
+func listen(addr, family string) (*net.UDPConn, error) {
+	network := "udp4"
+	if family == "6" {
+		network = "udp6"
+	}
+	if addr == "" {
+		addr = ":0"
+	}
+	laddr, err := net.ResolveUDPAddr(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return net.ListenUDP(network, laddr)
+}
+
+// resolve finds the address of a server of family, DefaultPort when it
+// has none.
+func resolve(ctx context.Context, server, family string) (netip.AddrPort, error) {
+	host, port := server, DefaultPort
+	if h, p, err := net.SplitHostPort(server); err == nil {
+		n, err := strconv.Atoi(p)
+		if err != nil || n <= 0 || n > 65535 {
+			return netip.AddrPort{}, fmt.Errorf("invalid port in %q", server)
+		}
+		host, port = h, n
+	}
+	network := "ip4"
+	if family == "6" {
+		network = "ip6"
+	}
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, network, host)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	if len(ips) == 0 {
+		return netip.AddrPort{}, fmt.Errorf("%s has no IPv%s address", host, strings.TrimPrefix(network, "ip"))
+	}
+	return netip.AddrPortFrom(ips[0].Unmap(), uint16(port)), nil
+}
+
+// Write prints r for people.
+func (r *Result) Write(w io.Writer) {
+	for _, s := range r.Servers {
+		if s.Error != "" {
+			fmt.Fprintf(w, "%-30s %s\n", s.Server, s.Error)
+			continue
+		}
+		fmt.Fprintf(w, "%-30s %s -> %s in %v", s.Server, s.Addr, s.Mapped, s.RTT.Round(time.Microsecond))
+		if s.Other != "" {
+			fmt.Fprintf(w, ", alternate %s", s.Other)
+		}
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintf(w, "--- %s is %s in public ---\n", r.Local, r.Mapped)
+	fmt.Fprintf(w, "Mapping:   %s", r.Mapping)
+	if r.MappingBy != "" {
+		fmt.Fprintf(w, " (%s)", r.MappingBy)
+	}
+	if r.NAT && r.PortPreserved {
+		fmt.Fprint(w, ", port preserved")
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "Filtering: %s\n", r.Filtering)
+	fmt.Fprintf(w, "Hairpin:   %s\n", r.Hairpin)
+	fmt.Fprintf(w, "NAT type:  %s\n", r.Type)
+	fmt.Fprintf(w, "Punching:  %s\n", r.Punching)
+}
@@ -0,0 +1,136 @@
+package stunnat
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/netip"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"gonet/pkg/config"
+	"gonet/pkg/logging"
+	"gonet/pkg/results"
+)
+
+// defaultServers are public STUN servers, the first with an alternate
+// address for the mapping and filtering tests.
+const defaultServers = "stun.stunprotocol.org,stun.l.google.com:19302"
+
+// Main runs gonet stun with the arguments after the command name.
+func Main(args []string) {
+	if len(args) < 1 {
+		log.Fatal("Usage: gonet stun detect|punch [flags]")
+	}
+	switch args[0] {
+	case "detect":
+		detectCommand(args[1:])
+	case "punch":
+		punchCommand(args[1:])
+	default:
+		log.Fatalf("Unknown stun command %q, want detect or punch", args[0])
+	}
+}
+
+func detectCommand(args []string) {
+	// Command line flags
+	flags := flag.NewFlagSet("stun detect", flag.ExitOnError)
+	local := flags.String("local", "", "Local address of the socket to test, like :5000 (default a random port)")
+	family := flags.String("family", "4", "Address family, 4 or 6")
+	timeout := flags.Duration("timeout", 500*time.Millisecond, "How long to wait for each answer")
+	retries := flags.Int("retries", 2, "Times to send a request again when nothing comes")
+	jsonOut := flags.String("json", "", "Write the result as JSON to this file when done, - for stdout")
+	logs := logging.RegisterFlags(flags)
+	configFile := flags.String("config", "", "YAML or JSON file setting flags by name, command line flags win")
+	flags.Parse(args)
+
+	if _, err := config.LoadFlags(flags, *configFile); err != nil {
+		log.Fatalf("Invalid -config: %v", err)
+	}
+	if err := logs.Setup(); err != nil {
+		log.Fatal(err)
+	}
+	servers := flags.Args()
+	if len(servers) == 0 {
+		servers = strings.Split(defaultServers, ",")
+	}
+
+	// Stop on interrupt
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	res, err := Detect(ctx, Config{
+		Servers: servers,
+		Local:   *local,
+		Family:  *family,
+		Timeout: *timeout,
+		Retries: *retries,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *jsonOut != "-" {
+		res.Write(os.Stdout)
+	}
+	if *jsonOut != "" {
+		if err := results.Write(*jsonOut, res); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+func punchCommand(args []string) {
+	// Command line flags
+	flags := flag.NewFlagSet("stun punch", flag.ExitOnError)
+	local := flags.String("local", "", "Local address of the socket, like :5000 (default a random port)")
+	family := flags.String("family", "4", "Address family, 4 or 6")
+	server := flags.String("server", "stun.l.google.com:19302", "STUN server to learn the public address from, empty for none")
+	interval := flags.Duration("interval", 200*time.Millisecond, "Time between packets")
+	duration := flags.Duration("duration", 30*time.Second, "How long to try")
+	jsonOut := flags.String("json", "", "Write the result as JSON to this file when done, - for stdout")
+	logs := logging.RegisterFlags(flags)
+	configFile := flags.String("config", "", "YAML or JSON file setting flags by name, command line flags win")
+	flags.Parse(args)
+
+	if _, err := config.LoadFlags(flags, *configFile); err != nil {
+		log.Fatalf("Invalid -config: %v", err)
+	}
+	if err := logs.Setup(); err != nil {
+		log.Fatal(err)
+	}
+	if flags.NArg() > 1 {
+		log.Fatal("Usage: gonet stun punch [flags] [peer address:port]")
+	}
+
+	// Stop on interrupt
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	res, err := Punch(ctx, PunchConfig{
+		Local:  *local,
+		Family: *family,
+		Server: *server,
+		Mapped: func(a netip.AddrPort) {
+			if *jsonOut != "-" {
+				fmt.Printf("Public address %s, give it to the peer\n", a)
+			}
+		},
+		Peer:     flags.Arg(0),
+		Interval: *interval,
+		Duration: *duration,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *jsonOut != "-" {
+		res.Write(os.Stdout)
+	}
+	if *jsonOut != "" {
+		if err := results.Write(*jsonOut, res); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package stunnat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// punchMagic starts every punch packet: "gonet punch <seq> <seen>", seen
+// being 1 once the sender has heard from its peer.
+const punchMagic = "gonet punch "
+
+// PunchConfig is a hole punching test for Punch. Both peers run one, each
+// with the other's public address, at about the same time.
+type PunchConfig struct {
+	Local  string // address of the local socket, default any with a random port
+	Family string // "4" or "6", default 4
+
+	// Server, if set, is a STUN server to learn the socket's public
+	// address from, the one to give the peer. Mapped gets it before the
+	// punching starts.
+	Server string
+	Mapped func(netip.AddrPort)
+
+	// Peer is the peer's public address. Without one the test only waits
+	// for the peer's packets and answers them.
+	Peer string
+
+	Interval time.Duration // between packets, default 200ms
+	Duration time.Duration // to give up after, default 30s
+	Timeout  time.Duration // of the STUN request, default 500ms
+}
+
+// PunchResult is a finished hole punching test. It succeeded when packets
+// got through both ways.
+type PunchResult struct {
+	Local    string        `json:"local"`
+	Mapped   string        `json:"mapped,omitempty"`
+	Peer     string        `json:"peer,omitempty"`
+	From     string        `json:"from,omitempty"` // where the peer's packets came from
+	Sent     uint64        `json:"sent"`
+	Received uint64        `json:"received"`
+	Success  bool          `json:"success"`
+	Time     time.Duration `json:"time_ns,omitempty"` // until it succeeded
+	Elapsed  time.Duration `json:"elapsed_ns"`
+}
+
+// Punch sends packets to the peer and waits for the peer's, until both
+// sides have heard from each other or it's time to give up.
+func Punch(ctx context.Context, cfg PunchConfig) (*PunchResult, error) {
+	if cfg.Interval <= 0 {
+		cfg.Interval = 200 * time.Millisecond
+	}
+	if cfg.Duration <= 0 {
+		cfg.Duration = 30 * time.Second
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 500 * time.Millisecond
+	}
+	conn, err := listen(cfg.Local, cfg.Family)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	res := &PunchResult{Local: unmap(conn.LocalAddr().(*net.UDPAddr).AddrPort()).String()}
+
+	if cfg.Server != "" {
+		server, err := resolve(ctx, cfg.Server, cfg.Family)
+		if err != nil {
+			return nil, err
+		}
+		c := &client{conn: conn, timeout: cfg.Timeout, retries: 2}
+		r, err := c.bind(ctx, server, 0)
+		if err != nil {
+			return nil, fmt.Errorf("STUN server %s: %v", cfg.Server, err)
+		}
+		conn.SetReadDeadline(time.Time{})
+		res.Mapped = r.mapped.String()
+		if cfg.Mapped != nil {
+			cfg.Mapped(r.mapped)
+		}
+	}
+	var peer netip.AddrPort
+	if cfg.Peer != "" {
+		if peer, err = netip.ParseAddrPort(cfg.Peer); err != nil {
+			return nil, fmt.Errorf("invalid peer %q, want address:port", cfg.Peer)
+		}
+		res.Peer = peer.String()
+	}
+
+	// The reader only hands on what the peer sends.
+	type packet struct {
+		from netip.AddrPort
+		seen bool
+	}
+	packets := make(chan packet, 16)
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := conn.ReadFromUDPAddrPort(buf)
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				continue
+			}
+			fields := strings.Fields(strings.TrimPrefix(string(buf[:n]), punchMagic))
+			if !strings.HasPrefix(string(buf[:n]), punchMagic) || len(fields) != 2 {
+				continue
+			}
+			select {
+			case packets <- packet{unmap(from), fields[1] == "1"}:
+			default:
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, cfg.Duration)
+	defer cancel()
+	tick := time.NewTicker(cfg.Interval)
+	defer tick.Stop()
+	start := time.Now()
+	var heard netip.AddrPort // where the peer's packets come from
+	// Once done, a few more packets tell the peer its side got through.
+	confirm := 0
+	send := func() error {
+		to := heard
+		if !to.IsValid() {
+			to = peer
+		}
+		if !to.IsValid() {
+			return nil
+		}
+		seen := 0
+		if heard.IsValid() {
+			seen = 1
+		}
+		res.Sent++
+		_, err := conn.WriteToUDPAddrPort([]byte(punchMagic+strconv.FormatUint(res.Sent, 10)+" "+strconv.Itoa(seen)), to)
+		return err
+	}
+	if err := send(); err != nil {
+		return nil, err
+	}
+	for confirm < 5 {
+		select {
+		case <-ctx.Done():
+			res.Elapsed = time.Since(start)
+			return res, nil
+		case p := <-packets:
+			res.Received++
+			if !heard.IsValid() {
+				// The first packet in says where the peer's NAT maps it
+				// towards us, which is where to answer.
+				heard = p.from
+				res.From = p.from.String()
+				if err := send(); err != nil {
+					return nil, err
+				}
+			}
+			if p.seen && !res.Success {
+				res.Success, res.Time = true, time.Since(start)
+			}
+		case <-tick.C:
+			if res.Success {
+				confirm++
+			}
+			if err := send(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	res.Elapsed = time.Since(start)
+	return res, nil
+}
+
+// Write prints r for people.
+func (r *PunchResult) Write(w io.Writer) {
+	fmt.Fprintf(w, "--- %s", r.Local)
+	if r.Mapped != "" {
+		fmt.Fprintf(w, " (public %s)", r.Mapped)
+	}
+	if r.Peer != "" {
+		fmt.Fprintf(w, " to %s", r.Peer)
+	}
+	fmt.Fprintln(w, " ---")
+	fmt.Fprintf(w, "Packets:   %d sent, %d received in %v\n", r.Sent, r.Received, r.Elapsed.Round(time.Millisecond))
+	if r.Peer != "" && r.From != "" && r.From != r.Peer {
+		fmt.Fprintf(w, "Peer seen: from %s, not the address given: its NAT maps per destination\n", r.From)
+	}
+	if r.Success {
+		fmt.Fprintf(w, "Punched:   yes, both ways after %v\n", r.Time.Round(time.Millisecond))
+	} else if r.Received > 0 {
+		fmt.Fprintln(w, "Punched:   one way only, the peer's packets got in but ours didn't get to it")
+	} else {
+		fmt.Fprintln(w, "Punched:   no, nothing got through from the peer")
+	}
+}
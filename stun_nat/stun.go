@@ -0,0 +1,213 @@
+package stunnat
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"time"
+)
+
+// STUN message types and attributes, RFC 5389 and RFC 5780, with the
+// CHANGED-ADDRESS of RFC 3489 servers.
+const (
+	magicCookie = 0x2112A442
+	headerLen   = 20
+
+	bindingRequest = 0x0001
+	bindingSuccess = 0x0101
+	bindingError   = 0x0111
+
+	attrMapped     = 0x0001
+	attrChange     = 0x0003
+	attrChanged    = 0x0005
+	attrErrorCode  = 0x0009
+	attrXORMapped  = 0x0020
+	attrXORMapped2 = 0x8020 // of pre-RFC 5389 drafts, still around
+	attrSoftware   = 0x8022
+	attrOrigin     = 0x802b
+	attrOtherAddr  = 0x802c
+
+	// CHANGE-REQUEST flags
+	changeIP   = 0x04
+	changePort = 0x02
+)
+
+// DefaultPort is the STUN port of servers given without one.
+const DefaultPort = 3478
+
+// errTimeout is a request that got no answer.
+var errTimeout = errors.New("no answer")
+
+// response is what a binding request got back.
+type response struct {
+	mapped netip.AddrPort
+	other  netip.AddrPort // the server's alternate address, if it has one
+	origin netip.AddrPort // where the server says it answered from
+	from   netip.AddrPort // where the answer came from
+	rtt    time.Duration
+}
+
+// request builds a binding request with id, asking the server to answer
+// from another address or port with change.
+func request(id [12]byte, change byte) []byte {
+	b := make([]byte, headerLen, headerLen+8+12)
+	binary.BigEndian.PutUint16(b[0:], bindingRequest)
+	binary.BigEndian.PutUint32(b[4:], magicCookie)
+	copy(b[8:], id[:])
+	attr := func(typ uint16, v []byte) {
+		b = binary.BigEndian.AppendUint16(b, typ)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(v)))
+		b = append(b, v...)
+		for len(b)%4 != 0 {
+			b = append(b, 0)
+		}
+	}
+	if change != 0 {
+		attr(attrChange, []byte{0, 0, 0, change})
+	}
+	attr(attrSoftware, []byte("gonet"))
+	binary.BigEndian.PutUint16(b[2:], uint16(len(b)-headerLen))
+	return b
+}
+
+// parseResponse reads the answer to the request with id. ok is false for
+// anything else, like a late answer to an earlier request.
+func parseResponse(b []byte, id [12]byte) (r response, ok bool, err error) {
+	if len(b) < headerLen || binary.BigEndian.Uint32(b[4:]) != magicCookie || [12]byte(b[8:20]) != id {
+		return r, false, nil
+	}
+	typ := binary.BigEndian.Uint16(b[0:])
+	n := int(binary.BigEndian.Uint16(b[2:]))
+	if typ != bindingSuccess && typ != bindingError {
+		return r, false, nil
+	}
+	if headerLen+n > len(b) {
+		return r, true, errors.New("truncated answer")
+	}
+	var xorMapped netip.AddrPort
+	attrs := b[headerLen : headerLen+n]
+	for len(attrs) >= 4 {
+		at := binary.BigEndian.Uint16(attrs[0:])
+		l := int(binary.BigEndian.Uint16(attrs[2:]))
+		if 4+l > len(attrs) {
+			return r, true, errors.New("truncated attribute")
+		}
+		v := attrs[4 : 4+l]
+		switch at {
+		case attrMapped:
+			r.mapped = parseAddr(v, nil)
+		case attrXORMapped, attrXORMapped2:
+			xorMapped = parseAddr(v, b[4:20])
+		case attrOtherAddr, attrChanged:
+			r.other = parseAddr(v, nil)
+		case attrOrigin:
+			r.origin = parseAddr(v, nil)
+		case attrErrorCode:
+			if typ == bindingError && len(v) >= 4 {
+				return r, true, fmt.Errorf("error %d %s", int(v[2]&7)*100+int(v[3]), v[4:])
+			}
+		}
+		attrs = attrs[(4+l+3)&^3:]
+	}
+	if typ == bindingError {
+		return r, true, errors.New("error answer")
+	}
+	if xorMapped.IsValid() {
+		r.mapped = xorMapped
+	}
+	if !r.mapped.IsValid() {
+		return r, true, errors.New("no mapped address in the answer")
+	}
+	return r, true, nil
+}
+
+// parseAddr reads an address attribute, XORed with the cookie and
+// transaction ID in xor when set.
+func parseAddr(v, xor []byte) netip.AddrPort {
+	if len(v) < 4 {
+		return netip.AddrPort{}
+	}
+	port := binary.BigEndian.Uint16(v[2:])
+	addr := append([]byte(nil), v[4:]...)
+	if xor != nil {
+		port ^= magicCookie >> 16
+		for i := range addr {
+			addr[i] ^= xor[i%len(xor)]
+		}
+	}
+	switch {
+	case v[1] == 1 && len(addr) == 4, v[1] == 2 && len(addr) == 16:
+		a, _ := netip.AddrFromSlice(addr)
+		return netip.AddrPortFrom(a, port)
+	}
+	return netip.AddrPort{}
+}
+
+// client runs binding requests on one socket, so they all see the same
+// mapping.
+type client struct {
+	conn    *net.UDPConn
+	timeout time.Duration
+	retries int
+}
+
+// bind sends a binding request to server, again on timeouts, and returns
+// the answer, from wherever it comes.
+func (c *client) bind(ctx context.Context, server netip.AddrPort, change byte) (response, error) {
+	var id [12]byte
+	rand.Read(id[:])
+	req := request(id, change)
+	buf := make([]byte, 1500)
+	for try := 0; try <= c.retries; try++ {
+		sent := time.Now()
+		if _, err := c.conn.WriteToUDPAddrPort(req, server); err != nil {
+			return response{}, err
+		}
+		deadline := sent.Add(c.timeout)
+		for {
+			if err := ctx.Err(); err != nil {
+				return response{}, err
+			}
+			// Wake up now and then for ctx.
+			c.conn.SetReadDeadline(earlier(deadline, time.Now().Add(100*time.Millisecond)))
+			n, from, err := c.conn.ReadFromUDPAddrPort(buf)
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				if time.Now().Before(deadline) {
+					continue
+				}
+				break
+			}
+			if err != nil {
+				return response{}, err
+			}
+			r, ok, err := parseResponse(buf[:n], id)
+			if !ok {
+				continue
+			}
+			if err != nil {
+				return response{}, err
+			}
+			r.from, r.rtt = unmap(from), time.Since(sent)
+			return r, nil
+		}
+	}
+	return response{}, errTimeout
+}
+
+// unmap turns IPv4-mapped IPv6 addresses, as dual stack sockets give
+// them, back into IPv4 ones.
+func unmap(a netip.AddrPort) netip.AddrPort {
+	return netip.AddrPortFrom(a.Addr().Unmap(), a.Port())
+}
+
+func earlier(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,145 @@
+package tcpclient
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+
+	"gonet/pkg/config"
+	"gonet/pkg/logging"
+	"gonet/pkg/results"
+	"gonet/pkg/stats"
+	"gonet/pkg/tcpperf"
+)
+
+// Main runs gonet tcp client with the arguments after the command name.
+func Main(args []string) {
+	// Command line flags
+	flags := flag.NewFlagSet("tcp client", flag.ExitOnError)
+	server := flags.String("server", "", "host:port of gonet tcp server")
+	parallel := flags.Int("parallel", 1, "Number of parallel streams")
+	duration := flags.Duration("duration", tcpperf.DefaultDuration, "How long to send")
+	reverse := flags.Bool("reverse", false, "Have the server send and the client receive")
+	noDelay := flags.Bool("nodelay", false, "Disable Nagle's algorithm")
+	length := tcpperf.Size(tcpperf.DefaultLen)
+	flags.Var(&length, "len", "Bytes per read or write, like 128K")
+	var window tcpperf.Size
+	flags.Var(&window, "window", "Socket send and receive buffer size of both ends, like 4M, bounding the TCP window (default: the system's)")
+	capacity := flags.Bool("capacity", false, "Estimate the bottleneck capacity to the server with packet pairs and trains instead")
+	probeSize := flags.Int("probe-size", tcpperf.DefaultProbeSize, "UDP payload bytes of each capacity probe")
+	pairs := flags.Int("pairs", tcpperf.DefaultPairs, "Packet pairs of a capacity test")
+	trains := flags.Int("trains", tcpperf.DefaultTrains, "Packet trains of a capacity test, -1 for none")
+	trainLen := flags.Int("train-len", tcpperf.DefaultTrainLen, "Packets per train")
+	gap := flags.Duration("gap", tcpperf.DefaultGap, "Mean idle time after each pair, trains wait train-len/2 times as long")
+	report := stats.RegisterFlags(flags)
+	record := results.RegisterFlags(flags)
+	jsonOut := flags.String("json", "", "Write the result as JSON to this file when done, - for stdout")
+	logs := logging.RegisterFlags(flags)
+	configFile := flags.String("config", "", "YAML or JSON file setting flags by name, command line flags win")
+	flags.Parse(args)
+
+	if _, err := config.LoadFlags(flags, *configFile); err != nil {
+		log.Fatalf("Invalid -config: %v", err)
+	}
+	if err := logs.Setup(); err != nil {
+		log.Fatal(err)
+	}
+	if *server == "" {
+		log.Fatal("Please specify the server with -server host:port")
+	}
+	rec, err := record.Recorder(flags)
+	if err != nil {
+		log.Fatal(err)
+	}
+	report.Sinks = append(report.Sinks, rec)
+
+	// Stop on interrupt
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	var c tcpperf.Client
+	if *capacity {
+		if *reverse {
+			log.Fatal("Capacity tests only go from the client to the server, -reverse isn't supported")
+		}
+		report.Unit = "Probes"
+		reporter, err := report.Reporter(c.Counters(), "Probe", "sent", "tcp_client")
+		if err != nil {
+			log.Fatal(err)
+		}
+		reporter.Start()
+		res, err := c.Capacity(ctx, tcpperf.CapacityConfig{
+			Server:   *server,
+			Size:     *probeSize,
+			Pairs:    *pairs,
+			Trains:   *trains,
+			TrainLen: *trainLen,
+			Gap:      *gap,
+		})
+		reporter.Stop()
+		if err != nil {
+			rec.Finish(nil, err)
+			log.Fatalf("Capacity test against %s failed: %v", *server, err)
+		}
+		if *jsonOut != "-" {
+			res.Write(os.Stdout)
+		}
+		if *jsonOut != "" {
+			if err := results.Write(*jsonOut, res); err != nil {
+				log.Fatal(err)
+			}
+		}
+		rec.Set(map[string]float64{
+			"capacity_mbps": res.Mbps,
+			"adr_mbps":      res.ADR,
+			"pairs":         float64(res.Pairs),
+			"trains":        float64(res.Trains),
+			"lost":          float64(res.Lost),
+		})
+		if _, err := rec.Finish(res, nil); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	verb, direction := "sent", "Outgoing"
+	if *reverse {
+		verb, direction = "received", "Incoming"
+	}
+	report.NoPackets = true
+	reporter, err := report.Reporter(c.Counters(), direction, verb, "tcp_client")
+	if err != nil {
+		log.Fatal(err)
+	}
+	reporter.Start()
+
+	res, err := c.Run(ctx, tcpperf.Config{
+		Server:   *server,
+		Streams:  *parallel,
+		Duration: *duration,
+		Len:      int(length),
+		Window:   int(window),
+		NoDelay:  *noDelay,
+		Reverse:  *reverse,
+	})
+	reporter.Stop()
+	if err != nil {
+		rec.Finish(nil, err)
+		log.Fatalf("Test against %s failed: %v", *server, err)
+	}
+	if *jsonOut != "-" {
+		res.Write(os.Stdout)
+	}
+	if *jsonOut != "" {
+		if err := results.Write(*jsonOut, res); err != nil {
+			log.Fatal(err)
+		}
+	}
+	// The server counted what arrived, which beats what was sent.
+	rec.Set(map[string]float64{"bytes": float64(res.Bytes), "mbps": res.Mbps, "streams": float64(len(res.Streams))})
+	if _, err := rec.Finish(res, nil); err != nil {
+		log.Fatal(err)
+	}
+}
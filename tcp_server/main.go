@@ -0,0 +1,85 @@
+package tcpserver
+
+import (
+	"context"
+	"flag"
+	"log"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+
+	"gonet/pkg/config"
+	"gonet/pkg/logging"
+	"gonet/pkg/results"
+	"gonet/pkg/stats"
+	"gonet/pkg/tcpperf"
+)
+
+// Main runs gonet tcp server with the arguments after the command name.
+func Main(args []string) {
+	// Command line flags
+	flags := flag.NewFlagSet("tcp server", flag.ExitOnError)
+	listen := flags.String("listen", ":5201", "TCP address to accept tests on")
+	var window tcpperf.Size
+	flags.Var(&window, "window", "Socket buffer size for tests that don't ask for one, like 4M (default: the system's)")
+	report := stats.RegisterFlags(flags)
+	record := results.RegisterFlags(flags)
+	logs := logging.RegisterFlags(flags)
+	configFile := flags.String("config", "", "YAML or JSON file setting flags by name, command line flags win")
+	flags.Parse(args)
+
+	if _, err := config.LoadFlags(flags, *configFile); err != nil {
+		log.Fatalf("Invalid -config: %v", err)
+	}
+	if err := logs.Setup(); err != nil {
+		log.Fatal(err)
+	}
+	rec, err := record.Recorder(flags)
+	if err != nil {
+		log.Fatal(err)
+	}
+	report.Sinks = append(report.Sinks, rec)
+
+	// Stop on interrupt
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	ln, err := net.Listen("tcp", *listen)
+	if err != nil {
+		log.Fatalf("Failed to listen for tests: %v", err)
+	}
+	slog.Info("Waiting for tests", "addr", ln.Addr())
+
+	// The run's result is every test the server answered.
+	var mu sync.Mutex
+	var tests []*tcpperf.Result
+	srv := tcpperf.Server{
+		Window: int(window),
+		Reports: func(r *tcpperf.Result) {
+			r.Write(os.Stdout)
+			mu.Lock()
+			tests = append(tests, r)
+			mu.Unlock()
+		},
+	}
+	report.NoPackets = true
+	reporter, err := report.Reporter(srv.Counters(), "TCP", "moved", "tcp_server")
+	if err != nil {
+		log.Fatal(err)
+	}
+	reporter.Start()
+	err = srv.Serve(ctx, ln)
+	reporter.Stop()
+	mu.Lock()
+	rec.Set(map[string]float64{"tests": float64(len(tests))})
+	_, ferr := rec.Finish(tests, err)
+	mu.Unlock()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if ferr != nil {
+		log.Fatal(ferr)
+	}
+}
@@ -0,0 +1,288 @@
+package tlsload
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"gonet/pkg/stats"
+)
+
+// Config is a handshake load for Load.Run.
+type Config struct {
+	Target     string // host:port
+	ServerName string // SNI and the name to verify, default the target's host
+
+	MinVersion, MaxVersion uint16   // tls.VersionTLS10 and so on, 0 for Go's defaults
+	CipherSuites           []uint16 // TLS 1.2 and older, nil for Go's defaults
+	ALPN                   []string
+	Insecure               bool // skip certificate verification
+
+	// Resume shares a session cache between the handshakes, so all but
+	// the first can resume a session.
+	Resume bool
+
+	Concurrency int     // handshakes in flight at most, default 10
+	Rate        float64 // handshakes started per second at most, 0 for no limit
+
+	// The test ends after Duration or Handshakes, whichever comes first;
+	// with neither it runs until ctx is done.
+	Duration   time.Duration
+	Handshakes uint64
+
+	Timeout time.Duration // of the connect and of the handshake, default 5s
+}
+
+// Result is a finished test.
+type Result struct {
+	Attempts       uint64            `json:"attempts"`
+	Handshakes     uint64            `json:"handshakes"` // completed
+	Resumed        uint64            `json:"resumed"`
+	ResumedPercent float64           `json:"resumed_percent"`
+	Failures       uint64            `json:"failures"`
+	FailuresBy     map[string]uint64 `json:"failures_by_reason,omitempty"`
+	Versions       map[string]uint64 `json:"versions"`
+	Ciphers        map[string]uint64 `json:"ciphers"`
+	ALPN           map[string]uint64 `json:"alpn,omitempty"`
+
+	Elapsed   time.Duration `json:"elapsed_ns"`
+	Rate      float64       `json:"rate"` // completed handshakes per second
+	Connect   stats.Latency `json:"connect"`
+	Handshake stats.Latency `json:"handshake"`
+}
+
+// Load opens TLS connections. The zero value is ready to use.
+type Load struct {
+	counters stats.Counters
+}
+
+// Counters counts the completed handshakes, for interval reports.
+func (l *Load) Counters() *stats.Counters {
+	return &l.counters
+}
+
+// clientConfig builds the TLS configuration of cfg.
+func clientConfig(cfg Config) (*tls.Config, error) {
+	host, _, err := net.SplitHostPort(cfg.Target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target %q, want host:port", cfg.Target)
+	}
+	tc := &tls.Config{
+		ServerName:         cfg.ServerName,
+		MinVersion:         cfg.MinVersion,
+		MaxVersion:         cfg.MaxVersion,
+		CipherSuites:       cfg.CipherSuites,
+		NextProtos:         cfg.ALPN,
+		InsecureSkipVerify: cfg.Insecure,
+	}
+	if tc.ServerName == "" {
+		tc.ServerName = host
+	}
+	if cfg.Resume {
+		tc.ClientSessionCache = tls.NewLRUClientSessionCache(cfg.Concurrency)
+	}
+	return tc, nil
+}
+
+// Run runs the test cfg describes. Cancelling ctx ends it, the result
+// then covers the handshakes done so far.
+func (l *Load) Run(ctx context.Context, cfg Config) (*Result, error) {
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = 10
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 5 * time.Second
+	}
+	tc, err := clientConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &Result{FailuresBy: map[string]uint64{}, Versions: map[string]uint64{}, Ciphers: map[string]uint64{}, ALPN: map[string]uint64{}}
+	var mu sync.Mutex
+	var connect, handshake stats.Histogram
+
+	// The producer paces the handshakes; in-flight ones finish after the
+	// test's end unless ctx is done.
+	produce := ctx
+	if cfg.Duration > 0 {
+		var cancel context.CancelFunc
+		produce, cancel = context.WithTimeout(ctx, cfg.Duration)
+		defer cancel()
+	}
+	jobs := make(chan uint64)
+	go func() {
+		defer close(jobs)
+		start := time.Now()
+		for i := uint64(0); cfg.Handshakes == 0 || i < cfg.Handshakes; i++ {
+			if cfg.Rate > 0 {
+				due := start.Add(time.Duration(float64(i) / cfg.Rate * float64(time.Second)))
+				if wait := time.Until(due); wait > 0 {
+					select {
+					case <-time.After(wait):
+					case <-produce.Done():
+						return
+					}
+				}
+			}
+			select {
+			case jobs <- i:
+			case <-produce.Done():
+				return
+			}
+		}
+	}()
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for range cfg.Concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range jobs {
+				h, err := dial(ctx, cfg, tc)
+				if err != nil && ctx.Err() != nil {
+					// Interrupted, not the server's fault.
+					continue
+				}
+
+				mu.Lock()
+				res.Attempts++
+				if err != nil {
+					res.Failures++
+					res.FailuresBy[reason(err)]++
+				} else {
+					res.Handshakes++
+					res.Versions[tls.VersionName(h.state.Version)]++
+					res.Ciphers[tls.CipherSuiteName(h.state.CipherSuite)]++
+					if h.state.NegotiatedProtocol != "" {
+						res.ALPN[h.state.NegotiatedProtocol]++
+					}
+					if h.state.DidResume {
+						res.Resumed++
+					}
+				}
+				mu.Unlock()
+				if err == nil {
+					connect.Record(h.connect)
+					handshake.Record(h.handshake)
+					l.counters.Add(1, 0)
+				} else if h.connect > 0 {
+					connect.Record(h.connect)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	res.Elapsed = time.Since(start)
+	res.Connect = connect.Summary()
+	res.Handshake = handshake.Summary()
+	if secs := res.Elapsed.Seconds(); secs > 0 {
+		res.Rate = float64(res.Handshakes) / secs
+	}
+	if res.Handshakes > 0 {
+		res.ResumedPercent = float64(res.Resumed) * 100 / float64(res.Handshakes)
+	}
+	return res, nil
+}
+
+// handshake is how a connection went.
+type handshake struct {
+	connect, handshake time.Duration
+	state              tls.ConnectionState
+}
+
+// dial connects and shakes hands once.
+func dial(ctx context.Context, cfg Config, tc *tls.Config) (handshake, error) {
+	var h handshake
+	d := net.Dialer{Timeout: cfg.Timeout}
+	began := time.Now()
+	nc, err := d.DialContext(ctx, "tcp", cfg.Target)
+	if err != nil {
+		return h, err
+	}
+	defer nc.Close()
+	h.connect = time.Since(began)
+
+	hctx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+	defer cancel()
+	conn := tls.Client(nc, tc)
+	began = time.Now()
+	if err := conn.HandshakeContext(hctx); err != nil {
+		return h, err
+	}
+	h.handshake = time.Since(began)
+	h.state = conn.ConnectionState()
+
+	// TLS 1.3 session tickets come after the handshake, read them for
+	// the next handshake to resume.
+	if cfg.Resume && h.state.Version == tls.VersionTLS13 {
+		conn.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+		conn.Read(make([]byte, 1))
+	}
+	return h, nil
+}
+
+// reason sorts handshake failures.
+func reason(err error) string {
+	var alert tls.AlertError
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	var recordErr tls.RecordHeaderError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &alert):
+		return "alert: " + strings.TrimPrefix(alert.Error(), "tls: ")
+	case errors.As(err, &unknownAuthority):
+		return "certificate: unknown authority"
+	case errors.As(err, &hostname):
+		return "certificate: wrong host name"
+	case errors.As(err, &invalid):
+		switch invalid.Reason {
+		case x509.Expired:
+			return "certificate: expired or not yet valid"
+		}
+		return "certificate: invalid"
+	case errors.As(err, &recordErr):
+		return "not TLS"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection refused"
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "connection reset"
+	case errors.As(err, &netErr) && netErr.Timeout(), errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case strings.Contains(err.Error(), "protocol version"):
+		return "no common version"
+	case strings.Contains(err.Error(), "cipher suite"):
+		return "no common cipher suite"
+	}
+	return "other: " + err.Error()
+}
+
+// Write prints r for people, with the latency histograms when buckets is
+// set.
+func (r *Result) Write(w io.Writer, buckets bool) {
+	fmt.Fprintf(w, "Handshakes: %d of %d in %v (%.2f/s), %d failed, %d resumed (%.1f%%)\n",
+		r.Handshakes, r.Attempts, r.Elapsed.Round(time.Millisecond), r.Rate, r.Failures, r.Resumed, r.ResumedPercent)
+	if len(r.FailuresBy) > 0 {
+		fmt.Fprintf(w, "Failures:   %s\n", stats.Counts(r.FailuresBy))
+	}
+	fmt.Fprintf(w, "Versions:   %s\n", stats.Counts(r.Versions))
+	fmt.Fprintf(w, "Ciphers:    %s\n", stats.Counts(r.Ciphers))
+	if len(r.ALPN) > 0 {
+		fmt.Fprintf(w, "ALPN:       %s\n", stats.Counts(r.ALPN))
+	}
+	fmt.Fprint(w, "Connect    ")
+	r.Connect.Write(w, buckets)
+	fmt.Fprint(w, "Handshake  ")
+	r.Handshake.Write(w, buckets)
+}
@@ -0,0 +1,160 @@
+package tlsload
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"gonet/pkg/config"
+	"gonet/pkg/logging"
+	"gonet/pkg/results"
+	"gonet/pkg/stats"
+)
+
+// Main runs gonet tlsload with the arguments after the command name.
+func Main(args []string) {
+	// Command line flags
+	flags := flag.NewFlagSet("tlsload", flag.ExitOnError)
+	target := flags.String("target", "", "Server to connect to, host:port (or the first argument)")
+	sni := flags.String("sni", "", "Server name to send and verify (default the target's host)")
+	minVersion := flags.String("min-version", "", "Lowest TLS version to offer: 1.0, 1.1, 1.2 or 1.3")
+	maxVersion := flags.String("max-version", "", "Highest TLS version to offer: 1.0, 1.1, 1.2 or 1.3")
+	ciphers := flags.String("ciphers", "", "Comma separated cipher suites to offer for TLS 1.2 and older, by Go name")
+	alpn := flags.String("alpn", "", "Comma separated ALPN protocols to offer, like h2,http/1.1")
+	insecure := flags.Bool("insecure", false, "Skip certificate verification")
+	resume := flags.Bool("resume", false, "Keep sessions and resume them, to measure resumption")
+	probe := flags.Bool("probe", false, "Find the versions and cipher suites the server accepts instead of a load test")
+	concurrency := flags.Int("c", 10, "Handshakes in flight at most")
+	rate := flags.Float64("rate", 0, "Handshakes started per second at most (0 for no limit)")
+	duration := flags.Duration("duration", 0, "How long to open connections (default 10s unless -n is given)")
+	handshakes := flags.Uint64("n", 0, "Stop after this many handshakes")
+	timeout := flags.Duration("timeout", 5*time.Second, "Timeout of the connect and of the handshake")
+	histogram := flags.Bool("histogram", false, "Print the latency histograms")
+	report := stats.RegisterFlags(flags)
+	jsonOut := flags.String("json", "", "Write the result as JSON to this file when done, - for stdout")
+	logs := logging.RegisterFlags(flags)
+	configFile := flags.String("config", "", "YAML or JSON file setting flags by name, command line flags win")
+	flags.Parse(args)
+
+	if _, err := config.LoadFlags(flags, *configFile); err != nil {
+		log.Fatalf("Invalid -config: %v", err)
+	}
+	if err := logs.Setup(); err != nil {
+		log.Fatal(err)
+	}
+	if *target == "" && flags.NArg() > 0 {
+		*target = flags.Arg(0)
+	}
+	if *target == "" {
+		log.Fatal("Usage: gonet tlsload [flags] <host:port>")
+	}
+
+	cfg := Config{
+		Target:      *target,
+		ServerName:  *sni,
+		Insecure:    *insecure,
+		Resume:      *resume,
+		Concurrency: *concurrency,
+		Rate:        *rate,
+		Duration:    *duration,
+		Handshakes:  *handshakes,
+		Timeout:     *timeout,
+	}
+	var err error
+	if cfg.MinVersion, err = parseVersion(*minVersion); err != nil {
+		log.Fatalf("Invalid -min-version: %v", err)
+	}
+	if cfg.MaxVersion, err = parseVersion(*maxVersion); err != nil {
+		log.Fatalf("Invalid -max-version: %v", err)
+	}
+	if *ciphers != "" {
+		if cfg.CipherSuites, err = parseCiphers(*ciphers); err != nil {
+			log.Fatalf("Invalid -ciphers: %v", err)
+		}
+	}
+	if *alpn != "" {
+		cfg.ALPN = strings.Split(*alpn, ",")
+	}
+	if cfg.Duration == 0 && cfg.Handshakes == 0 {
+		cfg.Duration = 10 * time.Second
+	}
+
+	// Stop on interrupt
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	var out any
+	if *probe {
+		s, err := Probe(ctx, cfg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *jsonOut != "-" {
+			s.Write(os.Stdout)
+		}
+		out = s
+	} else {
+		var l Load
+		report.Unit = "Handshakes"
+		reporter, err := report.Reporter(l.Counters(), "Handshake", "completed", "tlsload")
+		if err != nil {
+			log.Fatal(err)
+		}
+		reporter.Start()
+		r, err := l.Run(ctx, cfg)
+		reporter.Stop()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *jsonOut != "-" {
+			r.Write(os.Stdout, *histogram)
+		}
+		out = r
+	}
+
+	if *jsonOut != "" {
+		if err := results.Write(*jsonOut, out); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// parseVersion parses a TLS version like 1.2, empty for none.
+func parseVersion(s string) (uint16, error) {
+	switch strings.TrimPrefix(strings.ToLower(s), "tls") {
+	case "":
+		return 0, nil
+	case "1.0", "1":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version %q", s)
+}
+
+// parseCiphers parses a comma separated list of cipher suite names.
+func parseCiphers(s string) ([]uint16, error) {
+	byName := map[string]uint16{}
+	for _, c := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		byName[c.Name] = c.ID
+	}
+	var ids []uint16
+	for _, name := range strings.Split(s, ",") {
+		id, ok := byName[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
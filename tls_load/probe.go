@@ -0,0 +1,100 @@
+package tlsload
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+)
+
+// versions are the protocol versions Probe tries, oldest first.
+var versions = []uint16{tls.VersionTLS10, tls.VersionTLS11, tls.VersionTLS12, tls.VersionTLS13}
+
+// VersionSupport is what a server accepts of a protocol version.
+type VersionSupport struct {
+	Version   string `json:"version"`
+	Supported bool   `json:"supported"`
+	Reason    string `json:"reason,omitempty"` // why not
+
+	// Ciphers are the suites the server accepts, one handshake each. TLS
+	// 1.3 suites can't be picked, so there it's the one negotiated.
+	Ciphers []string `json:"ciphers,omitempty"`
+}
+
+// Support is a Probe's findings.
+type Support struct {
+	Target   string           `json:"target"`
+	Versions []VersionSupport `json:"versions"`
+}
+
+// Probe finds the versions and cipher suites the server of cfg accepts,
+// one handshake at a time. cfg's version and cipher settings are
+// ignored.
+func Probe(ctx context.Context, cfg Config) (*Support, error) {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 5 * time.Second
+	}
+	cfg.Resume = false
+	base, err := clientConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	try := func(version uint16, suites []uint16) (tls.ConnectionState, error) {
+		tc := base.Clone()
+		tc.MinVersion, tc.MaxVersion, tc.CipherSuites = version, version, suites
+		h, err := dial(ctx, cfg, tc)
+		return h.state, err
+	}
+
+	s := &Support{Target: cfg.Target}
+	for _, v := range versions {
+		vs := VersionSupport{Version: tls.VersionName(v)}
+		state, err := try(v, nil)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			vs.Reason = reason(err)
+			s.Versions = append(s.Versions, vs)
+			continue
+		}
+		vs.Supported = true
+		if v == tls.VersionTLS13 {
+			vs.Ciphers = []string{tls.CipherSuiteName(state.CipherSuite)}
+			s.Versions = append(s.Versions, vs)
+			continue
+		}
+		for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+			if !slices.Contains(suite.SupportedVersions, v) {
+				continue
+			}
+			if _, err := try(v, []uint16{suite.ID}); err == nil {
+				vs.Ciphers = append(vs.Ciphers, suite.Name)
+			}
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+		}
+		s.Versions = append(s.Versions, vs)
+	}
+	return s, nil
+}
+
+// Write prints s for people.
+func (s *Support) Write(w io.Writer) {
+	fmt.Fprintf(w, "%s\n", s.Target)
+	for _, v := range s.Versions {
+		if !v.Supported {
+			fmt.Fprintf(w, "  %-8s no (%s)\n", v.Version, v.Reason)
+			continue
+		}
+		fmt.Fprintf(w, "  %-8s yes\n", v.Version)
+		if len(v.Ciphers) > 0 {
+			fmt.Fprintf(w, "    %s\n", strings.Join(v.Ciphers, "\n    "))
+		}
+	}
+}
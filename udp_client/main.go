@@ -1,243 +1,334 @@
-package main
+package udpclient
 
 import (
+	"context"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
-	"math/rand"
+	"log/slog"
 	"net"
 	"os"
 	"os/signal"
-	"sync"
-	"time"
-
-	"github.com/google/gopacket"
-	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
+	"strconv"
+	"strings"
+
+	"gonet/pkg/config"
+	"gonet/pkg/generator"
+	"gonet/pkg/ifaceutil"
+	"gonet/pkg/logging"
+	"gonet/pkg/results"
+	"gonet/pkg/scenario"
+	"gonet/pkg/session"
+	"gonet/pkg/stats"
 )
 
-func main() {
-	// Command line flags
-	interfaceName := flag.String("interface", "eth0", "Network interface to use")
-	destMAC := flag.String("destmac", "", "Destination MAC address (default: broadcast)")
-	destIP := flag.String("destip", "255.255.255.255", "Destination IP address")
-	srcIP := flag.String("srcip", "192.168.1.2", "Source IP address")
-	destPort := flag.Int("destport", 8125, "Destination UDP port")
-	srcPort := flag.Int("srcport", 12345, "Source UDP port")
-	pps := flag.Int("pps", 1000, "Packets per second to send")
-	payloadSize := flag.Int("size", 1400, "Payload size in bytes")
-	duration := flag.Duration("duration", 0, "Duration to send (0 for indefinite)")
-	reportInterval := flag.Int("report", 1, "Reporting interval in seconds")
-	flag.Parse()
+// target is an entry of the -config targets list, fields left out default
+// to -destmac, -destip and -destport.
+type target struct {
+	DestMAC  string `json:"destmac"`
+	DestIP   string `json:"destip"`
+	DestPort int    `json:"destport"`
+}
 
-	// List all available interfaces if none specified
-	if *interfaceName == "" {
-		devices, err := pcap.FindAllDevs()
+func (t target) resolve(cfg generator.Config) (generator.Target, error) {
+	gt := generator.Target{MAC: cfg.DstMAC, IP: cfg.DstIP, Port: cfg.DstPort}
+	if t.DestMAC != "" {
+		mac, err := net.ParseMAC(t.DestMAC)
 		if err != nil {
-			log.Fatalf("Failed to find devices: %v", err)
-		}
-		if len(devices) == 0 {
-			log.Fatal("No devices found.")
-		}
-		fmt.Println("Available devices:")
-		for _, device := range devices {
-			fmt.Printf("Name: %s\n", device.Name)
-			fmt.Printf("Description: %s\n", device.Description)
-			fmt.Println("Addresses:")
-			for _, address := range device.Addresses {
-				fmt.Printf("  IP: %s, Netmask: %s\n", address.IP, address.Netmask)
-			}
-			fmt.Println("-----------------------------------")
+			return gt, err
 		}
-		log.Fatal("Please specify an interface name with -interface")
+		gt.MAC = mac
 	}
+	if t.DestIP != "" {
+		if gt.IP = net.ParseIP(t.DestIP); gt.IP == nil {
+			return gt, fmt.Errorf("invalid IP address %s", t.DestIP)
+		}
+	}
+	if t.DestPort != 0 {
+		gt.Port = t.DestPort
+	}
+	return gt, nil
+}
 
-	// Open the device for sending
-	handle, err := pcap.OpenLive(*interfaceName, 1600, true, pcap.BlockForever)
+// Main runs gonet udp send with the arguments after the command name.
+func Main(args []string) {
+	// Command line flags
+	flags := flag.NewFlagSet("udp send", flag.ExitOnError)
+	interfaceName := flags.String("interface", "eth0", "Network interface to use, by name, IP address or subnet")
+	destMAC := flags.String("destmac", "", "Destination MAC address (default: broadcast)")
+	destIP := flags.String("destip", "255.255.255.255", "Destination IP address")
+	srcIP := flags.String("srcip", "192.168.1.2", "Source IP address")
+	destPort := flags.Int("destport", 8125, "Destination UDP port")
+	srcPort := flags.Int("srcport", 12345, "Source UDP port")
+	pps := flags.Int("pps", 1000, "Packets per second to send")
+	payloadSize := flags.Int("size", 1400, "Payload size in bytes")
+	duration := flags.Duration("duration", 0, "Duration to send (0 for indefinite)")
+	backend := flags.String("backend", "pcap", "How packets go out: pcap, or xdp for an AF_XDP socket on Linux reaching millions of small packets per second, falling back to pcap when it can't be set up")
+	queue := flags.Int("xdp-queue", 0, "NIC queue the xdp backend sends on")
+	protocol := flags.String("protocol", "", "Send well-formed time protocol messages instead of random payloads: ntp client requests, ptp-sync or ptp-delay-req; -destport defaults to the protocol's and PTP's -destip to 224.0.1.129, -size doesn't apply")
+	ptpDomain := flags.Uint("ptp-domain", 0, "With -protocol ptp-sync or ptp-delay-req, the PTP domain")
+	flowControl := flags.String("flowcontrol", "", "Send flow control frames instead of UDP: pause for 802.3x pause frames, pfc for priority flow control (-destmac default 01:80:c2:00:00:01)")
+	quanta := flags.Uint("quanta", 65535, "With -flowcontrol, how long the peer should pause in 512 bit times, 0 to resume it")
+	priorities := flags.String("priorities", "3", "With -flowcontrol pfc, comma separated priorities 0 to 7 to pause")
+	discoveryProto := flags.String("discovery", "", "Send discovery announcements instead of UDP: lldp, or cdp for Cisco Discovery Protocol (-destmac default their multicast address)")
+	chassisID := flags.String("chassis-id", "", "With -discovery, the chassis or CDP device ID (default: the source MAC)")
+	portID := flags.String("port-id", "", "With -discovery, the port ID (default: the interface name)")
+	ttl := flags.Uint("ttl", 120, "With -discovery, seconds neighbors keep the entry, 0 to withdraw it")
+	sysName := flags.String("sysname", "", "With -discovery lldp, the system name")
+	sysDesc := flags.String("sysdesc", "", "With -discovery, the system description or CDP software version")
+	portDesc := flags.String("portdesc", "", "With -discovery, the port description or CDP platform")
+	capabilities := flags.String("capabilities", "", "With -discovery, comma separated capabilities: other, repeater, bridge, switch, ap, router, telephone, docsis, station")
+	mgmtIP := flags.String("mgmt-ip", "", "With -discovery, the management address")
+	var tlvs []generator.TLV
+	flags.Func("tlv", "With -discovery, an extra TLV as type=hex value, repeatable, like 127=0080c201000a for an LLDP port VLAN ID of 10", func(s string) error {
+		typ, value, ok := strings.Cut(s, "=")
+		if !ok {
+			return errors.New("want type=hex value")
+		}
+		t, err := strconv.ParseUint(typ, 0, 16)
+		if err != nil {
+			return err
+		}
+		v, err := hex.DecodeString(strings.ReplaceAll(value, ":", ""))
+		if err != nil {
+			return err
+		}
+		tlvs = append(tlvs, generator.TLV{Type: uint16(t), Value: v})
+		return nil
+	})
+	report := stats.RegisterFlags(flags)
+	record := results.RegisterFlags(flags)
+	logs := logging.RegisterFlags(flags)
+	configFile := flags.String("config", "", "YAML or JSON file setting flags by name and a targets list, command line flags win")
+	server := flags.String("server", "", "Run a coordinated test against gonet udp recv -control at this host:port and print the merged report (-duration default 10s)")
+	sequence := flags.Bool("seq", false, "Number the packets so the receiver can report loss, reordering and latency")
+	hops := flags.Int("trailer", 0, "Append a telemetry trailer with this many hop slots to the payloads, for the devices on the path to stamp and gonet udp recv -trailer to report the delay of each hop (0 for none)")
+	scenarioFile := flags.String("scenario", "", "With -server, run the phases of this YAML or JSON file and report pass or fail per phase")
+	flags.Parse(args)
+
+	sections, err := config.LoadFlags(flags, *configFile, "targets")
 	if err != nil {
-		log.Fatalf("Failed to open device %s: %v", *interfaceName, err)
+		log.Fatalf("Invalid -config: %v", err)
 	}
-	defer handle.Close()
-
-	// Get interface information
-	iface, err := net.InterfaceByName(*interfaceName)
+	if err := logs.Setup(); err != nil {
+		log.Fatal(err)
+	}
+	rec, err := record.Recorder(flags)
 	if err != nil {
-		log.Fatalf("Failed to get interface %s: %v", *interfaceName, err)
+		log.Fatal(err)
 	}
 
-	// Get source MAC address from the interface
-	srcMAC := iface.HardwareAddr
-
-	// Set destination MAC address
-	var dstMAC net.HardwareAddr
-	if *destMAC == "" {
-		// Use broadcast MAC address if not specified
-		dstMAC, _ = net.ParseMAC("ff:ff:ff:ff:ff:ff")
-	} else {
-		dstMAC, err = net.ParseMAC(*destMAC)
-		if err != nil {
-			log.Fatalf("Invalid MAC address format: %v", err)
+	// List all available interfaces if none specified
+	if *interfaceName == "" {
+		if err := ifaceutil.ListDevices(os.Stdout); err != nil {
+			log.Fatal(err)
 		}
+		log.Fatal("Please specify an interface name with -interface")
 	}
-
-	// Parse source and destination IP addresses
-	srcIPAddr := net.ParseIP(*srcIP)
-	if srcIPAddr == nil {
-		log.Fatalf("Invalid source IP address: %s", *srcIP)
+	device, err := ifaceutil.Resolve(*interfaceName)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	dstIPAddr := net.ParseIP(*destIP)
-	if dstIPAddr == nil {
-		log.Fatalf("Invalid destination IP address: %s", *destIP)
+	cfg := generator.Config{
+		Interface: device,
+		SrcPort:   *srcPort,
+		DstPort:   *destPort,
+		PPS:       *pps,
+		Size:      *payloadSize,
+		Duration:  *duration,
+		Sequence:  *sequence,
+		Trailer:   *hops,
+		Backend:   *backend,
+		Queue:     *queue,
 	}
-
-	// Create random payload
-	payload := make([]byte, *payloadSize)
-	rand.Read(payload)
-
-	// Create packet layers
-	eth := layers.Ethernet{
-		SrcMAC:       srcMAC,
-		DstMAC:       dstMAC,
-		EthernetType: layers.EthernetTypeIPv4,
+	if *protocol != "" {
+		set := map[string]bool{}
+		flags.Visit(func(f *flag.Flag) { set[f.Name] = true })
+		if *ptpDomain > 255 {
+			log.Fatalf("Invalid -ptp-domain %d, want 0 to 255", *ptpDomain)
+		}
+		cfg.TimeProto = &generator.TimeProto{Protocol: *protocol, Domain: uint8(*ptpDomain)}
+		switch *protocol {
+		case generator.NTPRequest:
+			if !set["destport"] {
+				cfg.DstPort = generator.NTPPort
+			}
+		case generator.PTPSync, generator.PTPDelayReq:
+			if !set["destport"] {
+				cfg.DstPort = generator.PTPEventPort
+			}
+			if !set["destip"] {
+				*destIP = generator.PTPMulticast.String()
+				if !set["destmac"] {
+					*destMAC = generator.PTPMulticastMAC.String()
+				}
+			}
+		default:
+			log.Fatalf("Unknown -protocol %q, want ntp, ptp-sync or ptp-delay-req", *protocol)
+		}
+		cfg.Size, _ = cfg.TimeProto.Size()
 	}
-
-	ip := layers.IPv4{
-		Version:  4,
-		TTL:      64,
-		Protocol: layers.IPProtocolUDP,
-		SrcIP:    srcIPAddr,
-		DstIP:    dstIPAddr,
+	switch *flowControl {
+	case "":
+	case "pause", "pfc":
+		if *server != "" || *scenarioFile != "" {
+			log.Fatal("-flowcontrol can't be used with -server or -scenario")
+		}
+		if *quanta > 65535 {
+			log.Fatalf("Invalid -quanta %d, want 0 to 65535", *quanta)
+		}
+		cfg.Pause = &generator.Pause{PFC: *flowControl == "pfc", Quanta: uint16(*quanta)}
+		if cfg.Pause.PFC {
+			for _, p := range strings.Split(*priorities, ",") {
+				prio, err := strconv.Atoi(strings.TrimSpace(p))
+				if err != nil {
+					log.Fatalf("Invalid -priorities: %v", err)
+				}
+				cfg.Pause.Priorities = append(cfg.Pause.Priorities, prio)
+			}
+		}
+	default:
+		log.Fatalf("Unknown -flowcontrol %q, want pause or pfc", *flowControl)
 	}
-
-	udp := layers.UDP{
-		SrcPort: layers.UDPPort(*srcPort),
-		DstPort: layers.UDPPort(*destPort),
+	switch *discoveryProto {
+	case "":
+	case "lldp", "cdp":
+		if *server != "" || *scenarioFile != "" || cfg.Pause != nil {
+			log.Fatal("-discovery can't be used with -server, -scenario or -flowcontrol")
+		}
+		if *ttl > 65535 {
+			log.Fatalf("Invalid -ttl %d, want 0 to 65535", *ttl)
+		}
+		cfg.Discovery = &generator.Discovery{
+			CDP:        *discoveryProto == "cdp",
+			ChassisID:  *chassisID,
+			PortID:     *portID,
+			TTL:        uint16(*ttl),
+			SystemName: *sysName,
+			SystemDesc: *sysDesc,
+			PortDesc:   *portDesc,
+			TLVs:       tlvs,
+		}
+		if *capabilities != "" {
+			cfg.Discovery.Capabilities = strings.Split(*capabilities, ",")
+		}
+		if *mgmtIP != "" {
+			if cfg.Discovery.MgmtIP = net.ParseIP(*mgmtIP); cfg.Discovery.MgmtIP == nil {
+				log.Fatalf("Invalid management IP address: %s", *mgmtIP)
+			}
+		}
+	default:
+		log.Fatalf("Unknown -discovery %q, want lldp or cdp", *discoveryProto)
 	}
-
-	// Set checksum for UDP layer
-	err = udp.SetNetworkLayerForChecksum(&ip)
-	if err != nil {
-		log.Fatalf("Failed to set network layer for checksum: %v", err)
+	if *destMAC != "" {
+		cfg.DstMAC, err = net.ParseMAC(*destMAC)
+		if err != nil {
+			log.Fatalf("Invalid MAC address format: %v", err)
+		}
 	}
-
-	// Create serializer and buffer
-	opts := gopacket.SerializeOptions{
-		FixLengths:       true,
-		ComputeChecksums: true,
+	if cfg.SrcIP = net.ParseIP(*srcIP); cfg.SrcIP == nil {
+		log.Fatalf("Invalid source IP address: %s", *srcIP)
 	}
-
-	// Create serialization buffer
-	buf := gopacket.NewSerializeBuffer()
-
-	// Signal handling for graceful shutdown
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, os.Interrupt)
-
-	// Variables for statistics
-	var mu sync.Mutex
-	var packetsSent uint64 = 0
-	var bytesSent uint64 = 0
-	startTime := time.Now()
-
-	// Create a stop channel
-	stopChan := make(chan struct{})
-
-	// Start reporter
-	go func() {
-		ticker := time.NewTicker(time.Duration(*reportInterval) * time.Second)
-		defer ticker.Stop()
-
-		var lastPackets uint64 = 0
-		var lastBytes uint64 = 0
-
-		for {
-			select {
-			case <-ticker.C:
-				mu.Lock()
-				currentPackets := packetsSent
-				currentBytes := bytesSent
-				intervalPackets := currentPackets - lastPackets
-				intervalBytes := currentBytes - lastBytes
-				lastPackets = currentPackets
-				lastBytes = currentBytes
-				mu.Unlock()
-
-				elapsedSec := time.Since(startTime).Seconds()
-				bitrate := float64(intervalBytes) * 8 / float64(*reportInterval) / 1_000_000 // Mbps
-				avgPacketRate := float64(currentPackets) / elapsedSec
-
-				fmt.Printf("Outgoing bitrate: %.2f Mbps | Packets: %d (%.2f pps avg) | Total sent: %.2f MB\n",
-					bitrate, intervalPackets, avgPacketRate, float64(currentBytes)/1_000_000)
-
-			case <-stopChan:
-				return
+	if cfg.DstIP = net.ParseIP(*destIP); cfg.DstIP == nil {
+		log.Fatalf("Invalid destination IP address: %s", *destIP)
+	}
+	if sections["targets"] != nil {
+		var targets []target
+		if err := config.Decode(sections["targets"], &targets); err != nil {
+			log.Fatalf("Invalid targets in %s: %v", *configFile, err)
+		}
+		for i, t := range targets {
+			gt, err := t.resolve(cfg)
+			if err != nil {
+				log.Fatalf("Invalid target %d in %s: %v", i+1, *configFile, err)
 			}
+			cfg.Targets = append(cfg.Targets, gt)
 		}
-	}()
+	}
 
-	// Packet sender
-	go func() {
-		// Calculate sleep duration for rate limiting
-		sleepDuration := time.Duration(1000000/(*pps)) * time.Microsecond
+	// Stop on interrupt
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
 
-		endTime := time.Time{}
-		if *duration > 0 {
-			endTime = startTime.Add(*duration)
+	if *scenarioFile != "" {
+		if *server == "" {
+			log.Fatal("-scenario needs -server")
 		}
-
-		for {
-			select {
-			case <-stopChan:
-				return
-			default:
-				// Check if we've exceeded the duration
-				if *duration > 0 && time.Now().After(endTime) {
-					close(stopChan)
-					return
-				}
-
-				// Serialize the packet with payload
-				err = gopacket.SerializeLayers(buf, opts,
-					&eth, &ip, &udp, gopacket.Payload(payload))
-				if err != nil {
-					log.Printf("Failed to serialize packet: %v", err)
-					continue
-				}
-
-				// Send the packet
-				packetData := buf.Bytes()
-				err = handle.WritePacketData(packetData)
-				if err != nil {
-					log.Printf("Failed to send packet: %v", err)
-					continue
+		sc, err := scenario.Load(*scenarioFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// One file or Prometheus listener can't be shared by the phases,
+		// they report as text.
+		cl := session.Client{Reporter: func(c *stats.Counters) (*stats.Reporter, error) {
+			return stats.NewReporter(c, report.Interval, &stats.TextSink{W: os.Stdout, Direction: "Outgoing", Verb: "sent"}), nil
+		}}
+		phases := scenario.Run(ctx, &cl, *server, cfg, sc)
+		scenario.Write(os.Stdout, phases)
+		// The phase checks are the assertions and a failed phase the
+		// run's error.
+		metrics := map[string]float64{}
+		var failed error
+		for _, p := range phases {
+			for _, c := range p.Checks {
+				rec.Assert(results.Assertion{Metric: p.Name + "." + c.Metric, Condition: c.Condition, Detail: c.Value, Pass: c.Pass})
+			}
+			if p.Report != nil {
+				for name, v := range p.Report.Metrics() {
+					metrics[p.Name+"."+name] = v
 				}
-
-				mu.Lock()
-				packetsSent++
-				bytesSent += uint64(len(packetData))
-				mu.Unlock()
-
-				// Sleep to maintain packet rate
-				time.Sleep(sleepDuration)
 			}
+			if p.Error != "" && failed == nil {
+				failed = fmt.Errorf("phase %s: %s", p.Name, p.Error)
+			}
+		}
+		rec.Set(metrics)
+		if _, err := rec.Finish(phases, failed); err != nil {
+			log.Fatal(err)
 		}
-	}()
+		if !scenario.Passed(phases) {
+			os.Exit(1)
+		}
+		return
+	}
 
-	// Wait for interrupt
-	<-sigChan
-	fmt.Println("\nShutting down...")
-	close(stopChan)
+	report.Sinks = append(report.Sinks, rec)
+	if *server != "" {
+		cl := session.Client{Reporter: func(c *stats.Counters) (*stats.Reporter, error) {
+			return report.Reporter(c, "Outgoing", "sent", "udp_send")
+		}}
+		r, err := cl.Run(ctx, *server, cfg)
+		if err != nil {
+			rec.Finish(nil, err)
+			log.Fatalf("Test against %s failed: %v", *server, err)
+		}
+		r.Write(os.Stdout)
+		rec.Set(r.Metrics())
+		if _, err := rec.Finish(r, nil); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
-	// Final statistics
-	time.Sleep(200 * time.Millisecond)
-	elapsedSec := time.Since(startTime).Seconds()
-	mu.Lock()
-	finalPackets := packetsSent
-	finalBytes := bytesSent
-	mu.Unlock()
+	var g generator.Generator
+	reporter, err := report.Reporter(g.Counters(), "Outgoing", "sent", "udp_send")
+	if err != nil {
+		log.Fatal(err)
+	}
+	reporter.Start()
 
-	avgBitrate := float64(finalBytes) * 8 / elapsedSec / 1_000_000
-	fmt.Printf("\nTotal packets: %d | Total bytes: %.2f MB | Avg bitrate: %.2f Mbps | Duration: %.2f sec\n",
-		finalPackets, float64(finalBytes)/1_000_000, avgBitrate, elapsedSec)
+	err = g.Run(ctx, cfg)
+	if ctx.Err() != nil {
+		slog.Info("Shutting down")
+	}
+	reporter.Stop()
+	if _, ferr := rec.Finish(nil, err); err == nil {
+		err = ferr
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
 }
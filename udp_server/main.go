@@ -1,178 +1,256 @@
-package main
+package udpserver
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
+	"net"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
 	"time"
 
-	"github.com/google/gopacket"
-	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
+	"gonet/pkg/capture"
+	"gonet/pkg/config"
+	"gonet/pkg/flowexport"
+	"gonet/pkg/ifaceutil"
+	"gonet/pkg/logging"
+	"gonet/pkg/results"
+	"gonet/pkg/session"
+	"gonet/pkg/stats"
 )
 
-func main() {
+// Main runs gonet udp recv with the arguments after the command name.
+func Main(args []string) {
 	// Command line flags
-	interfaceName := flag.String("interface", "eth0", "Network interface to listen on")
-	port := flag.Int("port", 8125, "UDP port to listen for")
-	promiscuous := flag.Bool("promisc", true, "Put interface in promiscuous mode")
-	reportInterval := flag.Int("report", 1, "Reporting interval in seconds")
-	flag.Parse()
+	flags := flag.NewFlagSet("udp recv", flag.ExitOnError)
+	interfaceName := flags.String("interface", "eth0", "Network interface to listen on, by name, IP address or subnet")
+	port := flags.Int("port", 8125, "UDP port to listen for")
+	promiscuous := flags.Bool("promisc", true, "Put interface in promiscuous mode")
+	report := stats.RegisterFlags(flags)
+	record := results.RegisterFlags(flags)
+	logs := logging.RegisterFlags(flags)
+	configFile := flags.String("config", "", "YAML or JSON file setting flags by name, command line flags win")
+	control := flags.String("control", "", "Accept coordinated tests from gonet udp send -server on this TCP address, e.g. :5201, each capturing the port it asks for")
+	sequence := flags.Bool("seq", false, "Read the sequence numbers of gonet udp send -seq and report loss, reordering and latency when done")
+	trailerFlag := flags.Bool("trailer", false, "Read the telemetry trailers of gonet udp send -trailer and report the delay of each hop the devices on the path stamped when done")
+	backend := flags.String("backend", "pcap", "How packets come in: pcap, or xdp for an AF_XDP socket per receive queue on Linux, counting far higher rates, falling back to pcap when it can't be set up")
+	heatmap := flags.Int("heatmap", 0, "With -seq, print a loss heatmap of this many periods per flow when done, or with -control per test (0 for none)")
+	heatmapOut := flags.String("heatmap-out", "", "With -seq, also write the loss heatmaps to this file, JSON if it ends in .json and CSV otherwise (-heatmap default 60)")
+	flowCollector := flags.String("flow-export", "", "Export the UDP flows seen to this NetFlow, IPFIX or sFlow collector host:port")
+	flowFormat := flags.String("flow-format", flowexport.IPFIX, "Flow export format: netflow9, ipfix or sflow for packet samples")
+	flowInterval := flags.Duration("flow-interval", 10*time.Second, "How often NetFlow and IPFIX records of the traffic since the last ones go out")
+	sflowRate := flags.Int("sflow-rate", 100, "Packets per sFlow sample")
+	flags.Parse(args)
+
+	if _, err := config.LoadFlags(flags, *configFile); err != nil {
+		log.Fatalf("Invalid -config: %v", err)
+	}
+	if err := logs.Setup(); err != nil {
+		log.Fatal(err)
+	}
+	rec, err := record.Recorder(flags)
+	if err != nil {
+		log.Fatal(err)
+	}
+	report.Sinks = append(report.Sinks, rec)
 
 	// List all available interfaces
-	devices, err := pcap.FindAllDevs()
+	if err := ifaceutil.ListDevices(os.Stdout); err != nil {
+		log.Fatal(err)
+	}
+
+	// Ask for an interface if none specified
+	if *interfaceName == "" {
+		log.Fatal("Please specify an interface name with -interface")
+	}
+	device, err := ifaceutil.Resolve(*interfaceName)
 	if err != nil {
-		log.Fatalf("Failed to find devices: %v", err)
+		log.Fatal(err)
 	}
 
-	if len(devices) == 0 {
-		log.Fatal("No devices found.")
+	// Stop on interrupt
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if *heatmapOut != "" && *heatmap <= 0 {
+		*heatmap = 60
 	}
+	var heatmaps []*capture.Heatmap
 
-	fmt.Println("Available devices:")
-	for _, device := range devices {
-		fmt.Printf("Name: %s\n", device.Name)
-		fmt.Printf("Description: %s\n", device.Description)
-		// fmt.Println("Addresses:")
-		// for _, address := range device.Addresses {
-		// 	fmt.Printf("  IP: %s, Netmask: %s\n", address.IP, address.Netmask)
-		// }
-		fmt.Println("-----------------------------------")
+	var flows *capture.FlowTable
+	stopExport := func() {}
+	if *flowCollector != "" {
+		cfg := flowexport.Config{Collector: *flowCollector, Format: *flowFormat, Interval: *flowInterval, SampleRate: *sflowRate}
+		if ifi, err := ifaceutil.Lookup(device); err == nil {
+			cfg.IfIndex = ifi.Index
+		}
+		if flows, stopExport, err = startExport(cfg); err != nil {
+			log.Fatalf("Invalid -flow-export: %v", err)
+		}
 	}
 
-	// List all available interfaces if none specified
-	if *interfaceName == "" {
-		devices, err := pcap.FindAllDevs()
+	if *control != "" {
+		ln, err := net.Listen("tcp", *control)
 		if err != nil {
-			log.Fatalf("Failed to find devices: %v", err)
+			log.Fatalf("Failed to listen for tests: %v", err)
 		}
-		if len(devices) == 0 {
-			log.Fatal("No devices found.")
+		slog.Info("Waiting for tests", "addr", ln.Addr())
+		// The run's result is every test the server captured.
+		var mu sync.Mutex
+		var tests []*session.Report
+		srv := session.Server{
+			Interface:   device,
+			Promiscuous: *promiscuous,
+			Backend:     *backend,
+			Flows:       flows,
+			Heatmap:     *heatmap,
+			// One file or Prometheus listener can't be shared by the
+			// tests, they report as text.
+			Reporter: func(c *stats.Counters) (*stats.Reporter, error) {
+				return stats.NewReporter(c, report.Interval, &stats.TextSink{W: os.Stdout, Direction: "Incoming", Verb: "received"}), nil
+			},
+			Reports: func(r *session.Report) {
+				r.Write(os.Stdout)
+				mu.Lock()
+				tests = append(tests, r)
+				if r.Heatmap != nil {
+					heatmaps = append(heatmaps, r.Heatmap)
+				}
+				mu.Unlock()
+			},
 		}
-		fmt.Println("Available devices:")
-		for _, device := range devices {
-			fmt.Printf("Name: %s\n", device.Name)
-			fmt.Printf("Description: %s\n", device.Description)
-			fmt.Println("Addresses:")
-			for _, address := range device.Addresses {
-				fmt.Printf("  IP: %s, Netmask: %s\n", address.IP, address.Netmask)
+		err = srv.Serve(ctx, ln)
+		stopExport()
+		mu.Lock()
+		if *heatmapOut != "" {
+			if herr := writeHeatmaps(*heatmapOut, heatmaps); herr != nil {
+				slog.Error("Failed to write heatmaps", "err", herr)
 			}
-			fmt.Println("-----------------------------------")
 		}
-		log.Fatal("Please specify an interface name with -interface")
+		rec.Set(map[string]float64{"tests": float64(len(tests))})
+		_, ferr := rec.Finish(tests, err)
+		mu.Unlock()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if ferr != nil {
+			log.Fatal(ferr)
+		}
+		return
 	}
 
-	// Set up pcap capture
-	handle, err := pcap.OpenLive(*interfaceName, 65536, *promiscuous, pcap.BlockForever)
+	var c capture.Capture
+	reporter, err := report.Reporter(c.Counters(), "Incoming", "received", "udp_recv")
 	if err != nil {
-		log.Fatalf("Failed to open device %s: %v", *interfaceName, err)
+		log.Fatal(err)
 	}
-	defer handle.Close()
+	reporter.Start()
 
-	// Set filter to capture only UDP packets on the specified port
-	filter := fmt.Sprintf("udp and port %d", *port)
-	err = handle.SetBPFFilter(filter)
+	start := time.Now()
+	err = c.Run(ctx, capture.Config{Interface: device, Port: *port, Promiscuous: *promiscuous, Sequence: *sequence, Trailer: *trailerFlag, Backend: *backend, Flows: flows})
+	if ctx.Err() != nil {
+		slog.Info("Shutting down")
+	}
+	reporter.Stop()
+	stopExport()
 	if err != nil {
-		log.Fatalf("Failed to set BPF filter: %v", err)
+		rec.Finish(nil, err)
+		log.Fatal(err)
 	}
 
-	// Create packet source
-	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
-
-	// Signal handling for graceful shutdown
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, os.Interrupt)
-
-	// Variables for statistics
-	var mu sync.Mutex
-	var packetsReceived uint64 = 0
-	var bytesReceived uint64 = 0
-	startTime := time.Now()
-
-	// Create a stop channel
-	stopChan := make(chan struct{})
-
-	// Start reporter
-	go func() {
-		ticker := time.NewTicker(time.Duration(*reportInterval) * time.Second)
-		defer ticker.Stop()
-
-		var lastPackets uint64 = 0
-		var lastBytes uint64 = 0
-
-		for {
-			select {
-			case <-ticker.C:
-				mu.Lock()
-				currentPackets := packetsReceived
-				currentBytes := bytesReceived
-				intervalPackets := currentPackets - lastPackets
-				intervalBytes := currentBytes - lastBytes
-				lastPackets = currentPackets
-				lastBytes = currentBytes
-				mu.Unlock()
-
-				elapsedSec := time.Since(startTime).Seconds()
-				bitrate := float64(intervalBytes) * 8 / float64(*reportInterval) / 1_000_000 // Mbps
-				avgPacketRate := float64(currentPackets) / elapsedSec
-
-				fmt.Printf("Incoming bitrate: %.2f Mbps | Packets: %d (%.2f pps avg) | Total received: %.2f MB\n",
-					bitrate, intervalPackets, avgPacketRate, float64(currentBytes)/1_000_000)
+	if queues := c.Queues(); len(queues) > 0 {
+		var dropped uint64
+		for _, q := range queues {
+			fmt.Printf("Queue %d:   %d packets, %d bytes, dropped %d (ring full %d, fill ring empty %d)\n", q.Queue, q.Packets, q.Bytes, q.Dropped, q.RingFull, q.FillEmpty)
+			dropped += q.Dropped
+		}
+		rec.Set(map[string]float64{"xdp_queues": float64(len(queues)), "xdp_dropped": float64(dropped)})
+	}
 
-			case <-stopChan:
-				return
+	var result any
+	if *sequence || *trailerFlag {
+		packets, bytes := c.Stats()
+		r := &session.Report{Elapsed: time.Since(start), Received: session.Counts{Packets: packets, Bytes: bytes}}
+		if *sequence {
+			seq := c.Sequence()
+			r.Sequence, r.Heatmap = &seq, c.Heatmap(*heatmap)
+		}
+		if *trailerFlag {
+			t := c.Trailer()
+			r.Trailer = &t
+		}
+		r.Merge()
+		r.Write(os.Stdout)
+		if *heatmapOut != "" && r.Heatmap != nil {
+			if err := writeHeatmaps(*heatmapOut, []*capture.Heatmap{r.Heatmap}); err != nil {
+				rec.Finish(nil, err)
+				log.Fatal(err)
 			}
 		}
-	}()
+		rec.Set(r.Metrics())
+		result = r
+	}
+	if _, err := rec.Finish(result, nil); err != nil {
+		log.Fatal(err)
+	}
+}
 
-	// Start packet processing
+// startExport starts exporting the flows of the table it returns to the
+// collector; stop sends what is left and waits for it.
+func startExport(cfg flowexport.Config) (table *capture.FlowTable, stop func(), err error) {
+	exp, err := flowexport.New(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	table = exp.Table()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
 	go func() {
-		for {
-			select {
-			case packet := <-packetSource.Packets():
-				// Process packet
-				if packet == nil {
-					continue
-				}
-
-				// Calculate packet size
-				packetSize := len(packet.Data())
-
-				// Extract UDP layer if needed for more detailed info
-				udpLayer := packet.Layer(layers.LayerTypeUDP)
-				if udpLayer != nil {
-					udp, _ := udpLayer.(*layers.UDP)
-					_ = udp // Can be used for additional info if needed
-				}
-
-				mu.Lock()
-				packetsReceived++
-				bytesReceived += uint64(packetSize)
-				mu.Unlock()
-
-			case <-stopChan:
-				return
-			}
-		}
+		exp.Run(ctx, table)
+		close(done)
 	}()
+	return table, func() {
+		cancel()
+		<-done
+	}, nil
+}
 
-	// Wait for interrupt
-	<-sigChan
-	fmt.Println("\nShutting down...")
-	close(stopChan)
-
-	// Final statistics
-	time.Sleep(200 * time.Millisecond)
-	elapsedSec := time.Since(startTime).Seconds()
-	mu.Lock()
-	finalPackets := packetsReceived
-	finalBytes := bytesReceived
-	mu.Unlock()
-
-	avgBitrate := float64(finalBytes) * 8 / elapsedSec / 1_000_000
-	fmt.Printf("\nTotal packets: %d | Total bytes: %.2f MB | Avg bitrate: %.2f Mbps | Duration: %.2f sec\n",
-		finalPackets, float64(finalBytes)/1_000_000, avgBitrate, elapsedSec)
+// writeHeatmaps writes heatmaps to path, as a JSON list if it ends in
+// .json and as CSV otherwise.
+func writeHeatmaps(path string, heatmaps []*capture.Heatmap) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if strings.HasSuffix(path, ".json") {
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(heatmaps); err != nil {
+			return err
+		}
+		return f.Close()
+	}
+	var buf bytes.Buffer
+	for i, h := range heatmaps {
+		buf.Reset()
+		if err := h.WriteCSV(&buf); err != nil {
+			return err
+		}
+		data := buf.Bytes()
+		if i > 0 {
+			// One header line.
+			_, data, _ = bytes.Cut(data, []byte("\n"))
+		}
+		if _, err := f.Write(data); err != nil {
+			return err
+		}
+	}
+	return f.Close()
 }